@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// autocert only supports the TLS-ALPN-01 and HTTP-01 challenges, both of which
+// require the ACME server to reach the enclave.  The DNS-01 challenge doesn't,
+// and it's the only challenge that allows for wildcard certificates, so we
+// implement it ourselves on top of golang.org/x/crypto/acme.
+const (
+	dnsProviderRoute53    = "route53"
+	dnsProviderCloudflare = "cloudflare"
+	dnsProviderRFC2136    = "rfc2136"
+
+	acmeDNSTimeout       = 10 * time.Minute
+	acmeDNSRetryInterval = time.Minute
+	acmeChallengeLabel   = "_acme-challenge."
+	// acmeDNSRecordTTL is the TTL of the TXT records that we create.
+	acmeDNSRecordTTL = 60
+)
+
+var (
+	errCfgBadACMEDNS = errors.New("given config has invalid DNS-01 settings")
+
+	// dnsPropagationDelay determines how long we wait after creating our TXT
+	// records before we ask the ACME server to validate them.  Using a
+	// variable allows us to skip the wait in our unit tests.
+	dnsPropagationDelay = 10 * time.Second
+)
+
+// dnsProvider creates and deletes the TXT records of DNS-01 challenges.  All
+// values of a given name are set at once because a certificate for both a
+// domain and its wildcard requires two records of the same name.
+type dnsProvider interface {
+	setTXT(ctx context.Context, name string, values []string) error
+	deleteTXT(ctx context.Context, name string, values []string) error
+}
+
+// validateACMEDNS returns an error if the config's DNS-01 settings are
+// incomplete for the configured DNS provider.
+func (c *Config) validateACMEDNS() error {
+	if c.ACMEDNSProvider == "" {
+		if c.ACMEWildcard {
+			return fmt.Errorf("%w: wildcard certificates require a DNS provider", errCfgBadACMEDNS)
+		}
+		return nil
+	}
+	if !c.UseACME {
+		return fmt.Errorf("%w: DNS provider requires ACME", errCfgBadACMEDNS)
+	}
+	if c.ACMEDNSZone == "" {
+		return fmt.Errorf("%w: missing DNS zone", errCfgBadACMEDNS)
+	}
+	switch c.ACMEDNSProvider {
+	case dnsProviderRoute53:
+	case dnsProviderCloudflare:
+		if c.ACMEDNSSecret == "" {
+			return fmt.Errorf("%w: Cloudflare requires an API token", errCfgBadACMEDNS)
+		}
+	case dnsProviderRFC2136:
+		if _, _, err := net.SplitHostPort(c.ACMEDNSServer); err != nil {
+			return fmt.Errorf("%w: bad name server: %v", errCfgBadACMEDNS, err)
+		}
+		if c.ACMEDNSKeyName == "" || c.ACMEDNSSecret == "" {
+			return fmt.Errorf("%w: RFC 2136 requires a TSIG key name and secret", errCfgBadACMEDNS)
+		}
+		if !isSecretRef(c.ACMEDNSSecret) {
+			if _, err := base64.StdEncoding.DecodeString(c.ACMEDNSSecret); err != nil {
+				return fmt.Errorf("%w: TSIG secret is not Base64-encoded", errCfgBadACMEDNS)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unknown DNS provider %q", errCfgBadACMEDNS, c.ACMEDNSProvider)
+	}
+	return nil
+}
+
+// newDNSProvider returns the DNS provider that the given config asks for.
+// Secret references in the config must already be resolved.
+func newDNSProvider(c *Config) (dnsProvider, error) {
+	switch c.ACMEDNSProvider {
+	case dnsProviderRoute53:
+		return &route53Provider{zoneID: c.ACMEDNSZone}, nil
+	case dnsProviderCloudflare:
+		return newCloudflareProvider(c.ACMEDNSZone, c.ACMEDNSSecret), nil
+	case dnsProviderRFC2136:
+		secret, err := base64.StdEncoding.DecodeString(c.ACMEDNSSecret)
+		if err != nil {
+			return nil, fmt.Errorf("%w: TSIG secret is not Base64-encoded", errCfgBadACMEDNS)
+		}
+		return &rfc2136Provider{
+			server:  c.ACMEDNSServer,
+			zone:    c.ACMEDNSZone,
+			keyName: c.ACMEDNSKeyName,
+			secret:  secret,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown DNS provider %q", errCfgBadACMEDNS, c.ACMEDNSProvider)
+}
+
+// acmeDomains returns the domains that our certificate covers.
+func (c *Config) acmeDomains() []string {
+	if c.ACMEWildcard {
+		return []string{c.FQDN, "*." + c.FQDN}
+	}
+	return []string{c.FQDN}
+}
+
+// obtainCertDNS01 obtains a certificate for the given domains from the given
+// ACME client, solving DNS-01 challenges via the given DNS provider.
+func obtainCertDNS01(ctx context.Context, client *acme.Client, p dnsProvider, domains []string) (*tls.Certificate, error) {
+	if _, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil &&
+		!errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ACME order: %w", err)
+	}
+
+	// Collect the challenges of all pending authorizations, and group their
+	// TXT records by name.
+	var (
+		challenges []*acme.Challenge
+		authzURLs  []string
+		records    = make(map[string][]string)
+	)
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("ACME server offers no DNS-01 challenge for %s", z.Identifier.Value)
+		}
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		name := acmeChallengeLabel + strings.TrimPrefix(z.Identifier.Value, "*.") + "."
+		records[name] = append(records[name], value)
+		challenges = append(challenges, chal)
+		authzURLs = append(authzURLs, z.URI)
+	}
+
+	for name, values := range records {
+		if err := p.setTXT(ctx, name, values); err != nil {
+			return nil, fmt.Errorf("failed to create TXT record %s: %w", name, err)
+		}
+		defer func(name string, values []string) {
+			// Our context may have expired, so we use a fresh one.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := p.deleteTXT(ctx, name, values); err != nil {
+				elog.Warn("Failed to delete TXT record.", "name", name, "error", err)
+			}
+		}(name, values)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(dnsPropagationDelay):
+	}
+
+	for i, chal := range challenges {
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, fmt.Errorf("failed to accept DNS-01 challenge: %w", err)
+		}
+		if _, err := client.WaitAuthorization(ctx, authzURLs[i]); err != nil {
+			return nil, fmt.Errorf("DNS-01 challenge failed: %w", err)
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: domains}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize ACME order: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// setupAcmeDNS obtains an HTTPS certificate in the background by solving
+// DNS-01 challenges, and renews the certificate after two thirds of its
+// lifetime.  Until we have a certificate, TLS handshakes fail.
+func (e *Enclave) setupAcmeDNS() error {
+	p, err := newDNSProvider(e.cfg)
+	if err != nil {
+		return err
+	}
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: acme.LetsEncryptURL, HTTPClient: outboundHTTPClient}
+	if e.cfg.ACMEDirectoryURL != "" {
+		elog.Info("Using custom ACME directory.", "url", e.cfg.ACMEDirectoryURL)
+		client.DirectoryURL = e.cfg.ACMEDirectoryURL
+	}
+
+	e.extPubSrv.TLSConfig = &tls.Config{GetCertificate: e.httpsCert.get}
+	e.setTLSMinVersion()
+	e.extPrivSrv.TLSConfig = e.extPubSrv.TLSConfig.Clone()
+	if e.cfg.ACMETempCert {
+		temp, err := e.newTempCert()
+		if err != nil {
+			return err
+		}
+		e.httpsCert.set(temp)
+	}
+
+	go func() {
+		defer reportPanic()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), acmeDNSTimeout)
+			ctx, span := startSpan(ctx, "acme.obtain_certificate")
+			span.setAttr("fqdn", e.cfg.FQDN)
+			cert, err := obtainCertDNS01(ctx, client, p, e.cfg.acmeDomains())
+			span.setError(err)
+			span.end()
+			cancel()
+
+			wait := acmeDNSRetryInterval
+			if err != nil {
+				elog.Warn("Failed to obtain certificate via DNS-01.", "provider", e.cfg.ACMEDNSProvider, "error", err)
+			} else {
+				e.setACMECert(cert)
+				wait = max(time.Until(cert.Leaf.NotAfter)*2/3, acmeDNSRetryInterval)
+			}
+			select {
+			case <-e.stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+	return nil
+}
+
+// setACMECert starts serving the given certificate, and embeds its
+// fingerprint in our attestation documents.
+func (e *Enclave) setACMECert(cert *tls.Certificate) {
+	var chain []byte
+	for _, der := range cert.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := e.setCertFingerprint(chain); err != nil {
+		elog.Error("Failed to set certificate fingerprint.", "error", err)
+		return
+	}
+	e.httpsCert.set(cert)
+	e.swappedInACMECert()
+	ops.certRenewals.Add(1)
+	elog.Info("Obtained certificate via DNS-01.", "domains", cert.Leaf.DNSNames, "expires", cert.Leaf.NotAfter)
+}
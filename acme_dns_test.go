@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// fakeDNSProvider records the TXT records that it's asked to set and delete.
+type fakeDNSProvider struct {
+	sync.Mutex
+	records map[string][]string
+	deleted map[string][]string
+}
+
+func newFakeDNSProvider() *fakeDNSProvider {
+	return &fakeDNSProvider{
+		records: make(map[string][]string),
+		deleted: make(map[string][]string),
+	}
+}
+
+func (p *fakeDNSProvider) setTXT(_ context.Context, name string, values []string) error {
+	p.Lock()
+	defer p.Unlock()
+	p.records[name] = values
+	return nil
+}
+
+func (p *fakeDNSProvider) deleteTXT(_ context.Context, name string, values []string) error {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.records, name)
+	p.deleted[name] = values
+	return nil
+}
+
+// mockACME returns a minimal RFC 8555 server that offers DNS-01 challenges
+// for the given domains, marks authorizations as valid once their challenge
+// is accepted, and issues certificates for the CSRs that it receives.  The
+// server doesn't verify JWS signatures.
+func mockACME(t *testing.T, domains []string) *httptest.Server {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	failOnErr(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mock ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	failOnErr(t, err)
+
+	var (
+		mu    sync.Mutex
+		valid = make(map[int]bool)
+		chain []byte
+		srv   *httptest.Server
+	)
+	mux := http.NewServeMux()
+	reply := func(w http.ResponseWriter, code int, v any) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	payload := func(r *http.Request, v any) error {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			return err
+		}
+		b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, v)
+	}
+	order := func(status string) map[string]any {
+		var authzs []string
+		for i := range domains {
+			authzs = append(authzs, fmt.Sprintf("%s/authz/%d", srv.URL, i))
+		}
+		o := map[string]any{
+			"status":         status,
+			"authorizations": authzs,
+			"finalize":       srv.URL + "/finalize",
+		}
+		if status == acme.StatusValid {
+			o["certificate"] = srv.URL + "/cert"
+		}
+		return o
+	}
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, map[string]string{
+			"newNonce":   srv.URL + "/nonce",
+			"newAccount": srv.URL + "/account",
+			"newOrder":   srv.URL + "/order",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", srv.URL+"/account/1")
+		reply(w, http.StatusCreated, map[string]string{"status": acme.StatusValid})
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", srv.URL+"/order/1")
+		reply(w, http.StatusCreated, order(acme.StatusPending))
+	})
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		status := acme.StatusReady
+		if chain != nil {
+			status = acme.StatusValid
+		}
+		reply(w, http.StatusOK, order(status))
+	})
+	mux.HandleFunc("/authz/", func(w http.ResponseWriter, r *http.Request) {
+		var i int
+		_, _ = fmt.Sscanf(r.URL.Path, "/authz/%d", &i)
+		mu.Lock()
+		status := acme.StatusPending
+		if valid[i] {
+			status = acme.StatusValid
+		}
+		mu.Unlock()
+		reply(w, http.StatusOK, map[string]any{
+			"status": status,
+			"identifier": map[string]string{
+				"type":  "dns",
+				"value": strings.TrimPrefix(domains[i], "*."),
+			},
+			"wildcard": strings.HasPrefix(domains[i], "*."),
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": fmt.Sprintf("%s/chal/http/%d", srv.URL, i), "token": "http"},
+				{"type": "dns-01", "url": fmt.Sprintf("%s/chal/%d", srv.URL, i), "token": fmt.Sprintf("tok-%d", i)},
+			},
+		})
+	})
+	mux.HandleFunc("/chal/", func(w http.ResponseWriter, r *http.Request) {
+		var i int
+		_, _ = fmt.Sscanf(r.URL.Path, "/chal/%d", &i)
+		mu.Lock()
+		valid[i] = true
+		mu.Unlock()
+		reply(w, http.StatusOK, map[string]string{"type": "dns-01", "status": acme.StatusValid})
+	})
+	mux.HandleFunc("/finalize", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		failOnErr(t, payload(r, &req))
+		der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		failOnErr(t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		failOnErr(t, err)
+		leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, caTmpl, csr.PublicKey, caKey)
+		failOnErr(t, err)
+
+		mu.Lock()
+		chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+		mu.Unlock()
+		w.Header().Set("Location", srv.URL+"/order/1")
+		reply(w, http.StatusOK, order(acme.StatusValid))
+	})
+	mux.HandleFunc("/cert", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(chain)
+	})
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestValidateACMEDNS(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("tsig secret"))
+	cases := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"disabled", Config{}, false},
+		{"wildcard without provider", Config{UseACME: true, ACMEWildcard: true}, true},
+		{"provider without ACME", Config{ACMEDNSProvider: dnsProviderRoute53, ACMEDNSZone: "Z1"}, true},
+		{"missing zone", Config{UseACME: true, ACMEDNSProvider: dnsProviderRoute53}, true},
+		{"route53", Config{UseACME: true, ACMEDNSProvider: dnsProviderRoute53, ACMEDNSZone: "Z1", ACMEWildcard: true}, false},
+		{"cloudflare without token", Config{UseACME: true, ACMEDNSProvider: dnsProviderCloudflare, ACMEDNSZone: "zone"}, true},
+		{"cloudflare", Config{UseACME: true, ACMEDNSProvider: dnsProviderCloudflare, ACMEDNSZone: "zone", ACMEDNSSecret: "token"}, false},
+		{"rfc2136 bad server", Config{UseACME: true, ACMEDNSProvider: dnsProviderRFC2136, ACMEDNSZone: "example.com",
+			ACMEDNSServer: "ns.example.com", ACMEDNSKeyName: "key", ACMEDNSSecret: secret}, true},
+		{"rfc2136 without key", Config{UseACME: true, ACMEDNSProvider: dnsProviderRFC2136, ACMEDNSZone: "example.com",
+			ACMEDNSServer: "ns.example.com:53"}, true},
+		{"rfc2136 bad secret", Config{UseACME: true, ACMEDNSProvider: dnsProviderRFC2136, ACMEDNSZone: "example.com",
+			ACMEDNSServer: "ns.example.com:53", ACMEDNSKeyName: "key", ACMEDNSSecret: "not base64!"}, true},
+		{"rfc2136 secret ref", Config{UseACME: true, ACMEDNSProvider: dnsProviderRFC2136, ACMEDNSZone: "example.com",
+			ACMEDNSServer: "ns.example.com:53", ACMEDNSKeyName: "key", ACMEDNSSecret: "asm://prod/tsig"}, false},
+		{"rfc2136", Config{UseACME: true, ACMEDNSProvider: dnsProviderRFC2136, ACMEDNSZone: "example.com",
+			ACMEDNSServer: "ns.example.com:53", ACMEDNSKeyName: "key", ACMEDNSSecret: secret}, false},
+		{"unknown provider", Config{UseACME: true, ACMEDNSProvider: "bind", ACMEDNSZone: "example.com"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.cfg.validateACMEDNS()
+			assertEqual(t, err != nil, c.wantErr)
+			if err != nil {
+				assertEqual(t, errors.Is(err, errCfgBadACMEDNS), true)
+			}
+		})
+	}
+}
+
+func TestObtainCertDNS01(t *testing.T) {
+	origDelay := dnsPropagationDelay
+	dnsPropagationDelay = 0
+	defer func() { dnsPropagationDelay = origDelay }()
+
+	c := &Config{FQDN: "example.com", ACMEWildcard: true}
+	domains := c.acmeDomains()
+	srv := mockACME(t, domains)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	failOnErr(t, err)
+	client := &acme.Client{Key: key, DirectoryURL: srv.URL + "/directory"}
+	p := newFakeDNSProvider()
+
+	cert, err := obtainCertDNS01(context.Background(), client, p, domains)
+	failOnErr(t, err)
+	assertEqual(t, strings.Join(cert.Leaf.DNSNames, ","), "example.com,*.example.com")
+	assertEqual(t, len(cert.Certificate), 2)
+
+	// Both challenges must have shared a single TXT record set, which we
+	// must have deleted after validation.
+	var want []string
+	for i := range domains {
+		v, err := client.DNS01ChallengeRecord(fmt.Sprintf("tok-%d", i))
+		failOnErr(t, err)
+		want = append(want, v)
+	}
+	assertEqual(t, len(p.records), 0)
+	assertEqual(t, strings.Join(p.deleted["_acme-challenge.example.com."], ","), strings.Join(want, ","))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeTempRetryInterval determines how long we wait before we ask the ACME
+// server for our certificate again.
+const acmeTempRetryInterval = 30 * time.Second
+
+var errCfgTempCertNoACME = errors.New("given config has temporary certificate but doesn't use ACME")
+
+// acmeCertEvent is the event that we emit when we swap our temporary
+// certificate for our ACME certificate.
+type acmeCertEvent struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	FQDN        string    `json:"fqdn"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// newTempCert creates the self-signed certificate that we serve until we have
+// our ACME certificate, and embeds its fingerprint in our attestation
+// documents.  Unlike our ACME certificate, the temporary certificate doesn't
+// meet the application's "cert" prerequisite.
+func (e *Enclave) newTempCert() (*tls.Certificate, error) {
+	cert, key, err := createCertificate(e.cfg.FQDN)
+	if err != nil {
+		return nil, err
+	}
+	tlsCert, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	if e.cfg.MockCertFp == "" {
+		fingerprint, err := leafFingerprint(cert)
+		if err != nil {
+			return nil, err
+		}
+		e.hashes.setTLSKeyHash(fingerprint)
+	}
+	elog.Info("Serving temporary self-signed certificate until we have our ACME certificate.")
+	return &tlsCert, nil
+}
+
+// withTempCert returns a GetCertificate function that serves the given
+// temporary certificate until we have our ACME certificate, after which it
+// defers to the given function.  ACME's TLS-ALPN-01 challenges always go to
+// the given function.
+func (e *Enclave) withTempCert(
+	temp *tls.Certificate,
+	get func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if e.acmeCertReady.Load() || slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return get(hello)
+		}
+		return temp, nil
+	}
+}
+
+// requestACMECert asks the given manager for our certificate, which makes the
+// manager obtain the certificate from the ACME server.  Without a temporary
+// certificate, the first client's TLS handshake does that, but clients
+// don't reach the manager while we serve our temporary certificate.
+func (e *Enclave) requestACMECert(m *autocert.Manager) {
+	defer reportPanic()
+	// Mimic a client that supports ECDSA, so we obtain an ECDSA certificate,
+	// like for most real clients.
+	hello := &tls.ClientHelloInfo{
+		ServerName:       e.cfg.FQDN,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	for {
+		_, err := m.GetCertificate(hello)
+		if err == nil {
+			return
+		}
+		elog.Warn("Failed to obtain ACME certificate.  Retrying.", "error", err, "delay", acmeTempRetryInterval)
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(acmeTempRetryInterval):
+		}
+	}
+}
+
+// swappedInACMECert records that we replaced our temporary certificate with
+// our ACME certificate, and forwards an event about it to our event sink, if
+// we have one.  Renewals of the ACME certificate don't emit events.
+func (e *Enclave) swappedInACMECert() {
+	if !e.cfg.ACMETempCert || !e.acmeCertReady.CompareAndSwap(false, true) {
+		return
+	}
+	hash := e.hashes.getTLSKeyHash()
+	fingerprint := hex.EncodeToString(hash[:])
+	elog.Info("Swapped temporary certificate for ACME certificate.", "fingerprint", fingerprint)
+	if e.events == nil {
+		return
+	}
+	// Marshalling a struct of strings and times cannot fail.
+	raw, _ := json.Marshal(&acmeCertEvent{
+		Type:        "nitriding.acme_cert_issued",
+		Time:        time.Now().UTC(),
+		FQDN:        e.cfg.FQDN,
+		Fingerprint: fingerprint,
+	})
+	if err := e.events.enqueue(raw); err != nil {
+		elog.Warn("Failed to forward certificate event.", "error", err)
+	}
+}
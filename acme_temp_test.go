@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/pem"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestLeafFingerprint(t *testing.T) {
+	cert, _, err := createCertificate("example.com")
+	failOnErr(t, err)
+	block, _ := pem.Decode(cert)
+
+	fingerprint, err := leafFingerprint(cert)
+	failOnErr(t, err)
+	assertEqual(t, fingerprint, sha256.Sum256(block.Bytes))
+
+	_, err = leafFingerprint([]byte("not PEM"))
+	assertEqual(t, err != nil, true)
+}
+
+func TestTempCert(t *testing.T) {
+	c := defaultCfg
+	c.UseACME, c.ACMETempCert, c.MockCertFp = true, true, ""
+	e := createEnclave(&c)
+
+	temp, err := e.newTempCert()
+	failOnErr(t, err)
+	fingerprint, err := leafFingerprint(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: temp.Certificate[0]}))
+	failOnErr(t, err)
+	assertEqual(t, e.hashes.tlsKeyHash, fingerprint)
+	// The application keeps waiting for the ACME certificate.
+	stop := make(chan struct{})
+	close(stop)
+	assertEqual(t, e.startup.wait([]string{appPrereqCert}, stop), false)
+
+	acmeCert := &tls.Certificate{}
+	get := e.withTempCert(temp, func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return acmeCert, nil
+	})
+	hello := &tls.ClientHelloInfo{ServerName: c.FQDN}
+	challenge := &tls.ClientHelloInfo{ServerName: c.FQDN, SupportedProtos: []string{acme.ALPNProto}}
+
+	cert, _ := get(hello)
+	assertEqual(t, cert, temp)
+	// ACME challenges must reach the ACME certificate manager.
+	cert, _ = get(challenge)
+	assertEqual(t, cert, acmeCert)
+
+	e.swappedInACMECert()
+	cert, _ = get(hello)
+	assertEqual(t, cert, acmeCert)
+}
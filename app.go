@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// The minimum and maximum delay before we restart a crashed enclave
+	// application.  The delay doubles with each crash.
+	minAppRestartDelay = time.Second
+	maxAppRestartDelay = time.Minute
+	// If the application ran for at least appHealthyAfter before it crashed,
+	// we reset the restart delay to its minimum.
+	appHealthyAfter = time.Minute
+	// The default time that the application has to exit after we sent it
+	// SIGTERM, before we kill it.
+	defaultAppStopTimeout = 10 * time.Second
+	// We split longer lines of the application's output into several log
+	// messages.
+	maxAppLineLen = 16 * 1024
+
+	// The prerequisites that the enclave application can wait for before we
+	// start it.
+	appPrereqCert    = "cert"    // We have a TLS certificate.
+	appPrereqKeys    = "keys"    // We have our key material, e.g., from our leader.
+	appPrereqTime    = "time"    // We synchronized our clock via Roughtime or the host.
+	appPrereqSVID    = "svid"    // We obtained an SVID from SPIRE.
+	appPrereqVault   = "vault"   // We logged in to Vault.
+	appPrereqSecrets = "secrets" // We have the secrets that we inject.
+
+	// The restart policies of application processes.
+	appRestartOnFailure = "on-failure" // Restart after crashes.
+	appRestartAlways    = "always"     // Also restart after exit code 0.
+	appRestartNever     = "never"      // Never restart.
+
+	maxAppCPUWeight = 10000
+)
+
+var (
+	errCfgEmptyAppCmd    = errors.New("given config contains empty application command")
+	errCfgSeccompAppCmd  = errors.New("given config combines seccomp filter with application command")
+	errCfgPrereqsNoApp   = errors.New("given config has application prerequisites but no application command")
+	errCfgBadAppPrereq   = errors.New("given config has unknown or unavailable application prerequisite")
+	errCfgAppPrereqCycle = errors.New("given config makes application wait for ACME certificate that requires application's readiness")
+	errCfgAppCmdAndApps  = errors.New("given config combines application command with application processes")
+	errCfgBadApp         = errors.New("given config has invalid application process")
+	errCfgBadAppLimits   = errors.New("given config has invalid application resource limits")
+	errNoCgroups         = errors.New("kernel doesn't support cgroup v2")
+
+	// appProcNameRegexp matches the names of application processes.
+	appProcNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+)
+
+// appSpec describes an application process that we supervise.
+type appSpec struct {
+	name    string
+	cmd     string
+	after   []string // The processes that we start before this one.
+	restart string   // The restart policy.
+}
+
+// parseAppSpec parses the given application process of the form
+// <name>[?after=<name>&restart=<policy>]:<command>.
+func parseAppSpec(s string) (*appSpec, error) {
+	bad := func(reason string) error {
+		return fmt.Errorf("%w: %q %s", errCfgBadApp, s, reason)
+	}
+	head, cmd, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, bad("is not of the form <name>:<command>")
+	}
+	name, rawQuery, _ := strings.Cut(head, "?")
+	if !appProcNameRegexp.MatchString(name) {
+		return nil, bad("has invalid name")
+	}
+	if len(strings.Fields(cmd)) == 0 {
+		return nil, bad("has empty command")
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, bad(err.Error())
+	}
+	spec := &appSpec{name: name, cmd: cmd, after: q["after"], restart: q.Get("restart")}
+	switch spec.restart {
+	case "":
+		spec.restart = appRestartOnFailure
+	case appRestartOnFailure, appRestartAlways, appRestartNever:
+	default:
+		return nil, bad("has unknown restart policy")
+	}
+	return spec, nil
+}
+
+// runsApp returns true if we run the enclave application.
+func (c *Config) runsApp() bool {
+	return c.AppCmd != "" || len(c.Apps) > 0
+}
+
+// appSpecs returns the application processes that we run, in the order in
+// which we start them, i.e., each process after the processes that it
+// depends on.  AppCmd is a single process that we restart on failure.
+func (c *Config) appSpecs() ([]*appSpec, error) {
+	if c.AppCmd != "" {
+		return []*appSpec{{name: appName(c.AppCmd), cmd: c.AppCmd, restart: appRestartOnFailure}}, nil
+	}
+	var specs []*appSpec
+	names := make(map[string]bool)
+	for _, a := range c.Apps {
+		spec, err := parseAppSpec(a)
+		if err != nil {
+			return nil, err
+		}
+		if names[spec.name] {
+			return nil, fmt.Errorf("%w: duplicate name %s", errCfgBadApp, spec.name)
+		}
+		names[spec.name] = true
+		specs = append(specs, spec)
+	}
+	for _, spec := range specs {
+		for _, dep := range spec.after {
+			if !names[dep] {
+				return nil, fmt.Errorf("%w: %s depends on unknown process %s", errCfgBadApp, spec.name, dep)
+			}
+		}
+	}
+
+	// We repeatedly start the first process whose dependencies we started,
+	// which keeps the configured order where possible.
+	ordered := make([]*appSpec, 0, len(specs))
+	started := make(map[string]bool)
+	for len(ordered) < len(specs) {
+		progress := false
+		for _, spec := range specs {
+			if started[spec.name] || !allStarted(spec.after, started) {
+				continue
+			}
+			ordered = append(ordered, spec)
+			started[spec.name] = true
+			progress = true
+		}
+		if !progress {
+			return nil, fmt.Errorf("%w: dependency cycle", errCfgBadApp)
+		}
+	}
+	return ordered, nil
+}
+
+// allStarted returns true if the given map contains all given names.
+func allStarted(names []string, started map[string]bool) bool {
+	for _, n := range names {
+		if !started[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// validateAppCmd returns an error if the config contains application
+// commands that we cannot run.  The application would inherit our seccomp
+// filter, which doesn't permit it to start.
+func (c *Config) validateAppCmd() error {
+	if !c.runsApp() {
+		if len(c.AppPrereqs) > 0 {
+			return errCfgPrereqsNoApp
+		}
+		if c.AppMaxAddrSpaceMiB > 0 || c.AppMaxFiles > 0 || c.AppCPUWeight > 0 {
+			return fmt.Errorf("%w: no application command", errCfgBadAppLimits)
+		}
+		return nil
+	}
+	if c.AppCmd != "" && len(c.Apps) > 0 {
+		return errCfgAppCmdAndApps
+	}
+	if c.AppCmd != "" && len(strings.Fields(c.AppCmd)) == 0 {
+		return errCfgEmptyAppCmd
+	}
+	if _, err := c.appSpecs(); err != nil {
+		return err
+	}
+	if c.Seccomp {
+		return errCfgSeccompAppCmd
+	}
+	if c.AppCPUWeight > maxAppCPUWeight {
+		return fmt.Errorf("%w: CPU weight exceeds %d", errCfgBadAppLimits, maxAppCPUWeight)
+	}
+	// Unprivileged processes cannot start processes in other cgroups.
+	if c.AppCPUWeight > 0 && c.UID != 0 {
+		return fmt.Errorf("%w: CPU weight requires nitriding to keep root privileges", errCfgBadAppLimits)
+	}
+	available := map[string]bool{
+		appPrereqCert:    true,
+		appPrereqKeys:    true,
+		appPrereqTime:    c.isTimeSyncEnabled(),
+		appPrereqSVID:    c.SpireServer != "",
+		appPrereqVault:   c.VaultAddr != "",
+		appPrereqSecrets: len(c.AppSecretInject) > 0,
+	}
+	for _, p := range c.AppPrereqs {
+		if !available[p] {
+			return fmt.Errorf("%w: %q", errCfgBadAppPrereq, p)
+		}
+		if p == appPrereqCert && c.acmeNeedsPublicSrv() && c.WaitForApp {
+			return errCfgAppPrereqCycle
+		}
+	}
+	return nil
+}
+
+// acmeNeedsPublicSrv returns true if we obtain our certificate via an ACME
+// challenge that our public Web server answers.
+func (c *Config) acmeNeedsPublicSrv() bool {
+	return c.UseACME && c.ACMEDNSProvider == ""
+}
+
+// appPrereqs returns the prerequisites that the enclave application waits
+// for.  Unless the config says otherwise, the application waits for our
+// certificate and key material.  If the public Web server waits for the
+// application, it cannot answer ACME challenges, so the application cannot
+// wait for an ACME certificate.  The application always waits for the
+// secrets that we inject into it.
+func (c *Config) appPrereqs() []string {
+	var prereqs []string
+	switch {
+	case len(c.AppPrereqs) > 0:
+		prereqs = slices.Clone(c.AppPrereqs)
+	case c.acmeNeedsPublicSrv() && c.WaitForApp:
+		prereqs = []string{appPrereqKeys}
+	default:
+		prereqs = []string{appPrereqCert, appPrereqKeys}
+	}
+	if len(c.AppSecretInject) > 0 && !slices.Contains(prereqs, appPrereqSecrets) {
+		prereqs = append(prereqs, appPrereqSecrets)
+	}
+	return prereqs
+}
+
+// startupBarrier keeps track of the prerequisites that we met during
+// startup, so the enclave application doesn't race us.
+type startupBarrier struct {
+	sync.Mutex
+	met map[string]chan struct{}
+}
+
+func newStartupBarrier() *startupBarrier {
+	return &startupBarrier{met: make(map[string]chan struct{})}
+}
+
+// get returns the channel that we close once the given prerequisite is met.
+// The caller must hold the lock.
+func (b *startupBarrier) get(prereq string) chan struct{} {
+	c, exists := b.met[prereq]
+	if !exists {
+		c = make(chan struct{})
+		b.met[prereq] = c
+	}
+	return c
+}
+
+// markMet records that the given prerequisite is met.  Prerequisites remain
+// met, e.g., when we later fail to renew our SVID.
+func (b *startupBarrier) markMet(prereq string) {
+	b.Lock()
+	defer b.Unlock()
+
+	c := b.get(prereq)
+	select {
+	case <-c:
+	default:
+		close(c)
+		elog.Info("Met prerequisite of enclave application.", "prerequisite", prereq)
+	}
+}
+
+// wait blocks until all given prerequisites are met, and returns true, or
+// until the given channel is closed, and returns false.
+func (b *startupBarrier) wait(prereqs []string, stop <-chan struct{}) bool {
+	for _, p := range prereqs {
+		b.Lock()
+		c := b.get(p)
+		b.Unlock()
+		select {
+		case <-c:
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
+
+// appLimits contains the resource limits of each of the enclave application's
+// processes, so a leak in the application cannot exhaust the enclave's fixed
+// memory and take us down with it.
+type appLimits struct {
+	maxAddrSpace uint64   // In bytes.
+	maxFiles     uint64   // Open files.
+	cgroup       *os.File // The cgroup with the application's CPU weight, if any.
+}
+
+// newAppLimits returns the application's resource limits.  If the config sets
+// a CPU weight, we create the application's cgroup, which requires root
+// privileges.  Without cgroup v2, we run the application without a weight.
+func newAppLimits(c *Config) *appLimits {
+	l := &appLimits{maxAddrSpace: c.AppMaxAddrSpaceMiB << 20, maxFiles: c.AppMaxFiles}
+	if c.AppCPUWeight > 0 {
+		cgroup, err := newAppCgroup(c.AppCPUWeight)
+		if err != nil {
+			elog.Warn("Running enclave application without CPU weight.", "error", err)
+		} else {
+			l.cgroup = cgroup
+		}
+	}
+	return l
+}
+
+// appProcess is an application process that we supervise.
+type appProcess struct {
+	spec        *appSpec
+	stop        chan struct{} // Closed to stop the process.
+	started     chan struct{} // Closed once the process started.
+	exited      chan struct{} // Closed once the process exited for good.
+	startedOnce sync.Once
+}
+
+func newAppProcess(spec *appSpec) *appProcess {
+	return &appProcess{
+		spec:    spec,
+		stop:    make(chan struct{}),
+		started: make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+}
+
+// markStarted records that the process started.
+func (p *appProcess) markStarted() {
+	p.startedOnce.Do(func() {
+		close(p.started)
+	})
+}
+
+// superviseApp runs the enclave application's processes in the order of
+// their dependencies: we start a process once the processes that it depends
+// on started.  Once our shutdown sequence stops the application, we stop the
+// processes in reverse order, so each process can rely on its dependencies
+// until it exited.  If the application fails its health checks, we restart
+// all of its processes the same way.  We close appExited when all processes
+// exited for good, e.g., with exit code 0 or because we stopped.
+func (e *Enclave) superviseApp() {
+	defer reportPanic()
+	defer close(e.appExited)
+
+	prereqs := e.cfg.appPrereqs()
+	elog.Info("Waiting for prerequisites of enclave application.", "prerequisites", prereqs)
+	if !e.startup.wait(prereqs, e.appStop) {
+		return
+	}
+	for e.runAppProcesses() {
+		ops.appRestarts.Add(1)
+		elog.Warn("Restarting unhealthy enclave application.")
+	}
+}
+
+// runAppProcesses starts the enclave application's processes, and returns
+// false once they exited for good or because we stopped, or true once we
+// stopped them because the application failed its health checks.
+func (e *Enclave) runAppProcesses() bool {
+	// The config is valid, so its processes are too.
+	specs, _ := e.cfg.appSpecs()
+	var procs []*appProcess
+	stopAll := func() {
+		for i := len(procs) - 1; i >= 0; i-- {
+			close(procs[i].stop)
+			<-procs[i].exited
+		}
+	}
+	for _, spec := range specs {
+		p := newAppProcess(spec)
+		procs = append(procs, p)
+		go e.superviseProcess(p)
+		// If the process never starts, we eventually start its dependents
+		// without it.
+		select {
+		case <-p.started:
+		case <-p.exited:
+		case <-e.appStop:
+			stopAll()
+			return false
+		}
+	}
+
+	unhealthy, stopProbe := make(chan struct{}, 1), make(chan struct{})
+	defer close(stopProbe)
+	if e.cfg.probesApp() {
+		go e.probeApp(stopProbe, unhealthy)
+	}
+	allExited := make(chan struct{})
+	go func() {
+		for _, p := range procs {
+			<-p.exited
+		}
+		close(allExited)
+	}()
+	select {
+	case <-allExited:
+		elog.Info("All enclave application processes exited.")
+	case <-e.appStop:
+		stopAll()
+		elog.Info("Enclave application stopped.")
+	case <-unhealthy:
+		stopAll()
+		return true
+	}
+	return false
+}
+
+// superviseProcess runs the given application process, and restarts it with
+// exponential backoff according to its restart policy.  We close the
+// process's exited channel when the process exited for good.
+func (e *Enclave) superviseProcess(p *appProcess) {
+	defer reportPanic()
+	defer close(p.exited)
+	defer p.markStarted()
+
+	name := p.spec.name
+	stdout, stderr := appOutputLogger(name, "stdout"), appOutputLogger(name, "stderr")
+	delay := minAppRestartDelay
+	for {
+		started := time.Now()
+		var env []string
+		var err error
+		if len(e.cfg.AppSecretInject) > 0 {
+			env, err = e.appSecrets.inject()
+		}
+		if err == nil {
+			err = runAppCommand(p.spec.cmd, env, e.appLimits, p.stop, e.cfg.AppStopTimeout, p.markStarted, stdout, stderr)
+		}
+		select {
+		case <-p.stop:
+			elog.Info("Enclave application process stopped.", "app", name)
+			return
+		default:
+		}
+		switch {
+		case err == nil && p.spec.restart != appRestartAlways:
+			elog.Info("Enclave application process exited.", "app", name)
+			return
+		case err != nil && p.spec.restart == appRestartNever:
+			elog.Error("Enclave application process crashed.  Not restarting.", "app", name, "error", err)
+			return
+		}
+
+		ops.appRestarts.Add(1)
+		if time.Since(started) >= appHealthyAfter {
+			delay = minAppRestartDelay
+		}
+		if err != nil {
+			elog.Error("Enclave application process crashed.  Restarting.", "app", name, "error", err, "delay", delay)
+		} else {
+			elog.Info("Enclave application process exited.  Restarting.", "app", name, "delay", delay)
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxAppRestartDelay)
+	}
+}
+
+// appName returns the name of the given command's executable, which tags the
+// application's output in our logs.
+func appName(appCmd string) string {
+	return filepath.Base(strings.Fields(appCmd)[0])
+}
+
+// appOutputLogger returns a function that logs lines of the given
+// application's output stream.  The lines go through our regular logging
+// pipeline, so they reach our log shipper and crash reports, both of which
+// work outside debug mode.
+func appOutputLogger(name, stream string) func(string) {
+	return func(line string) {
+		elog.Info(line, "app", name, "stream", stream)
+	}
+}
+
+// runAppCommand (i) runs the given command, (ii) waits until the command
+// finished execution, and (iii) in the meanwhile passes the command's stdout
+// and stderr to the given functions.  The command runs in the given
+// environment, or in ours if it's nil, and within the given resource limits,
+// unless they're nil.  We call the given function, unless it's nil, once the
+// command started.  If the given stop channel is closed, we send the command
+// SIGTERM, and kill it if it doesn't exit within the given timeout.
+func runAppCommand(
+	appCmd string,
+	env []string,
+	limits *appLimits,
+	stop <-chan struct{},
+	stopTimeout time.Duration,
+	onStart func(),
+	stdoutFunc, stderrFunc func(string),
+) error {
+	elog.Info("Invoking the enclave application.")
+	args := strings.Fields(appCmd)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	if limits != nil && limits.cgroup != nil {
+		startInCgroup(cmd, limits.cgroup)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// We can only limit the process once it exists, i.e., right after it
+	// started executing the command.
+	if limits != nil {
+		if err := limitProcess(cmd.Process.Pid, limits.maxAddrSpace, limits.maxFiles); err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return err
+		}
+	}
+	if onStart != nil {
+		onStart()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		forwardOutput(stderr, stderrFunc, "stderr")
+	}()
+	go func() {
+		defer wg.Done()
+		forwardOutput(stdout, stdoutFunc, "stdout")
+	}()
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-exited:
+			return
+		case <-stop:
+		}
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(stopTimeout):
+			elog.Warn("Enclave application didn't exit in time.  Killing it.")
+			_ = cmd.Process.Kill()
+		}
+	}()
+
+	// Wait closes the pipes, so we must finish reading from them first.
+	wg.Wait()
+	return cmd.Wait()
+}
+
+// forwardOutput continuously reads from the given Reader until an EOF occurs.
+// Each newly read line is passed to the given function f.
+func forwardOutput(readCloser io.ReadCloser, f func(string), output string) {
+	scanner := bufio.NewScanner(readCloser)
+	scanner.Split(scanAppLines)
+	for scanner.Scan() {
+		f(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		elog.Error("Error reading from enclave application.", "output", output, "error", err)
+		// Keep draining the pipe, so the application doesn't block on it.
+		_, _ = io.Copy(io.Discard, readCloser)
+	}
+}
+
+// scanAppLines works like bufio.ScanLines, except that it splits lines that
+// are longer than maxAppLineLen, so long lines neither exhaust our scanner's
+// buffer nor stall the application.
+func scanAppLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance == 0 && err == nil && len(data) >= maxAppLineLen {
+		return maxAppLineLen, data[:maxAppLineLen], nil
+	}
+	return advance, token, err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAppHealthInterval = 10 * time.Second
+	defaultAppHealthTimeout  = 5 * time.Second
+	defaultAppHealthFailures = 3
+)
+
+var (
+	errCfgBadAppHealth = errors.New("given config has invalid application health check")
+	errAppNotReady     = errors.New("enclave application is not ready")
+)
+
+// appHealthEvent is the event that we emit when we restart the enclave
+// application because it failed its health checks.
+type appHealthEvent struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error"`
+}
+
+// validateAppHealth returns an error if the config's application health check
+// is invalid.
+func (c *Config) validateAppHealth() error {
+	if c.AppHealthURL == "" && c.AppHealthCmd == "" {
+		return nil
+	}
+	if !c.runsApp() {
+		return fmt.Errorf("%w: no application command", errCfgBadAppHealth)
+	}
+	if c.AppHealthURL != "" && c.AppHealthCmd != "" {
+		return fmt.Errorf("%w: both URL and command are set", errCfgBadAppHealth)
+	}
+	if c.AppHealthURL != "" {
+		u, err := url.Parse(c.AppHealthURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: %q is no HTTP URL", errCfgBadAppHealth, c.AppHealthURL)
+		}
+	}
+	if c.AppHealthCmd != "" && len(strings.Fields(c.AppHealthCmd)) == 0 {
+		return fmt.Errorf("%w: empty command", errCfgBadAppHealth)
+	}
+	if c.AppHealthInterval < 0 || c.AppHealthTimeout < 0 || c.AppHealthFailures < 0 {
+		return fmt.Errorf("%w: negative interval, timeout, or failures", errCfgBadAppHealth)
+	}
+	return nil
+}
+
+// probesApp returns true if we check the enclave application's health.
+func (c *Config) probesApp() bool {
+	return c.AppHealthURL != "" || c.AppHealthCmd != ""
+}
+
+// probeAppOnce checks the enclave application's health once, and returns an
+// error if the application is unhealthy.  The application is healthy if its
+// health URL responds with a 2xx status code, or if its health command exits
+// with exit code 0.
+func probeAppOnce(ctx context.Context, c *Config) error {
+	ctx, cancel := context.WithTimeout(ctx, c.AppHealthTimeout)
+	defer cancel()
+
+	if c.AppHealthCmd != "" {
+		args := strings.Fields(c.AppHealthCmd)
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.AppHealthURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probeApp checks the enclave application's health once per interval until
+// the given channel is closed.  Once the application failed the configured
+// number of consecutive checks, we mark the application not ready, emit an
+// alert event, and signal the given channel, so the supervisor restarts the
+// application.
+func (e *Enclave) probeApp(stop <-chan struct{}, unhealthy chan<- struct{}) {
+	defer reportPanic()
+	ticker := time.NewTicker(e.cfg.AppHealthInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := probeAppOnce(context.Background(), e.cfg)
+		if err == nil {
+			if failures > 0 {
+				elog.Info("Enclave application is healthy again.")
+			}
+			failures = 0
+			// Applications that don't signal their readiness are ready
+			// once they're healthy.
+			if !e.cfg.WaitForApp {
+				e.appUnready.Store(false)
+			}
+			continue
+		}
+		failures++
+		elog.Warn("Enclave application failed health check.", "failures", failures, "error", err)
+		if failures < e.cfg.AppHealthFailures {
+			continue
+		}
+
+		e.appUnready.Store(true)
+		e.emitAppHealthEvent(failures, err)
+		select {
+		case unhealthy <- struct{}{}:
+		default:
+		}
+		return
+	}
+}
+
+// emitAppHealthEvent forwards an alert event about the unhealthy enclave
+// application to our event sink, if we have one.
+func (e *Enclave) emitAppHealthEvent(failures int, err error) {
+	if e.events == nil {
+		return
+	}
+	// Marshalling a struct of strings, integers, and times cannot fail.
+	raw, _ := json.Marshal(&appHealthEvent{
+		Type:     "nitriding.app_unhealthy",
+		Time:     time.Now().UTC(),
+		Failures: failures,
+		Error:    err.Error(),
+	})
+	if err := e.events.enqueue(raw); err != nil {
+		elog.Warn("Failed to forward application health event.", "error", err)
+	}
+}
+
+// requireAppReady returns a handler that responds with 503 Service Unavailable
+// while the enclave application isn't ready after we restarted it, and
+// otherwise passes requests to the given handler.
+func (e *Enclave) requireAppReady(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.appUnready.Load() {
+			httpError(w, r, errAppNotReady, http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
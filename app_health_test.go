@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidateAppHealth(t *testing.T) {
+	c := &Config{AppCmd: "my-app", AppHealthURL: "http://127.0.0.1:8081/health"}
+	failOnErr(t, c.validateAppHealth())
+
+	for _, c := range []*Config{
+		{AppHealthURL: "http://127.0.0.1:8081/health"},                          // No application.
+		{AppCmd: "my-app", AppHealthURL: "127.0.0.1:8081"},                      // No URL.
+		{AppCmd: "my-app", AppHealthURL: "http://127.0.0.1", AppHealthCmd: "x"}, // Both set.
+		{AppCmd: "my-app", AppHealthCmd: " "},                                   // Empty command.
+		{AppCmd: "my-app", AppHealthCmd: "true", AppHealthFailures: -1},
+	} {
+		if err := c.validateAppHealth(); !errors.Is(err, errCfgBadAppHealth) {
+			t.Fatalf("Expected error %v but got %v.", errCfgBadAppHealth, err)
+		}
+	}
+}
+
+func TestProbeAppOnce(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	c := &Config{AppHealthURL: srv.URL, AppHealthTimeout: time.Second}
+	failOnErr(t, probeAppOnce(context.Background(), c))
+	status = http.StatusInternalServerError
+	assertEqual(t, probeAppOnce(context.Background(), c) != nil, true)
+
+	c = &Config{AppHealthCmd: "true", AppHealthTimeout: time.Second}
+	failOnErr(t, probeAppOnce(context.Background(), c))
+	c.AppHealthCmd = "false"
+	assertEqual(t, probeAppOnce(context.Background(), c) != nil, true)
+	// Probes that take too long fail.
+	c.AppHealthCmd, c.AppHealthTimeout = "sleep 1", 10*time.Millisecond
+	assertEqual(t, probeAppOnce(context.Background(), c) != nil, true)
+}
+
+func TestRestartUnhealthyApp(t *testing.T) {
+	c := defaultCfg
+	c.AppCmd = "sleep 60"
+	c.AppHealthCmd = "false"
+	c.AppHealthInterval = 10 * time.Millisecond
+	c.AppHealthFailures = 2
+	e := createEnclave(&c)
+	e.appExited = make(chan struct{})
+	e.startup.markMet(appPrereqCert)
+	e.startup.markMet(appPrereqKeys)
+	restarts := ops.appRestarts.Load()
+	go e.superviseApp()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ops.appRestarts.Load() == restarts {
+		if time.Now().After(deadline) {
+			t.Fatal("Unhealthy application wasn't restarted.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The restarted application isn't ready until it signals its readiness.
+	assertEqual(t, e.appUnready.Load(), true)
+	rec := httptest.NewRecorder()
+	e.requireAppReady(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assertEqual(t, rec.Code, http.StatusServiceUnavailable)
+	assertEqual(t, e.signalReady(), true)
+	assertEqual(t, e.appUnready.Load(), false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultAppStopTimeout/2)
+	defer cancel()
+	failOnErr(t, e.stopApp(ctx))
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxAppSecretLen is the maximum length of an application secret's
+	// plaintext.  KMS cannot encrypt more than 4 KiB anyway.
+	maxAppSecretLen = 4096
+
+	// The ways in which we inject secrets into the enclave application.
+	appSecretViaEnv  = "env"
+	appSecretViaFile = "file"
+)
+
+var (
+	errCfgBadAppSecret    = errors.New("given config has invalid application secret")
+	errCfgBadAppSecretDir = errors.New("given config has unusable application secret directory")
+	errAppSecretsNotReady = errors.New("application secrets not yet fetched")
+	errNoAppSecretName    = errors.New("could not find 'name' in URL query parameters")
+	errNoSuchAppSecret    = errors.New("no application secret of the given name")
+	errBadAppSecret       = errors.New("application secret is empty or too long")
+	errAppSecretTaken     = errors.New("application secret was already provisioned")
+
+	errCfgBadAppSecretInject = errors.New("given config has invalid application secret injection")
+
+	// appSecretNameRegexp matches the names of application secrets, which
+	// double as file names.
+	appSecretNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+	// envVarRegexp matches the names of environment variables that we can set
+	// for the enclave application.
+	envVarRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// appSecretInjection determines how we expose an application secret to the
+// enclave application that we supervise.
+type appSecretInjection struct {
+	name string
+	via  string // appSecretViaEnv or appSecretViaFile.
+	env  string // The environment variable, if via is appSecretViaEnv.
+}
+
+// parseAppSecretInjection parses the given injection of the form
+// <name>=env:<variable> or <name>=file.
+func parseAppSecretInjection(s string) (*appSecretInjection, error) {
+	name, via, ok := strings.Cut(s, "=")
+	if !ok || !appSecretNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q is not of the form <name>=env:<variable> or <name>=file", errCfgBadAppSecretInject, s)
+	}
+	i := &appSecretInjection{name: name}
+	if variable, isEnv := strings.CutPrefix(via, appSecretViaEnv+":"); isEnv {
+		if !envVarRegexp.MatchString(variable) {
+			return nil, fmt.Errorf("%w: %s: invalid environment variable %q", errCfgBadAppSecretInject, name, variable)
+		}
+		i.via, i.env = appSecretViaEnv, variable
+		return i, nil
+	}
+	if via != appSecretViaFile {
+		return nil, fmt.Errorf("%w: %s: unknown injection %q", errCfgBadAppSecretInject, name, via)
+	}
+	i.via = appSecretViaFile
+	return i, nil
+}
+
+// parseAppSecret splits the given application secret of the form
+// <name>=asm://<secret-id> into its name and secret reference.
+func parseAppSecret(s string) (string, string, error) {
+	name, ref, ok := strings.Cut(s, "=")
+	if !ok || !appSecretNameRegexp.MatchString(name) {
+		return "", "", fmt.Errorf("%w: %q is not of the form <name>=asm://<secret-id>", errCfgBadAppSecret, s)
+	}
+	r, err := parseSecretRef(ref)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s: %v", errCfgBadAppSecret, name, err)
+	}
+	if r.scheme != schemeASM {
+		return "", "", fmt.Errorf("%w: %s: not a Secrets Manager reference", errCfgBadAppSecret, name)
+	}
+	return name, ref, nil
+}
+
+// validateAppSecrets returns an error if the config's application secrets or
+// the directory that we write them to are invalid.
+func (c *Config) validateAppSecrets() error {
+	var errs []error
+	names := make(map[string]bool)
+	for _, s := range c.AppSecrets {
+		name, _, err := parseAppSecret(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if names[name] {
+			errs = append(errs, fmt.Errorf("%w: duplicate name %s", errCfgBadAppSecret, name))
+		}
+		names[name] = true
+	}
+	if err := c.validateAppSecretInject(names); err != nil {
+		errs = append(errs, err)
+	}
+	if c.AppSecretsDir != "" {
+		if info, err := os.Stat(c.AppSecretsDir); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v", errCfgBadAppSecretDir, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("%w: %s is not a directory", errCfgBadAppSecretDir, c.AppSecretsDir))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateAppSecretInject returns an error if the config injects secrets into
+// the enclave application that it doesn't define, or files into a tmpfs that
+// it doesn't set.  The given names are those of the config's AppSecrets.
+func (c *Config) validateAppSecretInject(appSecrets map[string]bool) error {
+	if len(c.AppSecretInject) == 0 {
+		return nil
+	}
+	if !c.runsApp() {
+		return fmt.Errorf("%w: no application command", errCfgBadAppSecretInject)
+	}
+	var errs []error
+	injected := make(map[string]bool)
+	needsTmpfs := false
+	for _, s := range c.AppSecretInject {
+		i, err := parseAppSecretInjection(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if injected[i.name] {
+			errs = append(errs, fmt.Errorf("%w: duplicate name %s", errCfgBadAppSecretInject, i.name))
+		}
+		injected[i.name] = true
+		if !appSecrets[i.name] && !c.Provisioning {
+			errs = append(errs, fmt.Errorf("%w: %s is neither an application secret nor provisioned",
+				errCfgBadAppSecretInject, i.name))
+		}
+		needsTmpfs = needsTmpfs || i.via == appSecretViaFile
+	}
+	if needsTmpfs && !filepath.IsAbs(c.AppSecretsTmpfs) {
+		errs = append(errs, fmt.Errorf("%w: files require an absolute tmpfs path", errCfgBadAppSecretInject))
+	}
+	return errors.Join(errs...)
+}
+
+// fetchAppSecret fetches the KMS ciphertext that the given Secrets Manager
+// reference refers to, and decrypts it via KMS using an attestation document
+// that the given attester creates.  The EC2 host's instance role may be able
+// to read the secret, but only an attested enclave can decrypt it -- provided
+// that the KMS key's policy requires attestation.
+func fetchAppSecret(ctx context.Context, a attester, hashes *AttestationHashes, s string) ([]byte, error) {
+	ref, err := parseSecretRef(s)
+	if err != nil {
+		return nil, err
+	}
+	creds, region, err := getAWSSession(ctx, ref.region)
+	if err != nil {
+		return nil, err
+	}
+	var secret struct {
+		SecretBinary []byte
+		SecretString *string
+	}
+	in := map[string]string{"SecretId": ref.value}
+	err = callAWS(ctx, creds, region, "secretsmanager", "secretsmanager.GetSecretValue", in, &secret)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := secret.SecretBinary
+	if ciphertext == nil && secret.SecretString != nil {
+		if ciphertext, err = base64.StdEncoding.DecodeString(strings.TrimSpace(*secret.SecretString)); err != nil {
+			return nil, fmt.Errorf("secret is not a Base64-encoded KMS ciphertext: %w", err)
+		}
+	}
+	if len(ciphertext) == 0 {
+		return nil, errNoSecretString
+	}
+
+	resp, err := callKMSAsRecipient(ctx, a, hashes, region, "TrentService.Decrypt",
+		map[string]any{"CiphertextBlob": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Plaintext) == 0 || len(resp.Plaintext) > maxAppSecretLen {
+		wipeBytes(resp.Plaintext)
+		return nil, errBadAppSecret
+	}
+	return resp.Plaintext, nil
+}
+
+// appSecretStore holds the secrets that we fetch from Secrets Manager for the
+// enclave application, and the secrets that clients provision by name for the
+// application.
+type appSecretStore struct {
+	sync.Mutex
+	secrets     map[string]*SecretBytes // Nil until fetched.
+	provisioned map[string]*SecretBytes
+	pending     map[string]bool // Provisioned secrets that we still expect.
+	injections  []*appSecretInjection
+	tmpfs       string
+	uid, gid    uint32 // Owner of the secrets that we write to disk.
+	ready       func() // Called once we have all secrets that we inject.
+}
+
+// newAppSecretStore returns a new appSecretStore for the given config.  The
+// store calls the given function once it holds all secrets that the config
+// injects into the enclave application.
+func newAppSecretStore(c *Config, ready func()) *appSecretStore {
+	s := &appSecretStore{
+		provisioned: make(map[string]*SecretBytes),
+		pending:     make(map[string]bool),
+		tmpfs:       c.AppSecretsTmpfs,
+		uid:         c.UID,
+		gid:         c.GID,
+		ready:       ready,
+	}
+	fetched := make(map[string]bool)
+	for _, a := range c.AppSecrets {
+		if name, _, err := parseAppSecret(a); err == nil {
+			fetched[name] = true
+		}
+	}
+	for _, a := range c.AppSecretInject {
+		i, err := parseAppSecretInjection(a)
+		if err != nil {
+			continue
+		}
+		s.injections = append(s.injections, i)
+		if !fetched[i.name] {
+			s.pending[i.name] = true
+		}
+	}
+	return s
+}
+
+// checkReady calls our ready function if we hold all secrets that we inject.
+// The caller must hold the lock.
+func (s *appSecretStore) checkReady() {
+	if s.secrets != nil && len(s.pending) == 0 && s.ready != nil {
+		s.ready()
+	}
+}
+
+// fetch fetches the given application secrets using the given function, and
+// writes them to the given directory unless it's empty.
+func (s *appSecretStore) fetch(
+	ctx context.Context,
+	appSecrets []string,
+	dir string,
+	fetch func(context.Context, string) (string, error),
+) error {
+	secrets := make(map[string]*SecretBytes)
+	for _, a := range appSecrets {
+		name, ref, err := parseAppSecret(a)
+		if err != nil {
+			return err
+		}
+		plaintext, err := resolveWithRetry(ctx, fetch, ref)
+		if err != nil {
+			return fmt.Errorf("failed to fetch application secret %s: %w", name, err)
+		}
+		secrets[name] = newSecretBytes([]byte(plaintext))
+		if dir != "" {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(plaintext), 0o600); err != nil {
+				return fmt.Errorf("failed to write application secret %s: %w", name, err)
+			}
+			if err := chownUnprivileged(path, s.uid, s.gid); err != nil {
+				return fmt.Errorf("failed to hand over application secret %s: %w", name, err)
+			}
+		}
+		elog.Info("Fetched application secret.", "name", name)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.secrets = secrets
+	s.checkReady()
+	return nil
+}
+
+// provision stores the given plaintext as the provisioned secret of the given
+// name, and takes ownership of the plaintext.  Clients can only provision
+// secrets that we inject into the enclave application, and only once, so
+// nobody can swap a secret from under the application.
+func (s *appSecretStore) provision(name string, plaintext []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.provisioned[name]; exists {
+		wipeBytes(plaintext)
+		return errAppSecretTaken
+	}
+	if !s.pending[name] {
+		wipeBytes(plaintext)
+		return errNoSuchAppSecret
+	}
+	if len(plaintext) == 0 || len(plaintext) > maxAppSecretLen {
+		wipeBytes(plaintext)
+		return errBadAppSecret
+	}
+	delete(s.pending, name)
+	s.provisioned[name] = newSecretBytes(plaintext)
+	elog.Info("Received provisioned application secret.", "name", name)
+	s.checkReady()
+	return nil
+}
+
+// get returns a copy of the application secret of the given name.  The caller
+// is responsible for wiping the copy.
+func (s *appSecretStore) get(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if secret, ok := s.provisioned[name]; ok {
+		return bytes.Clone(secret.Bytes()), nil
+	}
+	if s.secrets == nil {
+		return nil, errAppSecretsNotReady
+	}
+	secret, ok := s.secrets[name]
+	if !ok {
+		return nil, errNoSuchAppSecret
+	}
+	return bytes.Clone(secret.Bytes()), nil
+}
+
+// wipe wipes our secrets.
+func (s *appSecretStore) wipe() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, secret := range s.secrets {
+		secret.Wipe()
+	}
+	s.secrets = nil
+	for name, secret := range s.provisioned {
+		secret.Wipe()
+		delete(s.provisioned, name)
+	}
+	s.removeFiles()
+}
+
+// inject returns the environment of the enclave application, which includes
+// the secrets that we inject as environment variables, and writes the secrets
+// that we inject as files to our tmpfs.  The application's environment
+// inherits ours.
+func (s *appSecretStore) inject() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	env := os.Environ()
+	for _, i := range s.injections {
+		secret, exists := s.provisioned[i.name]
+		if !exists {
+			secret, exists = s.secrets[i.name]
+		}
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", errAppSecretsNotReady, i.name)
+		}
+		switch i.via {
+		case appSecretViaEnv:
+			env = append(env, i.env+"="+string(secret.Bytes()))
+		case appSecretViaFile:
+			// We may inject again after the application crashed, and the
+			// previous file is read-only.
+			path := filepath.Join(s.tmpfs, i.name)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			if err := os.WriteFile(path, secret.Bytes(), 0o400); err != nil {
+				return nil, fmt.Errorf("failed to write application secret %s: %w", i.name, err)
+			}
+		}
+	}
+	return env, nil
+}
+
+// removeFiles removes the secrets that we injected as files.  The caller must
+// hold the lock.
+func (s *appSecretStore) removeFiles() {
+	for _, i := range s.injections {
+		if i.via == appSecretViaFile {
+			_ = os.Remove(filepath.Join(s.tmpfs, i.name))
+		}
+	}
+}
+
+// appSecretHandler returns an HTTP handler that returns the application
+// secret whose name is in the "name" URL parameter.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func appSecretHandler(s *appSecretStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			httpError(w, r, errNoAppSecretName, http.StatusBadRequest)
+			return
+		}
+		secret, err := s.get(name)
+		switch {
+		case errors.Is(err, errAppSecretsNotReady):
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			httpError(w, r, err, http.StatusNotFound)
+			return
+		}
+		defer wipeBytes(secret)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(secret)
+	}
+}
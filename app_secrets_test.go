@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateAppSecrets(t *testing.T) {
+	c := defaultCfg
+	c.AppSecrets = []string{"db=asm://prod/db", "tls.key=asm://prod/tls?region=us-east-1"}
+	c.AppSecretsDir = t.TempDir()
+	failOnErr(t, c.validateAppSecrets())
+
+	for _, s := range []string{
+		"asm://prod/db",       // No name.
+		"../db=asm://prod/db", // Name is no file name.
+		".db=asm://prod/db",   // Name is a hidden file.
+		"db=kms://Zm9v",       // Not a Secrets Manager reference.
+		"db=prod/db",          // Not a reference.
+	} {
+		c.AppSecrets = []string{s}
+		if err := c.validateAppSecrets(); !errors.Is(err, errCfgBadAppSecret) {
+			t.Fatalf("Expected error %v for %q but got %v.", errCfgBadAppSecret, s, err)
+		}
+	}
+	c.AppSecrets = []string{"db=asm://a", "db=asm://b"}
+	if err := c.validateAppSecrets(); !errors.Is(err, errCfgBadAppSecret) {
+		t.Fatalf("Expected error %v for duplicate names but got %v.", errCfgBadAppSecret, err)
+	}
+
+	c.AppSecrets = nil
+	c.AppSecretsDir = filepath.Join(t.TempDir(), "missing")
+	if err := c.validateAppSecrets(); !errors.Is(err, errCfgBadAppSecretDir) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadAppSecretDir, err)
+	}
+}
+
+func TestFetchAppSecret(t *testing.T) {
+	a := new(recipientAttester)
+	mockKMS(t, a)
+
+	plaintext, err := fetchAppSecret(context.Background(), a, new(AttestationHashes), "asm://prod/db")
+	failOnErr(t, err)
+	assertEqual(t, string(plaintext), "decrypted")
+}
+
+func TestAppSecretsOwner(t *testing.T) {
+	skipUnlessRoot(t)
+	c := defaultCfg
+	c.AppSecrets = []string{"db=asm://prod/db"}
+	c.AppSecretsDir = t.TempDir()
+	c.UID, c.GID = nobody, nobody
+	s := newAppSecretStore(&c, func() {})
+
+	fetch := func(context.Context, string) (string, error) { return "plaintext", nil }
+	failOnErr(t, s.fetch(context.Background(), c.AppSecrets, c.AppSecretsDir, fetch))
+	assertOwner(t, filepath.Join(c.AppSecretsDir, "db"), nobody, nobody)
+}
+
+func TestAppSecretHandler(t *testing.T) {
+	s := new(appSecretStore)
+	makeReq := makeReqToHandler(appSecretHandler(s))
+
+	assertResponse(t,
+		makeReq(http.MethodGet, pathAppSecrets+"?name=db", nil),
+		newErrResp(http.StatusServiceUnavailable, errAppSecretsNotReady),
+	)
+
+	dir := t.TempDir()
+	fetch := func(_ context.Context, ref string) (string, error) {
+		return "plaintext of " + ref, nil
+	}
+	failOnErr(t, s.fetch(context.Background(), []string{"db=asm://prod/db"}, dir, fetch))
+	assertResponse(t,
+		makeReq(http.MethodGet, pathAppSecrets+"?name=db", nil),
+		newResp(http.StatusOK, "plaintext of asm://prod/db"),
+	)
+	assertResponse(t,
+		makeReq(http.MethodGet, pathAppSecrets+"?name=foo", nil),
+		newErrResp(http.StatusNotFound, errNoSuchAppSecret),
+	)
+	assertResponse(t,
+		makeReq(http.MethodGet, pathAppSecrets, nil),
+		newErrResp(http.StatusBadRequest, errNoAppSecretName),
+	)
+
+	// The secret must also be in a file that only we can read.
+	info, err := os.Stat(filepath.Join(dir, "db"))
+	failOnErr(t, err)
+	assertEqual(t, info.Mode().Perm(), os.FileMode(0o600))
+	content, err := os.ReadFile(filepath.Join(dir, "db"))
+	failOnErr(t, err)
+	assertEqual(t, string(content), "plaintext of asm://prod/db")
+
+	s.wipe()
+	assertResponse(t,
+		makeReq(http.MethodGet, pathAppSecrets+"?name=db", nil),
+		newErrResp(http.StatusServiceUnavailable, errAppSecretsNotReady),
+	)
+}
+
+func TestValidateAppSecretInject(t *testing.T) {
+	c := defaultCfg
+	c.AppCmd = "my-app"
+	c.AppSecrets = []string{"db=asm://prod/db"}
+	c.AppSecretInject = []string{"db=env:DB_PASSWORD"}
+	failOnErr(t, c.validateAppSecrets())
+
+	for _, s := range []string{
+		"db",                // No injection.
+		"db=env:",           // No variable.
+		"db=env:1FOO",       // Invalid variable.
+		"db=stdin",          // Unknown injection.
+		"tls.key=file",      // Neither an application secret nor provisioned.
+		"db=file,db=env:DB", // Duplicate name.
+		"db=file",           // No tmpfs.
+	} {
+		c.AppSecretInject = splitList(s)
+		if err := c.validateAppSecrets(); !errors.Is(err, errCfgBadAppSecretInject) {
+			t.Fatalf("Expected error %v for %q but got %v.", errCfgBadAppSecretInject, s, err)
+		}
+	}
+	c.AppSecretsTmpfs = "/run/secrets"
+	failOnErr(t, c.validateAppSecrets())
+	c.Provisioning = true
+	c.AppSecretInject = []string{"tls.key=file"}
+	failOnErr(t, c.validateAppSecrets())
+
+	c.AppCmd = ""
+	if err := c.validateAppSecrets(); !errors.Is(err, errCfgBadAppSecretInject) {
+		t.Fatalf("Expected error %v without application but got %v.", errCfgBadAppSecretInject, err)
+	}
+}
+
+func TestAppSecretInject(t *testing.T) {
+	c := defaultCfg
+	c.AppSecrets = []string{"db=asm://prod/db"}
+	c.AppSecretInject = []string{"db=env:DB_PASSWORD", "tls.key=file"}
+	c.AppSecretsTmpfs = t.TempDir()
+	ready := make(chan struct{})
+	s := newAppSecretStore(&c, func() { close(ready) })
+
+	fetch := func(_ context.Context, ref string) (string, error) {
+		return "plaintext of " + ref, nil
+	}
+	failOnErr(t, s.fetch(context.Background(), c.AppSecrets, "", fetch))
+	_, err := s.inject()
+	assertEqual(t, errors.Is(err, errAppSecretsNotReady), true)
+
+	// Only the secrets that we inject can be provisioned, and only once.
+	assertEqual(t, s.provision("db", []byte("foo")), errNoSuchAppSecret)
+	failOnErr(t, s.provision("tls.key", []byte("key")))
+	assertEqual(t, s.provision("tls.key", []byte("other key")), errAppSecretTaken)
+	select {
+	case <-ready:
+	default:
+		t.Fatal("Store isn't ready despite holding all secrets.")
+	}
+
+	// We inject twice because the application may restart.
+	env, err := s.inject()
+	failOnErr(t, err)
+	env, err = s.inject()
+	failOnErr(t, err)
+	assertEqual(t, env[len(env)-1], "DB_PASSWORD=plaintext of asm://prod/db")
+	path := filepath.Join(c.AppSecretsTmpfs, "tls.key")
+	info, err := os.Stat(path)
+	failOnErr(t, err)
+	assertEqual(t, info.Mode().Perm(), os.FileMode(0o400))
+	content, err := os.ReadFile(path)
+	failOnErr(t, err)
+	assertEqual(t, string(content), "key")
+
+	s.wipe()
+	_, err = os.Stat(path)
+	assertEqual(t, errors.Is(err, os.ErrNotExist), true)
+	_, err = s.inject()
+	assertEqual(t, errors.Is(err, errAppSecretsNotReady), true)
+}
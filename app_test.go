@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpawnAppProcess(t *testing.T) {
+	expected := []string{"1", "2", "3"}
+	output := []string{}
+	f := func(s string) {
+		output = append(output, strings.TrimSpace(s))
+	}
+	dummy := func(string) {}
+
+	failOnErr(t, runAppCommand("seq 1 3", nil, nil, nil, defaultAppStopTimeout, nil, f, dummy))
+	if len(output) != len(expected) {
+		t.Fatalf("Expected slice length %d but got %d.", len(expected), len(output))
+	}
+
+	for i := range output {
+		if output[i] != expected[i] {
+			t.Fatalf("Expected element at index %d to be %s but got %s.", i, expected[i], output[i])
+		}
+	}
+}
+
+func TestSuperviseApp(t *testing.T) {
+	// The application crashes the first time, and exits cleanly the second
+	// time.
+	dir := t.TempDir()
+	script := filepath.Join(dir, "app.sh")
+	marker := filepath.Join(dir, "crashed")
+	body := fmt.Sprintf("test -e %s && exit 0\ntouch %s\nexit 1\n", marker, marker)
+	failOnErr(t, os.WriteFile(script, []byte(body), 0o600))
+	c := defaultCfg
+	c.AppCmd = "sh " + script
+	e := createEnclave(&c)
+	e.appExited = make(chan struct{})
+	e.startup.markMet(appPrereqCert)
+	e.startup.markMet(appPrereqKeys)
+	restarts := ops.appRestarts.Load()
+	go e.superviseApp()
+
+	select {
+	case <-e.appExited:
+	case <-time.After(minAppRestartDelay + 5*time.Second):
+		t.Fatal("Application wasn't restarted.")
+	}
+	assertEqual(t, ops.appRestarts.Load(), restarts+1)
+}
+
+func TestStopApp(t *testing.T) {
+	c := defaultCfg
+	c.AppCmd = "sleep 60"
+	e := createEnclave(&c)
+	e.appExited = make(chan struct{})
+	e.startup.markMet(appPrereqCert)
+	e.startup.markMet(appPrereqKeys)
+	go e.superviseApp()
+	// Give the application a moment to start.
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultAppStopTimeout/2)
+	defer cancel()
+	failOnErr(t, e.Stop(ctx))
+	select {
+	case <-e.appExited:
+	default:
+		t.Fatal("Application didn't stop.")
+	}
+}
+
+func TestValidateAppCmd(t *testing.T) {
+	c := &Config{AppCmd: "my-app -s foo"}
+	failOnErr(t, c.validateAppCmd())
+	c.Seccomp = true
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgSeccompAppCmd), true)
+	c = &Config{AppCmd: " "}
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgEmptyAppCmd), true)
+
+	c = &Config{AppCmd: "my-app", AppMaxAddrSpaceMiB: 512, AppMaxFiles: 1024, AppCPUWeight: 50}
+	failOnErr(t, c.validateAppCmd())
+	c.AppCPUWeight = maxAppCPUWeight + 1
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgBadAppLimits), true)
+	// We cannot start the application in its cgroup without root privileges.
+	c.AppCPUWeight, c.UID = 50, 1000
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgBadAppLimits), true)
+	c = &Config{AppMaxFiles: 1024}
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgBadAppLimits), true)
+}
+
+func TestAppOutputLogger(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *slog.Logger) { elog = l }(elog)
+	elog = newLogger(&buf, logFormatJSON)
+
+	assertEqual(t, appName("/usr/bin/my-app -s foo"), "my-app")
+	appOutputLogger("my-app", "stderr")("hello world")
+	var record map[string]any
+	failOnErr(t, json.Unmarshal(buf.Bytes(), &record))
+	assertEqual(t, record["msg"], "hello world")
+	assertEqual(t, record["app"], "my-app")
+	assertEqual(t, record["stream"], "stderr")
+}
+
+func TestForwardLongLines(t *testing.T) {
+	var lines []string
+	long := strings.Repeat("a", maxAppLineLen+1)
+	forwardOutput(io.NopCloser(strings.NewReader(long+"\nfoo\n")), func(s string) {
+		lines = append(lines, s)
+	}, "stdout")
+	assertEqual(t, len(lines), 3)
+	assertEqual(t, len(lines[0]), maxAppLineLen)
+	assertEqual(t, lines[1], "a")
+	assertEqual(t, lines[2], "foo")
+}
+
+func TestStartupBarrier(t *testing.T) {
+	b := newStartupBarrier()
+	stop := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		done <- b.wait([]string{appPrereqCert, appPrereqKeys}, stop)
+	}()
+	b.markMet(appPrereqKeys)
+	select {
+	case <-done:
+		t.Fatal("Barrier didn't wait for all prerequisites.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.markMet(appPrereqCert)
+	// Marking a prerequisite twice is harmless.
+	b.markMet(appPrereqCert)
+	assertEqual(t, <-done, true)
+
+	go func() {
+		done <- b.wait([]string{appPrereqTime}, stop)
+	}()
+	close(stop)
+	assertEqual(t, <-done, false)
+}
+
+func TestSuperviseAppWaits(t *testing.T) {
+	c := defaultCfg
+	c.AppCmd = "true"
+	c.AppPrereqs = []string{appPrereqKeys}
+	e := createEnclave(&c)
+	e.appExited = make(chan struct{})
+	go e.superviseApp()
+
+	select {
+	case <-e.appExited:
+		t.Fatal("Application didn't wait for its prerequisite.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	e.startup.markMet(appPrereqKeys)
+	select {
+	case <-e.appExited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Application didn't run after its prerequisite was met.")
+	}
+}
+
+func TestAppPrereqs(t *testing.T) {
+	c := &Config{AppCmd: "my-app"}
+	assertEqual(t, strings.Join(c.appPrereqs(), ","), "cert,keys")
+	// The public Web server must be able to answer ACME challenges.
+	c.UseACME, c.WaitForApp = true, true
+	assertEqual(t, strings.Join(c.appPrereqs(), ","), "keys")
+	c.AppPrereqs = []string{appPrereqCert}
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgAppPrereqCycle), true)
+	c.ACMEDNSProvider = "route53"
+	failOnErr(t, c.validateAppCmd())
+
+	c.AppPrereqs = []string{appPrereqSVID}
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgBadAppPrereq), true)
+	c.SpireServer = "127.0.0.1:8081"
+	failOnErr(t, c.validateAppCmd())
+	c.AppPrereqs = []string{"foo"}
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgBadAppPrereq), true)
+
+	c = &Config{AppPrereqs: []string{appPrereqKeys}}
+	assertEqual(t, errors.Is(c.validateAppCmd(), errCfgPrereqsNoApp), true)
+
+	// The application always waits for the secrets that we inject.
+	c = &Config{AppCmd: "my-app", AppSecretInject: []string{"db=env:DB"}}
+	assertEqual(t, strings.Join(c.appPrereqs(), ","), "cert,keys,secrets")
+	c.AppPrereqs = []string{appPrereqSecrets}
+	failOnErr(t, c.validateAppCmd())
+	assertEqual(t, strings.Join(c.appPrereqs(), ","), "secrets")
+}
+
+func TestAppSpecs(t *testing.T) {
+	c := &Config{Apps: []string{
+		"web?after=cache&after=auth:my-server -p 8080",
+		"cache?restart=always:redis-server",
+		"auth?restart=never:my-auth",
+	}}
+	failOnErr(t, c.validateAppCmd())
+	specs, err := c.appSpecs()
+	failOnErr(t, err)
+	var names []string
+	for _, s := range specs {
+		names = append(names, s.name)
+	}
+	// We start processes after their dependencies.
+	assertEqual(t, strings.Join(names, ","), "cache,auth,web")
+	assertEqual(t, specs[2].cmd, "my-server -p 8080")
+	assertEqual(t, specs[2].restart, appRestartOnFailure)
+	assertEqual(t, specs[0].restart, appRestartAlways)
+
+	for _, apps := range [][]string{
+		{"my-server"},                      // No name.
+		{"../web:my-server"},               // Invalid name.
+		{"web: "},                          // No command.
+		{"web?restart=sometimes:foo"},      // Unknown restart policy.
+		{"web?after=cache:my-server"},      // Unknown dependency.
+		{"web:foo", "web:bar"},             // Duplicate name.
+		{"a?after=b:foo", "b?after=a:bar"}, // Dependency cycle.
+	} {
+		c = &Config{Apps: apps}
+		if err := c.validateAppCmd(); !errors.Is(err, errCfgBadApp) {
+			t.Fatalf("Expected error %v for %q but got %v.", errCfgBadApp, apps, err)
+		}
+	}
+	c = &Config{AppCmd: "my-app", Apps: []string{"web:my-server"}}
+	assertEqual(t, c.validateAppCmd(), errCfgAppCmdAndApps)
+}
+
+func TestSuperviseApps(t *testing.T) {
+	// Each process records that it stopped, so we can check that we stop
+	// processes before their dependencies.
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	script := func(name string) string {
+		path := filepath.Join(dir, name+".sh")
+		body := fmt.Sprintf("trap 'echo %s >> %s; exit 0' TERM\nwhile :; do sleep 0.1; done\n", name, log)
+		failOnErr(t, os.WriteFile(path, []byte(body), 0o600))
+		return "sh " + path
+	}
+	c := defaultCfg
+	c.Apps = []string{
+		"web?after=cache:" + script("web"),
+		"cache:" + script("cache"),
+		"once?restart=never:false",
+	}
+	e := createEnclave(&c)
+	e.appExited = make(chan struct{})
+	e.startup.markMet(appPrereqCert)
+	e.startup.markMet(appPrereqKeys)
+	restarts := ops.appRestarts.Load()
+	go e.superviseApp()
+	// Give the processes a moment to start.
+	time.Sleep(500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultAppStopTimeout/2)
+	defer cancel()
+	failOnErr(t, e.stopApp(ctx))
+	content, err := os.ReadFile(log)
+	failOnErr(t, err)
+	assertEqual(t, string(content), "web\ncache\n")
+	// The crashed process must not have been restarted.
+	assertEqual(t, ops.appRestarts.Load(), restarts)
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/hf/nitrite"
 )
@@ -22,6 +25,9 @@ var (
 
 	// Multihash prefix marks the hash type and digest size
 	hashPrefix = []byte{0x12, sha256.Size}
+	// Multihash prefix of the "identity" hash function, whose 8-byte digest
+	// is our restart counter itself.
+	counterPrefix = []byte{0x00, 8}
 
 	// getPCRValues is a variable pointing to a function that returns PCR
 	// values.  Using a variable allows us to easily mock the function in our
@@ -32,17 +38,106 @@ var (
 // AttestationHashes contains hashes over public key material which we embed in
 // the enclave's attestation document for clients to verify.
 type AttestationHashes struct {
+	// Guard tlsKeyHash, appKeyHash, dataHash, hasData, and restarts, which
+	// change while we serve attestation documents.
+	dataLock   sync.Mutex
 	tlsKeyHash [sha256.Size]byte // Always set.
 	appKeyHash [sha256.Size]byte // Sometimes set, depending on application.
+	configHash [sha256.Size]byte // Always set.
+	dataHash   [sha256.Size]byte // Only set if the application attests data.
+	hasData    bool
+	restarts   uint64 // Only set if the restart counter is enabled.
+}
+
+// setTLSKeyHash records the fingerprint of the certificate that we serve,
+// which changes when we swap our temporary certificate for our ACME
+// certificate.
+func (a *AttestationHashes) setTLSKeyHash(h [sha256.Size]byte) {
+	a.dataLock.Lock()
+	defer a.dataLock.Unlock()
+
+	a.tlsKeyHash = h
+}
+
+// getTLSKeyHash returns the fingerprint of the certificate that we serve.
+func (a *AttestationHashes) getTLSKeyHash() [sha256.Size]byte {
+	a.dataLock.Lock()
+	defer a.dataLock.Unlock()
+
+	return a.tlsKeyHash
+}
+
+// setAppKeyHash records the hash over the enclave application's public key
+// material.
+func (a *AttestationHashes) setAppKeyHash(h [sha256.Size]byte) {
+	a.dataLock.Lock()
+	defer a.dataLock.Unlock()
+
+	a.appKeyHash = h
+}
+
+// addDataHash records the given hash over data that the enclave application
+// loaded, e.g., an S3 object.  We chain the hashes of all recorded data:
+// the data hash is SHA-256(previous data hash || given hash), starting with
+// zeroes, so verifiers can reproduce it from the hashes, in order, of the data
+// that they expect the enclave to have loaded.
+func (a *AttestationHashes) addDataHash(h [sha256.Size]byte) {
+	a.dataLock.Lock()
+	defer a.dataLock.Unlock()
+
+	a.dataHash = sha256.Sum256(append(a.dataHash[:], h[:]...))
+	a.hasData = true
+}
+
+// setRestartCount records the given value of our restart counter.
+func (a *AttestationHashes) setRestartCount(n uint64) {
+	a.dataLock.Lock()
+	defer a.dataLock.Unlock()
+
+	a.restarts = n
+}
+
+// restartCount returns the value of our restart counter, which is 0 if the
+// counter is disabled.
+func (a *AttestationHashes) restartCount() uint64 {
+	a.dataLock.Lock()
+	defer a.dataLock.Unlock()
+
+	return a.restarts
+}
+
+// hashConfig returns a SHA-256 hash over the compact JSON encoding of the given
+// config.  Verifiers can reproduce the hash by compacting the JSON that our
+// configuration endpoint returns.  Secrets (i.e., our auth token) are not part
+// of the JSON encoding and therefore don't affect the hash.
+func hashConfig(c *Config) ([sha256.Size]byte, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(raw), nil
 }
 
 // Serialize returns a byte slice that contains our concatenated hashes.
-// hashPrefix defines the hash type and length.  Note that all hashes are
-// always present.  If a hash was not initialized, it's set to 0-bytes.
+// hashPrefix defines the hash type and length.  Note that the first three
+// hashes are always present.  If a hash was not initialized, it's set to
+// 0-bytes.  The data hash is only present if the application attested data.
+// The restart counter, if enabled, comes last, as an identity multihash.
 func (a *AttestationHashes) Serialize() []byte {
+	a.dataLock.Lock()
+	defer a.dataLock.Unlock()
+
 	ser := []byte{}
 	ser = append(ser, append(hashPrefix, a.tlsKeyHash[:]...)...)
 	ser = append(ser, append(hashPrefix, a.appKeyHash[:]...)...)
+	ser = append(ser, append(hashPrefix, a.configHash[:]...)...)
+	if a.hasData {
+		ser = append(ser, append(hashPrefix, a.dataHash[:]...)...)
+	}
+	if a.restarts > 0 {
+		ser = append(ser, counterPrefix...)
+		ser = binary.BigEndian.AppendUint64(ser, a.restarts)
+	}
 	return ser
 }
 
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -48,7 +50,7 @@ func TestAttestationHashes(t *testing.T) {
 	if err := e.Start(); err != nil {
 		t.Fatal(err)
 	}
-	defer e.Stop() //nolint:errcheck
+	defer e.Stop(context.Background()) //nolint:errcheck
 	signalReady(t, e)
 
 	// Register dummy key material for the other hash to be initialized.
@@ -58,7 +60,7 @@ func TestAttestationHashes(t *testing.T) {
 	e.intSrv.Handler.ServeHTTP(rec, req)
 
 	s := e.hashes.Serialize()
-	expectedLen := sha256.Size*2 + len(hashPrefix)*2
+	expectedLen := sha256.Size*3 + len(hashPrefix)*3
 	if len(s) != expectedLen {
 		t.Fatalf("Expected serialized hashes to be of length %d but got %d.",
 			expectedLen, len(s))
@@ -74,7 +76,55 @@ func TestAttestationHashes(t *testing.T) {
 	expected := []byte(hashPrefix)
 	expected = append(expected, appKeyHash[:]...)
 	offset := len(hashPrefix) + sha256.Size
-	if !bytes.Equal(s[offset:], expected) {
-		t.Fatalf("Expected application key hash of %x but got %x.", expected, s[offset:])
+	if !bytes.Equal(s[offset:offset*2], expected) {
+		t.Fatalf("Expected application key hash of %x but got %x.", expected, s[offset:offset*2])
+	}
+
+	// The last hash must be over our configuration.
+	configHash, err := hashConfig(e.cfg)
+	failOnErr(t, err)
+	expected = append([]byte(hashPrefix), configHash[:]...)
+	if !bytes.Equal(s[offset*2:], expected) {
+		t.Fatalf("Expected config hash of %x but got %x.", expected, s[offset*2:])
+	}
+}
+
+func TestAttestationHashesConcurrency(t *testing.T) {
+	// The TLS key hash changes when we swap our temporary certificate for
+	// our ACME certificate, while we keep serving attestation documents.
+	// Run with -race.
+	a := new(AttestationHashes)
+	fingerprint := sha256.Sum256([]byte("ACME certificate"))
+	done := make(chan struct{})
+	go func() {
+		a.setTLSKeyHash(fingerprint)
+		close(done)
+	}()
+	_ = a.Serialize()
+	<-done
+	assertEqual(t, bytes.Equal(a.Serialize()[2:2+sha256.Size], fingerprint[:]), true)
+}
+
+func TestHashConfig(t *testing.T) {
+	c := defaultCfg
+	h1, err := hashConfig(&c)
+	failOnErr(t, err)
+
+	// The hash must be reproducible from the configuration endpoint.
+	var compact bytes.Buffer
+	failOnErr(t, json.Compact(&compact, []byte(c.String())))
+	assertEqual(t, sha256.Sum256(compact.Bytes()), h1)
+
+	// Secrets must not affect the hash, but everything else must.
+	c.IntAuthToken = "secret"
+	h2, err := hashConfig(&c)
+	failOnErr(t, err)
+	assertEqual(t, h1, h2)
+
+	c.Debug = !c.Debug
+	h2, err = hashConfig(&c)
+	failOnErr(t, err)
+	if h1 == h2 {
+		t.Fatal("Expected config hash to change.")
 	}
 }
@@ -15,8 +15,41 @@ var (
 	errNonceMismatch   = errors.New("nonce is unexpected")
 	errNoAttstnFromNSM = errors.New("NSM device did not return an attestation")
 	padding            = []byte("dummy")
+
+	// sharedNSMSession is a session with the Nitro Secure Module that we
+	// keep open for the lifetime of nitriding.  Once we drop privileges, we
+	// may no longer be allowed to open the NSM's device file.
+	sharedNSMSession *nsm.Session
 )
 
+// keepNSMSession opens a session with the Nitro Secure Module that all
+// subsequent attestation requests use.
+func keepNSMSession() error {
+	if sharedNSMSession != nil {
+		return nil
+	}
+	s, err := nsm.OpenDefaultSession()
+	if err != nil {
+		return err
+	}
+	sharedNSMSession = s
+	return nil
+}
+
+// openNSMSession returns our shared session with the Nitro Secure Module if
+// we have one, and a new session otherwise.  Callers must call the returned
+// function once they are done with the session.
+func openNSMSession() (*nsm.Session, func(), error) {
+	if sharedNSMSession != nil {
+		return sharedNSMSession, func() {}, nil
+	}
+	s, err := nsm.OpenDefaultSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, func() { _ = s.Close() }, nil
+}
+
 // attester defines functions for the creation and verification of attestation
 // documents.  Making this an interface helps with testing: It allows us to
 // implement a dummy attester that works without the AWS Nitro hypervisor.
@@ -32,6 +65,7 @@ type auxInfo interface{}
 type clientAuxInfo struct {
 	clientNonce       nonce
 	attestationHashes []byte
+	publicKey         []byte // Optional; our HPKE key for provisioning.
 }
 
 // workerAuxInfo holds the auxiliary information of the worker's attestation
@@ -73,7 +107,7 @@ func (*dummyAttester) verifyAttstn(doc []byte, n nonce) (auxInfo, error) {
 		return nil, err
 	}
 	if w.PublicKey != nil {
-		if n.b64() != w.LeadersNonce.b64() {
+		if !n.equal(w.LeadersNonce) {
 			return nil, errNonceMismatch
 		}
 		return &w, nil
@@ -84,7 +118,7 @@ func (*dummyAttester) verifyAttstn(doc []byte, n nonce) (auxInfo, error) {
 		return nil, err
 	}
 	if l.HashOfEncrypted != nil {
-		if n.b64() != l.WorkersNonce.b64() {
+		if !n.equal(l.WorkersNonce) {
 			return nil, errNonceMismatch
 		}
 		return &l, nil
@@ -122,14 +156,17 @@ func (*nitroAttester) createAttstn(aux auxInfo) ([]byte, error) {
 	case *clientAuxInfo:
 		nonce = v.clientNonce[:]
 		userData = v.attestationHashes
-		publicKey = padding
+		publicKey = v.publicKey
+		if publicKey == nil {
+			publicKey = padding
+		}
 	}
 
-	s, err := nsm.OpenDefaultSession()
+	s, closeSession, err := openNSMSession()
 	if err != nil {
 		return nil, err
 	}
-	defer s.Close()
+	defer closeSession()
 
 	res, err := s.Send(&request.Attestation{
 		Nonce:     nonce,
@@ -172,7 +209,7 @@ func (*nitroAttester) verifyAttstn(doc []byte, ourNonce nonce) (auxInfo, error)
 	if err != nil {
 		return nil, err
 	}
-	if ourNonce != theirNonce {
+	if !ourNonce.equal(theirNonce) {
 		return nil, errNonceMismatch
 	}
 
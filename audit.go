@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// The operations that our audit log records.
+	auditSetState  = "set_state"
+	auditSetHash   = "set_hash"
+	auditReady     = "ready"
+	auditSetConfig = "set_config"
+	auditShutdown  = "shutdown"
+
+	// Callers that don't talk to us via HTTP.
+	callerAPI    = "api"
+	callerSIGHUP = "sighup"
+
+	// The maximum number of entries that we keep in memory.  Once the log is
+	// full, we drop the oldest entries.  The hash chain remains verifiable
+	// from the oldest remaining entry onwards.
+	maxAuditEntries = 10000
+)
+
+var errBadSince = errors.New("failed to parse 'since' parameter")
+
+// auditEntry represents an operation that changed the enclave's state.
+// Entries form a hash chain: each entry's hash covers the entry (without its
+// hash) including the hash of the previous entry, which makes it evident if
+// entries were removed or modified after the fact.
+type auditEntry struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	Operation   string    `json:"operation"`
+	Caller      string    `json:"caller"`
+	PayloadHash string    `json:"payload_hash,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	PrevHash    string    `json:"prev_hash"`
+	Hash        string    `json:"hash,omitempty"`
+}
+
+// auditLog is an append-only, in-memory log of state-changing operations on
+// nitriding's internal API.  Each entry is also logged, so log shipping
+// forwards it to the EC2 host.
+type auditLog struct {
+	sync.Mutex
+	entries  []auditEntry
+	nextSeq  uint64
+	lastHash string
+	// forward is called with each new entry if it isn't nil.
+	forward func(auditEntry)
+}
+
+// newAuditLog returns a new, empty audit log.
+func newAuditLog() *auditLog {
+	return &auditLog{lastHash: hex.EncodeToString(make([]byte, sha256.Size))}
+}
+
+// record appends a new entry for the given operation to the audit log.  If
+// the given payload is nil, the entry has no payload hash.
+func (a *auditLog) record(op, caller string, payload []byte, status int) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	entry := auditEntry{
+		Seq:       a.nextSeq,
+		Time:      time.Now().UTC(),
+		Operation: op,
+		Caller:    caller,
+		Status:    status,
+		PrevHash:  a.lastHash,
+	}
+	if payload != nil {
+		sum := sha256.Sum256(payload)
+		entry.PayloadHash = hex.EncodeToString(sum[:])
+	}
+	entry.Hash = entry.hash()
+	a.lastHash = entry.Hash
+	a.nextSeq++
+
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > maxAuditEntries {
+		a.entries = a.entries[len(a.entries)-maxAuditEntries:]
+	}
+	elog.Info("Audit event.",
+		"seq", entry.Seq,
+		"operation", entry.Operation,
+		"caller", entry.Caller,
+		"payload_hash", entry.PayloadHash,
+		"status", entry.Status,
+		"hash", entry.Hash)
+	if a.forward != nil {
+		a.forward(entry)
+	}
+}
+
+// hash returns the hex-encoded SHA-256 hash over the JSON-encoded entry,
+// without the entry's own hash.
+func (entry auditEntry) hash() string {
+	entry.Hash = ""
+	// Marshalling a struct of strings, integers, and times cannot fail.
+	raw, _ := json.Marshal(entry)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// since returns a copy of all entries whose sequence number is at least the
+// given number.
+func (a *auditLog) since(seq uint64) []auditEntry {
+	a.Lock()
+	defer a.Unlock()
+
+	entries := []auditEntry{}
+	for _, entry := range a.entries {
+		if entry.Seq >= seq {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// errReader returns the given error once its caller has read everything
+// before it.  We use it to hand a request body's read error to the next
+// handler.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// audited returns an HTTP handler that records each of its requests to the
+// given operation in the audit log before passing it on to the given
+// handler.  If the audit log is disabled, we return the given handler.
+func audited(a *auditLog, op string, h http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload, err := io.ReadAll(r.Body)
+		var body io.Reader = bytes.NewReader(payload)
+		if err != nil {
+			body = io.MultiReader(body, errReader{err})
+		}
+		r.Body = io.NopCloser(body)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		h(ww, r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		a.record(op, r.RemoteAddr, payload, status)
+	}
+}
+
+// auditHandler returns an HTTP handler that returns the JSON-encoded entries
+// of the audit log, starting at the sequence number in the optional "since"
+// URL parameter.
+func auditHandler(a *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since uint64
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+				httpError(w, r, errBadSince, http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(a.since(since)); err != nil {
+			elog.Error("Error encoding audit log.", "error", err)
+		}
+	}
+}
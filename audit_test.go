@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	a := newAuditLog()
+	a.record(auditSetHash, "127.0.0.1:1234", []byte("foo"), http.StatusOK)
+	a.record(auditReady, callerAPI, nil, 0)
+
+	entries := a.since(0)
+	assertEqual(t, len(entries), 2)
+	sum := sha256.Sum256([]byte("foo"))
+	assertEqual(t, entries[0].PayloadHash, hex.EncodeToString(sum[:]))
+	assertEqual(t, entries[1].PayloadHash, "")
+
+	// The entries must form a hash chain.
+	for i, entry := range entries {
+		assertEqual(t, entry.Seq, uint64(i))
+		assertEqual(t, entry.Hash, entry.hash())
+		if i > 0 {
+			assertEqual(t, entry.PrevHash, entries[i-1].Hash)
+		}
+	}
+	assertEqual(t, len(a.since(1)), 1)
+
+	// A nil audit log must be harmless.
+	var disabled *auditLog
+	disabled.record(auditReady, callerAPI, nil, 0)
+}
+
+func TestAuditedEndpoints(t *testing.T) {
+	c := defaultCfg
+	c.AuditLog = true
+	e := createEnclave(&c)
+	makeReq := makeReqToSrv(e.intSrv)
+
+	// The audited handler must still see the request body.
+	hash := sha256.Sum256([]byte("foo"))
+	b64Hash := "LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564="
+	resp := makeReq(http.MethodPost, pathHash, bytes.NewBufferString(b64Hash))
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, e.hashes.appKeyHash, hash)
+	e.SignalReady()
+
+	resp = makeReq(http.MethodGet, pathAudit+"?since=0", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var entries []auditEntry
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&entries))
+	assertEqual(t, len(entries), 2)
+	assertEqual(t, entries[0].Operation, auditSetHash)
+	assertEqual(t, entries[0].Status, http.StatusOK)
+	payloadHash := sha256.Sum256([]byte(b64Hash))
+	assertEqual(t, entries[0].PayloadHash, hex.EncodeToString(payloadHash[:]))
+	assertEqual(t, entries[1].Operation, auditReady)
+	assertEqual(t, entries[1].Caller, callerAPI)
+
+	assertResponse(t,
+		makeReq(http.MethodGet, pathAudit+"?since=foo", nil),
+		newErrResp(http.StatusBadRequest, errBadSince),
+	)
+}
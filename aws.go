@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsSigAlgorithm = "AWS4-HMAC-SHA256"
+	awsDateFormat   = "20060102T150405Z"
+	// The maximum length of responses that we accept from AWS services and
+	// the instance metadata service.
+	maxAWSRespLen = 1024 * 1024
+)
+
+var (
+	errIMDS        = errors.New("failed to query instance metadata service")
+	errAWSResponse = errors.New("AWS service returned an error")
+
+	// imdsURL points to AWS's Instance Metadata Service.  Using variables
+	// allows us to mock AWS in our unit tests.
+	imdsURL = "http://169.254.169.254/latest"
+	// awsEndpoint returns the URL of the given AWS service in the given
+	// region.
+	awsEndpoint = func(service, region string) string {
+		return fmt.Sprintf("https://%s.%s.amazonaws.com/", service, region)
+	}
+	awsHTTPClient = &http.Client{Transport: outboundTransport, Timeout: 30 * time.Second}
+)
+
+// awsCredentials holds the temporary credentials of the EC2 instance's IAM
+// role, as returned by the instance metadata service.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// imdsGet returns the instance metadata at the given path, e.g.,
+// "meta-data/placement/region".
+func imdsGet(ctx context.Context, path string) (string, error) {
+	// IMDSv2 is session-oriented, so we first obtain a session token.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsURL+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := doAWSRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errIMDS, err)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, imdsURL+"/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	body, err := doAWSRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errIMDS, err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// getAWSRegion returns the region that our EC2 instance runs in.
+func getAWSRegion(ctx context.Context) (string, error) {
+	return imdsGet(ctx, "meta-data/placement/region")
+}
+
+// getAWSCredentials returns the temporary credentials of our EC2 instance's
+// IAM role.
+func getAWSCredentials(ctx context.Context) (*awsCredentials, error) {
+	const credsPath = "meta-data/iam/security-credentials/"
+	role, err := imdsGet(ctx, credsPath)
+	if err != nil {
+		return nil, err
+	}
+	// The instance has at most one role, so we take the first line.
+	role, _, _ = strings.Cut(role, "\n")
+	rawCreds, err := imdsGet(ctx, credsPath+role)
+	if err != nil {
+		return nil, err
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal([]byte(rawCreds), &creds); err != nil {
+		return nil, fmt.Errorf("%w: %v", errIMDS, err)
+	}
+	return &creds, nil
+}
+
+// getAWSSession returns the credentials of our EC2 instance's IAM role, and
+// the given region.  If no region is given, we return our EC2 instance's
+// region.
+func getAWSSession(ctx context.Context, region string) (*awsCredentials, string, error) {
+	creds, err := getAWSCredentials(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if region == "" {
+		if region, err = getAWSRegion(ctx); err != nil {
+			return nil, "", err
+		}
+	}
+	return creds, region, nil
+}
+
+// doAWSRequest sends the given request and returns the response body if the
+// response has status code 200.
+func doAWSRequest(req *http.Request) ([]byte, error) {
+	resp, err := awsHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(newLimitReader(resp.Body, maxAWSRespLen))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s: %s", errAWSResponse, resp.Status, body)
+	}
+	return body, nil
+}
+
+// callAWS invokes the given action (e.g., "TrentService.Decrypt") of an AWS
+// service that speaks the JSON 1.1 protocol, and decodes the service's
+// response into the given output.
+func callAWS(ctx context.Context, creds *awsCredentials, region, service, action string, in, out any) error {
+	return callAWSJSON(ctx, creds, region, service, "1.1", action, in, out)
+}
+
+// callAWSJSON is like callAWS, for services that speak the given version of
+// the JSON protocol, e.g., SQS, which speaks version 1.0.
+func callAWSJSON(ctx context.Context, creds *awsCredentials, region, service, version, action string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, awsEndpoint(service, region), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-"+version)
+	req.Header.Set("X-Amz-Target", action)
+	signAWSRequest(req, body, creds, region, service, currentTime())
+
+	respBody, err := doAWSRequest(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// awsURIEncode encodes the given string as required by AWS's Signature
+// Version 4: all bytes other than unreserved characters are percent-encoded.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signAWSRequest signs the given request with the given body using AWS's
+// Signature Version 4:
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+// We sign the Host header, the Content-Type header, and all X-Amz-* headers.
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+	payloadHash := sha256.Sum256(body)
+
+	// Assemble the canonical headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Assemble the canonical query string.
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalReq := strings.Join([]string{
+		req.Method,
+		awsURIEncode(path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalReqHash := sha256.Sum256([]byte(canonicalReq))
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		awsSigAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalReqHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigAlgorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
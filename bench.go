@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// The endpoints that "nitriding bench" can drive load against.
+	benchAttestation = "attestation" // Nitriding's attestation endpoint.
+	benchProxy       = "proxy"       // The enclave application, via our reverse proxy.
+
+	defaultBenchConcurrency = 8
+	defaultBenchDuration    = 10 * time.Second
+	defaultBenchTimeout     = 10 * time.Second
+)
+
+var errBadBenchArgs = errors.New("invalid benchmark arguments")
+
+// benchConfig determines what "nitriding bench" does.
+type benchConfig struct {
+	target      *url.URL
+	endpoints   []string
+	proxyPath   string
+	concurrency int
+	duration    time.Duration
+	timeout     time.Duration
+	insecure    bool
+}
+
+// benchResult contains the outcome of driving load against a single
+// endpoint.
+type benchResult struct {
+	endpoint  string
+	latencies []time.Duration // Of successful requests.
+	errors    int
+	elapsed   time.Duration
+}
+
+// parseBenchArgs parses the command line arguments of "nitriding bench",
+// which take the form "[flags] <enclave URL>".
+func parseBenchArgs(args []string, out io.Writer) (*benchConfig, error) {
+	var endpoints string
+	c := &benchConfig{}
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: nitriding bench [flags] <enclave URL, e.g., https://example.com>")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&endpoints, "endpoints", benchAttestation+","+benchProxy,
+		"Comma-separated endpoints to drive load against: attestation and proxy.")
+	fs.StringVar(&c.proxyPath, "proxy-path", "/",
+		"Path of the enclave application that the proxy endpoint requests.")
+	fs.IntVar(&c.concurrency, "concurrency", defaultBenchConcurrency,
+		"Number of concurrent requests.")
+	fs.DurationVar(&c.duration, "duration", defaultBenchDuration,
+		"How long to drive load against each endpoint.")
+	fs.DurationVar(&c.timeout, "timeout", defaultBenchTimeout,
+		"How long each request may take.")
+	fs.BoolVar(&c.insecure, "insecure", false,
+		"Skip certificate validation, e.g., for enclaves with self-signed certificates.")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() != 1 {
+		return nil, fmt.Errorf("%w: expected one enclave URL", errBadBenchArgs)
+	}
+	target, err := url.Parse(fs.Arg(0))
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+		return nil, fmt.Errorf("%w: %q is no HTTP URL", errBadBenchArgs, fs.Arg(0))
+	}
+	c.target = target
+	c.endpoints = splitList(endpoints)
+	for _, e := range c.endpoints {
+		if e != benchAttestation && e != benchProxy {
+			return nil, fmt.Errorf("%w: unknown endpoint %q", errBadBenchArgs, e)
+		}
+	}
+	if len(c.endpoints) == 0 || c.concurrency < 1 || c.duration <= 0 || c.timeout <= 0 {
+		return nil, fmt.Errorf("%w: need endpoints, concurrency, duration, and timeout", errBadBenchArgs)
+	}
+	if !strings.HasPrefix(c.proxyPath, "/") {
+		c.proxyPath = "/" + c.proxyPath
+	}
+	return c, nil
+}
+
+// runBench implements "nitriding bench", which drives load against an
+// enclave from outside the enclave, and writes the latency percentiles of
+// each endpoint to the given writer.  Operators can use the numbers to size
+// an enclave's CPUs and memory before going into production.
+func runBench(args []string, out io.Writer) error {
+	c, err := parseBenchArgs(args, out)
+	if err != nil {
+		return err
+	}
+
+	t := newOutboundTransport()
+	t.MaxIdleConnsPerHost = c.concurrency
+	if c.insecure {
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	client := &http.Client{Transport: t, Timeout: c.timeout}
+
+	results := make([]*benchResult, len(c.endpoints))
+	for i, endpoint := range c.endpoints {
+		fmt.Fprintf(out, "Driving load against %s for %s with %d concurrent requests.\n",
+			endpoint, c.duration, c.concurrency)
+		results[i] = benchEndpoint(client, c, endpoint)
+	}
+	writeBenchReport(out, results)
+	return nil
+}
+
+// benchURL returns a URL for the given endpoint.  Attestation URLs carry a
+// fresh nonce, like those of real clients.
+func benchURL(c *benchConfig, endpoint string) (string, error) {
+	u := *c.target
+	if endpoint == benchProxy {
+		u.Path = c.proxyPath
+		return u.String(), nil
+	}
+	n, err := newNonce()
+	if err != nil {
+		return "", err
+	}
+	u.Path = pathAttestation
+	u.RawQuery = url.Values{"nonce": {hex.EncodeToString(n[:])}}.Encode()
+	return u.String(), nil
+}
+
+// benchEndpoint sends requests to the given endpoint from the configured
+// number of goroutines until the configured duration elapsed.  Requests that
+// fail or don't return a 2xx status code count as errors.
+func benchEndpoint(client *http.Client, c *benchConfig, endpoint string) *benchResult {
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		res = &benchResult{endpoint: endpoint}
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), c.duration)
+	defer cancel()
+
+	start := time.Now()
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var (
+				latencies []time.Duration
+				errs      int
+			)
+			for ctx.Err() == nil {
+				begin := time.Now()
+				if err := benchRequest(client, c, endpoint); err != nil {
+					errs++
+					continue
+				}
+				latencies = append(latencies, time.Since(begin))
+			}
+			mu.Lock()
+			res.latencies = append(res.latencies, latencies...)
+			res.errors += errs
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	slices.Sort(res.latencies)
+	return res
+}
+
+// benchRequest sends a single request to the given endpoint, and returns an
+// error if the request failed.
+func benchRequest(client *http.Client, c *benchConfig, endpoint string) error {
+	u, err := benchURL(c, endpoint)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read the body, so we measure the entire response, and can reuse the
+	// connection.
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// percentile returns the given percentile (between 0 and 100) of the
+// result's latencies, which must be sorted.
+func (r *benchResult) percentile(p int) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := (len(r.latencies) - 1) * p / 100
+	return r.latencies[i]
+}
+
+// writeBenchReport writes a table of the given results to the given writer.
+func writeBenchReport(out io.Writer, results []*benchResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "endpoint\trequests\terrors\treq/s\tp50\tp90\tp99\tmax")
+	for _, r := range results {
+		requests := len(r.latencies) + r.errors
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\n",
+			r.endpoint,
+			requests,
+			r.errors,
+			float64(requests)/r.elapsed.Seconds(),
+			r.percentile(50).Round(time.Microsecond),
+			r.percentile(90).Round(time.Microsecond),
+			r.percentile(99).Round(time.Microsecond),
+			r.percentile(100).Round(time.Microsecond))
+	}
+	_ = w.Flush()
+}
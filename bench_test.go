@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBenchArgs(t *testing.T) {
+	c, err := parseBenchArgs([]string{"-endpoints", "proxy", "-proxy-path", "api", "https://example.com"}, io.Discard)
+	failOnErr(t, err)
+	assertEqual(t, strings.Join(c.endpoints, ","), benchProxy)
+	assertEqual(t, c.proxyPath, "/api")
+	assertEqual(t, c.concurrency, defaultBenchConcurrency)
+
+	for _, args := range [][]string{
+		{},                                 // No URL.
+		{"example.com"},                    // No HTTP URL.
+		{"https://a.com", "https://b.com"}, // Too many URLs.
+		{"-endpoints", "nonce", "https://example.com"},
+		{"-concurrency", "0", "https://example.com"},
+		{"-duration", "0s", "https://example.com"},
+	} {
+		if _, err := parseBenchArgs(args, io.Discard); !errors.Is(err, errBadBenchArgs) {
+			t.Fatalf("Expected error %v for %v but got %v.", errBadBenchArgs, args, err)
+		}
+	}
+}
+
+func TestBenchPercentile(t *testing.T) {
+	r := &benchResult{}
+	assertEqual(t, r.percentile(99), time.Duration(0))
+	for i := 1; i <= 100; i++ {
+		r.latencies = append(r.latencies, time.Duration(i))
+	}
+	assertEqual(t, r.percentile(50), time.Duration(50))
+	assertEqual(t, r.percentile(99), time.Duration(99))
+	assertEqual(t, r.percentile(100), time.Duration(100))
+}
+
+func TestRunBench(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case pathAttestation:
+			if _, err := getNonceFromReq(r); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		case "/api":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	failOnErr(t, runBench([]string{
+		"-insecure", "-duration", "100ms", "-concurrency", "2", "-proxy-path", "/api", srv.URL,
+	}, &out))
+
+	// Both endpoints must have served requests without errors.
+	for _, endpoint := range []string{benchAttestation, benchProxy} {
+		var row []string
+		for _, line := range strings.Split(out.String(), "\n") {
+			if fields := strings.Fields(line); len(fields) == 8 && fields[0] == endpoint {
+				row = fields
+			}
+		}
+		if row == nil {
+			t.Fatalf("Report lacks row for %s:\n%s", endpoint, out.String())
+		}
+		assertEqual(t, row[1] != "0", true)
+		assertEqual(t, row[2], "0")
+	}
+}
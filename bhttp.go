@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// We implement the parts of Binary HTTP (RFC 9292) that an Oblivious HTTP
+// gateway needs: we decode requests in both known-length and
+// indeterminate-length form, and encode responses in known-length form.  See:
+// https://www.rfc-editor.org/rfc/rfc9292.html
+const (
+	bhttpKnownLenReq  = 0
+	bhttpKnownLenResp = 1
+	bhttpIndefLenReq  = 2
+	// The maximum number of field lines per field section that we decode.
+	bhttpMaxFieldLines = 1000
+)
+
+var (
+	errBHTTPMalformed = errors.New("malformed binary HTTP message")
+	errBHTTPFraming   = errors.New("unsupported binary HTTP framing")
+)
+
+// bhttpDecoder reads the fields of a binary HTTP message.
+type bhttpDecoder struct {
+	buf []byte
+}
+
+// varint reads a QUIC variable-length integer (RFC 9000, Section 16).
+func (d *bhttpDecoder) varint() (uint64, error) {
+	if len(d.buf) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := 1 << (d.buf[0] >> 6)
+	if len(d.buf) < n {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := uint64(d.buf[0] & 0x3f)
+	for _, b := range d.buf[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+// bytes reads a length-prefixed byte string.
+func (d *bhttpDecoder) bytes() ([]byte, error) {
+	n, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+// done returns true if the rest of the message is empty or padding.  Binary
+// HTTP messages may be truncated after any section, in which case the
+// remaining sections are empty.
+func (d *bhttpDecoder) done() bool {
+	for _, b := range d.buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldLine reads a field line and adds it to the given header.
+func (d *bhttpDecoder) fieldLine(h http.Header, name []byte) error {
+	value, err := d.bytes()
+	if err != nil {
+		return err
+	}
+	h.Add(string(name), string(value))
+	return nil
+}
+
+// knownLenFields reads a known-length field section.
+func (d *bhttpDecoder) knownLenFields() (http.Header, error) {
+	h := make(http.Header)
+	if d.done() {
+		return h, nil
+	}
+	section, err := d.bytes()
+	if err != nil {
+		return nil, err
+	}
+	sub := &bhttpDecoder{buf: section}
+	for i := 0; len(sub.buf) > 0; i++ {
+		if i == bhttpMaxFieldLines {
+			return nil, fmt.Errorf("%w: too many field lines", errBHTTPMalformed)
+		}
+		name, err := sub.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := sub.fieldLine(h, name); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// indefLenFields reads an indeterminate-length field section, which ends with
+// an empty field name.
+func (d *bhttpDecoder) indefLenFields() (http.Header, error) {
+	h := make(http.Header)
+	if d.done() {
+		return h, nil
+	}
+	for i := 0; ; i++ {
+		if i == bhttpMaxFieldLines {
+			return nil, fmt.Errorf("%w: too many field lines", errBHTTPMalformed)
+		}
+		name, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(name) == 0 {
+			return h, nil
+		}
+		if err := d.fieldLine(h, name); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// indefLenContent reads indeterminate-length content, which consists of
+// chunks and ends with an empty chunk.
+func (d *bhttpDecoder) indefLenContent() ([]byte, error) {
+	var content []byte
+	if d.done() {
+		return content, nil
+	}
+	for {
+		chunk, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			return content, nil
+		}
+		content = append(content, chunk...)
+	}
+}
+
+// decodeBHTTPRequest decodes the given binary HTTP request.  The returned
+// request lacks a context and a remote address.
+func decodeBHTTPRequest(msg []byte) (*http.Request, error) {
+	d := &bhttpDecoder{buf: msg}
+	framing, err := d.varint()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBHTTPMalformed, err)
+	}
+	if framing != bhttpKnownLenReq && framing != bhttpIndefLenReq {
+		return nil, fmt.Errorf("%w: %d", errBHTTPFraming, framing)
+	}
+	knownLen := framing == bhttpKnownLenReq
+
+	var control [4][]byte // Method, scheme, authority, and path.
+	for i := range control {
+		if control[i], err = d.bytes(); err != nil {
+			return nil, fmt.Errorf("%w: %v", errBHTTPMalformed, err)
+		}
+	}
+	var (
+		header, trailer http.Header
+		content         []byte
+	)
+	if knownLen {
+		header, err = d.knownLenFields()
+		if err == nil && !d.done() {
+			content, err = d.bytes()
+		}
+		if err == nil {
+			trailer, err = d.knownLenFields()
+		}
+	} else {
+		header, err = d.indefLenFields()
+		if err == nil {
+			content, err = d.indefLenContent()
+		}
+		if err == nil {
+			trailer, err = d.indefLenFields()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBHTTPMalformed, err)
+	}
+	if !d.done() {
+		return nil, fmt.Errorf("%w: trailing data", errBHTTPMalformed)
+	}
+
+	method, scheme, authority, path := string(control[0]), string(control[1]), string(control[2]), string(control[3])
+	if authority == "" {
+		authority = header.Get("Host")
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil || method == "" {
+		return nil, fmt.Errorf("%w: bad method or path", errBHTTPMalformed)
+	}
+	u.Scheme, u.Host = scheme, authority
+	header.Del("Host")
+	r := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Host:          authority,
+		ContentLength: int64(len(content)),
+		Body:          io.NopCloser(bytes.NewReader(content)),
+		RequestURI:    path,
+	}
+	if len(trailer) > 0 {
+		r.Trailer = trailer
+	}
+	return r, nil
+}
+
+// appendVarint appends the given value as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// appendBHTTPBytes appends the given length-prefixed byte string.
+func appendBHTTPBytes(b, s []byte) []byte {
+	return append(appendVarint(b, uint64(len(s))), s...)
+}
+
+// appendBHTTPFields appends the given header as a known-length field
+// section.  Binary HTTP requires lowercase field names.
+func appendBHTTPFields(b []byte, h http.Header) []byte {
+	var section []byte
+	for name, values := range h {
+		for _, value := range values {
+			section = appendBHTTPBytes(section, []byte(strings.ToLower(name)))
+			section = appendBHTTPBytes(section, []byte(value))
+		}
+	}
+	return appendBHTTPBytes(b, section)
+}
+
+// encodeBHTTPResponse encodes the given response as a known-length binary
+// HTTP response.
+func encodeBHTTPResponse(status int, header, trailer http.Header, content []byte) []byte {
+	b := appendVarint(nil, bhttpKnownLenResp)
+	b = appendVarint(b, uint64(status))
+	b = appendBHTTPFields(b, header)
+	b = appendBHTTPBytes(b, content)
+	return appendBHTTPFields(b, trailer)
+}
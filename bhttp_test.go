@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// encodeBHTTPRequest encodes a known-length binary HTTP request the way
+// OHTTP clients do.
+func encodeBHTTPRequest(method, scheme, authority, path string, header http.Header, content []byte) []byte {
+	b := appendVarint(nil, bhttpKnownLenReq)
+	for _, s := range []string{method, scheme, authority, path} {
+		b = appendBHTTPBytes(b, []byte(s))
+	}
+	b = appendBHTTPFields(b, header)
+	b = appendBHTTPBytes(b, content)
+	return appendBHTTPFields(b, nil)
+}
+
+// decodeBHTTPResponse decodes a known-length binary HTTP response the way
+// OHTTP clients do.
+func decodeBHTTPResponse(t *testing.T, msg []byte) (int, http.Header, []byte) {
+	t.Helper()
+	d := &bhttpDecoder{buf: msg}
+	framing, err := d.varint()
+	failOnErr(t, err)
+	assertEqual(t, framing, uint64(bhttpKnownLenResp))
+	status, err := d.varint()
+	failOnErr(t, err)
+	header, err := d.knownLenFields()
+	failOnErr(t, err)
+	content, err := d.bytes()
+	failOnErr(t, err)
+	_, err = d.knownLenFields()
+	failOnErr(t, err)
+	return int(status), header, content
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+		d := &bhttpDecoder{buf: appendVarint(nil, v)}
+		got, err := d.varint()
+		failOnErr(t, err)
+		assertEqual(t, got, v)
+		assertEqual(t, len(d.buf), 0)
+	}
+	// RFC 9000, Appendix A.1.
+	d := &bhttpDecoder{buf: []byte{0x9d, 0x7f, 0x3e, 0x7d}}
+	got, err := d.varint()
+	failOnErr(t, err)
+	assertEqual(t, got, uint64(494878333))
+}
+
+func TestDecodeBHTTPRequest(t *testing.T) {
+	header := http.Header{"User-Agent": {"test"}, "Accept": {"text/plain", "text/html"}}
+	msg := encodeBHTTPRequest(http.MethodPost, "https", "example.com", "/foo?bar=baz", header, []byte("body"))
+	// Padding must be ignored.
+	msg = append(msg, 0, 0, 0)
+	r, err := decodeBHTTPRequest(msg)
+	failOnErr(t, err)
+	assertEqual(t, r.Method, http.MethodPost)
+	assertEqual(t, r.Host, "example.com")
+	assertEqual(t, r.URL.String(), "https://example.com/foo?bar=baz")
+	assertEqual(t, r.Header.Get("User-Agent"), "test")
+	assertEqual(t, len(r.Header.Values("Accept")), 2)
+	body, err := io.ReadAll(r.Body)
+	failOnErr(t, err)
+	assertEqual(t, string(body), "body")
+
+	// Binary HTTP allows truncating messages after the control data.
+	b := appendVarint(nil, bhttpKnownLenReq)
+	for _, s := range []string{http.MethodGet, "https", "example.com", "/"} {
+		b = appendBHTTPBytes(b, []byte(s))
+	}
+	r, err = decodeBHTTPRequest(b)
+	failOnErr(t, err)
+	assertEqual(t, r.ContentLength, int64(0))
+
+	// Indeterminate-length requests consist of chunks and terminators.
+	b = appendVarint(nil, bhttpIndefLenReq)
+	for _, s := range []string{http.MethodPut, "https", "", "/"} {
+		b = appendBHTTPBytes(b, []byte(s))
+	}
+	b = appendBHTTPBytes(appendBHTTPBytes(b, []byte("host")), []byte("example.com"))
+	b = appendVarint(b, 0)
+	b = appendBHTTPBytes(appendBHTTPBytes(b, []byte("foo")), []byte("bar"))
+	b = appendVarint(b, 0)
+	r, err = decodeBHTTPRequest(b)
+	failOnErr(t, err)
+	assertEqual(t, r.Host, "example.com")
+	assertEqual(t, r.Header.Get("Host"), "")
+	body, err = io.ReadAll(r.Body)
+	failOnErr(t, err)
+	assertEqual(t, string(body), "foobar")
+
+	// Responses are not requests.
+	_, err = decodeBHTTPRequest(encodeBHTTPResponse(http.StatusOK, nil, nil, nil))
+	assertEqual(t, errors.Is(err, errBHTTPFraming), true)
+	// Truncated strings are malformed.
+	_, err = decodeBHTTPRequest(msg[:10])
+	assertEqual(t, errors.Is(err, errBHTTPMalformed), true)
+	_, err = decodeBHTTPRequest(append(msg, 1))
+	assertEqual(t, errors.Is(err, errBHTTPMalformed), true)
+}
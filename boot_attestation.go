@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errNoBootAttstn = errors.New("boot attestation document not yet available")
+
+// createBootAttstn creates the attestation document that we serve at
+// /enclave/attestation?boot=true once we have our certificate and key
+// material, so the document contains their hashes.  Creating the document
+// also opens our session with the NSM before the first client asks for an
+// attestation document.  The boot document contains an all-zero nonce, so it
+// proves what the enclave ran at startup but not that it is still running.
+func (e *Enclave) createBootAttstn(publicKey []byte) {
+	defer reportPanic()
+	if !e.startup.wait([]string{appPrereqCert, appPrereqKeys}, e.stop) {
+		return
+	}
+	rawDoc, err := e.attester.createAttstn(&clientAuxInfo{
+		attestationHashes: e.hashes.Serialize(),
+		publicKey:         publicKey,
+	})
+	if err != nil {
+		ops.attestationErrors.Add(1)
+		elog.Warn("Failed to create boot attestation document.", "error", err)
+		return
+	}
+	ops.attestations.Add(1)
+	e.bootAttstn.Store(&rawDoc)
+	elog.Info("Created boot attestation document.")
+}
+
+// bootAttstnHandler returns an HTTP handler that serves our boot attestation
+// document if the request has the URL parameter "boot=true", and defers to
+// the given handler otherwise.  The boot document is cached, so it doesn't
+// require a proof of work.
+func bootAttstnHandler(e *Enclave, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("boot") != "true" {
+			next(w, r)
+			return
+		}
+		if e.cfg.UseProfiling {
+			httpError(w, r, errProfilingSet, http.StatusServiceUnavailable)
+			return
+		}
+		contentType := negotiateContentType(r.Header.Get("Accept"), attestationTypes)
+		if contentType == "" {
+			httpError(w, r, errNotAcceptable, http.StatusNotAcceptable)
+			return
+		}
+		rawDoc := e.bootAttstn.Load()
+		if rawDoc == nil {
+			httpError(w, r, errNoBootAttstn, http.StatusServiceUnavailable)
+			return
+		}
+		writeAttstn(w, contentType, *rawDoc)
+	}
+}
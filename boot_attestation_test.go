@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestBootAttstn(t *testing.T) {
+	c := defaultCfg
+	c.AttestationPoWBits = 8
+	e := createEnclave(&c)
+	makeReq := makeReqToSrv(e.extPubSrv)
+	path := pathAttestation + "?boot=true"
+
+	// We don't have a boot document until we met our prerequisites.
+	assertResponse(t,
+		makeReq(http.MethodGet, path, nil),
+		newErrResp(http.StatusServiceUnavailable, errNoBootAttstn),
+	)
+
+	e.startup.markMet(appPrereqCert)
+	e.startup.markMet(appPrereqKeys)
+	e.createBootAttstn(nil)
+
+	// The boot document requires neither a nonce nor a proof of work.
+	rawDoc, err := e.attester.createAttstn(&clientAuxInfo{attestationHashes: e.hashes.Serialize()})
+	failOnErr(t, err)
+	resp := makeReq(http.MethodGet, path, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	body, err := io.ReadAll(resp.Body)
+	failOnErr(t, err)
+	assertEqual(t, string(body), base64.StdEncoding.EncodeToString(rawDoc)+"\n")
+
+	// Without "boot=true", clients still need a nonce.
+	assertResponse(t,
+		makeReq(http.MethodGet, pathAttestation+"?boot=false", nil),
+		newErrResp(http.StatusBadRequest, errNoNonce),
+	)
+}
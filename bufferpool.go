@@ -9,20 +9,25 @@ import (
 // https://cs.opensource.google/go/go/+/refs/tags/go1.20.3:src/net/http/httputil/reverseproxy.go;l=634
 const bufSize = 32 * 1024
 
+// frameBufPool holds the buffers that forward frames between the TAP device
+// and the host proxy.  Each buffer fits a frame plus its length prefix, and
+// the buffers are reused whenever we reconnect to the host.
+var frameBufPool = newBufPool(frameSizeLen + frameLen)
+
 // bufPool implements the httputil.BufferPool interface.  The implementation is
-// based on sync.Pool.
+// based on sync.Pool, and all buffers have the same size.
 type bufPool struct {
 	sync.Pool
 }
 
-func newBufPool() *bufPool {
+func newBufPool(size int) *bufPool {
 	return &bufPool{
 		Pool: sync.Pool{
 			New: func() any {
 				// The Pool's New function should generally only return pointer
 				// types, since a pointer can be put into the return interface
 				// value without an allocation:
-				s := make([]byte, bufSize)
+				s := make([]byte, size)
 				return &s
 			},
 		},
@@ -3,7 +3,7 @@ package main
 import "testing"
 
 func TestBufPool(t *testing.T) {
-	p := newBufPool()
+	p := newBufPool(bufSize)
 	s1 := p.Get()
 	p.Put(s1)
 	s2 := p.Get()
@@ -12,3 +12,12 @@ func TestBufPool(t *testing.T) {
 		t.Fatalf("Byte slices have different lengths (%d vs %d).", len(s1), len(s2))
 	}
 }
+
+func TestFrameBufPool(t *testing.T) {
+	buf := frameBufPool.Get()
+	defer frameBufPool.Put(buf)
+
+	if len(buf) != frameSizeLen+frameLen {
+		t.Fatalf("Expected frame buffer of %d bytes but got %d.", frameSizeLen+frameLen, len(buf))
+	}
+}
@@ -1,63 +1,215 @@
 package main
 
 import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"sync"
 	"time"
 )
 
-// cache implements a simple cache whose items expire.
+const (
+	// defaultCacheMaxItems is the default maximum number of items in a cache.
+	// Enclaves have little memory, so we cannot let adversaries grow our
+	// cache without bound.
+	defaultCacheMaxItems = 10000
+	// cacheShards is the number of shards of caches that hold at least
+	// minShardedCacheItems items.  Smaller caches have a single shard.
+	cacheShards          = 16
+	minShardedCacheItems = 1024
+)
+
+// cacheItem is an item in our cache.
+type cacheItem struct {
+	key   string
+	added time.Time
+}
+
+// cache implements a simple cache whose items expire.  The cache holds up to
+// a maximum number of items.  Once it's full, adding an item evicts the least
+// recently used item.
+//
+// We don't index items by their key but by a keyed hash over it.  Looking up a
+// key compares hashes that an adversary cannot predict, so the lookup time
+// doesn't tell the adversary how close a guessed key is to a cached key.
+//
+// Concurrent requests would contend for a single lock, so we split large
+// caches into shards, each of which has its own lock, and pick an item's shard
+// by its keyed hash.  An adversary therefore cannot direct items at a single
+// shard.  Each shard evicts its own least recently used item, so eviction
+// across the cache only approximates LRU order.
 type cache struct {
-	sync.RWMutex
-	Items map[string]time.Time
-	TTL   time.Duration
+	TTL      time.Duration
+	MaxItems int
+	shards   []*cacheShard
+	// secret is the key of the hash that we index items by.
+	secret [sha256.Size]byte
+}
+
+// cacheShard holds a share of a cache's items.
+type cacheShard struct {
+	sync.Mutex
+	items    map[string]*list.Element
+	ttl      time.Duration
+	maxItems int
+	// lru orders our items from most recently used (front) to least recently
+	// used (back).
+	lru *list.List
 }
 
 // newCache creates and returns a new cache with the given lifetime for cache
-// items.
-func newCache(ttl time.Duration) *cache {
-	return &cache{
-		Items: make(map[string]time.Time),
-		TTL:   ttl,
+// items and the given maximum number of items.  If the maximum is not
+// positive, we use defaultCacheMaxItems.
+func newCache(ttl time.Duration, maxItems int) *cache {
+	if maxItems <= 0 {
+		maxItems = defaultCacheMaxItems
+	}
+	shards := 1
+	if maxItems >= minShardedCacheItems {
+		shards = cacheShards
+	}
+	return newShardedCache(ttl, maxItems, shards)
+}
+
+// newShardedCache creates and returns a new cache with the given number of
+// shards, among which we split the given maximum number of items.
+func newShardedCache(ttl time.Duration, maxItems, shards int) *cache {
+	c := &cache{
+		TTL:      ttl,
+		MaxItems: maxItems,
+		shards:   make([]*cacheShard, shards),
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			items: make(map[string]*list.Element),
+			ttl:   ttl,
+			// Round up, so the shards hold at least maxItems in total.
+			maxItems: (maxItems + shards - 1) / shards,
+			lru:      list.New(),
+		}
+	}
+	if _, err := rand.Read(c.secret[:]); err != nil {
+		fatal("Failed to create cache secret.", "error", err)
 	}
+	return c
+}
+
+// index returns the keyed hash over the given key, which we index items by.
+func (c *cache) index(key string) string {
+	mac := hmac.New(sha256.New, c.secret[:])
+	mac.Write([]byte(key))
+	return string(mac.Sum(nil))
+}
+
+// shard returns the shard that holds the item with the given index.
+func (c *cache) shard(index string) *cacheShard {
+	return c.shards[int(index[0])%len(c.shards)]
 }
 
-// Count returns the number of elements in the cache.
+// Count returns the number of unexpired elements in the cache.
 func (c *cache) Count() int {
-	c.RLock()
-	defer c.RUnlock()
+	count := 0
+	for _, s := range c.shards {
+		s.Lock()
+		s.prune()
+		count += len(s.items)
+		s.Unlock()
+	}
+	return count
+}
 
-	return len(c.Items)
+// prune removes all expired items from the shard.  The caller must hold the
+// shard's lock.
+func (s *cacheShard) prune() {
+	for key, elem := range s.items {
+		if s.isExpired(elem) {
+			s.remove(key, elem)
+		}
+	}
 }
 
-// pruneLater prunes the given element after ttl.
-func (c *cache) pruneLater(key string, ttl time.Duration) {
-	time.Sleep(ttl)
+// isExpired returns true if the given cache element is older than our TTL.
+func (s *cacheShard) isExpired(elem *list.Element) bool {
+	return time.Since(elem.Value.(*cacheItem).added) >= s.ttl
+}
 
-	c.Lock()
-	defer c.Unlock()
-	delete(c.Items, key)
+// remove deletes the given element from the shard.  The caller must hold the
+// shard's lock.
+func (s *cacheShard) remove(key string, elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.items, key)
 }
 
-// Add adds a new string item to the cache.
+// Add adds a new string item to the cache.  If the item's shard is full, we
+// first drop expired items and, if that's not enough, the shard's least
+// recently used item.
 func (c *cache) Add(key string) {
-	c.Lock()
-	defer c.Unlock()
+	key = c.index(key)
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
 
-	c.Items[key] = time.Now().UTC()
-	// Spawn a goroutine that deletes the given element after TTL.  Note that
-	// the enclave's endpoint for requesting nonces should not be exposed to
-	// the Internet because it would allow adversaries to request nonces at a
-	// high rate, thus spawning many goroutines, which would constitute a
-	// resource DoS attack.
-	go c.pruneLater(key, c.TTL)
+	if elem, exists := s.items[key]; exists {
+		elem.Value.(*cacheItem).added = time.Now().UTC()
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.insert(key)
+}
+
+// AddIfAbsent adds the given string item to the cache and returns true,
+// unless the item already exists in the cache, in which case it returns
+// false.  Unlike calling Exists and then Add, checking and adding the item is
+// atomic, so of several concurrent callers with the same item, only one
+// succeeds.
+func (c *cache) AddIfAbsent(key string) bool {
+	key = c.index(key)
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if elem, exists := s.items[key]; exists {
+		if !s.isExpired(elem) {
+			s.lru.MoveToFront(elem)
+			return false
+		}
+		s.remove(key, elem)
+	}
+	s.insert(key)
+	return true
+}
+
+// insert adds the item with the given index, which must not exist yet, to
+// the shard.  The caller must hold the shard's lock.
+func (s *cacheShard) insert(key string) {
+	if len(s.items) >= s.maxItems {
+		s.prune()
+	}
+	for len(s.items) >= s.maxItems {
+		oldest := s.lru.Back()
+		s.remove(oldest.Value.(*cacheItem).key, oldest)
+		ops.nonceCacheEvictions.Add(1)
+	}
+	s.items[key] = s.lru.PushFront(&cacheItem{key: key, added: time.Now().UTC()})
 }
 
 // Exists returns true if the given string item exists in the cache.  If the
 // item exists but is expired, the function returns false.
 func (c *cache) Exists(key string) bool {
-	c.RLock()
-	defer c.RUnlock()
-	_, exists := c.Items[key]
+	key = c.index(key)
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
 
-	return exists
+	elem, exists := s.items[key]
+	if !exists {
+		return false
+	}
+	if s.isExpired(elem) {
+		s.remove(key, elem)
+		return false
+	}
+	s.lru.MoveToFront(elem)
+	return true
 }
@@ -2,12 +2,14 @@ package main
 
 import (
 	"fmt"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestCache(t *testing.T) {
-	c := newCache(time.Millisecond * 50)
+	c := newCache(time.Millisecond*50, 0)
 	elem := "foo"
 
 	c.Add(elem)
@@ -28,7 +30,7 @@ func TestCache(t *testing.T) {
 }
 
 func TestCacheWithManyElems(t *testing.T) {
-	c := newCache(time.Millisecond * 50)
+	c := newCache(time.Millisecond*50, 0)
 
 	// Add 100 items.
 	for i := 0; i < 100; i++ {
@@ -49,3 +51,135 @@ func TestCacheWithManyElems(t *testing.T) {
 		t.Fatalf("Expected 100 but got %d elems in cache.", count)
 	}
 }
+
+func TestCacheEvictsLRU(t *testing.T) {
+	c := newCache(time.Minute, 3)
+	evictions := ops.nonceCacheEvictions.Load()
+
+	c.Add("a")
+	c.Add("b")
+	c.Add("c")
+	// Use "a", which makes "b" the least recently used item.
+	if !c.Exists("a") {
+		t.Fatal("Expected element not found in cache.")
+	}
+	c.Add("d")
+
+	assertEqual(t, c.Count(), 3)
+	assertEqual(t, c.Exists("b"), false)
+	for _, key := range []string{"a", "c", "d"} {
+		if !c.Exists(key) {
+			t.Errorf("Expected element %q not found in cache.", key)
+		}
+	}
+	assertEqual(t, ops.nonceCacheEvictions.Load(), evictions+1)
+}
+
+func TestCachePrefersExpiredItems(t *testing.T) {
+	c := newCache(time.Millisecond*50, 2)
+	evictions := ops.nonceCacheEvictions.Load()
+
+	c.Add("a")
+	time.Sleep(time.Millisecond * 100)
+	c.Add("b")
+	// The cache is full, but "a" expired, so there's no need to evict "b".
+	c.Add("c")
+
+	assertEqual(t, c.Exists("b"), true)
+	assertEqual(t, c.Exists("c"), true)
+	assertEqual(t, ops.nonceCacheEvictions.Load(), evictions)
+}
+
+func TestCacheHidesKeys(t *testing.T) {
+	c := newCache(time.Minute, 0)
+	c.Add("foo")
+
+	// Items must be indexed by a keyed hash, not by the key itself.
+	_, exists := c.shards[0].items["foo"]
+	assertEqual(t, exists, false)
+	assertEqual(t, c.Exists("foo"), true)
+	assertEqual(t, newCache(time.Minute, 0).index("foo") == c.index("foo"), false)
+}
+
+func TestShardedCache(t *testing.T) {
+	c := newCache(time.Minute, 0)
+	assertEqual(t, len(c.shards), cacheShards)
+	assertEqual(t, len(newCache(time.Minute, minShardedCacheItems-1).shards), 1)
+
+	for i := 0; i < 1000; i++ {
+		c.Add(fmt.Sprintf("%d", i))
+	}
+	assertEqual(t, c.Count(), 1000)
+	// The keyed hash spreads items across all shards.
+	for i, s := range c.shards {
+		if len(s.items) == 0 {
+			t.Errorf("Shard %d holds no items.", i)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if !c.Exists(fmt.Sprintf("%d", i)) {
+			t.Fatalf("Expected element %d not found in cache.", i)
+		}
+	}
+}
+
+// benchmarkCache adds and looks up items concurrently, and reports the 99th
+// percentile of the operations' latency.  Each goroutine cycles through a few
+// keys, so the cache never fills up, and we measure lock contention rather
+// than eviction.
+func benchmarkCache(b *testing.B, shards int) {
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+	)
+	c := newShardedCache(time.Minute, defaultCacheMaxItems, shards)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var local []time.Duration
+		for i := 0; pb.Next(); i++ {
+			key := fmt.Sprintf("%p-%d", &local, i%256)
+			start := time.Now()
+			c.Add(key)
+			c.Exists(key)
+			local = append(local, time.Since(start))
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	slices.Sort(latencies)
+	if len(latencies) > 0 {
+		b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns/op")
+	}
+}
+
+func BenchmarkCacheSingleShard(b *testing.B) { benchmarkCache(b, 1) }
+func BenchmarkCacheSharded(b *testing.B)     { benchmarkCache(b, cacheShards) }
+
+func TestCacheAddIfAbsent(t *testing.T) {
+	c := newCache(time.Millisecond*50, 0)
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		added int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.AddIfAbsent("foo") {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, added, 1)
+
+	// Once expired, the element can be added again.
+	time.Sleep(time.Millisecond * 100)
+	assertEqual(t, c.AddIfAbsent("foo"), true)
+}
@@ -0,0 +1,245 @@
+// Package client connects Go clients to nitriding enclaves.  Before a Dialer
+// hands out a connection, it fetches the enclave's attestation document over
+// the connection, verifies the document's measurements against an expected
+// policy, and makes sure that the document binds the enclave's TLS
+// certificate.  A Verifier implements the nonce and attestation exchange for
+// clients that bring their own connections.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+const (
+	// pathAttestation is nitriding's attestation endpoint.
+	pathAttestation = "/enclave/attestation"
+	// nonceLen is the size of the nonces that nitriding expects, in bytes.
+	nonceLen         = 20
+	contentTypeCBOR  = "application/cbor"
+	maxAttstnDocSize = 1 << 16
+)
+
+var (
+	ErrPCRMismatch         = errors.New("attestation document's PCR value doesn't match policy")
+	ErrNonceMismatch       = errors.New("attestation document doesn't contain our nonce")
+	ErrFingerprintMismatch = errors.New("attestation document doesn't contain the enclave's certificate fingerprint")
+	ErrNoPCRs              = errors.New("policy expects no PCR values")
+
+	errUnexpectedData = errors.New("enclave sent unexpected data after attestation document")
+
+	// hashPrefix is the multihash prefix of a SHA-256 hash, which precedes
+	// the certificate fingerprint in the attestation document's user data.
+	hashPrefix = []byte{0x12, sha256.Size}
+
+	// verifyAttstn verifies the given attestation document and returns its
+	// content.  Using a variable allows us to mock the function in our unit
+	// tests.
+	verifyAttstn = func(doc []byte, roots *x509.CertPool) (*nitrite.Document, error) {
+		res, err := nitrite.Verify(doc, nitrite.VerifyOptions{Roots: roots, CurrentTime: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+		return res.Document, nil
+	}
+)
+
+// Policy determines which enclaves we trust.
+type Policy struct {
+	// PCRs maps PCR indexes to the values that the enclave's attestation
+	// document must contain, e.g., 0 to the SHA-384 hash over the enclave
+	// image.  PCRs that are missing from the map may have any value.
+	PCRs map[uint][]byte
+	// Roots contains the root certificates of attestation documents.  If
+	// nil, we use the AWS Nitro Enclaves root certificate.  Tests can set it
+	// to the root certificate of a fake NSM.
+	Roots *x509.CertPool
+}
+
+// verify returns an error if the given attestation document doesn't satisfy
+// the policy.
+func (p *Policy) verify(doc *nitrite.Document) error {
+	for pcr, expected := range p.PCRs {
+		if !bytes.Equal(doc.PCRs[pcr], expected) {
+			return fmt.Errorf("%w: PCR%d is %x", ErrPCRMismatch, pcr, doc.PCRs[pcr])
+		}
+	}
+	return nil
+}
+
+// Dialer dials TLS connections to enclaves that satisfy its policy.  Once a
+// Dialer verified an enclave's attestation document, it pins the enclave's
+// certificate fingerprint, and subsequent connections to the same address
+// that present the same certificate skip attestation.  If the enclave's
+// certificate changes, e.g., because it was renewed, the Dialer verifies a
+// fresh attestation document.  A Dialer is safe for concurrent use.
+type Dialer struct {
+	// Policy determines which enclaves the Dialer trusts.
+	Policy Policy
+	// NetDialer dials the underlying TCP connections.  If nil, the Dialer
+	// uses a zero net.Dialer.
+	NetDialer *net.Dialer
+	// MaxAge is the maximum age of attestation documents.  If zero, the
+	// Dialer uses DefaultMaxAge.
+	MaxAge time.Duration
+
+	sync.Mutex // Guard pinned.
+	pinned     map[string][sha256.Size]byte
+}
+
+// DialAttestedTLS dials a TLS connection to the enclave at the given address,
+// e.g., "example.com:443", and returns the connection once the enclave's
+// attestation document satisfies the given policy.
+func DialAttestedTLS(ctx context.Context, network, addr string, p *Policy) (*tls.Conn, error) {
+	d := &Dialer{Policy: *p}
+	return d.DialTLSContext(ctx, network, addr)
+}
+
+// DialContext implements the same interface as net.Dialer's DialContext, so
+// the Dialer can serve as an http.Transport's DialTLSContext.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.DialTLSContext(ctx, network, addr)
+}
+
+// DialTLSContext dials a TLS connection to the enclave at the given address,
+// and returns the connection once the enclave's attestation document
+// satisfies the Dialer's policy.  The returned connection speaks HTTP/1.1.
+func (d *Dialer) DialTLSContext(ctx context.Context, network, addr string) (*tls.Conn, error) {
+	if len(d.Policy.PCRs) == 0 {
+		return nil, ErrNoPCRs
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	netDialer := d.NetDialer
+	if netDialer == nil {
+		netDialer = new(net.Dialer)
+	}
+	tlsDialer := &tls.Dialer{
+		NetDialer: netDialer,
+		Config: &tls.Config{
+			ServerName: host,
+			// Enclaves may use self-signed certificates.  We trust the
+			// certificate because the attestation document binds it.
+			InsecureSkipVerify: true,
+			// We fetch the attestation document via HTTP/1.1 over the
+			// connection that we hand out.
+			NextProtos: []string{"http/1.1"},
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	c, err := tlsDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*tls.Conn)
+
+	fingerprint := sha256.Sum256(conn.ConnectionState().PeerCertificates[0].Raw)
+	if d.isPinned(addr, fingerprint) {
+		return conn, nil
+	}
+	if err := d.attest(ctx, conn, host, fingerprint); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	d.pin(addr, fingerprint)
+	return conn, nil
+}
+
+// attest fetches the enclave's attestation document over the given
+// connection, and returns an error if the document doesn't satisfy our
+// policy, or doesn't bind the given certificate fingerprint.
+func (d *Dialer) attest(ctx context.Context, conn *tls.Conn, host string, fingerprint [sha256.Size]byte) error {
+	n, err := newNonce()
+	if err != nil {
+		return err
+	}
+	rawDoc, err := fetchAttstn(ctx, conn, host, n)
+	if err != nil {
+		return err
+	}
+	doc, err := verifyDoc(rawDoc, n, &d.Policy, d.MaxAge)
+	if err != nil {
+		return err
+	}
+	// The user data begins with the multihash of the certificate
+	// fingerprint.
+	expected := append(bytes.Clone(hashPrefix), fingerprint[:]...)
+	if !bytes.HasPrefix(doc.UserData, expected) {
+		return ErrFingerprintMismatch
+	}
+	return nil
+}
+
+// fetchAttstn requests an attestation document that contains the given nonce
+// over the given connection, and returns the raw document.
+func fetchAttstn(ctx context.Context, conn *tls.Conn, host string, n []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     pathAttestation,
+		RawQuery: url.Values{"nonce": {hex.EncodeToString(n)}}.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", contentTypeCBOR)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rawDoc, err := readAttstn(resp)
+	if err != nil {
+		return nil, err
+	}
+	// The caller gets the connection without our reader, so we must not have
+	// buffered anything beyond the response.
+	if r.Buffered() > 0 {
+		return nil, errUnexpectedData
+	}
+	return rawDoc, nil
+}
+
+func (d *Dialer) isPinned(addr string, fingerprint [sha256.Size]byte) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	pinned, exists := d.pinned[addr]
+	return exists && pinned == fingerprint
+}
+
+func (d *Dialer) pin(addr string, fingerprint [sha256.Size]byte) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.pinned == nil {
+		d.pinned = make(map[string][sha256.Size]byte)
+	}
+	d.pinned[addr] = fingerprint
+}
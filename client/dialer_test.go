@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+var testPCR0 = bytes48(1)
+
+func bytes48(b byte) []byte {
+	pcr := make([]byte, 48)
+	pcr[0] = b
+	return pcr
+}
+
+// newTestEnclave returns a TLS server that mimics nitriding's attestation
+// endpoint.  Its "attestation documents" are JSON-encoded, and our mocked
+// verifier decodes them.  The given function can tamper with the documents.
+func newTestEnclave(t *testing.T, tamper func(*nitrite.Document)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var (
+		srv      *httptest.Server
+		attstns  = new(atomic.Int32)
+		origVrfy = verifyAttstn
+	)
+	verifyAttstn = func(doc []byte, _ *x509.CertPool) (*nitrite.Document, error) {
+		var d nitrite.Document
+		return &d, json.Unmarshal(doc, &d)
+	}
+	t.Cleanup(func() { verifyAttstn = origVrfy })
+
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != pathAttestation {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		attstns.Add(1)
+		n, _ := hex.DecodeString(r.URL.Query().Get("nonce"))
+		fingerprint := sha256.Sum256(srv.Certificate().Raw)
+		doc := &nitrite.Document{
+			PCRs:      map[uint][]byte{0: testPCR0},
+			Nonce:     n,
+			Timestamp: uint64(time.Now().UnixMilli()),
+			UserData:  append(append(hashPrefix, fingerprint[:]...), make([]byte, 68)...),
+		}
+		if tamper != nil {
+			tamper(doc)
+		}
+		_ = json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, attstns
+}
+
+func TestDialAttestedTLS(t *testing.T) {
+	srv, attstns := newTestEnclave(t, nil)
+	d := &Dialer{Policy: Policy{PCRs: map[uint][]byte{0: testPCR0}}}
+	addr := srv.Listener.Addr().String()
+
+	// The connection remains usable after attestation.
+	client := &http.Client{Transport: &http.Transport{DialTLSContext: d.DialContext}}
+	resp, err := client.Get("https://" + addr + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusTeapot, resp.StatusCode)
+	}
+
+	// Subsequent connections to the pinned certificate skip attestation.
+	for i := 0; i < 2; i++ {
+		conn, err := d.DialTLSContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if n := attstns.Load(); n != 1 {
+		t.Fatalf("Expected 1 attestation but got %d.", n)
+	}
+}
+
+func TestDialAttestedTLSRejects(t *testing.T) {
+	p := &Policy{PCRs: map[uint][]byte{0: testPCR0}}
+	cases := []struct {
+		tamper func(*nitrite.Document)
+		err    error
+	}{
+		{func(d *nitrite.Document) { d.PCRs[0] = bytes48(2) }, ErrPCRMismatch},
+		{func(d *nitrite.Document) { d.Nonce = make([]byte, nonceLen) }, ErrNonceMismatch},
+		{func(d *nitrite.Document) { d.UserData = make([]byte, 102) }, ErrFingerprintMismatch},
+	}
+	for _, c := range cases {
+		srv, _ := newTestEnclave(t, c.tamper)
+		_, err := DialAttestedTLS(context.Background(), "tcp", srv.Listener.Addr().String(), p)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("Expected error %v but got %v.", c.err, err)
+		}
+	}
+
+	srv, _ := newTestEnclave(t, nil)
+	if _, err := DialAttestedTLS(context.Background(), "tcp", srv.Listener.Addr().String(), &Policy{}); !errors.Is(err, ErrNoPCRs) {
+		t.Fatalf("Expected error %v but got %v.", ErrNoPCRs, err)
+	}
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+const (
+	// DefaultMaxAge is the maximum age of the attestation documents that we
+	// accept, unless configured otherwise.
+	DefaultMaxAge     = 5 * time.Minute
+	defaultRetries    = 3
+	defaultRetryDelay = time.Second
+	// maxClockSkew is how far in the future an attestation document's
+	// timestamp may lie.
+	maxClockSkew = time.Minute
+)
+
+var (
+	ErrStaleAttstn = errors.New("attestation document is too old")
+
+	errRetryable = errors.New("transient error")
+)
+
+// Verifier fetches attestation documents from an enclave's attestation
+// endpoint and verifies them.  For each attempt, it generates a fresh nonce,
+// and it accepts only documents that contain the nonce, are recent, and
+// satisfy its policy.  A Verifier is safe for concurrent use.
+type Verifier struct {
+	// Policy determines which enclaves the Verifier trusts.
+	Policy Policy
+	// HTTPClient fetches attestation documents.  If nil, the Verifier uses
+	// http.DefaultClient.
+	HTTPClient *http.Client
+	// MaxAge is the maximum age of attestation documents.  If zero, the
+	// Verifier uses DefaultMaxAge.
+	MaxAge time.Duration
+	// Retries is how often the Verifier retries after network errors and
+	// responses with status code 429 or 5xx.  If zero, the Verifier retries
+	// three times.  If negative, it doesn't retry.
+	Retries int
+	// RetryDelay is how long the Verifier waits before its first retry.  The
+	// delay doubles with each retry.  If zero, the Verifier waits one second.
+	RetryDelay time.Duration
+}
+
+// Attest fetches an attestation document from the enclave at the given URL,
+// e.g., "https://example.com", and returns the document's content once it
+// verified the document.
+func (v *Verifier) Attest(ctx context.Context, enclaveURL string) (*nitrite.Document, error) {
+	if len(v.Policy.PCRs) == 0 {
+		return nil, ErrNoPCRs
+	}
+	base, err := url.Parse(enclaveURL)
+	if err != nil {
+		return nil, err
+	}
+	retries, delay := v.Retries, v.RetryDelay
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	if delay == 0 {
+		delay = defaultRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		doc, err := v.attest(ctx, base)
+		if err == nil || !errors.Is(err, errRetryable) || attempt >= retries {
+			return doc, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay << attempt):
+		}
+	}
+}
+
+// attest makes a single attempt to fetch and verify an attestation document.
+func (v *Verifier) attest(ctx context.Context, base *url.URL) (*nitrite.Document, error) {
+	n, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	u := *base
+	u.Path = strings.TrimSuffix(u.Path, "/") + pathAttestation
+	u.RawQuery = url.Values{"nonce": {hex.EncodeToString(n)}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", contentTypeCBOR)
+
+	client := v.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", errRetryable, err)
+	}
+	defer resp.Body.Close()
+	rawDoc, err := readAttstn(resp)
+	if err != nil {
+		return nil, err
+	}
+	return verifyDoc(rawDoc, n, &v.Policy, v.MaxAge)
+}
+
+// newNonce returns a fresh nonce of the size that nitriding expects.
+func newNonce() ([]byte, error) {
+	n := make([]byte, nonceLen)
+	if _, err := rand.Read(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// readAttstn returns the raw attestation document in the given response.
+// Errors are retryable if the status code suggests that a later attempt may
+// succeed.
+func readAttstn(resp *http.Response) ([]byte, error) {
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("failed to fetch attestation document: got status code %d", resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			err = fmt.Errorf("%w: %v", errRetryable, err)
+		}
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxAttstnDocSize))
+}
+
+// verifyDoc verifies the given raw attestation document, and returns its
+// content if it contains the given nonce, is no older than the given maximum
+// age, and satisfies the given policy.
+func verifyDoc(rawDoc, n []byte, p *Policy, maxAge time.Duration) (*nitrite.Document, error) {
+	doc, err := verifyAttstn(rawDoc, p.Roots)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(doc.Nonce, n) {
+		return nil, ErrNonceMismatch
+	}
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	age := time.Since(time.UnixMilli(int64(doc.Timestamp)))
+	if age > maxAge || age < -maxClockSkew {
+		return nil, fmt.Errorf("%w: created %s ago", ErrStaleAttstn, age.Round(time.Second))
+	}
+	if err := p.verify(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+func TestVerifierAttest(t *testing.T) {
+	srv, attstns := newTestEnclave(t, nil)
+	v := &Verifier{
+		Policy:     Policy{PCRs: map[uint][]byte{0: testPCR0}},
+		HTTPClient: srv.Client(),
+	}
+	doc, err := v.Attest(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Nonce) != nonceLen {
+		t.Fatalf("Expected %d-byte nonce but got %d bytes.", nonceLen, len(doc.Nonce))
+	}
+	if n := attstns.Load(); n != 1 {
+		t.Fatalf("Expected 1 attestation but got %d.", n)
+	}
+}
+
+func TestVerifierRejects(t *testing.T) {
+	p := Policy{PCRs: map[uint][]byte{0: testPCR0}}
+	cases := []struct {
+		tamper func(*nitrite.Document)
+		err    error
+	}{
+		{func(d *nitrite.Document) { d.PCRs[0] = bytes48(2) }, ErrPCRMismatch},
+		{func(d *nitrite.Document) { d.Nonce = make([]byte, nonceLen) }, ErrNonceMismatch},
+		{func(d *nitrite.Document) {
+			d.Timestamp = uint64(time.Now().Add(-DefaultMaxAge - time.Minute).UnixMilli())
+		}, ErrStaleAttstn},
+		{func(d *nitrite.Document) {
+			d.Timestamp = uint64(time.Now().Add(2 * maxClockSkew).UnixMilli())
+		}, ErrStaleAttstn},
+	}
+	for _, c := range cases {
+		srv, attstns := newTestEnclave(t, c.tamper)
+		v := &Verifier{Policy: p, HTTPClient: srv.Client()}
+		if _, err := v.Attest(context.Background(), srv.URL); !errors.Is(err, c.err) {
+			t.Fatalf("Expected error %v but got %v.", c.err, err)
+		}
+		// Verification errors aren't worth retrying.
+		if n := attstns.Load(); n != 1 {
+			t.Fatalf("Expected 1 attestation but got %d.", n)
+		}
+	}
+
+	v := &Verifier{}
+	if _, err := v.Attest(context.Background(), "https://example.com"); !errors.Is(err, ErrNoPCRs) {
+		t.Fatalf("Expected error %v but got %v.", ErrNoPCRs, err)
+	}
+}
+
+func TestVerifierRetries(t *testing.T) {
+	enclave, _ := newTestEnclave(t, nil)
+	var requests atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			enclave.Config.Handler.ServeHTTP(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	v := &Verifier{
+		Policy:     Policy{PCRs: map[uint][]byte{0: testPCR0}},
+		HTTPClient: srv.Client(),
+		RetryDelay: time.Millisecond,
+	}
+	if _, err := v.Attest(context.Background(), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("Expected 3 requests but got %d.", n)
+	}
+
+	// Give up after the configured number of retries, and don't retry client
+	// errors.
+	for _, c := range []struct {
+		status   int
+		requests int32
+	}{
+		{http.StatusBadGateway, 2},
+		{http.StatusBadRequest, 1},
+	} {
+		var requests atomic.Int32
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(c.status)
+		}))
+		v.HTTPClient, v.Retries = srv.Client(), 1
+		if _, err := v.Attest(context.Background(), srv.URL); err == nil {
+			t.Fatal("Expected error but got none.")
+		}
+		srv.Close()
+		if n := requests.Load(); n != c.requests {
+			t.Fatalf("Expected %d requests but got %d.", c.requests, n)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCluster consists of a leader and a worker enclave that run in-process
+// with fake attestation, and an enclave application that sits behind both
+// enclaves' reverse proxies.  Instead of binding to their configured ports,
+// the enclaves' Web servers run as httptest servers.
+type testCluster struct {
+	leader, worker         *Enclave
+	leaderPub, workerPub   *httptest.Server
+	leaderPriv, workerPriv *httptest.Server
+	app                    *httptest.Server
+}
+
+// newTestCluster starts a leader and a worker enclave whose reverse proxies
+// forward requests to the given application handler.  The leader has a
+// self-signed certificate and key material, which the worker obtains once the
+// test calls syncKeys.
+func newTestCluster(t *testing.T, app http.Handler) *testCluster {
+	t.Helper()
+	// Other tests mock the functions that key synchronization uses.
+	origClient, origSyncURL := newUnauthenticatedHTTPClient, getSyncURL
+	newUnauthenticatedHTTPClient = _newUnauthenticatedHTTPClient
+	getSyncURL = func(host string, port uint16) *url.URL { return _getSyncURL(host, port) }
+	t.Cleanup(func() { newUnauthenticatedHTTPClient, getSyncURL = origClient, origSyncURL })
+
+	c := &testCluster{app: httptest.NewServer(app)}
+	t.Cleanup(c.app.Close)
+	appURL, err := url.Parse(c.app.URL)
+	failOnErr(t, err)
+
+	// The leader derives the worker's sync URL from its own private port, so
+	// the worker's private Web server must be up before we create the leader.
+	workerCfg := defaultCfg
+	workerCfg.AppWebSrv = appURL
+	c.worker = createEnclave(&workerCfg)
+	c.workerPriv = newTestSrv(t, c.worker.extPrivSrv.Handler, nil)
+
+	leaderCfg := workerCfg
+	leaderCfg.ExtPrivPort = srvPort(t, c.workerPriv)
+	c.leader = createEnclave(&leaderCfg)
+	failOnErr(t, c.leader.genSelfSignedCert())
+	c.leader.keys.setAppKeys([]byte("AppTestKeys"))
+	c.leader.setupLeader()
+	c.leaderPriv = newTestSrv(t, c.leader.extPrivSrv.Handler, nil)
+
+	c.leaderPub = newTestSrv(t, c.leader.extPubSrv.Handler, c.leader.httpsCert.get)
+	c.workerPub = newTestSrv(t, c.worker.extPubSrv.Handler, c.worker.httpsCert.get)
+	for _, e := range []*Enclave{c.leader, c.worker} {
+		e := e
+		t.Cleanup(func() { _ = e.Stop(context.Background()) })
+	}
+	return c
+}
+
+// newTestSrv starts an HTTPS server for the given handler.  If the given
+// function isn't nil, the server obtains its certificate from the function,
+// like our public Web server.
+func newTestSrv(
+	t *testing.T,
+	h http.Handler,
+	getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(h)
+	if getCert != nil {
+		srv.TLS = &tls.Config{GetCertificate: getCert}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// srvPort returns the port that the given server listens on.
+func srvPort(t *testing.T, srv *httptest.Server) uint16 {
+	t.Helper()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	failOnErr(t, err)
+	p, err := strconv.ParseUint(port, 10, 16)
+	failOnErr(t, err)
+	return uint16(p)
+}
+
+// syncKeys registers the worker with the leader, like a worker does after
+// startup, and waits until the leader synchronized its key material with the
+// worker.
+func (c *testCluster) syncKeys(t *testing.T) {
+	t.Helper()
+	leader, err := url.Parse(c.leaderPriv.URL + pathHeartbeat)
+	failOnErr(t, err)
+	worker := &url.URL{Host: c.workerPriv.Listener.Addr().String()}
+	failOnErr(t, asWorker(c.worker.setupWorkerPostSync, c.worker.attester).registerWith(leader, worker))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for c.leader.workers.length() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Leader didn't synchronize keys with worker.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// client returns an HTTP client for the enclaves' public Web servers.  The
+// client sends the enclaves' FQDN via SNI, so the servers present the
+// enclaves' certificate rather than httptest's.
+func (c *testCluster) client() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName:         c.leader.cfg.FQDN,
+			InsecureSkipVerify: true,
+		},
+	}}
+}
+
+// certFingerprint returns the fingerprint of the certificate that the given
+// server presents.
+func (c *testCluster) certFingerprint(t *testing.T, srv *httptest.Server) [sha256.Size]byte {
+	t.Helper()
+	resp, err := c.client().Get(srv.URL + pathConfig)
+	failOnErr(t, err)
+	resp.Body.Close()
+	return sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+}
+
+func TestClusterKeySync(t *testing.T) {
+	c := newTestCluster(t, http.NotFoundHandler())
+	c.syncKeys(t)
+
+	assertEqual(t, c.worker.keys.equal(c.leader.keys), true)
+	assertEqual(t, bytes.Equal(c.worker.keys.getAppKeys(), []byte("AppTestKeys")), true)
+	// The worker serves the leader's certificate, whose fingerprint is in the
+	// leader's attestation documents.
+	fingerprint := c.certFingerprint(t, c.leaderPub)
+	assertEqual(t, fingerprint, c.leader.hashes.tlsKeyHash)
+	assertEqual(t, c.certFingerprint(t, c.workerPub), fingerprint)
+}
+
+func TestClusterReverseProxy(t *testing.T) {
+	c := newTestCluster(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	c.syncKeys(t)
+
+	for _, srv := range []*httptest.Server{c.leaderPub, c.workerPub} {
+		resp, err := c.client().Get(srv.URL + "/foo")
+		failOnErr(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		failOnErr(t, err)
+		assertEqual(t, resp.StatusCode, http.StatusOK)
+		assertEqual(t, string(body), "hello /foo")
+	}
+}
+
+// roundTripFunc lets us intercept requests of HTTP clients.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestClusterKeysPrereq(t *testing.T) {
+	c := newTestCluster(t, http.NotFoundHandler())
+	// Hold back the leader's key material until we release it.
+	release := make(chan struct{})
+	newUnauthenticatedHTTPClient = func() *http.Client {
+		client := _newUnauthenticatedHTTPClient()
+		transport := client.Transport
+		client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Method == http.MethodPost && r.URL.Path == pathSync {
+				<-release
+			}
+			return transport.RoundTrip(r)
+		})
+		return client
+	}
+	keysMet := func(timeout time.Duration) bool {
+		stop := make(chan struct{})
+		timer := time.AfterFunc(timeout, func() { close(stop) })
+		defer timer.Stop()
+		return c.worker.startup.wait([]string{appPrereqKeys}, stop)
+	}
+
+	// Registration succeeds before the leader sends its keys, so the
+	// application must keep waiting.
+	leader, err := url.Parse(c.leaderPriv.URL + pathHeartbeat)
+	failOnErr(t, err)
+	worker := &url.URL{Host: c.workerPriv.Listener.Addr().String()}
+	failOnErr(t, asWorker(c.worker.setupWorkerPostSync, c.worker.attester).registerWith(leader, worker))
+	assertEqual(t, keysMet(100*time.Millisecond), false)
+
+	close(release)
+	assertEqual(t, keysMet(5*time.Second), true)
+	assertEqual(t, bytes.Equal(c.worker.keys.getAppKeys(), []byte("AppTestKeys")), true)
+}
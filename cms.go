@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// KMS encrypts the responses that it sends to attested enclaves as a
+// Cryptographic Message Syntax (CMS) EnvelopedData structure (RFC 5652): the
+// content is encrypted with AES-256-CBC under a random key, which is in turn
+// encrypted to the RSA public key in our attestation document using
+// RSAES-OAEP with SHA-256.  The structure is BER-encoded, which
+// encoding/asn1 cannot parse, so we implement the small subset of BER that
+// we need.
+
+const (
+	berClassUniversal = 0
+	berClassContext   = 2
+
+	berTagOctetString = 4
+	berTagOID         = 6
+	berTagSequence    = 16
+	berTagSet         = 17
+
+	// maxBERDepth limits the nesting of the BER values that we parse.
+	maxBERDepth = 16
+)
+
+var (
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidRSAESOAEP     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidAES256CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+
+	errBadBER = errors.New("malformed BER encoding")
+	errBadCMS = errors.New("unexpected CMS EnvelopedData structure")
+)
+
+// berValue represents a parsed BER type-length-value triple.  Primitive values
+// have content, and constructed values have children.
+type berValue struct {
+	class       int
+	tag         int
+	constructed bool
+	content     []byte
+	children    []*berValue
+}
+
+// is returns true if the value has the given class and tag.
+func (v *berValue) is(class, tag int) bool {
+	return v.class == class && v.tag == tag
+}
+
+// child returns the value's child at the given index if it exists and has
+// the given class and tag.
+func (v *berValue) child(i, class, tag int) (*berValue, error) {
+	if i >= len(v.children) || !v.children[i].is(class, tag) {
+		return nil, fmt.Errorf("%w: missing element %d", errBadCMS, i)
+	}
+	return v.children[i], nil
+}
+
+// bytes returns the content of an octet string.  BER allows for splitting
+// octet strings into constructed values that contain primitive chunks.
+func (v *berValue) bytes() []byte {
+	if !v.constructed {
+		return v.content
+	}
+	var b []byte
+	for _, c := range v.children {
+		b = append(b, c.bytes()...)
+	}
+	return b
+}
+
+// oid returns the value as an object identifier.
+func (v *berValue) oid() (asn1.ObjectIdentifier, error) {
+	if v.constructed || !v.is(berClassUniversal, berTagOID) || len(v.content) > 127 {
+		return nil, fmt.Errorf("%w: expected object identifier", errBadCMS)
+	}
+	var oid asn1.ObjectIdentifier
+	der := append([]byte{berTagOID, byte(len(v.content))}, v.content...)
+	if _, err := asn1.Unmarshal(der, &oid); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadCMS, err)
+	}
+	return oid, nil
+}
+
+// parseBER parses the BER value at the beginning of the given bytes, and
+// returns the value and the remaining bytes.
+func parseBER(b []byte, depth int) (*berValue, []byte, error) {
+	if depth > maxBERDepth {
+		return nil, nil, fmt.Errorf("%w: values nested too deeply", errBadBER)
+	}
+	if len(b) < 2 {
+		return nil, nil, fmt.Errorf("%w: value too short", errBadBER)
+	}
+	v := &berValue{
+		class:       int(b[0] >> 6),
+		constructed: b[0]&0x20 != 0,
+		tag:         int(b[0] & 0x1f),
+	}
+	b = b[1:]
+	if v.tag == 0x1f {
+		// The tag number follows in base 128.
+		v.tag = 0
+		for {
+			if len(b) == 0 || v.tag >= 1<<24 {
+				return nil, nil, fmt.Errorf("%w: bad tag number", errBadBER)
+			}
+			c := b[0]
+			b = b[1:]
+			v.tag = v.tag<<7 | int(c&0x7f)
+			if c&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("%w: missing length", errBadBER)
+	}
+	l := b[0]
+	b = b[1:]
+	if l == 0x80 {
+		// The value has an indefinite length and ends with two zero bytes.
+		if !v.constructed {
+			return nil, nil, fmt.Errorf("%w: primitive value with indefinite length", errBadBER)
+		}
+		for {
+			if len(b) >= 2 && b[0] == 0 && b[1] == 0 {
+				return v, b[2:], nil
+			}
+			c, rest, err := parseBER(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			v.children = append(v.children, c)
+			b = rest
+		}
+	}
+
+	length := int(l)
+	if l > 0x80 {
+		n := int(l & 0x7f)
+		if n > 4 || len(b) < n {
+			return nil, nil, fmt.Errorf("%w: bad length", errBadBER)
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if length < 0 || length > len(b) {
+		return nil, nil, fmt.Errorf("%w: value exceeds input", errBadBER)
+	}
+	content, rest := b[:length], b[length:]
+	if !v.constructed {
+		v.content = content
+		return v, rest, nil
+	}
+	for len(content) > 0 {
+		c, r, err := parseBER(content, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		v.children = append(v.children, c)
+		content = r
+	}
+	return v, rest, nil
+}
+
+// checkAlgorithm returns an error if the given AlgorithmIdentifier doesn't
+// identify the given algorithm.
+func checkAlgorithm(alg *berValue, expected asn1.ObjectIdentifier) error {
+	if !alg.is(berClassUniversal, berTagSequence) || len(alg.children) == 0 {
+		return fmt.Errorf("%w: expected algorithm identifier", errBadCMS)
+	}
+	oid, err := alg.children[0].oid()
+	if err != nil {
+		return err
+	}
+	if !oid.Equal(expected) {
+		return fmt.Errorf("%w: unsupported algorithm %s", errBadCMS, oid)
+	}
+	return nil
+}
+
+// openEnvelopedData decrypts the given BER-encoded CMS EnvelopedData
+// structure, which must have a single recipient: the given RSA key.
+func openEnvelopedData(priv *rsa.PrivateKey, ber []byte) ([]byte, error) {
+	contentInfo, _, err := parseBER(ber, 0)
+	if err != nil {
+		return nil, err
+	}
+	// ContentInfo ::= SEQUENCE { contentType, [0] EXPLICIT content }
+	if !contentInfo.is(berClassUniversal, berTagSequence) || len(contentInfo.children) != 2 {
+		return nil, fmt.Errorf("%w: expected content info", errBadCMS)
+	}
+	if oid, err := contentInfo.children[0].oid(); err != nil {
+		return nil, err
+	} else if !oid.Equal(oidEnvelopedData) {
+		return nil, fmt.Errorf("%w: unexpected content type %s", errBadCMS, oid)
+	}
+	wrapper, err := contentInfo.child(1, berClassContext, 0)
+	if err != nil {
+		return nil, err
+	}
+	envelopedData, err := wrapper.child(0, berClassUniversal, berTagSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	// EnvelopedData ::= SEQUENCE { version, [0] originatorInfo OPTIONAL,
+	// recipientInfos, encryptedContentInfo, ... }
+	var recipientInfos, encryptedContentInfo *berValue
+	for _, c := range envelopedData.children[min(1, len(envelopedData.children)):] {
+		switch {
+		case recipientInfos == nil && c.is(berClassUniversal, berTagSet):
+			recipientInfos = c
+		case recipientInfos != nil && c.is(berClassUniversal, berTagSequence):
+			encryptedContentInfo = c
+		}
+		if encryptedContentInfo != nil {
+			break
+		}
+	}
+	if recipientInfos == nil || encryptedContentInfo == nil || len(recipientInfos.children) != 1 {
+		return nil, fmt.Errorf("%w: expected a single recipient and encrypted content", errBadCMS)
+	}
+
+	// KeyTransRecipientInfo ::= SEQUENCE { version, rid,
+	// keyEncryptionAlgorithm, encryptedKey }
+	recipient := recipientInfos.children[0]
+	if len(recipient.children) != 4 {
+		return nil, fmt.Errorf("%w: expected key transport recipient", errBadCMS)
+	}
+	if err := checkAlgorithm(recipient.children[2], oidRSAESOAEP); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := recipient.child(3, berClassUniversal, berTagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, encryptedKey.bytes(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(key)
+
+	// EncryptedContentInfo ::= SEQUENCE { contentType,
+	// contentEncryptionAlgorithm, [0] IMPLICIT encryptedContent }
+	if len(encryptedContentInfo.children) != 3 {
+		return nil, fmt.Errorf("%w: expected encrypted content", errBadCMS)
+	}
+	alg := encryptedContentInfo.children[1]
+	if err := checkAlgorithm(alg, oidAES256CBC); err != nil {
+		return nil, err
+	}
+	iv, err := alg.child(1, berClassUniversal, berTagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	encryptedContent, err := encryptedContentInfo.child(2, berClassContext, 0)
+	if err != nil {
+		return nil, err
+	}
+	return decryptAESCBC(key, iv.bytes(), encryptedContent.bytes())
+}
+
+// decryptAESCBC decrypts the given PKCS#7-padded ciphertext.
+func decryptAESCBC(key, iv, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: bad ciphertext length", errBadCMS)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > aes.BlockSize ||
+		!bytes.Equal(plaintext[len(plaintext)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		wipeBytes(plaintext)
+		return nil, fmt.Errorf("%w: bad padding", errBadCMS)
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
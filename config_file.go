@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var errCfgFileNotFlat = errors.New("config file must contain a flat mapping of options")
+
+// LoadConfig reads the YAML-encoded configuration file at the given path and
+// returns the resulting config.  As JSON is a subset of YAML, JSON-encoded
+// files work too.  Each option is named after the corresponding Config field
+// in lower snake case, e.g.:
+//
+//	fqdn: example.com
+//	ext_pub_port: 443
+//	read_timeout: 30s
+//	cors_allowed_origins: ["https://example.com"]
+//
+// Unknown options are rejected.  The returned config is validated and its
+// optional fields are set to their defaults.
+func LoadConfig(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	c, err := parseConfig(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	c.setDefaults()
+	return c, nil
+}
+
+// parseConfig parses the given YAML-encoded configuration.
+func parseConfig(raw []byte) (*Config, error) {
+	var opts map[string]any
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	if err := dec.Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	c := new(Config)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := snakeCase(field.Name)
+		opt, exists := opts[key]
+		if !exists {
+			continue
+		}
+		delete(opts, key)
+
+		var err error
+		switch o := opt.(type) {
+		case []any:
+			if field.Type.Kind() != reflect.Slice {
+				return nil, fmt.Errorf("option %s must not be a list", key)
+			}
+			list := make([]string, len(o))
+			for j, elem := range o {
+				list[j] = fmt.Sprint(elem)
+			}
+			v.Field(i).Set(reflect.ValueOf(list))
+		case map[string]any:
+			return nil, fmt.Errorf("%w: option %s is a mapping", errCfgFileNotFlat, key)
+		case nil:
+			// An empty option leaves the field unset.
+		default:
+			err = setFromString(v.Field(i), fmt.Sprint(o))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for option %s: %w", key, err)
+		}
+	}
+
+	if len(opts) > 0 {
+		unknown := make([]string, 0, len(opts))
+		for key := range opts {
+			unknown = append(unknown, key)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown options: %s", strings.Join(unknown, ", "))
+	}
+	return c, nil
+}
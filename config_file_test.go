@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nitriding.yaml")
+	failOnErr(t, os.WriteFile(path, []byte(`
+# Comments are allowed.
+fqdn: example.com
+ext_pub_port: 443
+int_port: 8080
+host_proxy_port: 1024
+use_acme: true
+read_timeout: 5s
+app_url: https://github.com/foo/bar
+cors_allowed_origins:
+  - https://a.com
+  - https://b.com
+`), 0600))
+
+	c, err := LoadConfig(path)
+	failOnErr(t, err)
+	assertEqual(t, c.FQDN, "example.com")
+	assertEqual(t, c.ExtPubPort, uint16(443))
+	assertEqual(t, c.UseACME, true)
+	assertEqual(t, c.ReadTimeout, 5*time.Second)
+	assertEqual(t, c.AppURL.String(), "https://github.com/foo/bar")
+	assertEqual(t, strings.Join(c.CORSAllowedOrigins, "|"), "https://a.com|https://b.com")
+	// Unset options must get their defaults.
+	assertEqual(t, c.WriteTimeout, defaultWriteTimeout)
+
+	// A config that lacks required fields must fail validation.
+	failOnErr(t, os.WriteFile(path, []byte("fqdn: example.com\n"), 0600))
+	if _, err = LoadConfig(path); !errors.Is(err, errCfgMissingPort) {
+		t.Fatalf("Expected error %v but got %v.", errCfgMissingPort, err)
+	}
+
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "does-not-exist.yaml"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected error %v but got %v.", os.ErrNotExist, err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	// JSON is a subset of YAML.
+	c, err := parseConfig([]byte(`{"fqdn": "example.com", "debug": true}`))
+	failOnErr(t, err)
+	assertEqual(t, c.FQDN, "example.com")
+	assertEqual(t, c.Debug, true)
+
+	_, err = parseConfig([]byte("fqdn: example.com\nfoo: bar\nbar: baz\n"))
+	assertEqual(t, err.Error(), "unknown options: bar, foo")
+
+	_, err = parseConfig([]byte("fqdn:\n  foo: bar\n"))
+	if !errors.Is(err, errCfgFileNotFlat) {
+		t.Fatalf("Expected error %v but got %v.", errCfgFileNotFlat, err)
+	}
+
+	for _, invalid := range []string{
+		"ext_pub_port: 70000",
+		"debug: maybe",
+		"read_timeout: forever",
+		"fqdn: [a, b]",
+	} {
+		if _, err = parseConfig([]byte(invalid)); err == nil {
+			t.Fatalf("Expected error for invalid config %q.", invalid)
+		}
+	}
+}
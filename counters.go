@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ops counts nitriding's core operations.  Unlike our Prometheus metrics, the
+// counters are always enabled, so the info endpoint can report them even if
+// Prometheus is disabled.
+var ops = new(opsCounters)
+
+// opsCounters holds counters of nitriding's core operations.
+type opsCounters struct {
+	attestations        atomic.Uint64
+	attestationErrors   atomic.Uint64
+	keySyncs            atomic.Uint64
+	keySyncErrors       atomic.Uint64
+	certRenewals        atomic.Uint64
+	hostProxyErrors     atomic.Uint64
+	appProxyErrors      atomic.Uint64
+	nonceCacheEvictions atomic.Uint64
+	shedRequests        atomic.Uint64
+	eventsForwarded     atomic.Uint64
+	eventsDropped       atomic.Uint64
+	appRestarts         atomic.Uint64
+	dnsCacheHits        atomic.Uint64
+	dnsCacheMisses      atomic.Uint64
+}
+
+// opsSnapshot contains the values of our counters at a given point in time.
+type opsSnapshot struct {
+	Attestations        uint64 `json:"attestations"`
+	AttestationErrors   uint64 `json:"attestation_errors"`
+	KeySyncs            uint64 `json:"key_syncs"`
+	KeySyncErrors       uint64 `json:"key_sync_errors"`
+	CertRenewals        uint64 `json:"cert_renewals"`
+	HostProxyErrors     uint64 `json:"host_proxy_errors"`
+	AppProxyErrors      uint64 `json:"app_proxy_errors"`
+	NonceCacheEvictions uint64 `json:"nonce_cache_evictions"`
+	ShedRequests        uint64 `json:"shed_requests"`
+	EventsForwarded     uint64 `json:"events_forwarded"`
+	EventsDropped       uint64 `json:"events_dropped"`
+	AppRestarts         uint64 `json:"app_restarts"`
+	DNSCacheHits        uint64 `json:"dns_cache_hits"`
+	DNSCacheMisses      uint64 `json:"dns_cache_misses"`
+}
+
+// snapshot returns the current values of our counters.
+func (o *opsCounters) snapshot() *opsSnapshot {
+	return &opsSnapshot{
+		Attestations:        o.attestations.Load(),
+		AttestationErrors:   o.attestationErrors.Load(),
+		KeySyncs:            o.keySyncs.Load(),
+		KeySyncErrors:       o.keySyncErrors.Load(),
+		CertRenewals:        o.certRenewals.Load(),
+		HostProxyErrors:     o.hostProxyErrors.Load(),
+		AppProxyErrors:      o.appProxyErrors.Load(),
+		NonceCacheEvictions: o.nonceCacheEvictions.Load(),
+		ShedRequests:        o.shedRequests.Load(),
+		EventsForwarded:     o.eventsForwarded.Load(),
+		EventsDropped:       o.eventsDropped.Load(),
+		AppRestarts:         o.appRestarts.Load(),
+		DNSCacheHits:        o.dnsCacheHits.Load(),
+		DNSCacheMisses:      o.dnsCacheMisses.Load(),
+	}
+}
+
+// countKeySync counts the outcome of a key synchronization.
+func (o *opsCounters) countKeySync(err error) {
+	if err != nil {
+		o.keySyncErrors.Add(1)
+	} else {
+		o.keySyncs.Add(1)
+	}
+}
+
+// opsCollector exposes our counters as Prometheus metrics.
+type opsCollector struct {
+	counters *opsCounters
+	descs    map[string]*prometheus.Desc
+}
+
+func newOpsCollector(namespace string, counters *opsCounters) *opsCollector {
+	c := &opsCollector{counters: counters, descs: make(map[string]*prometheus.Desc)}
+	for name, help := range map[string]string{
+		"attestations":          "Attestation documents issued to clients",
+		"attestation_errors":    "Failures to create attestation documents for clients",
+		"key_syncs":             "Successful key synchronizations between leader and workers",
+		"key_sync_errors":       "Failed key synchronizations between leader and workers",
+		"cert_renewals":         "Certificates obtained via ACME",
+		"host_proxy_errors":     "Failures to set up networking via the EC2 host's proxy",
+		"app_proxy_errors":      "Failures to reach the enclave application's Web server",
+		"nonce_cache_evictions": "Nonces evicted from the full nonce cache before they expired",
+		"shed_requests":         "Low-priority requests rejected while the enclave was overloaded",
+		"events_forwarded":      "Events forwarded to SQS or Kafka",
+		"events_dropped":        "Events dropped because the queue was full or the sink rejected them",
+		"app_restarts":          "Restarts of the enclave application after it crashed",
+		"dns_cache_hits":        "DNS queries answered from the local DNS cache",
+		"dns_cache_misses":      "DNS queries forwarded to an upstream resolver",
+	} {
+		c.descs[name] = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name+"_total"), help, nil, nil)
+	}
+	return c
+}
+
+func (c *opsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *opsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.counters.snapshot()
+	for name, value := range map[string]uint64{
+		"attestations":          s.Attestations,
+		"attestation_errors":    s.AttestationErrors,
+		"key_syncs":             s.KeySyncs,
+		"key_sync_errors":       s.KeySyncErrors,
+		"cert_renewals":         s.CertRenewals,
+		"host_proxy_errors":     s.HostProxyErrors,
+		"app_proxy_errors":      s.AppProxyErrors,
+		"nonce_cache_evictions": s.NonceCacheEvictions,
+		"shed_requests":         s.ShedRequests,
+		"events_forwarded":      s.EventsForwarded,
+		"events_dropped":        s.EventsDropped,
+		"app_restarts":          s.AppRestarts,
+		"dns_cache_hits":        s.DNSCacheHits,
+		"dns_cache_misses":      s.DNSCacheMisses,
+	} {
+		ch <- prometheus.MustNewConstMetric(c.descs[name], prometheus.CounterValue, float64(value))
+	}
+}
+
+// countingCache wraps an autocert.Cache and counts the certificates that
+// autocert stores in it, i.e., certificate issuances and renewals.
+type countingCache struct {
+	autocert.Cache
+}
+
+func (c countingCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.Cache.Put(ctx, key, data)
+	// Besides certificates (whose keys are domain names, optionally followed
+	// by "+rsa"), autocert stores its account key in the cache.
+	if err == nil && !strings.HasPrefix(key, "acme_account") {
+		ops.certRenewals.Add(1)
+	}
+	return err
+}
+
+// countRevProxyErr returns a reverse proxy error handler that counts the
+// error before passing it on to the given handler.  If the given handler is
+// nil, we respond with status code 502.
+func countRevProxyErr(next func(http.ResponseWriter, *http.Request, error)) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		ops.appProxyErrors.Add(1)
+		if next != nil {
+			next(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
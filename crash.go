@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// The number of recent log records that we include in crash reports.
+	crashReportLogLines = 100
+	// How long we wait for the host to accept a crash report.  We're about
+	// to die, so we cannot wait for long.
+	crashReportTimeout = 3 * time.Second
+)
+
+var (
+	// recentLogs holds our most recent log records, for crash reports.
+	recentLogs = newLogRing(crashReportLogLines)
+	// crashDial connects to the EC2 host's crash report collector.  It's nil
+	// if crash reporting is disabled.
+	crashDial func() (net.Conn, error)
+)
+
+// logRing is an io.Writer that keeps the given number of most recent writes,
+// i.e., log records.
+type logRing struct {
+	sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// newLogRing returns a new ring buffer that holds up to n log records.
+func newLogRing(n int) *logRing {
+	return &logRing{lines: make([]string, n)}
+}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.lines[l.next] = string(p)
+	l.next = (l.next + 1) % len(l.lines)
+	if l.next == 0 {
+		l.full = true
+	}
+	return len(p), nil
+}
+
+// records returns a copy of the log records in the ring buffer, oldest first.
+func (l *logRing) records() []string {
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.full {
+		return append([]string{}, l.lines[:l.next]...)
+	}
+	return append(append([]string{}, l.lines[l.next:]...), l.lines[:l.next]...)
+}
+
+// handler returns an slog.Handler that writes JSON-encoded log records of at
+// least our current log level to the ring buffer.
+func (l *logRing) handler() slog.Handler {
+	return slog.NewJSONHandler(l, newHandlerOptions())
+}
+
+// crashReport is the message that we send to the EC2 host right before
+// nitriding dies.  Nitro enclaves leave no trace once they're gone, so the
+// report is often the only clue to what went wrong.
+type crashReport struct {
+	Time      time.Time `json:"time"`
+	Version   string    `json:"version"`
+	GitCommit string    `json:"git_commit"`
+	Reason    string    `json:"reason"`
+	Stack     string    `json:"stack"`
+	Logs      []string  `json:"logs"`
+}
+
+// configureCrashReports enables crash reporting if the given config has a
+// crash report port.
+func configureCrashReports(c *Config) {
+	if c.CrashReportPort != 0 {
+		crashDial = dialHostVsock(c.HostCID, c.CrashReportPort)
+	}
+}
+
+// sendCrashReport sends a length-prefixed, JSON-encoded crash report with the
+// given reason and stack trace to the EC2 host, if crash reporting is
+// enabled.
+func sendCrashReport(reason string, stack []byte) {
+	if crashDial == nil {
+		return
+	}
+	msg, err := json.Marshal(&crashReport{
+		Time:      time.Now().UTC(),
+		Version:   version,
+		GitCommit: gitCommit,
+		Reason:    reason,
+		Stack:     string(stack),
+		Logs:      recentLogs.records(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode crash report: %v\n", err)
+		return
+	}
+	conn, err := crashDial()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to crash report collector: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(crashReportTimeout))
+	if _, err := conn.Write(lengthPrefixed(msg)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send crash report: %v\n", err)
+	}
+}
+
+// reportPanic sends a crash report to the EC2 host if the calling goroutine
+// panics, and then resumes panicking.  Goroutines must defer it directly:
+//
+//	defer reportPanic()
+func reportPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	sendCrashReport(fmt.Sprintf("panic: %v", r), debug.Stack())
+	panic(r)
+}
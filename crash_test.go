@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLogRing(t *testing.T) {
+	l := newLogRing(3)
+	assertEqual(t, len(l.records()), 0)
+
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(l, "%d", i)
+	}
+	assertEqual(t, strings.Join(l.records(), ","), "2,3,4")
+}
+
+func TestCrashReport(t *testing.T) {
+	host, enclave := net.Pipe()
+	defer host.Close()
+	crashDial = func() (net.Conn, error) { return enclave, nil }
+	defer func() { crashDial = nil }()
+
+	elog.Info("Last words before the crash.")
+	go func() {
+		// Swallow the panic that reportPanic resumes.
+		defer func() { _ = recover() }()
+		defer reportPanic()
+		panic("oops")
+	}()
+
+	var length uint32
+	failOnErr(t, binary.Read(host, binary.BigEndian, &length))
+	msg := make([]byte, length)
+	_, err := io.ReadFull(host, msg)
+	failOnErr(t, err)
+	var report crashReport
+	failOnErr(t, json.Unmarshal(msg, &report))
+
+	assertEqual(t, report.Reason, "panic: oops")
+	assertEqual(t, report.Version, version)
+	if !strings.Contains(report.Stack, "TestCrashReport") {
+		t.Fatalf("Expected stack trace to contain test function but got:\n%s", report.Stack)
+	}
+	if len(report.Logs) == 0 || !strings.Contains(report.Logs[len(report.Logs)-1], "Last words before the crash.") {
+		t.Fatalf("Expected crash report to contain recent log records but got: %v", report.Logs)
+	}
+}
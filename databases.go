@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The protocols of the databases that nitriding helps the enclave
+// application connect to.  PostgreSQL (RDS and Aurora) upgrades to TLS after
+// an SSLRequest message; MySQL upgrades in the middle of its handshake; and
+// ElastiCache (Redis, Valkey, and Memcached) speaks TLS from the start.
+const (
+	dbProtoPostgres = "postgres"
+	dbProtoMySQL    = "mysql"
+	dbProtoTLS      = "tls"
+
+	dbDialTimeout = 10 * time.Second
+)
+
+var (
+	errCfgBadDatabase    = errors.New("given config has invalid database")
+	errCfgNoDatabaseCA   = errors.New("given config has databases but no usable database CA")
+	errDatabasesNotReady = errors.New("database credentials not yet fetched")
+	errNoDatabaseName    = errors.New("could not find 'name' in URL query parameters")
+	errNoSuchDatabase    = errors.New("no database of the given name")
+	errPostgresNoTLS     = errors.New("PostgreSQL server refused TLS")
+
+	// databaseNameRegexp matches the names of databases.
+	databaseNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	// postgresSSLRequest is the message that asks a PostgreSQL server to
+	// upgrade the connection to TLS.
+	postgresSSLRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+)
+
+// database is a database endpoint that the enclave application connects to.
+type database struct {
+	name, protocol, host, port, user string
+	passwordRef                      string // Empty if there's no password.
+	localPort                        uint16 // Zero if we don't forward.
+}
+
+// parseDatabase parses the given database of the form
+// <name>=<protocol>://[<user>@]<host>:<port>[?password=asm://<secret-id>&local=<port>].
+func parseDatabase(s string) (*database, error) {
+	bad := func(reason string) error {
+		return fmt.Errorf("%w: %q %s", errCfgBadDatabase, s, reason)
+	}
+	name, rawURL, ok := strings.Cut(s, "=")
+	if !ok || !databaseNameRegexp.MatchString(name) {
+		return nil, bad("is not of the form <name>=<protocol>://<host>:<port>")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, bad(err.Error())
+	}
+	db := &database{name: name, protocol: u.Scheme, user: u.User.Username()}
+	switch db.protocol {
+	case dbProtoPostgres, dbProtoMySQL, dbProtoTLS:
+	default:
+		return nil, bad("has unsupported protocol")
+	}
+	if _, set := u.User.Password(); set {
+		return nil, bad("contains a plaintext password")
+	}
+	if db.host, db.port, err = net.SplitHostPort(u.Host); err != nil || db.host == "" {
+		return nil, bad("lacks host or port")
+	}
+
+	q := u.Query()
+	if db.passwordRef = q.Get("password"); db.passwordRef != "" {
+		r, err := parseSecretRef(db.passwordRef)
+		if err != nil {
+			return nil, bad(err.Error())
+		}
+		if r.scheme != schemeASM {
+			return nil, bad("has a password that's not a Secrets Manager reference")
+		}
+	}
+	if local := q.Get("local"); local != "" {
+		port, err := strconv.ParseUint(local, 10, 16)
+		if err != nil || port == 0 {
+			return nil, bad("has invalid local port")
+		}
+		if db.protocol == dbProtoMySQL {
+			return nil, bad("cannot be forwarded because MySQL negotiates TLS mid-handshake")
+		}
+		db.localPort = uint16(port)
+	}
+	return db, nil
+}
+
+// validateDatabases returns an error if any of the config's databases is
+// invalid, or if the config lacks the CA that database servers must chain to.
+func (c *Config) validateDatabases() error {
+	if len(c.Databases) == 0 {
+		return nil
+	}
+	var errs []error
+	names := make(map[string]bool)
+	ports := make(map[uint16]bool)
+	for _, s := range c.Databases {
+		db, err := parseDatabase(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if names[db.name] {
+			errs = append(errs, fmt.Errorf("%w: duplicate name %s", errCfgBadDatabase, db.name))
+		}
+		names[db.name] = true
+		if db.localPort != 0 {
+			if ports[db.localPort] {
+				errs = append(errs, fmt.Errorf("%w: duplicate local port %d", errCfgBadDatabase, db.localPort))
+			}
+			ports[db.localPort] = true
+		}
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM([]byte(c.DatabaseCA)) {
+		errs = append(errs, errCfgNoDatabaseCA)
+	}
+	return errors.Join(errs...)
+}
+
+// databaseInfo is what the enclave application learns about a database: all
+// it needs to establish a TLS-verified connection.
+type databaseInfo struct {
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	Host      string `json:"host"`
+	Port      string `json:"port"`
+	User      string `json:"user,omitempty"`
+	Password  string `json:"password,omitempty"`
+	CABundle  string `json:"ca_bundle"`
+	LocalAddr string `json:"local_addr,omitempty"`
+}
+
+// databaseStore holds the enclave application's databases, their
+// credentials, and the CA certificates that we pin their servers to.
+type databaseStore struct {
+	sync.Mutex
+	dbs       map[string]*database
+	caPEM     string
+	roots     *x509.CertPool
+	passwords map[string]*SecretBytes // Nil until fetched.
+}
+
+// newDatabaseStore returns a new databaseStore for the given config, which
+// must be valid.
+func newDatabaseStore(c *Config) *databaseStore {
+	s := &databaseStore{
+		dbs:   make(map[string]*database),
+		caPEM: c.DatabaseCA,
+		roots: x509.NewCertPool(),
+	}
+	s.roots.AppendCertsFromPEM([]byte(c.DatabaseCA))
+	for _, d := range c.Databases {
+		if db, err := parseDatabase(d); err == nil {
+			s.dbs[db.name] = db
+		}
+	}
+	return s
+}
+
+// fetch fetches the passwords of our databases using the given function.
+func (s *databaseStore) fetch(ctx context.Context, fetch func(context.Context, string) (string, error)) error {
+	passwords := make(map[string]*SecretBytes)
+	for name, db := range s.dbs {
+		if db.passwordRef == "" {
+			continue
+		}
+		plaintext, err := resolveWithRetry(ctx, fetch, db.passwordRef)
+		if err != nil {
+			return fmt.Errorf("failed to fetch password of database %s: %w", name, err)
+		}
+		registerSecret(plaintext)
+		passwords[name] = newSecretBytes([]byte(plaintext))
+		elog.Info("Fetched database password.", "name", name)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.passwords = passwords
+	return nil
+}
+
+// info returns what the enclave application needs to know to connect to the
+// database of the given name.
+func (s *databaseStore) info(name string) (*databaseInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.passwords == nil {
+		return nil, errDatabasesNotReady
+	}
+	db, ok := s.dbs[name]
+	if !ok {
+		return nil, errNoSuchDatabase
+	}
+	info := &databaseInfo{
+		Name:     db.name,
+		Protocol: db.protocol,
+		Host:     db.host,
+		Port:     db.port,
+		User:     db.user,
+		CABundle: s.caPEM,
+	}
+	if p, ok := s.passwords[name]; ok {
+		info.Password = string(p.Bytes())
+	}
+	if db.localPort != 0 {
+		info.LocalAddr = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(db.localPort)))
+	}
+	return info, nil
+}
+
+// dial establishes a TLS connection to the given database, verifying the
+// server's certificate against our pinned CA certificates.
+func (s *databaseStore) dial(ctx context.Context, db *database) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbDialTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(db.host, db.port))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if db.protocol == dbProtoPostgres {
+		if _, err := conn.Write(postgresSSLRequest); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		var resp [1]byte
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp[0] != 'S' {
+			conn.Close()
+			return nil, errPostgresNoTLS
+		}
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		RootCAs:    s.roots,
+		ServerName: db.host,
+		MinVersion: tls.VersionTLS12,
+		Time:       currentTime,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// forward listens on the local ports of our databases, and forwards each
+// connection to its database over TLS, so enclave applications whose clients
+// cannot pin CA certificates can connect in plaintext to localhost.  The
+// listeners are closed once the given channel is closed.
+func (s *databaseStore) forward(stop chan struct{}) error {
+	for _, db := range s.dbs {
+		if db.localPort == 0 {
+			continue
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(db.localPort))))
+		if err != nil {
+			return fmt.Errorf("failed to listen for database %s: %w", db.name, err)
+		}
+		elog.Info("Forwarding database.", "name", db.name, "addr", l.Addr().String())
+		go func() {
+			<-stop
+			l.Close()
+		}()
+		go s.acceptLoop(l, db)
+	}
+	return nil
+}
+
+// acceptLoop accepts connections on the given listener, and forwards them to
+// the given database.
+func (s *databaseStore) acceptLoop(l net.Listener, db *database) {
+	defer reportPanic()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer reportPanic()
+			defer conn.Close()
+			upstream, err := s.dial(context.Background(), db)
+			if err != nil {
+				elog.Warn("Failed to connect to database.", "name", db.name, "error", err)
+				return
+			}
+			defer upstream.Close()
+			done := make(chan struct{}, 2)
+			go func() { _, _ = io.Copy(upstream, conn); done <- struct{}{} }()
+			go func() { _, _ = io.Copy(conn, upstream); done <- struct{}{} }()
+			<-done
+		}()
+	}
+}
+
+// wipe wipes our database passwords.
+func (s *databaseStore) wipe() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, p := range s.passwords {
+		p.Wipe()
+	}
+	s.passwords = nil
+}
+
+// databaseHandler returns an HTTP handler that returns the connection details
+// and credentials of the database whose name is in the "name" URL parameter.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func databaseHandler(s *databaseStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			httpError(w, r, errNoDatabaseName, http.StatusBadRequest)
+			return
+		}
+		info, err := s.info(name)
+		switch {
+		case errors.Is(err, errDatabasesNotReady):
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			httpError(w, r, err, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			elog.Error("Error encoding database info.", "error", err)
+		}
+	}
+}
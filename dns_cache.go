@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsCacheAddr is the address of our caching resolver, which the
+	// enclave's resolv.conf points to.
+	dnsCacheAddr = "127.0.0.1:53"
+	// dnsCacheMaxItems bounds the number of responses that we cache.
+	dnsCacheMaxItems = 10000
+	// We cache positive responses for at most dnsMaxTTL and negative
+	// responses for at most dnsMaxNegativeTTL, even if the upstream resolver
+	// permits longer.
+	dnsMaxTTL         = time.Hour
+	dnsMaxNegativeTTL = 5 * time.Minute
+	// dnsUpstreamTimeout is how long we wait for each upstream resolver.
+	dnsUpstreamTimeout = 2 * time.Second
+	// dnsTCPIdleTimeout is how long we keep idle TCP connections open.
+	dnsTCPIdleTimeout = 10 * time.Second
+	// dnsMinUDPLen is the size of UDP responses that every client accepts.
+	dnsMinUDPLen = 512
+	dnsMaxMsgLen = 0xffff
+)
+
+var (
+	errCfgBadDNSUpstream = errors.New("given config's DNSUpstreams require DNSCache and must be IP:port pairs")
+	errDNSNoUpstream     = errors.New("no upstream resolver answered")
+	errDNSBadResponse    = errors.New("upstream resolver's response doesn't match our query")
+)
+
+// validateDNSCache returns an error if the config has upstream resolvers but
+// no cache, or upstream resolvers that aren't IP:port pairs.  Upstreams must
+// be addresses because we cannot resolve their names.
+func (c *Config) validateDNSCache() error {
+	if len(c.DNSUpstreams) > 0 && !c.DNSCache {
+		return errCfgBadDNSUpstream
+	}
+	for _, upstream := range c.DNSUpstreams {
+		if _, err := netip.ParseAddrPort(upstream); err != nil {
+			return fmt.Errorf("%w: %v", errCfgBadDNSUpstream, err)
+		}
+	}
+	return nil
+}
+
+// dnsKey identifies a DNS question.  Names are case-insensitive.
+type dnsKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// dnsCacheEntry holds a cached response.
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	added   time.Time
+	expires time.Time
+}
+
+// dnsResolver is a caching stub resolver that forwards queries to the
+// configured upstream resolvers, e.g., the host proxy's resolver, which the
+// enclave can only reach via a VSOCK round trip.  We respect the TTLs of
+// responses, cache negative responses as per RFC 2308, and never cache server
+// failures or truncated responses.
+type dnsResolver struct {
+	sync.Mutex
+	upstreams []string
+	overrides hostOverrides
+	entries   map[dnsKey]*dnsCacheEntry
+}
+
+// newDNSResolver returns a new resolver that forwards queries to the given
+// upstream resolvers, which it tries in order, and answers queries for the
+// given overridden hostnames itself.
+func newDNSResolver(upstreams []string, overrides hostOverrides) *dnsResolver {
+	return &dnsResolver{
+		upstreams: upstreams,
+		overrides: overrides,
+		entries:   make(map[dnsKey]*dnsCacheEntry),
+	}
+}
+
+// dnsUpstreams returns the config's upstream resolvers or, if there are none,
+// the resolver of the host proxy, which is our TAP subnet's gateway.
+func (c *Config) dnsUpstreams() []string {
+	if len(c.DNSUpstreams) > 0 {
+		return c.DNSUpstreams
+	}
+	// Our config is valid, so the subnet parses.
+	subnet, _ := parseTapSubnet(c.TapSubnet)
+	return []string{net.JoinHostPort(subnet.gw.String(), "53")}
+}
+
+// listen serves DNS over UDP and TCP at the given address until the given
+// channel is closed.
+func (r *dnsResolver) listen(addr string, stop chan struct{}) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP: %w", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to listen on TCP: %w", err)
+	}
+	go func() {
+		<-stop
+		pc.Close()
+		l.Close()
+	}()
+	go r.serveUDP(pc)
+	go r.serveTCP(l)
+	elog.Info("Started caching DNS resolver.", "addr", addr, "upstreams", r.upstreams)
+	return nil
+}
+
+func (r *dnsResolver) serveUDP(pc net.PacketConn) {
+	defer reportPanic()
+	for {
+		buf := make([]byte, dnsMaxMsgLen)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				elog.Error("Failed to read DNS query.", "error", err)
+			}
+			return
+		}
+		go func() {
+			if resp := r.answer(buf[:n], true); resp != nil {
+				_, _ = pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (r *dnsResolver) serveTCP(l net.Listener) {
+	defer reportPanic()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				elog.Error("Failed to accept DNS connection.", "error", err)
+			}
+			return
+		}
+		go r.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers the length-prefixed queries on the given connection
+// until the client closes it or goes idle.
+func (r *dnsResolver) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readTCPMsg(conn)
+		if err != nil {
+			return
+		}
+		resp := r.answer(query, false)
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(tcpMsg(resp)); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the packed response to the given query, or nil if the query
+// is too malformed to answer.  UDP responses that exceed the client's
+// advertised payload size are truncated, so the client retries over TCP.
+func (r *dnsResolver) answer(query []byte, udp bool) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil || q.Header.Response || len(q.Questions) != 1 {
+		return nil
+	}
+	maxLen := dnsMaxMsgLen
+	if udp {
+		maxLen = udpPayloadLen(&q)
+	}
+
+	resp := r.resolve(&q, query)
+	resp.Header.ID = q.Header.ID
+	resp.Questions = q.Questions
+	resp.Header.RecursionDesired = q.Header.RecursionDesired
+	// We strip EDNS records from the responses that we cache, so we don't
+	// return another client's EDNS options.
+	resp.Additionals = withoutOPT(resp.Additionals)
+
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	if len(packed) > maxLen {
+		truncated := dnsErrorResponse(&q, resp.Header.RCode)
+		truncated.Header.Truncated = true
+		packed, _ = truncated.Pack()
+	}
+	return packed
+}
+
+// resolve returns the response to the given query, which we either answer
+// ourselves, if the query is for an overridden hostname, take from our cache,
+// or forward to our upstream resolvers.
+func (r *dnsResolver) resolve(q *dnsmessage.Message, query []byte) dnsmessage.Message {
+	if answers, ok := r.overrides.answer(q.Questions[0]); ok {
+		resp := dnsErrorResponse(q, dnsmessage.RCodeSuccess)
+		resp.Header.Authoritative = true
+		resp.Answers = answers
+		return resp
+	}
+	key := dnsKeyOf(q.Questions[0])
+	if resp, ok := r.lookup(key); ok {
+		ops.dnsCacheHits.Add(1)
+		return resp
+	}
+	ops.dnsCacheMisses.Add(1)
+	resp, err := r.forward(query, q.Header.ID)
+	if err != nil {
+		elog.Warn("Failed to resolve DNS query.", "name", key.name, "error", err)
+		return dnsErrorResponse(q, dnsmessage.RCodeServerFailure)
+	}
+	r.store(key, resp)
+	return resp
+}
+
+// lookup returns a copy of the cached response to the given question, with
+// its TTLs reduced by the time that the response spent in our cache.
+func (r *dnsResolver) lookup(key dnsKey) (dnsmessage.Message, bool) {
+	r.Lock()
+	defer r.Unlock()
+	entry, exists := r.entries[key]
+	if !exists {
+		return dnsmessage.Message{}, false
+	}
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		delete(r.entries, key)
+		return dnsmessage.Message{}, false
+	}
+	elapsed := uint32(now.Sub(entry.added) / time.Second)
+	msg := entry.msg
+	msg.Answers = agedResources(msg.Answers, elapsed)
+	msg.Authorities = agedResources(msg.Authorities, elapsed)
+	msg.Additionals = agedResources(msg.Additionals, elapsed)
+	return msg, true
+}
+
+// store caches a copy of the given response to the given question, if the
+// response permits caching.  We copy the response's records because packing
+// the caller's response writes to them.  If our cache is full, we first drop
+// expired responses and, if that's not enough, an arbitrary one.
+func (r *dnsResolver) store(key dnsKey, msg dnsmessage.Message) {
+	ttl, ok := cacheTTL(&msg)
+	if !ok {
+		return
+	}
+	msg.Answers = slices.Clone(msg.Answers)
+	msg.Authorities = slices.Clone(msg.Authorities)
+	msg.Additionals = slices.Clone(msg.Additionals)
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	if _, exists := r.entries[key]; !exists && len(r.entries) >= dnsCacheMaxItems {
+		for k, entry := range r.entries {
+			if !now.Before(entry.expires) {
+				delete(r.entries, k)
+			}
+		}
+		for k := range r.entries {
+			if len(r.entries) < dnsCacheMaxItems {
+				break
+			}
+			delete(r.entries, k)
+		}
+	}
+	r.entries[key] = &dnsCacheEntry{msg: msg, added: now, expires: now.Add(ttl)}
+}
+
+// forward sends the given query to our upstream resolvers, in order, and
+// returns the first response.  If an upstream's UDP response is truncated,
+// we repeat the query over TCP, so we can cache the complete response.
+func (r *dnsResolver) forward(query []byte, id uint16) (dnsmessage.Message, error) {
+	err := errDNSNoUpstream
+	for _, upstream := range r.upstreams {
+		var resp dnsmessage.Message
+		resp, err = exchange("udp", upstream, query, id)
+		if err == nil && resp.Header.Truncated {
+			resp, err = exchange("tcp", upstream, query, id)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		elog.Debug("Upstream resolver failed.", "upstream", upstream, "error", err)
+	}
+	return dnsmessage.Message{}, err
+}
+
+// exchange sends the given query to the given upstream resolver and returns
+// its response.
+func exchange(network, upstream string, query []byte, id uint16) (dnsmessage.Message, error) {
+	var msg dnsmessage.Message
+	conn, err := net.DialTimeout(network, upstream, dnsUpstreamTimeout)
+	if err != nil {
+		return msg, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+
+	var resp []byte
+	if network == "tcp" {
+		if _, err = conn.Write(tcpMsg(query)); err != nil {
+			return msg, err
+		}
+		if resp, err = readTCPMsg(conn); err != nil {
+			return msg, err
+		}
+	} else {
+		if _, err = conn.Write(query); err != nil {
+			return msg, err
+		}
+		buf := make([]byte, dnsMaxMsgLen)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return msg, err
+		}
+		resp = buf[:n]
+	}
+	if err = msg.Unpack(resp); err != nil {
+		return msg, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if !msg.Header.Response || msg.Header.ID != id {
+		return msg, errDNSBadResponse
+	}
+	return msg, nil
+}
+
+// cacheTTL returns how long we may cache the given response, or false if we
+// must not cache it.  Positive responses live as long as their shortest
+// answer TTL.  Negative responses -- NXDOMAIN and NODATA -- live as long as
+// the SOA record in their authority section permits, as per RFC 2308, and
+// aren't cacheable without one.
+func cacheTTL(msg *dnsmessage.Message) (time.Duration, bool) {
+	if msg.Header.Truncated {
+		return 0, false
+	}
+	var ttl time.Duration
+	switch {
+	case msg.Header.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0:
+		minTTL := msg.Answers[0].Header.TTL
+		for _, rr := range msg.Answers[1:] {
+			minTTL = min(minTTL, rr.Header.TTL)
+		}
+		ttl = min(time.Duration(minTTL)*time.Second, dnsMaxTTL)
+	case msg.Header.RCode == dnsmessage.RCodeSuccess || msg.Header.RCode == dnsmessage.RCodeNameError:
+		soa, ok := soaTTL(msg.Authorities)
+		if !ok {
+			return 0, false
+		}
+		ttl = min(soa, dnsMaxNegativeTTL)
+	default:
+		return 0, false
+	}
+	return ttl, ttl > 0
+}
+
+// soaTTL returns the negative caching TTL of the first SOA record in the
+// given authority section: the minimum of the record's TTL and its MINIMUM
+// field.
+func soaTTL(authorities []dnsmessage.Resource) (time.Duration, bool) {
+	for _, rr := range authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(rr.Header.TTL, soa.MinTTL)) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// agedResources returns a copy of the given resource records whose TTLs we
+// reduced by the given number of seconds.
+func agedResources(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if rrs == nil {
+		return nil
+	}
+	aged := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		aged[i] = rr
+		aged[i].Header.TTL -= min(rr.Header.TTL, elapsed)
+	}
+	return aged
+}
+
+// withoutOPT returns the given additional records without EDNS records.
+func withoutOPT(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+	var filtered []dnsmessage.Resource
+	for _, rr := range rrs {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+// udpPayloadLen returns the UDP payload size that the given query's EDNS
+// record advertises, or the minimum size if it has none.
+func udpPayloadLen(q *dnsmessage.Message) int {
+	for _, rr := range q.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return max(int(rr.Header.Class), dnsMinUDPLen)
+		}
+	}
+	return dnsMinUDPLen
+}
+
+// dnsErrorResponse returns an empty response to the given query with the given
+// response code.
+func dnsErrorResponse(q *dnsmessage.Message, rcode dnsmessage.RCode) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 q.Header.ID,
+			Response:           true,
+			RecursionDesired:   q.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: q.Questions,
+	}
+}
+
+func dnsKeyOf(q dnsmessage.Question) dnsKey {
+	return dnsKey{
+		name:  strings.ToLower(q.Name.String()),
+		qtype: q.Type,
+		class: q.Class,
+	}
+}
+
+// tcpMsg returns the given DNS message with the two-byte length prefix that
+// DNS over TCP requires.
+func tcpMsg(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
+
+// readTCPMsg reads a length-prefixed DNS message from the given reader.
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
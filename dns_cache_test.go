@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	testDNSName = dnsmessage.MustNewName("example.com.")
+	testDNSAddr = [4]byte{198, 51, 100, 1}
+)
+
+// fakeUpstream runs an upstream resolver on localhost that answers queries
+// over UDP and TCP with the given function.  It returns the resolver's
+// address and the number of queries that it answered.
+func fakeUpstream(t *testing.T, respond func(q *dnsmessage.Message, tcp bool) dnsmessage.Message) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	failOnErr(t, err)
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	failOnErr(t, err)
+	t.Cleanup(func() { pc.Close(); l.Close() })
+
+	queries := new(atomic.Int32)
+	answer := func(query []byte, tcp bool) []byte {
+		var q dnsmessage.Message
+		failOnErr(t, q.Unpack(query))
+		queries.Add(1)
+		resp := respond(&q, tcp)
+		resp.Header.ID = q.Header.ID
+		resp.Header.Response = true
+		resp.Questions = q.Questions
+		packed, err := resp.Pack()
+		failOnErr(t, err)
+		return packed
+	}
+	go func() {
+		buf := make([]byte, dnsMaxMsgLen)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(answer(buf[:n], false), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if query, err := readTCPMsg(conn); err == nil {
+				_, _ = conn.Write(tcpMsg(answer(query, true)))
+			}
+			conn.Close()
+		}
+	}()
+	return pc.LocalAddr().String(), queries
+}
+
+func dnsQuery(t *testing.T, id uint16, name dnsmessage.Name) []byte {
+	t.Helper()
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+	}
+	packed, err := q.Pack()
+	failOnErr(t, err)
+	return packed
+}
+
+func dnsAnswer(t *testing.T, resp []byte) dnsmessage.Message {
+	t.Helper()
+	var msg dnsmessage.Message
+	failOnErr(t, msg.Unpack(resp))
+	return msg
+}
+
+func aRecord(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name: testDNSName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl,
+		},
+		Body: &dnsmessage.AResource{A: testDNSAddr},
+	}
+}
+
+func soaRecord(ttl, minTTL uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name: testDNSName, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl,
+		},
+		Body: &dnsmessage.SOAResource{NS: testDNSName, MBox: testDNSName, MinTTL: minTTL},
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	upstream, queries := fakeUpstream(t, func(*dnsmessage.Message, bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(300), aRecord(600)}}
+	})
+	r := newDNSResolver([]string{upstream}, nil)
+	hits := ops.dnsCacheHits.Load()
+
+	for id := uint16(1); id <= 2; id++ {
+		resp := dnsAnswer(t, r.answer(dnsQuery(t, id, testDNSName), true))
+		assertEqual(t, resp.Header.ID, id)
+		assertEqual(t, len(resp.Answers), 2)
+	}
+	assertEqual(t, queries.Load(), int32(1))
+	assertEqual(t, ops.dnsCacheHits.Load()-hits, uint64(1))
+
+	// Names are case-insensitive, and cached TTLs count down.
+	key := dnsKeyOf(dnsmessage.Question{Name: testDNSName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	r.entries[key].added = r.entries[key].added.Add(-10 * time.Second)
+	resp := dnsAnswer(t, r.answer(dnsQuery(t, 3, dnsmessage.MustNewName("EXAMPLE.com.")), true))
+	assertEqual(t, resp.Answers[0].Header.TTL, uint32(290))
+	assertEqual(t, resp.Answers[1].Header.TTL, uint32(590))
+	assertEqual(t, queries.Load(), int32(1))
+
+	// Expired responses are fetched again.
+	r.entries[key].expires = time.Now()
+	_ = r.answer(dnsQuery(t, 4, testDNSName), true)
+	assertEqual(t, queries.Load(), int32(2))
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	for _, test := range []struct {
+		resp    dnsmessage.Message
+		queries int32
+	}{
+		// NXDOMAIN with an SOA record is cached...
+		{
+			dnsmessage.Message{
+				Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+				Authorities: []dnsmessage.Resource{soaRecord(600, 60)},
+			},
+			1,
+		},
+		// ...but neither NXDOMAIN without one nor server failures.
+		{dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}, 2},
+		{dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}, 2},
+	} {
+		resp := test.resp
+		upstream, queries := fakeUpstream(t, func(*dnsmessage.Message, bool) dnsmessage.Message {
+			return resp
+		})
+		r := newDNSResolver([]string{upstream}, nil)
+		for id := uint16(1); id <= 2; id++ {
+			got := dnsAnswer(t, r.answer(dnsQuery(t, id, testDNSName), true))
+			assertEqual(t, got.Header.RCode, resp.Header.RCode)
+		}
+		assertEqual(t, queries.Load(), test.queries)
+	}
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	for _, test := range []struct {
+		msg dnsmessage.Message
+		ttl time.Duration
+		ok  bool
+	}{
+		{dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(60), aRecord(30)}}, 30 * time.Second, true},
+		{dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(86400)}}, dnsMaxTTL, true},
+		{dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(0)}}, 0, false},
+		// NODATA.
+		{dnsmessage.Message{Authorities: []dnsmessage.Resource{soaRecord(30, 3600)}}, 30 * time.Second, true},
+		{
+			dnsmessage.Message{
+				Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+				Authorities: []dnsmessage.Resource{soaRecord(86400, 86400)},
+			},
+			dnsMaxNegativeTTL, true,
+		},
+		{dnsmessage.Message{}, 0, false},
+		{
+			dnsmessage.Message{
+				Header:  dnsmessage.Header{Truncated: true},
+				Answers: []dnsmessage.Resource{aRecord(60)},
+			},
+			0, false,
+		},
+		{dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeRefused}}, 0, false},
+	} {
+		ttl, ok := cacheTTL(&test.msg)
+		assertEqual(t, ttl, test.ttl)
+		assertEqual(t, ok, test.ok)
+	}
+}
+
+func TestDNSCacheTruncation(t *testing.T) {
+	many := make([]dnsmessage.Resource, 50)
+	for i := range many {
+		many[i] = aRecord(60)
+	}
+	upstream, queries := fakeUpstream(t, func(_ *dnsmessage.Message, tcp bool) dnsmessage.Message {
+		if !tcp {
+			return dnsmessage.Message{Header: dnsmessage.Header{Truncated: true}}
+		}
+		return dnsmessage.Message{Answers: many}
+	})
+	r := newDNSResolver([]string{upstream}, nil)
+
+	// We fetch truncated responses again over TCP, but truncate them for
+	// UDP clients, which then ask us over TCP.
+	resp := dnsAnswer(t, r.answer(dnsQuery(t, 1, testDNSName), true))
+	assertEqual(t, resp.Header.Truncated, true)
+	assertEqual(t, len(resp.Answers), 0)
+	assertEqual(t, queries.Load(), int32(2))
+	resp = dnsAnswer(t, r.answer(dnsQuery(t, 2, testDNSName), false))
+	assertEqual(t, len(resp.Answers), len(many))
+	assertEqual(t, queries.Load(), int32(2))
+}
+
+func TestDNSCacheNoUpstream(t *testing.T) {
+	// Nothing listens on the discard port.
+	r := newDNSResolver([]string{"127.0.0.1:9"}, nil)
+	resp := dnsAnswer(t, r.answer(dnsQuery(t, 1, testDNSName), true))
+	assertEqual(t, resp.Header.RCode, dnsmessage.RCodeServerFailure)
+
+	// Malformed queries get no response.
+	assertEqual(t, r.answer([]byte("foo"), true) == nil, true)
+}
+
+func TestDNSCacheListen(t *testing.T) {
+	upstream, _ := fakeUpstream(t, func(*dnsmessage.Message, bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(60)}}
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	addr := "127.0.0.1:50053"
+	failOnErr(t, newDNSResolver([]string{upstream}, nil).listen(addr, stop))
+
+	for _, network := range []string{"udp", "tcp"} {
+		resp, err := exchange(network, addr, dnsQuery(t, 1, testDNSName), 1)
+		failOnErr(t, err)
+		assertEqual(t, resp.Answers[0].Body.(*dnsmessage.AResource).A, testDNSAddr)
+	}
+}
+
+func TestValidateDNSCache(t *testing.T) {
+	failOnErr(t, new(Config).validateDNSCache())
+	failOnErr(t, (&Config{DNSCache: true, DNSUpstreams: []string{"10.0.0.2:53", "[fd00::53]:53"}}).validateDNSCache())
+
+	for _, c := range []*Config{
+		{DNSUpstreams: []string{"10.0.0.2:53"}},
+		{DNSCache: true, DNSUpstreams: []string{"dns.example.com:53"}},
+		{DNSCache: true, DNSUpstreams: []string{"10.0.0.2"}},
+	} {
+		if err := c.validateDNSCache(); !errors.Is(err, errCfgBadDNSUpstream) {
+			t.Fatalf("Expected error %v but got %v.", errCfgBadDNSUpstream, err)
+		}
+	}
+
+	// The default upstream is the host proxy's resolver.
+	c := &Config{TapSubnet: defaultTapSubnet}
+	assertEqual(t, c.dnsUpstreams()[0], "192.168.127.1:53")
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errDNSProvider = errors.New("DNS provider returned an error")
+
+	// The endpoints of Route 53 and Cloudflare.  Using variables allows us to
+	// mock the providers in our unit tests.
+	route53Endpoint   = "https://route53.amazonaws.com/2013-04-01"
+	cloudflareAPIURL  = "https://api.cloudflare.com/client/v4"
+	route53PollPeriod = 2 * time.Second
+)
+
+// route53Provider manages TXT records in the given Route 53 hosted zone,
+// using the EC2 host's instance role.
+type route53Provider struct {
+	zoneID string
+}
+
+// route53Change is the body of Route 53's ChangeResourceRecordSets request.
+type route53Change struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Values  []string `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+// route53ChangeInfo is the part of Route 53's responses that tells us if a
+// change is in effect on all of Route 53's name servers.
+type route53ChangeInfo struct {
+	ID     string `xml:"ChangeInfo>Id"`
+	Status string `xml:"ChangeInfo>Status"`
+}
+
+// call sends a signed request to Route 53 and decodes the response.
+func (p *route53Provider) call(ctx context.Context, method, path string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = xml.Marshal(in); err != nil {
+			return err
+		}
+	}
+	creds, err := getAWSCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, route53Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	// Route 53 is a global service whose requests are signed for us-east-1.
+	signAWSRequest(req, body, creds, "us-east-1", "route53", currentTime())
+	respBody, err := doAWSRequest(req)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(respBody, out)
+}
+
+// change applies the given action to the TXT record set of the given name,
+// and waits until Route 53's name servers serve the change.
+func (p *route53Provider) change(ctx context.Context, action, name string, values []string) error {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = `"` + v + `"`
+	}
+	var info route53ChangeInfo
+	if err := p.call(ctx, http.MethodPost, "/hostedzone/"+p.zoneID+"/rrset", &route53Change{
+		Action: action,
+		Name:   name,
+		Type:   "TXT",
+		TTL:    acmeDNSRecordTTL,
+		Values: quoted,
+	}, &info); err != nil {
+		return err
+	}
+	for info.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(route53PollPeriod):
+		}
+		if err := p.call(ctx, http.MethodGet, info.ID, nil, &info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *route53Provider) setTXT(ctx context.Context, name string, values []string) error {
+	return p.change(ctx, "UPSERT", name, values)
+}
+
+func (p *route53Provider) deleteTXT(ctx context.Context, name string, values []string) error {
+	return p.change(ctx, "DELETE", name, values)
+}
+
+// cloudflareProvider manages TXT records in the given Cloudflare zone, using
+// the given API token.
+type cloudflareProvider struct {
+	sync.Mutex
+	zoneID string
+	token  string
+	ids    map[string]string // Maps name and value to the record's ID.
+}
+
+// newCloudflareProvider returns a new cloudflareProvider.
+func newCloudflareProvider(zoneID, token string) *cloudflareProvider {
+	return &cloudflareProvider{
+		zoneID: zoneID,
+		token:  token,
+		ids:    make(map[string]string),
+	}
+}
+
+// call sends an authenticated request to Cloudflare's API and returns the
+// result in Cloudflare's response envelope.
+func (p *cloudflareProvider) call(ctx context.Context, method, path string, in any) (json.RawMessage, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPIURL+"/zones/"+p.zoneID+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", contentTypeJSON)
+	resp, err := awsHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Success bool            `json:"success"`
+		Result  json.RawMessage `json:"result"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(newLimitReader(resp.Body, maxAWSRespLen)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("%w: %s", errDNSProvider, resp.Status)
+	}
+	if !out.Success {
+		msgs := make([]string, len(out.Errors))
+		for i, e := range out.Errors {
+			msgs[i] = e.Message
+		}
+		return nil, fmt.Errorf("%w: %s: %s", errDNSProvider, resp.Status, strings.Join(msgs, "; "))
+	}
+	return out.Result, nil
+}
+
+func (p *cloudflareProvider) setTXT(ctx context.Context, name string, values []string) error {
+	for _, v := range values {
+		result, err := p.call(ctx, http.MethodPost, "/dns_records", map[string]any{
+			"type":    "TXT",
+			"name":    strings.TrimSuffix(name, "."),
+			"content": v,
+			"ttl":     acmeDNSRecordTTL,
+		})
+		if err != nil {
+			return err
+		}
+		var record struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(result, &record); err != nil {
+			return err
+		}
+		p.Lock()
+		p.ids[name+" "+v] = record.ID
+		p.Unlock()
+	}
+	return nil
+}
+
+func (p *cloudflareProvider) deleteTXT(ctx context.Context, name string, values []string) error {
+	var errs []error
+	for _, v := range values {
+		p.Lock()
+		id, ok := p.ids[name+" "+v]
+		delete(p.ids, name+" "+v)
+		p.Unlock()
+		if !ok {
+			continue
+		}
+		if _, err := p.call(ctx, http.MethodDelete, "/dns_records/"+id, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DNS constants for RFC 2136 updates that are signed with TSIG (RFC 8945).
+const (
+	dnsOpcodeUpdate = 5
+	dnsTypeSOA      = 6
+	dnsTypeTXT      = 16
+	dnsTypeTSIG     = 250
+	dnsClassIN      = 1
+	dnsClassNone    = 254
+	dnsClassAny     = 255
+	tsigFudge       = 300
+	tsigAlgorithm   = "hmac-sha256."
+	dnsTimeout      = 10 * time.Second
+	maxDNSMsgLen    = 65535
+)
+
+// rfc2136Provider manages TXT records via dynamic DNS updates that it sends to
+// the given name server, authenticated with the given TSIG key.
+type rfc2136Provider struct {
+	server  string
+	zone    string
+	keyName string
+	secret  []byte
+}
+
+// appendDNSName appends the given domain name in DNS wire format.
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid DNS name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// appendRR appends a resource record with the given fields.
+func appendRR(b []byte, name string, typ, class uint16, ttl uint32, rdata []byte) ([]byte, error) {
+	b, err := appendDNSName(b, name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...), nil
+}
+
+// newUpdate returns a signed DNS UPDATE message that adds or -- if the given
+// class is dnsClassNone -- deletes the given TXT records.
+func (p *rfc2136Provider) newUpdate(id uint16, name string, class uint16, values []string, now time.Time) ([]byte, error) {
+	ttl := uint32(acmeDNSRecordTTL)
+	if class == dnsClassNone {
+		ttl = 0
+	}
+	// Header: ID, opcode, and one zone, no prerequisites, a number of
+	// updates, and no additional records yet.
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsOpcodeUpdate<<11)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(values)))
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg, err := appendDNSName(msg, p.zone)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	for _, v := range values {
+		if len(v) > 255 {
+			return nil, errors.New("TXT value too long")
+		}
+		rdata := append([]byte{byte(len(v))}, v...)
+		if msg, err = appendRR(msg, name, dnsTypeTXT, class, ttl, rdata); err != nil {
+			return nil, err
+		}
+	}
+
+	// The TSIG MAC covers the message and the TSIG variables.
+	keyName, err := appendDNSName(nil, p.keyName)
+	if err != nil {
+		return nil, err
+	}
+	alg, _ := appendDNSName(nil, tsigAlgorithm)
+	timeSigned := binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))[2:]
+	vars := append(append([]byte{}, keyName...), 0, dnsClassAny, 0, 0, 0, 0)
+	vars = append(vars, alg...)
+	vars = append(vars, timeSigned...)
+	vars = binary.BigEndian.AppendUint16(vars, tsigFudge)
+	vars = append(vars, 0, 0, 0, 0) // Error and other length.
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(msg)
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+
+	rdata := append([]byte{}, alg...)
+	rdata = append(rdata, timeSigned...)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = append(rdata, 0, 0, 0, 0) // Error and other length.
+	if msg, err = appendRR(msg, p.keyName, dnsTypeTSIG, dnsClassAny, 0, rdata); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(msg[10:], 1) // One additional record.
+	return msg, nil
+}
+
+// update sends a DNS UPDATE message over TCP and checks the response code.
+func (p *rfc2136Provider) update(ctx context.Context, name string, class uint16, values []string) error {
+	var rawID [2]byte
+	if _, err := rand.Read(rawID[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(rawID[:])
+	msg, err := p.newUpdate(id, name, class, values, currentTime())
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", p.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp) != id {
+		return fmt.Errorf("%w: malformed DNS response", errDNSProvider)
+	}
+	if rcode := resp[3] & 0x0f; rcode != 0 {
+		return fmt.Errorf("%w: DNS update failed with rcode %d", errDNSProvider, rcode)
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) setTXT(ctx context.Context, name string, values []string) error {
+	return p.update(ctx, name, dnsClassIN, values)
+}
+
+func (p *rfc2136Provider) deleteTXT(ctx context.Context, name string, values []string) error {
+	return p.update(ctx, name, dnsClassNone, values)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRoute53Provider(t *testing.T) {
+	mockAWS(t)
+	var (
+		mu      sync.Mutex
+		changes []route53Change
+		polls   int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), awsSigAlgorithm+" Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/us-east-1/route53/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/hostedzone/Z1/rrset":
+			var c route53Change
+			if err := xml.NewDecoder(r.Body).Decode(&c); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			changes = append(changes, c)
+			_, _ = w.Write([]byte(`<ChangeResourceRecordSetsResponse><ChangeInfo>` +
+				`<Id>/change/C1</Id><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`))
+		case r.Method == http.MethodGet && r.URL.Path == "/change/C1":
+			polls++
+			_, _ = w.Write([]byte(`<GetChangeResponse><ChangeInfo>` +
+				`<Id>/change/C1</Id><Status>INSYNC</Status></ChangeInfo></GetChangeResponse>`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	origEndpoint, origPoll := route53Endpoint, route53PollPeriod
+	route53Endpoint, route53PollPeriod = srv.URL, 0
+	defer func() { route53Endpoint, route53PollPeriod = origEndpoint, origPoll }()
+
+	p := &route53Provider{zoneID: "Z1"}
+	name, values := "_acme-challenge.example.com.", []string{"foo", "bar"}
+	failOnErr(t, p.setTXT(context.Background(), name, values))
+	failOnErr(t, p.deleteTXT(context.Background(), name, values))
+
+	assertEqual(t, len(changes), 2)
+	assertEqual(t, polls, 2)
+	assertEqual(t, changes[0].Action, "UPSERT")
+	assertEqual(t, changes[1].Action, "DELETE")
+	assertEqual(t, changes[0].Name, name)
+	assertEqual(t, changes[0].Type, "TXT")
+	assertEqual(t, strings.Join(changes[0].Values, ","), `"foo","bar"`)
+
+	if err := (&route53Provider{zoneID: "Z2"}).setTXT(context.Background(), name, values); err == nil {
+		t.Fatal("Expected error for unknown hosted zone.")
+	}
+}
+
+func TestCloudflareProvider(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		records = make(map[string]string)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"success":false,"errors":[{"message":"Invalid API token"}]}`))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/zones/zone/dns_records":
+			var rec struct {
+				Type, Name, Content string
+			}
+			_ = json.NewDecoder(r.Body).Decode(&rec)
+			if rec.Type != "TXT" || rec.Name != "_acme-challenge.example.com" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"success":false,"errors":[{"message":"bad record"}]}`))
+				return
+			}
+			id := "id-" + rec.Content
+			records[id] = rec.Content
+			_, _ = w.Write([]byte(`{"success":true,"result":{"id":"` + id + `"}}`))
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/zones/zone/dns_records/"):
+			delete(records, strings.TrimPrefix(r.URL.Path, "/zones/zone/dns_records/"))
+			_, _ = w.Write([]byte(`{"success":true,"result":{}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	origURL := cloudflareAPIURL
+	cloudflareAPIURL = srv.URL
+	defer func() { cloudflareAPIURL = origURL }()
+
+	p := newCloudflareProvider("zone", "token")
+	name, values := "_acme-challenge.example.com.", []string{"foo", "bar"}
+	failOnErr(t, p.setTXT(context.Background(), name, values))
+	assertEqual(t, len(records), 2)
+	assertEqual(t, records["id-foo"], "foo")
+	failOnErr(t, p.deleteTXT(context.Background(), name, values))
+	assertEqual(t, len(records), 0)
+
+	err := newCloudflareProvider("zone", "wrong").setTXT(context.Background(), name, values)
+	if err == nil || !strings.Contains(err.Error(), "Invalid API token") {
+		t.Fatalf("Expected Cloudflare's error message but got %v.", err)
+	}
+}
+
+// mockNameServer accepts DNS updates over TCP, verifies their TSIG signature
+// with the given key, and responds with the given rcode.  It sends the
+// updates that it receives to the returned channel.
+func mockNameServer(t *testing.T, keyName string, secret []byte, rcode byte) (string, chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	failOnErr(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	updates := make(chan []byte, 10)
+
+	key, _ := appendDNSName(nil, keyName)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var n [2]byte
+			if _, err := io.ReadFull(conn, n[:]); err != nil {
+				conn.Close()
+				continue
+			}
+			msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				conn.Close()
+				continue
+			}
+
+			// Split off the TSIG record, and verify its MAC over the
+			// unsigned message and the TSIG variables.
+			resp := append([]byte{}, msg[:4]...)
+			resp[2] |= 0x80 // Set the QR bit.
+			i := bytes.LastIndex(msg, append(append([]byte{}, key...), 0, dnsTypeTSIG))
+			if i < 0 {
+				resp[3] = 9 // NOTAUTH
+			} else {
+				unsigned := append([]byte{}, msg[:i]...)
+				binary.BigEndian.PutUint16(unsigned[10:], 0)
+				rdata := msg[i+len(key)+10:]
+				algLen := bytes.IndexByte(rdata, 0) + 1
+				macLen := int(binary.BigEndian.Uint16(rdata[algLen+8:]))
+				gotMAC := rdata[algLen+10 : algLen+10+macLen]
+
+				vars := append(append([]byte{}, key...), 0, dnsClassAny, 0, 0, 0, 0)
+				vars = append(vars, rdata[:algLen+8]...)
+				vars = append(vars, 0, 0, 0, 0)
+				mac := hmac.New(sha256.New, secret)
+				mac.Write(unsigned)
+				mac.Write(vars)
+				if !hmac.Equal(mac.Sum(nil), gotMAC) {
+					resp[3] = 9 // NOTAUTH
+				} else {
+					resp[3] = rcode
+					updates <- unsigned
+				}
+			}
+			resp = append(resp, make([]byte, 8)...)
+			_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), updates
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	secret := []byte("tsig secret")
+	addr, updates := mockNameServer(t, "acme-key", secret, 0)
+	p := &rfc2136Provider{server: addr, zone: "example.com", keyName: "acme-key", secret: secret}
+	name, values := "_acme-challenge.example.com.", []string{"foo", "bar"}
+
+	failOnErr(t, p.setTXT(context.Background(), name, values))
+	msg := <-updates
+	assertEqual(t, msg[2]>>3, byte(dnsOpcodeUpdate))
+	assertEqual(t, binary.BigEndian.Uint16(msg[8:]), uint16(2))
+	assertEqual(t, bytes.Contains(msg, []byte("\x0f_acme-challenge\x07example\x03com\x00")), true)
+	assertEqual(t, bytes.Contains(msg, []byte{0, dnsTypeTXT, 0, dnsClassIN, 0, 0, 0, acmeDNSRecordTTL, 0, 4, 3, 'f', 'o', 'o'}), true)
+
+	failOnErr(t, p.deleteTXT(context.Background(), name, values))
+	msg = <-updates
+	assertEqual(t, bytes.Contains(msg, []byte{0, dnsTypeTXT, 0, dnsClassNone, 0, 0, 0, 0, 0, 4, 3, 'b', 'a', 'r'}), true)
+
+	// The name server must reject updates that are signed with another key.
+	p.secret = []byte("wrong secret")
+	if err := p.setTXT(context.Background(), name, values); err == nil {
+		t.Fatal("Expected error for update with bad TSIG signature.")
+	}
+
+	// Refused updates must result in an error.
+	addr, _ = mockNameServer(t, "acme-key", secret, 5)
+	p = &rfc2136Provider{server: addr, zone: "example.com", keyName: "acme-key", secret: secret}
+	if err := p.setTXT(context.Background(), name, values); err == nil {
+		t.Fatal("Expected error for refused update.")
+	}
+}
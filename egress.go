@@ -0,0 +1,338 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxEgressDests is the maximum number of destinations that we track
+	// individually.  Traffic to further destinations is counted as
+	// untracked, which bounds our memory use and the number of Prometheus
+	// time series.
+	maxEgressDests = 1024
+
+	// The EtherTypes, IP protocol numbers, and TCP flags that we look at.
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	protoICMP     = 1
+	protoTCP      = 6
+	protoUDP      = 17
+	protoICMPv6   = 58
+	tcpFlagSYN    = 0x02
+	tcpFlagRST    = 0x04
+	tcpFlagACK    = 0x10
+
+	ethHeaderLen  = 14
+	ipv6HeaderLen = 40
+	icmpHeaderLen = 8
+
+	egressOther = "other"
+)
+
+// packet contains the parts of an IP packet that we care about.
+type packet struct {
+	src, dst         netip.Addr
+	proto            uint8
+	srcPort, dstPort uint16
+	tcpFlags         uint8
+	// payload is the packet's layer 4 segment.
+	payload []byte
+}
+
+// parseFrame parses the IP packet in the given Ethernet frame.  It returns
+// false if the frame doesn't contain an IPv4 or IPv6 packet.
+func parseFrame(frame []byte) (packet, bool) {
+	if len(frame) < ethHeaderLen {
+		return packet{}, false
+	}
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeIPv4:
+		return parseIPv4(frame[ethHeaderLen:])
+	case etherTypeIPv6:
+		return parseIPv6(frame[ethHeaderLen:])
+	}
+	return packet{}, false
+}
+
+// parseIPv4 parses the given IPv4 packet, which may be truncated after its
+// layer 4 ports, like the packets that ICMP errors quote.
+func parseIPv4(b []byte) (packet, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return packet{}, false
+	}
+	headerLen := int(b[0]&0x0f) * 4
+	if headerLen < 20 || len(b) < headerLen {
+		return packet{}, false
+	}
+	p := packet{
+		src:   netip.AddrFrom4([4]byte(b[12:16])),
+		dst:   netip.AddrFrom4([4]byte(b[16:20])),
+		proto: b[9],
+	}
+	// Only the first fragment contains the layer 4 header.
+	if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 {
+		p.parsePayload(b[headerLen:])
+	}
+	return p, true
+}
+
+// parseIPv6 parses the given IPv6 packet.  We don't follow extension
+// headers, so packets that have any lack ports.
+func parseIPv6(b []byte) (packet, bool) {
+	if len(b) < ipv6HeaderLen || b[0]>>4 != 6 {
+		return packet{}, false
+	}
+	p := packet{
+		src:   netip.AddrFrom16([16]byte(b[8:24])),
+		dst:   netip.AddrFrom16([16]byte(b[24:40])),
+		proto: b[6],
+	}
+	p.parsePayload(b[ipv6HeaderLen:])
+	return p, true
+}
+
+func (p *packet) parsePayload(b []byte) {
+	p.payload = b
+	if (p.proto == protoTCP || p.proto == protoUDP) && len(b) >= 4 {
+		p.srcPort = binary.BigEndian.Uint16(b[0:2])
+		p.dstPort = binary.BigEndian.Uint16(b[2:4])
+	}
+	if p.proto == protoTCP && len(b) >= 14 {
+		p.tcpFlags = b[13]
+	}
+}
+
+// unreachable returns the packet that the given ICMP "destination
+// unreachable" error quotes, i.e., the packet that we failed to deliver.
+func (p *packet) unreachable() (packet, bool) {
+	if len(p.payload) < icmpHeaderLen {
+		return packet{}, false
+	}
+	switch {
+	case p.proto == protoICMP && p.payload[0] == 3:
+		return parseIPv4(p.payload[icmpHeaderLen:])
+	case p.proto == protoICMPv6 && p.payload[0] == 1:
+		return parseIPv6(p.payload[icmpHeaderLen:])
+	}
+	return packet{}, false
+}
+
+// egressDest identifies a destination of outbound traffic.
+type egressDest struct {
+	addr  netip.Addr
+	port  uint16
+	proto uint8
+}
+
+// egressCounters counts the traffic to a destination.  Connections are TCP
+// connection attempts, and errors are TCP resets and ICMP "destination
+// unreachable" errors.  Bytes are the lengths of Ethernet frames.
+type egressCounters struct {
+	Connections   uint64 `json:"connections"`
+	PacketsSent   uint64 `json:"packets_sent"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+	Errors        uint64 `json:"errors"`
+}
+
+// egressStat contains the counters of a destination.
+type egressStat struct {
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Protocol string `json:"protocol"`
+	egressCounters
+}
+
+// egressSnapshot contains the values of our egress counters at a given point
+// in time.
+type egressSnapshot struct {
+	Destinations []egressStat   `json:"destinations"`
+	Untracked    egressCounters `json:"untracked"`
+}
+
+// egressStats counts the enclave's outbound TCP and UDP traffic by
+// destination, as our TAP forwarder sees it.  To keep inbound connections
+// (e.g., from clients that reach the enclave via the host proxy) from
+// flooding our table, we only track destinations that the enclave initiated
+// TCP connections or sent UDP datagrams to.
+type egressStats struct {
+	sync.Mutex
+	dests     map[egressDest]*egressCounters
+	untracked egressCounters
+}
+
+// newEgressStats returns a new, empty egressStats.
+func newEgressStats() *egressStats {
+	return &egressStats{dests: make(map[egressDest]*egressCounters)}
+}
+
+// observeOut counts the given Ethernet frame, which the enclave sends to the
+// host.
+func (s *egressStats) observeOut(frame []byte) {
+	if s == nil {
+		return
+	}
+	p, ok := parseFrame(frame)
+	if !ok || (p.proto != protoTCP && p.proto != protoUDP) {
+		return
+	}
+	connect := p.proto == protoTCP && p.tcpFlags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN
+	dest := egressDest{addr: p.dst, port: p.dstPort, proto: p.proto}
+
+	s.Lock()
+	defer s.Unlock()
+	c, exists := s.dests[dest]
+	if !exists {
+		// A TCP segment that belongs to a connection that we didn't initiate.
+		if p.proto == protoTCP && !connect {
+			return
+		}
+		if len(s.dests) >= maxEgressDests {
+			c = &s.untracked
+		} else {
+			c = new(egressCounters)
+			s.dests[dest] = c
+		}
+	}
+	if connect {
+		c.Connections++
+	}
+	c.PacketsSent++
+	c.BytesSent += uint64(len(frame))
+}
+
+// observeIn counts the given Ethernet frame, which the host sends to the
+// enclave.
+func (s *egressStats) observeIn(frame []byte) {
+	if s == nil {
+		return
+	}
+	p, ok := parseFrame(frame)
+	if !ok {
+		return
+	}
+	isErr := p.proto == protoTCP && p.tcpFlags&tcpFlagRST != 0
+	dest := egressDest{addr: p.src, port: p.srcPort, proto: p.proto}
+	if quoted, ok := p.unreachable(); ok {
+		isErr = true
+		dest = egressDest{addr: quoted.dst, port: quoted.dstPort, proto: quoted.proto}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	c, exists := s.dests[dest]
+	if !exists {
+		return
+	}
+	if isErr {
+		c.Errors++
+	}
+	c.BytesReceived += uint64(len(frame))
+}
+
+// snapshot returns the current values of our counters, sorted by
+// destination.
+func (s *egressStats) snapshot() *egressSnapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	snap := &egressSnapshot{
+		Destinations: make([]egressStat, 0, len(s.dests)),
+		Untracked:    s.untracked,
+	}
+	for dest, c := range s.dests {
+		snap.Destinations = append(snap.Destinations, egressStat{
+			Host:           dest.addr.String(),
+			Port:           dest.port,
+			Protocol:       protoName(dest.proto),
+			egressCounters: *c,
+		})
+	}
+	slices.SortFunc(snap.Destinations, func(a, b egressStat) int {
+		if n := cmp.Compare(a.Host, b.Host); n != 0 {
+			return n
+		}
+		if n := cmp.Compare(a.Port, b.Port); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.Protocol, b.Protocol)
+	})
+	return snap
+}
+
+// protoName returns the name of the given layer 4 protocol.
+func protoName(proto uint8) string {
+	switch proto {
+	case protoTCP:
+		return "tcp"
+	case protoUDP:
+		return "udp"
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// egressHandler returns an HTTP handler that returns our JSON-encoded egress
+// counters.
+func egressHandler(s *egressStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(s.snapshot()); err != nil {
+			elog.Error("Error encoding egress stats.", "error", err)
+		}
+	}
+}
+
+// egressCollector exposes our egress counters as Prometheus metrics, labelled
+// by destination.  Untracked traffic has the host "other".
+type egressCollector struct {
+	stats *egressStats
+	descs map[string]*prometheus.Desc
+}
+
+func newEgressCollector(namespace string, stats *egressStats) *egressCollector {
+	c := &egressCollector{stats: stats, descs: make(map[string]*prometheus.Desc)}
+	for name, help := range map[string]string{
+		"connections":    "TCP connection attempts to a destination",
+		"packets_sent":   "Packets sent to a destination",
+		"bytes_sent":     "Bytes sent to a destination",
+		"bytes_received": "Bytes received from a destination",
+		"errors":         "TCP resets and ICMP unreachable errors from a destination",
+	} {
+		c.descs[name] = prometheus.NewDesc(prometheus.BuildFQName(namespace, "egress", name+"_total"),
+			help, []string{"host", "port", "protocol"}, nil)
+	}
+	return c
+}
+
+func (c *egressCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *egressCollector) Collect(ch chan<- prometheus.Metric) {
+	snap := c.stats.snapshot()
+	stats := append(snap.Destinations, egressStat{Host: egressOther, egressCounters: snap.Untracked})
+	for _, s := range stats {
+		port := strconv.Itoa(int(s.Port))
+		for name, value := range map[string]uint64{
+			"connections":    s.Connections,
+			"packets_sent":   s.PacketsSent,
+			"bytes_sent":     s.BytesSent,
+			"bytes_received": s.BytesReceived,
+			"errors":         s.Errors,
+		} {
+			ch <- prometheus.MustNewConstMetric(c.descs[name], prometheus.CounterValue,
+				float64(value), s.Host, port, s.Protocol)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	enclaveAddr  = netip.MustParseAddr("192.168.127.2")
+	remoteAddr   = netip.MustParseAddr("198.51.100.1")
+	enclaveAddr6 = netip.MustParseAddr("fd00::2")
+	remoteAddr6  = netip.MustParseAddr("2001:db8::1")
+)
+
+// ipPacket returns an IPv4 or IPv6 packet of the given protocol, whose layer
+// 4 header contains the given ports and, for TCP, flags.
+func ipPacket(src, dst netip.Addr, proto uint8, sport, dport uint16, flags uint8) []byte {
+	l4 := make([]byte, 20)
+	binary.BigEndian.PutUint16(l4[0:2], sport)
+	binary.BigEndian.PutUint16(l4[2:4], dport)
+	l4[13] = flags
+
+	if src.Is4() {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		ip[9] = proto
+		copy(ip[12:16], src.AsSlice())
+		copy(ip[16:20], dst.AsSlice())
+		return append(ip, l4...)
+	}
+	ip := make([]byte, ipv6HeaderLen)
+	ip[0] = 0x60
+	ip[6] = proto
+	copy(ip[8:24], src.AsSlice())
+	copy(ip[24:40], dst.AsSlice())
+	return append(ip, l4...)
+}
+
+// ethFrame wraps the given IP packet in an Ethernet frame.
+func ethFrame(ipPacket []byte) []byte {
+	frame := make([]byte, ethHeaderLen)
+	etherType := uint16(etherTypeIPv4)
+	if ipPacket[0]>>4 == 6 {
+		etherType = etherTypeIPv6
+	}
+	binary.BigEndian.PutUint16(frame[12:14], etherType)
+	return append(frame, ipPacket...)
+}
+
+// unreachableFrame returns an ICMP "port unreachable" error that quotes the
+// given packet.
+func unreachableFrame(src, dst netip.Addr, quoted []byte) []byte {
+	icmp := append([]byte{3, 3, 0, 0, 0, 0, 0, 0}, quoted[:28]...)
+	ip := ipPacket(src, dst, protoICMP, 0, 0, 0)[:20]
+	return ethFrame(append(ip, icmp...))
+}
+
+func egressCountersOf(s *egressStats, addr netip.Addr, port uint16, proto uint8) egressCounters {
+	s.Lock()
+	defer s.Unlock()
+	if c, ok := s.dests[egressDest{addr: addr, port: port, proto: proto}]; ok {
+		return *c
+	}
+	return egressCounters{}
+}
+
+func TestEgressTCP(t *testing.T) {
+	s := newEgressStats()
+	syn := ethFrame(ipPacket(enclaveAddr, remoteAddr, protoTCP, 40000, 443, tcpFlagSYN))
+	ack := ethFrame(ipPacket(enclaveAddr, remoteAddr, protoTCP, 40000, 443, tcpFlagACK))
+	synAck := ethFrame(ipPacket(remoteAddr, enclaveAddr, protoTCP, 443, 40000, tcpFlagSYN|tcpFlagACK))
+	rst := ethFrame(ipPacket(remoteAddr, enclaveAddr, protoTCP, 443, 40000, tcpFlagRST))
+
+	s.observeOut(syn)
+	s.observeIn(synAck)
+	s.observeOut(ack)
+	s.observeIn(rst)
+	assertEqual(t, egressCountersOf(s, remoteAddr, 443, protoTCP), egressCounters{
+		Connections:   1,
+		PacketsSent:   2,
+		BytesSent:     uint64(len(syn) + len(ack)),
+		BytesReceived: uint64(len(synAck) + len(rst)),
+		Errors:        1,
+	})
+
+	// Connections that clients initiated aren't egress traffic.
+	s.observeIn(ethFrame(ipPacket(remoteAddr, enclaveAddr, protoTCP, 50000, 443, tcpFlagSYN)))
+	s.observeOut(ethFrame(ipPacket(enclaveAddr, remoteAddr, protoTCP, 443, 50000, tcpFlagSYN|tcpFlagACK)))
+	assertEqual(t, len(s.snapshot().Destinations), 1)
+
+	s.observeOut(ethFrame(ipPacket(enclaveAddr6, remoteAddr6, protoTCP, 40000, 443, tcpFlagSYN)))
+	assertEqual(t, egressCountersOf(s, remoteAddr6, 443, protoTCP).Connections, uint64(1))
+}
+
+func TestEgressUDP(t *testing.T) {
+	s := newEgressStats()
+	query := ipPacket(enclaveAddr, remoteAddr, protoUDP, 40000, 53, 0)
+	s.observeOut(ethFrame(query))
+	s.observeIn(ethFrame(ipPacket(remoteAddr, enclaveAddr, protoUDP, 53, 40000, 0)))
+	s.observeIn(unreachableFrame(remoteAddr, enclaveAddr, query))
+
+	c := egressCountersOf(s, remoteAddr, 53, protoUDP)
+	assertEqual(t, c.Connections, uint64(0))
+	assertEqual(t, c.PacketsSent, uint64(1))
+	assertEqual(t, c.Errors, uint64(1))
+}
+
+func TestEgressMalformed(t *testing.T) {
+	s := newEgressStats()
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:14], 0x0806)
+	for _, frame := range [][]byte{
+		nil,
+		arp,
+		ethFrame([]byte{0x45}),
+		ethFrame(ipPacket(enclaveAddr, remoteAddr, protoTCP, 1, 2, tcpFlagSYN)[:19]),
+	} {
+		s.observeOut(frame)
+		s.observeIn(frame)
+	}
+	assertEqual(t, len(s.snapshot().Destinations), 0)
+
+	// Nil stats count nothing.
+	var nilStats *egressStats
+	nilStats.observeOut(arp)
+	nilStats.observeIn(arp)
+}
+
+func TestEgressUntracked(t *testing.T) {
+	s := newEgressStats()
+	for port := 1; port <= maxEgressDests+1; port++ {
+		s.observeOut(ethFrame(ipPacket(enclaveAddr, remoteAddr, protoUDP, 40000, uint16(port), 0)))
+	}
+	snap := s.snapshot()
+	assertEqual(t, len(snap.Destinations), maxEgressDests)
+	assertEqual(t, snap.Untracked.PacketsSent, uint64(1))
+	// Snapshots are sorted.
+	assertEqual(t, snap.Destinations[0].Port, uint16(1))
+	assertEqual(t, snap.Destinations[maxEgressDests-1].Port, uint16(maxEgressDests))
+}
+
+func TestEgressHandler(t *testing.T) {
+	cfg := defaultCfg
+	cfg.EgressStats = true
+	e := createEnclave(&cfg)
+	e.egress.observeOut(ethFrame(ipPacket(enclaveAddr, remoteAddr, protoTCP, 40000, 443, tcpFlagSYN)))
+
+	resp := makeReqToSrv(e.extPrivSrv)(http.MethodGet, versioned(pathEgress), nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var snap egressSnapshot
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&snap))
+	assertEqual(t, len(snap.Destinations), 1)
+	assertEqual(t, snap.Destinations[0].Host, remoteAddr.String())
+	assertEqual(t, snap.Destinations[0].Protocol, "tcp")
+	assertEqual(t, snap.Destinations[0].Connections, uint64(1))
+
+	// One time series per counter, for the destination and for untracked
+	// traffic.
+	assertEqual(t, testutil.CollectAndCount(newEgressCollector("", e.egress)), 10)
+}
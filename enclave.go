@@ -11,12 +11,17 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"html/template"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	_ "net/http/pprof"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -25,6 +30,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -36,8 +42,11 @@ const (
 	// EC2 instance.  According to the AWS docs, it is always 3:
 	// https://docs.aws.amazon.com/enclaves/latest/user/nitro-enclave-concepts.html
 	parentCID = 3
-	// The following paths are handled by nitriding.
+	// The following paths are handled by nitriding.  Each path is also
+	// available under pathV1, e.g., /enclave/v1/attestation.  The unversioned
+	// paths are deprecated.
 	pathRoot        = "/enclave"
+	pathV1          = "/enclave/v1"
 	pathAttestation = "/enclave/attestation"
 	pathState       = "/enclave/state"
 	pathSync        = "/enclave/sync"
@@ -47,6 +56,42 @@ const (
 	pathConfig      = "/enclave/config"
 	pathLeader      = "/enclave/leader"
 	pathHeartbeat   = "/enclave/heartbeat"
+	pathInfo        = "/enclave/info"
+	pathImage       = "/enclave/image"
+	pathBundle      = "/enclave/verification-bundle"
+	pathOpenAPI     = "/enclave/openapi.json"
+	pathAudit       = "/enclave/audit"
+	pathStats       = "/enclave/stats"
+	pathEgress      = "/enclave/egress"
+	pathEntropy     = "/enclave/entropy"
+	pathProvision   = "/enclave/provision"
+	pathSecrets     = "/enclave/secrets"
+	pathTime        = "/enclave/time"
+	pathShutdown    = "/enclave/shutdown"
+	pathKMSDecrypt  = "/enclave/kms/decrypt"
+	pathKMSDataKey  = "/enclave/kms/data-key"
+	pathAppSecrets  = "/enclave/app-secrets"
+	pathS3Fetch     = "/enclave/s3/fetch"
+	pathSealedState = "/enclave/sealed-state"
+	pathSealedLog   = "/enclave/sealed-log"
+	pathSLAttstn    = pathSealedLog + "/attestation"
+	pathVaultToken  = "/enclave/vault/token"
+	pathSVID        = "/enclave/svid"
+	pathDatabases   = "/enclave/databases"
+	pathEvents      = "/enclave/events"
+	pathOIDC        = "/enclave/oidc"
+	pathOIDCConfig  = pathOIDC + "/.well-known/openid-configuration"
+	pathOIDCKeys    = pathOIDC + "/jwks"
+	pathOIDCAttstn  = pathOIDC + "/jwks/attestation"
+	pathOIDCToken   = pathOIDC + "/token"
+	pathOHTTP       = "/enclave/ohttp"
+	pathOHTTPKeys   = pathOHTTP + "/keys"
+	pathOHTTPAttstn = pathOHTTP + "/keys/attestation"
+	pathPrivacyPass = "/enclave/privacy-pass"
+	pathPPDirectory = pathPrivacyPass + "/directory"
+	pathPPAttstn    = pathPrivacyPass + "/directory/attestation"
+	pathPPIssue     = pathPrivacyPass + "/token-request"
+	pathPPRedeem    = pathPrivacyPass + "/redeem"
 	// All other paths are handled by the enclave application's Web server if
 	// it exists.
 	pathProxy = "/*"
@@ -55,30 +100,88 @@ const (
 	inProgress = 1 // Leader designation is in progress.
 	isLeader   = 2 // The enclave is the leader.
 	isWorker   = 3 // The enclave is a worker.
+	// Default timeouts for our Web servers.  The timeouts protect against
+	// slowloris-style attacks that keep connections open for as long as
+	// possible.
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	// The default upper limit for the size of request bodies.  It must
+	// accommodate the largest key material that applications can set.
+	defaultMaxReqBodyLen = maxKeyMaterialLen + 1024
 )
 
 var (
-	errCfgMissingFQDN = errors.New("given config is missing FQDN")
-	errCfgMissingPort = errors.New("given config is missing port")
+	errCfgMissingFQDN  = errors.New("given config is missing FQDN")
+	errCfgMissingPort  = errors.New("given config is missing port")
+	errCfgBadCompress  = errors.New("given config has invalid compression level")
+	errCfgBadTemplate  = errors.New("given config has invalid index page template")
+	errCfgPortConflict = errors.New("given config uses the same port for multiple servers")
+	errCfgBadFdLimit   = errors.New("given config has invalid file descriptor limits")
+	errCfgBadBodyLen   = errors.New("given config has negative maximum request body length")
+	errCfgBadTokenFile = errors.New("given config has unusable auth token file")
+	errCfgNeedState    = errors.New("given config disables state endpoints, which key synchronization requires")
+	errCfgGIDNoUID     = errors.New("given config sets group ID but not user ID")
+	errCfgUIDNoGID     = errors.New("given config sets user ID but not group ID")
+	errCfgBadInterval  = errors.New("given config has negative interval")
 )
 
 // Enclave represents a service running inside an AWS Nitro Enclave.
 type Enclave struct {
 	attester
-	sync.Mutex            // Guard syncState.
-	cfg                   *Config
-	syncState             int
-	extPubSrv, extPrivSrv *http.Server
-	intSrv                *http.Server
-	promSrv               *http.Server
-	revProxy              *httputil.ReverseProxy
-	hashes                *AttestationHashes
-	promRegistry          *prometheus.Registry
-	metrics               *metrics
-	workers               *workerManager
-	keys                  *enclaveKeys
-	httpsCert             *certRetriever
-	ready, stop           chan struct{}
+	sync.Mutex                       // Guard syncState.
+	cfg                              *Config
+	syncState                        int
+	extPubSrv, extPrivSrv            *http.Server
+	intSrv                           *http.Server
+	grpcSrv                          *http.Server
+	grpc                             *grpcServer
+	promSrv                          *http.Server
+	revProxy                         *httputil.ReverseProxy
+	hashes                           *AttestationHashes
+	powSeen                          *cache // Used proof-of-work solutions.
+	promRegistry                     *prometheus.Registry
+	metrics                          *metrics
+	workers                          *workerManager
+	keys                             *enclaveKeys
+	httpsCert                        *certRetriever
+	ready, stop, appStop             chan struct{}
+	readyOnce, stopOnce, appStopOnce sync.Once
+	startTime                        time.Time
+	appMiddlewaresLock               sync.Mutex // Guard appMiddlewares and appChainBuilt.
+	appMiddlewares                   []func(http.Handler) http.Handler
+	appChainBuilt                    bool
+	curCfg                           atomic.Pointer[Config]
+	reloadLock                       sync.Mutex // Guard reloadHooks and serialize reloads.
+	reloadHooks                      []func(*Config)
+	lifecycleLock                    sync.Mutex // Guard lifecycleHooks and lifecycleStarted.
+	lifecycleHooks                   map[string][]lifecycleHook
+	lifecycleStarted                 bool
+	audit                            *auditLog
+	provisioner                      *provisioner
+	vault                            *secretVault
+	appSecrets                       *appSecretStore
+	vaultAuth                        *vaultAuth
+	spire                            *spireAgent
+	oidc                             *oidcIssuer
+	databases                        *databaseStore
+	events                           *eventForwarder
+	sealer                           *stateSealer
+	sealedLog                        *sealedLog
+	egress                           *egressStats
+	onion                            *onionService
+	ohttp                            *ohttpGateway
+	appExited                        chan struct{}
+	shutdownReq                      chan struct{}
+	shutdownReqOnce                  sync.Once
+	startup                          *startupBarrier
+	appLimits                        *appLimits
+	appUnready                       atomic.Bool
+	acmeCertReady                    atomic.Bool
+	bootAttstn                       atomic.Pointer[[]byte]
+	tokens                           *tokenIssuer
+	load                             *loadMonitor
 }
 
 // Config represents the configuration of our enclave service.
@@ -110,6 +213,26 @@ type Config struct {
 	// required.
 	IntPort uint16
 
+	// GRPCSocket contains the path of a Unix socket on which nitriding offers
+	// the enclave-internal API as a gRPC service, in addition to the HTTP API
+	// on IntPort.  The service is defined in doc/internal.proto.  If
+	// IntAuthToken is set, gRPC calls must carry the token in their
+	// authorization metadata.  If unset, nitriding doesn't offer gRPC.  If
+	// the path starts with "@", e.g., "@nitriding", nitriding creates the
+	// socket in Linux's abstract namespace, where it has no owner or
+	// permissions, so any process in the enclave can connect to it.
+	GRPCSocket string
+
+	// GRPCSocketMode contains the permissions of GRPCSocket.  The default,
+	// 0660, lets the socket's owner and group connect.
+	GRPCSocketMode os.FileMode
+
+	// GRPCSocketUID and GRPCSocketGID determine the user and group that own
+	// GRPCSocket.  They must be set together, and default to UID and GID.
+	// Neither GRPCSocketMode nor the owner apply to abstract sockets.
+	GRPCSocketUID uint32
+	GRPCSocketGID uint32
+
 	// UseVsockForExtPort must be set to true if direct communication
 	// between the host and Web server via VSOCK is desired. The daemon will listen
 	// on the enclave's VSOCK address and the port defined in ExtPubPort.
@@ -124,6 +247,57 @@ type Config struct {
 	// required.
 	HostProxyPort uint32
 
+	// HostCID contains the VSOCK context ID of the EC2 host, which runs the
+	// proxy application and the services behind LogVsockPort,
+	// HostHeartbeatPort, CrashReportPort, HostTimePort, SealedLogPort, and a
+	// vsock:// SealedStateStore.  The default is 3, which AWS assigns to the
+	// parent instance.
+	HostCID uint32
+
+	// TapSubnet contains the IPv4 subnet, in CIDR notation, of the TAP device
+	// that forwards the enclave's traffic to the host proxy.  Nitriding uses
+	// the subnet's first address as its default gateway and DNS resolver, and
+	// the second address as its own, like gvproxy.  Change the subnet if it
+	// overlaps with networks that the enclave application must reach, or if
+	// the host proxy uses a different one.  The default is 192.168.127.0/24.
+	TapSubnet string
+
+	// TapQueues determines the number of queues of the TAP device that
+	// forwards the enclave's traffic to the host.  Nitriding forwards each
+	// queue's outgoing frames in its own goroutine and pins each goroutine to
+	// its own vCPU, so network throughput scales with the enclave's vCPUs.
+	// The default is one queue, and the maximum is 256.
+	TapQueues int
+
+	// EgressStats enables per-destination counters of the enclave's outbound
+	// TCP and UDP traffic: connection attempts, packets and bytes sent, bytes
+	// received, and errors.  Nitriding exposes the counters via its external
+	// but private API and as Prometheus metrics, which helps debugging and
+	// auditing what the enclave talks to.  Counting costs a little CPU for
+	// each forwarded frame.
+	EgressStats bool
+
+	// DNSCache enables a caching DNS resolver at 127.0.0.1:53, which the
+	// enclave's resolv.conf then points to.  The resolver forwards queries
+	// to DNSUpstreams and caches responses for as long as their TTLs permit,
+	// so applications that make many lookups don't pay a VSOCK round trip
+	// per query.  Negative responses are cached for at most five minutes.
+	DNSCache bool
+
+	// DNSUpstreams contains the IP:port pairs of the resolvers that DNSCache
+	// forwards queries to, in order of preference.  The default is the host
+	// proxy's resolver, at the first address of TapSubnet.
+	DNSUpstreams []string
+
+	// HostOverrides contains static hostname-to-IP mappings, each of the form
+	// <hostname>=<IP address>, e.g., "db.internal=10.0.0.5".  A hostname
+	// with several addresses appears several times.  Nitriding writes the
+	// overrides to the enclave's /etc/hosts, so both nitriding and the
+	// enclave application resolve the hostnames without DNS, and DNSCache
+	// answers queries for them itself, which is useful for internal services
+	// that public DNS doesn't know or resolves differently.
+	HostOverrides []string
+
 	// PrometheusPort contains the TCP port of the Web server that exposes
 	// Prometheus metrics.  Prometheus metrics only reveal coarse-grained
 	// information and are safe to export in production.
@@ -154,11 +328,26 @@ type Config struct {
 	// nitro-cli's "--debug-mode" flag.
 	Debug bool
 
-	// FdCur and FdMax set the soft and hard resource limit, respectively.  The
-	// default for both variables is 65536.
+	// FdCur and FdMax set the soft and hard resource limit, respectively.  By
+	// default, nitriding raises the hard limit to the kernel's maximum, and the
+	// soft limit to the hard limit.  If nitriding may not raise the hard limit,
+	// it raises the soft limit as high as the hard limit permits.
 	FdCur uint64
 	FdMax uint64
 
+	// AutoTune makes nitriding tune the Go runtime to the enclave's resources
+	// at startup: it sets GOMAXPROCS to the enclave's vCPUs, Go's soft memory
+	// limit to GoMemLimitPercent of the enclave's memory, and -- unless FdCur
+	// and FdMax are set -- the file descriptor limits to one descriptor per
+	// 64 KiB of memory, between 4096 and 1048576.  The GOMAXPROCS and
+	// GOMEMLIMIT environment variables take precedence.
+	AutoTune bool
+
+	// GoMemLimitPercent determines the percentage of the enclave's memory
+	// that AutoTune sets as Go's soft memory limit.  The enclave application
+	// shares the enclave's memory, so the default is 50.
+	GoMemLimitPercent int
+
 	// AppURL should be set to the URL of the software repository that's
 	// running inside the enclave, e.g., "https://github.com/foo/bar".  The URL
 	// is shown on the enclave's index page, as part of instructions on how to
@@ -173,6 +362,113 @@ type Config struct {
 	// applications can ignore this.
 	AppWebSrv *url.URL
 
+	// AppCmd contains the command that nitriding runs as the enclave
+	// application once its networking, certificate, and key synchronization
+	// are ready, e.g., "my-enclave-app -s foo".  Nitriding restarts the
+	// application with exponential backoff if it crashes, and exits once the
+	// application exits with exit code 0.  Upon shutdown, nitriding sends the
+	// application SIGTERM.  AppCmd cannot be combined with Seccomp.
+	AppCmd string
+
+	// Apps contains the processes of an enclave application that consists
+	// of several processes, e.g., an application server and a local cache.
+	// Nitriding runs Apps like AppCmd, which cannot be combined with Apps.
+	// Each entry has the form <name>:<command>, where the name may be
+	// followed by the query parameters after=<name>, which makes nitriding
+	// start the given process first and stop it last, and restart=<policy>:
+	// "on-failure" (the default) restarts the process if it crashes, "always"
+	// also restarts it if it exits with exit code 0, and "never" doesn't
+	// restart it.  Nitriding exits once all processes exited for good.
+	Apps []string
+
+	// AppMaxAddrSpaceMiB limits the address space, in MiB, of each of the
+	// enclave application's processes, so a memory leak in the application
+	// cannot exhaust the enclave's fixed memory and take nitriding down with
+	// it.  Zero means no limit.
+	AppMaxAddrSpaceMiB uint64
+
+	// AppMaxFiles limits the number of files that each of the enclave
+	// application's processes can open.  Zero means no limit.
+	AppMaxFiles uint64
+
+	// AppCPUWeight determines the CPU weight, from 1 to 10000, of the cgroup
+	// that the enclave application runs in; the default weight of other
+	// cgroups is 100.  The weight requires cgroup v2 and cannot be combined
+	// with UID.  Without cgroup v2, nitriding runs the application without a
+	// weight.  Zero means no weight.
+	AppCPUWeight uint16
+
+	// AppHealthURL contains an enclave-internal URL, e.g.,
+	// "http://127.0.0.1:8081/health", that nitriding probes to check the
+	// health of the enclave application.  The application is healthy if the
+	// URL responds with a 2xx status code.  If the application fails
+	// AppHealthFailures consecutive probes, nitriding restarts it, considers
+	// it not ready until it signals its readiness again (or, without
+	// WaitForApp, until it passes a probe), and emits an alert event to
+	// EventSink.  AppHealthURL cannot be combined with AppHealthCmd.
+	AppHealthURL string
+
+	// AppHealthCmd works like AppHealthURL, except that nitriding runs the
+	// given command, which must exit with exit code 0 if the application is
+	// healthy.
+	AppHealthCmd string
+
+	// AppHealthInterval determines how often nitriding probes the
+	// application's health.  The default is 10 seconds.
+	AppHealthInterval time.Duration
+
+	// AppHealthTimeout determines how long a probe of the application's
+	// health may take.  The default is 5 seconds.
+	AppHealthTimeout time.Duration
+
+	// AppHealthFailures determines after how many consecutive failed probes
+	// nitriding restarts the application.  The default is 3.
+	AppHealthFailures int
+
+	// LifecycleHooks contains commands of the form "<point>:<command>" that
+	// nitriding runs at the given lifecycle point: "after-cert" once it has
+	// its TLS certificate, "after-keys" once it has its key material, and
+	// "before-serve" right before it starts its public Web server, which
+	// waits for the command.  Hooks can, e.g., warm caches or register the
+	// enclave with a discovery system.  Nitriding logs failing hooks but
+	// doesn't stop.  Applications that embed nitriding can register hooks
+	// via OnLifecycle instead.  LifecycleHooks cannot be combined with
+	// Seccomp.
+	LifecycleHooks []string
+
+	// HookTimeout determines how long each lifecycle hook may take.  The
+	// default is 30 seconds.
+	HookTimeout time.Duration
+
+	// AppPrereqs contains the prerequisites that nitriding waits for before
+	// it starts AppCmd or Apps: "cert" (nitriding has a TLS certificate, which
+	// may take a while if it comes from ACME), "keys" (nitriding has its key
+	// material, which worker enclaves obtain from their leader), "time"
+	// (nitriding synchronized its clock via RoughtimeServer or HostTimePort),
+	// "svid" (nitriding obtained an SVID from SpireServer), "vault" (nitriding
+	// logged in to VaultAddr), and "secrets" (nitriding has the secrets of
+	// AppSecretInject, which the application always waits for).  The default
+	// is "cert" and "keys".
+	AppPrereqs []string
+
+	// ShutdownSequence determines the order of the steps in which nitriding
+	// shuts down gracefully: "drain" (stop accepting public connections and
+	// wait for in-flight requests), "app" (send the application SIGTERM and
+	// wait for it to exit), and "wipe" (wipe key material).  The sequence
+	// must contain each step exactly once.  The default is "drain", "app",
+	// and "wipe".  Nitriding shuts down its remaining Web servers last.
+	ShutdownSequence []string
+
+	// DrainTimeout determines how long nitriding waits for in-flight public
+	// requests to finish before it closes their connections.  The default is
+	// 5 seconds.
+	DrainTimeout time.Duration
+
+	// AppStopTimeout determines how long the enclave application has to exit
+	// after nitriding sent it SIGTERM, before nitriding kills it.  The
+	// default is 10 seconds.
+	AppStopTimeout time.Duration
+
 	// WaitForApp instructs nitriding to wait for the application's signal
 	// before launching the Internet-facing Web server.  Set this flag if your
 	// application takes a while to bootstrap and you don't want to risk
@@ -185,17 +481,830 @@ type Config struct {
 	// MockCertFp specifies a mock TLS certificate fingerprint
 	// to use in attestation documents.
 	MockCertFp string
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout, and IdleTimeout set the
+	// respective timeouts of nitriding's Web servers.  See the documentation
+	// of Go's http.Server for the semantics of each timeout.  If a timeout is
+	// unset, nitriding uses a safe default.  A negative value disables the
+	// given timeout.  ReadTimeout and WriteTimeout don't apply to requests
+	// that nitriding forwards to the enclave application, which may stream
+	// request or response bodies for longer; the application must enforce
+	// its own timeouts.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// CORSAllowedOrigins contains the origins that are allowed to make
+	// cross-origin requests to nitriding's public endpoints, e.g.,
+	// "https://example.com".  The wildcard "*" allows all origins.  If unset,
+	// nitriding does not send CORS headers.  Requests that nitriding forwards
+	// to the enclave application are not affected by this setting.
+	CORSAllowedOrigins []string
+
+	// CORSAllowedMethods contains the HTTP methods that cross-origin requests
+	// may use.  The default is GET, HEAD, and OPTIONS.
+	CORSAllowedMethods []string
+
+	// CORSMaxAge determines how long browsers may cache the response to
+	// preflight requests.  If unset, browsers use their own default.
+	CORSMaxAge time.Duration
+
+	// MaxReqBodyLen sets the maximum length (in bytes) of request bodies that
+	// nitriding accepts.  Requests that exceed this limit are rejected with
+	// status code 413.  The limit does not apply to requests that nitriding
+	// forwards to the enclave application.  The default suffices for the
+	// maximum amount of key material that applications can set.
+	MaxReqBodyLen int64
+
+	// IntAuthToken contains a bearer token that the enclave application must
+	// provide (in the Authorization header) when talking to nitriding's
+	// enclave-internal Web server.  Set this field if you want to restrict
+	// which processes inside the enclave can use the internal API.  The token
+	// is never exposed via nitriding's configuration endpoint.  The token may
+	// be a secret reference (kms://... or asm://...) that nitriding resolves at
+	// startup.
+	IntAuthToken string `json:"-" secret:"true"`
+
+	// IntAuthTokenFile contains the path of a file that nitriding writes the
+	// internal API's bearer token to, readable only by nitriding's user.  If
+	// IntAuthToken is unset, nitriding generates a random token at startup.
+	IntAuthTokenFile string
+
+	// AccessLog enables structured, JSON-encoded access logs for nitriding's
+	// Web servers.  Each log entry contains the request's method, path,
+	// status code, latency, response size, and request ID.  Access logs are
+	// always enabled if Debug is set.
+	AccessLog bool
+
+	// AccessLogSkipPaths contains URL paths that are excluded from access
+	// logs, e.g., frequently-polled health checks.
+	AccessLogSkipPaths []string
+
+	// DisableSecurityHeaders stops the public Web server from setting
+	// security-related HTTP headers.  By default, nitriding sets the
+	// Strict-Transport-Security header on all responses, and the
+	// X-Content-Type-Options, Referrer-Policy, and Content-Security-Policy
+	// headers on responses to nitriding's own endpoints.
+	DisableSecurityHeaders bool
+
+	// HSTSMaxAge determines for how long browsers should only contact the
+	// enclave via HTTPS.  The default is one year.  A negative value disables
+	// the Strict-Transport-Security header.
+	HSTSMaxAge time.Duration
+
+	// ReferrerPolicy and ContentSecurityPolicy set the values of the
+	// respective headers for nitriding's endpoints.  If unset, nitriding uses
+	// restrictive defaults that suit its endpoints, none of which load
+	// resources or link to other pages.
+	ReferrerPolicy        string
+	ContentSecurityPolicy string
+
+	// CompressLevel enables gzip and deflate compression of the public Web
+	// server's responses (including the enclave application's responses) if
+	// set to a compression level in the interval [1, 9].  Compression is
+	// disabled by default.  Nitriding only compresses responses whose
+	// content type is in CompressTypes, and leaves alone responses that are
+	// already compressed.
+	CompressLevel int
+
+	// CompressTypes contains the content types that nitriding compresses,
+	// e.g., "application/json".  If unset, nitriding compresses common
+	// text-based content types.
+	CompressTypes []string
+
+	// IndexTemplate contains an html/template that replaces nitriding's
+	// plain-text index page, which allows for branded and localized
+	// transparency pages.  The template can use the variables {{.FQDN}},
+	// {{.AppURL}}, {{.PCRs}} (a map from PCR index to hex-encoded value, only
+	// set inside an enclave), and {{.CertFingerprint}}.  Regardless of this
+	// field, clients that prefer application/json get a JSON-encoded index
+	// that contains the same variables.
+	IndexTemplate string
+
+	// DisableGetState and DisableSetState remove the enclave-internal
+	// endpoints that retrieve and set the application state (e.g., key
+	// material) that's synchronized between enclaves.  Single-enclave
+	// deployments that don't use key synchronization can set both fields to
+	// avoid exposing these endpoints at all.  These fields must not be set if
+	// FQDNLeader is set.
+	DisableGetState bool
+	DisableSetState bool
+
+	// DisableIndexPage removes nitriding's index page.
+	DisableIndexPage bool
+
+	// Profile selects a preset of defaults for the given environment: "dev",
+	// "staging", or "prod".  Fields that are set explicitly take precedence
+	// over the profile's defaults.  The dev profile enables debug mode and
+	// access logs; the staging profile uses Let's Encrypt's staging
+	// environment and enables access logs; and the prod profile uses strict
+	// timeouts, requires TLS 1.3, and refuses to run with Debug or
+	// UseProfiling set.
+	Profile string
+
+	// ACMEDirectoryURL contains the directory URL of the ACME server that we
+	// obtain certificates from if UseACME is set.  The default is Let's
+	// Encrypt's production environment.
+	ACMEDirectoryURL string
+
+	// ACMEDNSProvider makes nitriding solve ACME's DNS-01 challenge instead of
+	// TLS-ALPN-01 and HTTP-01, so the ACME server needn't reach the enclave.
+	// It's one of "route53", "cloudflare", or "rfc2136", and requires UseACME.
+	ACMEDNSProvider string
+
+	// ACMEDNSZone is the DNS zone that contains FQDN: the hosted zone ID for
+	// Route 53, the zone ID for Cloudflare, and the zone name for RFC 2136.
+	ACMEDNSZone string
+
+	// ACMEDNSServer is the host:port of the name server that accepts RFC 2136
+	// dynamic updates.
+	ACMEDNSServer string
+
+	// ACMEDNSKeyName is the name of the TSIG key that signs RFC 2136 updates.
+	ACMEDNSKeyName string
+
+	// ACMEDNSSecret is the Cloudflare API token, or the Base64-encoded
+	// HMAC-SHA256 TSIG secret for RFC 2136.  Route 53 uses the EC2 host's
+	// instance role instead.
+	ACMEDNSSecret string `json:"-" secret:"true"`
+
+	// ACMEWildcard adds *.FQDN to our certificate, which requires
+	// ACMEDNSProvider.
+	ACMEWildcard bool
+
+	// ACMETempCert makes nitriding serve a temporary self-signed certificate
+	// until it has its ACME certificate, instead of failing TLS handshakes
+	// while it waits for the ACME server.  Once nitriding has its ACME
+	// certificate, it swaps it in, embeds its fingerprint in attestation
+	// documents, and emits an event to EventSink.  Attestation documents from
+	// before the swap carry the temporary certificate's fingerprint.  The
+	// enclave application's "cert" prerequisite waits for the ACME
+	// certificate.  ACMETempCert requires UseACME.
+	ACMETempCert bool
+
+	// TLSMinVersion sets the minimum TLS version that nitriding's Web servers
+	// accept: "1.2" (the default) or "1.3".
+	TLSMinVersion string
+
+	// LogLevel sets the minimum level of nitriding's log messages: "debug",
+	// "info" (the default), "warn", or "error".  The log level can be changed
+	// at runtime by reloading the configuration.
+	LogLevel string
+
+	// LogFormat sets the format of nitriding's log messages: "text" (the
+	// default) or "json".
+	LogFormat string
+
+	// LogVsockPort enables log shipping if set.  Nitriding then streams
+	// JSON-encoded log records to the given VSOCK port on the EC2 host, in
+	// addition to writing them to stderr.  This makes logs available in
+	// production enclaves, whose console output is invisible.
+	LogVsockPort uint32
+
+	// LogVsockProtocol sets the protocol that nitriding speaks with the
+	// host-side log collector: "framed" (the default) prefixes each record
+	// with its length as a 4-byte, big-endian integer, and "syslog" sends RFC
+	// 5424 messages with octet-counting framing.
+	LogVsockProtocol string
+
+	// OTLPEndpoint contains the base URL of an OpenTelemetry collector, e.g.,
+	// "http://collector.example.com:4318".  If set, nitriding records spans
+	// for inbound requests, attestation, key synchronization, and ACME, and
+	// exports them via OTLP/HTTP.  Nitriding passes the span of each request
+	// on to the enclave application via the traceparent header.
+	OTLPEndpoint string
+
+	// AuditLog enables an append-only, in-memory audit log of the operations
+	// that the enclave application performs via nitriding's internal API:
+	// setting the enclave state, registering a hash, signalling readiness, and
+	// changing the configuration.  Each entry records the caller, the time,
+	// and a SHA-256 hash over the request body.  Entries are also logged, so
+	// log shipping forwards them to the EC2 host.
+	AuditLog bool
+
+	// HostHeartbeatPort enables heartbeats to the EC2 host if set.  Nitriding
+	// then periodically sends a length-prefixed, JSON-encoded message with its
+	// status, uptime, version, and certificate fingerprint to the given VSOCK
+	// port on the host, so host-side tooling can detect a hung or crashed
+	// enclave.
+	HostHeartbeatPort uint32
+
+	// HostHeartbeatInterval determines how often nitriding sends heartbeats to
+	// the EC2 host.  The default is ten seconds.
+	HostHeartbeatInterval time.Duration
+
+	// CrashReportPort enables crash reports if set.  If nitriding panics or
+	// hits a fatal error, it sends a length-prefixed, JSON-encoded report with
+	// the stack trace and its most recent log records to the given VSOCK port
+	// on the EC2 host before it terminates.
+	CrashReportPort uint32
+
+	// Seccomp restricts nitriding to an allowlist of system calls once its
+	// networking and certificate are set up, which limits what an attacker
+	// can do with a compromised handler.  The filter applies to all of
+	// nitriding's threads and is inherited by child processes, so it cannot
+	// be combined with nitriding spawning the enclave application.  Other
+	// system calls fail with EPERM.
+	Seccomp bool
+
+	// UID and GID determine the unprivileged user and group that nitriding
+	// switches to once it has set up its networking and Web servers.
+	// Nitriding keeps only the capabilities CAP_NET_ADMIN, to re-create its
+	// TAP interface, and CAP_NET_BIND_SERVICE, to start its public Web server
+	// on a privileged port.  Before switching, nitriding hands the files
+	// and sockets that it created over to UID and GID.  If UID is 0 (the
+	// default), nitriding keeps running as root.  UID and GID must be set
+	// together, so nitriding cannot keep root's group.
+	UID uint32
+	GID uint32
+
+	// EntropyReseedInterval determines how often nitriding mixes fresh random
+	// bytes from the Nitro Secure Module into the kernel's entropy pool.  The
+	// default is one hour.  Nitriding only reseeds inside an enclave.
+	EntropyReseedInterval time.Duration
+
+	// LockMemory locks all of nitriding's memory into RAM via mlockall, so
+	// key material -- the TLS private key and the application's registered
+	// keys -- can never be swapped to disk.  If nitriding embeds the enclave
+	// application, this applies to the application's memory as well.
+	// Regardless of this setting, nitriding always disables core dumps.
+	LockMemory bool
+
+	// Provisioning enables a public endpoint that accepts secrets which
+	// clients encrypt, using HPKE, to a public key that nitriding publishes in
+	// its attestation documents.  The enclave application fetches the
+	// decrypted secrets via the enclave-internal API.
+	Provisioning bool
+
+	// DeliveredSecrets contains secrets that nitriding delivers to other
+	// enclaves whose measurement is in SecretDeliveryPCRs.  Each entry has the
+	// form <name>=<secret reference>, e.g., "db=kms://...", and nitriding
+	// resolves the references at startup.
+	DeliveredSecrets []string
+
+	// SecretDeliveryPCRs contains the hex-encoded PCR0 values of the enclave
+	// images that nitriding delivers DeliveredSecrets to.  This field is
+	// required if DeliveredSecrets is set.
+	SecretDeliveryPCRs []string
+
+	// AttestationPoWBits requires clients to solve a proof-of-work puzzle of
+	// the given difficulty, in bits, before nitriding asks the Nitro Secure
+	// Module for an attestation document.  Consider setting this if your
+	// enclave is exposed to the Internet without DDoS protection.  The maximum
+	// is 32, and 0 (the default) disables the puzzle.
+	AttestationPoWBits uint8
+
+	// RoughtimeServer contains the address (host:port) of a Roughtime server
+	// that nitriding obtains authenticated time from.  Enclave clocks drift,
+	// so nitriding uses the authenticated time to verify attestation
+	// documents, create certificates, and sign AWS requests, and exposes it
+	// to the enclave application.  Time synchronization is disabled by
+	// default.
+	RoughtimeServer string
+
+	// RoughtimePublicKey contains the Base64-encoded Ed25519 public key of
+	// RoughtimeServer.  This field is required if RoughtimeServer is set.
+	RoughtimePublicKey string
+
+	// HostTimePort enables time synchronization with the EC2 host if set.
+	// Nitriding then periodically sends a length-prefixed, JSON-encoded
+	// message with its local time to the given VSOCK port on the host, and
+	// expects a message of the same format with the host's time in response,
+	// e.g., from a host whose clock chrony disciplines via the Amazon Time
+	// Sync Service's PTP hardware clock.  Unlike Roughtime, the host's time is
+	// unauthenticated, so a malicious host can make nitriding accept expired
+	// attestation documents and certificates.  HostTimePort and
+	// RoughtimeServer are mutually exclusive.
+	HostTimePort uint32
+
+	// TimeSyncInterval determines how often nitriding synchronizes its time.
+	// The default is ten minutes.
+	TimeSyncInterval time.Duration
+
+	// RequireFIPS makes nitriding refuse to start unless its cryptography --
+	// including TLS and the verification of attestation documents -- runs on
+	// a FIPS-validated module.  Build nitriding with "make nitriding-fips" or
+	// with GOEXPERIMENT=boringcrypto to get such a module.  Features that
+	// rely on cryptography outside the module, i.e., key synchronization,
+	// provisioning, and secret delivery, are unavailable in FIPS mode.
+	RequireFIPS bool
+
+	// OverloadMemPercent and OverloadCPUPercent determine the memory and CPU
+	// utilization, in percent, at which nitriding considers the enclave
+	// overloaded.  While the enclave is overloaded, nitriding responds with
+	// status code 503 to low-priority requests -- for the index page, runtime
+	// statistics, and Prometheus metrics -- while attestation, key
+	// synchronization, and the enclave application remain available.  A value
+	// of 0 (the default) disables the respective check.
+	OverloadMemPercent uint8
+	OverloadCPUPercent uint8
+
+	// AppSecrets contains secrets in AWS Secrets Manager that nitriding
+	// fetches at startup and exposes to the enclave application.  Each entry
+	// has the form <name>=asm://<secret-id>, optionally followed by
+	// "?region=<region>".  Each secret's value must be a KMS ciphertext --
+	// binary or Base64-encoded -- which nitriding decrypts via KMS using an
+	// attestation document.  That way, the EC2 host's instance role may read
+	// the secret, but only the enclave learns its plaintext.
+	AppSecrets []string
+
+	// AppSecretsDir determines the directory that nitriding writes each of
+	// AppSecrets to, as a file of the secret's name that only nitriding's user
+	// can read.  If the field is empty, the enclave application can only fetch
+	// its secrets via the enclave-internal API.
+	AppSecretsDir string
+
+	// AppSecretInject exposes secrets to the enclave application that
+	// nitriding runs via AppCmd or Apps.  Each entry has the form
+	// <name>=env:<variable>, which sets the given environment variable to
+	// the secret, or <name>=file, which writes the secret to the file of the
+	// given name in AppSecretsTmpfs.  The name refers to one of AppSecrets
+	// or, if Provisioning is enabled, to a secret that a client provisions
+	// via POST /enclave/provision?name=<name>.  The application doesn't start
+	// before all of its secrets are available.
+	AppSecretInject []string
+
+	// AppSecretsTmpfs determines the directory at which nitriding mounts a
+	// private tmpfs for the secrets that AppSecretInject writes to files.
+	// Only nitriding's user can access the tmpfs, and the files are
+	// read-only.  This field is required if AppSecretInject contains files.
+	AppSecretsTmpfs string
+
+	// VaultAddr contains the address of a HashiCorp Vault server, e.g.,
+	// "https://vault.example.com:8200".  If set, nitriding logs in to Vault
+	// using an attestation document, keeps its token alive, and exposes the
+	// token to the enclave application, so the enclave image doesn't need a
+	// static token.
+	VaultAddr string
+
+	// VaultAuthPath contains the path of the Vault auth method that verifies
+	// nitriding's attestation documents -- a Vault plugin or a bridge that
+	// exchanges attestation documents for JWTs.  The default is
+	// "auth/nitro-enclave/login".
+	VaultAuthPath string
+
+	// VaultRole contains the Vault role that nitriding logs in as.  This
+	// field is required if VaultAddr is set.
+	VaultRole string
+
+	// SpireServer contains the address (host:port) of a SPIRE server.  If
+	// set, nitriding attests to the server using an attestation document,
+	// like a SPIRE agent does, and obtains an X.509 SVID that the enclave
+	// application can use for mTLS with other workloads.  The server must run
+	// a node attestor plugin of type "aws_nitro" that verifies attestation
+	// documents.
+	SpireServer string
+
+	// SpireTrustDomain contains the SPIFFE trust domain of the SPIRE server,
+	// e.g., "example.org".  This field is required if SpireServer is set.
+	SpireTrustDomain string
+
+	// SpireTrustBundle contains the PEM-encoded certificates of the trust
+	// domain, which nitriding uses to authenticate the SPIRE server.  This
+	// field is required if SpireServer is set.
+	SpireTrustBundle string
+
+	// OIDCTokens enables the minting of short-lived JSON Web Tokens for the
+	// enclave application, which downstream services can verify via the
+	// OpenID Connect discovery document and JWKS that nitriding publishes.
+	// The signing key is ephemeral, and its public key is available in
+	// attestation documents, so verifiers can tie tokens to the enclave's
+	// measurements.
+	OIDCTokens bool
+
+	// Databases contains the RDS and ElastiCache endpoints that the enclave
+	// application connects to.  Each entry has the form
+	// <name>=<protocol>://[<user>@]<host>:<port>, where the protocol is
+	// "postgres", "mysql", or "tls" (for ElastiCache), optionally followed by
+	// the query parameters password=asm://<secret-id> and local=<port>.  Like
+	// AppSecrets, the password must be a KMS ciphertext in Secrets Manager,
+	// which nitriding decrypts using an attestation document.  If a local port
+	// is set, nitriding forwards plaintext connections to 127.0.0.1:<port>
+	// to the database over TLS, which MySQL doesn't support.
+	Databases []string
+
+	// DatabaseCA contains the PEM-encoded CA certificates that database
+	// servers' certificates must chain to, e.g., the RDS CA bundle.  Nitriding
+	// doesn't trust any other CAs for databases.  This field is required if
+	// Databases is set.
+	DatabaseCA string
+
+	// SealedStateKMSKey contains the ID, ARN, or alias of the KMS key that
+	// nitriding encrypts sealed state under, which the enclave application
+	// saves and loads via the enclave-internal API or Enclave.SaveState and
+	// Enclave.LoadState.  Nitriding obtains each blob's data key from KMS
+	// with an attestation document, so the key's policy can use the
+	// kms:RecipientAttestation condition keys to restrict the blobs to
+	// enclaves with the given measurements.  This field is required if
+	// SealedStateStore is set.
+	SealedStateKMSKey string
+
+	// SealedStateStore contains the untrusted store of sealed state: either
+	// s3://<bucket>[/<prefix>][?region=<region>] for Amazon S3 (using the EC2
+	// host's instance role) or vsock://<port> for a store on the EC2 host,
+	// which speaks length-prefixed JSON.  The store only sees ciphertext and
+	// cannot tamper with it, but it can withhold blobs or roll them back to
+	// older versions.
+	SealedStateStore string
+
+	// RestartCounter contains the name of the sealed state in
+	// SealedStateStore that holds the enclave's restart counter.  If set,
+	// nitriding increments the counter at startup and adds it to the user
+	// data of attestation documents, so verifiers can detect enclaves that
+	// restart suspiciously often, or whose counter was rolled back.  Each
+	// enclave needs its own name.
+	RestartCounter string
+
+	// SealedLogPort enables the sealed log if set.  The enclave application
+	// then appends records via the enclave-internal API, which nitriding
+	// hash-chains, signs with a key that's included in attestation
+	// documents, and streams to the given VSOCK port on the EC2 host, as
+	// length-prefixed JSON.  This gives the application a tamper-evident log
+	// of its decisions.
+	SealedLogPort uint32
+
+	// EventSink contains the message broker that nitriding forwards events
+	// to, which the enclave application enqueues via the enclave-internal
+	// API.  It has the form sqs://<region>/<account-id>/<queue-name> for
+	// Amazon SQS (using the EC2 host's instance role) or
+	// kafka://<broker>[,<broker>...]/<topic>, optionally followed by
+	// "?tls=true", for Kafka.  Nitriding batches events and retries until
+	// the broker accepts them, but events that are still queued are lost if
+	// the enclave restarts.
+	EventSink string
+
+	// EventAuditLog makes nitriding forward its audit log entries to
+	// EventSink as well.  This requires AuditLog.
+	EventAuditLog bool
+
+	// SigstoreBundle contains the path to a Sigstore bundle, as created by
+	// "cosign sign-blob --bundle", over SigstoreArtifact.  If set, nitriding
+	// verifies the bundle before it starts its Web servers and refuses to
+	// start if verification fails.  The SHA-256 hash of the verified
+	// artifact becomes the first entry of the data hash in attestation
+	// documents.
+	SigstoreBundle string
+
+	// SigstoreArtifact contains the path to the signed artifact, e.g., the
+	// enclave application's binary or a manifest of its files.
+	SigstoreArtifact string
+
+	// SigstoreIdentity contains the email address or URI that the signing
+	// certificate must be issued for, and SigstoreIssuer the OIDC issuer
+	// that must have vouched for the identity, e.g.,
+	// https://token.actions.githubusercontent.com.
+	SigstoreIdentity string
+	SigstoreIssuer   string
+
+	// SigstoreRoots contains the PEM-encoded root and intermediate
+	// certificates of the Fulcio instance that issues signing certificates,
+	// and SigstoreRekorKey the PEM-encoded public key of the Rekor instance
+	// that logs signatures.
+	SigstoreRoots    string
+	SigstoreRekorKey string
+
+	// ImageMetadata contains a JSON object with the enclave image's build
+	// metadata, e.g., the source repository, Git commit, and build
+	// toolchain.  Nitriding returns the object at GET /enclave/image, along
+	// with its PCR values, so verifiers can find and reproduce the build that
+	// matches our attestation documents.  The object should be part of the
+	// image, so the measurements cover it.
+	ImageMetadata string
+
+	// OnionService makes nitriding publish its public Web server as a Tor
+	// onion service on port 443.  Tor must run inside the enclave, and reaches
+	// the Tor network via the EC2 host.  Nitriding keeps the onion key and
+	// hands it to Tor via Tor's control port at TorControlAddr, which must be
+	// on the loopback interface.
+	OnionService bool
+
+	// TorControlAddr is the host:port of Tor's control port (by default,
+	// 127.0.0.1:9051), and TorControlPassword the password that nitriding
+	// authenticates with.
+	TorControlAddr     string
+	TorControlPassword string `json:"-" secret:"true"`
+
+	// OnionKey contains the Base64-encoded 32-byte Ed25519 seed of the onion
+	// service's key, so the onion address survives restarts.  Use a secret
+	// reference, e.g., kms://<ciphertext>, to keep the seed confidential.  If
+	// unset, nitriding generates a fresh key and therefore a new onion address
+	// each time it starts.
+	OnionKey string `json:"-" secret:"true"`
+
+	// OHTTPGateway makes nitriding act as an Oblivious HTTP gateway (RFC
+	// 9458) for the enclave application, which requires AppWebSrv.  Clients
+	// encrypt binary HTTP requests to an HPKE key that never leaves the
+	// enclave, and send them via an OHTTP relay, so the application can
+	// process requests without learning the clients' IP addresses.  The key
+	// configuration is available in attestation documents.  Each enclave has
+	// its own key, so clients must send requests to the enclave whose key
+	// configuration they fetched.
+	OHTTPGateway bool
+
+	// PrivacyPass makes nitriding issue privately verifiable Privacy Pass
+	// tokens (RFC 9578) to clients, which the enclave application can then
+	// ask nitriding to verify.  The issuer key is part of the key material
+	// that the leader enclave syncs to its workers, so all replicas issue
+	// and verify the same tokens.  The public key is available in
+	// attestation documents.
+	PrivacyPass bool
 }
 
-// Validate returns an error if required fields in the config are not set.
+// Validate returns an error if required fields in the config are not set, or
+// if fields are set to invalid values.  Validate checks all fields, and the
+// returned error contains all problems that it found.
 func (c *Config) Validate() error {
+	var errs []error
 	if c.ExtPubPort == 0 || c.IntPort == 0 || c.HostProxyPort == 0 {
-		return errCfgMissingPort
+		errs = append(errs, errCfgMissingPort)
 	}
 	if c.FQDN == "" {
-		return errCfgMissingFQDN
+		errs = append(errs, errCfgMissingFQDN)
+	} else if _, err := normalizeFQDN(c.FQDN); err != nil {
+		errs = append(errs, fmt.Errorf("FQDN %q: %w", c.FQDN, err))
+	}
+	if c.FQDNLeader != "" {
+		if _, err := normalizeFQDN(c.FQDNLeader); err != nil {
+			errs = append(errs, fmt.Errorf("leader FQDN %q: %w", c.FQDNLeader, err))
+		}
+	}
+	if err := c.validateProfile(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseTLSVersion(c.TLSMinVersion); err != nil {
+		errs = append(errs, err)
+	}
+	if c.isScalingEnabled() && (c.DisableGetState || c.DisableSetState) {
+		errs = append(errs, errCfgNeedState)
+	}
+	errs = append(errs, c.checkPortConflicts()...)
+	if c.FdMax != 0 && c.FdCur > c.FdMax {
+		errs = append(errs, fmt.Errorf("%w: soft limit %d exceeds hard limit %d",
+			errCfgBadFdLimit, c.FdCur, c.FdMax))
+	}
+	if c.MaxReqBodyLen < 0 {
+		errs = append(errs, errCfgBadBodyLen)
+	}
+	if c.GID != 0 && c.UID == 0 {
+		errs = append(errs, errCfgGIDNoUID)
+	}
+	if c.UID != 0 && c.GID == 0 {
+		errs = append(errs, errCfgUIDNoGID)
+	}
+	if c.HostHeartbeatInterval < 0 || c.EntropyReseedInterval < 0 || c.TimeSyncInterval < 0 {
+		errs = append(errs, errCfgBadInterval)
+	}
+	if c.AttestationPoWBits > maxPoWBits {
+		errs = append(errs, errCfgBadPoW)
+	}
+	if c.GoMemLimitPercent < 0 || c.GoMemLimitPercent > 100 {
+		errs = append(errs, errCfgBadMemLimit)
+	}
+	if c.ACMETempCert && !c.UseACME {
+		errs = append(errs, errCfgTempCertNoACME)
+	}
+	if c.TapQueues < 0 || c.TapQueues > maxTapQueues {
+		errs = append(errs, errCfgBadTapQueues)
+	}
+	if c.TapSubnet != "" {
+		if _, err := parseTapSubnet(c.TapSubnet); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.validateDNSCache(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateHostOverrides(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateGRPC(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.OverloadMemPercent > 100 || c.OverloadCPUPercent > 100 {
+		errs = append(errs, errCfgBadOverload)
+	}
+	if c.CompressLevel < 0 || c.CompressLevel > 9 {
+		errs = append(errs, errCfgBadCompress)
+	}
+	if c.IntAuthTokenFile != "" {
+		dir := filepath.Dir(c.IntAuthTokenFile)
+		if info, err := os.Stat(dir); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v", errCfgBadTokenFile, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("%w: %s is not a directory", errCfgBadTokenFile, dir))
+		}
+	}
+	if c.IndexTemplate != "" {
+		if _, err := template.New("index").Parse(c.IndexTemplate); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v", errCfgBadTemplate, err))
+		}
+	}
+	if err := c.validateTracing(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateLogging(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateSecretRefs(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateSecretDelivery(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateAppSecrets(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateDatabases(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateEvents(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateSigstore(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateImageMetadata(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateAppCmd(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateShutdown(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateAppHealth(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateLifecycleHooks(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateOnion(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateOHTTP(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateTimeSync(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateSealedState(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateRestartCounter(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateACMEDNS(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateVault(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateSpire(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateFIPS(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// namedPort is a port together with the name of the config field that sets
+// it.
+type namedPort struct {
+	name string
+	port uint32
+}
+
+// checkPortConflicts returns an error for each TCP port that's used by more
+// than one of our Web servers, and for each VSOCK port on the EC2 host that's
+// used by more than one of the host's services.  Unset ports are ignored.
+func (c *Config) checkPortConflicts() []error {
+	ports := []namedPort{
+		{"ExtPrivPort", uint32(c.ExtPrivPort)},
+		{"IntPort", uint32(c.IntPort)},
+		{"PrometheusPort", uint32(c.PrometheusPort)},
+	}
+	// If we listen on VSOCK, our public port doesn't compete with TCP ports.
+	if !c.UseVsockForExtPort {
+		ports = append(ports, namedPort{"ExtPubPort", uint32(c.ExtPubPort)})
+	}
+	if c.DNSCache {
+		ports = append(ports, namedPort{"DNSCache", 53})
+	}
+	// Our VSOCK connections to the host all go to the same context ID, so
+	// each service needs its own port.
+	hostPorts := []namedPort{
+		{"HostProxyPort", c.HostProxyPort},
+		{"LogVsockPort", c.LogVsockPort},
+		{"HostHeartbeatPort", c.HostHeartbeatPort},
+		{"CrashReportPort", c.CrashReportPort},
+		{"HostTimePort", c.HostTimePort},
+		{"SealedLogPort", c.SealedLogPort},
+		{"SealedStateStore", c.sealedStateHostPort()},
+	}
+	return append(portConflicts(ports), portConflicts(hostPorts)...)
+}
+
+// portConflicts returns an error for each port that appears more than once
+// in the given list.  Unset ports are ignored.
+func portConflicts(ports []namedPort) []error {
+	var errs []error
+	seen := make(map[uint32]string)
+	for _, p := range ports {
+		if p.port == 0 {
+			continue
+		}
+		if other, exists := seen[p.port]; exists {
+			errs = append(errs, fmt.Errorf("%w: %s and %s are both %d",
+				errCfgPortConflict, other, p.name, p.port))
+			continue
+		}
+		seen[p.port] = p.name
+	}
+	return errs
+}
+
+// setDefaults sets default values for optional fields that are unset.  The
+// defaults of the config's profile take precedence over our general defaults.
+func (c *Config) setDefaults() {
+	c.applyProfile()
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.MaxReqBodyLen == 0 {
+		c.MaxReqBodyLen = defaultMaxReqBodyLen
+	}
+	if len(c.CORSAllowedMethods) == 0 {
+		c.CORSAllowedMethods = defaultCORSMethods
+	}
+	if c.HSTSMaxAge == 0 {
+		c.HSTSMaxAge = defaultHSTSMaxAge
+	}
+	if c.ReferrerPolicy == "" {
+		c.ReferrerPolicy = defaultReferrerPolicy
+	}
+	if c.ContentSecurityPolicy == "" {
+		c.ContentSecurityPolicy = defaultCSP
+	}
+	if c.HostHeartbeatInterval == 0 {
+		c.HostHeartbeatInterval = defaultHostHeartbeatInterval
+	}
+	if c.EntropyReseedInterval == 0 {
+		c.EntropyReseedInterval = defaultEntropyReseedInterval
+	}
+	if c.TimeSyncInterval == 0 {
+		c.TimeSyncInterval = defaultTimeSyncInterval
+	}
+	if len(c.ShutdownSequence) == 0 {
+		c.ShutdownSequence = defaultShutdownSequence
+	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = defaultDrainTimeout
+	}
+	if c.AppStopTimeout == 0 {
+		c.AppStopTimeout = defaultAppStopTimeout
+	}
+	if c.AppHealthInterval == 0 {
+		c.AppHealthInterval = defaultAppHealthInterval
+	}
+	if c.AppHealthTimeout == 0 {
+		c.AppHealthTimeout = defaultAppHealthTimeout
+	}
+	if c.AppHealthFailures == 0 {
+		c.AppHealthFailures = defaultAppHealthFailures
+	}
+	if c.HookTimeout == 0 {
+		c.HookTimeout = defaultHookTimeout
+	}
+	if c.HostCID == 0 {
+		c.HostCID = parentCID
+	}
+	if c.TapSubnet == "" {
+		c.TapSubnet = defaultTapSubnet
+	}
+	if c.TapQueues == 0 {
+		c.TapQueues = 1
+	}
+}
+
+// setTimeouts applies our configured timeouts to the given Web servers.
+func (c *Config) setTimeouts(srvs ...*http.Server) {
+	for _, srv := range srvs {
+		srv.ReadHeaderTimeout = c.ReadHeaderTimeout
+		srv.ReadTimeout = c.ReadTimeout
+		srv.WriteTimeout = c.WriteTimeout
+		srv.IdleTimeout = c.IdleTimeout
 	}
-	return nil
 }
 
 // isScalingEnabled returns true if horizontal enclave scaling is enabled in our
@@ -204,6 +1313,12 @@ func (c *Config) isScalingEnabled() bool {
 	return c.FQDNLeader != ""
 }
 
+// isOverloadProtectionEnabled returns true if nitriding sheds low-priority
+// requests when the enclave is overloaded.
+func (c *Config) isOverloadProtectionEnabled() bool {
+	return c.OverloadMemPercent > 0 || c.OverloadCPUPercent > 0
+}
+
 // String returns a string representation of the enclave's configuration.
 func (c *Config) String() string {
 	s, err := json.MarshalIndent(c, "", "  ")
@@ -213,11 +1328,35 @@ func (c *Config) String() string {
 	return string(s)
 }
 
-// NewEnclave creates and returns a new enclave with the given config.
+// NewEnclave creates and returns a new enclave with the given config.  Fields
+// of the config are overridden by the corresponding NITRIDING_* environment
+// variables, if set.
 func NewEnclave(cfg *Config) (*Enclave, error) {
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("failed to create enclave: %w", err)
+	}
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("failed to create enclave: %w", err)
 	}
+	if cfg.RequireFIPS && !fipsEnabled() {
+		return nil, fmt.Errorf("failed to create enclave: %w", errNoFIPS)
+	}
+	cfg.setDefaults()
+	cfg.registerSecrets()
+	configureLogging(cfg)
+	configureTracing(cfg)
+	configureCrashReports(cfg)
+	// Validate made sure that our FQDNs are valid, so we can safely ignore
+	// errors.  From here on, we only use the ASCII form of our FQDNs.
+	cfg.FQDN, _ = normalizeFQDN(cfg.FQDN)
+	if cfg.isScalingEnabled() {
+		cfg.FQDNLeader, _ = normalizeFQDN(cfg.FQDNLeader)
+	}
+
+	keys, err := newSealedKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create enclave keys: %w", err)
+	}
 
 	reg := prometheus.NewRegistry()
 	e := &Enclave{
@@ -239,14 +1378,40 @@ func NewEnclave(cfg *Config) (*Enclave, error) {
 			Handler: promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}),
 		},
 		httpsCert:    &certRetriever{},
-		keys:         &enclaveKeys{},
+		keys:         keys,
 		promRegistry: reg,
 		metrics:      newMetrics(reg, cfg.PrometheusNamespace),
 		hashes:       new(AttestationHashes),
 		workers:      newWorkerManager(time.Minute),
 		stop:         make(chan struct{}),
+		appStop:      make(chan struct{}),
+		shutdownReq:  make(chan struct{}),
 		ready:        make(chan struct{}),
+		startup:      newStartupBarrier(),
+	}
+	if cfg.AuditLog {
+		e.audit = newAuditLog()
+	}
+	if cfg.EgressStats {
+		e.egress = newEgressStats()
+		reg.MustRegister(newEgressCollector(cfg.PrometheusNamespace, e.egress))
+	}
+	e.curCfg.Store(cfg)
+	cfg.setTimeouts(e.extPubSrv, e.extPrivSrv, e.intSrv, e.promSrv)
+	// Read and write timeouts can be reloaded, so we also apply them per
+	// request.
+	timeouts := e.reloadable(func(c *Config) func(http.Handler) http.Handler {
+		return timeoutMiddleware(c.ReadTimeout, c.WriteTimeout)
+	})
+	for _, srv := range []*http.Server{e.extPubSrv, e.extPrivSrv, e.intSrv} {
+		srv.Handler.(*chi.Mux).Use(timeouts)
+		srv.Handler.(*chi.Mux).Use(requestIDMiddleware)
+		srv.Handler.(*chi.Mux).NotFound(notFoundHandler)
+		srv.Handler.(*chi.Mux).MethodNotAllowed(methodNotAllowedHandler)
 	}
+	e.extPubSrv.Handler.(*chi.Mux).Use(traceMiddleware(apiPublic))
+	e.extPrivSrv.Handler.(*chi.Mux).Use(traceMiddleware(apiPrivate))
+	e.intSrv.Handler.(*chi.Mux).Use(traceMiddleware(apiInternal))
 
 	// Increase the maximum number of idle connections per host.  This is
 	// critical to boosting the requests per second that our reverse proxy can
@@ -259,15 +1424,51 @@ func NewEnclave(cfg *Config) (*Enclave, error) {
 
 	if cfg.Debug {
 		e.attester = &dummyAttester{}
-		e.extPubSrv.Handler.(*chi.Mux).Use(middleware.Logger)
-		e.extPrivSrv.Handler.(*chi.Mux).Use(middleware.Logger)
-		e.intSrv.Handler.(*chi.Mux).Use(middleware.Logger)
+	}
+	if cfg.Debug || cfg.AccessLog {
+		a := newAccessLogger(os.Stderr, cfg.AccessLogSkipPaths)
+		e.extPubSrv.Handler.(*chi.Mux).Use(a.middleware(apiPublic))
+		e.extPrivSrv.Handler.(*chi.Mux).Use(a.middleware(apiPrivate))
+		e.intSrv.Handler.(*chi.Mux).Use(a.middleware(apiInternal))
 	}
 	if cfg.PrometheusPort > 0 {
 		e.extPubSrv.Handler.(*chi.Mux).Use(e.metrics.middleware)
 		e.extPrivSrv.Handler.(*chi.Mux).Use(e.metrics.middleware)
 		e.intSrv.Handler.(*chi.Mux).Use(e.metrics.middleware)
 	}
+	if cfg.isOverloadProtectionEnabled() {
+		e.load = newLoadMonitor(cfg.OverloadMemPercent, cfg.OverloadCPUPercent)
+		e.extPubSrv.Handler.(*chi.Mux).Use(shedLoad(e.load, isLowPriorityPath))
+		e.extPrivSrv.Handler.(*chi.Mux).Use(shedLoad(e.load, isLowPriorityPath))
+		e.promSrv.Handler = shedLoad(e.load, isAnyRequest)(e.promSrv.Handler)
+	}
+	e.promSrv.Handler = timeouts(e.promSrv.Handler)
+	// The following middlewares depend on configuration fields that can be
+	// reloaded at runtime.
+	e.extPubSrv.Handler.(*chi.Mux).Use(e.reloadable(func(c *Config) func(http.Handler) http.Handler {
+		return bodyLimitMiddleware(c.MaxReqBodyLen, true)
+	}))
+	for _, srv := range []*http.Server{e.extPrivSrv, e.intSrv} {
+		srv.Handler.(*chi.Mux).Use(e.reloadable(func(c *Config) func(http.Handler) http.Handler {
+			return bodyLimitMiddleware(c.MaxReqBodyLen, false)
+		}))
+	}
+	e.extPubSrv.Handler.(*chi.Mux).Use(e.reloadable(func(c *Config) func(http.Handler) http.Handler {
+		if len(c.CORSAllowedOrigins) == 0 {
+			return nil
+		}
+		return corsMiddleware(c)
+	}))
+	e.extPubSrv.Handler.(*chi.Mux).Use(e.reloadable(func(c *Config) func(http.Handler) http.Handler {
+		if c.DisableSecurityHeaders {
+			return nil
+		}
+		return securityHeadersMiddleware(c)
+	}))
+	if cfg.CompressLevel > 0 {
+		e.extPubSrv.Handler.(*chi.Mux).Use(middleware.Compress(cfg.CompressLevel, cfg.CompressTypes...))
+	}
+	e.extPubSrv.Handler.(*chi.Mux).Use(e.appMiddleware)
 	if cfg.UseProfiling {
 		e.extPubSrv.Handler.(*chi.Mux).Mount(pathProfiling, middleware.Profiler())
 	}
@@ -277,44 +1478,247 @@ func NewEnclave(cfg *Config) (*Enclave, error) {
 	if cfg.isScalingEnabled() {
 		e.setSyncState(inProgress)
 	}
+	if cfg.AttestationPoWBits > 0 {
+		e.powSeen = newPoWCache()
+	}
+
+	if cfg.IntAuthToken == "" && cfg.IntAuthTokenFile != "" {
+		token, err := newAuthToken()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create auth token: %w", err)
+		}
+		cfg.IntAuthToken = token
+		registerSecret(token)
+	}
+	if cfg.IntAuthToken != "" {
+		// The token may be a secret reference that we only resolve in Start,
+		// so we look it up at request time.
+		e.intSrv.Handler.(*chi.Mux).Use(authMiddleware(func() string { return cfg.IntAuthToken }))
+	}
+
+	if len(cfg.AppSecrets) > 0 || len(cfg.AppSecretInject) > 0 {
+		e.appSecrets = newAppSecretStore(cfg, func() { e.startup.markMet(appPrereqSecrets) })
+	}
 
 	// Register external public HTTP API.
 	m := e.extPubSrv.Handler.(*chi.Mux)
-	m.Get(pathAttestation, attestationHandler(e.cfg.UseProfiling, e.hashes, e.attester))
-	m.Get(pathRoot, rootHandler(e.cfg))
-	m.Get(pathConfig, configHandler(e.cfg))
+	var provisionKey []byte
+	if cfg.Provisioning {
+		p, err := newProvisioner()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create provisioning key: %w", err)
+		}
+		e.provisioner = p
+		provisionKey = e.provisioner.publicKey()
+		addRoute(m, http.MethodPost, pathProvision, provisionHandler(e.provisioner, e.appSecrets))
+	}
+	addRoute(m, http.MethodGet, pathAttestation, bootAttstnHandler(e, e.attestationEndpoint(provisionKey)))
+	addRoute(m, http.MethodGet, pathBundle, e.withPoW(verificationBundleHandler(e, provisionKey)))
+	if cfg.OIDCTokens {
+		if e.oidc, err = newOIDCIssuer(oidcIssuerURL(cfg)); err != nil {
+			return nil, fmt.Errorf("failed to create OIDC signing key: %w", err)
+		}
+		addRoute(m, http.MethodGet, pathOIDCConfig, oidcDiscoveryHandler(e.oidc))
+		addRoute(m, http.MethodGet, pathOIDCKeys, jwksHandler(e.oidc))
+		addRoute(m, http.MethodGet, pathOIDCAttstn, e.attestationEndpoint(e.oidc.publicKey()))
+	}
+	if cfg.SealedLogPort != 0 {
+		shipper := newLogShipper(logProtoFramed, dialHostVsock(cfg.HostCID, cfg.SealedLogPort))
+		if e.sealedLog, err = newSealedLog(shipper); err != nil {
+			return nil, fmt.Errorf("failed to create sealed log signing key: %w", err)
+		}
+		addRoute(m, http.MethodGet, pathSLAttstn, e.attestationEndpoint(e.sealedLog.publicKey()))
+	}
+	if cfg.PrivacyPass {
+		if e.tokens, err = newTokenIssuer(e.keys, publicURL(cfg, pathPPIssue)); err != nil {
+			return nil, fmt.Errorf("failed to create Privacy Pass token key: %w", err)
+		}
+		addRoute(m, http.MethodGet, pathPPDirectory, privacyPassDirHandler(e.tokens))
+		addRoute(m, http.MethodGet, pathPPAttstn, e.withPoW(privacyPassAttstnHandler(e.tokens, e.cfg.UseProfiling, e.hashes, e.attester)))
+		addRoute(m, http.MethodPost, pathPPIssue, privacyPassIssueHandler(e.tokens))
+	}
+	if !cfg.DisableIndexPage {
+		addRoute(m, http.MethodGet, pathRoot, rootHandler(e))
+	}
+	addRoute(m, http.MethodGet, pathConfig, configHandler(e.currentConfig))
+	addRoute(m, http.MethodGet, pathInfo, infoHandler(e))
+	addRoute(m, http.MethodGet, pathImage, imageHandler(e))
+	addRoute(m, http.MethodGet, pathOpenAPI, openAPIHandler(e))
 
 	// Register external but private HTTP API.
 	m = e.extPrivSrv.Handler.(*chi.Mux)
-	m.Handle(pathSync, asWorker(e.setupWorkerPostSync, e.attester))
+	worker := asWorker(e.setupWorkerPostSync, e.attester)
+	addRoute(m, http.MethodGet, pathSync, worker.ServeHTTP)
+	addRoute(m, http.MethodPost, pathSync, worker.ServeHTTP)
+	addRoute(m, http.MethodGet, pathStats, statsHandler())
+	if e.egress != nil {
+		addRoute(m, http.MethodGet, pathEgress, egressHandler(e.egress))
+	}
+	if len(cfg.DeliveredSecrets) > 0 {
+		e.vault = newSecretVault(cfg.SecretDeliveryPCRs)
+		addRoute(m, http.MethodPost, pathSecrets, secretDeliveryHandler(e.vault))
+	}
 
 	// Register enclave-internal HTTP API.
 	m = e.intSrv.Handler.(*chi.Mux)
 	if cfg.WaitForApp {
-		m.Get(pathReady, readyHandler(e.ready))
+		addRoute(m, http.MethodGet, pathReady, audited(e.audit, auditReady, readyHandler(e.signalReady)))
+	}
+	if !cfg.DisableGetState {
+		addRoute(m, http.MethodGet, pathState, getStateHandler(e.getSyncState, e.keys))
+	}
+	if !cfg.DisableSetState {
+		addRoute(m, http.MethodPut, pathState, audited(e.audit, auditSetState,
+			putStateHandler(e.attester, e.getSyncState, e.keys, e.workers)))
+	}
+	addRoute(m, http.MethodPost, pathHash, audited(e.audit, auditSetHash, hashHandler(e)))
+	addRoute(m, http.MethodPut, pathConfig, audited(e.audit, auditSetConfig, reloadHandler(e)))
+	// Without an auth token, any process in the enclave could shut us down.
+	if cfg.IntAuthToken != "" {
+		addRoute(m, http.MethodPost, pathShutdown, audited(e.audit, auditShutdown, shutdownHandler(e)))
+	}
+	if inEnclave {
+		addRoute(m, http.MethodGet, pathEntropy, entropyHandler(nsmRandom))
+	} else {
+		addRoute(m, http.MethodGet, pathEntropy, entropyHandler(cryptoRandom))
+	}
+	if e.audit != nil {
+		addRoute(m, http.MethodGet, pathAudit, auditHandler(e.audit))
+	}
+	if e.provisioner != nil {
+		addRoute(m, http.MethodGet, pathProvision, getProvisionedHandler(e.provisioner))
+	}
+	if cfg.isTimeSyncEnabled() {
+		addRoute(m, http.MethodGet, pathTime, timeHandler())
+	}
+	addRoute(m, http.MethodPost, pathKMSDecrypt, kmsHandler("Decrypt",
+		func() kmsRequest { return new(kmsDecryptRequest) }, e.attester, e.hashes))
+	addRoute(m, http.MethodPost, pathKMSDataKey, kmsHandler("GenerateDataKey",
+		func() kmsRequest { return new(kmsDataKeyRequest) }, e.attester, e.hashes))
+	addRoute(m, http.MethodPost, pathS3Fetch, s3FetchHandler(e.hashes))
+	if e.appSecrets != nil {
+		addRoute(m, http.MethodGet, pathAppSecrets, appSecretHandler(e.appSecrets))
+	}
+	if cfg.VaultAddr != "" {
+		e.vaultAuth = newVaultAuth(cfg, e.attester, e.hashes)
+		addRoute(m, http.MethodGet, pathVaultToken, vaultTokenHandler(e.vaultAuth))
+	}
+	if cfg.SpireServer != "" {
+		e.spire = newSpireAgent(cfg, e.attester, e.hashes)
+		addRoute(m, http.MethodGet, pathSVID, svidHandler(e.spire))
+	}
+	if len(cfg.Databases) > 0 {
+		e.databases = newDatabaseStore(cfg)
+		addRoute(m, http.MethodGet, pathDatabases, databaseHandler(e.databases))
+	}
+	if cfg.SealedStateStore != "" {
+		e.sealer = newStateSealer(cfg, e.attester, e.hashes)
+		addRoute(m, http.MethodPut, pathSealedState, putSealedStateHandler(e.sealer))
+		addRoute(m, http.MethodGet, pathSealedState, getSealedStateHandler(e.sealer))
+	}
+	if cfg.EventSink != "" {
+		// The config was validated, so parsing cannot fail.
+		sink, _ := parseEventSink(cfg.EventSink)
+		e.events = newEventForwarder(sink)
+		addRoute(m, http.MethodPost, pathEvents, eventHandler(e.events))
+		if cfg.EventAuditLog {
+			e.audit.forward = e.events.forwardAudit()
+		}
+	}
+	if e.oidc != nil {
+		addRoute(m, http.MethodPost, pathOIDCToken, oidcTokenHandler(e.oidc))
+	}
+	if e.sealedLog != nil {
+		addRoute(m, http.MethodPost, pathSealedLog, sealedLogHandler(e.sealedLog))
+	}
+	if cfg.GRPCSocket != "" {
+		e.grpc = newGRPCServer(e)
+	}
+	if e.tokens != nil {
+		addRoute(m, http.MethodPost, pathPPRedeem, privacyPassRedeemHandler(e.tokens))
+	}
+	if cfg.OnionService {
+		e.onion = newOnionService(cfg)
 	}
-	m.Get(pathState, getStateHandler(e.getSyncState, e.keys))
-	m.Put(pathState, putStateHandler(e.attester, e.getSyncState, e.keys, e.workers))
-	m.Post(pathHash, hashHandler(e))
 
 	// Configure our reverse proxy if the enclave application exposes an HTTP
 	// server.
 	if cfg.AppWebSrv != nil {
 		e.revProxy = httputil.NewSingleHostReverseProxy(cfg.AppWebSrv)
-		e.revProxy.BufferPool = newBufPool()
+		e.revProxy.BufferPool = newBufPool(bufSize)
 		e.revProxy.Transport = customTransport
-		e.extPubSrv.Handler.(*chi.Mux).Handle(pathProxy, e.revProxy)
+		// Uploads, long polling, and server-sent events can take longer than
+		// our read and write timeouts, so we leave them to the application.
+		noTimeouts := timeoutMiddleware(0, 0)
+		e.extPubSrv.Handler.(*chi.Mux).Handle(pathProxy, noTimeouts(e.requireAppReady(e.revProxy)))
 		// If we expose Prometheus metrics, we keep track of the HTTP backend's
 		// responses.
 		if cfg.PrometheusPort > 0 {
 			e.revProxy.ModifyResponse = e.metrics.checkRevProxyResp
-			e.revProxy.ErrorHandler = e.metrics.checkRevProxyErr
+			e.revProxy.ErrorHandler = countRevProxyErr(e.metrics.checkRevProxyErr)
+		} else {
+			e.revProxy.ErrorHandler = countRevProxyErr(nil)
+		}
+	}
+	if cfg.OHTTPGateway {
+		if e.ohttp, err = newOHTTPGateway(e.revProxy); err != nil {
+			return nil, fmt.Errorf("failed to create OHTTP gateway key: %w", err)
 		}
+		m := e.extPubSrv.Handler.(*chi.Mux)
+		addRoute(m, http.MethodPost, pathOHTTP, ohttpGatewayHandler(e.ohttp))
+		addRoute(m, http.MethodGet, pathOHTTPKeys, ohttpKeysHandler(e.ohttp))
+		addRoute(m, http.MethodGet, pathOHTTPAttstn, e.attestationEndpoint(e.ohttp.keyConfig()))
 	}
 
+	for _, h := range cfg.LifecycleHooks {
+		point, cmd, err := parseLifecycleHook(h)
+		if err != nil {
+			return nil, err
+		}
+		e.OnLifecycle(point, commandHook(cmd))
+	}
+
+	// Include a hash over our configuration in attestation documents, so
+	// verifiers can confirm how nitriding was configured.
+	configHash, err := hashConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash config: %w", err)
+	}
+	e.hashes.configHash = configHash
+
 	return e, nil
 }
 
+// versioned returns the versioned equivalent of the given unversioned path,
+// e.g., /enclave/v1/attestation for /enclave/attestation.
+func versioned(path string) string {
+	return pathV1 + strings.TrimPrefix(path, pathRoot)
+}
+
+// unversioned returns the unversioned equivalent of the given path, e.g.,
+// /enclave/attestation for /enclave/v1/attestation.  Unversioned paths are
+// returned as is.
+func unversioned(path string) string {
+	if path == pathV1 || strings.HasPrefix(path, pathV1+"/") {
+		return pathRoot + strings.TrimPrefix(path, pathV1)
+	}
+	return path
+}
+
+// addRoute registers the given handler for the given method and path under
+// our versioned API.  For backwards compatibility, the handler remains
+// available under the unversioned path, but responses to the unversioned path
+// carry headers that mark the path as deprecated, in the spirit of RFC 9745.
+func addRoute(m chi.Router, method, path string, h http.HandlerFunc) {
+	successor := versioned(path)
+	m.MethodFunc(method, successor, h)
+	m.MethodFunc(method, path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		h(w, r)
+	})
+}
+
 // Start starts the Nitro Enclave.  If something goes wrong, the function
 // returns an error.
 func (e *Enclave) Start() error {
@@ -323,23 +1727,134 @@ func (e *Enclave) Start() error {
 		leader = e.getLeader(pathHeartbeat)
 	)
 	errPrefix := "failed to start Nitro Enclave"
+	e.startTime = time.Now().UTC()
+
+	// Keep our key material out of core dumps and swap space.  We do this
+	// before we create any keys.
+	if err = disableCoreDumps(); err != nil {
+		return fmt.Errorf("%s: %w", errPrefix, err)
+	}
+	if e.cfg.LockMemory {
+		if err = lockMemory(); err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		elog.Info("Locked memory.")
+	}
+
+	// Verify the enclave application's signature before we set up anything
+	// that the application may depend on.
+	if e.cfg.SigstoreBundle != "" {
+		if err = e.verifyAppSignature(); err != nil {
+			return fmt.Errorf("%s: failed to verify application signature: %w", errPrefix, err)
+		}
+	}
 
 	if inEnclave {
+		fdCur, fdMax := e.cfg.FdCur, e.cfg.FdMax
+		if e.cfg.AutoTune {
+			fdCur, fdMax = autoTune(e.cfg)
+		}
 		// Set file descriptor limit.  There's no need to exit if this fails.
-		if err = setFdLimit(e.cfg.FdCur, e.cfg.FdMax); err != nil {
-			elog.Printf("Failed to set new file descriptor limit: %s", err)
+		if err = setFdLimit(fdCur, fdMax); err != nil {
+			elog.Warn("Failed to set new file descriptor limit.", "error", err)
 		}
 		if err = configureLoIface(); err != nil {
 			return fmt.Errorf("%s: %w", errPrefix, err)
 		}
+		go e.reseedEntropy(e.cfg.EntropyReseedInterval)
+	}
+
+	if e.cfg.HostHeartbeatPort != 0 {
+		go e.sendHostHeartbeats(dialHostVsock(e.cfg.HostCID, e.cfg.HostHeartbeatPort), e.cfg.HostHeartbeatInterval)
 	}
 
 	// Set up our networking environment which creates a TAP device that
 	// forwards traffic (via the VSOCK interface) to the EC2 host.
-	go runNetworking(e.cfg, e.stop)
+	go runNetworking(e.cfg, e.egress, e.stop)
+	if e.cfg.DNSCache {
+		// Port 53 requires root privileges.
+		if err = newDNSResolver(e.cfg.dnsUpstreams(), newHostOverrides(e.cfg.HostOverrides)).listen(dnsCacheAddr, e.stop); err != nil {
+			return fmt.Errorf("%s: failed to start DNS cache: %w", errPrefix, err)
+		}
+	}
+	if e.cfg.isTimeSyncEnabled() {
+		server, query := e.timeSource()
+		go e.syncTime(server, query, e.cfg.TimeSyncInterval)
+	}
+	if e.load != nil {
+		go e.monitorLoad()
+	}
+	if e.vaultAuth != nil {
+		go e.maintainVaultToken()
+	}
+	if e.spire != nil {
+		go e.maintainSVID()
+	}
+	if e.events != nil {
+		go e.events.run(e.stop)
+	}
+	if e.sealedLog != nil {
+		go e.sealedLog.shipper.run(e.stop)
+	}
+
+	// Resolve secret references now that we can reach AWS via the host.
+	ctx, cancel := context.WithTimeout(context.Background(), secretResolveTimeout)
+	resolve := func(ctx context.Context, ref string) (string, error) {
+		return resolveSecret(ctx, e.attester, e.hashes, ref)
+	}
+	err = e.cfg.resolveSecrets(ctx, resolve)
+	if err == nil && e.vault != nil {
+		err = e.vault.resolve(ctx, e.cfg.DeliveredSecrets, resolve)
+	}
+	if err == nil && e.cfg.AppSecretsTmpfs != "" {
+		err = mountTmpfs(e.cfg.AppSecretsTmpfs, e.cfg.UID, e.cfg.GID)
+	}
+	if err == nil && e.appSecrets != nil {
+		err = e.appSecrets.fetch(ctx, e.cfg.AppSecrets, e.cfg.AppSecretsDir,
+			func(ctx context.Context, ref string) (string, error) {
+				plaintext, err := fetchAppSecret(ctx, e.attester, e.hashes, ref)
+				defer wipeBytes(plaintext)
+				return string(plaintext), err
+			})
+	}
+	if err == nil && e.databases != nil {
+		err = e.databases.fetch(ctx, func(ctx context.Context, ref string) (string, error) {
+			plaintext, err := fetchAppSecret(ctx, e.attester, e.hashes, ref)
+			defer wipeBytes(plaintext)
+			return string(plaintext), err
+		})
+		if err == nil {
+			err = e.databases.forward(e.stop)
+		}
+	}
+	if err == nil && e.cfg.RestartCounter != "" {
+		err = e.countRestart(ctx)
+	}
+	if err == nil && e.onion != nil {
+		err = e.onion.setKey(e.cfg.OnionKey, e.cfg.TorControlPassword)
+	}
+	cancel()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errPrefix, err)
+	}
+
+	if e.cfg.IntAuthTokenFile != "" {
+		if err = writeAuthToken(e.cfg.IntAuthTokenFile, e.cfg.IntAuthToken, e.cfg.UID, e.cfg.GID); err != nil {
+			return fmt.Errorf("%s: failed to write auth token: %w", errPrefix, err)
+		}
+	}
+
+	e.startLifecycleHooks()
+	var provisionKey []byte
+	if e.provisioner != nil {
+		provisionKey = e.provisioner.publicKey()
+	}
+	go e.createBootAttstn(provisionKey)
 
 	// Get an HTTPS certificate.
-	if e.cfg.UseACME {
+	if e.cfg.UseACME && e.cfg.ACMEDNSProvider != "" {
+		err = e.setupAcmeDNS()
+	} else if e.cfg.UseACME {
 		err = e.setupAcme()
 	} else {
 		err = e.genSelfSignedCert()
@@ -351,24 +1866,121 @@ func (e *Enclave) Start() error {
 	if err = e.startWebServers(); err != nil {
 		return fmt.Errorf("%s: %w", errPrefix, err)
 	}
+	if e.onion != nil {
+		go e.publishOnion()
+	}
 
-	if !e.cfg.isScalingEnabled() {
-		return nil
+	// Creating the application's cgroup requires root privileges.
+	if e.cfg.runsApp() {
+		e.appLimits = newAppLimits(e.cfg)
+	}
+
+	// We no longer need root privileges.  We keep our session with the NSM
+	// because we may not be allowed to open its device file as another user.
+	if e.cfg.UID != 0 {
+		if inEnclave {
+			if err = keepNSMSession(); err != nil {
+				return fmt.Errorf("%s: failed to open NSM session: %w", errPrefix, err)
+			}
+		}
+		if err = dropPrivileges(e.cfg.UID, e.cfg.GID); err != nil {
+			return fmt.Errorf("%s: failed to drop privileges: %w", errPrefix, err)
+		}
+		elog.Info("Dropped privileges.", "uid", e.cfg.UID, "gid", e.cfg.GID)
+	}
+
+	// Our networking and certificate are set up, so we no longer need most
+	// system calls.
+	if e.cfg.Seccomp {
+		if err = installSeccompFilter(); err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		elog.Info("Installed seccomp filter.")
 	}
 
 	// Check if we are the leader.
-	if !e.weAreLeader() {
-		elog.Println("Obtaining worker's hostname.")
+	if e.cfg.isScalingEnabled() && !e.weAreLeader() {
+		elog.Info("Obtaining worker's hostname.")
 		worker := getSyncURL(getHostnameOrDie(), e.cfg.ExtPrivPort)
 		err = asWorker(e.setupWorkerPostSync, e.attester).registerWith(leader, worker)
 		if err != nil {
-			elog.Fatalf("Error syncing with leader: %v", err)
+			fatal("Error syncing with leader.", "error", err)
 		}
+	} else {
+		// Without a leader to sync from, we already have our key material.
+		// Workers only have theirs once the leader sent it, which happens
+		// after registration, in setupWorkerPostSync.
+		e.startup.markMet(appPrereqKeys)
+	}
+
+	// The application waits for its prerequisites before it starts.
+	if e.cfg.runsApp() {
+		e.appExited = make(chan struct{})
+		go e.superviseApp()
 	}
 
 	return nil
 }
 
+// Use adds the given middlewares to the public Web server, which allows
+// applications that embed nitriding to add authentication, tracing, or custom
+// headers.  The middlewares run after nitriding's own middlewares, for both
+// nitriding's endpoints and requests that are forwarded to the enclave
+// application.  Use must be called before Start, and it panics if the public
+// Web server has already handled requests.
+func (e *Enclave) Use(middlewares ...func(http.Handler) http.Handler) {
+	e.appMiddlewaresLock.Lock()
+	defer e.appMiddlewaresLock.Unlock()
+
+	if e.appChainBuilt {
+		panic("nitriding: middlewares must be added before the public Web server handles requests")
+	}
+	e.appMiddlewares = append(e.appMiddlewares, middlewares...)
+}
+
+// appMiddleware is a chi middleware that runs the middlewares that were
+// added via Use.  chi requires middlewares to be added before routes, but
+// embedding applications only get to call Use after NewEnclave registered
+// our routes, so we only assemble the middleware chain once the first request
+// arrives.
+func (e *Enclave) appMiddleware(h http.Handler) http.Handler {
+	var (
+		once    sync.Once
+		chained http.Handler
+	)
+	f := func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			e.appMiddlewaresLock.Lock()
+			defer e.appMiddlewaresLock.Unlock()
+			e.appChainBuilt = true
+			chained = chi.Chain(e.appMiddlewares...).Handler(h)
+		})
+		chained.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(f)
+}
+
+// SignalReady signals that the enclave application is ready, which instructs
+// nitriding to start its Internet-facing Web server if WaitForApp is set.
+// This is the Go equivalent of calling the enclave-internal ready endpoint.
+// It is safe to call SignalReady repeatedly.
+func (e *Enclave) SignalReady() {
+	if e.signalReady() {
+		e.audit.record(auditReady, callerAPI, nil, 0)
+	}
+}
+
+// signalReady closes our ready channel and returns true if this is the first
+// time that the application signalled its readiness, or the first time since
+// we restarted the unhealthy application.
+func (e *Enclave) signalReady() (first bool) {
+	e.readyOnce.Do(func() {
+		close(e.ready)
+		first = true
+	})
+	return e.appUnready.CompareAndSwap(true, false) || first
+}
+
 // getSyncState returns the enclave's key synchronization state.
 func (e *Enclave) getSyncState() int {
 	e.Lock()
@@ -394,7 +2006,7 @@ func (e *Enclave) weAreLeader() (result bool) {
 		leader      = e.getLeader(pathLeader)
 	)
 	defer func() {
-		elog.Printf("We are leader: %v", result)
+		elog.Info("Determined leadership.", "leader", result)
 		if result {
 			e.setSyncState(isLeader)
 		} else {
@@ -404,13 +2016,13 @@ func (e *Enclave) weAreLeader() (result bool) {
 
 	ourNonce, err = newNonce()
 	if err != nil {
-		elog.Fatalf("Error creating new nonce: %v", err)
+		fatal("Error creating new nonce.", "error", err)
 	}
 
 	m := e.extPrivSrv.Handler.(*chi.Mux)
-	m.Get(pathLeader, getLeaderHandler(ourNonce, weAreLeader))
+	addRoute(m, http.MethodGet, pathLeader, getLeaderHandler(ourNonce, weAreLeader))
 	// Reset the handler as we no longer have a need for it.
-	defer m.Get(pathLeader,
+	defer addRoute(m, http.MethodGet, pathLeader,
 		func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusGone)
 		},
@@ -423,7 +2035,7 @@ func (e *Enclave) weAreLeader() (result bool) {
 		case <-e.stop:
 			return
 		case <-errChan:
-			elog.Println("Not yet able to talk to leader designation endpoint.")
+			elog.Debug("Not yet able to talk to leader designation endpoint.")
 			time.Sleep(time.Second)
 			continue
 		case result = <-areWeLeader:
@@ -433,7 +2045,7 @@ func (e *Enclave) weAreLeader() (result bool) {
 			result = true
 			return
 		case <-timeout.C:
-			elog.Fatal("Timed out talking to leader designation endpoint.")
+			fatal("Timed out talking to leader designation endpoint.")
 		}
 	}
 }
@@ -448,6 +2060,8 @@ func (e *Enclave) setupWorkerPostSync(keys *enclaveKeys) error {
 	}
 	e.httpsCert.set(&cert)
 
+	e.startup.markMet(appPrereqKeys)
+
 	// Start our heartbeat.
 	worker := getSyncURL(getHostnameOrDie(), e.cfg.ExtPrivPort)
 	go e.workerHeartbeat(worker)
@@ -460,8 +2074,8 @@ func (e *Enclave) setupWorkerPostSync(keys *enclaveKeys) error {
 func (e *Enclave) setupLeader() {
 	go e.workers.start(e.stop)
 	// Make leader-specific endpoint available.
-	e.extPrivSrv.Handler.(*chi.Mux).Post(pathHeartbeat, heartbeatHandler(e))
-	elog.Println("Set up leader endpoint and started worker event loop.")
+	addRoute(e.extPrivSrv.Handler.(*chi.Mux), http.MethodPost, pathHeartbeat, heartbeatHandler(e))
+	elog.Info("Set up leader endpoint and started worker event loop.")
 }
 
 // workerHeartbeat periodically talks to the leader enclave to 1) let the leader
@@ -469,8 +2083,9 @@ func (e *Enclave) setupLeader() {
 // that the leader has different key material than the worker, the worker
 // re-registers itself, which triggers key re-synchronization.
 func (e *Enclave) workerHeartbeat(worker *url.URL) {
-	elog.Println("Starting worker's heartbeat loop.")
-	defer elog.Println("Exiting worker's heartbeat loop.")
+	defer reportPanic()
+	elog.Info("Starting worker's heartbeat loop.")
+	defer elog.Info("Exiting worker's heartbeat loop.")
 	var (
 		leader = e.getLeader(pathHeartbeat)
 		timer  = time.NewTicker(time.Minute)
@@ -487,7 +2102,7 @@ func (e *Enclave) workerHeartbeat(worker *url.URL) {
 			hbBody.HashedKeys = e.keys.hashAndB64()
 			body, err := json.Marshal(hbBody)
 			if err != nil {
-				elog.Printf("Error marshalling heartbeat request: %v", err)
+				elog.Error("Error marshalling heartbeat request.", "error", err)
 				e.metrics.heartbeats.With(badHb(err)).Inc()
 				continue
 			}
@@ -498,37 +2113,53 @@ func (e *Enclave) workerHeartbeat(worker *url.URL) {
 				bytes.NewReader(body),
 			)
 			if err != nil {
-				elog.Printf("Error posting heartbeat to leader: %v", err)
+				elog.Warn("Error posting heartbeat to leader.", "error", err)
 				e.metrics.heartbeats.With(badHb(err)).Inc()
 				continue
 			}
 			if resp.StatusCode != http.StatusOK {
 				e.metrics.heartbeats.With(badHb(fmt.Errorf("got status code %d", resp.StatusCode))).Inc()
-				elog.Printf("Leader responded to heartbeat with status code %d.", resp.StatusCode)
+				elog.Warn("Leader rejected heartbeat.", "status", resp.StatusCode)
 				continue
 			}
-			elog.Println("Successfully sent heartbeat to leader.")
+			elog.Debug("Successfully sent heartbeat to leader.")
 			e.metrics.heartbeats.With(goodHb).Inc()
 		}
 	}
 }
 
-// Stop stops the enclave.
-func (e *Enclave) Stop() error {
-	close(e.stop)
-	if err := e.intSrv.Shutdown(context.Background()); err != nil {
-		return err
+// WipeKeyMaterial overwrites nitriding's and the enclave application's key
+// material with zeros, and discards our HTTPS certificate.  Stop calls
+// WipeKeyMaterial, so only call it yourself if the enclave should keep running
+// without its keys.
+func (e *Enclave) WipeKeyMaterial() {
+	e.keys.wipe()
+	e.httpsCert.set(nil)
+	if e.provisioner != nil {
+		e.provisioner.wipe()
 	}
-	if err := e.extPubSrv.Shutdown(context.Background()); err != nil {
-		return err
+	if e.vault != nil {
+		e.vault.wipe()
 	}
-	if err := e.extPrivSrv.Shutdown(context.Background()); err != nil {
-		return err
+	if e.vaultAuth != nil {
+		e.vaultAuth.wipe()
 	}
-	if err := e.promSrv.Shutdown(context.Background()); err != nil {
-		return err
+	if e.spire != nil {
+		e.spire.wipe()
 	}
-	return nil
+	if e.appSecrets != nil {
+		e.appSecrets.wipe()
+	}
+	if e.databases != nil {
+		e.databases.wipe()
+	}
+	if e.onion != nil {
+		e.onion.wipe()
+	}
+	if e.ohttp != nil {
+		e.ohttp.wipe()
+	}
+	elog.Info("Wiped key material.")
 }
 
 // getExtListener returns a listener for the HTTPS service
@@ -545,46 +2176,59 @@ func (e *Enclave) getExtListener() (net.Listener, error) {
 // Web server, and -- if desired -- a Web server for profiling and/or metrics.
 func (e *Enclave) startWebServers() error {
 	if e.cfg.PrometheusPort > 0 {
-		elog.Printf("Starting Prometheus Web server (%s).", e.promSrv.Addr)
+		elog.Info("Starting Prometheus Web server.", "addr", e.promSrv.Addr)
 		go func() {
+			defer reportPanic()
 			err := e.promSrv.ListenAndServe()
 			if err != nil && !errors.Is(err, http.ErrServerClosed) {
-				elog.Fatalf("Prometheus Web server error: %v", err)
+				fatal("Prometheus Web server error.", "error", err)
 			}
 		}()
 	}
 
 	go func() {
-		elog.Printf("Starting internal Web server at %s.", e.intSrv.Addr)
+		defer reportPanic()
+		elog.Info("Starting internal Web server.", "addr", e.intSrv.Addr)
 		err := e.intSrv.ListenAndServe()
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			elog.Fatalf("Private Web server error: %v", err)
+			fatal("Private Web server error.", "error", err)
 		}
 	}()
+	if e.grpc != nil {
+		elog.Info("Starting internal gRPC server.", "socket", e.cfg.GRPCSocket)
+		srv, err := e.grpc.listen(e.cfg)
+		if err != nil {
+			return fmt.Errorf("failed to listen on gRPC socket: %w", err)
+		}
+		e.grpcSrv = srv
+	}
 	go func() {
-		elog.Printf("Starting external private Web server at %s.", e.extPrivSrv.Addr)
+		defer reportPanic()
+		elog.Info("Starting external private Web server.", "addr", e.extPrivSrv.Addr)
 		err := e.extPrivSrv.ListenAndServeTLS("", "")
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			elog.Fatalf("External private Web server error: %v", err)
+			fatal("External private Web server error.", "error", err)
 		}
 	}()
 	go func() {
+		defer reportPanic()
 		// If desired, don't launch our Internet-facing Web server until the
 		// application signalled that it's ready.
 		if e.cfg.WaitForApp {
 			<-e.ready
-			elog.Println("Application signalled that it's ready.  Starting public Web server.")
+			elog.Info("Application signalled that it's ready.  Starting public Web server.")
 		}
+		e.runLifecycleHooks(hookBeforeServe)
 
 		listener, err := e.getExtListener()
 		if err != nil {
-			elog.Fatalf("Failed to listen on external port: %v", err)
+			fatal("Failed to listen on external port.", "error", err)
 		}
 
-		elog.Printf("Starting external public Web server at :%d.", e.cfg.ExtPubPort)
+		elog.Info("Starting external public Web server.", "port", e.cfg.ExtPubPort)
 		err = e.extPubSrv.ServeTLS(listener, "", "")
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			elog.Fatalf("External public Web server error: %v", err)
+			fatal("External public Web server error.", "error", err)
 		}
 	}()
 
@@ -601,22 +2245,30 @@ func (e *Enclave) genSelfSignedCert() error {
 	if err := e.setCertFingerprint(cert); err != nil {
 		return err
 	}
-	e.keys.setNitridingKeys(key, cert)
-
 	tlsCert, err := tls.X509KeyPair(cert, key)
 	if err != nil {
 		return err
 	}
+	e.keys.setNitridingKeys(key, cert)
 	e.httpsCert.set(&tlsCert)
 	e.extPubSrv.TLSConfig = &tls.Config{
 		GetCertificate: e.httpsCert.get,
 	}
+	e.setTLSMinVersion()
 	// Both servers share a TLS config.
 	e.extPrivSrv.TLSConfig = e.extPubSrv.TLSConfig.Clone()
 
 	return nil
 }
 
+// setTLSMinVersion applies our minimum TLS version to the public Web server's
+// TLS config.
+func (e *Enclave) setTLSMinVersion() {
+	// Validate made sure that the version is valid.
+	v, _ := parseTLSVersion(e.cfg.TLSMinVersion)
+	e.extPubSrv.TLSConfig.MinVersion = v
+}
+
 // setupAcme attempts to retrieve an HTTPS certificate from Let's Encrypt for
 // the given FQDN.  Note that we are unable to cache certificates across
 // enclave restarts, so the enclave requests a new certificate each time it
@@ -625,7 +2277,7 @@ func (e *Enclave) genSelfSignedCert() error {
 func (e *Enclave) setupAcme() error {
 	var err error
 
-	elog.Printf("ACME hostname set to %s.", e.cfg.FQDN)
+	elog.Info("Set ACME hostname.", "fqdn", e.cfg.FQDN)
 	// By default, we use an in-memory certificate cache.  We only use the
 	// directory cache when we're *not* in an enclave.  There's no point in
 	// writing certificates to disk when in an enclave because the disk does
@@ -637,13 +2289,33 @@ func (e *Enclave) setupAcme() error {
 		cache = autocert.DirCache(acmeCertCacheDir)
 	}
 	certManager := autocert.Manager{
-		Cache:      cache,
+		Cache:      countingCache{cache},
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: autocert.HostWhitelist([]string{e.cfg.FQDN}...),
+		Client:     &acme.Client{DirectoryURL: autocert.DefaultACMEDirectory, HTTPClient: outboundHTTPClient},
+	}
+	if e.cfg.ACMEDirectoryURL != "" {
+		elog.Info("Using custom ACME directory.", "url", e.cfg.ACMEDirectoryURL)
+		certManager.Client.DirectoryURL = e.cfg.ACMEDirectoryURL
 	}
 	e.extPubSrv.TLSConfig = certManager.TLSConfig()
+	e.setTLSMinVersion()
+	if e.cfg.ACMETempCert {
+		temp, err := e.newTempCert()
+		if err != nil {
+			return err
+		}
+		e.extPubSrv.TLSConfig.GetCertificate = e.withTempCert(temp, e.extPubSrv.TLSConfig.GetCertificate)
+		go e.requestACMECert(&certManager)
+	}
 
 	go func() {
+		defer reportPanic()
+		// This span measures how long it takes to obtain our certificate.
+		_, span := startSpan(context.Background(), "acme.obtain_certificate")
+		span.setAttr("fqdn", e.cfg.FQDN)
+		defer span.end()
+
 		var rawData []byte
 		for {
 			// Get the SHA-1 hash over our leaf certificate.
@@ -653,13 +2325,14 @@ func (e *Enclave) setupAcme() error {
 			if err != nil {
 				time.Sleep(5 * time.Second)
 			} else {
-				elog.Print("Got certificates from cache.  Proceeding with start.")
+				elog.Info("Got certificates from cache.  Proceeding with start.")
 				break
 			}
 		}
 		if err := e.setCertFingerprint(rawData); err != nil {
-			elog.Fatalf("Failed to set certificate fingerprint: %s", err)
+			fatal("Failed to set certificate fingerprint.", "error", err)
 		}
+		e.swappedInACMECert()
 	}()
 	return nil
 }
@@ -674,30 +2347,43 @@ func (e *Enclave) setCertFingerprint(rawData []byte) error {
 		if err != nil {
 			return errors.New("failed to decode mock certificate fingerprint hex")
 		}
-		copy(e.hashes.tlsKeyHash[:], hash)
+		var fingerprint [sha256.Size]byte
+		copy(fingerprint[:], hash)
+		e.hashes.setTLSKeyHash(fingerprint)
+		e.startup.markMet(appPrereqCert)
 		return nil
 	}
-	rest := []byte{}
-	for rest != nil {
-		block, rest := pem.Decode(rawData)
+	fingerprint, err := leafFingerprint(rawData)
+	if err != nil {
+		return err
+	}
+	e.hashes.setTLSKeyHash(fingerprint)
+	elog.Info("Set SHA-256 fingerprint of server's certificate.",
+		"fingerprint", fmt.Sprintf("%x", fingerprint[:]))
+	e.startup.markMet(appPrereqCert)
+	return nil
+}
+
+// leafFingerprint returns the SHA-256 fingerprint of the first non-CA
+// certificate in the given PEM-encoded data.
+func leafFingerprint(rawData []byte) ([sha256.Size]byte, error) {
+	for {
+		var block *pem.Block
+		block, rawData = pem.Decode(rawData)
 		if block == nil {
-			return errors.New("pem.Decode failed because it didn't find PEM data in the input we provided")
+			return [sha256.Size]byte{}, errors.New("pem.Decode failed because it didn't find PEM data in the input we provided")
 		}
-		if block.Type == "CERTIFICATE" {
-			cert, err := x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				return err
-			}
-			if !cert.IsCA {
-				e.hashes.tlsKeyHash = sha256.Sum256(cert.Raw)
-				elog.Printf("Set SHA-256 fingerprint of server's certificate to: %x",
-					e.hashes.tlsKeyHash[:])
-				return nil
-			}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		if !cert.IsCA {
+			return sha256.Sum256(cert.Raw), nil
 		}
-		rawData = rest
 	}
-	return nil
 }
 
 // getLeader returns the leader enclave's URL.
@@ -2,81 +2,196 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"sync"
 )
 
-// enclaveKeys holds key material for nitriding itself (the HTTPS certificate)
-// and for the enclave application (whatever the application wants to "store"
-// in nitriding).  These keys are meant to be managed by a leader enclave and --
-// if horizontal scaling is required -- synced to worker enclaves.  The struct
-// implements getters and setters that allow for thread-safe setting and getting
-// of members.
+// enclaveKeys holds key material for nitriding itself (the HTTPS certificate
+// and the Privacy Pass token key) and for the enclave application (whatever
+// the application wants to "store" in nitriding).  These keys are meant to be
+// managed by a leader enclave and -- if horizontal scaling is required --
+// synced to worker enclaves.  The struct implements getters and setters that
+// allow for thread-safe setting and getting of members.
+//
+// If the struct has a sealer, its members hold encrypted key material, and
+// the getters decrypt the key material transiently.  That way, a bug that
+// discloses (parts of) nitriding's memory doesn't disclose the plaintext key
+// material.  See newSealedKeys.
 type enclaveKeys struct {
 	sync.Mutex
 	NitridingKey  []byte `json:"nitriding_key"`
 	NitridingCert []byte `json:"nitriding_cert"`
 	AppKeys       []byte `json:"app_keys"`
+	TokenKey      []byte `json:"token_key"`
+	// sealer encrypts our key material at rest under an ephemeral key that
+	// never leaves nitriding's memory.
+	sealer cipher.AEAD
+}
+
+// newSealedKeys returns an empty enclaveKeys that encrypts its key material
+// at rest under a freshly generated AES-256-GCM key.
+func newSealedKeys() (*enclaveKeys, error) {
+	key := make([]byte, 32)
+	defer wipeBytes(key)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &enclaveKeys{sealer: aead}, nil
+}
+
+// seal returns the given key material as we store it.  If we have a sealer,
+// we encrypt the key material and wipe the plaintext.  Otherwise, we store the
+// key material as-is.  The caller must hold the lock.
+func (e *enclaveKeys) seal(plaintext []byte) []byte {
+	if e.sealer == nil || plaintext == nil {
+		return plaintext
+	}
+	defer wipeBytes(plaintext)
+
+	nonce := make([]byte, e.sealer.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		fatal("Failed to create nonce for sealing key material.", "error", err)
+	}
+	return e.sealer.Seal(nonce, nonce, plaintext, nil)
+}
+
+// open returns a plaintext copy of the given stored key material.  The caller
+// must hold the lock, and is responsible for wiping the copy.
+func (e *enclaveKeys) open(stored []byte) []byte {
+	if e.sealer == nil || stored == nil {
+		return bytes.Clone(stored)
+	}
+	n := e.sealer.NonceSize()
+	plaintext, err := e.sealer.Open(nil, stored[:n], stored[n:], nil)
+	if err != nil {
+		// Only memory corruption can get us here.
+		fatal("Failed to unseal key material.", "error", err)
+	}
+	return plaintext
 }
 
 func (e1 *enclaveKeys) equal(e2 *enclaveKeys) bool {
-	e1.Lock()
-	e2.Lock()
-	defer e1.Unlock()
-	defer e2.Unlock()
-
-	return bytes.Equal(e1.NitridingCert, e2.NitridingCert) &&
-		bytes.Equal(e1.NitridingKey, e2.NitridingKey) &&
-		bytes.Equal(e1.AppKeys, e2.AppKeys)
+	k1, k2 := e1.copy(), e2.copy()
+	defer k1.wipe()
+	defer k2.wipe()
+
+	return bytes.Equal(k1.NitridingCert, k2.NitridingCert) &&
+		bytes.Equal(k1.NitridingKey, k2.NitridingKey) &&
+		bytes.Equal(k1.AppKeys, k2.AppKeys) &&
+		bytes.Equal(k1.TokenKey, k2.TokenKey)
 }
 
+// setAppKeys sets the application keys, and takes ownership of the given
+// slice: if we seal our key material, we wipe the plaintext.
 func (e *enclaveKeys) setAppKeys(appKeys []byte) {
 	e.Lock()
 	defer e.Unlock()
 
-	e.AppKeys = appKeys
+	replaceKey(&e.AppKeys, e.seal(appKeys))
 }
 
+// setNitridingKeys sets nitriding's key and certificate, and takes ownership
+// of the given slices: if we seal our key material, we wipe the plaintext.
 func (e *enclaveKeys) setNitridingKeys(key, cert []byte) {
 	e.Lock()
 	defer e.Unlock()
 
-	e.NitridingKey = key
-	e.NitridingCert = cert
+	replaceKey(&e.NitridingKey, e.seal(key))
+	replaceKey(&e.NitridingCert, e.seal(cert))
+}
+
+// setTokenKey sets the Privacy Pass token key, and takes ownership of the
+// given slice: if we seal our key material, we wipe the plaintext.
+func (e *enclaveKeys) setTokenKey(tokenKey []byte) {
+	e.Lock()
+	defer e.Unlock()
+
+	replaceKey(&e.TokenKey, e.seal(tokenKey))
+}
+
+// replaceKey sets the given key to the given new key material, and wipes the
+// old key material unless it's shared with the new key material.
+func replaceKey(key *[]byte, newKey []byte) {
+	if len(*key) > 0 && (len(newKey) == 0 || &(*key)[0] != &newKey[0]) {
+		wipeBytes(*key)
+	}
+	*key = newKey
 }
 
+// set sets our key material to a copy of the given key material, which
+// remains intact.
 func (e *enclaveKeys) set(newKeys *enclaveKeys) {
-	e.setAppKeys(newKeys.AppKeys)
-	e.setNitridingKeys(newKeys.NitridingKey, newKeys.NitridingCert)
+	keys := newKeys.copy()
+	e.setAppKeys(keys.AppKeys)
+	e.setNitridingKeys(keys.NitridingKey, keys.NitridingCert)
+	e.setTokenKey(keys.TokenKey)
+}
+
+// wipe overwrites our key material with zeros before discarding it.
+func (e *enclaveKeys) wipe() {
+	e.Lock()
+	defer e.Unlock()
+
+	for _, key := range [][]byte{e.NitridingKey, e.NitridingCert, e.AppKeys, e.TokenKey} {
+		wipeBytes(key)
+	}
+	e.NitridingKey, e.NitridingCert, e.AppKeys, e.TokenKey = nil, nil, nil, nil
 }
 
+// copy returns a deep plaintext copy of our key material, which remains
+// intact when we later rotate or wipe our keys.  The caller is responsible
+// for wiping the copy.
 func (e *enclaveKeys) copy() *enclaveKeys {
 	e.Lock()
 	defer e.Unlock()
 
 	return &enclaveKeys{
-		NitridingKey:  e.NitridingKey,
-		NitridingCert: e.NitridingCert,
-		AppKeys:       e.AppKeys,
+		NitridingKey:  e.open(e.NitridingKey),
+		NitridingCert: e.open(e.NitridingCert),
+		AppKeys:       e.open(e.AppKeys),
+		TokenKey:      e.open(e.TokenKey),
 	}
 }
 
+// getAppKeys returns a plaintext copy of the application keys.  The caller is
+// responsible for wiping the copy.
 func (e *enclaveKeys) getAppKeys() []byte {
 	e.Lock()
 	defer e.Unlock()
 
-	return e.AppKeys
+	return e.open(e.AppKeys)
+}
+
+// getTokenKey returns a plaintext copy of the Privacy Pass token key.  The
+// caller is responsible for wiping the copy.
+func (e *enclaveKeys) getTokenKey() []byte {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.open(e.TokenKey)
 }
 
 // hashAndB64 returns the Base64-encoded hash over our key material.  The
 // resulting string is not confidential as it's impractical to reverse the key
 // material.
 func (e *enclaveKeys) hashAndB64() string {
-	e.Lock()
-	defer e.Unlock()
+	k := e.copy()
+	defer k.wipe()
 
-	keys := append(append(e.NitridingCert, e.NitridingKey...), e.AppKeys...)
+	keys := append(append(append(k.NitridingCert, k.NitridingKey...), k.AppKeys...), k.TokenKey...)
+	defer wipeBytes(keys)
 	hash := sha256.Sum256(keys)
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
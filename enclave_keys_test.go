@@ -82,3 +82,51 @@ func TestModifyCloneObject(t *testing.T) {
 		t.Fatal("Cloned object must not affect original object.")
 	}
 }
+
+func TestRotateKeysWipesOldKeys(t *testing.T) {
+	keys := newTestKeys(t)
+	oldAppKeys, oldKey := keys.AppKeys, keys.NitridingKey
+
+	keys.setAppKeys([]byte("NewAppKeys"))
+	keys.setNitridingKeys([]byte("NewKey"), []byte("NewCert"))
+	assertEqual(t, bytes.Count(oldAppKeys, []byte{0}), len(oldAppKeys))
+	assertEqual(t, bytes.Count(oldKey, []byte{0}), len(oldKey))
+
+	// Setting the same key material again must not wipe it.
+	keys.setAppKeys(keys.AppKeys)
+	assertEqual(t, string(keys.getAppKeys()), "NewAppKeys")
+}
+
+func TestCopiedKeysSurviveWipe(t *testing.T) {
+	keys := newTestKeys(t)
+	appKeys, clonedKeys := keys.getAppKeys(), keys.copy()
+
+	keys.wipe()
+	assertEqual(t, string(appKeys), "AppTestKeys")
+	assertEqual(t, string(clonedKeys.AppKeys), "AppTestKeys")
+}
+
+func TestSealedKeys(t *testing.T) {
+	keys, err := newSealedKeys()
+	failOnErr(t, err)
+	plainKeys := newTestKeys(t)
+
+	appKeys := []byte("AppTestKeys")
+	keys.setAppKeys(appKeys)
+	// The plaintext we handed over must be wiped, and must not be stored.
+	assertEqual(t, bytes.Count(appKeys, []byte{0}), len(appKeys))
+	assertEqual(t, bytes.Contains(keys.AppKeys, []byte("AppTestKeys")), false)
+	assertEqual(t, string(keys.getAppKeys()), "AppTestKeys")
+
+	// Setting sealed keys from plaintext keys must leave the latter intact.
+	keys.set(plainKeys)
+	assertEqual(t, bytes.Equal(keys.NitridingKey, plainKeys.NitridingKey), false)
+	assertEqual(t, keys.equal(plainKeys), true)
+	assertEqual(t, keys.hashAndB64(), plainKeys.hashAndB64())
+
+	clonedKeys := keys.copy()
+	assertEqual(t, bytes.Equal(clonedKeys.NitridingKey, plainKeys.NitridingKey), true)
+	keys.wipe()
+	assertEqual(t, keys.getAppKeys() == nil, true)
+	assertEqual(t, clonedKeys.equal(plainKeys), true)
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 var defaultCfg = Config{
@@ -48,12 +54,58 @@ func TestValidateConfig(t *testing.T) {
 
 	// Set the remaining required fields.
 	c.ExtPubPort = 1
-	c.ExtPrivPort = 1
-	c.IntPort = 1
+	c.ExtPrivPort = 2
+	c.IntPort = 3
 	c.HostProxyPort = 1
 	if err = c.Validate(); err != nil {
 		t.Fatalf("Validation of valid config returned an error.")
 	}
+
+	// All problems must be reported at once.
+	c.CompressLevel = 10
+	c.IntPort = c.ExtPrivPort
+	c.FdCur, c.FdMax = 2, 1
+	c.GID = 1000
+	c.AttestationPoWBits = maxPoWBits + 1
+	c.OverloadCPUPercent = 101
+	c.TapQueues = maxTapQueues + 1
+	c.TapSubnet = "192.168.127.0/31"
+	c.GoMemLimitPercent = 101
+	c.ACMETempCert = true
+	err = c.Validate()
+	for _, expected := range []error{errCfgBadCompress, errCfgPortConflict, errCfgBadFdLimit, errCfgGIDNoUID, errCfgBadPoW, errCfgBadOverload, errCfgBadTapQueues, errCfgBadTapSubnet, errCfgBadMemLimit, errCfgTempCertNoACME} {
+		if !errors.Is(err, expected) {
+			t.Fatalf("Expected error %v in %v.", expected, err)
+		}
+	}
+
+	// Setting only the user ID would keep root's group.
+	c.UID, c.GID = 1000, 0
+	if err = c.Validate(); !errors.Is(err, errCfgUIDNoGID) {
+		t.Fatalf("Expected error %v in %v.", errCfgUIDNoGID, err)
+	}
+}
+
+func TestHostPortConflicts(t *testing.T) {
+	c := &Config{HostProxyPort: 1024, LogVsockPort: 1025, HostHeartbeatPort: 1026}
+	assertEqual(t, len(c.checkPortConflicts()), 0)
+
+	// Host ports don't compete with TCP ports.
+	c.ExtPrivPort = 1024
+	assertEqual(t, len(c.checkPortConflicts()), 0)
+
+	c.CrashReportPort, c.HostTimePort = 1025, 1024
+	errs := c.checkPortConflicts()
+	assertEqual(t, len(errs), 2)
+	for _, err := range errs {
+		assertEqual(t, errors.Is(err, errCfgPortConflict), true)
+	}
+
+	// So does a vsock:// sealed state store, but an s3:// store doesn't.
+	c = &Config{HostProxyPort: 1024, SealedStateStore: "s3://1024"}
+	assertEqual(t, len(c.checkPortConflicts()), 0)
+	c.SealedStateStore = "vsock://1024"
+	assertEqual(t, len(c.checkPortConflicts()), 1)
 }
 
 func TestGenSelfSignedCert(t *testing.T) {
@@ -62,3 +114,98 @@ func TestGenSelfSignedCert(t *testing.T) {
 		t.Fatalf("Failed to create self-signed certificate: %s", err)
 	}
 }
+
+func TestTimeouts(t *testing.T) {
+	c := defaultCfg
+	e := createEnclave(&c)
+	for _, srv := range []*http.Server{e.extPubSrv, e.extPrivSrv, e.intSrv, e.promSrv} {
+		assertEqual(t, srv.ReadHeaderTimeout, defaultReadHeaderTimeout)
+		assertEqual(t, srv.ReadTimeout, defaultReadTimeout)
+		assertEqual(t, srv.WriteTimeout, defaultWriteTimeout)
+		assertEqual(t, srv.IdleTimeout, defaultIdleTimeout)
+	}
+
+	// Custom timeouts must take precedence over our defaults.
+	c = defaultCfg
+	c.ReadTimeout = time.Second
+	c.IdleTimeout = -1
+	e = createEnclave(&c)
+	assertEqual(t, e.extPubSrv.ReadTimeout, time.Second)
+	assertEqual(t, e.extPubSrv.IdleTimeout, time.Duration(-1))
+	assertEqual(t, e.extPubSrv.WriteTimeout, defaultWriteTimeout)
+}
+
+func TestStop(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	e.keys.set(newTestKeys(t))
+	appKeys := e.keys.AppKeys
+
+	if err := e.Stop(context.Background()); err != nil {
+		t.Fatalf("Failed to stop enclave: %v", err)
+	}
+	// Stopping the enclave again must not panic.
+	if err := e.Stop(context.Background()); err != nil {
+		t.Fatalf("Failed to stop enclave again: %v", err)
+	}
+
+	// Our key material must be gone, and overwritten with zeros.
+	assertEqual(t, e.keys.getAppKeys() == nil, true)
+	for _, b := range appKeys {
+		if b != 0 {
+			t.Fatal("Expected key material to be overwritten.")
+		}
+	}
+	if _, err := e.httpsCert.get(nil); err == nil {
+		t.Fatal("Expected certificate to be gone.")
+	}
+}
+
+func TestUse(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	addHeader := func(key string) func(http.Handler) http.Handler {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Custom", key)
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+	e.Use(addHeader("foo"))
+	e.Use(addHeader("bar"))
+
+	resp := makeReqToSrv(e.extPubSrv)(http.MethodGet, pathRoot, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, strings.Join(resp.Header.Values("X-Custom"), ","), "foo,bar")
+
+	// Adding middlewares after the first request must panic.
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected Use to panic after the first request.")
+		}
+	}()
+	e.Use(addHeader("baz"))
+}
+
+func TestPunycodeFQDN(t *testing.T) {
+	c := defaultCfg
+	c.FQDN = "Bücher.example"
+	e := createEnclave(&c)
+	assertEqual(t, e.cfg.FQDN, "xn--bcher-kva.example")
+
+	c.FQDN = "foo_bar.example"
+	if _, err := NewEnclave(&c); !errors.Is(err, errBadFQDN) {
+		t.Fatalf("Expected error %v but got %v.", errBadFQDN, err)
+	}
+}
+
+func TestWipeKeyMaterial(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	e.keys.set(newTestKeys(t))
+	key := e.keys.NitridingKey
+
+	e.WipeKeyMaterial()
+	assertEqual(t, e.keys.NitridingKey == nil, true)
+	assertEqual(t, bytes.Count(key, []byte{0}), len(key))
+	cert, err := e.httpsCert.get(nil)
+	assertEqual(t, cert == nil && err != nil, true)
+}
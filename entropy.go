@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultEntropyReseedInterval = time.Hour
+	// The number of random bytes that the entropy endpoint returns by
+	// default, and at most.
+	defaultEntropyLen = 32
+	maxEntropyLen     = 4096
+)
+
+var (
+	errNoRandomFromNSM = errors.New("got no random bytes from NSM")
+	errFailedEntropy   = errors.New("failed to obtain random bytes")
+	errBadEntropyLen   = fmt.Errorf("'size' parameter must be in interval [1, %d]", maxEntropyLen)
+)
+
+// reseedEntropy periodically mixes fresh random bytes from the NSM into the
+// system's entropy pool, until the enclave stops.  We seed the pool at boot,
+// but long-running enclaves benefit from fresh hardware entropy.
+func (e *Enclave) reseedEntropy(interval time.Duration) {
+	defer reportPanic()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			if err := seedEntropy(); err != nil {
+				elog.Warn("Failed to reseed entropy pool.", "error", err)
+				continue
+			}
+			elog.Debug("Reseeded entropy pool.")
+		}
+	}
+}
+
+// getRandom returns the given number of random bytes that the given function
+// produces in chunks.
+func getRandom(n int, chunk func() ([]byte, error)) ([]byte, error) {
+	random := make([]byte, 0, n)
+	for len(random) < n {
+		b, err := chunk()
+		if err != nil {
+			return nil, err
+		}
+		random = append(random, b[:min(len(b), n-len(random))]...)
+	}
+	return random, nil
+}
+
+// entropyHandler returns an HTTP handler that returns the number of random
+// bytes that the optional "size" URL parameter asks for.  Inside an enclave,
+// the bytes come straight from the NSM, so the enclave application doesn't
+// have to trust the kernel's random number generator.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func entropyHandler(chunk func() ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := defaultEntropyLen
+		if s := r.URL.Query().Get("size"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 1 || n > maxEntropyLen {
+				httpError(w, r, errBadEntropyLen, http.StatusBadRequest)
+				return
+			}
+		}
+		random, err := getRandom(n, chunk)
+		if err != nil {
+			elog.Error("Failed to obtain random bytes.", "error", err)
+			httpError(w, r, errFailedEntropy, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(random)
+	}
+}
+
+// cryptoRandom returns a chunk of random bytes from our cryptographically
+// secure random number generator.  We use it outside of enclaves, where we
+// have no NSM.
+func cryptoRandom() ([]byte, error) {
+	b := make([]byte, defaultEntropyLen)
+	if _, err := cryptoRead(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestGetRandom(t *testing.T) {
+	chunk := func() ([]byte, error) { return []byte{1, 2, 3}, nil }
+	random, err := getRandom(7, chunk)
+	failOnErr(t, err)
+	assertEqual(t, len(random), 7)
+	assertEqual(t, string(random), string([]byte{1, 2, 3, 1, 2, 3, 1}))
+
+	_, err = getRandom(1, func() ([]byte, error) { return nil, errNoRandomFromNSM })
+	assertEqual(t, errors.Is(err, errNoRandomFromNSM), true)
+}
+
+func TestEntropyHandler(t *testing.T) {
+	makeReq := makeReqToSrv(createEnclave(&defaultCfg).intSrv)
+
+	resp := makeReq(http.MethodGet, pathEntropy, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	body, err := io.ReadAll(resp.Body)
+	failOnErr(t, err)
+	assertEqual(t, len(body), defaultEntropyLen)
+
+	resp = makeReq(http.MethodGet, pathEntropy+"?size=1000", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	body, err = io.ReadAll(resp.Body)
+	failOnErr(t, err)
+	assertEqual(t, len(body), 1000)
+
+	for _, size := range []string{"0", "-1", "4097", "foo"} {
+		assertResponse(t,
+			makeReq(http.MethodGet, pathEntropy+"?size="+size, nil),
+			newErrResp(http.StatusBadRequest, errBadEntropyLen),
+		)
+	}
+}
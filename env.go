@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const envPrefix = "NITRIDING_"
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	urlType      = reflect.TypeOf(&url.URL{})
+	fileModeType = reflect.TypeOf(os.FileMode(0))
+)
+
+// snakeCase returns the given Config field name in lower snake case, e.g.,
+// "fqdn_leader" for "FQDNLeader".  Acronyms are kept in one piece.
+func snakeCase(field string) string {
+	var b strings.Builder
+	runes := []rune(field)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := !unicode.IsUpper(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// envName returns the name of the environment variable that corresponds to
+// the given Config field name, e.g., "NITRIDING_FQDN_LEADER" for
+// "FQDNLeader".
+func envName(field string) string {
+	return envPrefix + strings.ToUpper(snakeCase(field))
+}
+
+// setFromString parses the given string according to the type of the given
+// value and sets the value accordingly.
+func setFromString(v reflect.Value, s string) error {
+	switch v.Type() {
+	case durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case urlType:
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(u))
+		return nil
+	case fileModeType:
+		// File modes are conventionally written in octal, e.g., "0660".
+		m, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return err
+		}
+		v.SetUint(m)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported slice type %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(splitList(s)))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// applyEnv overrides the config's fields with the values of the corresponding
+// NITRIDING_* environment variables, which the given function looks up.  Each
+// field maps to the environment variable that's named after the field, in
+// upper snake case, e.g., ExtPubPort maps to NITRIDING_EXT_PUB_PORT.  Lists
+// are comma-separated and durations use Go's duration syntax, e.g., "30s".
+// Environment variables take precedence over values that were set
+// programmatically (or via command line flags).
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := envName(field.Name)
+		s, exists := lookupEnv(name)
+		if !exists {
+			continue
+		}
+		if err := setFromString(v.Field(i), s); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+	return nil
+}
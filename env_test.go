@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	cases := map[string]string{
+		"FQDN":               "NITRIDING_FQDN",
+		"FQDNLeader":         "NITRIDING_FQDN_LEADER",
+		"ExtPubPort":         "NITRIDING_EXT_PUB_PORT",
+		"UseACME":            "NITRIDING_USE_ACME",
+		"CORSAllowedOrigins": "NITRIDING_CORS_ALLOWED_ORIGINS",
+		"HSTSMaxAge":         "NITRIDING_HSTS_MAX_AGE",
+		"FdCur":              "NITRIDING_FD_CUR",
+	}
+	for field, expected := range cases {
+		assertEqual(t, envName(field), expected)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"NITRIDING_FQDN":                 "env.example.com",
+		"NITRIDING_EXT_PUB_PORT":         "8443",
+		"NITRIDING_DEBUG":                "false",
+		"NITRIDING_READ_TIMEOUT":         "5s",
+		"NITRIDING_CORS_ALLOWED_ORIGINS": "https://a.com, https://b.com",
+		"NITRIDING_APP_URL":              "https://github.com/foo/bar",
+		"NITRIDING_COMPRESS_LEVEL":       "-1",
+		"NITRIDING_GRPC_SOCKET_MODE":     "0600",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		v, exists := env[key]
+		return v, exists
+	}
+
+	c := defaultCfg
+	failOnErr(t, c.applyEnv(lookupEnv))
+	assertEqual(t, c.FQDN, "env.example.com")
+	assertEqual(t, c.ExtPubPort, uint16(8443))
+	assertEqual(t, c.Debug, false)
+	assertEqual(t, c.ReadTimeout, 5*time.Second)
+	assertEqual(t, strings.Join(c.CORSAllowedOrigins, "|"), "https://a.com|https://b.com")
+	assertEqual(t, c.AppURL.String(), "https://github.com/foo/bar")
+	assertEqual(t, c.CompressLevel, -1)
+	assertEqual(t, c.GRPCSocketMode, os.FileMode(0o600))
+	// Fields without environment variables must be left alone.
+	assertEqual(t, c.IntPort, defaultCfg.IntPort)
+
+	// Invalid values must result in an error.
+	env = map[string]string{"NITRIDING_EXT_PUB_PORT": "70000"}
+	c = defaultCfg
+	if err := c.applyEnv(lookupEnv); err == nil || !strings.Contains(err.Error(), "NITRIDING_EXT_PUB_PORT") {
+		t.Fatalf("Expected error for out-of-range port but got %v.", err)
+	}
+	env = map[string]string{"NITRIDING_DEBUG": "maybe"}
+	if err := c.applyEnv(lookupEnv); errors.Unwrap(err) == nil {
+		t.Fatalf("Expected wrapped error for invalid bool but got %v.", err)
+	}
+}
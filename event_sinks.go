@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// SQS accepts at most 10 messages and 256 KiB per batch.
+	maxSQSBatchLen  = 10
+	maxSQSBatchSize = 256 * 1024
+
+	maxKafkaBatchLen  = 500
+	maxKafkaBatchSize = 1024 * 1024
+	kafkaClientID     = "nitriding"
+	kafkaTimeout      = 10 * time.Second
+	// The maximum length of responses that we accept from Kafka brokers.
+	maxKafkaRespLen = 1024 * 1024
+)
+
+var (
+	errSQSFailed        = errors.New("SQS failed to accept messages")
+	errKafkaResponse    = errors.New("malformed Kafka response")
+	errKafkaNoPartition = errors.New("Kafka topic has no partition with a leader")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// sqsSink sends events to an Amazon SQS queue, using the EC2 host's instance
+// role.
+type sqsSink struct {
+	region   string
+	queueURL string
+}
+
+// newSQSSink returns a new sqsSink for the given queue.
+func newSQSSink(region, account, queue string) *sqsSink {
+	return &sqsSink{
+		region:   region,
+		queueURL: fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", region, account, queue),
+	}
+}
+
+func (s *sqsSink) limits() (int, int) {
+	return maxSQSBatchLen, maxSQSBatchSize
+}
+
+func (s *sqsSink) send(ctx context.Context, batch [][]byte) ([][]byte, error) {
+	type entry struct {
+		ID          string `json:"Id"`
+		MessageBody string
+	}
+	entries := make([]entry, len(batch))
+	for i, event := range batch {
+		entries[i] = entry{ID: strconv.Itoa(i), MessageBody: string(event)}
+	}
+	creds, err := getAWSCredentials(ctx)
+	if err != nil {
+		return batch, err
+	}
+	var resp struct {
+		Failed []struct {
+			ID          string `json:"Id"`
+			SenderFault bool
+			Code        string
+			Message     string
+		}
+	}
+	if err := callAWSJSON(ctx, creds, s.region, "sqs", "1.0", "AmazonSQS.SendMessageBatch",
+		map[string]any{"QueueUrl": s.queueURL, "Entries": entries}, &resp); err != nil {
+		return batch, err
+	}
+
+	// Retry messages that failed because of SQS, and drop those that SQS
+	// will never accept.
+	var retry [][]byte
+	for _, f := range resp.Failed {
+		i, err := strconv.Atoi(f.ID)
+		if err != nil || i < 0 || i >= len(batch) {
+			continue
+		}
+		if f.SenderFault {
+			ops.eventsDropped.Add(1)
+			elog.Warn("SQS rejected event.", "code", f.Code, "message", f.Message)
+			continue
+		}
+		retry = append(retry, batch[i])
+	}
+	if len(retry) > 0 {
+		return retry, fmt.Errorf("%w: %d of %d messages", errSQSFailed, len(retry), len(batch))
+	}
+	return nil, nil
+}
+
+// Kafka API keys and the versions of the requests that we send.  Version 3 of
+// Produce is the oldest that supports record batches (magic 2), which every
+// broker since Kafka 0.11 accepts.
+const (
+	kafkaAPIProduce      = 0
+	kafkaAPIMetadata     = 3
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 1
+)
+
+// kafkaSink sends events to a Kafka topic.  It looks up the topic's partition
+// leaders via the given bootstrap brokers, and spreads batches over the
+// partitions in a round-robin fashion.
+type kafkaSink struct {
+	sync.Mutex
+	brokers []string
+	topic   string
+	tls     *tls.Config // Nil if the brokers speak plaintext.
+	corrID  int32
+	next    int // The index of the partition that gets the next batch.
+}
+
+// newKafkaSink returns a new kafkaSink for the given brokers and topic.
+func newKafkaSink(brokers []string, topic string, useTLS bool) *kafkaSink {
+	s := &kafkaSink{brokers: brokers, topic: topic}
+	if useTLS {
+		s.tls = &tls.Config{MinVersion: tls.VersionTLS12, Time: currentTime}
+	}
+	return s
+}
+
+func (s *kafkaSink) limits() (int, int) {
+	return maxKafkaBatchLen, maxKafkaBatchSize
+}
+
+// kafkaEncoder appends values in Kafka's wire format.
+type kafkaEncoder []byte
+
+func (e *kafkaEncoder) int8(v int8)   { *e = append(*e, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { *e = binary.BigEndian.AppendUint16(*e, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { *e = binary.BigEndian.AppendUint32(*e, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { *e = binary.BigEndian.AppendUint64(*e, uint64(v)) }
+func (e *kafkaEncoder) str(s string) {
+	e.int16(int16(len(s)))
+	*e = append(*e, s...)
+}
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	*e = append(*e, b...)
+}
+
+// kafkaDecoder reads values in Kafka's wire format.  It remembers the first
+// error, so callers only need to check it at the end.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = errKafkaResponse
+		return make([]byte, max(n, 0))
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.next(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.next(4))) }
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.next(8))) }
+func (d *kafkaDecoder) str() string {
+	n := d.int16()
+	if n == -1 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// arrayLen returns the length of the array that follows, and guards against
+// lengths that exceed what's left of the response.
+func (d *kafkaDecoder) arrayLen() int {
+	n := int(d.int32())
+	if n < 0 || n > len(d.b) {
+		n = 0
+	}
+	return n
+}
+
+// recordBatch returns a record batch (magic 2) that contains the given
+// values, without keys or headers.
+func recordBatch(values [][]byte, now time.Time) []byte {
+	var records []byte
+	for i, v := range values {
+		var r []byte
+		r = append(r, 0)                     // Attributes.
+		r = binary.AppendVarint(r, 0)        // Timestamp delta.
+		r = binary.AppendVarint(r, int64(i)) // Offset delta.
+		r = binary.AppendVarint(r, -1)       // Key length.
+		r = binary.AppendVarint(r, int64(len(v)))
+		r = append(r, v...)
+		r = binary.AppendVarint(r, 0) // Headers.
+		records = binary.AppendVarint(records, int64(len(r)))
+		records = append(records, r...)
+	}
+
+	// The CRC covers everything from the attributes onwards.
+	var tail kafkaEncoder
+	tail.int16(0) // Attributes: no compression, no transaction.
+	tail.int32(int32(len(values) - 1))
+	tail.int64(now.UnixMilli())
+	tail.int64(now.UnixMilli())
+	tail.int64(-1) // Producer ID.
+	tail.int16(-1) // Producer epoch.
+	tail.int32(-1) // Base sequence.
+	tail.int32(int32(len(values)))
+	tail = append(tail, records...)
+
+	var b kafkaEncoder
+	b.int64(0)                            // Base offset.
+	b.int32(int32(4 + 1 + 4 + len(tail))) // Batch length.
+	b.int32(-1)                           // Partition leader epoch.
+	b.int8(2)                             // Magic.
+	b.int32(int32(crc32.Checksum(tail, crc32c)))
+	return append(b, tail...)
+}
+
+// kafkaConn is a connection to a Kafka broker.
+type kafkaConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dial connects to the given broker.
+func (s *kafkaSink) dial(ctx context.Context, addr string) (*kafkaConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.tls != nil {
+		cfg := s.tls.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return &kafkaConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// roundTrip sends the given request over the given connection, and returns
+// the response body.
+func (s *kafkaSink) roundTrip(c *kafkaConn, apiKey, version int16, body []byte) (*kafkaDecoder, error) {
+	s.Lock()
+	s.corrID++
+	corrID := s.corrID
+	s.Unlock()
+
+	var req kafkaEncoder
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(corrID)
+	req.str(kafkaClientID)
+	req = append(req, body...)
+	if _, err := c.Write(binary.BigEndian.AppendUint32(nil, uint32(len(req)))); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	var l [4]byte
+	if _, err := io.ReadFull(c.r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n < 4 || n > maxKafkaRespLen {
+		return nil, errKafkaResponse
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{b: resp}
+	if d.int32() != corrID {
+		return nil, fmt.Errorf("%w: unexpected correlation ID", errKafkaResponse)
+	}
+	return d, nil
+}
+
+// leaders returns the addresses of the leaders of our topic's partitions,
+// keyed by partition.
+func (s *kafkaSink) leaders(ctx context.Context) (map[int32]string, error) {
+	var errs []error
+	for _, addr := range s.brokers {
+		c, err := s.dial(ctx, addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var req kafkaEncoder
+		req.int32(1)
+		req.str(s.topic)
+		d, err := s.roundTrip(c, kafkaAPIMetadata, kafkaMetadataVersion, req)
+		c.Close()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		brokers := make(map[int32]string)
+		for i := d.arrayLen(); i > 0; i-- {
+			id, host, port := d.int32(), d.str(), d.int32()
+			d.str() // Rack.
+			brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		d.int32() // Controller ID.
+		leaders := make(map[int32]string)
+		for i := d.arrayLen(); i > 0; i-- {
+			topicErr, name := d.int16(), d.str()
+			d.next(1) // Is internal.
+			for j := d.arrayLen(); j > 0; j-- {
+				partErr, partition, leader := d.int16(), d.int32(), d.int32()
+				d.next(4 * d.arrayLen()) // Replicas.
+				d.next(4 * d.arrayLen()) // In-sync replicas.
+				if addr, ok := brokers[leader]; ok && name == s.topic && topicErr == 0 && partErr == 0 {
+					leaders[partition] = addr
+				}
+			}
+		}
+		if d.err != nil {
+			errs = append(errs, d.err)
+			continue
+		}
+		if len(leaders) == 0 {
+			return nil, errKafkaNoPartition
+		}
+		return leaders, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *kafkaSink) send(ctx context.Context, batch [][]byte) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, kafkaTimeout)
+	defer cancel()
+	leaders, err := s.leaders(ctx)
+	if err != nil {
+		return batch, err
+	}
+	partitions := make([]int32, 0, len(leaders))
+	for p := range leaders {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	s.Lock()
+	partition := partitions[s.next%len(partitions)]
+	s.next++
+	s.Unlock()
+
+	c, err := s.dial(ctx, leaders[partition])
+	if err != nil {
+		return batch, err
+	}
+	defer c.Close()
+	var req kafkaEncoder
+	req.int16(-1) // Transactional ID.
+	req.int16(-1) // Acks: wait for all in-sync replicas.
+	req.int32(int32(kafkaTimeout.Milliseconds()))
+	req.int32(1)
+	req.str(s.topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(recordBatch(batch, currentTime()))
+	d, err := s.roundTrip(c, kafkaAPIProduce, kafkaProduceVersion, req)
+	if err != nil {
+		return batch, err
+	}
+
+	var errCode int16
+	for i := d.arrayLen(); i > 0; i-- {
+		d.str() // Topic.
+		for j := d.arrayLen(); j > 0; j-- {
+			d.int32() // Partition.
+			if code := d.int16(); code != 0 {
+				errCode = code
+			}
+			d.int64() // Base offset.
+			d.int64() // Log append time.
+		}
+	}
+	if d.err != nil {
+		return batch, d.err
+	}
+	if errCode != 0 {
+		return batch, fmt.Errorf("%w: error code %d", errKafkaResponse, errCode)
+	}
+	return nil, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventSinkSQS   = "sqs"
+	eventSinkKafka = "kafka"
+
+	// maxEventLen is the maximum length of an event.  It's SQS's limit.
+	maxEventLen = 256 * 1024
+	// maxEventQueueLen is the number of events that we buffer while the sink
+	// is unreachable.  Once the queue is full, we reject new events.
+	maxEventQueueLen = 10000
+	// How long we wait for further events before we forward a partial batch.
+	eventFlushInterval = time.Second
+	eventSendTimeout   = 30 * time.Second
+	// The minimum and maximum delays between retries of failed batches.
+	minEventRetryDelay = time.Second
+	maxEventRetryDelay = time.Minute
+)
+
+var (
+	errCfgBadEventSink = errors.New("given config has invalid event sink")
+	errEventQueueFull  = errors.New("event queue is full")
+	errBadEvent        = errors.New("event is empty, too long, or not valid JSON")
+)
+
+// eventSink forwards batches of events to a message broker.  It returns the
+// events that it failed to forward and that we should retry.
+type eventSink interface {
+	send(ctx context.Context, batch [][]byte) ([][]byte, error)
+	// limits returns the maximum number of events per batch, and the maximum
+	// number of bytes.
+	limits() (int, int)
+}
+
+// parseEventSink parses the given event sink, which has the form
+// sqs://<region>/<account-id>/<queue-name> or
+// kafka://<broker>[,<broker>...]/<topic>[?tls=true].
+func parseEventSink(s string) (eventSink, error) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q lacks scheme", errCfgBadEventSink, s)
+	}
+	rest, query, _ := strings.Cut(rest, "?")
+	switch scheme {
+	case eventSinkSQS:
+		parts := strings.Split(rest, "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("%w: %q is not of the form sqs://<region>/<account-id>/<queue-name>", errCfgBadEventSink, s)
+		}
+		return newSQSSink(parts[0], parts[1], parts[2]), nil
+	case eventSinkKafka:
+		brokers, topic, ok := strings.Cut(rest, "/")
+		if !ok || brokers == "" || topic == "" {
+			return nil, fmt.Errorf("%w: %q is not of the form kafka://<broker>/<topic>", errCfgBadEventSink, s)
+		}
+		var addrs []string
+		for _, b := range strings.Split(brokers, ",") {
+			if _, _, err := net.SplitHostPort(b); err != nil {
+				return nil, fmt.Errorf("%w: bad Kafka broker %q", errCfgBadEventSink, b)
+			}
+			addrs = append(addrs, b)
+		}
+		var useTLS bool
+		switch query {
+		case "", "tls=false":
+		case "tls=true":
+			useTLS = true
+		default:
+			return nil, fmt.Errorf("%w: unsupported Kafka options %q", errCfgBadEventSink, query)
+		}
+		return newKafkaSink(addrs, topic, useTLS), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported scheme %q", errCfgBadEventSink, scheme)
+}
+
+// validateEvents returns an error if the config's event sink is invalid, or
+// if the config forwards audit events without an audit log or a sink.
+func (c *Config) validateEvents() error {
+	if c.EventAuditLog && (c.EventSink == "" || !c.AuditLog) {
+		return fmt.Errorf("%w: forwarding audit events requires an event sink and the audit log", errCfgBadEventSink)
+	}
+	if c.EventSink == "" {
+		return nil
+	}
+	_, err := parseEventSink(c.EventSink)
+	return err
+}
+
+// eventForwarder buffers events in memory and forwards them in batches to an
+// event sink, retrying with exponential backoff until the sink accepts them.
+// Events survive outages of the sink but not restarts of the enclave.
+type eventForwarder struct {
+	sync.Mutex
+	sink   eventSink
+	queue  [][]byte
+	notify chan struct{}
+}
+
+// newEventForwarder returns a new eventForwarder for the given sink.
+func newEventForwarder(sink eventSink) *eventForwarder {
+	return &eventForwarder{
+		sink:   sink,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// enqueue adds the given event to our queue.
+func (f *eventForwarder) enqueue(event []byte) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.queue) >= maxEventQueueLen {
+		ops.eventsDropped.Add(1)
+		return errEventQueueFull
+	}
+	f.queue = append(f.queue, event)
+	if maxEvents, _ := f.sink.limits(); len(f.queue) >= maxEvents {
+		select {
+		case f.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// nextBatch removes and returns the oldest events in our queue that fit into
+// a batch.
+func (f *eventForwarder) nextBatch() [][]byte {
+	f.Lock()
+	defer f.Unlock()
+
+	maxEvents, maxBytes := f.sink.limits()
+	var n, size int
+	for n < len(f.queue) && n < maxEvents && size+len(f.queue[n]) <= maxBytes {
+		size += len(f.queue[n])
+		n++
+	}
+	batch := f.queue[:n:n]
+	f.queue = f.queue[n:]
+	return batch
+}
+
+// requeue puts the given events back at the front of our queue.
+func (f *eventForwarder) requeue(events [][]byte) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.queue = append(events, f.queue...)
+}
+
+// flush forwards all queued events, and returns the first error that we
+// encounter.  Events that the sink failed to accept remain queued.
+func (f *eventForwarder) flush(ctx context.Context) error {
+	for {
+		batch := f.nextBatch()
+		if len(batch) == 0 {
+			return nil
+		}
+		ctx, span := startSpan(ctx, "events.send")
+		span.setAttr("events", fmt.Sprint(len(batch)))
+		retry, err := f.sink.send(ctx, batch)
+		span.setError(err)
+		span.end()
+		ops.eventsForwarded.Add(uint64(len(batch) - len(retry)))
+		if len(retry) > 0 {
+			f.requeue(retry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// run forwards events until the given channel is closed, at which point we
+// try one last time to forward what's left in our queue.  We forward partial
+// batches every eventFlushInterval, and full batches right away.
+func (f *eventForwarder) run(stop chan struct{}) {
+	defer reportPanic()
+	var delay time.Duration
+	for {
+		wait, notify := eventFlushInterval, f.notify
+		if delay > 0 {
+			// Don't let new events cut our backoff short.
+			wait, notify = delay, nil
+		}
+		select {
+		case <-stop:
+			ctx, cancel := context.WithTimeout(context.Background(), eventSendTimeout)
+			if err := f.flush(ctx); err != nil {
+				elog.Warn("Failed to forward remaining events.", "error", err)
+			}
+			cancel()
+			return
+		case <-notify:
+		case <-time.After(wait):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), eventSendTimeout)
+		err := f.flush(ctx)
+		cancel()
+		if err != nil {
+			delay = min(max(2*delay, minEventRetryDelay), maxEventRetryDelay)
+			elog.Warn("Failed to forward events; retrying.", "error", err, "delay", delay)
+		} else {
+			delay = 0
+		}
+	}
+}
+
+// eventHandler returns an HTTP handler that enqueues the JSON-encoded event
+// in the request body for forwarding.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func eventHandler(f *eventForwarder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event, err := io.ReadAll(newLimitReader(r.Body, maxEventLen))
+		if errors.Is(err, errTooMuchToRead) || isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
+			return
+		}
+		if len(event) == 0 || !json.Valid(event) {
+			httpError(w, r, errBadEvent, http.StatusBadRequest)
+			return
+		}
+		if err := f.enqueue(event); err != nil {
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// auditEvent wraps audit log entries that we forward as events, so consumers
+// can tell them apart from the enclave application's events.
+type auditEvent struct {
+	Type  string     `json:"type"`
+	Entry auditEntry `json:"entry"`
+}
+
+// forwardAudit returns a function that enqueues the given audit log entry.
+func (f *eventForwarder) forwardAudit() func(auditEntry) {
+	return func(entry auditEntry) {
+		// Marshalling a struct of strings, integers, and times cannot fail.
+		raw, _ := json.Marshal(&auditEvent{Type: "nitriding.audit", Entry: entry})
+		if err := f.enqueue(raw); err != nil {
+			elog.Warn("Failed to forward audit event.", "seq", entry.Seq, "error", err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEventSink records the batches that it receives, and fails the given
+// number of times before it accepts batches.
+type fakeEventSink struct {
+	sync.Mutex
+	batches   [][][]byte
+	failures  int
+	maxEvents int
+}
+
+func (s *fakeEventSink) limits() (int, int) { return s.maxEvents, 1024 }
+
+func (s *fakeEventSink) send(_ context.Context, batch [][]byte) ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return batch, errors.New("broker unavailable")
+	}
+	s.batches = append(s.batches, batch)
+	return nil, nil
+}
+
+func TestValidateEvents(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"disabled", Config{}, false},
+		{"sqs", Config{EventSink: "sqs://us-east-1/123456789012/events"}, false},
+		{"kafka", Config{EventSink: "kafka://b1:9092,b2:9092/events"}, false},
+		{"kafka over TLS", Config{EventSink: "kafka://b1:9094/events?tls=true"}, false},
+		{"audit", Config{EventSink: "sqs://us-east-1/123456789012/events", AuditLog: true, EventAuditLog: true}, false},
+		{"audit without audit log", Config{EventSink: "sqs://us-east-1/123456789012/events", EventAuditLog: true}, true},
+		{"audit without sink", Config{AuditLog: true, EventAuditLog: true}, true},
+		{"no scheme", Config{EventSink: "events"}, true},
+		{"bad scheme", Config{EventSink: "nats://localhost:4222/events"}, true},
+		{"bad queue", Config{EventSink: "sqs://us-east-1/events"}, true},
+		{"bad broker", Config{EventSink: "kafka://b1/events"}, true},
+		{"no topic", Config{EventSink: "kafka://b1:9092"}, true},
+		{"bad Kafka option", Config{EventSink: "kafka://b1:9092/events?sasl=plain"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.cfg.validateEvents()
+			assertEqual(t, err != nil, c.wantErr)
+			if err != nil {
+				assertEqual(t, errors.Is(err, errCfgBadEventSink), true)
+			}
+		})
+	}
+}
+
+func TestEventForwarder(t *testing.T) {
+	sink := &fakeEventSink{failures: 1, maxEvents: 2}
+	f := newEventForwarder(sink)
+	for _, e := range []string{`1`, `2`, `3`} {
+		failOnErr(t, f.enqueue([]byte(e)))
+	}
+
+	// The first attempt fails, so all events must remain queued, in order.
+	if err := f.flush(context.Background()); err == nil {
+		t.Fatal("Expected error from failing sink.")
+	}
+	assertEqual(t, len(f.queue), 3)
+	failOnErr(t, f.flush(context.Background()))
+	assertEqual(t, len(f.queue), 0)
+	assertEqual(t, len(sink.batches), 2)
+	assertEqual(t, string(bytes.Join(sink.batches[0], nil)), "12")
+	assertEqual(t, string(bytes.Join(sink.batches[1], nil)), "3")
+
+	// A full queue rejects new events.
+	for i := 0; i < maxEventQueueLen; i++ {
+		failOnErr(t, f.enqueue([]byte(`{}`)))
+	}
+	assertEqual(t, f.enqueue([]byte(`{}`)), errEventQueueFull)
+}
+
+func TestEventForwarderRun(t *testing.T) {
+	sink := &fakeEventSink{maxEvents: 2}
+	f := newEventForwarder(sink)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		f.run(stop)
+		close(done)
+	}()
+
+	// A full batch is forwarded right away, and the remaining event once we
+	// stop.
+	for _, e := range []string{`1`, `2`, `3`} {
+		failOnErr(t, f.enqueue([]byte(e)))
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		sink.Lock()
+		n := len(sink.batches)
+		sink.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Full batch wasn't forwarded.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+	assertEqual(t, len(sink.batches), 2)
+	assertEqual(t, len(f.queue), 0)
+}
+
+func TestEventHandler(t *testing.T) {
+	c := defaultCfg
+	c.AuditLog = true
+	c.EventSink = "sqs://us-east-1/123456789012/events"
+	c.EventAuditLog = true
+	e := createEnclave(&c)
+	makeReq := makeReqToSrv(e.intSrv)
+
+	resp := makeReq(http.MethodPost, pathEvents, strings.NewReader(`{"user":"alice","action":"login"}`))
+	assertEqual(t, resp.StatusCode, http.StatusAccepted)
+	assertResponse(t,
+		makeReq(http.MethodPost, pathEvents, strings.NewReader(`not JSON`)),
+		newErrResp(http.StatusBadRequest, errBadEvent),
+	)
+	assertResponse(t,
+		makeReq(http.MethodPost, pathEvents, bytes.NewReader(make([]byte, maxEventLen+1))),
+		newErrResp(http.StatusRequestEntityTooLarge, errBodyTooLarge),
+	)
+	assertEqual(t, len(e.events.queue), 1)
+
+	// Audit log entries must be forwarded too.
+	e.audit.record(auditSetConfig, callerSIGHUP, nil, http.StatusOK)
+	assertEqual(t, len(e.events.queue), 2)
+	var event auditEvent
+	failOnErr(t, json.Unmarshal(e.events.queue[1], &event))
+	assertEqual(t, event.Type, "nitriding.audit")
+	assertEqual(t, event.Entry.Operation, auditSetConfig)
+}
+
+func TestSQSSink(t *testing.T) {
+	mockAWS(t)
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), awsSigAlgorithm+" Credential=AKID/") ||
+			r.Header.Get("X-Amz-Target") != "AmazonSQS.SendMessageBatch" ||
+			r.Header.Get("Content-Type") != "application/x-amz-json-1.0" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var in struct {
+			QueueUrl string
+			Entries  []struct {
+				ID          string `json:"Id"`
+				MessageBody string
+			}
+		}
+		failOnErr(t, json.NewDecoder(r.Body).Decode(&in))
+		assertEqual(t, in.QueueUrl, "https://sqs.us-west-2.amazonaws.com/123456789012/events")
+		// We accept the first message, fail the second, and reject the
+		// third.
+		for _, e := range in.Entries[:1] {
+			got = append(got, e.MessageBody)
+		}
+		_, _ = w.Write([]byte(`{"Successful":[{"Id":"0"}],"Failed":[` +
+			`{"Id":"1","SenderFault":false,"Code":"InternalError"},` +
+			`{"Id":"2","SenderFault":true,"Code":"InvalidMessageContents"}]}`))
+	}))
+	defer srv.Close()
+	origEndpoint := awsEndpoint
+	awsEndpoint = func(service, region string) string { return srv.URL }
+	defer func() { awsEndpoint = origEndpoint }()
+
+	sink, err := parseEventSink("sqs://us-west-2/123456789012/events")
+	failOnErr(t, err)
+	retry, err := sink.send(context.Background(), [][]byte{[]byte(`1`), []byte(`2`), []byte(`3`)})
+	assertEqual(t, errors.Is(err, errSQSFailed), true)
+	assertEqual(t, len(retry), 1)
+	assertEqual(t, string(retry[0]), `2`)
+	assertEqual(t, strings.Join(got, ","), `1`)
+}
+
+// mockKafkaBroker runs a Kafka broker that serves the metadata of the given
+// topic -- with two partitions that it leads -- and records the values of the
+// record batches that it receives, after checking their CRC.
+func mockKafkaBroker(t *testing.T, topic string) (string, func() map[int32][]string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	failOnErr(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	host, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	var (
+		mu       sync.Mutex
+		received = make(map[int32][]string)
+	)
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			var l [4]byte
+			if _, err := io.ReadFull(conn, l[:]); err != nil {
+				return
+			}
+			req := make([]byte, binary.BigEndian.Uint32(l[:]))
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			d := &kafkaDecoder{b: req}
+			apiKey, _, corrID := d.int16(), d.int16(), d.int32()
+			d.str() // Client ID.
+
+			var resp kafkaEncoder
+			resp.int32(corrID)
+			switch apiKey {
+			case kafkaAPIMetadata:
+				resp.int32(1) // Brokers.
+				resp.int32(1)
+				resp.str(host)
+				resp.int32(int32(port))
+				resp.int16(-1)
+				resp.int32(1) // Controller ID.
+				resp.int32(1) // Topics.
+				resp.int16(0)
+				resp.str(topic)
+				resp.int8(0)
+				resp.int32(2) // Partitions.
+				for p := int32(0); p < 2; p++ {
+					resp.int16(0)
+					resp.int32(p)
+					resp.int32(1)
+					resp.int32(1)
+					resp.int32(1)
+					resp.int32(1)
+					resp.int32(1)
+				}
+			case kafkaAPIProduce:
+				d.int16() // Transactional ID.
+				d.int16() // Acks.
+				d.int32() // Timeout.
+				d.int32() // Topics.
+				gotTopic := d.str()
+				d.int32() // Partitions.
+				partition := d.int32()
+				batch := d.next(int(d.int32()))
+				errCode := int16(0)
+				if gotTopic != topic || len(batch) < 61 ||
+					binary.BigEndian.Uint32(batch[17:]) != crc32.Checksum(batch[21:], crc32c) {
+					errCode = 2 // CORRUPT_MESSAGE
+				} else {
+					records := batch[61:]
+					for len(records) > 0 {
+						n, k := binary.Varint(records)
+						rec := records[k : k+int(n)]
+						records = records[k+int(n):]
+						rec = rec[1:] // Attributes.
+						for i := 0; i < 3; i++ {
+							_, k := binary.Varint(rec)
+							rec = rec[k:]
+						}
+						vLen, k := binary.Varint(rec)
+						mu.Lock()
+						received[partition] = append(received[partition], string(rec[k:k+int(vLen)]))
+						mu.Unlock()
+					}
+				}
+				resp.int32(1)
+				resp.str(topic)
+				resp.int32(1)
+				resp.int32(partition)
+				resp.int16(errCode)
+				resp.int64(0)
+				resp.int64(-1)
+				resp.int32(0) // Throttle time.
+			}
+			out := binary.BigEndian.AppendUint32(nil, uint32(len(resp)))
+			if _, err := conn.Write(append(out, resp...)); err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l.Addr().String(), func() map[int32][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	addr, received := mockKafkaBroker(t, "events")
+	sink, err := parseEventSink("kafka://127.0.0.1:1," + addr + "/events")
+	failOnErr(t, err)
+
+	// The first broker is unreachable, so the sink must fall back to the
+	// second one.  Batches alternate between the two partitions.
+	retry, err := sink.send(context.Background(), [][]byte{[]byte(`{"n":1}`), []byte(`{"n":2}`)})
+	failOnErr(t, err)
+	assertEqual(t, len(retry), 0)
+	_, err = sink.send(context.Background(), [][]byte{[]byte(`{"n":3}`)})
+	failOnErr(t, err)
+	got := received()
+	assertEqual(t, strings.Join(got[0], ","), `{"n":1},{"n":2}`)
+	assertEqual(t, strings.Join(got[1], ","), `{"n":3}`)
+
+	// A topic without partitions must result in an error.
+	sink, err = parseEventSink("kafka://" + addr + "/unknown")
+	failOnErr(t, err)
+	retry, err = sink.send(context.Background(), [][]byte{[]byte(`{}`)})
+	assertEqual(t, errors.Is(err, errKafkaNoPartition), true)
+	assertEqual(t, len(retry), 1)
+}
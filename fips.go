@@ -0,0 +1,33 @@
+package main
+
+import "errors"
+
+const fipsOff = "off"
+
+var (
+	errCfgFIPS = errors.New("given config enables features that rely on cryptography outside the FIPS module")
+	errNoFIPS  = errors.New("FIPS mode required but nitriding's cryptography does not run on a FIPS-validated module")
+)
+
+// fipsMode returns the name of the FIPS-validated module that our
+// cryptography runs on, or "off".
+func fipsMode() string {
+	if fipsEnabled() {
+		return fipsModule
+	}
+	return fipsOff
+}
+
+// validateFIPS returns an error if the config requires FIPS mode but enables
+// features that use cryptography from golang.org/x/crypto, which is not part
+// of any FIPS-validated module: key synchronization uses NaCl's box, and both
+// provisioning and secret delivery use HPKE with ChaCha20Poly1305.
+func (c *Config) validateFIPS() error {
+	if !c.RequireFIPS {
+		return nil
+	}
+	if c.isScalingEnabled() || c.Provisioning || len(c.DeliveredSecrets) > 0 {
+		return errCfgFIPS
+	}
+	return nil
+}
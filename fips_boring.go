@@ -0,0 +1,20 @@
+//go:build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+	// Restrict TLS to FIPS-approved protocol versions, cipher suites, and
+	// curves.
+	_ "crypto/tls/fipsonly"
+)
+
+// fipsModule names the FIPS-validated cryptographic module that this build of
+// nitriding uses.
+const fipsModule = "boringcrypto"
+
+// fipsEnabled returns true if our cryptography runs on the FIPS-validated
+// module.
+func fipsEnabled() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,16 @@
+//go:build !boringcrypto && go1.24
+
+package main
+
+import "crypto/fips140"
+
+// fipsModule names the FIPS-validated cryptographic module that this build of
+// nitriding uses.
+const fipsModule = "fips140"
+
+// fipsEnabled returns true if our cryptography runs on the FIPS-validated
+// module.  That's the case if nitriding was built with GOFIPS140 set, or runs
+// with GODEBUG=fips140=on.
+func fipsEnabled() bool {
+	return fips140.Enabled()
+}
@@ -0,0 +1,13 @@
+//go:build !boringcrypto && !go1.24
+
+package main
+
+// fipsModule names the FIPS-validated cryptographic module that this build of
+// nitriding uses.  Toolchains before Go 1.24 have none.
+const fipsModule = ""
+
+// fipsEnabled returns true if our cryptography runs on the FIPS-validated
+// module.
+func fipsEnabled() bool {
+	return false
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateFIPS(t *testing.T) {
+	c := defaultCfg
+	c.RequireFIPS = true
+	failOnErr(t, c.validateFIPS())
+
+	c.Provisioning = true
+	assertEqual(t, errors.Is(c.validateFIPS(), errCfgFIPS), true)
+}
+
+func TestRequireFIPS(t *testing.T) {
+	c := defaultCfg
+	c.RequireFIPS = true
+	_, err := NewEnclave(&c)
+	if fipsEnabled() {
+		failOnErr(t, err)
+	} else {
+		assertEqual(t, errors.Is(err, errNoFIPS), true)
+	}
+}
+
+func TestFIPSMode(t *testing.T) {
+	if fipsEnabled() {
+		assertEqual(t, fipsMode(), fipsModule)
+	} else {
+		assertEqual(t, fipsMode(), fipsOff)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// grpcService is the fully-qualified name of the gRPC service that
+	// doc/internal.proto defines.
+	grpcService = "nitriding.v1.Internal"
+	// maxGRPCMsgLen is the maximum length of request messages that we
+	// accept, which is also gRPC's default.
+	maxGRPCMsgLen = 4 << 20
+	// defaultGRPCSocketMode lets the socket's owner and group connect to
+	// the socket.
+	defaultGRPCSocketMode os.FileMode = 0o660
+)
+
+// gRPC status codes, as defined in
+// https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+var (
+	errCfgBadGRPCSocket = errors.New("given config has invalid gRPC socket path")
+	errGRPCCompressed   = errors.New("compressed messages are not supported")
+	errGRPCMsgTooLarge  = errors.New("message too large")
+	errGRPCBadMsg       = errors.New("malformed message")
+	errGRPCNoMethod     = errors.New("unknown method")
+)
+
+// isAbstractSocket returns true if the given Unix socket path refers to
+// Linux's abstract socket namespace.
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// validateGRPC returns an error if the config's gRPC socket cannot be
+// created, or if the config restricts access to the socket in ways we
+// cannot enforce.
+func (c *Config) validateGRPC() error {
+	if c.GRPCSocket == "" {
+		return nil
+	}
+	if c.GRPCSocketMode&^os.ModePerm != 0 {
+		return fmt.Errorf("%w: mode %o has more than permission bits", errCfgBadGRPCSocket, c.GRPCSocketMode)
+	}
+	if (c.GRPCSocketUID == 0) != (c.GRPCSocketGID == 0) {
+		return fmt.Errorf("%w: owner requires both user and group ID", errCfgBadGRPCSocket)
+	}
+	if isAbstractSocket(c.GRPCSocket) {
+		if c.GRPCSocketMode != 0 || c.GRPCSocketUID != 0 {
+			return fmt.Errorf("%w: abstract sockets have no mode or owner", errCfgBadGRPCSocket)
+		}
+		return nil
+	}
+	dir := filepath.Dir(c.GRPCSocket)
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("%w: %v", errCfgBadGRPCSocket, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", errCfgBadGRPCSocket, dir)
+	}
+	return nil
+}
+
+// grpcMethod maps a method of our gRPC service to the enclave-internal HTTP
+// endpoint that implements it.
+type grpcMethod struct {
+	httpMethod string
+	path       string
+	// handler serves the HTTP request.  If nil, the request goes to our
+	// internal Web server's router.  Either way, the request is subject to
+	// the same middleware (authentication, access log, metrics) as REST
+	// requests.
+	handler http.Handler
+	// request translates the gRPC request message into the HTTP request's
+	// query string and body.
+	request func(msg []byte) (query string, body []byte, err error)
+	// response translates the HTTP response body into the gRPC response
+	// message.
+	response func(body []byte) ([]byte, error)
+}
+
+// grpcServer offers the enclave-internal API as a gRPC service, for
+// applications that prefer generated client stubs over hand-written HTTP
+// requests.  Rather than re-implementing the internal API, the server
+// translates each call into a request to the corresponding HTTP endpoint,
+// and the endpoint's response back into a gRPC response.  The server speaks
+// gRPC's HTTP/2 wire protocol without TLS, and encodes messages by hand, like
+// our SPIRE client.
+type grpcServer struct {
+	intSrv  http.Handler
+	methods map[string]*grpcMethod
+}
+
+// newGRPCServer returns a gRPC server for the given enclave's internal API.
+// Our internal Web server's routes must already be registered.
+func newGRPCServer(e *Enclave) *grpcServer {
+	// Our internal Web server doesn't serve attestation documents, so we call
+	// the handler directly, and ask for the raw CBOR-encoded document.  The
+	// handler sits behind our internal Web server's middleware, so it
+	// authenticates, logs, and measures calls like the router does.
+	attstn := attestationHandler(e.cfg.UseProfiling, e.hashes, nil, e.attester)
+	mux := e.intSrv.Handler.(*chi.Mux)
+	attest := chi.Chain(mux.Middlewares()...).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept", contentTypeCBOR)
+		attstn(w, r)
+	})
+	noMsg := func([]byte) (string, []byte, error) { return "", nil, nil }
+	emptyMsg := func([]byte) ([]byte, error) { return nil, nil }
+
+	s := &grpcServer{
+		intSrv:  e.intSrv.Handler,
+		methods: make(map[string]*grpcMethod),
+	}
+	s.register("Ready", &grpcMethod{
+		httpMethod: http.MethodGet,
+		path:       pathReady,
+		request:    noMsg,
+		response:   emptyMsg,
+	})
+	s.register("GetState", &grpcMethod{
+		httpMethod: http.MethodGet,
+		path:       pathState,
+		request:    noMsg,
+		response: func(body []byte) ([]byte, error) {
+			return protoAppendBytes(nil, 1, body), nil
+		},
+	})
+	s.register("PutState", &grpcMethod{
+		httpMethod: http.MethodPut,
+		path:       pathState,
+		request: func(msg []byte) (string, []byte, error) {
+			state, err := protoBytes(msg, 1)
+			return "", state, err
+		},
+		response: emptyMsg,
+	})
+	s.register("RegisterHash", &grpcMethod{
+		httpMethod: http.MethodPost,
+		path:       pathHash,
+		request: func(msg []byte) (string, []byte, error) {
+			hash, err := protoBytes(msg, 1)
+			return "", []byte(base64.StdEncoding.EncodeToString(hash)), err
+		},
+		response: emptyMsg,
+	})
+	s.register("Attest", &grpcMethod{
+		httpMethod: http.MethodGet,
+		path:       pathAttestation,
+		handler:    attest,
+		request: func(msg []byte) (string, []byte, error) {
+			n, err := protoBytes(msg, 1)
+			return fmt.Sprintf("nonce=%x", n), nil, err
+		},
+		response: func(body []byte) ([]byte, error) {
+			return protoAppendBytes(nil, 1, body), nil
+		},
+	})
+	s.register("AppendLog", &grpcMethod{
+		httpMethod: http.MethodPost,
+		path:       pathSealedLog,
+		request: func(msg []byte) (string, []byte, error) {
+			record, err := protoBytes(msg, 1)
+			return "", record, err
+		},
+		response: func(body []byte) ([]byte, error) {
+			var receipt sealedLogReceipt
+			if err := json.Unmarshal(body, &receipt); err != nil {
+				return nil, err
+			}
+			resp := binary.AppendUvarint([]byte{1<<3 | protoWireVarint}, receipt.Seq)
+			return protoAppendBytes(resp, 2, []byte(receipt.Hash)), nil
+		},
+	})
+	return s
+}
+
+// register adds the given method to our service.
+func (s *grpcServer) register(name string, m *grpcMethod) {
+	if m.handler == nil {
+		m.handler = s.intSrv
+	}
+	s.methods[fmt.Sprintf("/%s/%s", grpcService, name)] = m
+}
+
+// ServeHTTP implements the http.Handler interface.  It serves a single,
+// unary gRPC call.
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	m, ok := s.methods[r.URL.Path]
+	if !ok {
+		writeGRPCStatus(w, grpcUnimplemented, errGRPCNoMethod.Error())
+		return
+	}
+	msg, err := readGRPCMsg(r.Body)
+	if errors.Is(err, errGRPCCompressed) {
+		writeGRPCStatus(w, grpcUnimplemented, err.Error())
+		return
+	}
+	if errors.Is(err, errGRPCMsgTooLarge) {
+		writeGRPCStatus(w, grpcResourceExhausted, err.Error())
+		return
+	}
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	query, body, err := m.request(msg)
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	target := versioned(m.path)
+	if query != "" {
+		target += "?" + query
+	}
+	req, err := http.NewRequestWithContext(r.Context(), m.httpMethod, target, bytes.NewReader(body))
+	if err != nil {
+		writeGRPCStatus(w, grpcInternal, err.Error())
+		return
+	}
+	req.RemoteAddr = r.RemoteAddr
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	rec := newGRPCRecorder()
+	m.handler.ServeHTTP(rec, req)
+	if rec.status() != http.StatusOK {
+		writeGRPCStatus(w, grpcCode(rec.status()), httpErrorMessage(rec.status(), rec.body.Bytes()))
+		return
+	}
+
+	resp, err := m.response(rec.body.Bytes())
+	if err != nil {
+		writeGRPCStatus(w, grpcInternal, err.Error())
+		return
+	}
+	if _, err := w.Write(grpcFrame(resp)); err != nil {
+		elog.Error("Error writing gRPC response.", "error", err)
+		return
+	}
+	writeGRPCStatus(w, grpcOK, "")
+}
+
+// listen serves our gRPC service on the Unix socket at the given path until
+// the returned server is shut down.  We remove stale sockets that a previous
+// instance left behind.
+func (s *grpcServer) listen(c *Config) (*http.Server, error) {
+	path := c.GRPCSocket
+	abstract := isAbstractSocket(path)
+	if !abstract {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if !abstract {
+		if err := restrictSocket(c); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	srv := &http.Server{Handler: h2c.NewHandler(s, &http2.Server{})}
+	go func() {
+		defer reportPanic()
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("gRPC server error.", "error", err)
+		}
+	}()
+	return srv, nil
+}
+
+// restrictSocket sets the owner and permissions of the config's gRPC socket.
+// Unless the config names the socket's owner, the socket belongs to the user
+// and group that nitriding drops its privileges to.
+func restrictSocket(c *Config) error {
+	uid, gid := c.GRPCSocketUID, c.GRPCSocketGID
+	if uid == 0 {
+		uid, gid = c.UID, c.GID
+	}
+	if err := chownUnprivileged(c.GRPCSocket, uid, gid); err != nil {
+		return err
+	}
+	mode := c.GRPCSocketMode
+	if mode == 0 {
+		mode = defaultGRPCSocketMode
+	}
+	return os.Chmod(c.GRPCSocket, mode)
+}
+
+// readGRPCMsg reads a single, uncompressed, length-prefixed gRPC message from
+// the given reader.  Unlike readGRPCFrame, we tell apart the reasons for
+// rejecting a message, because our clients get to see them.
+func readGRPCMsg(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", errGRPCBadMsg, err)
+	}
+	if hdr[0] != 0 {
+		return nil, errGRPCCompressed
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxGRPCMsgLen {
+		return nil, errGRPCMsgTooLarge
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", errGRPCBadMsg, err)
+	}
+	return msg, nil
+}
+
+// writeGRPCStatus sets the trailers that conclude every gRPC response.
+func writeGRPCStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", fmt.Sprint(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(msg))
+	}
+}
+
+// grpcPercentEncode encodes the given status message as gRPC requires: all
+// bytes outside of printable ASCII, and the percent sign, are
+// percent-encoded.
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcCode returns the gRPC status code that best matches the given HTTP
+// status code of our internal API.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		// The endpoint is disabled in our configuration.
+		return grpcUnimplemented
+	case http.StatusGone:
+		return grpcFailedPrecondition
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusInternalServerError:
+		return grpcInternal
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	default:
+		return grpcUnknown
+	}
+}
+
+// httpErrorMessage returns the message of the given error response, which
+// is wrapped in our JSON error envelope if the endpoint provided a reason.
+func httpErrorMessage(status int, body []byte) string {
+	var resp errorResponse
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Message != "" {
+		return resp.Message
+	}
+	return http.StatusText(status)
+}
+
+// protoBytes returns the value of the length-delimited field with the given
+// number in the given protobuf message, or nil if the field is unset.  As in
+// protobuf, the last occurrence of a field wins.
+func protoBytes(msg []byte, num int) ([]byte, error) {
+	fields, err := protoDecode(msg)
+	if err != nil {
+		return nil, errGRPCBadMsg
+	}
+	var val []byte
+	for _, f := range fields {
+		if f.num == num {
+			val = f.bytes
+		}
+	}
+	return val, nil
+}
+
+// grpcRecorder is a minimal http.ResponseWriter that buffers the response of
+// the internal API's endpoints.
+type grpcRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newGRPCRecorder() *grpcRecorder {
+	return &grpcRecorder{header: make(http.Header)}
+}
+
+func (r *grpcRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *grpcRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *grpcRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+// status returns the response's status code.  Like net/http, we default to
+// 200 if the handler didn't set one.
+func (r *grpcRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestGRPCAbstractSocket(t *testing.T) {
+	c := defaultCfg
+	c.GRPCSocket = fmt.Sprintf("@nitriding-test-%d", os.Getpid())
+	failOnErr(t, c.validateGRPC())
+	call := grpcClient(t, createEnclave(&c))
+	assertEqual(t, call("Ready", "", nil).code, grpcOK)
+
+	// Abstract sockets don't show up in the file system.
+	if _, err := os.Stat(c.GRPCSocket); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file for abstract socket but got %v.", err)
+	}
+}
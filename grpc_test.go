@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+)
+
+// grpcResult is the outcome of a unary gRPC call.
+type grpcResult struct {
+	code int
+	msg  string
+	resp []byte
+}
+
+// grpcClient serves the given enclave's gRPC service on a Unix socket and
+// returns a function that makes unary calls to the service, with the given
+// bearer token unless it's empty.
+func grpcClient(t *testing.T, e *Enclave) func(method, token string, msg []byte) grpcResult {
+	t.Helper()
+	srv, err := e.grpc.listen(e.cfg)
+	failOnErr(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", e.cfg.GRPCSocket)
+		},
+	}}
+	return func(method, token string, msg []byte) grpcResult {
+		t.Helper()
+		body := bytes.NewReader(grpcFrame(msg))
+		req, err := http.NewRequest(http.MethodPost, "http://nitriding/"+grpcService+"/"+method, body)
+		failOnErr(t, err)
+		req.Header.Set("Content-Type", "application/grpc")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		failOnErr(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		failOnErr(t, err)
+
+		var r grpcResult
+		if len(raw) > 0 {
+			r.resp, err = readGRPCMsg(bytes.NewReader(raw))
+			failOnErr(t, err)
+		}
+		r.code, err = strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+		failOnErr(t, err)
+		r.msg = resp.Trailer.Get("Grpc-Message")
+		return r
+	}
+}
+
+func grpcCfg(t *testing.T) Config {
+	c := defaultCfg
+	c.GRPCSocket = filepath.Join(t.TempDir(), "grpc.sock")
+	return c
+}
+
+func TestGRPC(t *testing.T) {
+	c := grpcCfg(t)
+	c.SealedLogPort = 8006
+	e := createEnclave(&c)
+	call := grpcClient(t, e)
+
+	r := call("Ready", "", nil)
+	assertEqual(t, r.code, grpcOK)
+	r = call("Ready", "", nil)
+	assertEqual(t, r.code, grpcFailedPrecondition)
+	assertEqual(t, r.msg, errAlreadyReady.Error())
+
+	hash := sha256.Sum256([]byte("public key"))
+	r = call("RegisterHash", "", protoAppendBytes(nil, 1, hash[:]))
+	assertEqual(t, r.code, grpcOK)
+	assertEqual(t, e.hashes.appKeyHash, hash)
+	r = call("RegisterHash", "", protoAppendBytes(nil, 1, hash[:4]))
+	assertEqual(t, r.code, grpcInvalidArgument)
+	assertEqual(t, r.msg, errHashWrongSize.Error())
+
+	// Key synchronization is disabled.
+	r = call("GetState", "", nil)
+	assertEqual(t, r.code, grpcPermissionDenied)
+	assertEqual(t, r.msg, errKeySyncDisabled.Error())
+
+	r = call("Attest", "", protoAppendBytes(nil, 1, make([]byte, nonceLen)))
+	assertEqual(t, r.code, grpcOK)
+	doc, err := protoBytes(r.resp, 1)
+	failOnErr(t, err)
+	assertEqual(t, len(doc) > 0, true)
+	r = call("Attest", "", protoAppendBytes(nil, 1, []byte("short")))
+	assertEqual(t, r.code, grpcInvalidArgument)
+
+	r = call("AppendLog", "", protoAppendBytes(nil, 1, []byte("approved")))
+	assertEqual(t, r.code, grpcOK)
+	entry := shippedEntry(t, e.sealedLog.shipper)
+	hashField, err := protoBytes(r.resp, 2)
+	failOnErr(t, err)
+	assertEqual(t, string(hashField), entry.Hash)
+
+	r = call("Shutdown", "", nil)
+	assertEqual(t, r.code, grpcUnimplemented)
+}
+
+func TestGRPCAuth(t *testing.T) {
+	c := grpcCfg(t)
+	c.IntAuthToken = "secret"
+	call := grpcClient(t, createEnclave(&c))
+	nonce := protoAppendBytes(nil, 1, make([]byte, nonceLen))
+
+	for _, method := range []string{"Ready", "Attest"} {
+		assertEqual(t, call(method, "", nonce).code, grpcUnauthenticated)
+		assertEqual(t, call(method, "wrong", nonce).code, grpcUnauthenticated)
+		assertEqual(t, call(method, c.IntAuthToken, nonce).code, grpcOK)
+	}
+}
+
+func TestGRPCMiddleware(t *testing.T) {
+	c := grpcCfg(t)
+	c.PrometheusPort = 80
+	e := createEnclave(&c)
+	call := grpcClient(t, e)
+
+	// Attest bypasses our internal Web server's router, but not its
+	// middleware.
+	for _, m := range []struct{ method, path string }{
+		{"Ready", pathReady},
+		{"Attest", pathAttestation},
+	} {
+		assertEqual(t, call(m.method, "", protoAppendBytes(nil, 1, make([]byte, nonceLen))).code, grpcOK)
+		assertEqual(t, testutil.ToFloat64(e.metrics.reqs.WithLabelValues(
+			versioned(m.path),
+			http.MethodGet,
+			fmt.Sprint(http.StatusOK),
+			notAvailable),
+		), float64(1))
+	}
+}
+
+func TestGRPCSocketOwner(t *testing.T) {
+	skipUnlessRoot(t)
+	c := grpcCfg(t)
+	c.UID, c.GID = nobody, nobody
+	grpcClient(t, createEnclave(&c))
+	assertOwner(t, c.GRPCSocket, nobody, nobody)
+
+	// An explicit owner takes precedence.
+	c = grpcCfg(t)
+	c.UID, c.GID = nobody, nobody
+	c.GRPCSocketUID, c.GRPCSocketGID = 1000, 1000
+	grpcClient(t, createEnclave(&c))
+	assertOwner(t, c.GRPCSocket, 1000, 1000)
+}
+
+func TestGRPCSocketMode(t *testing.T) {
+	for mode, expected := range map[os.FileMode]os.FileMode{
+		0:     defaultGRPCSocketMode,
+		0o600: 0o600,
+	} {
+		c := grpcCfg(t)
+		c.GRPCSocketMode = mode
+		call := grpcClient(t, createEnclave(&c))
+		fi, err := os.Stat(c.GRPCSocket)
+		failOnErr(t, err)
+		assertEqual(t, fi.Mode().Perm(), expected)
+		assertEqual(t, call("Ready", "", nil).code, grpcOK)
+	}
+}
+
+func TestProtoBytes(t *testing.T) {
+	msg := binary.AppendUvarint([]byte{2<<3 | protoWireVarint}, 42)
+	msg = protoAppendBytes(msg, 1, []byte("foo"))
+	msg = protoAppendBytes(msg, 1, []byte("bar"))
+	val, err := protoBytes(msg, 1)
+	failOnErr(t, err)
+	assertEqual(t, string(val), "bar")
+	val, err = protoBytes(msg, 3)
+	failOnErr(t, err)
+	assertEqual(t, val == nil, true)
+
+	if _, err := protoBytes(msg[:len(msg)-1], 1); !errors.Is(err, errGRPCBadMsg) {
+		t.Fatalf("Expected error %v but got %v.", errGRPCBadMsg, err)
+	}
+	assertEqual(t, grpcPercentEncode("100% ok\n"), "100%25 ok%0A")
+}
+
+func TestValidateGRPC(t *testing.T) {
+	c := grpcCfg(t)
+	failOnErr(t, c.validateGRPC())
+	c.GRPCSocketMode, c.GRPCSocketUID, c.GRPCSocketGID = 0o600, 1000, 1000
+	failOnErr(t, c.validateGRPC())
+	c.GRPCSocket = "@nitriding"
+	c.GRPCSocketMode, c.GRPCSocketUID, c.GRPCSocketGID = 0, 0, 0
+	failOnErr(t, c.validateGRPC())
+
+	for _, mutate := range []func(*Config){
+		// The socket's directory doesn't exist.
+		func(c *Config) { c.GRPCSocket = filepath.Join(c.GRPCSocket, "grpc.sock") },
+		// The mode has more than permission bits.
+		func(c *Config) { c.GRPCSocketMode = os.ModeSetuid | 0o600 },
+		// The owner lacks a group.
+		func(c *Config) { c.GRPCSocketUID = 1000 },
+		// Abstract sockets have no mode or owner.
+		func(c *Config) { c.GRPCSocket, c.GRPCSocketMode = "@nitriding", 0o600 },
+		func(c *Config) { c.GRPCSocket, c.GRPCSocketUID, c.GRPCSocketGID = "@nitriding", 1000, 1000 },
+	} {
+		c := grpcCfg(t)
+		mutate(&c)
+		if err := c.validateGRPC(); !errors.Is(err, errCfgBadGRPCSocket) {
+			t.Fatalf("Expected error %v but got %v.", errCfgBadGRPCSocket, err)
+		}
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 const (
@@ -23,17 +26,66 @@ const (
 	maxHeartbeatBody = 44 + 255 + 128
 	// The HTML for the enclave's index page.
 	indexPage = "This host runs inside an AWS Nitro Enclave.\n"
+	// The media types that we support for attestation documents.
+	contentTypeText = "text/plain"
+	contentTypeHTML = "text/html"
+	contentTypeCBOR = "application/cbor"
+	contentTypeJSON = "application/json"
 )
 
 var (
+	// attestationTypes contains the media types in which we can return
+	// attestation documents.  The first type is our default.
+	attestationTypes = []string{contentTypeText, contentTypeCBOR, contentTypeJSON}
+
 	errFailedReqBody         = errors.New("failed to read request body")
+	errBodyTooLarge          = errors.New("request body too large")
 	errHashWrongSize         = errors.New("given hash is of invalid size")
 	errNoBase64              = errors.New("no Base64 given")
 	errDesignationInProgress = errors.New("leader designation in progress")
 	errEndpointGone          = errors.New("endpoint not meant to be used")
+	errAlreadyReady          = errors.New("application already signalled its readiness")
 	errKeySyncDisabled       = errors.New("key synchronization is disabled")
+	errNotFound              = errors.New("endpoint not found")
+	errMethodNotAllowed      = errors.New("method not allowed")
+	errNotAcceptable         = errors.New("none of the requested media types are supported")
 )
 
+// errorResponse is the JSON envelope of nitriding's error responses.  It
+// allows clients to handle failures programmatically.
+type errorResponse struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// httpError replies to the given request with the given error and HTTP
+// status code, wrapped in our JSON error envelope.
+func httpError(w http.ResponseWriter, r *http.Request, err error, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(&errorResponse{
+		Code:      code,
+		Message:   err.Error(),
+		RequestID: middleware.GetReqID(r.Context()),
+	}); err != nil {
+		elog.Error("Error encoding error response.", "error", err)
+	}
+}
+
+// notFoundHandler replies to requests for unknown paths with our JSON error
+// envelope.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	httpError(w, r, errNotFound, http.StatusNotFound)
+}
+
+// methodNotAllowedHandler replies to requests that use an unsupported HTTP
+// method with our JSON error envelope.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	httpError(w, r, errMethodNotAllowed, http.StatusMethodNotAllowed)
+}
+
 func errNo200(code int) error {
 	return fmt.Errorf("peer responded with HTTP code %d", code)
 }
@@ -48,11 +100,67 @@ func formatIndexPage(appURL *url.URL) string {
 	return page
 }
 
+// indexData holds the variables that custom index page templates can use.
+// We also return indexData to clients that ask for a JSON-encoded index page.
+type indexData struct {
+	FQDN            string          `json:"fqdn"`
+	AppURL          string          `json:"app_url,omitempty"`
+	PCRs            map[uint]string `json:"pcrs,omitempty"`
+	CertFingerprint string          `json:"cert_fingerprint"`
+}
+
+// newIndexData returns the variables of our index page.  The PCR values
+// remain unset if we're not running inside an enclave.
+func newIndexData(e *Enclave, pcrs map[uint][]byte) *indexData {
+	data := &indexData{
+		FQDN:            e.cfg.FQDN,
+		CertFingerprint: fmt.Sprintf("%x", e.hashes.getTLSKeyHash()),
+	}
+	if e.cfg.AppURL != nil {
+		data.AppURL = e.cfg.AppURL.String()
+	}
+	if len(pcrs) > 0 {
+		data.PCRs = make(map[uint]string, len(pcrs))
+		for pcr, value := range pcrs {
+			data.PCRs[pcr] = fmt.Sprintf("%x", value)
+		}
+	}
+	return data
+}
+
 // rootHandler returns a handler that informs the visitor that this host runs
-// inside an enclave.  This is useful for testing.
-func rootHandler(cfg *Config) http.HandlerFunc {
+// inside an enclave.  By default, the index page is plain text.  If the
+// enclave application provided a custom template, we render the template
+// instead.  Clients that prefer JSON get a machine-readable index.
+func rootHandler(e *Enclave) http.HandlerFunc {
+	var (
+		tmpl    *template.Template
+		offers  = []string{contentTypeText, contentTypeJSON}
+		getPCRs = cachedPCRs("index page")
+	)
+	if e.cfg.IndexTemplate != "" {
+		// Config.Validate made sure that the template parses.
+		tmpl = template.Must(template.New("index").Parse(e.cfg.IndexTemplate))
+		offers = []string{contentTypeHTML, contentTypeJSON}
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, formatIndexPage(cfg.AppURL))
+		w.Header().Add("Vary", "Accept")
+		switch negotiateContentType(r.Header.Get("Accept"), offers) {
+		case contentTypeJSON:
+			w.Header().Set("Content-Type", contentTypeJSON)
+			if err := json.NewEncoder(w).Encode(newIndexData(e, getPCRs())); err != nil {
+				elog.Error("Error encoding index page.", "error", err)
+			}
+		default:
+			if tmpl == nil {
+				fmt.Fprintln(w, formatIndexPage(e.cfg.AppURL))
+				return
+			}
+			w.Header().Set("Content-Type", contentTypeHTML+"; charset=utf-8")
+			if err := tmpl.Execute(w, newIndexData(e, getPCRs())); err != nil {
+				elog.Error("Error rendering index page template.", "error", err)
+			}
+		}
 	}
 }
 
@@ -65,21 +173,22 @@ func getStateHandler(getSyncState func() int, keys *enclaveKeys) http.HandlerFun
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch getSyncState() {
 		case noSync:
-			http.Error(w, errKeySyncDisabled.Error(), http.StatusForbidden)
+			httpError(w, r, errKeySyncDisabled, http.StatusForbidden)
 		case isLeader:
-			http.Error(w, errEndpointGone.Error(), http.StatusGone)
+			httpError(w, r, errEndpointGone, http.StatusGone)
 		case inProgress:
-			http.Error(w, errDesignationInProgress.Error(), http.StatusServiceUnavailable)
+			httpError(w, r, errDesignationInProgress, http.StatusServiceUnavailable)
 		case isWorker:
 			w.Header().Set("Content-Type", "application/octet-stream")
 			appKeys := keys.getAppKeys()
+			defer wipeBytes(appKeys)
 			n, err := w.Write(appKeys)
 			if err != nil {
-				elog.Fatalf("Error writing state to client: %v", err)
+				fatal("Error writing state to client.", "error", err)
 			}
 			expected := len(appKeys)
 			if n != expected {
-				elog.Fatalf("Only wrote %d out of %d-byte state to client.", n, expected)
+				fatal("Failed to write entire state to client.", "written", n, "expected", expected)
 			}
 		}
 	}
@@ -100,15 +209,19 @@ func putStateHandler(
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch getSyncState() {
 		case noSync:
-			http.Error(w, errKeySyncDisabled.Error(), http.StatusForbidden)
+			httpError(w, r, errKeySyncDisabled, http.StatusForbidden)
 		case isWorker:
-			http.Error(w, errEndpointGone.Error(), http.StatusGone)
+			httpError(w, r, errEndpointGone, http.StatusGone)
 		case inProgress:
-			http.Error(w, errDesignationInProgress.Error(), http.StatusServiceUnavailable)
+			httpError(w, r, errDesignationInProgress, http.StatusServiceUnavailable)
 		case isLeader:
 			keys, err := io.ReadAll(newLimitReader(r.Body, maxKeyMaterialLen))
+			if isBodyTooLarge(err) {
+				httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil {
-				http.Error(w, errFailedReqBody.Error(), http.StatusInternalServerError)
+				httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
 				return
 			}
 			enclaveKeys.setAppKeys(keys)
@@ -117,8 +230,8 @@ func putStateHandler(
 			// The leader's application keys have changed.  Re-synchronize the key
 			// material with all registered workers.  If synchronization fails for a
 			// given worker, unregister it.
-			elog.Printf("Application keys have changed.  Re-synchronizing with %d worker(s).",
-				workers.length())
+			elog.Info("Application keys have changed.  Re-synchronizing with workers.",
+				"workers", workers.length())
 			go workers.forAll(
 				func(worker *url.URL) {
 					if err := asLeader(enclaveKeys, a).syncWith(worker); err != nil {
@@ -144,84 +257,185 @@ func hashHandler(e *Enclave) http.HandlerFunc {
 		maxReadLen := base64.StdEncoding.EncodedLen(sha256.Size) + 1
 		body, err := io.ReadAll(newLimitReader(r.Body, maxReadLen))
 		if errors.Is(err, errTooMuchToRead) {
-			http.Error(w, errTooMuchToRead.Error(), http.StatusBadRequest)
+			httpError(w, r, errTooMuchToRead, http.StatusBadRequest)
+			return
+		}
+		if isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
 			return
 		}
 		if err != nil {
-			http.Error(w, errFailedReqBody.Error(), http.StatusInternalServerError)
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
+			return
 		}
 
 		keyHash, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
 		if err != nil {
-			http.Error(w, errNoBase64.Error(), http.StatusBadRequest)
+			httpError(w, r, errNoBase64, http.StatusBadRequest)
 			return
 		}
 
 		if len(keyHash) != sha256.Size {
-			http.Error(w, errHashWrongSize.Error(), http.StatusBadRequest)
+			httpError(w, r, errHashWrongSize, http.StatusBadRequest)
 			return
 		}
-		copy(e.hashes.appKeyHash[:], keyHash)
+		e.hashes.setAppKeyHash([sha256.Size]byte(keyHash))
 	}
 }
 
 // readyHandler returns an HTTP handler that lets the enclave application
-// signal that it's ready, instructing nitriding to start its Internet-facing
-// Web server.  We initially gate access to the Internet-facing API to avoid
-// the issuance of unexpected attestation documents that lack the application's
-// hash because the application couldn't register it in time.
+// signal that it's ready via the given function, instructing nitriding to
+// start its Internet-facing Web server.  We initially gate access to the
+// Internet-facing API to avoid the issuance of unexpected attestation
+// documents that lack the application's hash because the application couldn't
+// register it in time.
 //
 // This is an enclave-internal endpoint that can only be accessed by the
 // trusted enclave application.
-func readyHandler(ready chan struct{}) http.HandlerFunc {
-	var once sync.Once
+func readyHandler(signalReady func() bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		once.Do(func() {
-			close(ready)
-			w.WriteHeader(http.StatusOK)
-		})
-		w.WriteHeader(http.StatusGone)
+		if !signalReady() {
+			httpError(w, r, errAlreadyReady, http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
-// configHandler returns an HTTP handler that prints the enclave's
+// configHandler returns an HTTP handler that prints the enclave's current
 // configuration.
-func configHandler(cfg *Config) http.HandlerFunc {
+func configHandler(getCfg func() *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, cfg)
+		fmt.Fprintln(w, getCfg())
 	}
 }
 
-// attestationHandler takes as input a flag indicating if profiling is enabled
-// and an AttestationHashes struct, and returns a HandlerFunc.  If profiling is
-// enabled, we abort attestation because profiling leaks enclave-internal data.
-// The returned HandlerFunc expects a nonce in the URL query parameters and
-// subsequently asks its hypervisor for an attestation document that contains
-// both the nonce and the hashes in the given struct.  The resulting
-// Base64-encoded attestation document is then returned to the requester.
-func attestationHandler(useProfiling bool, hashes *AttestationHashes, a attester) http.HandlerFunc {
+// enclaveInfo holds information about the running nitriding instance, which
+// allows operators to confirm what's running behind a given hostname.
+type enclaveInfo struct {
+	Version         string       `json:"version"`
+	GitCommit       string       `json:"git_commit"`
+	StartTime       time.Time    `json:"start_time"`
+	Uptime          string       `json:"uptime"`
+	InEnclave       bool         `json:"in_enclave"`
+	FIPSMode        string       `json:"fips_mode"`
+	FQDN            string       `json:"fqdn"`
+	CertFingerprint string       `json:"cert_fingerprint"`
+	ConfigHash      string       `json:"config_hash"`
+	OnionAddress    string       `json:"onion_address,omitempty"`
+	RestartCount    uint64       `json:"restart_count,omitempty"`
+	Operations      *opsSnapshot `json:"operations"`
+}
+
+// infoHandler returns an HTTP handler that returns JSON-encoded information
+// about the running nitriding instance.
+func infoHandler(e *Enclave) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := enclaveInfo{
+			Version:         version,
+			GitCommit:       gitCommit,
+			StartTime:       e.startTime,
+			InEnclave:       inEnclave,
+			FIPSMode:        fipsMode(),
+			FQDN:            e.cfg.FQDN,
+			CertFingerprint: fmt.Sprintf("%x", e.hashes.getTLSKeyHash()),
+			ConfigHash:      fmt.Sprintf("%x", e.hashes.configHash[:]),
+			RestartCount:    e.hashes.restartCount(),
+			Operations:      ops.snapshot(),
+		}
+		if e.onion != nil {
+			info.OnionAddress = e.onion.address()
+		}
+		if !e.startTime.IsZero() {
+			info.Uptime = time.Since(e.startTime).Round(time.Second).String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&info); err != nil {
+			elog.Error("Error encoding enclave info.", "error", err)
+		}
+	}
+}
+
+// attestationResponse is the JSON wrapper around an attestation document that
+// we return if the client asks for JSON.
+type attestationResponse struct {
+	Document string `json:"document"`
+}
+
+// attestationEndpoint returns the handler of a public attestation endpoint
+// whose attestation documents contain the given public key, behind our
+// proof-of-work check.
+func (e *Enclave) attestationEndpoint(publicKey []byte) http.HandlerFunc {
+	return e.withPoW(attestationHandler(e.cfg.UseProfiling, e.hashes, publicKey, e.attester))
+}
+
+// attestationHandler takes as input a flag indicating if profiling is enabled,
+// an AttestationHashes struct, and an optional public key, and returns a
+// HandlerFunc.  If profiling is enabled, we abort attestation because
+// profiling leaks enclave-internal data.  The returned HandlerFunc expects a
+// nonce in the URL query parameters and subsequently asks its hypervisor for
+// an attestation document that contains the nonce, the hashes in the given
+// struct, and the public key.  The resulting attestation document is then
+// returned to the requester in the encoding that the requester asked for via
+// its Accept header: raw CBOR, a JSON wrapper, or -- by default --
+// Base64-encoded text.
+func attestationHandler(useProfiling bool, hashes *AttestationHashes, publicKey []byte, a attester) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if useProfiling {
-			http.Error(w, errProfilingSet.Error(), http.StatusServiceUnavailable)
+			httpError(w, r, errProfilingSet, http.StatusServiceUnavailable)
 			return
 		}
 
 		n, err := getNonceFromReq(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		// Figure out the encoding that the client wants before we bother the
+		// hypervisor.
+		contentType := negotiateContentType(r.Header.Get("Accept"), attestationTypes)
+		if contentType == "" {
+			httpError(w, r, errNotAcceptable, http.StatusNotAcceptable)
 			return
 		}
 
+		_, span := startSpan(r.Context(), "attestation.create")
 		rawDoc, err := a.createAttstn(&clientAuxInfo{
 			clientNonce:       n,
 			attestationHashes: hashes.Serialize(),
+			publicKey:         publicKey,
 		})
+		span.setError(err)
+		span.end()
 		if err != nil {
-			http.Error(w, errFailedAttestation.Error(), http.StatusInternalServerError)
+			ops.attestationErrors.Add(1)
+			httpError(w, r, errFailedAttestation, http.StatusInternalServerError)
 			return
 		}
-		b64Doc := base64.StdEncoding.EncodeToString(rawDoc)
-		fmt.Fprintln(w, b64Doc)
+
+		ops.attestations.Add(1)
+		writeAttstn(w, contentType, rawDoc)
+	}
+}
+
+// writeAttstn writes the given raw attestation document to the client, in the
+// given encoding.
+func writeAttstn(w http.ResponseWriter, contentType string, rawDoc []byte) {
+	var err error
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	b64Doc := base64.StdEncoding.EncodeToString(rawDoc)
+	switch contentType {
+	case contentTypeCBOR:
+		_, err = w.Write(rawDoc)
+	case contentTypeJSON:
+		err = json.NewEncoder(w).Encode(&attestationResponse{Document: b64Doc})
+	default:
+		_, err = fmt.Fprintln(w, b64Doc)
+	}
+	if err != nil {
+		elog.Error("Error writing attestation document to client.", "error", err)
 	}
 }
 
@@ -237,24 +451,28 @@ func heartbeatHandler(e *Enclave) http.HandlerFunc {
 		)
 
 		body, err := io.ReadAll(newLimitReader(r.Body, maxHeartbeatBody))
+		if isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil {
-			http.Error(w, errFailedReqBody.Error(), http.StatusInternalServerError)
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
 			return
 		}
 		if err := json.Unmarshal(body, &hb); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			httpError(w, r, err, http.StatusBadRequest)
 			return
 		}
 		worker, err := e.getWorker(&hb)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
-		elog.Printf("Heartbeat from worker %s.", worker.Host)
+		elog.Debug("Heartbeat from worker.", "worker", worker.Host)
 		ourKeysHash, theirKeysHash := e.keys.hashAndB64(), hb.HashedKeys
 		if ourKeysHash != theirKeysHash {
-			elog.Printf("Worker's keys are invalid.  Re-synchronizing.")
+			elog.Info("Worker's keys are invalid.  Re-synchronizing.", "worker", worker.Host)
 			go syncAndRegister(e.keys, worker)
 		} else {
 			e.workers.register(worker)
@@ -271,11 +489,11 @@ func getLeaderHandler(ourNonce nonce, weAreLeader chan struct{}) http.HandlerFun
 		)
 		theirNonce, err = getNonceFromReq(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			httpError(w, r, err, http.StatusBadRequest)
 			return
 		}
 
-		if ourNonce == theirNonce {
+		if ourNonce.equal(theirNonce) {
 			if len(weAreLeader) == 0 {
 				weAreLeader <- struct{}{}
 			}
@@ -285,7 +503,7 @@ func getLeaderHandler(ourNonce nonce, weAreLeader chan struct{}) http.HandlerFun
 			//    endpoint.
 			// 2. We're a worker and some other entity in the private network is
 			//    talking to this endpoint.  That shouldn't happen.
-			elog.Println("Received nonce that does not match our own.")
+			elog.Warn("Received nonce that does not match our own.")
 		}
 		w.WriteHeader(http.StatusOK)
 	}
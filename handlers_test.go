@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
@@ -46,6 +47,13 @@ func newResp(status int, body string) *http.Response {
 	}
 }
 
+// newErrResp is a helper function that creates an HTTP response whose body
+// contains the given error in our JSON error envelope.
+func newErrResp(status int, err error) *http.Response {
+	body, _ := json.Marshal(&errorResponse{Code: status, Message: err.Error()})
+	return newResp(status, string(body))
+}
+
 func retState(state int) func() int {
 	return func() int {
 		return state
@@ -92,6 +100,12 @@ func assertResponse(t *testing.T, actual, expected *http.Response) {
 	if len(actualBody) > 0 && actualBody[len(actualBody)-1] == '\n' {
 		actualBody = actualBody[:len(actualBody)-1]
 	}
+	// Request IDs are random, so we remove them from error responses.
+	var errResp errorResponse
+	if json.Unmarshal(actualBody, &errResp) == nil && errResp.RequestID != "" {
+		errResp.RequestID = ""
+		actualBody, _ = json.Marshal(&errResp)
+	}
 	if !bytes.Equal(expectedBody, actualBody) {
 		t.Fatalf("expected HTTP body\n%q\nbut got\n%q", string(expectedBody), string(actualBody))
 	}
@@ -106,6 +120,39 @@ func TestRootHandler(t *testing.T) {
 	)
 }
 
+func TestRootHandlerTemplate(t *testing.T) {
+	c := defaultCfg
+	c.AppURL, _ = url.Parse("https://github.com/foo/bar")
+	c.IndexTemplate = `<h1>{{.FQDN}}</h1><a href="{{.AppURL}}">code</a>`
+	srv := createEnclave(&c).extPubSrv
+	makeReq := func(accept string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, pathRoot, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	resp := makeReq("text/html,*/*;q=0.8")
+	assertEqual(t, resp.Header.Get("Content-Type"), "text/html; charset=utf-8")
+	assertResponse(t, resp, newResp(http.StatusOK,
+		fmt.Sprintf(`<h1>%s</h1><a href="%s">code</a>`, c.FQDN, c.AppURL)))
+
+	// Clients that prefer JSON get a machine-readable index.
+	var data indexData
+	resp = makeReq("application/json")
+	assertEqual(t, resp.Header.Get("Content-Type"), "application/json")
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&data))
+	assertEqual(t, data.FQDN, c.FQDN)
+	assertEqual(t, data.AppURL, c.AppURL.String())
+
+	// Invalid templates must be rejected.
+	c.IndexTemplate = "{{.FQDN"
+	if err := c.Validate(); !errors.Is(err, errCfgBadTemplate) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadTemplate, err)
+	}
+}
+
 // signalReady signals to the enclave-internal Web server that we're ready,
 // instructing it to spin up its Internet-facing Web server.
 func signalReady(t *testing.T, e *Enclave) {
@@ -130,13 +177,13 @@ func TestGetStateHandler(t *testing.T) {
 	makeReq := makeReqToHandler(getStateHandler(retState(noSync), keys))
 	assertResponse(t,
 		makeReq(http.MethodGet, pathState, nil),
-		newResp(http.StatusForbidden, errKeySyncDisabled.Error()),
+		newErrResp(http.StatusForbidden, errKeySyncDisabled),
 	)
 
 	makeReq = makeReqToHandler(getStateHandler(retState(isLeader), keys))
 	assertResponse(t,
 		makeReq(http.MethodGet, pathState, nil),
-		newResp(http.StatusGone, errEndpointGone.Error()),
+		newErrResp(http.StatusGone, errEndpointGone),
 	)
 
 	makeReq = makeReqToHandler(getStateHandler(retState(isWorker), keys))
@@ -148,7 +195,7 @@ func TestGetStateHandler(t *testing.T) {
 	makeReq = makeReqToHandler(getStateHandler(retState(inProgress), keys))
 	assertResponse(t,
 		makeReq(http.MethodGet, pathState, nil),
-		newResp(http.StatusServiceUnavailable, errDesignationInProgress.Error()),
+		newErrResp(http.StatusServiceUnavailable, errDesignationInProgress),
 	)
 }
 
@@ -167,25 +214,25 @@ func TestPutStateHandler(t *testing.T) {
 	makeReq := makeReqToHandler(putStateHandler(a, retState(noSync), keys, workers))
 	assertResponse(t,
 		makeReq(http.MethodPut, pathState, strings.NewReader("appKeys")),
-		newResp(http.StatusForbidden, errKeySyncDisabled.Error()),
+		newErrResp(http.StatusForbidden, errKeySyncDisabled),
 	)
 
 	makeReq = makeReqToHandler(putStateHandler(a, retState(isWorker), keys, workers))
 	assertResponse(t,
 		makeReq(http.MethodPut, pathState, strings.NewReader("appKeys")),
-		newResp(http.StatusGone, errEndpointGone.Error()),
+		newErrResp(http.StatusGone, errEndpointGone),
 	)
 
 	makeReq = makeReqToHandler(putStateHandler(a, retState(inProgress), keys, workers))
 	assertResponse(t,
 		makeReq(http.MethodPut, pathState, strings.NewReader("appKeys")),
-		newResp(http.StatusServiceUnavailable, errDesignationInProgress.Error()),
+		newErrResp(http.StatusServiceUnavailable, errDesignationInProgress),
 	)
 
 	makeReq = makeReqToHandler(putStateHandler(a, retState(isLeader), keys, workers))
 	assertResponse(t,
 		makeReq(http.MethodPut, pathState, bytes.NewReader(tooLargeKey)),
-		newResp(http.StatusInternalServerError, errFailedReqBody.Error()),
+		newErrResp(http.StatusInternalServerError, errFailedReqBody),
 	)
 	assertResponse(t,
 		makeReq(http.MethodPut, pathState, bytes.NewReader(almostTooLargeKey)),
@@ -242,7 +289,7 @@ func TestProxyHandler(t *testing.T) {
 	if err := e.Start(); err != nil {
 		t.Fatal(err)
 	}
-	defer e.Stop() //nolint:errcheck
+	defer e.Stop(context.Background()) //nolint:errcheck
 	signalReady(t, e)
 
 	// Skip certificate validation because we are using a self-signed
@@ -266,6 +313,29 @@ func TestProxyHandler(t *testing.T) {
 	assertResponse(t, resp, newResp(http.StatusOK, appPage))
 }
 
+func TestProxyWithoutTimeouts(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer app.Close()
+
+	c := defaultCfg
+	c.AppWebSrv, _ = url.Parse(app.URL)
+	c.ReadTimeout, c.WriteTimeout = 10*time.Millisecond, 10*time.Millisecond
+	e := createEnclave(&c)
+	srv := httptest.NewUnstartedServer(e.extPubSrv.Handler)
+	c.setTimeouts(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	// The application's response takes longer than our write timeout, which
+	// must not apply to proxied requests.
+	resp, err := http.Get(srv.URL + "/foo/bar")
+	failOnErr(t, err)
+	assertResponse(t, resp, newResp(http.StatusOK, "slow"))
+}
+
 func TestHashHandler(t *testing.T) {
 	validHash := [sha256.Size]byte{}
 	validHashB64 := base64.StdEncoding.EncodeToString(validHash[:])
@@ -275,20 +345,20 @@ func TestHashHandler(t *testing.T) {
 	// Send invalid Base64.
 	assertResponse(t,
 		makeReq(http.MethodPost, pathHash, bytes.NewBufferString("foo")),
-		newResp(http.StatusBadRequest, errNoBase64.Error()),
+		newErrResp(http.StatusBadRequest, errNoBase64),
 	)
 
 	// Send invalid hash size.
 	assertResponse(t,
 		makeReq(http.MethodPost, pathHash, bytes.NewBufferString("AAAAAAAAAAAAAA==")),
-		newResp(http.StatusBadRequest, errHashWrongSize.Error()),
+		newErrResp(http.StatusBadRequest, errHashWrongSize),
 	)
 
 	// Send too much data.
 	s := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
 	assertResponse(t,
 		makeReq(http.MethodPost, pathHash, bytes.NewBufferString(s)),
-		newResp(http.StatusBadRequest, errTooMuchToRead.Error()),
+		newErrResp(http.StatusBadRequest, errTooMuchToRead),
 	)
 
 	// Finally, send a valid, Base64-encoded SHA-256 hash.
@@ -316,7 +386,7 @@ func TestReadiness(t *testing.T) {
 	if err := e.Start(); err != nil {
 		t.Fatal(err)
 	}
-	defer e.Stop() //nolint:errcheck
+	defer e.Stop(context.Background()) //nolint:errcheck
 
 	nitridingSrv := fmt.Sprintf("https://127.0.0.1:%d", e.cfg.ExtPubPort)
 	u := nitridingSrv + pathRoot
@@ -352,7 +422,7 @@ func TestReadinessWithWaitForUp(t *testing.T) {
 	if err := e.Start(); err != nil {
 		t.Fatal(err)
 	}
-	defer e.Stop() //nolint:errcheck
+	defer e.Stop(context.Background()) //nolint:errcheck
 
 	// Check if the Internet-facing Web server is running.
 	nitridingSrv := fmt.Sprintf("https://127.0.0.1:%d", e.cfg.ExtPubPort)
@@ -383,7 +453,8 @@ func TestReadyHandler(t *testing.T) {
 		<-ready
 	}()
 
-	makeReq := makeReqToHandler(readyHandler(ready))
+	e := &Enclave{ready: ready}
+	makeReq := makeReqToHandler(readyHandler(e.signalReady))
 	assertResponse(t,
 		makeReq(http.MethodGet, pathReady, nil),
 		newResp(http.StatusOK, ""),
@@ -393,7 +464,7 @@ func TestReadyHandler(t *testing.T) {
 	// Subsequent calls should return 410 Gone.
 	assertResponse(t,
 		makeReq(http.MethodGet, pathReady, nil),
-		newResp(http.StatusGone, ""),
+		newErrResp(http.StatusGone, errAlreadyReady),
 	)
 }
 
@@ -405,7 +476,7 @@ func TestAttestationHandlerWhileProfiling(t *testing.T) {
 	// Ensure that the attestation handler aborts if profiling is enabled.
 	assertResponse(t,
 		makeReq(http.MethodGet, pathAttestation, nil),
-		newResp(http.StatusServiceUnavailable, errProfilingSet.Error()),
+		newErrResp(http.StatusServiceUnavailable, errProfilingSet),
 	)
 }
 
@@ -421,12 +492,12 @@ func TestAttestationHandler(t *testing.T) {
 
 	assertResponse(t,
 		makeReq(http.MethodGet, pathAttestation, nil),
-		newResp(http.StatusBadRequest, errNoNonce.Error()),
+		newErrResp(http.StatusBadRequest, errNoNonce),
 	)
 
 	assertResponse(t,
 		makeReq(http.MethodGet, pathAttestation+"?nonce=foobar", nil),
-		newResp(http.StatusBadRequest, errBadNonceFormat.Error()),
+		newErrResp(http.StatusBadRequest, errBadNonceFormat),
 	)
 
 	// If we are not inside an enclave, attestation is going to result in an
@@ -434,11 +505,54 @@ func TestAttestationHandler(t *testing.T) {
 	if !inEnclave {
 		assertResponse(t,
 			makeReq(http.MethodGet, pathAttestation+"?nonce=0000000000000000000000000000000000000000", nil),
-			newResp(http.StatusInternalServerError, errFailedAttestation.Error()),
+			newErrResp(http.StatusInternalServerError, errFailedAttestation),
 		)
 	}
 }
 
+func TestAttestationEncoding(t *testing.T) {
+	var (
+		hashes = new(AttestationHashes)
+		a      = &dummyAttester{}
+		h      = attestationHandler(false, hashes, nil, a)
+		path   = pathAttestation + "?nonce=0000000000000000000000000000000000000000"
+	)
+	rawDoc, err := a.createAttstn(&clientAuxInfo{attestationHashes: hashes.Serialize()})
+	failOnErr(t, err)
+	b64Doc := base64.StdEncoding.EncodeToString(rawDoc)
+	jsonDoc, err := json.Marshal(&attestationResponse{Document: b64Doc})
+	failOnErr(t, err)
+
+	cases := []struct {
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"", http.StatusOK, contentTypeText, b64Doc + "\n"},
+		{"*/*", http.StatusOK, contentTypeText, b64Doc + "\n"},
+		{contentTypeCBOR, http.StatusOK, contentTypeCBOR, string(rawDoc)},
+		{contentTypeJSON, http.StatusOK, contentTypeJSON, string(jsonDoc) + "\n"},
+		{"text/html", http.StatusNotAcceptable, "application/json", ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", c.accept)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		resp := rec.Result()
+
+		assertEqual(t, resp.StatusCode, c.status)
+		assertEqual(t, resp.Header.Get("Content-Type"), c.contentType)
+		if c.status != http.StatusOK {
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		failOnErr(t, err)
+		assertEqual(t, string(body), c.body)
+	}
+}
+
 func TestConfigHandler(t *testing.T) {
 	makeReq := makeReqToSrv(createEnclave(&defaultCfg).extPubSrv)
 
@@ -460,7 +574,7 @@ func TestHeartbeatHandler(t *testing.T) {
 	tooLargeBuf := bytes.NewBuffer(make([]byte, maxHeartbeatBody+1))
 	assertResponse(t,
 		makeReq(http.MethodPost, pathHeartbeat, tooLargeBuf),
-		newResp(http.StatusInternalServerError, errFailedReqBody.Error()),
+		newErrResp(http.StatusInternalServerError, errFailedReqBody),
 	)
 
 	assertResponse(t,
@@ -528,7 +642,7 @@ func TestGetLeaderHandler(t *testing.T) {
 	makeReq := makeReqToHandler(getLeaderHandler(nonce, weAreLeader))
 	assertResponse(t,
 		makeReq(http.MethodGet, pathLeader, nil),
-		newResp(http.StatusBadRequest, errNoNonce.Error()),
+		newErrResp(http.StatusBadRequest, errNoNonce),
 	)
 
 	// Send an unexpected nonce.
@@ -545,3 +659,103 @@ func TestGetLeaderHandler(t *testing.T) {
 		newResp(http.StatusOK, ""),
 	)
 }
+
+func TestInfoHandler(t *testing.T) {
+	var info enclaveInfo
+	e := createEnclave(&defaultCfg)
+	e.hashes.tlsKeyHash = sha256.Sum256([]byte("foo"))
+	resp := makeReqToSrv(e.extPubSrv)(http.MethodGet, pathInfo, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, info.Version, version)
+	assertEqual(t, info.FQDN, defaultCfg.FQDN)
+	assertEqual(t, info.InEnclave, inEnclave)
+	assertEqual(t, info.CertFingerprint, fmt.Sprintf("%x", e.hashes.tlsKeyHash[:]))
+	if info.Operations == nil {
+		t.Fatal("Expected operation counters in enclave info.")
+	}
+}
+
+func TestSignalReady(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	e.SignalReady()
+	<-e.ready
+
+	// Signalling readiness again must be harmless, and the ready endpoint must
+	// know that we're already ready.
+	e.SignalReady()
+	assertResponse(t,
+		makeReqToSrv(e.intSrv)(http.MethodGet, pathReady, nil),
+		newErrResp(http.StatusGone, errAlreadyReady),
+	)
+}
+
+func TestHTTPError(t *testing.T) {
+	var errResp errorResponse
+	makeReq := makeReqToSrv(createEnclave(&defaultCfg).extPubSrv)
+
+	resp := makeReq(http.MethodGet, "/does-not-exist", nil)
+	assertEqual(t, resp.Header.Get("Content-Type"), "application/json")
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, errResp.Code, http.StatusNotFound)
+	assertEqual(t, errResp.Message, errNotFound.Error())
+	assertEqual(t, errResp.RequestID, resp.Header.Get(requestIDHeader))
+
+	assertResponse(t,
+		makeReq(http.MethodPost, pathAttestation, nil),
+		newErrResp(http.StatusMethodNotAllowed, errMethodNotAllowed),
+	)
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	makeReq := makeReqToSrv(createEnclave(&defaultCfg).extPubSrv)
+
+	// Our versioned path must not carry deprecation headers.
+	resp := makeReq(http.MethodGet, versioned(pathRoot), nil)
+	assertResponse(t, resp, newResp(http.StatusOK, formatIndexPage(defaultCfg.AppURL)))
+	assertEqual(t, resp.Header.Get("Deprecation"), "")
+
+	resp = makeReq(http.MethodGet, pathConfig, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Deprecation"), "true")
+	assertEqual(t, resp.Header.Get("Link"), `</enclave/v1/config>; rel="successor-version"`)
+
+	assertEqual(t, versioned(pathAttestation), "/enclave/v1/attestation")
+	assertEqual(t, unversioned(versioned(pathAttestation)), pathAttestation)
+	assertEqual(t, unversioned(pathAttestation), pathAttestation)
+}
+
+func TestDisabledEndpoints(t *testing.T) {
+	c := defaultCfg
+	c.DisableGetState = true
+	c.DisableIndexPage = true
+	e := createEnclave(&c)
+
+	assertResponse(t,
+		makeReqToSrv(e.extPubSrv)(http.MethodGet, pathRoot, nil),
+		newErrResp(http.StatusNotFound, errNotFound),
+	)
+	// The state endpoint still accepts PUT requests.
+	assertResponse(t,
+		makeReqToSrv(e.intSrv)(http.MethodGet, pathState, nil),
+		newErrResp(http.StatusMethodNotAllowed, errMethodNotAllowed),
+	)
+
+	c.DisableSetState = true
+	e = createEnclave(&c)
+	assertResponse(t,
+		makeReqToSrv(e.intSrv)(http.MethodPut, pathState, nil),
+		newErrResp(http.StatusNotFound, errNotFound),
+	)
+
+	// Key synchronization requires the state endpoints.
+	c.FQDNLeader = "leader.example.com"
+	if err := c.Validate(); !errors.Is(err, errCfgNeedState) {
+		t.Fatalf("Expected error %v but got %v.", errCfgNeedState, err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// The lifecycle points at which we run hooks.
+	hookAfterCert   = "after-cert"   // We have our TLS certificate.
+	hookAfterKeys   = "after-keys"   // We have our key material, e.g., from our leader.
+	hookBeforeServe = "before-serve" // We are about to start our public Web server.
+
+	defaultHookTimeout = 30 * time.Second
+)
+
+var (
+	errCfgBadHook     = errors.New("given config has invalid lifecycle hook")
+	errCfgSeccompHook = errors.New("given config combines seccomp filter with lifecycle hook commands")
+
+	// hookPrereqs maps the lifecycle points that follow a startup prerequisite
+	// to that prerequisite.
+	hookPrereqs = map[string]string{
+		hookAfterCert: appPrereqCert,
+		hookAfterKeys: appPrereqKeys,
+	}
+)
+
+// lifecycleHook is a function that runs at one of our lifecycle points, e.g.,
+// to warm a cache or to register the enclave with a discovery system.  The
+// given context expires after the configured hook timeout.
+type lifecycleHook func(ctx context.Context) error
+
+// isHookPoint returns true if the given string is one of our lifecycle points.
+func isHookPoint(point string) bool {
+	_, exists := hookPrereqs[point]
+	return exists || point == hookBeforeServe
+}
+
+// parseLifecycleHook parses a hook of the form "<point>:<command>", e.g.,
+// "after-keys:/bin/register-enclave".
+func parseLifecycleHook(s string) (string, string, error) {
+	point, cmd, found := strings.Cut(s, ":")
+	if !found || !isHookPoint(point) {
+		return "", "", fmt.Errorf("%w: %q has no known lifecycle point", errCfgBadHook, s)
+	}
+	if len(strings.Fields(cmd)) == 0 {
+		return "", "", fmt.Errorf("%w: %q has no command", errCfgBadHook, s)
+	}
+	return point, cmd, nil
+}
+
+// validateLifecycleHooks returns an error if any of the config's lifecycle
+// hooks is invalid, or if its hook timeout is negative.  Like the enclave
+// application, hook commands don't work with our seccomp filter, which
+// forbids the system calls that spawn processes.
+func (c *Config) validateLifecycleHooks() error {
+	if c.HookTimeout < 0 {
+		return fmt.Errorf("%w: negative timeout", errCfgBadHook)
+	}
+	for _, h := range c.LifecycleHooks {
+		if _, _, err := parseLifecycleHook(h); err != nil {
+			return err
+		}
+	}
+	if len(c.LifecycleHooks) > 0 && c.Seccomp {
+		return errCfgSeccompHook
+	}
+	return nil
+}
+
+// commandHook returns a lifecycle hook that runs the given command, and
+// fails if the command exits with a non-zero exit code.
+func commandHook(cmd string) lifecycleHook {
+	return func(ctx context.Context) error {
+		args := strings.Fields(cmd)
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+}
+
+// OnLifecycle registers the given hook to run at the given lifecycle point:
+// "after-cert" once we have our TLS certificate, "after-keys" once we have our
+// key material, and "before-serve" right before we start our public Web
+// server, which waits for the hook.  Hooks at the same point run in the order
+// in which they were registered.  A failing hook doesn't stop the enclave.
+// OnLifecycle must be called before Start, and it panics if the given point
+// is unknown or if the enclave has already started.
+func (e *Enclave) OnLifecycle(point string, hook lifecycleHook) {
+	e.lifecycleLock.Lock()
+	defer e.lifecycleLock.Unlock()
+
+	if !isHookPoint(point) {
+		panic(fmt.Sprintf("nitriding: unknown lifecycle point %q", point))
+	}
+	if e.lifecycleStarted {
+		panic("nitriding: lifecycle hooks must be registered before the enclave starts")
+	}
+	if e.lifecycleHooks == nil {
+		e.lifecycleHooks = make(map[string][]lifecycleHook)
+	}
+	e.lifecycleHooks[point] = append(e.lifecycleHooks[point], hook)
+}
+
+// startLifecycleHooks runs the hooks of each lifecycle point that follows a
+// startup prerequisite once we met the prerequisite.  The before-serve hooks
+// run when we start our public Web server.
+func (e *Enclave) startLifecycleHooks() {
+	e.lifecycleLock.Lock()
+	e.lifecycleStarted = true
+	e.lifecycleLock.Unlock()
+
+	for point, prereq := range hookPrereqs {
+		point, prereq := point, prereq
+		go func() {
+			defer reportPanic()
+			if e.startup.wait([]string{prereq}, e.stop) {
+				e.runLifecycleHooks(point)
+			}
+		}()
+	}
+}
+
+// runLifecycleHooks runs the hooks of the given lifecycle point one after
+// another.  We log failing hooks but carry on, so a broken hook cannot keep
+// the enclave from serving.
+func (e *Enclave) runLifecycleHooks(point string) {
+	e.lifecycleLock.Lock()
+	hooks := e.lifecycleHooks[point]
+	e.lifecycleLock.Unlock()
+
+	for i, hook := range hooks {
+		ctx, cancel := context.WithTimeout(context.Background(), e.cfg.HookTimeout)
+		err := hook(ctx)
+		cancel()
+		if err != nil {
+			elog.Warn("Lifecycle hook failed.", "point", point, "hook", i, "error", err)
+			continue
+		}
+		elog.Info("Ran lifecycle hook.", "point", point, "hook", i)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidateLifecycleHooks(t *testing.T) {
+	c := &Config{LifecycleHooks: []string{"after-cert:true", "before-serve:/bin/register -v"}}
+	failOnErr(t, c.validateLifecycleHooks())
+
+	for _, c := range []*Config{
+		{LifecycleHooks: []string{"true"}},             // No point.
+		{LifecycleHooks: []string{"after-start:true"}}, // Unknown point.
+		{LifecycleHooks: []string{"after-keys: "}},     // No command.
+		{LifecycleHooks: []string{"after-keys:true", ""}},
+		{HookTimeout: -time.Second},
+	} {
+		if err := c.validateLifecycleHooks(); !errors.Is(err, errCfgBadHook) {
+			t.Fatalf("Expected error %v but got %v.", errCfgBadHook, err)
+		}
+	}
+
+	c = &Config{LifecycleHooks: []string{"after-keys:true"}, Seccomp: true}
+	if err := c.validateLifecycleHooks(); !errors.Is(err, errCfgSeccompHook) {
+		t.Fatalf("Expected error %v but got %v.", errCfgSeccompHook, err)
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	failOnErr(t, commandHook("true")(context.Background()))
+	assertEqual(t, commandHook("false")(context.Background()) != nil, true)
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	c := defaultCfg
+	c.LifecycleHooks = []string{"after-keys:false"}
+	e := createEnclave(&c)
+
+	ran := make(chan string, 3)
+	for _, point := range []string{hookAfterCert, hookAfterKeys, hookBeforeServe} {
+		point := point
+		e.OnLifecycle(point, func(context.Context) error {
+			ran <- point
+			return nil
+		})
+	}
+	e.startLifecycleHooks()
+
+	// Hooks don't run before their lifecycle point.
+	select {
+	case p := <-ran:
+		t.Fatalf("Hook for %s ran prematurely.", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The failing command hook doesn't keep the subsequent hook from running.
+	for _, point := range []string{hookAfterKeys, hookAfterCert, hookBeforeServe} {
+		switch point {
+		case hookBeforeServe:
+			e.runLifecycleHooks(point)
+		default:
+			e.startup.markMet(hookPrereqs[point])
+		}
+		select {
+		case p := <-ran:
+			assertEqual(t, p, point)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Hook for %s didn't run.", point)
+		}
+	}
+}
+
+func TestOnLifecyclePanics(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	assertPanics := func(f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected panic but got none.")
+			}
+		}()
+		f()
+	}
+	nop := func(context.Context) error { return nil }
+
+	assertPanics(func() { e.OnLifecycle("after-start", nop) })
+	e.startLifecycleHooks()
+	assertPanics(func() { e.OnLifecycle(hookAfterCert, nop) })
+}
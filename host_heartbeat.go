@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// The states that our host heartbeats report.
+	statusStarting = "starting" // Waiting for the application to be ready.
+	statusServing  = "serving"  // The public Web server is running.
+	statusStopping = "stopping" // The enclave is shutting down.
+
+	defaultHostHeartbeatInterval = 10 * time.Second
+	hostHeartbeatWriteTimeout    = 5 * time.Second
+)
+
+// hostHeartbeat is the message that we periodically send to the EC2 host, so
+// host-side tooling can detect a hung or crashed enclave without probing our
+// public Web server.
+type hostHeartbeat struct {
+	Time            time.Time `json:"time"`
+	Status          string    `json:"status"`
+	Uptime          string    `json:"uptime"`
+	Version         string    `json:"version"`
+	GitCommit       string    `json:"git_commit"`
+	CertFingerprint string    `json:"cert_fingerprint"`
+}
+
+// newHostHeartbeat returns a heartbeat that reflects our current status.
+func (e *Enclave) newHostHeartbeat() *hostHeartbeat {
+	hb := &hostHeartbeat{
+		Time:            time.Now().UTC(),
+		Status:          statusServing,
+		Uptime:          time.Since(e.startTime).Round(time.Second).String(),
+		Version:         version,
+		GitCommit:       gitCommit,
+		CertFingerprint: fmt.Sprintf("%x", e.hashes.getTLSKeyHash()),
+	}
+	if e.cfg.WaitForApp {
+		select {
+		case <-e.ready:
+		default:
+			hb.Status = statusStarting
+		}
+	}
+	// We restarted the unhealthy application, which isn't ready yet.
+	if e.appUnready.Load() {
+		hb.Status = statusStarting
+	}
+	select {
+	case <-e.stop:
+		hb.Status = statusStopping
+	default:
+	}
+	return hb
+}
+
+// sendHostHeartbeats sends a length-prefixed, JSON-encoded heartbeat over the
+// connection that the given function establishes, once per the given
+// interval, until the enclave stops.  If the host is unreachable, we try
+// again at the next interval.
+func (e *Enclave) sendHostHeartbeats(dial func() (net.Conn, error), interval time.Duration) {
+	defer reportPanic()
+	var conn net.Conn
+	send := func() {
+		var err error
+		if conn == nil {
+			if conn, err = dial(); err != nil {
+				elog.Debug("Failed to connect to host for heartbeat.", "error", err)
+				return
+			}
+		}
+		msg, err := json.Marshal(e.newHostHeartbeat())
+		if err != nil {
+			elog.Error("Error marshalling host heartbeat.", "error", err)
+			return
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(hostHeartbeatWriteTimeout))
+		if _, err = conn.Write(lengthPrefixed(msg)); err != nil {
+			elog.Debug("Failed to send heartbeat to host.", "error", err)
+			_ = conn.Close()
+			conn = nil
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		send()
+		select {
+		case <-e.stop:
+			// Tell the host that we're going away on purpose.
+			send()
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func readHostHeartbeat(t *testing.T, conn net.Conn) *hostHeartbeat {
+	t.Helper()
+	var length uint32
+	failOnErr(t, binary.Read(conn, binary.BigEndian, &length))
+	msg := make([]byte, length)
+	_, err := io.ReadFull(conn, msg)
+	failOnErr(t, err)
+	var hb hostHeartbeat
+	failOnErr(t, json.Unmarshal(msg, &hb))
+	return &hb
+}
+
+func TestHostHeartbeats(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	e.startTime = time.Now()
+	host, enclave := net.Pipe()
+	defer host.Close()
+
+	done := make(chan struct{})
+	go func() {
+		e.sendHostHeartbeats(func() (net.Conn, error) { return enclave, nil }, time.Millisecond)
+		close(done)
+	}()
+
+	// We're waiting for the application, so we're still starting.
+	hb := readHostHeartbeat(t, host)
+	assertEqual(t, hb.Status, statusStarting)
+	assertEqual(t, hb.Version, version)
+
+	e.SignalReady()
+	for hb.Status == statusStarting {
+		hb = readHostHeartbeat(t, host)
+	}
+	assertEqual(t, hb.Status, statusServing)
+
+	close(e.stop)
+	for hb.Status == statusServing {
+		hb = readHostHeartbeat(t, host)
+	}
+	assertEqual(t, hb.Status, statusStopping)
+	<-done
+}
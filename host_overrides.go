@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// hostsPreamble are the entries that every hosts file needs.
+const hostsPreamble = "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"
+
+var errCfgBadHostOverride = errors.New("given config has invalid host override")
+
+// parseHostOverride parses the given host override of the form
+// <hostname>=<IP address>, and returns the lowercased hostname without
+// trailing dot.
+func parseHostOverride(s string) (string, netip.Addr, error) {
+	name, ip, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", netip.Addr{}, fmt.Errorf("%w: %q lacks '='", errCfgBadHostOverride, s)
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, err := dnsmessage.NewName(name + "."); err != nil || name == "" || strings.ContainsAny(name, " \t\n#") {
+		return "", netip.Addr{}, fmt.Errorf("%w: %q is not a hostname", errCfgBadHostOverride, name)
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Zone() != "" {
+		return "", netip.Addr{}, fmt.Errorf("%w: %q is not an IP address", errCfgBadHostOverride, ip)
+	}
+	return name, addr.Unmap(), nil
+}
+
+// validateHostOverrides returns an error if any of the config's host
+// overrides is invalid.
+func (c *Config) validateHostOverrides() error {
+	var errs []error
+	for _, s := range c.HostOverrides {
+		if _, _, err := parseHostOverride(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hostOverrides maps lowercased hostnames to the IP addresses that they
+// resolve to, like /etc/hosts.  Nitriding writes the overrides to the
+// enclave's /etc/hosts, which both nitriding's and the enclave application's
+// resolvers consult before DNS, and our DNS cache answers queries for
+// overridden names itself, for applications that bypass /etc/hosts.
+type hostOverrides map[string][]netip.Addr
+
+// newHostOverrides returns the given host overrides, which must be valid.
+// A hostname may appear several times, to resolve to several addresses.
+func newHostOverrides(entries []string) hostOverrides {
+	h := make(hostOverrides)
+	for _, s := range entries {
+		name, addr, _ := parseHostOverride(s)
+		if !slices.Contains(h[name], addr) {
+			h[name] = append(h[name], addr)
+		}
+	}
+	return h
+}
+
+// hostsFile returns the content of a hosts file that contains our
+// overrides, sorted by hostname.
+func (h hostOverrides) hostsFile() string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	b.WriteString(hostsPreamble)
+	for _, name := range names {
+		for _, addr := range h[name] {
+			fmt.Fprintf(&b, "%s\t%s\n", addr, name)
+		}
+	}
+	return b.String()
+}
+
+// answer returns the answer records for the given question, and false if
+// we don't override the question's name.  For overridden names, we answer
+// A and AAAA questions with the matching addresses, and all other questions
+// with no records, so internal names never reach upstream resolvers.  The
+// answers have a TTL of zero because they cost clients nothing to ask for
+// again.
+func (h hostOverrides) answer(q dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+	addrs, ok := h[strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")]
+	if !ok {
+		return nil, false
+	}
+	var answers []dnsmessage.Resource
+	for _, addr := range addrs {
+		var body dnsmessage.ResourceBody
+		switch {
+		case q.Type == dnsmessage.TypeA && addr.Is4():
+			body = &dnsmessage.AResource{A: addr.As4()}
+		case q.Type == dnsmessage.TypeAAAA && addr.Is6():
+			body = &dnsmessage.AAAAResource{AAAA: addr.As16()}
+		default:
+			continue
+		}
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class},
+			Body:   body,
+		})
+	}
+	return answers, true
+}
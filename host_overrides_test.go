@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseHostOverride(t *testing.T) {
+	name, addr, err := parseHostOverride("DB.Internal.=10.0.0.5")
+	failOnErr(t, err)
+	assertEqual(t, name, "db.internal")
+	assertEqual(t, addr, netip.MustParseAddr("10.0.0.5"))
+	_, addr, err = parseHostOverride("db.internal=::ffff:10.0.0.5")
+	failOnErr(t, err)
+	assertEqual(t, addr, netip.MustParseAddr("10.0.0.5"))
+
+	for _, s := range []string{
+		"db.internal",
+		"=10.0.0.5",
+		"db internal=10.0.0.5",
+		"db.internal=db.example.com",
+		"db.internal=fe80::1%eth0",
+	} {
+		if _, _, err := parseHostOverride(s); !errors.Is(err, errCfgBadHostOverride) {
+			t.Fatalf("Expected error %v for %q but got %v.", errCfgBadHostOverride, s, err)
+		}
+	}
+	c := &Config{HostOverrides: []string{"db.internal=10.0.0.5", "cache.internal"}}
+	if err := c.validateHostOverrides(); !errors.Is(err, errCfgBadHostOverride) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadHostOverride, err)
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	h := newHostOverrides([]string{
+		"db.internal=10.0.0.5",
+		"cache.internal=10.0.0.6",
+		"db.internal=fd00::5",
+		"DB.internal=10.0.0.5",
+	})
+	assertEqual(t, h.hostsFile(), hostsPreamble+
+		"10.0.0.6\tcache.internal\n"+
+		"10.0.0.5\tdb.internal\n"+
+		"fd00::5\tdb.internal\n")
+}
+
+func TestHostOverridesAnswer(t *testing.T) {
+	h := newHostOverrides([]string{"db.internal=10.0.0.5", "db.internal=fd00::5"})
+	question := func(name string, qtype dnsmessage.Type) dnsmessage.Question {
+		return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}
+	}
+
+	answers, ok := h.answer(question("DB.internal.", dnsmessage.TypeA))
+	assertEqual(t, ok, true)
+	assertEqual(t, len(answers), 1)
+	assertEqual(t, answers[0].Body.(*dnsmessage.AResource).A, [4]byte{10, 0, 0, 5})
+	answers, _ = h.answer(question("db.internal.", dnsmessage.TypeAAAA))
+	assertEqual(t, answers[0].Body.(*dnsmessage.AAAAResource).AAAA, netip.MustParseAddr("fd00::5").As16())
+
+	// Overridden names have no other records.
+	answers, ok = h.answer(question("db.internal.", dnsmessage.TypeMX))
+	assertEqual(t, ok, true)
+	assertEqual(t, len(answers), 0)
+	_, ok = h.answer(question("example.com.", dnsmessage.TypeA))
+	assertEqual(t, ok, false)
+}
+
+func TestDNSCacheOverrides(t *testing.T) {
+	upstream, queries := fakeUpstream(t, func(*dnsmessage.Message, bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(60)}}
+	})
+	r := newDNSResolver([]string{upstream}, newHostOverrides([]string{"example.com=10.0.0.5"}))
+
+	resp := dnsAnswer(t, r.answer(dnsQuery(t, 1, testDNSName), true))
+	assertEqual(t, resp.Header.ID, uint16(1))
+	assertEqual(t, resp.Header.Authoritative, true)
+	assertEqual(t, resp.Answers[0].Body.(*dnsmessage.AResource).A, [4]byte{10, 0, 0, 5})
+	// Queries for overridden names never reach upstream resolvers.
+	assertEqual(t, queries.Load(), int32(0))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	hostTimeTimeout = 5 * time.Second
+	// hostTimeMaxMsgLen is the maximum length of the host's response.
+	hostTimeMaxMsgLen = 1024
+)
+
+var errBadHostTimeMsg = errors.New("malformed host time message")
+
+// hostTimeMsg is the message that we exchange with the EC2 host to obtain its
+// time.  We send our local time, which tells the host how far our clock has
+// drifted, and the host responds with its own time.
+type hostTimeMsg struct {
+	Time time.Time `json:"time"`
+}
+
+// queryHostTime asks the EC2 host, over the connection that the given
+// function establishes, for the time.  The request and the response are both
+// length-prefixed and JSON-encoded hostTimeMsg.  The function returns the
+// offset between the host's time and our local clock, as well as the radius
+// of uncertainty around the offset.
+func queryHostTime(dial func() (net.Conn, error)) (time.Duration, time.Duration, error) {
+	conn, err := dial()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(hostTimeTimeout))
+
+	sent := time.Now()
+	req, err := json.Marshal(&hostTimeMsg{Time: sent.UTC()})
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := conn.Write(lengthPrefixed(req)); err != nil {
+		return 0, 0, err
+	}
+	var l [4]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return 0, 0, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 || n > hostTimeMaxMsgLen {
+		return 0, 0, fmt.Errorf("%w: length %d", errBadHostTimeMsg, n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return 0, 0, err
+	}
+	rtt := time.Since(sent)
+
+	var msg hostTimeMsg
+	if err := json.Unmarshal(resp, &msg); err != nil || msg.Time.IsZero() {
+		return 0, 0, errBadHostTimeMsg
+	}
+	// Like for Roughtime, we assume that the host's time corresponds to the
+	// middle of our round trip.
+	offset := msg.Time.Sub(sent.Add(rtt / 2))
+	return offset, rtt / 2, nil
+}
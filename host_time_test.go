@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveHostTime answers one time request on the given connection with the
+// given response.
+func serveHostTime(t *testing.T, conn net.Conn, resp []byte) {
+	defer conn.Close()
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return
+	}
+	var req hostTimeMsg
+	if err := json.Unmarshal(msg, &req); err != nil || req.Time.IsZero() {
+		t.Errorf("Got malformed host time request %q.", msg)
+	}
+	_, _ = conn.Write(resp)
+}
+
+func TestQueryHostTime(t *testing.T) {
+	resp, err := json.Marshal(&hostTimeMsg{Time: time.Now().Add(time.Hour)})
+	failOnErr(t, err)
+	host, enclave := net.Pipe()
+	go serveHostTime(t, host, lengthPrefixed(resp))
+
+	offset, radius, err := queryHostTime(func() (net.Conn, error) { return enclave, nil })
+	failOnErr(t, err)
+	if offset < 59*time.Minute || offset > 61*time.Minute {
+		t.Fatalf("Expected offset of about an hour but got %s.", offset)
+	}
+	if radius > hostTimeTimeout {
+		t.Fatalf("Got unexpected radius %s.", radius)
+	}
+}
+
+func TestQueryHostTimeBadResponse(t *testing.T) {
+	for _, resp := range [][]byte{
+		lengthPrefixed([]byte("foo")),
+		lengthPrefixed([]byte("{}")),
+		lengthPrefixed(make([]byte, hostTimeMaxMsgLen+1)),
+	} {
+		host, enclave := net.Pipe()
+		go serveHostTime(t, host, resp)
+		_, _, err := queryHostTime(func() (net.Conn, error) { return enclave, nil })
+		assertEqual(t, errors.Is(err, errBadHostTimeMsg), true)
+	}
+}
+
+func TestTimeSource(t *testing.T) {
+	cfg := defaultCfg
+	cfg.HostTimePort = 1234
+	e := createEnclave(&cfg)
+	server, _ := e.timeSource()
+	assertEqual(t, server, "vsock:3:1234")
+
+	e.cfg.RoughtimeServer = "example.com:2002"
+	server, _ = e.timeSource()
+	assertEqual(t, server, "example.com:2002")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// We implement the subset of Hybrid Public Key Encryption (HPKE) that we need
+// to receive secrets and Oblivious HTTP requests from clients: single-shot
+// encryption and secret export in HPKE's base mode with the cipher suite
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, and ChaCha20Poly1305.  See RFC 9180:
+// https://www.rfc-editor.org/rfc/rfc9180.html
+const (
+	hpkeKEMID    = 0x0020
+	hpkeKDFID    = 0x0001
+	hpkeAEADID   = 0x0003
+	hpkeModeBase = 0x00
+	// The length of the encapsulated key that precedes the ciphertext.
+	hpkeEncLen = curve25519.PointSize
+)
+
+var (
+	errHPKECiphertext = errors.New("HPKE ciphertext too short")
+	errHPKEDecrypt    = errors.New("failed to decrypt HPKE ciphertext")
+
+	hpkeKEMSuite = binary.BigEndian.AppendUint16([]byte("KEM"), hpkeKEMID)
+	hpkeSuite    = binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(
+		binary.BigEndian.AppendUint16([]byte("HPKE"), hpkeKEMID), hpkeKDFID), hpkeAEADID)
+)
+
+// hpkeKey is an X25519 key pair that clients encrypt messages to.
+type hpkeKey struct {
+	priv []byte
+	pub  []byte
+}
+
+// newHPKEKey generates and returns a new HPKE key pair.
+func newHPKEKey() (*hpkeKey, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeKey{priv: priv, pub: pub}, nil
+}
+
+// open decrypts the given ciphertext, which consists of the encapsulated key
+// followed by the sealed message, and which was encrypted to our public key
+// using the given info string.
+func (k *hpkeKey) open(info, ciphertext []byte) ([]byte, error) {
+	plaintext, _, err := k.openExport(info, ciphertext, nil, 0)
+	return plaintext, err
+}
+
+// openExport works like open, and also returns a secret of length n that it
+// exports from the HPKE context using the given exporter context.  Senders
+// export the same secret, which lets them decrypt replies.
+func (k *hpkeKey) openExport(info, ciphertext, exporterContext []byte, n int) ([]byte, []byte, error) {
+	if len(ciphertext) < hpkeEncLen {
+		return nil, nil, errHPKECiphertext
+	}
+	enc, sealed := ciphertext[:hpkeEncLen], ciphertext[hpkeEncLen:]
+	dh, err := curve25519.X25519(k.priv, enc)
+	if err != nil {
+		return nil, nil, errHPKEDecrypt
+	}
+	defer wipeBytes(dh)
+
+	aead, nonce, exporterSecret, err := hpkeContext(hpkeSharedSecret(dh, enc, k.pub), info)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipeBytes(exporterSecret)
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, nil, errHPKEDecrypt
+	}
+	return plaintext, hpkeExport(exporterSecret, exporterContext, n), nil
+}
+
+// hpkeSeal encrypts the given plaintext to the given public key using the
+// given info string.  The resulting ciphertext consists of the encapsulated
+// key followed by the sealed message.
+func hpkeSeal(pubKey, info, plaintext []byte) ([]byte, error) {
+	ciphertext, _, err := hpkeSealExport(pubKey, info, plaintext, nil, 0)
+	return ciphertext, err
+}
+
+// hpkeSealExport works like hpkeSeal, and also returns a secret of length n
+// that it exports from the HPKE context using the given exporter context.
+func hpkeSealExport(pubKey, info, plaintext, exporterContext []byte, n int) ([]byte, []byte, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, nil, err
+	}
+	defer wipeBytes(ephemeral)
+	enc, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := curve25519.X25519(ephemeral, pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipeBytes(dh)
+
+	aead, nonce, exporterSecret, err := hpkeContext(hpkeSharedSecret(dh, enc, pubKey), info)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipeBytes(exporterSecret)
+	return aead.Seal(enc, nonce, plaintext, nil), hpkeExport(exporterSecret, exporterContext, n), nil
+}
+
+// wipe overwrites our private key with zeros.
+func (k *hpkeKey) wipe() {
+	wipeBytes(k.priv)
+}
+
+// hpkeSharedSecret derives the KEM's shared secret from the given
+// Diffie-Hellman output, encapsulated key, and recipient public key.
+func hpkeSharedSecret(dh, enc, pubKey []byte) []byte {
+	prk := hpkeLabeledExtract(hpkeKEMSuite, nil, "eae_prk", dh)
+	defer wipeBytes(prk)
+	kemContext := append(append([]byte{}, enc...), pubKey...)
+	return hpkeLabeledExpand(hpkeKEMSuite, prk, "shared_secret", kemContext, sha256.Size)
+}
+
+// hpkeContext runs HPKE's key schedule in base mode, and returns the AEAD and
+// nonce for the first (and only) message, and the exporter secret.  The
+// function wipes the given shared secret.
+func hpkeContext(sharedSecret, info []byte) (cipher.AEAD, []byte, []byte, error) {
+	defer wipeBytes(sharedSecret)
+	pskIDHash := hpkeLabeledExtract(hpkeSuite, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(hpkeSuite, nil, "info_hash", info)
+	ksContext := append(append([]byte{hpkeModeBase}, pskIDHash...), infoHash...)
+
+	secret := hpkeLabeledExtract(hpkeSuite, sharedSecret, "secret", nil)
+	defer wipeBytes(secret)
+	key := hpkeLabeledExpand(hpkeSuite, secret, "key", ksContext, chacha20poly1305.KeySize)
+	defer wipeBytes(key)
+	nonce := hpkeLabeledExpand(hpkeSuite, secret, "base_nonce", ksContext, chacha20poly1305.NonceSize)
+	exporterSecret := hpkeLabeledExpand(hpkeSuite, secret, "exp", ksContext, sha256.Size)
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		wipeBytes(exporterSecret)
+		return nil, nil, nil, err
+	}
+	return aead, nonce, exporterSecret, nil
+}
+
+// hpkeExport implements HPKE's secret export, and returns a secret of length
+// n, or nil if n is zero.
+func hpkeExport(exporterSecret, exporterContext []byte, n int) []byte {
+	if n == 0 {
+		return nil
+	}
+	return hpkeLabeledExpand(hpkeSuite, exporterSecret, "sec", exporterContext, n)
+}
+
+// hpkeLabeledExtract implements HPKE's LabeledExtract.
+func hpkeLabeledExtract(suite, salt []byte, label string, ikm []byte) []byte {
+	labeled := append(append(append([]byte("HPKE-v1"), suite...), label...), ikm...)
+	return hkdf.Extract(sha256.New, labeled, salt)
+}
+
+// hpkeLabeledExpand implements HPKE's LabeledExpand.  The function doesn't
+// return an error because HKDF-SHA256 can expand up to 8160 bytes, far more
+// than we ever ask for.
+func hpkeLabeledExpand(suite, prk []byte, label string, info []byte, n int) []byte {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(n))
+	labeled = append(append(append(append(labeled, "HPKE-v1"...), suite...), label...), info...)
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, labeled), out); err != nil {
+		panic(err)
+	}
+	return out
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// mustSeal encrypts the given plaintext to the given public key the way
+// clients do.
+func mustSeal(t *testing.T, pubKey, info, plaintext []byte) []byte {
+	t.Helper()
+	ciphertext, err := hpkeSeal(pubKey, info, plaintext)
+	failOnErr(t, err)
+	return ciphertext
+}
+
+func TestHPKERoundTrip(t *testing.T) {
+	key, err := newHPKEKey()
+	failOnErr(t, err)
+	info, plaintext := []byte("info"), []byte("secret")
+
+	ciphertext := mustSeal(t, key.pub, info, plaintext)
+	decrypted, err := key.open(info, ciphertext)
+	failOnErr(t, err)
+	assertEqual(t, bytes.Equal(decrypted, plaintext), true)
+
+	// Another info string must not decrypt the ciphertext.
+	_, err = key.open([]byte("other info"), ciphertext)
+	assertEqual(t, errors.Is(err, errHPKEDecrypt), true)
+
+	// Neither must another key.
+	other, err := newHPKEKey()
+	failOnErr(t, err)
+	_, err = other.open(info, ciphertext)
+	assertEqual(t, errors.Is(err, errHPKEDecrypt), true)
+
+	_, err = key.open(info, ciphertext[:hpkeEncLen-1])
+	assertEqual(t, errors.Is(err, errHPKECiphertext), true)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var (
+	errCfgBadImageMetadata = errors.New("given config's image metadata is not a JSON object")
+
+	// The files that reveal the kernel's command line and release.  Both are
+	// variables, so tests can replace them.
+	kernelCmdlineFile = "/proc/cmdline"
+	kernelReleaseFile = "/proc/sys/kernel/osrelease"
+)
+
+// The PCRs that the Nitro hypervisor sets to measurements of the enclave
+// image file (EIF): PCR0 covers the entire image, PCR1 the kernel, its
+// command line, and the bootstrap ramdisk, and PCR2 the application's
+// ramdisk.
+var imagePCRs = []uint{0, 1, 2}
+
+// imageInfo describes the enclave image that we're running, so verifiers can
+// correlate our attestation documents with a reproducible build of the EIF.
+type imageInfo struct {
+	PCRs     map[uint]string `json:"pcrs,omitempty"`
+	Kernel   *kernelInfo     `json:"kernel,omitempty"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// kernelInfo describes the kernel that we're running on.
+type kernelInfo struct {
+	Release       string `json:"release"`
+	Cmdline       string `json:"cmdline"`
+	CmdlineSHA384 string `json:"cmdline_sha384"`
+}
+
+// validateImageMetadata returns an error if the config's image metadata is
+// set but isn't a JSON object.
+func (c *Config) validateImageMetadata() error {
+	if c.ImageMetadata == "" {
+		return nil
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(c.ImageMetadata), &obj); err != nil {
+		return fmt.Errorf("%w: %v", errCfgBadImageMetadata, err)
+	}
+	return nil
+}
+
+// cachedPCRs returns a function that returns our PCR values.  Our PCR values
+// don't change while we're running, so there's no need to ask the hypervisor
+// more than once.  The function returns nil if we're not running inside an
+// enclave.
+func cachedPCRs(purpose string) func() map[uint][]byte {
+	var (
+		pcrs map[uint][]byte
+		once sync.Once
+	)
+	return func() map[uint][]byte {
+		once.Do(func() {
+			if !inEnclave {
+				return
+			}
+			var err error
+			if pcrs, err = getPCRValues(); err != nil {
+				elog.Warn("Failed to get PCR values for "+purpose+".", "error", err)
+			}
+		})
+		return pcrs
+	}
+}
+
+// getKernelInfo returns information about our kernel, or nil if the kernel
+// doesn't reveal its command line.
+func getKernelInfo() *kernelInfo {
+	cmdline, err := os.ReadFile(kernelCmdlineFile)
+	if err != nil {
+		return nil
+	}
+	release, _ := os.ReadFile(kernelReleaseFile)
+	// The kernel terminates its command line with a newline, which isn't part
+	// of the command line that the EIF contains.
+	cmdline = bytes.TrimSuffix(cmdline, []byte("\n"))
+	return &kernelInfo{
+		Release:       string(bytes.TrimSpace(release)),
+		Cmdline:       string(cmdline),
+		CmdlineSHA384: fmt.Sprintf("%x", sha512.Sum384(cmdline)),
+	}
+}
+
+// imageHandler returns an HTTP handler that returns JSON-encoded information
+// about the enclave image: its PCR values, the kernel and its command line,
+// and the build metadata that the operator embedded in the image.
+func imageHandler(e *Enclave) http.HandlerFunc {
+	getPCRs := cachedPCRs("image endpoint")
+	kernel := getKernelInfo()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := imageInfo{Kernel: kernel}
+		if e.cfg.ImageMetadata != "" {
+			info.Metadata = json.RawMessage(e.cfg.ImageMetadata)
+		}
+		if pcrs := getPCRs(); len(pcrs) > 0 {
+			info.PCRs = make(map[uint]string, len(imagePCRs))
+			for _, pcr := range imagePCRs {
+				if value, ok := pcrs[pcr]; ok {
+					info.PCRs[pcr] = fmt.Sprintf("%x", value)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(&info); err != nil {
+			elog.Error("Error encoding image info.", "error", err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateImageMetadata(t *testing.T) {
+	failOnErr(t, (&Config{}).validateImageMetadata())
+	failOnErr(t, (&Config{ImageMetadata: `{"git_commit": "abc"}`}).validateImageMetadata())
+	for _, metadata := range []string{`["abc"]`, `{"git_commit":`, "abc"} {
+		err := (&Config{ImageMetadata: metadata}).validateImageMetadata()
+		assertEqual(t, errors.Is(err, errCfgBadImageMetadata), true)
+	}
+}
+
+func TestImageHandler(t *testing.T) {
+	dir := t.TempDir()
+	origCmdline, origRelease := kernelCmdlineFile, kernelReleaseFile
+	kernelCmdlineFile = filepath.Join(dir, "cmdline")
+	kernelReleaseFile = filepath.Join(dir, "osrelease")
+	origInEnclave, origGetPCRValues := inEnclave, getPCRValues
+	defer func() {
+		kernelCmdlineFile, kernelReleaseFile = origCmdline, origRelease
+		inEnclave, getPCRValues = origInEnclave, origGetPCRValues
+	}()
+	failOnErr(t, os.WriteFile(kernelCmdlineFile, []byte("reboot=k console=ttyS0\n"), 0o600))
+	failOnErr(t, os.WriteFile(kernelReleaseFile, []byte("4.14.246\n"), 0o600))
+
+	var calls int
+	pcrs := map[uint][]byte{
+		0: bytes.Repeat([]byte{0}, sha512.Size384),
+		1: bytes.Repeat([]byte{1}, sha512.Size384),
+		2: bytes.Repeat([]byte{2}, sha512.Size384),
+		3: bytes.Repeat([]byte{3}, sha512.Size384),
+	}
+	inEnclave = true
+	getPCRValues = func() (map[uint][]byte, error) {
+		calls++
+		return pcrs, nil
+	}
+
+	c := defaultCfg
+	c.ImageMetadata = `{"git_commit": "abc"}`
+	makeReq := makeReqToSrv(createEnclave(&c).extPubSrv)
+	var info imageInfo
+	for i := 0; i < 2; i++ {
+		resp := makeReq(http.MethodGet, pathImage, nil)
+		assertEqual(t, resp.StatusCode, http.StatusOK)
+		assertEqual(t, resp.Header.Get("Content-Type"), contentTypeJSON)
+		info = imageInfo{}
+		failOnErr(t, json.NewDecoder(resp.Body).Decode(&info))
+	}
+	// We must only ask the hypervisor once.
+	assertEqual(t, calls, 1)
+
+	// Only PCR0 to PCR2 measure the image.
+	assertEqual(t, len(info.PCRs), 3)
+	for pcr := uint(0); pcr <= 2; pcr++ {
+		assertEqual(t, info.PCRs[pcr], fmt.Sprintf("%x", pcrs[pcr]))
+	}
+	assertEqual(t, *info.Kernel, kernelInfo{
+		Release:       "4.14.246",
+		Cmdline:       "reboot=k console=ttyS0",
+		CmdlineSHA384: fmt.Sprintf("%x", sha512.Sum384([]byte("reboot=k console=ttyS0"))),
+	})
+	assertEqual(t, string(info.Metadata), `{"git_commit":"abc"}`)
+}
+
+func TestImageHandlerOutsideEnclave(t *testing.T) {
+	origCmdline := kernelCmdlineFile
+	kernelCmdlineFile = filepath.Join(t.TempDir(), "does-not-exist")
+	defer func() { kernelCmdlineFile = origCmdline }()
+
+	var info imageInfo
+	resp := makeReqToSrv(createEnclave(&defaultCfg).extPubSrv)(http.MethodGet, pathImage, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&info))
+	assertEqual(t, info.PCRs == nil, true)
+	assertEqual(t, info.Kernel == nil, true)
+	assertEqual(t, info.Metadata == nil, true)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// kmsRecipientKeyBits is the size of the ephemeral RSA key that KMS
+	// encrypts its responses to.
+	kmsRecipientKeyBits = 2048
+	// kmsKeyEncryptionAlg is the algorithm that KMS uses to encrypt its
+	// responses to our ephemeral RSA key.
+	kmsKeyEncryptionAlg = "RSAES_OAEP_SHA_256"
+	// defaultKMSKeySpec is the kind of data key that we generate unless the
+	// enclave application asks for a number of bytes.
+	defaultKMSKeySpec = "AES_256"
+)
+
+var (
+	errKMSBadRequest    = errors.New("KMS request lacks required fields or has malformed fields")
+	errKMSNoRecipient   = errors.New("KMS response lacks ciphertext for recipient")
+	errKMSRecipientAttn = errors.New("failed to create attestation document for KMS")
+)
+
+// kmsRecipient tells KMS to encrypt its response to the public key in the
+// given attestation document.  KMS policies can then evaluate the
+// kms:RecipientAttestation condition keys, i.e., restrict the use of a key to
+// enclaves with the given measurements.
+type kmsRecipient struct {
+	AttestationDocument    []byte
+	KeyEncryptionAlgorithm string
+}
+
+// kmsDecryptRequest is the enclave application's request to decrypt a KMS
+// ciphertext.  If no region is given, we use the EC2 host's region.
+type kmsDecryptRequest struct {
+	CiphertextBlob    []byte            `json:"ciphertext_blob"`
+	KeyID             string            `json:"key_id,omitempty"`
+	EncryptionContext map[string]string `json:"encryption_context,omitempty"`
+	Region            string            `json:"region,omitempty"`
+}
+
+// kmsDataKeyRequest is the enclave application's request to generate a data
+// key.  If neither a key spec nor a number of bytes is given, we generate a
+// 256-bit AES key.
+type kmsDataKeyRequest struct {
+	KeyID             string            `json:"key_id"`
+	KeySpec           string            `json:"key_spec,omitempty"`
+	NumberOfBytes     int               `json:"number_of_bytes,omitempty"`
+	EncryptionContext map[string]string `json:"encryption_context,omitempty"`
+	Region            string            `json:"region,omitempty"`
+}
+
+// kmsResponse is our response to the enclave application.  The ciphertext is
+// only set for generated data keys.
+type kmsResponse struct {
+	KeyID          string `json:"key_id"`
+	Plaintext      []byte `json:"plaintext"`
+	CiphertextBlob []byte `json:"ciphertext_blob,omitempty"`
+}
+
+// callKMSAsRecipient invokes the given KMS action with the given input, and
+// asks KMS to encrypt the plaintext in its response to an ephemeral RSA key,
+// which we bind to an attestation document.  This is what AWS's
+// kmstool-enclave-cli does, so enclave applications don't need to ship it.
+// The caller is responsible for wiping the plaintext in the response.
+func callKMSAsRecipient(
+	ctx context.Context,
+	a attester,
+	hashes *AttestationHashes,
+	region, action string,
+	in map[string]any,
+) (*kmsResponse, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, kmsRecipientKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	n, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := a.createAttstn(&clientAuxInfo{
+		clientNonce:       n,
+		attestationHashes: hashes.Serialize(),
+		publicKey:         pub,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errKMSRecipientAttn, err)
+	}
+	in["Recipient"] = &kmsRecipient{
+		AttestationDocument:    doc,
+		KeyEncryptionAlgorithm: kmsKeyEncryptionAlg,
+	}
+
+	creds, region, err := getAWSSession(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		KeyID                  string
+		CiphertextBlob         []byte
+		CiphertextForRecipient []byte
+	}
+	if err := callAWS(ctx, creds, region, "kms", action, in, &out); err != nil {
+		return nil, err
+	}
+	if len(out.CiphertextForRecipient) == 0 {
+		return nil, errKMSNoRecipient
+	}
+	plaintext, err := openEnvelopedData(priv, out.CiphertextForRecipient)
+	if err != nil {
+		return nil, err
+	}
+	return &kmsResponse{
+		KeyID:          out.KeyID,
+		Plaintext:      plaintext,
+		CiphertextBlob: out.CiphertextBlob,
+	}, nil
+}
+
+// toInput turns the request into the input of KMS's Decrypt action.
+func (req *kmsDecryptRequest) toInput() (map[string]any, error) {
+	if len(req.CiphertextBlob) == 0 {
+		return nil, errKMSBadRequest
+	}
+	in := map[string]any{"CiphertextBlob": req.CiphertextBlob}
+	if req.KeyID != "" {
+		in["KeyId"] = req.KeyID
+	}
+	if len(req.EncryptionContext) > 0 {
+		in["EncryptionContext"] = req.EncryptionContext
+	}
+	return in, nil
+}
+
+// toInput turns the request into the input of KMS's GenerateDataKey action.
+func (req *kmsDataKeyRequest) toInput() (map[string]any, error) {
+	if req.KeyID == "" || (req.KeySpec != "" && req.NumberOfBytes != 0) || req.NumberOfBytes < 0 {
+		return nil, errKMSBadRequest
+	}
+	in := map[string]any{"KeyId": req.KeyID}
+	switch {
+	case req.NumberOfBytes > 0:
+		in["NumberOfBytes"] = req.NumberOfBytes
+	case req.KeySpec != "":
+		in["KeySpec"] = req.KeySpec
+	default:
+		in["KeySpec"] = defaultKMSKeySpec
+	}
+	if len(req.EncryptionContext) > 0 {
+		in["EncryptionContext"] = req.EncryptionContext
+	}
+	return in, nil
+}
+
+// kmsRequest is implemented by the enclave application's requests to KMS.
+type kmsRequest interface {
+	toInput() (map[string]any, error)
+	region() string
+}
+
+func (req *kmsDecryptRequest) region() string { return req.Region }
+func (req *kmsDataKeyRequest) region() string { return req.Region }
+
+// kmsHandler returns an HTTP handler that decodes the enclave application's
+// JSON-encoded request into the request that the given function returns,
+// invokes the given KMS action with an attestation document, and returns the
+// plaintext that KMS encrypted to us.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func kmsHandler(action string, newReq func() kmsRequest, a attester, hashes *AttestationHashes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := newReq()
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			if isBodyTooLarge(err) {
+				httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			httpError(w, r, errKMSBadRequest, http.StatusBadRequest)
+			return
+		}
+		in, err := req.toInput()
+		if err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		ctx, span := startSpan(r.Context(), "kms."+strings.ToLower(action))
+		resp, err := callKMSAsRecipient(ctx, a, hashes, req.region(), "TrentService."+action, in)
+		span.setError(err)
+		span.end()
+		if errors.Is(err, errKMSRecipientAttn) {
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			elog.Warn("KMS request failed.", "action", action, "error", err)
+			httpError(w, r, err, http.StatusBadGateway)
+			return
+		}
+		defer wipeBytes(resp.Plaintext)
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			elog.Error("Error encoding KMS response.", "error", err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sealEnvelopedData returns a DER-encoded CMS EnvelopedData structure that
+// contains the given plaintext for the given recipient, like KMS does.
+func sealEnvelopedData(t *testing.T, pub *rsa.PublicKey, plaintext []byte) []byte {
+	t.Helper()
+	type algorithmIdentifier struct {
+		Algorithm  asn1.ObjectIdentifier
+		Parameters asn1.RawValue `asn1:"optional"`
+	}
+	type keyTransRecipientInfo struct {
+		Version                int
+		SubjectKeyIdentifier   asn1.RawValue
+		KeyEncryptionAlgorithm algorithmIdentifier
+		EncryptedKey           []byte
+	}
+	type encryptedContentInfo struct {
+		ContentType                asn1.ObjectIdentifier
+		ContentEncryptionAlgorithm algorithmIdentifier
+		EncryptedContent           []byte `asn1:"tag:0"`
+	}
+	type envelopedData struct {
+		Version              int
+		RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+		EncryptedContentInfo encryptedContentInfo
+	}
+	type contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     envelopedData `asn1:"explicit,tag:0"`
+	}
+
+	key, iv := make([]byte, 32), make([]byte, aes.BlockSize)
+	_, _ = rand.Read(key)
+	_, _ = rand.Read(iv)
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	failOnErr(t, err)
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	ciphertext := append(bytes.Clone(plaintext), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, err := aes.NewCipher(key)
+	failOnErr(t, err)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+	rawIV, err := asn1.Marshal(iv)
+	failOnErr(t, err)
+
+	der, err := asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content: envelopedData{
+			Version: 2,
+			RecipientInfos: []keyTransRecipientInfo{{
+				Version:                2,
+				SubjectKeyIdentifier:   asn1.RawValue{Class: berClassContext, Tag: 0, Bytes: []byte("kid")},
+				KeyEncryptionAlgorithm: algorithmIdentifier{Algorithm: oidRSAESOAEP},
+				EncryptedKey:           encryptedKey,
+			}},
+			EncryptedContentInfo: encryptedContentInfo{
+				ContentType:                asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1},
+				ContentEncryptionAlgorithm: algorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: rawIV}},
+				EncryptedContent:           ciphertext,
+			},
+		},
+	})
+	failOnErr(t, err)
+	return der
+}
+
+func TestParseBER(t *testing.T) {
+	// A constructed octet string of indefinite length that consists of two
+	// chunks.
+	v, rest, err := parseBER([]byte{0x24, 0x80, 0x04, 0x02, 'a', 'b', 0x04, 0x01, 'c', 0x00, 0x00, 0xff}, 0)
+	failOnErr(t, err)
+	assertEqual(t, v.is(berClassUniversal, berTagOctetString), true)
+	assertEqual(t, string(v.bytes()), "abc")
+	assertEqual(t, bytes.Equal(rest, []byte{0xff}), true)
+
+	// A context-specific value with a high tag number and a long length.
+	v, _, err = parseBER(append([]byte{0x9f, 0x81, 0x00, 0x81, 0x80}, make([]byte, 128)...), 0)
+	failOnErr(t, err)
+	assertEqual(t, v.is(berClassContext, 128), true)
+	assertEqual(t, len(v.content), 128)
+
+	for _, b := range [][]byte{
+		{0x04},                   // Missing length.
+		{0x04, 0x05, 'a'},        // Length exceeds input.
+		{0x04, 0x80, 0x00, 0x00}, // Primitive value with indefinite length.
+		{0x24, 0x80, 0x04, 0x01}, // Missing end of contents.
+		bytes.Repeat([]byte{0x30, 0x80}, maxBERDepth+2),
+	} {
+		if _, _, err := parseBER(b, 0); !errors.Is(err, errBadBER) {
+			t.Fatalf("Expected error %v for %x but got %v.", errBadBER, b, err)
+		}
+	}
+}
+
+func TestOpenEnvelopedData(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, kmsRecipientKeyBits)
+	failOnErr(t, err)
+
+	for _, plaintext := range []string{"", "data key", "exactly 16 bytes"} {
+		der := sealEnvelopedData(t, &priv.PublicKey, []byte(plaintext))
+		decrypted, err := openEnvelopedData(priv, der)
+		failOnErr(t, err)
+		assertEqual(t, string(decrypted), plaintext)
+	}
+
+	// Another recipient's key must not work.
+	other, err := rsa.GenerateKey(rand.Reader, kmsRecipientKeyBits)
+	failOnErr(t, err)
+	if _, err := openEnvelopedData(other, sealEnvelopedData(t, &priv.PublicKey, []byte("foo"))); err == nil {
+		t.Fatal("Expected error when decrypting with the wrong key.")
+	}
+
+	// Neither must other content types.
+	der, err := asn1.Marshal(struct{ ContentType asn1.ObjectIdentifier }{oidRSAESOAEP})
+	failOnErr(t, err)
+	if _, err := openEnvelopedData(priv, der); !errors.Is(err, errBadCMS) {
+		t.Fatalf("Expected error %v but got %v.", errBadCMS, err)
+	}
+}
+
+// recipientAttester remembers the public key that it was asked to attest.
+type recipientAttester struct {
+	dummyAttester
+	publicKey []byte
+}
+
+func (a *recipientAttester) createAttstn(aux auxInfo) ([]byte, error) {
+	a.publicKey = aux.(*clientAuxInfo).publicKey
+	return []byte("attestation document"), nil
+}
+
+// mockKMS points our AWS clients to a Web server that mimics KMS's Decrypt
+// and GenerateDataKey actions for recipients, and Secrets Manager, which
+// returns a KMS ciphertext.  The server encrypts its responses to the public
+// key that the given attester attested.
+func mockKMS(t *testing.T, a *recipientAttester) {
+	t.Helper()
+	mockAWS(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") == "secretsmanager.GetSecretValue" {
+			_, _ = w.Write([]byte(`{"SecretString":"` +
+				base64.StdEncoding.EncodeToString([]byte("kms-ciphertext")) + `"}`))
+			return
+		}
+		var in struct {
+			CiphertextBlob []byte
+			KeyId          string
+			KeySpec        string
+			Recipient      kmsRecipient
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil ||
+			string(in.Recipient.AttestationDocument) != "attestation document" ||
+			in.Recipient.KeyEncryptionAlgorithm != kmsKeyEncryptionAlg {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pub, err := x509.ParsePKIXPublicKey(a.publicKey)
+		failOnErr(t, err)
+
+		out := map[string]any{"KeyId": "arn:aws:kms:us-east-2:1:key/foo"}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Decrypt":
+			out["CiphertextForRecipient"] = sealEnvelopedData(t, pub.(*rsa.PublicKey), []byte("decrypted"))
+		case "TrentService.GenerateDataKey":
+			if in.KeyId != "alias/foo" || in.KeySpec != defaultKMSKeySpec {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			out["CiphertextBlob"] = []byte("wrapped data key")
+			out["CiphertextForRecipient"] = sealEnvelopedData(t, pub.(*rsa.PublicKey), []byte("data key"))
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	}))
+	origEndpoint := awsEndpoint
+	awsEndpoint = func(service, region string) string { return srv.URL }
+	t.Cleanup(func() {
+		awsEndpoint = origEndpoint
+		srv.Close()
+	})
+}
+
+func TestKMSHandlers(t *testing.T) {
+	a := new(recipientAttester)
+	mockKMS(t, a)
+	hashes := new(AttestationHashes)
+	decrypt := makeReqToHandler(kmsHandler("Decrypt",
+		func() kmsRequest { return new(kmsDecryptRequest) }, a, hashes))
+	dataKey := makeReqToHandler(kmsHandler("GenerateDataKey",
+		func() kmsRequest { return new(kmsDataKeyRequest) }, a, hashes))
+
+	var resp kmsResponse
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	res := decrypt(http.MethodPost, pathKMSDecrypt, strings.NewReader(`{"ciphertext_blob":"`+ciphertext+`"}`))
+	assertEqual(t, res.StatusCode, http.StatusOK)
+	failOnErr(t, json.NewDecoder(res.Body).Decode(&resp))
+	assertEqual(t, string(resp.Plaintext), "decrypted")
+	assertEqual(t, resp.KeyID, "arn:aws:kms:us-east-2:1:key/foo")
+
+	resp = kmsResponse{}
+	res = dataKey(http.MethodPost, pathKMSDataKey, strings.NewReader(`{"key_id":"alias/foo"}`))
+	assertEqual(t, res.StatusCode, http.StatusOK)
+	failOnErr(t, json.NewDecoder(res.Body).Decode(&resp))
+	assertEqual(t, string(resp.Plaintext), "data key")
+	assertEqual(t, string(resp.CiphertextBlob), "wrapped data key")
+
+	// Malformed requests never reach KMS.
+	for _, body := range []string{`{}`, `not json`} {
+		res = decrypt(http.MethodPost, pathKMSDecrypt, strings.NewReader(body))
+		assertEqual(t, res.StatusCode, http.StatusBadRequest)
+	}
+	res = dataKey(http.MethodPost, pathKMSDataKey, strings.NewReader(`{"key_id":"alias/foo","key_spec":"AES_128","number_of_bytes":16}`))
+	assertEqual(t, res.StatusCode, http.StatusBadRequest)
+
+	// KMS errors result in a bad gateway.
+	res = dataKey(http.MethodPost, pathKMSDataKey, strings.NewReader(`{"key_id":"alias/bar"}`))
+	assertEqual(t, res.StatusCode, http.StatusBadGateway)
+}
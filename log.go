@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// The output formats of our log messages.
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var (
+	errCfgBadLogLevel  = errors.New("given config has unknown log level")
+	errCfgBadLogFormat = errors.New("given config has unknown log format")
+
+	// logLevel holds the minimum level of the messages that we log.  Unlike
+	// the log format, the level can change at runtime.
+	logLevel  = new(slog.LevelVar)
+	logFormat = logFormatText
+	elog      = newLogger(os.Stderr, logFormat)
+	// logShip is our log shipper, if enabled, which runs until we close
+	// logShipStop.
+	logShip         *logShipper
+	logShipStop     chan struct{}
+	logShipStopOnce sync.Once
+)
+
+// newHandlerOptions returns the options of our log handlers: they record the
+// source of each message, honor our current log level, and redact secrets.
+func newHandlerOptions() *slog.HandlerOptions {
+	return &slog.HandlerOptions{AddSource: true, Level: logLevel, ReplaceAttr: redactAttr}
+}
+
+// newLogger returns a logger that writes messages of at least our current log
+// level in the given format to the given writer.  The logger also keeps the
+// most recent messages for crash reports.
+func newLogger(w io.Writer, format string) *slog.Logger {
+	opts := newHandlerOptions()
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if format == logFormatJSON {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(teeHandler{h, recentLogs.handler()})
+}
+
+// parseLogLevel parses the given log level: "debug", "info", "warn", or
+// "error", in any case.  The empty string maps to "info".
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("%w: %q", errCfgBadLogLevel, s)
+	}
+	return level, nil
+}
+
+// validateLogging returns an error if the config's log level, log format, or
+// log shipping protocol is unknown.
+func (c *Config) validateLogging() error {
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	switch c.LogFormat {
+	case "", logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("%w: %q", errCfgBadLogFormat, c.LogFormat)
+	}
+	switch c.LogVsockProtocol {
+	case "", logProtoFramed, logProtoSyslog:
+	default:
+		return fmt.Errorf("%w: %q", errCfgBadLogProto, c.LogVsockProtocol)
+	}
+	return nil
+}
+
+// configureLogging sets our log level and log format according to the given,
+// validated config, and starts our log shipper if the config asks for it.
+func configureLogging(c *Config) {
+	level, _ := parseLogLevel(c.LogLevel)
+	logLevel.Set(level)
+	format := c.LogFormat
+	if format == "" {
+		format = logFormatText
+	}
+	startShipper := c.LogVsockPort != 0 && logShip == nil
+	if format == logFormat && !startShipper {
+		return
+	}
+
+	logFormat = format
+	if startShipper {
+		logShip = newLogShipper(c.LogVsockProtocol, dialHostVsock(c.HostCID, c.LogVsockPort))
+		logShipStop = make(chan struct{})
+		go logShip.run(logShipStop)
+	}
+	if logShip != nil {
+		elog = newShippingLogger(os.Stderr, format, logShip)
+	} else {
+		elog = newLogger(os.Stderr, format)
+	}
+}
+
+// stopLogShipper stops our log shipper, if enabled, and waits until it has
+// shipped the records that it still had queued, or until the given context
+// expires.
+func stopLogShipper(ctx context.Context) error {
+	if logShip == nil {
+		return nil
+	}
+	logShipStopOnce.Do(func() { close(logShipStop) })
+	select {
+	case <-logShip.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fatal logs the given message and attributes at the error level, sends a
+// crash report to the EC2 host if enabled, and terminates nitriding.
+func fatal(msg string, args ...any) {
+	var pcs [1]uintptr
+	// Skip runtime.Callers and fatal, so the message points to our caller.
+	runtime.Callers(2, pcs[:])
+	r := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	r.Add(args...)
+	_ = elog.Handler().Handle(context.Background(), r)
+	sendCrashReport(msg, debug.Stack())
+	os.Exit(1)
+}
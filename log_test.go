@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for s, expected := range map[string]slog.Level{
+		"":      slog.LevelInfo,
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		level, err := parseLogLevel(s)
+		failOnErr(t, err)
+		assertEqual(t, level, expected)
+	}
+	if _, err := parseLogLevel("verbose"); !errors.Is(err, errCfgBadLogLevel) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadLogLevel, err)
+	}
+
+	c := &Config{LogFormat: "xml"}
+	if err := c.validateLogging(); !errors.Is(err, errCfgBadLogFormat) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadLogFormat, err)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	logLevel.Set(slog.LevelWarn)
+
+	var buf bytes.Buffer
+	l := newLogger(&buf, logFormatJSON)
+	l.Info("dropped")
+	assertEqual(t, buf.Len(), 0)
+
+	l.Warn("kept", "foo", "bar")
+	var entry map[string]any
+	failOnErr(t, json.Unmarshal(buf.Bytes(), &entry))
+	assertEqual(t, entry["msg"], "kept")
+	assertEqual(t, entry["level"], "WARN")
+	assertEqual(t, entry["foo"], "bar")
+}
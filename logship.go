@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdlayher/vsock"
+)
+
+const (
+	// The protocols that our log shipper can speak with the host-side
+	// collector.  The framed protocol prefixes each JSON-encoded log record
+	// with its length as a 4-byte, big-endian integer.  The syslog protocol
+	// sends RFC 5424 messages using the octet-counting framing of RFC 6587,
+	// which rsyslog and syslog-ng understand.
+	logProtoFramed = "framed"
+	logProtoSyslog = "syslog"
+
+	// The number of log records that we buffer while the collector is slow or
+	// unreachable.  Once the buffer is full, we drop new records instead of
+	// blocking nitriding.
+	logShipBufLen = 4096
+	// How long we wait for the collector to accept a record before we consider
+	// the connection dead.
+	logShipWriteTimeout = 10 * time.Second
+	// The bounds of our exponential backoff when (re-)connecting to the
+	// collector.
+	logShipMinBackoff = time.Second
+	logShipMaxBackoff = 30 * time.Second
+
+	// The syslog facility "daemon".
+	syslogFacility = 3
+)
+
+var errCfgBadLogProto = errors.New("given config has unknown log shipping protocol")
+
+// logShipper streams log records to a collector on the EC2 host.  Records are
+// queued in a bounded buffer, so a slow or absent collector never blocks
+// nitriding.  Instead, we count the records that we had to drop, and tell the
+// collector about them once it catches up.
+type logShipper struct {
+	records  chan []byte
+	dropped  atomic.Uint64
+	protocol string
+	dial     func() (net.Conn, error)
+	done     chan struct{} // Closed once run returns.
+}
+
+// newLogShipper returns a new log shipper that speaks the given protocol with
+// the collector that the given function connects to.
+func newLogShipper(protocol string, dial func() (net.Conn, error)) *logShipper {
+	if protocol == "" {
+		protocol = logProtoFramed
+	}
+	return &logShipper{
+		records:  make(chan []byte, logShipBufLen),
+		protocol: protocol,
+		dial:     dial,
+		done:     make(chan struct{}),
+	}
+}
+
+// dialHostVsock returns a function that connects to the given VSOCK port on
+// the EC2 host.
+func dialHostVsock(cid, port uint32) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return vsock.Dial(cid, port, nil)
+	}
+}
+
+// encode turns the given JSON-encoded log record into a frame of our
+// protocol.
+func (s *logShipper) encode(level slog.Level, record []byte) []byte {
+	record = bytes.TrimRight(record, "\n")
+	if s.protocol == logProtoSyslog {
+		var severity int
+		switch {
+		case level >= slog.LevelError:
+			severity = 3
+		case level >= slog.LevelWarn:
+			severity = 4
+		case level >= slog.LevelInfo:
+			severity = 6
+		default:
+			severity = 7
+		}
+		msg := fmt.Sprintf("<%d>1 %s - nitriding %d - - %s",
+			syslogFacility*8+severity,
+			time.Now().UTC().Format(time.RFC3339Nano),
+			os.Getpid(),
+			record)
+		return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+	}
+
+	return lengthPrefixed(record)
+}
+
+// send queues the given log record for shipping, or drops it if our buffer is
+// full.
+func (s *logShipper) send(level slog.Level, record []byte) {
+	if !s.enqueue(s.encode(level, record)) {
+		s.dropped.Add(1)
+	}
+}
+
+// enqueue queues the given frame for shipping, and returns false if our
+// buffer is full.
+func (s *logShipper) enqueue(frame []byte) bool {
+	select {
+	case s.records <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// run ships queued log records to the collector until the given channel is
+// closed, and then flushes the records that are still queued.  If the
+// collector is unreachable, we keep trying to reconnect.
+func (s *logShipper) run(stop chan struct{}) {
+	var (
+		conn    net.Conn
+		pending []byte
+		backoff = logShipMinBackoff
+	)
+	defer close(s.done)
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	for {
+		if pending == nil {
+			select {
+			case <-stop:
+				conn = s.flush(conn, nil)
+				return
+			case pending = <-s.records:
+			}
+		}
+
+		if conn == nil {
+			var err error
+			if conn, err = s.dial(); err != nil {
+				// We cannot use our logger here because its messages would
+				// end up in our own buffer.
+				fmt.Fprintf(os.Stderr, "Failed to connect to log collector: %v\n", err)
+				select {
+				case <-stop:
+					conn = s.flush(nil, pending)
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(2*backoff, logShipMaxBackoff)
+				continue
+			}
+			backoff = logShipMinBackoff
+		}
+
+		// Tell the collector if we had to drop log records.
+		if n := s.dropped.Swap(0); n > 0 {
+			note := fmt.Sprintf(`{"time":%q,"level":"WARN","msg":"Dropped log records.","dropped":%d}`,
+				time.Now().UTC().Format(time.RFC3339Nano), n)
+			pending = append(s.encode(slog.LevelWarn, []byte(note)), pending...)
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(logShipWriteTimeout))
+		if _, err := conn.Write(pending); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to ship logs: %v\n", err)
+			_ = conn.Close()
+			conn = nil
+			continue
+		}
+		pending = nil
+	}
+}
+
+// flush ships the given pending frame and the records that are still queued
+// over the given connection, or over a new one if it's nil, and returns the
+// connection.  Unlike run, flush gives up on the first error: we are
+// stopping, and a collector that cannot keep up shouldn't keep us from doing
+// so.
+func (s *logShipper) flush(conn net.Conn, pending []byte) net.Conn {
+	if conn == nil {
+		var err error
+		if conn, err = s.dial(); err != nil {
+			return nil
+		}
+	}
+	for {
+		if pending == nil {
+			select {
+			case pending = <-s.records:
+			default:
+				return conn
+			}
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(logShipWriteTimeout))
+		if _, err := conn.Write(pending); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to flush logs: %v\n", err)
+			return conn
+		}
+		pending = nil
+	}
+}
+
+// shipHandler is an slog.Handler that JSON-encodes log records and hands them
+// to our log shipper.
+type shipHandler struct {
+	shipper *logShipper
+	opts    *slog.HandlerOptions
+	// The WithAttrs and WithGroup calls that we have to replay on each
+	// record's JSON handler.
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *shipHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+func (h *shipHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	var jh slog.Handler = slog.NewJSONHandler(&buf, h.opts)
+	for _, f := range h.with {
+		jh = f(jh)
+	}
+	if err := jh.Handle(ctx, r); err != nil {
+		return err
+	}
+	h.shipper.send(r.Level, buf.Bytes())
+	return nil
+}
+
+func (h *shipHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(jh slog.Handler) slog.Handler { return jh.WithAttrs(attrs) })
+}
+
+func (h *shipHandler) WithGroup(name string) slog.Handler {
+	return h.extend(func(jh slog.Handler) slog.Handler { return jh.WithGroup(name) })
+}
+
+func (h *shipHandler) extend(f func(slog.Handler) slog.Handler) *shipHandler {
+	with := append(h.with[:len(h.with):len(h.with)], f)
+	return &shipHandler{shipper: h.shipper, opts: h.opts, with: with}
+}
+
+// teeHandler is an slog.Handler that passes log records to several handlers.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// newShippingLogger returns a logger that writes log records in the given
+// format to the given writer, and also hands them to the given log shipper.
+func newShippingLogger(w io.Writer, format string, s *logShipper) *slog.Logger {
+	opts := newHandlerOptions()
+	local := newLogger(w, format).Handler()
+	return slog.New(teeHandler{local, &shipHandler{shipper: s, opts: opts}})
+}
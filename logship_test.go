@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogShipperFramed(t *testing.T) {
+	host, enclave := net.Pipe()
+	defer host.Close()
+	s := newLogShipper("", func() (net.Conn, error) { return enclave, nil })
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.run(stop)
+
+	l := newShippingLogger(io.Discard, logFormatText, s)
+	l.Info("Hello.", "foo", "bar")
+
+	var length uint32
+	failOnErr(t, binary.Read(host, binary.BigEndian, &length))
+	record := make([]byte, length)
+	_, err := io.ReadFull(host, record)
+	failOnErr(t, err)
+
+	var entry map[string]any
+	failOnErr(t, json.Unmarshal(record, &entry))
+	assertEqual(t, entry["msg"], "Hello.")
+	assertEqual(t, entry["foo"], "bar")
+}
+
+func TestLogShipperSyslog(t *testing.T) {
+	s := newLogShipper(logProtoSyslog, nil)
+	frame := string(s.encode(slog.LevelWarn, []byte(`{"msg":"Hello."}`+"\n")))
+
+	rawLen, msg, _ := strings.Cut(frame, " ")
+	length, err := strconv.Atoi(rawLen)
+	failOnErr(t, err)
+	assertEqual(t, length, len(msg))
+	// Facility "daemon" (3) and severity "warning" (4) result in priority 28.
+	if !strings.HasPrefix(msg, "<28>1 ") || !strings.HasSuffix(msg, ` - - {"msg":"Hello."}`) {
+		t.Fatalf("Unexpected syslog message: %q", msg)
+	}
+}
+
+func TestLogShipperDrops(t *testing.T) {
+	// Without a running shipper, the buffer fills up and we must drop records
+	// instead of blocking.
+	s := newLogShipper("", nil)
+	for i := 0; i < logShipBufLen+10; i++ {
+		s.send(slog.LevelInfo, []byte("{}"))
+	}
+	assertEqual(t, s.dropped.Load(), uint64(10))
+}
+
+func TestLogShipperFlush(t *testing.T) {
+	host, enclave := net.Pipe()
+	defer host.Close()
+	s := newLogShipper("", func() (net.Conn, error) { return enclave, nil })
+	l := newShippingLogger(io.Discard, logFormatText, s)
+	for i := 0; i < 3; i++ {
+		l.Info("Stopping.", "i", i)
+	}
+
+	// Records that are still queued when we stop must be shipped.
+	stop := make(chan struct{})
+	close(stop)
+	go s.run(stop)
+	for i := 0; i < 3; i++ {
+		var length uint32
+		failOnErr(t, binary.Read(host, binary.BigEndian, &length))
+		_, err := io.CopyN(io.Discard, host, int64(length))
+		failOnErr(t, err)
+	}
+	<-s.done
+}
+
+func TestStopLogShipper(t *testing.T) {
+	defer func(s *logShipper, stop chan struct{}) {
+		logShip, logShipStop, logShipStopOnce = s, stop, sync.Once{}
+	}(logShip, logShipStop)
+
+	// Our collector never reads, so the flush cannot complete, and we must
+	// give up once our context expires.
+	host, enclave := net.Pipe()
+	defer host.Close()
+	logShip = newLogShipper("", func() (net.Conn, error) { return enclave, nil })
+	logShipStop, logShipStopOnce = make(chan struct{}), sync.Once{}
+	logShip.send(slog.LevelInfo, []byte("{}"))
+	go logShip.run(logShipStop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := stopLogShipper(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error %v but got %v.", context.DeadlineExceeded, err)
+	}
+
+	// Once the collector reads, the shipper stops.
+	go func() { _, _ = io.Copy(io.Discard, host) }()
+	failOnErr(t, stopLogShipper(context.Background()))
+}
@@ -1,21 +1,26 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"flag"
-	"io"
-	"log"
+	"fmt"
 	"math"
 	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	elog      = log.New(os.Stderr, "nitriding: ", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
 	inEnclave = false
+	// version and gitCommit are set at build time via -ldflags; see our
+	// Makefile.
+	version   = "devel"
+	gitCommit = "unknown"
 )
 
 func init() {
@@ -33,9 +38,40 @@ func init() {
 }
 
 func main() {
+	defer reportPanic()
+	// "nitriding bench" drives load against an enclave instead of running one.
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:], os.Stdout); err != nil && !errors.Is(err, flag.ErrHelp) {
+			fatal("Benchmark failed.", "error", err)
+		}
+		return
+	}
+	// "nitriding verification-bundle" pins an enclave for non-Go verifiers.
+	if len(os.Args) > 1 && os.Args[1] == "verification-bundle" {
+		if err := runVerificationBundle(os.Args[2:], os.Stdout); err != nil && !errors.Is(err, flag.ErrHelp) {
+			fatal("Failed to fetch verification bundle.", "error", err)
+		}
+		return
+	}
 	var fqdn, fqdnLeader, appURL, appWebSrv, appCmd, prometheusNamespace, mockCertFp string
-	var extPubPort, extPrivPort, intPort, hostProxyPort, prometheusPort uint
-	var useACME, waitForApp, useProfiling, useVsockForExtPort, disableKeepAlives, debug bool
+	var corsOrigins, corsMethods, intAuthTokenFile, grpcSocket, grpcSocketMode, accessLogSkip, referrerPolicy, csp, compressTypes, indexTmplFile, configFile, appPrereqs string
+	var profile, acmeDirURL, tlsMinVersion, logLevel, logFormat, logVsockProto, otlpEndpoint, tapSubnet string
+	var deliveredSecrets, deliveryPCRs, roughtimeServer, roughtimeKey, appSecrets, appSecretsDir string
+	var appSecretInject, appSecretsTmpfs, shutdownSeq, apps, appHealthURL, appHealthCmd, lifecycleHooks string
+	var vaultAddr, vaultAuthPath, vaultRole, spireServer, spireTrustDomain, spireBundleFile string
+	var databases, databaseCAFile, eventSink, dnsUpstreams, hostOverrides string
+	var sealedStateKMSKey, sealedStateStore, restartCounter string
+	var sigstoreBundle, sigstoreArtifact, sigstoreIdentity, sigstoreIssuer, sigstoreRootsFile, sigstoreRekorKeyFile, imageMetadataFile string
+	var acmeDNSProvider, acmeDNSZone, acmeDNSServer, acmeDNSKeyName, acmeDNSSecret string
+	var torControlAddr, torControlPassword, onionKey string
+	var extPubPort, extPrivPort, intPort, hostProxyPort, hostCID, prometheusPort, logVsockPort, hostHbPort, hostTimePort, crashPort, sealedLogPort, uid, gid, grpcSocketUID, grpcSocketGID, powBits, overloadMem, overloadCPU, appCPUWeight uint
+	var appMaxAddrSpace, appMaxFiles uint64
+	var maxReqBodyLen int64
+	var compressLevel, appHealthFailures, tapQueues, goMemLimitPercent int
+	var useACME, waitForApp, useProfiling, useVsockForExtPort, disableKeepAlives, debug, accessLog, disableSecHeaders, auditLog, seccomp, lockMemory, provisioning, requireFIPS, oidcTokens, acmeWildcard, acmeTempCert, eventAuditLog, onionService, ohttpGateway, privacyPass bool
+	var disableGetState, disableSetState, disableIndexPage, autoTune, egressStats, dnsCache bool
+	var readHeaderTimeout, readTimeout, writeTimeout, idleTimeout, corsMaxAge, hstsMaxAge, hostHbInterval, reseedInterval, timeSyncInterval time.Duration
+	var drainTimeout, appStopTimeout, appHealthInterval, appHealthTimeout, hookTimeout time.Duration
 	var err error
 
 	flag.StringVar(&fqdn, "fqdn", "",
@@ -47,7 +83,37 @@ func main() {
 	flag.StringVar(&appWebSrv, "appwebsrv", "",
 		"Enclave-internal HTTP server of the enclave application (e.g., \"http://127.0.0.1:8081\").")
 	flag.StringVar(&appCmd, "appcmd", "",
-		"Launch enclave application via the given command.")
+		"Launch enclave application via the given command once nitriding is ready, and restart it if it crashes.")
+	flag.StringVar(&apps, "apps", "",
+		"Comma-separated <name>[?after=<name>&restart=<policy>]:<command> processes that nitriding launches instead of -appcmd.")
+	flag.Uint64Var(&appMaxAddrSpace, "app-max-addr-space", 0,
+		"Address space limit, in MiB, of each of the application's processes.  Unlimited by default.")
+	flag.Uint64Var(&appMaxFiles, "app-max-files", 0,
+		"Open file limit of each of the application's processes.  Unlimited by default.")
+	flag.UintVar(&appCPUWeight, "app-cpu-weight", 0,
+		"CPU weight (1-10000) of the application's cgroup, relative to the default of 100.  Requires cgroup v2.")
+	flag.StringVar(&appHealthURL, "app-health-url", "",
+		"Enclave-internal URL (e.g., \"http://127.0.0.1:8081/health\") that nitriding probes to restart the application if it's unhealthy.")
+	flag.StringVar(&appHealthCmd, "app-health-cmd", "",
+		"Command that nitriding runs to probe the application's health, as an alternative to -app-health-url.")
+	flag.DurationVar(&appHealthInterval, "app-health-interval", 0,
+		fmt.Sprintf("How often nitriding probes the application's health.  Defaults to %s.", defaultAppHealthInterval))
+	flag.DurationVar(&appHealthTimeout, "app-health-timeout", 0,
+		fmt.Sprintf("How long a probe of the application's health may take.  Defaults to %s.", defaultAppHealthTimeout))
+	flag.IntVar(&appHealthFailures, "app-health-failures", 0,
+		fmt.Sprintf("Consecutive failed probes after which nitriding restarts the application.  Defaults to %d.", defaultAppHealthFailures))
+	flag.StringVar(&lifecycleHooks, "lifecycle-hooks", "",
+		"Comma-separated <point>:<command> hooks that nitriding runs at the lifecycle points after-cert, after-keys, and before-serve.")
+	flag.DurationVar(&hookTimeout, "hook-timeout", 0,
+		fmt.Sprintf("How long each lifecycle hook may take.  Defaults to %s.", defaultHookTimeout))
+	flag.StringVar(&appPrereqs, "app-prereqs", "",
+		"Comma-separated prerequisites that must be met before -appcmd starts: cert, keys, time, svid, vault, and secrets.  Defaults to cert,keys.")
+	flag.StringVar(&shutdownSeq, "shutdown-sequence", "",
+		"Comma-separated order of the shutdown steps drain, app, and wipe.  Defaults to drain,app,wipe.")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 0,
+		fmt.Sprintf("How long to wait for in-flight public requests when shutting down.  Defaults to %s.", defaultDrainTimeout))
+	flag.DurationVar(&appStopTimeout, "app-stop-timeout", 0,
+		fmt.Sprintf("How long -appcmd has to exit after SIGTERM before nitriding kills it.  Defaults to %s.", defaultAppStopTimeout))
 	flag.StringVar(&prometheusNamespace, "prometheus-namespace", "",
 		"Prometheus namespace for exported metrics.")
 	flag.UintVar(&extPubPort, "ext-pub-port", 443,
@@ -62,6 +128,20 @@ func main() {
 		"Nitriding's enclave-internal HTTP port.  Only used by the enclave application.")
 	flag.UintVar(&hostProxyPort, "host-proxy-port", 1024,
 		"Port of proxy application running on EC2 host.")
+	flag.UintVar(&hostCID, "host-cid", 0,
+		fmt.Sprintf("VSOCK context ID of the EC2 host that runs the proxy application.  Defaults to %d.", parentCID))
+	flag.StringVar(&tapSubnet, "tap-subnet", "",
+		fmt.Sprintf("IPv4 subnet of the TAP interface; nitriding uses its first address as gateway and its second address as its own.  Defaults to %s.", defaultTapSubnet))
+	flag.IntVar(&tapQueues, "tap-queues", 1,
+		"Number of TAP device queues, each of which nitriding forwards on its own vCPU.")
+	flag.BoolVar(&egressStats, "egress-stats", false,
+		"Count the enclave's outbound traffic by destination, and expose the counters at /enclave/egress and as Prometheus metrics.")
+	flag.BoolVar(&dnsCache, "dns-cache", false,
+		"Run a caching DNS resolver at 127.0.0.1:53 and point the enclave's resolv.conf to it.")
+	flag.StringVar(&dnsUpstreams, "dns-upstreams", "",
+		"Comma-separated IP:port pairs of the resolvers that -dns-cache forwards to.  Defaults to the host proxy's resolver.")
+	flag.StringVar(&hostOverrides, "host-overrides", "",
+		"Comma-separated hostname=IP pairs that nitriding writes to /etc/hosts and that -dns-cache answers itself.")
 	flag.UintVar(&prometheusPort, "prometheus-port", 0,
 		"Port to expose Prometheus metrics at.")
 	flag.BoolVar(&useProfiling, "profile", false,
@@ -74,133 +154,531 @@ func main() {
 		"Print extra debug messages and use dummy attester for testing outside enclaves.")
 	flag.StringVar(&mockCertFp, "mock-cert-fp", "",
 		"Mock certificate fingerprint to use in attestation documents (hexadecimal)")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 0,
+		fmt.Sprintf("Maximum duration for reading the header of HTTP requests (default %s, or stricter with -config-profile prod).", defaultReadHeaderTimeout))
+	flag.DurationVar(&readTimeout, "read-timeout", 0,
+		fmt.Sprintf("Maximum duration for reading entire HTTP requests, including the body (default %s, or stricter with -config-profile prod).  Does not apply to requests for the enclave application.", defaultReadTimeout))
+	flag.DurationVar(&writeTimeout, "write-timeout", 0,
+		fmt.Sprintf("Maximum duration before timing out writes of HTTP responses (default %s, or stricter with -config-profile prod).  Does not apply to requests for the enclave application.", defaultWriteTimeout))
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0,
+		fmt.Sprintf("Maximum duration to wait for the next request on keep-alive connections (default %s, or stricter with -config-profile prod).", defaultIdleTimeout))
+	flag.StringVar(&corsOrigins, "cors-origins", "",
+		"Comma-separated list of origins that may make cross-origin requests to nitriding's endpoints (e.g., \"https://example.com\").")
+	flag.StringVar(&corsMethods, "cors-methods", "",
+		"Comma-separated list of HTTP methods that cross-origin requests may use.")
+	flag.DurationVar(&corsMaxAge, "cors-max-age", 0,
+		"Duration for which browsers may cache responses to CORS preflight requests.")
+	flag.Int64Var(&maxReqBodyLen, "max-body-len", defaultMaxReqBodyLen,
+		"Maximum length (in bytes) of request bodies that nitriding accepts.")
+	flag.StringVar(&intAuthTokenFile, "int-auth-token-file", "",
+		"Require a bearer token for the enclave-internal Web server and write the token to the given file.")
+	flag.StringVar(&grpcSocket, "grpc-socket", "",
+		"Offer the enclave-internal API as a gRPC service on the Unix socket at the given path.  A leading '@' places the socket in the abstract namespace.")
+	flag.StringVar(&grpcSocketMode, "grpc-socket-mode", "",
+		fmt.Sprintf("Permissions of the gRPC socket, in octal.  Defaults to %#o.", defaultGRPCSocketMode))
+	flag.UintVar(&grpcSocketUID, "grpc-socket-uid", 0,
+		"User ID that owns the gRPC socket.  Requires -grpc-socket-gid.  Defaults to -uid.")
+	flag.UintVar(&grpcSocketGID, "grpc-socket-gid", 0,
+		"Group ID that owns the gRPC socket.  Requires -grpc-socket-uid.  Defaults to -gid.")
+	flag.BoolVar(&accessLog, "access-log", false,
+		"Write structured, JSON-encoded access logs to stderr.  Always enabled in debug mode.")
+	flag.StringVar(&accessLogSkip, "access-log-skip", "",
+		"Comma-separated list of URL paths to exclude from access logs (e.g., \"/health\").")
+	flag.BoolVar(&disableSecHeaders, "disable-security-headers", false,
+		"Do not set security headers (HSTS, CSP, etc.) on the public Web server's responses.")
+	flag.DurationVar(&hstsMaxAge, "hsts-max-age", defaultHSTSMaxAge,
+		"Value of the HSTS header's max-age directive.  A negative value disables HSTS.")
+	flag.StringVar(&referrerPolicy, "referrer-policy", defaultReferrerPolicy,
+		"Referrer-Policy header of nitriding's public endpoints.")
+	flag.StringVar(&csp, "csp", defaultCSP,
+		"Content-Security-Policy header of nitriding's public endpoints.")
+	flag.IntVar(&compressLevel, "compress-level", 0,
+		"Compress the public Web server's responses at the given level in [1, 9].  Disabled by default.")
+	flag.StringVar(&compressTypes, "compress-types", "",
+		"Comma-separated list of content types to compress.  Defaults to common text-based types.")
+	flag.StringVar(&indexTmplFile, "index-template", "",
+		"File containing an HTML template for the enclave's index page.")
+	flag.BoolVar(&disableGetState, "disable-get-state", false,
+		"Remove the enclave-internal endpoint that returns the application's state.")
+	flag.BoolVar(&disableSetState, "disable-set-state", false,
+		"Remove the enclave-internal endpoint that sets the application's state.")
+	flag.BoolVar(&disableIndexPage, "disable-index-page", false,
+		"Remove the enclave's index page.")
+	flag.StringVar(&profile, "config-profile", "",
+		"Preset of defaults: \"dev\", \"staging\", or \"prod\".")
+	flag.StringVar(&acmeDirURL, "acme-directory", "",
+		"Directory URL of the ACME server.  Defaults to Let's Encrypt.")
+	flag.StringVar(&acmeDNSProvider, "acme-dns-provider", "",
+		"Solve ACME's DNS-01 challenge via \"route53\", \"cloudflare\", or \"rfc2136\".")
+	flag.StringVar(&acmeDNSZone, "acme-dns-zone", "",
+		"DNS zone that contains the FQDN: hosted zone ID, Cloudflare zone ID, or zone name.")
+	flag.StringVar(&acmeDNSServer, "acme-dns-server", "",
+		"Name server (host:port) that accepts RFC 2136 updates.")
+	flag.StringVar(&acmeDNSKeyName, "acme-dns-key-name", "",
+		"Name of the TSIG key that signs RFC 2136 updates.")
+	flag.StringVar(&acmeDNSSecret, "acme-dns-secret", "",
+		"Cloudflare API token or Base64-encoded TSIG secret.  May be a secret reference.")
+	flag.BoolVar(&acmeWildcard, "acme-wildcard", false,
+		"Add a wildcard for the FQDN to the certificate.  Requires -acme-dns-provider.")
+	flag.BoolVar(&acmeTempCert, "acme-temp-cert", false,
+		"Serve a temporary self-signed certificate until nitriding has its ACME certificate.")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "",
+		"Minimum TLS version that nitriding accepts: \"1.2\" (the default) or \"1.3\".")
+	flag.StringVar(&logLevel, "log-level", "",
+		"Minimum level of log messages: \"debug\", \"info\" (the default), \"warn\", or \"error\".")
+	flag.StringVar(&logFormat, "log-format", "",
+		"Format of log messages: \"text\" (the default) or \"json\".")
+	flag.UintVar(&logVsockPort, "log-vsock-port", 0,
+		"VSOCK port on the EC2 host that nitriding ships its logs to.  Disabled by default.")
+	flag.StringVar(&logVsockProto, "log-vsock-protocol", "",
+		"Protocol for shipping logs: \"framed\" (the default) or \"syslog\".")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"Base URL of an OpenTelemetry collector that nitriding exports traces to, e.g., \"http://collector:4318\".")
+	flag.BoolVar(&auditLog, "audit-log", false,
+		"Keep an audit log of state-changing operations on the internal API.")
+	flag.UintVar(&hostHbPort, "host-heartbeat-port", 0,
+		"VSOCK port on the EC2 host that nitriding sends heartbeats to.  Disabled by default.")
+	flag.DurationVar(&hostHbInterval, "host-heartbeat-interval", 0,
+		fmt.Sprintf("How often nitriding sends heartbeats to the EC2 host.  Defaults to %s.", defaultHostHeartbeatInterval))
+	flag.UintVar(&crashPort, "crash-report-port", 0,
+		"VSOCK port on the EC2 host that nitriding sends crash reports to.  Disabled by default.")
+	flag.BoolVar(&seccomp, "seccomp", false,
+		"Restrict nitriding to an allowlist of system calls after startup.  Cannot be combined with -appcmd.")
+	flag.UintVar(&uid, "uid", 0,
+		"Unprivileged user ID that nitriding switches to after startup.  Requires -gid.  Disabled by default.")
+	flag.UintVar(&gid, "gid", 0,
+		"Unprivileged group ID that nitriding switches to after startup.  Requires -uid.")
+	flag.DurationVar(&reseedInterval, "entropy-reseed-interval", 0,
+		fmt.Sprintf("How often nitriding reseeds the kernel's entropy pool from the NSM.  Defaults to %s.", defaultEntropyReseedInterval))
+	flag.BoolVar(&lockMemory, "lock-memory", false,
+		"Lock nitriding's memory into RAM, so key material is never swapped to disk.")
+	flag.BoolVar(&autoTune, "auto-tune", false,
+		"Tune GOMAXPROCS, Go's memory limit, and file descriptor limits to the enclave's vCPUs and memory.")
+	flag.IntVar(&goMemLimitPercent, "go-mem-limit-percent", 0,
+		fmt.Sprintf("Percentage of the enclave's memory that -auto-tune sets as Go's memory limit.  Defaults to %d.", defaultGoMemLimitPercent))
+	flag.BoolVar(&provisioning, "provisioning", false,
+		"Accept secrets that clients encrypt to an HPKE key in our attestation documents.")
+	flag.StringVar(&deliveredSecrets, "delivered-secrets", "",
+		"Comma-separated list of <name>=<secret reference> pairs that nitriding delivers to attested enclaves.")
+	flag.StringVar(&deliveryPCRs, "secret-delivery-pcrs", "",
+		"Comma-separated list of hex-encoded PCR0 values of the enclaves that nitriding delivers secrets to.")
+	flag.UintVar(&powBits, "attestation-pow-bits", 0,
+		"Difficulty, in bits, of the proof-of-work puzzle that clients must solve before requesting attestation documents.  Disabled by default.")
+	flag.StringVar(&roughtimeServer, "roughtime-server", "",
+		"Address (host:port) of a Roughtime server that nitriding obtains authenticated time from.  Disabled by default.")
+	flag.StringVar(&roughtimeKey, "roughtime-public-key", "",
+		"Base64-encoded Ed25519 public key of the Roughtime server.")
+	flag.BoolVar(&requireFIPS, "require-fips", false,
+		"Refuse to start unless nitriding's cryptography runs on a FIPS-validated module.")
+	flag.UintVar(&hostTimePort, "host-time-port", 0,
+		"VSOCK port on the EC2 host that nitriding obtains unauthenticated time from.  Cannot be combined with -roughtime-server.  Disabled by default.")
+	flag.DurationVar(&timeSyncInterval, "time-sync-interval", 0,
+		fmt.Sprintf("How often nitriding synchronizes its time.  Defaults to %s.", defaultTimeSyncInterval))
+	flag.UintVar(&overloadMem, "overload-mem-percent", 0,
+		"Memory utilization, in percent, above which nitriding sheds low-priority requests.  Disabled by default.")
+	flag.UintVar(&overloadCPU, "overload-cpu-percent", 0,
+		"CPU utilization, in percent, above which nitriding sheds low-priority requests.  Disabled by default.")
+	flag.StringVar(&appSecrets, "app-secrets", "",
+		"Comma-separated list of <name>=asm://<secret-id> pairs of KMS-encrypted secrets that nitriding fetches for the enclave application.")
+	flag.StringVar(&appSecretsDir, "app-secrets-dir", "",
+		"Directory to write the secrets of -app-secrets to.  By default, the application fetches them via the internal API.")
+	flag.StringVar(&appSecretInject, "app-secret-inject", "",
+		"Comma-separated list of <name>=env:<variable> or <name>=file entries that inject application or provisioned secrets into the application of -appcmd.")
+	flag.StringVar(&appSecretsTmpfs, "app-secrets-tmpfs", "",
+		"Directory to mount a private tmpfs at, for the secrets that -app-secret-inject writes to files.")
+	flag.StringVar(&vaultAddr, "vault-addr", "",
+		"Address of a HashiCorp Vault server that nitriding logs in to using an attestation document (e.g., \"https://vault.example.com:8200\").")
+	flag.StringVar(&vaultAuthPath, "vault-auth-path", "",
+		fmt.Sprintf("Path of the Vault auth method that verifies attestation documents.  Defaults to %q.", defaultVaultAuthPath))
+	flag.StringVar(&vaultRole, "vault-role", "",
+		"Vault role that nitriding logs in as.  Required if -vault-addr is set.")
+	flag.StringVar(&spireServer, "spire-server", "",
+		"Address (host:port) of a SPIRE server that nitriding obtains an X.509 SVID from using an attestation document.")
+	flag.StringVar(&spireTrustDomain, "spire-trust-domain", "",
+		"SPIFFE trust domain of the SPIRE server (e.g., \"example.org\").  Required if -spire-server is set.")
+	flag.StringVar(&spireBundleFile, "spire-trust-bundle", "",
+		"File containing the PEM-encoded trust bundle of the SPIRE server's trust domain.  Required if -spire-server is set.")
+	flag.BoolVar(&oidcTokens, "oidc-tokens", false,
+		"Mint short-lived JWTs for the enclave application, signed by a key that's included in attestation documents.")
+	flag.StringVar(&databases, "databases", "",
+		"Comma-separated list of <name>=<protocol>://[<user>@]<host>:<port> databases whose TLS and credentials nitriding sets up for the enclave application.")
+	flag.StringVar(&databaseCAFile, "database-ca", "",
+		"File containing the PEM-encoded CA certificates that database servers must chain to.  Required if -databases is set.")
+	flag.StringVar(&sealedStateKMSKey, "sealed-state-kms-key", "",
+		"ID, ARN, or alias of the KMS key that nitriding encrypts the enclave application's sealed state under.  Required if -sealed-state-store is set.")
+	flag.StringVar(&sealedStateStore, "sealed-state-store", "",
+		"Untrusted store of sealed state: s3://<bucket>[/<prefix>][?region=<region>] or vsock://<port> for a store on the EC2 host.")
+	flag.StringVar(&restartCounter, "restart-counter", "",
+		"Name of the sealed state in -sealed-state-store that holds the enclave's restart counter, which nitriding adds to attestation documents.")
+	flag.UintVar(&sealedLogPort, "sealed-log-port", 0,
+		"VSOCK port on the EC2 host that nitriding streams the enclave application's hash-chained, signed log records to.")
+	flag.StringVar(&eventSink, "event-sink", "",
+		"Message broker that nitriding forwards the enclave application's events to: sqs://<region>/<account-id>/<queue-name> or kafka://<broker>/<topic>.")
+	flag.BoolVar(&eventAuditLog, "event-audit-log", false,
+		"Forward audit log entries to -event-sink as well.  Requires -audit-log.")
+	flag.StringVar(&sigstoreBundle, "sigstore-bundle", "",
+		"Sigstore bundle over -sigstore-artifact that nitriding verifies before it starts.")
+	flag.StringVar(&sigstoreArtifact, "sigstore-artifact", "",
+		"Signed artifact, e.g., the enclave application's binary.  Required if -sigstore-bundle is set.")
+	flag.StringVar(&sigstoreIdentity, "sigstore-identity", "",
+		"Email address or URI that the signing certificate must be issued for.  Required if -sigstore-bundle is set.")
+	flag.StringVar(&sigstoreIssuer, "sigstore-issuer", "",
+		"OIDC issuer that must have vouched for -sigstore-identity.  Required if -sigstore-bundle is set.")
+	flag.StringVar(&sigstoreRootsFile, "sigstore-roots", "",
+		"File containing Fulcio's PEM-encoded root and intermediate certificates.  Required if -sigstore-bundle is set.")
+	flag.StringVar(&sigstoreRekorKeyFile, "sigstore-rekor-key", "",
+		"File containing Rekor's PEM-encoded public key.  Required if -sigstore-bundle is set.")
+	flag.StringVar(&imageMetadataFile, "image-metadata", "",
+		"File containing a JSON object with the enclave image's build metadata, which nitriding returns at "+pathImage+".")
+	flag.BoolVar(&ohttpGateway, "ohttp-gateway", false,
+		"Act as an Oblivious HTTP gateway that decapsulates requests for the application Web server (see -appwebsrv).")
+	flag.BoolVar(&privacyPass, "privacy-pass", false,
+		"Issue Privacy Pass tokens to clients, and verify them on behalf of the enclave application.")
+	flag.BoolVar(&onionService, "onion-service", false,
+		"Publish the public Web server as a Tor onion service via a Tor process that runs inside the enclave.")
+	flag.StringVar(&torControlAddr, "tor-control", defaultTorControlAddr,
+		"Address (host:port) of Tor's control port, which must be on the loopback interface.")
+	flag.StringVar(&torControlPassword, "tor-control-password", "",
+		"Password for Tor's control port.  May be a secret reference.")
+	flag.StringVar(&onionKey, "onion-key", "",
+		"Base64-encoded 32-byte Ed25519 seed of the onion service's key.  May be a secret reference.  If unset, the onion address changes with each start.")
+	flag.StringVar(&configFile, "config", "",
+		"YAML-encoded configuration file.  Cannot be combined with other flags, except -appcmd.")
 	flag.Parse()
 
-	if fqdn == "" {
-		elog.Fatalf("-fqdn must be set.")
-	}
 	if extPubPort < 1 || extPubPort > math.MaxUint16 {
-		elog.Fatalf("-extport must be in interval [1, %d]", math.MaxUint16)
+		fatal(fmt.Sprintf("-extport must be in interval [1, %d].", math.MaxUint16))
 	}
 	if extPrivPort < 1 || extPrivPort > math.MaxUint16 {
-		elog.Fatalf("-extPrivPort must be in interval [1, %d]", math.MaxUint16)
+		fatal(fmt.Sprintf("-extPrivPort must be in interval [1, %d].", math.MaxUint16))
 	}
 	if intPort < 1 || intPort > math.MaxUint16 {
-		elog.Fatalf("-intport must be in interval [1, %d]", math.MaxUint16)
+		fatal(fmt.Sprintf("-intport must be in interval [1, %d].", math.MaxUint16))
 	}
 	if hostProxyPort < 1 || hostProxyPort > math.MaxUint32 {
-		elog.Fatalf("-host-proxy-port must be in interval [1, %d]", math.MaxUint32)
+		fatal(fmt.Sprintf("-host-proxy-port must be in interval [1, %d].", math.MaxUint32))
+	}
+	if hostCID > math.MaxUint32 {
+		fatal(fmt.Sprintf("-host-cid must be in interval [0, %d].", math.MaxUint32))
+	}
+	if hostHbPort > math.MaxUint32 {
+		fatal(fmt.Sprintf("-host-heartbeat-port must be in interval [0, %d].", math.MaxUint32))
+	}
+	if hostTimePort > math.MaxUint32 {
+		fatal(fmt.Sprintf("-host-time-port must be in interval [0, %d].", math.MaxUint32))
+	}
+	if uid > math.MaxUint32 || gid > math.MaxUint32 {
+		fatal(fmt.Sprintf("-uid and -gid must be in interval [0, %d].", math.MaxUint32))
+	}
+	if grpcSocketUID > math.MaxUint32 || grpcSocketGID > math.MaxUint32 {
+		fatal(fmt.Sprintf("-grpc-socket-uid and -grpc-socket-gid must be in interval [0, %d].", math.MaxUint32))
+	}
+	var socketMode uint64
+	if grpcSocketMode != "" {
+		if socketMode, err = strconv.ParseUint(grpcSocketMode, 8, 32); err != nil {
+			fatal("-grpc-socket-mode must be an octal number.", "error", err)
+		}
+	}
+	if crashPort > math.MaxUint32 {
+		fatal(fmt.Sprintf("-crash-report-port must be in interval [0, %d].", math.MaxUint32))
+	}
+	if logVsockPort > math.MaxUint32 {
+		fatal(fmt.Sprintf("-log-vsock-port must be in interval [0, %d].", math.MaxUint32))
+	}
+	if sealedLogPort > math.MaxUint32 {
+		fatal(fmt.Sprintf("-sealed-log-port must be in interval [0, %d].", math.MaxUint32))
+	}
+	if powBits > maxPoWBits {
+		fatal(fmt.Sprintf("-attestation-pow-bits must be in interval [0, %d].", maxPoWBits))
+	}
+	if overloadMem > 100 || overloadCPU > 100 {
+		fatal("-overload-mem-percent and -overload-cpu-percent must be in interval [0, 100].")
 	}
 	if prometheusPort > math.MaxUint16 {
-		elog.Fatalf("-prometheus-port must be in interval [1, %d]", math.MaxUint16)
+		fatal(fmt.Sprintf("-prometheus-port must be in interval [1, %d].", math.MaxUint16))
+	}
+	if compressLevel < 0 || compressLevel > 9 {
+		fatal("-compress-level must be in interval [0, 9].")
+	}
+	if maxReqBodyLen < 1 {
+		fatal("-max-body-len must be positive.")
 	}
 	if prometheusPort != 0 && prometheusNamespace == "" {
-		elog.Fatalf("-prometheus-namespace must be set when Prometheus is used.")
+		fatal("-prometheus-namespace must be set when Prometheus is used.")
 	}
 
 	c := &Config{
-		FQDN:                fqdn,
-		FQDNLeader:          fqdnLeader,
-		ExtPubPort:          uint16(extPubPort),
-		ExtPrivPort:         uint16(extPrivPort),
-		IntPort:             uint16(intPort),
-		UseVsockForExtPort:  useVsockForExtPort,
-		DisableKeepAlives:   disableKeepAlives,
-		PrometheusPort:      uint16(prometheusPort),
-		PrometheusNamespace: prometheusNamespace,
-		HostProxyPort:       uint32(hostProxyPort),
-		UseACME:             useACME,
-		WaitForApp:          waitForApp,
-		UseProfiling:        useProfiling,
-		MockCertFp:          mockCertFp,
-		Debug:               debug,
+		FQDN:                   fqdn,
+		FQDNLeader:             fqdnLeader,
+		ExtPubPort:             uint16(extPubPort),
+		ExtPrivPort:            uint16(extPrivPort),
+		IntPort:                uint16(intPort),
+		UseVsockForExtPort:     useVsockForExtPort,
+		DisableKeepAlives:      disableKeepAlives,
+		PrometheusPort:         uint16(prometheusPort),
+		PrometheusNamespace:    prometheusNamespace,
+		HostProxyPort:          uint32(hostProxyPort),
+		HostCID:                uint32(hostCID),
+		TapSubnet:              tapSubnet,
+		TapQueues:              tapQueues,
+		EgressStats:            egressStats,
+		DNSCache:               dnsCache,
+		DNSUpstreams:           splitList(dnsUpstreams),
+		HostOverrides:          splitList(hostOverrides),
+		UseACME:                useACME,
+		WaitForApp:             waitForApp,
+		AppCmd:                 appCmd,
+		Apps:                   splitList(apps),
+		AppMaxAddrSpaceMiB:     appMaxAddrSpace,
+		AppMaxFiles:            appMaxFiles,
+		AppCPUWeight:           uint16(appCPUWeight),
+		AppHealthURL:           appHealthURL,
+		AppHealthCmd:           appHealthCmd,
+		AppHealthInterval:      appHealthInterval,
+		AppHealthTimeout:       appHealthTimeout,
+		AppHealthFailures:      appHealthFailures,
+		AppPrereqs:             splitList(appPrereqs),
+		LifecycleHooks:         splitList(lifecycleHooks),
+		HookTimeout:            hookTimeout,
+		ShutdownSequence:       splitList(shutdownSeq),
+		DrainTimeout:           drainTimeout,
+		AppStopTimeout:         appStopTimeout,
+		UseProfiling:           useProfiling,
+		MockCertFp:             mockCertFp,
+		Debug:                  debug,
+		ReadHeaderTimeout:      readHeaderTimeout,
+		ReadTimeout:            readTimeout,
+		WriteTimeout:           writeTimeout,
+		IdleTimeout:            idleTimeout,
+		CORSAllowedOrigins:     splitList(corsOrigins),
+		CORSAllowedMethods:     splitList(corsMethods),
+		CORSMaxAge:             corsMaxAge,
+		MaxReqBodyLen:          maxReqBodyLen,
+		IntAuthTokenFile:       intAuthTokenFile,
+		GRPCSocket:             grpcSocket,
+		GRPCSocketMode:         os.FileMode(socketMode),
+		GRPCSocketUID:          uint32(grpcSocketUID),
+		GRPCSocketGID:          uint32(grpcSocketGID),
+		AccessLog:              accessLog,
+		AccessLogSkipPaths:     splitList(accessLogSkip),
+		DisableSecurityHeaders: disableSecHeaders,
+		HSTSMaxAge:             hstsMaxAge,
+		ReferrerPolicy:         referrerPolicy,
+		ContentSecurityPolicy:  csp,
+		CompressLevel:          compressLevel,
+		CompressTypes:          splitList(compressTypes),
+		DisableGetState:        disableGetState,
+		DisableSetState:        disableSetState,
+		DisableIndexPage:       disableIndexPage,
+		Profile:                profile,
+		ACMEDirectoryURL:       acmeDirURL,
+		ACMEDNSProvider:        acmeDNSProvider,
+		ACMEDNSZone:            acmeDNSZone,
+		ACMEDNSServer:          acmeDNSServer,
+		ACMEDNSKeyName:         acmeDNSKeyName,
+		ACMEDNSSecret:          acmeDNSSecret,
+		ACMEWildcard:           acmeWildcard,
+		ACMETempCert:           acmeTempCert,
+		TLSMinVersion:          tlsMinVersion,
+		LogLevel:               logLevel,
+		LogFormat:              logFormat,
+		LogVsockPort:           uint32(logVsockPort),
+		LogVsockProtocol:       logVsockProto,
+		OTLPEndpoint:           otlpEndpoint,
+		AuditLog:               auditLog,
+		HostHeartbeatPort:      uint32(hostHbPort),
+		HostHeartbeatInterval:  hostHbInterval,
+		CrashReportPort:        uint32(crashPort),
+		Seccomp:                seccomp,
+		UID:                    uint32(uid),
+		GID:                    uint32(gid),
+		EntropyReseedInterval:  reseedInterval,
+		LockMemory:             lockMemory,
+		AutoTune:               autoTune,
+		GoMemLimitPercent:      goMemLimitPercent,
+		Provisioning:           provisioning,
+		DeliveredSecrets:       splitList(deliveredSecrets),
+		SecretDeliveryPCRs:     splitList(deliveryPCRs),
+		AttestationPoWBits:     uint8(powBits),
+		RoughtimeServer:        roughtimeServer,
+		RoughtimePublicKey:     roughtimeKey,
+		HostTimePort:           uint32(hostTimePort),
+		TimeSyncInterval:       timeSyncInterval,
+		RequireFIPS:            requireFIPS,
+		OverloadMemPercent:     uint8(overloadMem),
+		OverloadCPUPercent:     uint8(overloadCPU),
+		AppSecrets:             splitList(appSecrets),
+		AppSecretsDir:          appSecretsDir,
+		AppSecretInject:        splitList(appSecretInject),
+		AppSecretsTmpfs:        appSecretsTmpfs,
+		VaultAddr:              vaultAddr,
+		VaultAuthPath:          vaultAuthPath,
+		VaultRole:              vaultRole,
+		SpireServer:            spireServer,
+		SpireTrustDomain:       spireTrustDomain,
+		OIDCTokens:             oidcTokens,
+		Databases:              splitList(databases),
+		SealedStateKMSKey:      sealedStateKMSKey,
+		SealedStateStore:       sealedStateStore,
+		RestartCounter:         restartCounter,
+		SealedLogPort:          uint32(sealedLogPort),
+		EventSink:              eventSink,
+		EventAuditLog:          eventAuditLog,
+		SigstoreBundle:         sigstoreBundle,
+		SigstoreArtifact:       sigstoreArtifact,
+		SigstoreIdentity:       sigstoreIdentity,
+		SigstoreIssuer:         sigstoreIssuer,
+		OnionService:           onionService,
+		TorControlAddr:         torControlAddr,
+		TorControlPassword:     torControlPassword,
+		OnionKey:               onionKey,
+		OHTTPGateway:           ohttpGateway,
+		PrivacyPass:            privacyPass,
+	}
+	if indexTmplFile != "" {
+		tmpl, err := os.ReadFile(indexTmplFile)
+		if err != nil {
+			fatal("Failed to read index page template.", "error", err)
+		}
+		c.IndexTemplate = string(tmpl)
+	}
+	if spireBundleFile != "" {
+		bundle, err := os.ReadFile(spireBundleFile)
+		if err != nil {
+			fatal("Failed to read SPIRE trust bundle.", "error", err)
+		}
+		c.SpireTrustBundle = string(bundle)
+	}
+	if databaseCAFile != "" {
+		ca, err := os.ReadFile(databaseCAFile)
+		if err != nil {
+			fatal("Failed to read database CA.", "error", err)
+		}
+		c.DatabaseCA = string(ca)
+	}
+	if sigstoreRootsFile != "" {
+		roots, err := os.ReadFile(sigstoreRootsFile)
+		if err != nil {
+			fatal("Failed to read Fulcio certificates.", "error", err)
+		}
+		c.SigstoreRoots = string(roots)
+	}
+	if sigstoreRekorKeyFile != "" {
+		key, err := os.ReadFile(sigstoreRekorKeyFile)
+		if err != nil {
+			fatal("Failed to read Rekor public key.", "error", err)
+		}
+		c.SigstoreRekorKey = string(key)
+	}
+	if imageMetadataFile != "" {
+		metadata, err := os.ReadFile(imageMetadataFile)
+		if err != nil {
+			fatal("Failed to read image metadata.", "error", err)
+		}
+		c.ImageMetadata = string(metadata)
 	}
 	if appURL != "" {
 		u, err := url.Parse(appURL)
 		if err != nil {
-			elog.Fatalf("Failed to parse application URL: %v", err)
+			fatal("Failed to parse application URL.", "error", err)
 		}
 		c.AppURL = u
 	}
 	if appWebSrv != "" {
 		u, err := url.Parse(appWebSrv)
 		if err != nil {
-			elog.Fatalf("Failed to parse URL of Web server: %v", err)
+			fatal("Failed to parse URL of Web server.", "error", err)
 		}
 		c.AppWebSrv = u
 	}
-	if debug {
-		elog.Println("WARNING: Using debug mode, which must not be enabled in production!")
+	if configFile != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "config" && f.Name != "appcmd" {
+				fatal(fmt.Sprintf("-%s cannot be combined with -config.", f.Name))
+			}
+		})
+		if c, err = LoadConfig(configFile); err != nil {
+			fatal("Failed to load configuration.", "error", err)
+		}
+		if appCmd != "" {
+			c.AppCmd = appCmd
+		}
+	}
+	if c.Debug {
+		elog.Warn("Using debug mode, which must not be enabled in production!")
 	}
 
 	enclave, err := NewEnclave(c)
 	if err != nil {
-		elog.Fatalf("Failed to create enclave: %v", err)
+		fatal("Failed to create enclave.", "error", err)
 	}
 
 	if err := enclave.Start(); err != nil {
-		elog.Fatalf("Enclave terminated: %v", err)
+		fatal("Enclave terminated.", "error", err)
+	}
+	if configFile != "" {
+		go reloadOnSIGHUP(enclave, configFile)
 	}
 
 	// Nitriding supports two ways of starting the enclave application:
 	//
-	// 1) Nitriding spawns the enclave application itself, and waits for it
-	//    to terminate.
+	// 1) Nitriding spawns and supervises the enclave application itself, and
+	//    exits once the application exited for good.
 	//
 	// 2) The enclave application is started by a shell script (which also
-	//    starts nitriding).  In this case, we simply block forever.
-	if appCmd != "" {
-		f := func(s string) {
-			elog.Printf("Application says: %s", s)
-		}
-		runAppCommand(appCmd, f, f)
-	} else {
-		// Block forever.
-		<-make(chan struct{})
-	}
-	elog.Println("Exiting nitriding.")
-}
-
-// runAppCommand (i) runs the given command, (ii) waits until the command
-// finished execution, and (iii) in the meanwhile prints the command's stdout
-// and stderr.
-func runAppCommand(appCmd string, stdoutFunc, stderrFunc func(string)) {
-	elog.Printf("Invoking the enclave application.")
-	args := strings.Split(appCmd, " ")
-	cmd := exec.Command(args[0], args[1:]...)
-
-	// Print the enclave application's stderr.
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		elog.Fatalf("Failed to obtain stderr pipe for enclave application: %v", err)
-	}
-	go forwardOutput(stderr, stderrFunc, "stderr")
-
-	// Print the enclave application's stdout.
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		elog.Fatalf("Failed to obtain stdout pipe for enclave application: %v", err)
+	//    starts nitriding).  In this case, we run until we receive a signal.
+	//
+	// Either way, we shut down gracefully on SIGINT and SIGTERM, or when the
+	// application requests it via our internal API, which includes stopping
+	// the enclave application.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		elog.Info("Received signal.  Shutting down.", "signal", s.String())
+	case <-enclave.shutdownReq:
+		elog.Info("Received shutdown request.  Shutting down.")
+	case <-enclave.appExited:
 	}
-	go forwardOutput(stdout, stdoutFunc, "stdout")
-
-	if err := cmd.Start(); err != nil {
-		elog.Fatalf("Failed to start enclave application: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout())
+	defer cancel()
+	if err := enclave.Stop(ctx); err != nil {
+		elog.Error("Failed to shut down gracefully.", "error", err)
 	}
+	elog.Info("Exiting nitriding.")
+}
 
-	if err := cmd.Wait(); err != nil {
-		elog.Fatalf("Enclave application exited with non-0 exit code: %v", err)
+// reloadOnSIGHUP reloads the given configuration file whenever we receive a
+// SIGHUP, and applies the file's runtime-tunable fields to the given enclave.
+func reloadOnSIGHUP(e *Enclave, configFile string) {
+	defer reportPanic()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		c, err := LoadConfig(configFile)
+		if err == nil {
+			err = c.applyEnv(os.LookupEnv)
+		}
+		if err == nil {
+			err = e.Reload(c)
+		}
+		if err == nil {
+			raw, _ := os.ReadFile(configFile)
+			e.audit.record(auditSetConfig, callerSIGHUP, raw, 0)
+		}
+		if err != nil {
+			elog.Error("Failed to reload configuration.", "error", err)
+		}
 	}
-	elog.Println("Enclave application exited.")
 }
 
-// forwardOutput continuously reads from the given Reader until an EOF occurs.
-// Each newly read line is passed to the given function f.
-func forwardOutput(readCloser io.ReadCloser, f func(string), output string) {
-	scanner := bufio.NewScanner(readCloser)
-	for scanner.Scan() {
-		f(scanner.Text())
-	}
-	if err := scanner.Err(); err != nil {
-		elog.Printf("Error reading from enclave application's %s: %v", output, err)
+// splitList splits the given comma-separated list into its elements.
+func splitList(s string) []string {
+	var elems []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			elems = append(elems, elem)
+		}
 	}
+	return elems
 }
@@ -1,26 +1,35 @@
 package main
 
 import (
+	"os"
+	"os/exec"
 	"strings"
 	"testing"
 )
 
-func TestSpawnAppProcess(t *testing.T) {
-	expected := []string{"1", "2", "3"}
-	output := []string{}
-	f := func(s string) {
-		output = append(output, strings.TrimSpace(s))
-	}
-	dummy := func(string) {}
+func TestSplitList(t *testing.T) {
+	assertEqual(t, len(splitList("")), 0)
+	assertEqual(t, strings.Join(splitList("a, b,,c "), "|"), "a|b|c")
+}
 
-	runAppCommand("seq 1 3", f, dummy)
-	if len(output) != len(expected) {
-		t.Fatalf("Expected slice length %d but got %d.", len(expected), len(output))
+func TestFlags(t *testing.T) {
+	// Run main in a child process, which defines and parses all of our
+	// flags.  The flag package panics if two flags share a name, and -help
+	// makes main exit once parsing is done.
+	if os.Getenv("NITRIDING_TEST_CHILD") == "TestFlags" {
+		os.Args = []string{"nitriding", "-help"}
+		main()
+		return
 	}
-
-	for i := range output {
-		if output[i] != expected[i] {
-			t.Fatalf("Expected element at index %d to be %s but got %s.", i, expected[i], output[i])
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFlags$")
+	cmd.Env = append(os.Environ(), "NITRIDING_TEST_CHILD=TestFlags")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v\n%s", err, out)
+	}
+	for _, name := range []string{"-profile", "-config-profile"} {
+		if !strings.Contains(string(out), "\n  "+name+"\n") && !strings.Contains(string(out), "\n  "+name+" ") {
+			t.Fatalf("Expected flag %s in usage:\n%s", name, out)
 		}
 	}
 }
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -14,6 +16,8 @@ const (
 	reqMethod  = "http_req_method"
 	respStatus = "http_resp_status"
 	respErr    = "http_resp_error"
+	reqRoute   = "http_req_route"
+	respClass  = "http_resp_status_class"
 
 	notAvailable = "n/a"
 )
@@ -34,11 +38,12 @@ type metrics struct {
 	reqs        *prometheus.CounterVec
 	proxiedReqs *prometheus.CounterVec
 	heartbeats  *prometheus.CounterVec
+	durations   *prometheus.HistogramVec
 }
 
 // newMetrics initializes our Prometheus metrics.
 func newMetrics(reg prometheus.Registerer, namespace string) *metrics {
-	elog.Printf("Initializing Prometheus metrics for %q.", namespace)
+	elog.Info("Initializing Prometheus metrics.", "namespace", namespace)
 	m := &metrics{
 		reqs: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -64,10 +69,21 @@ func newMetrics(reg prometheus.Registerer, namespace string) *metrics {
 			},
 			[]string{respErr},
 		),
+		durations: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "request_duration_seconds",
+				Help:      "Duration of HTTP requests to nitriding, by route and status class",
+				Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+			},
+			[]string{reqRoute, reqMethod, respClass},
+		),
 	}
 	reg.MustRegister(m.proxiedReqs)
 	reg.MustRegister(m.reqs)
 	reg.MustRegister(m.heartbeats)
+	reg.MustRegister(m.durations)
+	reg.MustRegister(newOpsCollector(namespace, ops))
 
 	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{
 		Namespace: namespace,
@@ -105,10 +121,21 @@ func (m *metrics) checkRevProxyErr(w http.ResponseWriter, r *http.Request, err e
 	w.WriteHeader(http.StatusBadGateway)
 }
 
+// statusClass returns the class of the given HTTP status code, e.g., "2xx".
+func statusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
 // middleware implements a chi middleware that records each request as part of
-// our Prometheus metrics.
+// our Prometheus metrics.  Request durations are labelled with the route
+// pattern instead of the path, which keeps the number of time series bounded
+// even though the enclave application's paths are arbitrary.
 func (m *metrics) middleware(h http.Handler) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 		h.ServeHTTP(ww, r)
 		m.reqs.With(prometheus.Labels{
@@ -117,6 +144,16 @@ func (m *metrics) middleware(h http.Handler) http.Handler {
 			respStatus: fmt.Sprint(ww.Status()),
 			respErr:    notAvailable,
 		}).Inc()
+
+		route := notAvailable
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		m.durations.With(prometheus.Labels{
+			reqRoute:  route,
+			reqMethod: r.Method,
+			respClass: statusClass(ww.Status()),
+		}).Observe(time.Since(start).Seconds())
 	}
 	return http.HandlerFunc(f)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestHandlerMetrics(t *testing.T) {
@@ -53,7 +55,7 @@ func TestHandlerMetrics(t *testing.T) {
 	makeReq = makeReqToSrv(enclave.intSrv)
 	assertResponse(t,
 		makeReq(http.MethodPost, pathHash, bytes.NewBufferString("foo")),
-		newResp(http.StatusBadRequest, errNoBase64.Error()),
+		newErrResp(http.StatusBadRequest, errNoBase64),
 	)
 
 	// One final time, make sure that Prometheus recorded the above request.
@@ -65,6 +67,34 @@ func TestHandlerMetrics(t *testing.T) {
 	), float64(1))
 }
 
+func TestDurationMetrics(t *testing.T) {
+	c := defaultCfg
+	c.PrometheusPort = 80
+	enclave := createEnclave(&c)
+	makeReq := makeReqToSrv(enclave.extPubSrv)
+
+	makeReq(http.MethodGet, pathConfig, nil)
+	makeReq(http.MethodGet, pathConfig, nil)
+	makeReq(http.MethodPost, pathConfig, nil)
+
+	// Both GET requests end up in the same histogram.
+	assertEqual(t, testutil.CollectAndCount(enclave.metrics.durations), 2)
+	okCount := func() uint64 {
+		var m dto.Metric
+		h := enclave.metrics.durations.WithLabelValues(pathConfig, http.MethodGet, "2xx")
+		failOnErr(t, h.(prometheus.Metric).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	assertEqual(t, okCount(), uint64(2))
+}
+
+func TestStatusClass(t *testing.T) {
+	assertEqual(t, statusClass(0), "2xx")
+	assertEqual(t, statusClass(http.StatusOK), "2xx")
+	assertEqual(t, statusClass(http.StatusNotFound), "4xx")
+	assertEqual(t, statusClass(http.StatusBadGateway), "5xx")
+}
+
 func TestMetrics(t *testing.T) {
 	err1, err2 := errors.New("backend timeout"), errors.New("backend exploded")
 	expectedStatus1, expectedStatus2 := 200, 404
@@ -118,3 +148,42 @@ func TestMetrics(t *testing.T) {
 		notAvailable),
 	), float64(1))
 }
+
+func TestOpsCounters(t *testing.T) {
+	counters := new(opsCounters)
+	counters.attestations.Add(3)
+	counters.countKeySync(nil)
+	counters.countKeySync(errors.New("worker unreachable"))
+	s := counters.snapshot()
+	assertEqual(t, s.Attestations, uint64(3))
+	assertEqual(t, s.KeySyncs, uint64(1))
+	assertEqual(t, s.KeySyncErrors, uint64(1))
+
+	// Our counters must show up in Prometheus.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newOpsCollector("nitriding", counters))
+	families, err := reg.Gather()
+	failOnErr(t, err)
+	values := make(map[string]float64)
+	for _, f := range families {
+		values[f.GetName()] = f.GetMetric()[0].GetCounter().GetValue()
+	}
+	assertEqual(t, len(values), 14)
+	assertEqual(t, values["nitriding_attestations_total"], float64(3))
+	assertEqual(t, values["nitriding_key_sync_errors_total"], float64(1))
+}
+
+func TestCountingCache(t *testing.T) {
+	before := ops.certRenewals.Load()
+	c := countingCache{newCertCache()}
+	ctx := context.Background()
+	failOnErr(t, c.Put(ctx, "acme_account+key", []byte("key")))
+	failOnErr(t, c.Put(ctx, "example.com", []byte("cert")))
+	assertEqual(t, ops.certRenewals.Load()-before, uint64(1))
+
+	before = ops.appProxyErrors.Load()
+	r := httptest.NewRecorder()
+	countRevProxyErr(nil)(r, httptest.NewRequest(http.MethodGet, "/", nil), errors.New("refused"))
+	assertEqual(t, r.Code, http.StatusBadGateway)
+	assertEqual(t, ops.appProxyErrors.Load()-before, uint64(1))
+}
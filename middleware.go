@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	authTokenLen = 32 // The length of our bearer token in bytes.
+
+	// The header that carries request IDs, and the properties of the request
+	// IDs that we generate and accept.
+	requestIDHeader = "X-Request-ID"
+	requestIDLen    = 16
+	maxRequestIDLen = 128
+
+	// Default values of our security headers.
+	defaultHSTSMaxAge     = 365 * 24 * time.Hour
+	defaultReferrerPolicy = "no-referrer"
+	defaultCSP            = "default-src 'none'; frame-ancestors 'none'"
+)
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	errUnauthorized    = errors.New("missing or invalid bearer token")
+)
+
+// isNitridingPath returns true if the given URL path is handled by nitriding
+// rather than by the enclave application.
+func isNitridingPath(path string) bool {
+	return path == pathRoot || strings.HasPrefix(path, pathRoot+"/")
+}
+
+// corsMiddleware returns a chi middleware that sets Cross-Origin Resource
+// Sharing (CORS) headers for nitriding's endpoints, which allows browser-based
+// verifiers to request attestation documents.  Requests that are forwarded to
+// the enclave application are left alone because the application is in charge
+// of its own CORS policy.
+func corsMiddleware(cfg *Config) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool)
+	for _, origin := range cfg.CORSAllowedOrigins {
+		allowed[origin] = true
+	}
+	methods := strings.Join(cfg.CORSAllowedMethods, ", ")
+	maxAge := strconv.Itoa(int(cfg.CORSMaxAge.Seconds()))
+
+	return func(h http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !isNitridingPath(r.URL.Path) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			if !allowed[origin] && !allowed["*"] {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			// Answer preflight requests ourselves instead of passing them on
+			// to handlers that don't know about the OPTIONS method.
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				if cfg.CORSMaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", maxAge)
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(f)
+	}
+}
+
+// isValidRequestID returns true if the given request ID is short and only
+// consists of characters that are safe to log and to forward.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware assigns an ID to each inbound request.  If the request
+// already carries a valid X-Request-ID header (e.g., set by a load balancer),
+// we adopt its ID; otherwise, we generate a random one.  The ID ends up in
+// access logs and error responses, is returned to the client, and is
+// forwarded to the enclave application, which allows for correlating a
+// request across components.
+func requestIDMiddleware(h http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(id) {
+			buf := make([]byte, requestIDLen)
+			if _, err := cryptoRead(buf); err != nil {
+				elog.Error("Failed to generate request ID.", "error", err)
+			}
+			id = hex.EncodeToString(buf)
+		}
+		// Setting the header on the request makes our reverse proxy forward
+		// the ID to the enclave application.
+		r.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), middleware.RequestIDKey, id)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(f)
+}
+
+// securityHeadersMiddleware returns a chi middleware that sets security
+// headers on the public Web server's responses.  The HSTS header applies to
+// the entire host, so we set it on all responses.  The remaining headers only
+// make sense for nitriding's own endpoints; the enclave application knows
+// best what its own pages need.
+func securityHeadersMiddleware(cfg *Config) func(http.Handler) http.Handler {
+	hsts := fmt.Sprintf("max-age=%d", int(cfg.HSTSMaxAge.Seconds()))
+
+	return func(h http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			if cfg.HSTSMaxAge > 0 {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			if isNitridingPath(r.URL.Path) {
+				w.Header().Set("X-Content-Type-Options", "nosniff")
+				w.Header().Set("Referrer-Policy", cfg.ReferrerPolicy)
+				w.Header().Set("Content-Security-Policy", cfg.ContentSecurityPolicy)
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(f)
+	}
+}
+
+// bodyLimitMiddleware returns a chi middleware that caps the size of request
+// bodies at the given number of bytes, preventing peers from exhausting the
+// enclave's memory with enormous requests.  If onlyNitriding is set, bodies of
+// requests that are forwarded to the enclave application are not capped.
+func bodyLimitMiddleware(limit int64, onlyNitriding bool) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil && (!onlyNitriding || isNitridingPath(r.URL.Path)) {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(f)
+	}
+}
+
+// timeoutMiddleware returns a chi middleware that applies the given read and
+// write timeouts to each request by setting its connection's deadlines.  A
+// running http.Server reads its own timeout fields without synchronization,
+// so the middleware is how we change timeouts at runtime.  Zero and negative
+// timeouts disable the deadlines.
+func timeoutMiddleware(read, write time.Duration) func(http.Handler) http.Handler {
+	deadline := func(d time.Duration) time.Time {
+		if d <= 0 {
+			return time.Time{}
+		}
+		return time.Now().Add(d)
+	}
+	return func(h http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			// Response writers that don't support deadlines keep the
+			// server's timeouts.
+			rc := http.NewResponseController(w)
+			_ = rc.SetReadDeadline(deadline(read))
+			_ = rc.SetWriteDeadline(deadline(write))
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(f)
+	}
+}
+
+// isBodyTooLarge returns true if the given error was caused by a request body
+// that exceeded our limits.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// newAuthToken returns a random, hex-encoded bearer token.
+func newAuthToken() (string, error) {
+	buf := make([]byte, authTokenLen)
+	if _, err := cryptoRead(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// writeAuthToken writes the given bearer token to the given file, which is
+// only readable by its owner: the given user, or the current user if the
+// user ID is 0.
+func writeAuthToken(path, token string, uid, gid uint32) error {
+	// Remove the file first because WriteFile does not change the permissions
+	// of existing files.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+		return err
+	}
+	return chownUnprivileged(path, uid, gid)
+}
+
+// authMiddleware returns a chi middleware that rejects requests that don't
+// carry the bearer token that the given function returns in their
+// Authorization header.
+func authMiddleware(token func() string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			expected := []byte("Bearer " + token())
+			actual := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(actual, expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				httpError(w, r, errUnauthorized, http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(f)
+	}
+}
+
+// accessLogEntry represents a structured access log entry.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Server     string    `json:"server"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	LatencyMs  float64   `json:"latency_ms"`
+	Bytes      int       `json:"bytes"`
+	RemoteAddr string    `json:"remote_addr"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// accessLogger writes JSON-encoded access log entries, one per line, to its
+// writer.  Requests for paths in its skip set (e.g., health checks) are not
+// logged, to cut noise.
+type accessLogger struct {
+	sync.Mutex // Guards out.
+	out        io.Writer
+	skip       map[string]bool
+}
+
+// newAccessLogger returns a new access logger that writes to the given writer
+// and skips the given paths.
+func newAccessLogger(out io.Writer, skipPaths []string) *accessLogger {
+	skip := make(map[string]bool)
+	for _, path := range skipPaths {
+		skip[path] = true
+	}
+	return &accessLogger{
+		out:  out,
+		skip: skip,
+	}
+}
+
+// log writes the given access log entry.
+func (a *accessLogger) log(entry *accessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		elog.Error("Error marshalling access log entry.", "error", err)
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		elog.Error("Error writing access log entry.", "error", err)
+	}
+}
+
+// middleware returns a chi middleware that logs requests to the Web server of
+// the given name.
+func (a *accessLogger) middleware(server string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			if a.skip[r.URL.Path] {
+				h.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			h.ServeHTTP(ww, r)
+			status := ww.Status()
+			// Handlers that don't explicitly set a status code respond with
+			// 200 OK.
+			if status == 0 {
+				status = http.StatusOK
+			}
+			a.log(&accessLogEntry{
+				Time:       start.UTC(),
+				Server:     server,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     status,
+				LatencyMs:  float64(time.Since(start).Microseconds()) / 1000,
+				Bytes:      ww.BytesWritten(),
+				RemoteAddr: r.RemoteAddr,
+				RequestID:  middleware.GetReqID(r.Context()),
+			})
+		}
+		return http.HandlerFunc(f)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	c := defaultCfg
+	c.CORSAllowedOrigins = []string{"https://example.com"}
+	c.CORSMaxAge = time.Hour
+	srv := createEnclave(&c).extPubSrv
+
+	makeReq := func(method, path, origin string) *http.Response {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	// An allowed origin must get CORS headers.
+	resp := makeReq(http.MethodGet, pathConfig, "https://example.com")
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Access-Control-Allow-Origin"), "https://example.com")
+
+	// A disallowed origin must not.
+	resp = makeReq(http.MethodGet, pathConfig, "https://evil.com")
+	assertEqual(t, resp.Header.Get("Access-Control-Allow-Origin"), "")
+
+	// Preflight requests are answered by the middleware.
+	resp = makeReq(http.MethodOptions, pathAttestation, "https://example.com")
+	assertEqual(t, resp.StatusCode, http.StatusNoContent)
+	assertEqual(t, resp.Header.Get("Access-Control-Allow-Methods"), "GET, HEAD, OPTIONS")
+	assertEqual(t, resp.Header.Get("Access-Control-Max-Age"), "3600")
+}
+
+func TestCORSWildcard(t *testing.T) {
+	c := defaultCfg
+	c.CORSAllowedOrigins = []string{"*"}
+	h := corsMiddleware(&c)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, pathAttestation, nil)
+	req.Header.Set("Origin", "https://foo.com")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertEqual(t, rec.Result().Header.Get("Access-Control-Allow-Origin"), "https://foo.com")
+
+	// Paths that belong to the enclave application must be left alone.
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("Origin", "https://foo.com")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assertEqual(t, rec.Result().Header.Get("Access-Control-Allow-Origin"), "")
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var fwdID string
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fwdID = r.Header.Get(requestIDHeader)
+		assertEqual(t, middleware.GetReqID(r.Context()), fwdID)
+	}))
+	makeReq := func(id string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, pathRoot, nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	// Without an inbound ID, we generate one.
+	resp := makeReq("")
+	assertEqual(t, len(fwdID), requestIDLen*2)
+	assertEqual(t, resp.Header.Get(requestIDHeader), fwdID)
+
+	// Valid inbound IDs are adopted and forwarded.
+	resp = makeReq("lb-1234.abc_def")
+	assertEqual(t, fwdID, "lb-1234.abc_def")
+	assertEqual(t, resp.Header.Get(requestIDHeader), "lb-1234.abc_def")
+
+	// Invalid inbound IDs are replaced.
+	for _, id := range []string{"foo bar", "foo\nbar", strings.Repeat("a", maxRequestIDLen+1)} {
+		makeReq(id)
+		assertEqual(t, fwdID != id, true)
+		assertEqual(t, len(fwdID), requestIDLen*2)
+	}
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	c := defaultCfg
+	srv := createEnclave(&c).extPubSrv
+	makeReq := func(path string) *http.Response {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Result()
+	}
+
+	// Nitriding's endpoints get all security headers.
+	resp := makeReq(pathConfig)
+	assertEqual(t, resp.Header.Get("Strict-Transport-Security"), "max-age=31536000")
+	assertEqual(t, resp.Header.Get("X-Content-Type-Options"), "nosniff")
+	assertEqual(t, resp.Header.Get("Referrer-Policy"), defaultReferrerPolicy)
+	assertEqual(t, resp.Header.Get("Content-Security-Policy"), defaultCSP)
+
+	// The application's endpoints only get HSTS.
+	resp = makeReq("/foo")
+	assertEqual(t, resp.Header.Get("Strict-Transport-Security"), "max-age=31536000")
+	assertEqual(t, resp.Header.Get("Content-Security-Policy"), "")
+
+	// Headers can be customized and disabled.
+	c = defaultCfg
+	c.HSTSMaxAge = -1
+	c.ContentSecurityPolicy = "default-src 'self'"
+	srv = createEnclave(&c).extPubSrv
+	resp = makeReq(pathConfig)
+	assertEqual(t, resp.Header.Get("Strict-Transport-Security"), "")
+	assertEqual(t, resp.Header.Get("Content-Security-Policy"), "default-src 'self'")
+
+	c = defaultCfg
+	c.DisableSecurityHeaders = true
+	srv = createEnclave(&c).extPubSrv
+	resp = makeReq(pathConfig)
+	assertEqual(t, resp.Header.Get("Strict-Transport-Security"), "")
+	assertEqual(t, resp.Header.Get("Referrer-Policy"), "")
+}
+
+func TestCompression(t *testing.T) {
+	c := defaultCfg
+	c.CompressLevel = 5
+	srv := createEnclave(&c).extPubSrv
+	makeReq := func(path, encoding string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	// The info endpoint returns JSON, which we compress.
+	resp := makeReq(pathInfo, "gzip")
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Content-Encoding"), "gzip")
+	zr, err := gzip.NewReader(resp.Body)
+	failOnErr(t, err)
+	var info enclaveInfo
+	failOnErr(t, json.NewDecoder(zr).Decode(&info))
+	assertEqual(t, info.FQDN, c.FQDN)
+
+	// Clients that don't support compression get uncompressed responses.
+	resp = makeReq(pathInfo, "")
+	assertEqual(t, resp.Header.Get("Content-Encoding"), "")
+
+	// Compression is disabled by default.
+	srv = createEnclave(&defaultCfg).extPubSrv
+	resp = makeReq(pathInfo, "gzip")
+	assertEqual(t, resp.Header.Get("Content-Encoding"), "")
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	c := defaultCfg
+	c.MaxReqBodyLen = 10
+	makeReq := makeReqToSrv(createEnclave(&c).intSrv)
+
+	assertResponse(t,
+		makeReq(http.MethodPost, pathHash, strings.NewReader(strings.Repeat("A", 11))),
+		newErrResp(http.StatusRequestEntityTooLarge, errBodyTooLarge),
+	)
+	// A body within the limit makes it to the handler.
+	assertResponse(t,
+		makeReq(http.MethodPost, pathHash, strings.NewReader("foo")),
+		newErrResp(http.StatusBadRequest, errNoBase64),
+	)
+
+	// Requests for the enclave application are not capped on the public
+	// server.
+	var n int
+	h := bodyLimitMiddleware(1, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		n = len(b)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/foo", strings.NewReader("foobar")))
+	assertEqual(t, n, len("foobar"))
+}
+
+func TestWriteAuthTokenOwner(t *testing.T) {
+	skipUnlessRoot(t)
+	path := filepath.Join(t.TempDir(), "token")
+	failOnErr(t, writeAuthToken(path, "secret", nobody, nobody))
+	assertOwner(t, path, nobody, nobody)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	c := defaultCfg
+	c.IntAuthTokenFile = filepath.Join(t.TempDir(), "token")
+	e := createEnclave(&c)
+	if len(c.IntAuthToken) != hex.EncodedLen(authTokenLen) {
+		t.Fatalf("Expected generated token of length %d.", hex.EncodedLen(authTokenLen))
+	}
+	if err := writeAuthToken(c.IntAuthTokenFile, c.IntAuthToken, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	token, err := os.ReadFile(c.IntAuthTokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeReq := func(auth string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, pathState, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		e.intSrv.Handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	assertResponse(t, makeReq(""), newErrResp(http.StatusUnauthorized, errUnauthorized))
+	assertResponse(t, makeReq("Bearer foo"), newErrResp(http.StatusUnauthorized, errUnauthorized))
+	assertResponse(t,
+		makeReq("Bearer "+string(token)),
+		newErrResp(http.StatusForbidden, errKeySyncDisabled),
+	)
+}
+
+func TestAccessLogger(t *testing.T) {
+	var (
+		entry accessLogEntry
+		out   = new(bytes.Buffer)
+		a     = newAccessLogger(out, []string{"/health"})
+		h     = a.middleware(apiPublic)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprint(w, "foobar")
+		}))
+	)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/foo", nil))
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Failed to unmarshal access log entry: %v", err)
+	}
+	assertEqual(t, entry.Server, apiPublic)
+	assertEqual(t, entry.Method, http.MethodPut)
+	assertEqual(t, entry.Path, "/foo")
+	assertEqual(t, entry.Status, http.StatusTeapot)
+	assertEqual(t, entry.Bytes, len("foobar"))
+
+	// Skipped paths must not show up in our log.
+	out.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	assertEqual(t, out.Len(), 0)
+}
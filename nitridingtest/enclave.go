@@ -0,0 +1,94 @@
+package nitridingtest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+const (
+	pathAttestation = "/enclave/attestation"
+	nonceLen        = 20
+	contentTypeCBOR = "application/cbor"
+	contentTypeJSON = "application/json"
+)
+
+// hashPrefix is the multihash prefix of a SHA-256 hash.
+var hashPrefix = []byte{0x12, sha256.Size}
+
+// Enclave is an HTTPS server that mimics an enclave's public endpoints: it
+// serves attestation documents from its fake NSM at /enclave/attestation,
+// like nitriding, and forwards all other requests to the application handler,
+// like nitriding's reverse proxy.  Like nitriding's documents, the user data
+// of the Enclave's documents begins with the multihash of the fingerprint of
+// the server's certificate, followed by all-zero application and config
+// hashes.
+type Enclave struct {
+	*httptest.Server
+	NSM *NSM
+}
+
+// NewEnclave starts and returns a new Enclave whose attestation documents
+// come from the given NSM.  The given application handler may be nil, in
+// which case the Enclave responds to other requests with 404 Not Found.  The
+// caller should call Close when finished, to shut the Enclave down.
+func NewEnclave(nsm *NSM, app http.Handler) *Enclave {
+	if app == nil {
+		app = http.NotFoundHandler()
+	}
+	e := &Enclave{NSM: nsm}
+	mux := http.NewServeMux()
+	mux.HandleFunc(pathAttestation, e.attestationHandler)
+	mux.Handle("/", app)
+	e.Server = httptest.NewTLSServer(mux)
+	return e
+}
+
+// UserData returns the user data that the Enclave's attestation documents
+// contain.
+func (e *Enclave) UserData() []byte {
+	fingerprint := sha256.Sum256(e.Certificate().Raw)
+	var userData []byte
+	for _, h := range [][sha256.Size]byte{fingerprint, {}, {}} {
+		userData = append(userData, hashPrefix...)
+		userData = append(userData, h[:]...)
+	}
+	return userData
+}
+
+func (e *Enclave) attestationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nonce, err := hex.DecodeString(r.URL.Query().Get("nonce"))
+	if err != nil || len(nonce) != nonceLen {
+		http.Error(w, fmt.Sprintf("nonce must be %d hex digits", 2*nonceLen), http.StatusBadRequest)
+		return
+	}
+	rawDoc, err := e.NSM.Attest(nonce, e.UserData(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	b64Doc := base64.StdEncoding.EncodeToString(rawDoc)
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, contentTypeCBOR):
+		w.Header().Set("Content-Type", contentTypeCBOR)
+		_, _ = w.Write(rawDoc)
+	case strings.Contains(accept, contentTypeJSON):
+		w.Header().Set("Content-Type", contentTypeJSON)
+		_ = json.NewEncoder(w).Encode(map[string]string{"document": b64Doc})
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprintln(w, b64Doc)
+	}
+}
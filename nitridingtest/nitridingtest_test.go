@@ -0,0 +1,136 @@
+package nitridingtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brave/nitriding-daemon/client"
+	"github.com/hf/nitrite"
+)
+
+func newTestNSM(t *testing.T) *NSM {
+	t.Helper()
+	nsm, err := NewNSM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nsm
+}
+
+func TestNSMAttest(t *testing.T) {
+	nsm := newTestNSM(t)
+	pcr0 := bytes.Repeat([]byte{1}, sha512.Size384)
+	nsm.SetPCR(0, pcr0)
+
+	nonce, userData := []byte("nonce"), []byte("user data")
+	rawDoc, err := nsm.Attest(nonce, userData, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := nitrite.Verify(rawDoc, nitrite.VerifyOptions{Roots: nsm.Roots()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Document.Nonce, nonce) || !bytes.Equal(res.Document.UserData, userData) {
+		t.Fatal("Attestation document lacks nonce or user data.")
+	}
+	if !bytes.Equal(res.Document.PCRs[0], pcr0) || len(res.Document.PCRs) != numPCRs {
+		t.Fatalf("Unexpected PCRs: %x", res.Document.PCRs)
+	}
+
+	// The fake NSM's documents don't verify against the AWS root.
+	if _, err := nitrite.Verify(rawDoc, nitrite.VerifyOptions{}); err == nil {
+		t.Fatal("Expected error but got none.")
+	}
+}
+
+func TestEnclave(t *testing.T) {
+	nsm := newTestNSM(t)
+	pcr0 := bytes.Repeat([]byte{2}, sha512.Size384)
+	nsm.SetPCR(0, pcr0)
+	e := NewEnclave(nsm, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer e.Close()
+	policy := client.Policy{PCRs: map[uint][]byte{0: pcr0}, Roots: nsm.Roots()}
+
+	v := &client.Verifier{Policy: policy, HTTPClient: e.Client()}
+	doc, err := v.Attest(context.Background(), e.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(doc.UserData, e.UserData()) {
+		t.Fatal("Attestation document lacks the enclave's user data.")
+	}
+
+	// The attested dialer reaches the application.
+	d := &client.Dialer{Policy: policy}
+	c := &http.Client{Transport: &http.Transport{DialTLSContext: d.DialContext}}
+	resp, err := c.Get(e.URL + "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatalf("Expected body %q but got %q.", "hello", body)
+	}
+
+	policy.PCRs[0] = make([]byte, sha512.Size384)
+	v = &client.Verifier{Policy: policy, HTTPClient: e.Client()}
+	if _, err := v.Attest(context.Background(), e.URL); !errors.Is(err, client.ErrPCRMismatch) {
+		t.Fatalf("Expected error %v but got %v.", client.ErrPCRMismatch, err)
+	}
+}
+
+func TestVsockListener(t *testing.T) {
+	l := NewVsockListener(3, 1024)
+	if l.Addr().Network() != "vsock" || l.Addr().String() != "vm(3):1024" {
+		t.Fatalf("Unexpected address %s.", l.Addr())
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := l.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("Expected %q but got %q.", "ping", buf)
+	}
+	conn.Close()
+
+	// Dial gives up if nobody accepts the connection.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Dial(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error %v but got %v.", context.DeadlineExceeded, err)
+	}
+
+	_ = l.Close()
+	if _, err := l.Accept(); !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("Expected error %v but got %v.", ErrListenerClosed, err)
+	}
+	if _, err := l.Dial(context.Background()); !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("Expected error %v but got %v.", ErrListenerClosed, err)
+	}
+}
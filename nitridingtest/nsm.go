@@ -0,0 +1,200 @@
+// Package nitridingtest helps applications that work with nitriding write unit
+// tests without AWS hardware.  It provides a fake Nitro Secure Module (NSM)
+// whose attestation documents verify against the NSM's own root certificate,
+// in-memory vsock listeners, and an httptest-style server that mimics an
+// enclave's public nitriding endpoints.
+package nitridingtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hf/nitrite"
+)
+
+const (
+	// numPCRs is the number of PCRs that the NSM reports.
+	numPCRs = 16
+	// certValidity determines how long the fake NSM's certificates are valid.
+	certValidity = 24 * time.Hour
+	// coseAlgES384 is the COSE algorithm identifier of ECDSA with SHA-384.
+	coseAlgES384 = -35
+)
+
+// NSM is a fake Nitro Secure Module.  Like the real NSM, it signs attestation
+// documents with a certificate that chains up to a root certificate, but the
+// root certificate is the fake NSM's own, so verifiers only accept its
+// documents if they trust Roots.  An NSM is safe for concurrent use.
+type NSM struct {
+	sync.Mutex // Guard pcrs.
+	pcrs       map[uint][]byte
+
+	root, leaf *x509.Certificate
+	key        *ecdsa.PrivateKey
+}
+
+// sigStructure is the COSE Sign1 structure that the NSM signs.
+type sigStructure struct {
+	_ struct{} `cbor:",toarray"`
+
+	Context     string
+	Protected   []byte
+	ExternalAAD []byte
+	Payload     []byte
+}
+
+// sign1 is a COSE Sign1 message, i.e., an attestation document.
+type sign1 struct {
+	_ struct{} `cbor:",toarray"`
+
+	Protected   []byte
+	Unprotected map[int]any
+	Payload     []byte
+	Signature   []byte
+}
+
+// NewNSM returns a fake NSM with a fresh root certificate.  All PCRs are
+// zero, like those of enclaves in debug mode, until SetPCR changes them.
+func NewNSM() (*NSM, error) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake.nitro-enclaves"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "i-00000000000000000-enc0000000000000000.fake"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, root, &key.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return nil, err
+	}
+
+	pcrs := make(map[uint][]byte, numPCRs)
+	for i := uint(0); i < numPCRs; i++ {
+		pcrs[i] = make([]byte, sha512.Size384)
+	}
+	return &NSM{pcrs: pcrs, root: root, leaf: leaf, key: key}, nil
+}
+
+// SetPCR sets the given PCR to the given SHA-384 hash, e.g., PCR0 to the
+// measurement of the enclave image that the test expects.
+func (n *NSM) SetPCR(pcr uint, value []byte) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.pcrs[pcr] = append([]byte(nil), value...)
+}
+
+// PCRs returns a copy of the NSM's PCR values.
+func (n *NSM) PCRs() map[uint][]byte {
+	n.Lock()
+	defer n.Unlock()
+
+	pcrs := make(map[uint][]byte, len(n.pcrs))
+	for pcr, value := range n.pcrs {
+		pcrs[pcr] = append([]byte(nil), value...)
+	}
+	return pcrs
+}
+
+// Roots returns a certificate pool that contains the NSM's root certificate,
+// for use in nitrite.VerifyOptions or client.Policy.
+func (n *NSM) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(n.root)
+	return pool
+}
+
+// RootPEM returns the NSM's PEM-encoded root certificate.
+func (n *NSM) RootPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: n.root.Raw}))
+}
+
+// Attest returns a signed attestation document that contains the given nonce,
+// user data, and public key, each of which may be nil.
+func (n *NSM) Attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	payload, err := cbor.Marshal(&nitrite.Document{
+		ModuleID:    n.leaf.Subject.CommonName,
+		Timestamp:   uint64(time.Now().UnixMilli()),
+		Digest:      "SHA384",
+		PCRs:        n.PCRs(),
+		Certificate: n.leaf.Raw,
+		CABundle:    [][]byte{n.root.Raw},
+		PublicKey:   publicKey,
+		UserData:    userData,
+		Nonce:       nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+	protected, err := cbor.Marshal(map[int]int{1: coseAlgES384})
+	if err != nil {
+		return nil, err
+	}
+	toSign, err := cbor.Marshal(&sigStructure{
+		Context:     "Signature1",
+		Protected:   protected,
+		ExternalAAD: []byte{},
+		Payload:     payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha512.Sum384(toSign)
+	r, s, err := ecdsa.Sign(rand.Reader, n.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// COSE encodes ECDSA signatures as the concatenation of the fixed-size
+	// big-endian r and s.
+	sig := make([]byte, 2*sha512.Size384)
+	r.FillBytes(sig[:sha512.Size384])
+	s.FillBytes(sig[sha512.Size384:])
+
+	return cbor.Marshal(&sign1{
+		Protected:   protected,
+		Unprotected: map[int]any{},
+		Payload:     payload,
+		Signature:   sig,
+	})
+}
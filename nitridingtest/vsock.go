@@ -0,0 +1,83 @@
+package nitridingtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrListenerClosed is returned by the methods of a closed VsockListener.
+var ErrListenerClosed = errors.New("vsock listener closed")
+
+// VsockAddr is the address of a VsockListener.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+// Network returns "vsock".
+func (a *VsockAddr) Network() string { return "vsock" }
+
+// String returns the address in the same format as github.com/mdlayher/vsock.
+func (a *VsockAddr) String() string { return fmt.Sprintf("vm(%d):%d", a.CID, a.Port) }
+
+// VsockListener is an in-memory net.Listener that stands in for the vsock
+// listeners that connect an enclave to its EC2 host.  Its Dial method
+// connects to the listener without a kernel, so tests can exercise code that
+// accepts vsock connections, e.g., a host-side proxy.
+type VsockListener struct {
+	addr      *VsockAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewVsockListener returns a listener for the given context ID and port.
+func NewVsockListener(cid, port uint32) *VsockListener {
+	return &VsockListener{
+		addr:   &VsockAddr{CID: cid, Port: port},
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection that Dial creates.
+func (l *VsockListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the listener.  Established connections remain open.
+func (l *VsockListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns the listener's vsock address.
+func (l *VsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial connects to the listener, and returns the client side of the
+// connection once the listener accepted it.
+func (l *VsockListener) Dial(ctx context.Context) (net.Conn, error) {
+	var err error
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		err = ErrListenerClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	_ = client.Close()
+	_ = server.Close()
+	return nil, err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 )
@@ -30,3 +31,10 @@ func newNonce() (nonce, error) {
 func (n *nonce) b64() string {
 	return base64.StdEncoding.EncodeToString(n[:])
 }
+
+// equal returns true if the given nonce is identical to ours.  The comparison
+// takes constant time, so an adversary cannot learn how many leading bytes of
+// a guessed nonce are correct.
+func (n *nonce) equal(other nonce) bool {
+	return subtle.ConstantTimeCompare(n[:], other[:]) == 1
+}
@@ -49,3 +49,14 @@ func TestNonceErrors(t *testing.T) {
 		t.Fatalf("Expected error %v but got %v.", errNotEnoughRead, err)
 	}
 }
+
+func TestNonceEqual(t *testing.T) {
+	n1, err := newNonce()
+	failOnErr(t, err)
+	n2 := n1
+	assertEqual(t, n1.equal(n2), true)
+
+	n2[nonceLen-1] ^= 1
+	assertEqual(t, n1.equal(n2), false)
+	assertEqual(t, n1.equal(nonce{}), false)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// We implement an Oblivious HTTP (OHTTP) gateway as specified in RFC 9458:
+// https://www.rfc-editor.org/rfc/rfc9458.html
+// Clients encrypt binary HTTP requests to our HPKE key and send them via an
+// OHTTP relay, so neither we nor the enclave application learn the clients'
+// IP addresses, and the relay doesn't learn the requests.
+const (
+	ohttpKeyID     = 0x01
+	ohttpReqType   = "message/ohttp-req"
+	ohttpRespType  = "message/ohttp-res"
+	ohttpKeysType  = "application/ohttp-keys"
+	ohttpReqLabel  = "message/bhttp request"
+	ohttpRespLabel = "message/bhttp response"
+	// The length of the secret that we export to encrypt responses, and of
+	// the response nonce: the larger of the AEAD's key and nonce lengths.
+	ohttpRespSecLen = chacha20poly1305.KeySize
+	// The maximum lengths of encapsulated requests and of the enclave
+	// application's responses.
+	maxOHTTPReqLen  = maxKeyMaterialLen
+	maxOHTTPRespLen = 16 * 1024 * 1024
+)
+
+var (
+	errOHTTPKeyConfig = errors.New("request uses unknown key ID or algorithms")
+	errOHTTPReqType   = errors.New("expected content type " + ohttpReqType)
+	errOHTTPNoKey     = errors.New("gateway key is gone")
+	errOHTTPRespLen   = errors.New("application's response is too large")
+	errCfgOHTTPNoApp  = errors.New("given config enables OHTTP gateway without application Web server")
+)
+
+// validateOHTTP returns an error if the config enables our OHTTP gateway but
+// lacks an enclave application Web server that we can hand requests to.
+func (c *Config) validateOHTTP() error {
+	if c.OHTTPGateway && c.AppWebSrv == nil {
+		return errCfgOHTTPNoApp
+	}
+	return nil
+}
+
+// ohttpGateway decapsulates OHTTP requests, hands them to the enclave
+// application, and encapsulates the application's responses.  We publish the
+// gateway's key configuration in attestation documents, so clients can verify
+// that only this enclave can decrypt their requests.
+type ohttpGateway struct {
+	sync.Mutex
+	key     *hpkeKey
+	app     http.Handler
+	keysCfg []byte
+}
+
+// newOHTTPGateway returns a new ohttpGateway with a fresh HPKE key pair that
+// hands requests to the given handler.
+func newOHTTPGateway(app http.Handler) (*ohttpGateway, error) {
+	key, err := newHPKEKey()
+	if err != nil {
+		return nil, err
+	}
+	return &ohttpGateway{
+		key:     key,
+		app:     app,
+		keysCfg: ohttpKeyConfig(key.pub),
+	}, nil
+}
+
+// ohttpHeader returns the header that precedes encapsulated requests.
+func ohttpHeader() []byte {
+	hdr := []byte{ohttpKeyID}
+	hdr = binary.BigEndian.AppendUint16(hdr, hpkeKEMID)
+	hdr = binary.BigEndian.AppendUint16(hdr, hpkeKDFID)
+	return binary.BigEndian.AppendUint16(hdr, hpkeAEADID)
+}
+
+// ohttpKeyConfig returns the key configuration for the given public key, in
+// the application/ohttp-keys format: a length-prefixed list of
+// configurations, which in our case contains one configuration with one
+// cipher suite.
+func ohttpKeyConfig(pub []byte) []byte {
+	cfg := []byte{ohttpKeyID}
+	cfg = binary.BigEndian.AppendUint16(cfg, hpkeKEMID)
+	cfg = append(cfg, pub...)
+	cfg = binary.BigEndian.AppendUint16(cfg, 4)
+	cfg = binary.BigEndian.AppendUint16(cfg, hpkeKDFID)
+	cfg = binary.BigEndian.AppendUint16(cfg, hpkeAEADID)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(cfg))), cfg...)
+}
+
+// keyConfig returns our key configuration, or nil if our key is gone.
+func (g *ohttpGateway) keyConfig() []byte {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.key == nil {
+		return nil
+	}
+	return g.keysCfg
+}
+
+// decapsulate decrypts the given encapsulated request, and returns the
+// binary HTTP request, the request's encapsulated key, and the secret that
+// encrypts the response.
+func (g *ohttpGateway) decapsulate(encReq []byte) ([]byte, []byte, []byte, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.key == nil {
+		return nil, nil, nil, errOHTTPNoKey
+	}
+	hdr := ohttpHeader()
+	if len(encReq) < len(hdr) || !bytes.Equal(encReq[:len(hdr)], hdr) {
+		return nil, nil, nil, errOHTTPKeyConfig
+	}
+	info := append(append([]byte(ohttpReqLabel), 0), hdr...)
+	ciphertext := encReq[len(hdr):]
+	req, secret, err := g.key.openExport(info, ciphertext, []byte(ohttpRespLabel), ohttpRespSecLen)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return req, ciphertext[:hpkeEncLen], secret, nil
+}
+
+// encapsulateOHTTPResponse encrypts the given binary HTTP response, using
+// the exported secret and the encapsulated key of the request that it
+// answers.
+func encapsulateOHTTPResponse(resp, enc, secret []byte) ([]byte, error) {
+	respNonce := make([]byte, ohttpRespSecLen)
+	if _, err := rand.Read(respNonce); err != nil {
+		return nil, err
+	}
+	aead, nonce, err := ohttpResponseAEAD(secret, enc, respNonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(respNonce, nonce, resp, nil), nil
+}
+
+// ohttpResponseAEAD derives the AEAD and nonce that encrypt a response from
+// the exported secret, the request's encapsulated key, and the response
+// nonce.
+func ohttpResponseAEAD(secret, enc, respNonce []byte) (cipher.AEAD, []byte, error) {
+	salt := append(append([]byte{}, enc...), respNonce...)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	defer wipeBytes(prk)
+	key := make([]byte, chacha20poly1305.KeySize)
+	defer wipeBytes(key)
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("key")), key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("nonce")), nonce); err != nil {
+		return nil, nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	return aead, nonce, err
+}
+
+// wipe wipes our HPKE private key.  We cannot decapsulate requests after
+// that.
+func (g *ohttpGateway) wipe() {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.key != nil {
+		g.key.wipe()
+		g.key = nil
+	}
+}
+
+// ohttpResponse buffers the enclave application's response, so we can
+// encapsulate it.
+type ohttpResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *ohttpResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *ohttpResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *ohttpResponse) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.body.Len()+len(b) > maxOHTTPRespLen {
+		return 0, errOHTTPRespLen
+	}
+	return r.body.Write(b)
+}
+
+// ohttpGatewayHandler returns an HTTP handler that decapsulates OHTTP
+// requests, hands them to the enclave application, and returns the
+// encapsulated responses.  The application sees neither the client's nor the
+// relay's IP address.
+func ohttpGatewayHandler(g *ohttpGateway) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != ohttpReqType {
+			httpError(w, r, errOHTTPReqType, http.StatusUnsupportedMediaType)
+			return
+		}
+		encReq, err := io.ReadAll(newLimitReader(r.Body, maxOHTTPReqLen))
+		if errors.Is(err, errTooMuchToRead) || isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
+			return
+		}
+		rawReq, enc, secret, err := g.decapsulate(encReq)
+		if errors.Is(err, errOHTTPNoKey) {
+			httpError(w, r, err, http.StatusGone)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		defer wipeBytes(secret)
+		inner, err := decodeBHTTPRequest(rawReq)
+		if err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		// An empty remote address keeps our reverse proxy from adding an
+		// X-Forwarded-For header.
+		inner = inner.WithContext(r.Context())
+		inner.RemoteAddr = ""
+
+		resp := &ohttpResponse{header: make(http.Header)}
+		g.app.ServeHTTP(resp, inner)
+		status := resp.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// Handlers set trailers that they didn't announce by prefixing their
+		// names with http.TrailerPrefix.
+		trailer := make(http.Header)
+		resp.header.Del("Trailer")
+		for name, values := range resp.header {
+			if k, ok := strings.CutPrefix(name, http.TrailerPrefix); ok {
+				trailer[k] = values
+				delete(resp.header, name)
+			}
+		}
+		encResp, err := encapsulateOHTTPResponse(
+			encodeBHTTPResponse(status, resp.header, trailer, resp.body.Bytes()), enc, secret)
+		if err != nil {
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ohttpRespType)
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(encResp)
+	}
+}
+
+// ohttpKeysHandler returns an HTTP handler that returns our gateway's key
+// configuration.
+func ohttpKeysHandler(g *ohttpGateway) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := g.keyConfig()
+		if keys == nil {
+			httpError(w, r, errOHTTPNoKey, http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", ohttpKeysType)
+		_, _ = w.Write(keys)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// ohttpClient encapsulates requests and decapsulates responses the way OHTTP
+// clients do.
+type ohttpClient struct {
+	t      *testing.T
+	pub    []byte
+	enc    []byte
+	secret []byte
+}
+
+// newOHTTPClient parses the given key configuration.
+func newOHTTPClient(t *testing.T, keys []byte) *ohttpClient {
+	t.Helper()
+	assertEqual(t, int(binary.BigEndian.Uint16(keys)), len(keys)-2)
+	cfg := keys[2:]
+	assertEqual(t, cfg[0], byte(ohttpKeyID))
+	assertEqual(t, binary.BigEndian.Uint16(cfg[1:]), uint16(hpkeKEMID))
+	pub := cfg[3 : 3+hpkeEncLen]
+	suites := cfg[3+hpkeEncLen:]
+	assertEqual(t, binary.BigEndian.Uint16(suites), uint16(4))
+	assertEqual(t, binary.BigEndian.Uint16(suites[2:]), uint16(hpkeKDFID))
+	assertEqual(t, binary.BigEndian.Uint16(suites[4:]), uint16(hpkeAEADID))
+	return &ohttpClient{t: t, pub: pub}
+}
+
+func (c *ohttpClient) encapsulate(req []byte) []byte {
+	hdr := ohttpHeader()
+	info := append(append([]byte(ohttpReqLabel), 0), hdr...)
+	ciphertext, secret, err := hpkeSealExport(c.pub, info, req, []byte(ohttpRespLabel), ohttpRespSecLen)
+	failOnErr(c.t, err)
+	c.enc, c.secret = ciphertext[:hpkeEncLen], secret
+	return append(hdr, ciphertext...)
+}
+
+func (c *ohttpClient) decapsulate(encResp []byte) []byte {
+	respNonce, ciphertext := encResp[:ohttpRespSecLen], encResp[ohttpRespSecLen:]
+	aead, nonce, err := ohttpResponseAEAD(c.secret, c.enc, respNonce)
+	failOnErr(c.t, err)
+	resp, err := aead.Open(nil, nonce, ciphertext, nil)
+	failOnErr(c.t, err)
+	return resp
+}
+
+func TestOHTTPGateway(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set(http.TrailerPrefix+"Foo", "bar")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	defer app.Close()
+
+	c := defaultCfg
+	c.AppWebSrv, _ = url.Parse(app.URL)
+	c.OHTTPGateway = true
+	e := createEnclave(&c)
+	srv := e.extPubSrv
+
+	resp := makeReqToSrv(srv)(http.MethodGet, pathOHTTPKeys, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Content-Type"), ohttpKeysType)
+	keys, err := io.ReadAll(resp.Body)
+	failOnErr(t, err)
+	client := newOHTTPClient(t, keys)
+
+	post := func(body []byte, contentType string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, pathOHTTP, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	inner := encodeBHTTPRequest(http.MethodPost, "https", "example.com", "/foo", nil, []byte("bar"))
+	resp = post(client.encapsulate(inner), ohttpReqType)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Content-Type"), ohttpRespType)
+	encResp, err := io.ReadAll(resp.Body)
+	failOnErr(t, err)
+	status, header, content := decodeBHTTPResponse(t, client.decapsulate(encResp))
+	assertEqual(t, status, http.StatusCreated)
+	assertEqual(t, string(content), "POST /foo bar")
+	// The application must not learn the relay's IP address.
+	assertEqual(t, header.Get("X-Forwarded-For"), "")
+
+	// Requests must be encapsulated to our key configuration.
+	encReq := client.encapsulate(inner)
+	encReq[0]++
+	assertEqual(t, post(encReq, ohttpReqType).StatusCode, http.StatusBadRequest)
+	encReq = client.encapsulate(inner)
+	encReq[len(encReq)-1]++
+	assertEqual(t, post(encReq, ohttpReqType).StatusCode, http.StatusBadRequest)
+	assertEqual(t, post(client.encapsulate(inner), "application/octet-stream").StatusCode,
+		http.StatusUnsupportedMediaType)
+
+	// The key is unusable once wiped.
+	e.WipeKeyMaterial()
+	assertEqual(t, post(client.encapsulate(inner), ohttpReqType).StatusCode, http.StatusGone)
+	assertEqual(t, makeReqToSrv(srv)(http.MethodGet, pathOHTTPKeys, nil).StatusCode, http.StatusGone)
+}
+
+func TestValidateOHTTP(t *testing.T) {
+	c := &Config{OHTTPGateway: true}
+	assertEqual(t, errors.Is(c.validateOHTTP(), errCfgOHTTPNoApp), true)
+	c.AppWebSrv, _ = url.Parse("http://127.0.0.1:8080")
+	failOnErr(t, c.validateOHTTP())
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// The lifetime of the tokens that we mint unless the enclave application
+	// asks for a different one, and the maximum lifetime.
+	defaultOIDCTokenTTL = 5 * time.Minute
+	maxOIDCTokenTTL     = time.Hour
+	oidcSigningAlg      = "ES256"
+)
+
+var (
+	errOIDCBadRequest = errors.New("token request lacks subject or audience, has invalid lifetime, or overrides registered claims")
+
+	// oidcRegisteredClaims are the claims that we set, and that the enclave
+	// application therefore cannot set.
+	oidcRegisteredClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"}
+)
+
+// oidcTokenRequest is the enclave application's request to mint a token.
+// The lifetime is in seconds.
+type oidcTokenRequest struct {
+	Subject  string         `json:"sub"`
+	Audience string         `json:"aud"`
+	TTL      int64          `json:"ttl,omitempty"`
+	Claims   map[string]any `json:"claims,omitempty"`
+}
+
+// oidcTokenResponse is our response to the enclave application.
+type oidcTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// jwk is the JSON Web Key representation of an ECDSA P-256 public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// oidcIssuer mints JSON Web Tokens that downstream services can verify using
+// the public key that we publish as JWKS, and that our attestation documents
+// contain.  That gives the enclave application a bearer credential whose
+// trust is rooted in the enclave.  The signing key never leaves the enclave,
+// and each enclave has its own key.
+type oidcIssuer struct {
+	issuer string
+	key    *ecdsa.PrivateKey
+	jwk    *jwk
+}
+
+// newOIDCIssuer returns a new oidcIssuer with a fresh signing key, for the
+// given issuer URL.
+func newOIDCIssuer(issuer string) (*oidcIssuer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub := &jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   b64URL(key.X.FillBytes(make([]byte, 32))),
+		Y:   b64URL(key.Y.FillBytes(make([]byte, 32))),
+		Use: "sig",
+		Alg: oidcSigningAlg,
+	}
+	// The key ID is the key's RFC 7638 thumbprint.
+	thumbprint := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`,
+		pub.Crv, pub.Kty, pub.X, pub.Y)))
+	pub.Kid = b64URL(thumbprint[:])
+	return &oidcIssuer{issuer: issuer, key: key, jwk: pub}, nil
+}
+
+// oidcIssuerURL returns the issuer URL of the tokens that the enclave with the
+// given config mints, which is where verifiers find our discovery document.
+func oidcIssuerURL(c *Config) string {
+	return publicURL(c, pathOIDC)
+}
+
+// b64URL returns the unpadded Base64url encoding of the given bytes, as used
+// by JSON Web Tokens.
+func b64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// publicKey returns the DER-encoded public key that we sign tokens with.
+func (i *oidcIssuer) publicKey() []byte {
+	der, _ := x509.MarshalPKIXPublicKey(&i.key.PublicKey)
+	return der
+}
+
+// mint returns a signed token for the given request.
+func (i *oidcIssuer) mint(req *oidcTokenRequest) (*oidcTokenResponse, error) {
+	ttl := defaultOIDCTokenTTL
+	if req.TTL != 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	if req.Subject == "" || req.Audience == "" || ttl <= 0 || ttl > maxOIDCTokenTTL {
+		return nil, errOIDCBadRequest
+	}
+	for _, c := range oidcRegisteredClaims {
+		if _, ok := req.Claims[c]; ok {
+			return nil, errOIDCBadRequest
+		}
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, err
+	}
+
+	now := currentTime().Truncate(time.Second)
+	exp := now.Add(ttl)
+	claims := make(map[string]any, len(req.Claims)+len(oidcRegisteredClaims))
+	for k, v := range req.Claims {
+		claims[k] = v
+	}
+	claims["iss"] = i.issuer
+	claims["sub"] = req.Subject
+	claims["aud"] = req.Audience
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = exp.Unix()
+	claims["jti"] = hex.EncodeToString(jti)
+
+	header, err := json.Marshal(map[string]string{"alg": oidcSigningAlg, "typ": "JWT", "kid": i.jwk.Kid})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	signingInput := b64URL(header) + "." + b64URL(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, i.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// JWS encodes ECDSA signatures as the concatenation of r and s.
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return &oidcTokenResponse{
+		Token:     signingInput + "." + b64URL(sig),
+		ExpiresAt: exp,
+	}, nil
+}
+
+// oidcDiscoveryHandler returns an HTTP handler that returns our OpenID
+// Connect discovery document.
+func oidcDiscoveryHandler(i *oidcIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                i.issuer,
+			"jwks_uri":                              i.issuer + "/jwks",
+			"response_types_supported":              []string{"id_token"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{oidcSigningAlg},
+		}); err != nil {
+			elog.Error("Error encoding OIDC discovery document.", "error", err)
+		}
+	}
+}
+
+// jwksHandler returns an HTTP handler that returns our JSON Web Key Set.
+func jwksHandler(i *oidcIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(map[string][]*jwk{"keys": {i.jwk}}); err != nil {
+			elog.Error("Error encoding JWKS.", "error", err)
+		}
+	}
+}
+
+// oidcTokenHandler returns an HTTP handler that mints a token for the enclave
+// application's JSON-encoded request.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func oidcTokenHandler(i *oidcIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req oidcTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			if isBodyTooLarge(err) {
+				httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			httpError(w, r, errOIDCBadRequest, http.StatusBadRequest)
+			return
+		}
+		resp, err := i.mint(&req)
+		if errors.Is(err, errOIDCBadRequest) {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			elog.Error("Error encoding OIDC token.", "error", err)
+		}
+	}
+}
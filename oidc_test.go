@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// verifyJWT verifies the given token's signature using the given JSON Web
+// Key, and returns the token's claims.
+func verifyJWT(t *testing.T, token string, key *jwk) map[string]any {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	assertEqual(t, len(parts), 3)
+
+	var header map[string]string
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	failOnErr(t, err)
+	failOnErr(t, json.Unmarshal(rawHeader, &header))
+	assertEqual(t, header["alg"], oidcSigningAlg)
+	assertEqual(t, header["kid"], key.Kid)
+
+	x, err := base64.RawURLEncoding.DecodeString(key.X)
+	failOnErr(t, err)
+	y, err := base64.RawURLEncoding.DecodeString(key.Y)
+	failOnErr(t, err)
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	failOnErr(t, err)
+	assertEqual(t, len(sig), 64)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Fatal("Expected valid token signature.")
+	}
+
+	var claims map[string]any
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	failOnErr(t, err)
+	failOnErr(t, json.Unmarshal(payload, &claims))
+	return claims
+}
+
+func TestOIDCTokens(t *testing.T) {
+	c := defaultCfg
+	c.OIDCTokens = true
+	e := createEnclave(&c)
+	issuer := oidcIssuerURL(&c)
+	assertEqual(t, issuer, "https://example.com:50000/enclave/v1/oidc")
+
+	// Verifiers discover our keys.
+	resp := makeReqToSrv(e.extPubSrv)(http.MethodGet, versioned(pathOIDCConfig), nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var discovery map[string]any
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&discovery))
+	assertEqual(t, discovery["issuer"], issuer)
+	assertEqual(t, discovery["jwks_uri"], issuer+"/jwks")
+
+	resp = makeReqToSrv(e.extPubSrv)(http.MethodGet, versioned(pathOIDCKeys), nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var jwks struct {
+		Keys []*jwk `json:"keys"`
+	}
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&jwks))
+	assertEqual(t, len(jwks.Keys), 1)
+
+	resp = makeReqToSrv(e.extPubSrv)(http.MethodGet, versioned(pathOIDCAttstn)+"?nonce="+strings.Repeat("00", nonceLen), nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+
+	// The enclave application mints a token.
+	mint := makeReqToSrv(e.intSrv)
+	resp = mint(http.MethodPost, versioned(pathOIDCToken),
+		strings.NewReader(`{"sub":"app","aud":"api.example.com","ttl":60,"claims":{"role":"admin"}}`))
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var token oidcTokenResponse
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&token))
+	claims := verifyJWT(t, token.Token, jwks.Keys[0])
+	assertEqual(t, claims["iss"], issuer)
+	assertEqual(t, claims["sub"], "app")
+	assertEqual(t, claims["aud"], "api.example.com")
+	assertEqual(t, claims["role"], "admin")
+	assertEqual(t, int64(claims["exp"].(float64)-claims["iat"].(float64)), int64(60))
+	assertEqual(t, int64(claims["exp"].(float64)), token.ExpiresAt.Unix())
+
+	for _, body := range []string{
+		`{"aud":"api.example.com"}`,
+		`{"sub":"app"}`,
+		`{"sub":"app","aud":"api.example.com","ttl":-1}`,
+		`{"sub":"app","aud":"api.example.com","ttl":86400}`,
+		`{"sub":"app","aud":"api.example.com","claims":{"iss":"https://evil.com"}}`,
+		`not json`,
+	} {
+		resp = mint(http.MethodPost, versioned(pathOIDCToken), strings.NewReader(body))
+		assertResponse(t, resp, newErrResp(http.StatusBadRequest, errOIDCBadRequest))
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// onionPort is the virtual port that our onion service listens on.
+	onionPort    = 443
+	onionVersion = 3
+	// The address of Tor's control port if the config doesn't set one.
+	defaultTorControlAddr = "127.0.0.1:9051"
+	torControlTimeout     = 30 * time.Second
+	minOnionRetryDelay    = time.Second
+	maxOnionRetryDelay    = time.Minute
+)
+
+var (
+	errCfgBadOnion   = errors.New("given config has invalid onion service settings")
+	errTorControl    = errors.New("Tor control port rejected command")
+	errOnionMismatch = errors.New("Tor published onion service with unexpected address")
+	errOnionKeyWiped = errors.New("onion key was wiped")
+
+	// torQuoter escapes strings for the Tor control protocol's quoted strings.
+	torQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// validateOnion returns an error if the config publishes an onion service but
+// Tor's control port (which receives the onion key) is not on the loopback
+// interface, if Tor cannot reach our public Web server, or if the onion key
+// is malformed.
+func (c *Config) validateOnion() error {
+	if !c.OnionService {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(c.torControl())
+	if err != nil {
+		return fmt.Errorf("%w: bad Tor control address %q", errCfgBadOnion, c.TorControlAddr)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%w: Tor must run inside the enclave, on the loopback interface", errCfgBadOnion)
+	}
+	if c.UseVsockForExtPort {
+		return fmt.Errorf("%w: Tor cannot reach our public Web server via VSOCK", errCfgBadOnion)
+	}
+	if c.OnionKey != "" && !isSecretRef(c.OnionKey) {
+		if _, err := parseOnionKey(c.OnionKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// torControl returns the address of Tor's control port.
+func (c *Config) torControl() string {
+	if c.TorControlAddr == "" {
+		return defaultTorControlAddr
+	}
+	return c.TorControlAddr
+}
+
+// parseOnionKey parses the given Base64-encoded Ed25519 seed.
+func parseOnionKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: onion key is not a Base64-encoded %d-byte seed", errCfgBadOnion, ed25519.SeedSize)
+	}
+	defer wipeBytes(seed)
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// onionAddress returns the v3 onion address of the given public key, as
+// specified in Tor's rend-spec-v3.
+func onionAddress(pub ed25519.PublicKey) string {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pub)
+	h.Write([]byte{onionVersion})
+	raw := append(append([]byte{}, pub...), h.Sum(nil)[:2]...)
+	raw = append(raw, onionVersion)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(raw)) + ".onion"
+}
+
+// expandOnionKey returns the given key in the "expanded" form that Tor's
+// ADD_ONION command expects: the clamped scalar followed by the hash prefix.
+func expandOnionKey(key ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(key.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:]
+}
+
+// onionService publishes our public Web server as a Tor onion service.  Tor
+// runs inside the enclave and reaches the Tor network via the EC2 host, like
+// all our outbound traffic.  We hand the onion key to Tor via its control
+// port, so the key never leaves the enclave.
+type onionService struct {
+	sync.Mutex
+	controlAddr string
+	password    string
+	target      string // Where Tor forwards connections to.
+	key         *SecretBytes
+	addr        string
+}
+
+// newOnionService returns a new onionService for the given config.
+func newOnionService(c *Config) *onionService {
+	return &onionService{
+		controlAddr: c.torControl(),
+		target:      fmt.Sprintf("127.0.0.1:%d", c.ExtPubPort),
+	}
+}
+
+// setKey sets the onion key to the given Base64-encoded seed, or to a fresh
+// key if the seed is empty, and sets the password that we authenticate to
+// Tor's control port with.
+func (o *onionService) setKey(seed, password string) error {
+	var (
+		key ed25519.PrivateKey
+		err error
+	)
+	if seed == "" {
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		key, err = parseOnionKey(seed)
+	}
+	if err != nil {
+		return err
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	o.key = newSecretBytes(key)
+	o.addr = onionAddress(key.Public().(ed25519.PublicKey))
+	o.password = password
+	return nil
+}
+
+// address returns our onion address, or the empty string if we don't have
+// a key yet.
+func (o *onionService) address() string {
+	o.Lock()
+	defer o.Unlock()
+	return o.addr
+}
+
+// wipe discards the onion key.  The onion service remains published until
+// Tor's control connection closes.
+func (o *onionService) wipe() {
+	o.Lock()
+	defer o.Unlock()
+	if o.key != nil {
+		o.key.Wipe()
+	}
+}
+
+// torCommand sends the given command to Tor's control port and returns the
+// reply lines, without their status codes.
+func torCommand(conn *textproto.Conn, format string, args ...any) ([]string, error) {
+	if err := conn.PrintfLine(format, args...); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		// Reply lines have the form <code><separator><text>, where the
+		// separator is a space for the last line of a reply.
+		if len(line) < 4 {
+			return nil, fmt.Errorf("%w: malformed reply %q", errTorControl, line)
+		}
+		if line[:3] != "250" {
+			return nil, fmt.Errorf("%w: %s", errTorControl, line)
+		}
+		lines = append(lines, line[4:])
+		if line[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+// publish connects to Tor's control port and publishes our onion service.
+// The onion service remains published for as long as the returned connection
+// is open.
+func (o *onionService) publish(ctx context.Context) (*textproto.Conn, error) {
+	o.Lock()
+	key, password, addr := o.key.Bytes(), o.password, o.addr
+	o.Unlock()
+	if key == nil {
+		return nil, errOnionKeyWiped
+	}
+
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", o.controlAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = raw.SetDeadline(deadline)
+	}
+	conn := textproto.NewConn(raw)
+	fail := func(err error) (*textproto.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := torCommand(conn, `AUTHENTICATE "%s"`, torQuoter.Replace(password)); err != nil {
+		return fail(err)
+	}
+	expanded := expandOnionKey(ed25519.PrivateKey(key))
+	defer wipeBytes(expanded)
+	// Tor doesn't echo the key because of DiscardPK.  Without the Detach
+	// flag, Tor removes the onion service once we close the connection.
+	reply, err := torCommand(conn, "ADD_ONION ED25519-V3:%s Flags=DiscardPK Port=%d,%s",
+		base64.StdEncoding.EncodeToString(expanded), onionPort, o.target)
+	if err != nil {
+		return fail(err)
+	}
+	for _, line := range reply {
+		if id, ok := strings.CutPrefix(line, "ServiceID="); ok && id+".onion" != addr {
+			return fail(fmt.Errorf("%w: %s", errOnionMismatch, id))
+		}
+	}
+	_ = raw.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// publishOnion publishes our onion service and keeps it published until the
+// enclave stops.  If Tor closes the control connection, e.g., because it
+// restarted, we publish the onion service again.
+func (e *Enclave) publishOnion() {
+	defer reportPanic()
+	var delay time.Duration
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), torControlTimeout)
+		ctx, span := startSpan(ctx, "tor.add_onion")
+		conn, err := e.onion.publish(ctx)
+		span.setError(err)
+		span.end()
+		cancel()
+
+		if err == nil {
+			elog.Info("Published onion service.", "address", e.onion.address())
+			closed := make(chan struct{})
+			go func() {
+				// Tor sends nothing unless we subscribe to events, so the
+				// read only returns once the connection closes.
+				_, _ = conn.R.ReadByte()
+				close(closed)
+			}()
+			select {
+			case <-e.stop:
+				conn.Close()
+				return
+			case <-closed:
+				conn.Close()
+				elog.Warn("Lost connection to Tor's control port.")
+			}
+			delay = minOnionRetryDelay
+		} else {
+			delay = min(max(2*delay, minOnionRetryDelay), maxOnionRetryDelay)
+			elog.Warn("Failed to publish onion service; retrying.", "error", err, "delay", delay)
+		}
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
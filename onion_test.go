@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// mockTor implements just enough of Tor's control protocol to publish onion
+// services.  It sends each ADD_ONION command that it receives to the returned
+// channel.
+func mockTor(t *testing.T, password, serviceID string) (string, chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	failOnErr(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	cmds := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimSuffix(line, "\r\n")
+					switch {
+					case line == fmt.Sprintf("AUTHENTICATE %q", password):
+						fmt.Fprint(conn, "250 OK\r\n")
+					case strings.HasPrefix(line, "AUTHENTICATE"):
+						fmt.Fprint(conn, "515 Authentication failed: Password did not match\r\n")
+						return
+					case strings.HasPrefix(line, "ADD_ONION"):
+						cmds <- line
+						fmt.Fprintf(conn, "250-ServiceID=%s\r\n250 OK\r\n", serviceID)
+					default:
+						fmt.Fprint(conn, "510 Unrecognized command\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), cmds
+}
+
+func TestValidateOnion(t *testing.T) {
+	seed := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+	cases := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"disabled", Config{TorControlAddr: "10.0.0.1:9051"}, false},
+		{"default control port", Config{OnionService: true}, false},
+		{"localhost", Config{OnionService: true, TorControlAddr: "localhost:9051"}, false},
+		{"key", Config{OnionService: true, OnionKey: seed}, false},
+		{"key reference", Config{OnionService: true, OnionKey: "kms://Zm9v"}, false},
+		{"remote control port", Config{OnionService: true, TorControlAddr: "10.0.0.1:9051"}, true},
+		{"bad control port", Config{OnionService: true, TorControlAddr: "127.0.0.1"}, true},
+		{"VSOCK", Config{OnionService: true, UseVsockForExtPort: true}, true},
+		{"bad key", Config{OnionService: true, OnionKey: "Zm9v"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.cfg.validateOnion()
+			assertEqual(t, err != nil, c.wantErr)
+			if err != nil {
+				assertEqual(t, errors.Is(err, errCfgBadOnion), true)
+			}
+		})
+	}
+}
+
+func TestOnionAddress(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	failOnErr(t, err)
+	addr := onionAddress(pub)
+	assertEqual(t, len(addr), 56+len(".onion"))
+
+	raw, err := base32.StdEncoding.DecodeString(strings.ToUpper(strings.TrimSuffix(addr, ".onion")))
+	failOnErr(t, err)
+	assertEqual(t, ed25519.PublicKey(raw[:ed25519.PublicKeySize]).Equal(pub), true)
+	assertEqual(t, raw[len(raw)-1], byte(onionVersion))
+	h := sha3.Sum256(append(append([]byte(".onion checksum"), pub...), onionVersion))
+	assertEqual(t, string(raw[ed25519.PublicKeySize:ed25519.PublicKeySize+2]), string(h[:2]))
+}
+
+func TestExpandOnionKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	failOnErr(t, err)
+	expanded := expandOnionKey(key)
+	h := sha512.Sum512(key.Seed())
+	assertEqual(t, len(expanded), 64)
+	assertEqual(t, expanded[0]&7, byte(0))
+	assertEqual(t, expanded[31]&0xc0, byte(0x40))
+	assertEqual(t, string(expanded[32:]), string(h[32:]))
+}
+
+func TestPublishOnion(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	key := ed25519.NewKeyFromSeed(seed)
+	addr := onionAddress(key.Public().(ed25519.PublicKey))
+	controlAddr, cmds := mockTor(t, `pass"word`, strings.TrimSuffix(addr, ".onion"))
+
+	c := defaultCfg
+	c.OnionService = true
+	c.TorControlAddr = controlAddr
+	e := createEnclave(&c)
+	failOnErr(t, e.onion.setKey(base64.StdEncoding.EncodeToString(seed), `pass"word`))
+	assertEqual(t, e.onion.address(), addr)
+
+	go e.publishOnion()
+	defer close(e.stop)
+	select {
+	case cmd := <-cmds:
+		want := fmt.Sprintf("ADD_ONION ED25519-V3:%s Flags=DiscardPK Port=443,127.0.0.1:%d",
+			base64.StdEncoding.EncodeToString(expandOnionKey(key)), c.ExtPubPort)
+		assertEqual(t, cmd, want)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for onion service to be published.")
+	}
+
+	resp := makeReqToSrv(e.extPubSrv)(http.MethodGet, pathInfo, nil)
+	var info enclaveInfo
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&info))
+	assertEqual(t, info.OnionAddress, addr)
+}
+
+func TestPublishOnionErrors(t *testing.T) {
+	ctx := context.Background()
+	o := &onionService{target: "127.0.0.1:443"}
+	failOnErr(t, o.setKey("", "foo"))
+
+	// Tor rejects our password.
+	o.controlAddr, _ = mockTor(t, "bar", strings.TrimSuffix(o.address(), ".onion"))
+	if _, err := o.publish(ctx); !errors.Is(err, errTorControl) {
+		t.Fatalf("Expected error %v but got %v.", errTorControl, err)
+	}
+
+	// Tor publishes an unexpected onion address.
+	o.controlAddr, _ = mockTor(t, "foo", "foo")
+	if _, err := o.publish(ctx); !errors.Is(err, errOnionMismatch) {
+		t.Fatalf("Expected error %v but got %v.", errOnionMismatch, err)
+	}
+
+	o.wipe()
+	if _, err := o.publish(ctx); !errors.Is(err, errOnionKeyWiped) {
+		t.Fatalf("Expected error %v but got %v.", errOnionKeyWiped, err)
+	}
+}
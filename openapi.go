@@ -0,0 +1,883 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const openAPIVersion = "3.0.3"
+
+// The Web servers that expose nitriding's APIs.  We use them as tags in our
+// OpenAPI specification.
+const (
+	apiPublic   = "public"
+	apiPrivate  = "private"
+	apiInternal = "internal"
+)
+
+// openAPISpec represents an OpenAPI specification.  We only implement the
+// subset of the specification that we need to describe nitriding's APIs:
+// https://spec.openapis.org/oas/v3.0.3
+type openAPISpec struct {
+	OpenAPI    string                       `json:"openapi"`
+	Info       openAPIInfo                  `json:"info"`
+	Tags       []openAPITag                 `json:"tags"`
+	Paths      map[string]openAPIPathItem   `json:"paths"`
+	Components map[string]map[string]schema `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPITag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// openAPIPathItem maps lower-case HTTP methods to operations.
+type openAPIPathItem map[string]*openAPIOperation
+
+type openAPIOperation struct {
+	Tags        []string                    `json:"tags"`
+	Summary     string                      `json:"summary"`
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	Schema      schema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                      `json:"required"`
+	Content  map[string]openAPIContent `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                    `json:"description"`
+	Content     map[string]openAPIContent `json:"content,omitempty"`
+}
+
+type openAPIContent struct {
+	Schema schema `json:"schema"`
+}
+
+// schema represents an OpenAPI schema object.  A map keeps our schema
+// definitions below concise.
+type schema map[string]any
+
+var (
+	nonceParam = openAPIParameter{
+		Name:        "nonce",
+		In:          "query",
+		Description: fmt.Sprintf("%d-byte nonce, encoded as %d hexadecimal digits.", nonceLen, nonceNumDigits),
+		Required:    true,
+		Schema:      schema{"type": "string", "pattern": fmt.Sprintf("^[0-9a-fA-F]{%d}$", nonceNumDigits)},
+	}
+	bootParam = openAPIParameter{
+		Name:        "boot",
+		In:          "query",
+		Description: "If true, returns the attestation document that nitriding created at startup, whose nonce is all zeroes.  Then, nonce is optional.",
+		Schema:      schema{"type": "boolean"},
+	}
+	powParam = openAPIParameter{
+		Name:        "pow",
+		In:          "query",
+		Description: "Solution to the proof-of-work puzzle, if nitriding requires one.",
+		Schema:      schema{"type": "string", "maxLength": maxPoWLen},
+	}
+	powTSParam = openAPIParameter{
+		Name:        "pow_ts",
+		In:          "query",
+		Description: "Unix timestamp of the proof-of-work puzzle, if nitriding requires one.",
+		Schema:      schema{"type": "integer"},
+	}
+	stateNameParam = openAPIParameter{
+		Name:        "name",
+		In:          "query",
+		Description: "The sealed state's name: 1 to 128 letters, digits, dots, dashes, and underscores.",
+		Required:    true,
+		Schema:      schema{"type": "string", "pattern": stateNameRegexp.String()},
+	}
+	stringSchema  = schema{"type": "string"}
+	binarySchema  = schema{"type": "string", "format": "binary"}
+	counterSchema = schema{"type": "integer", "format": "int64", "minimum": 0}
+	schemaRef     = func(name string) schema {
+		return schema{"$ref": "#/components/schemas/" + name}
+	}
+
+	// apiSchemas contains the schemas that our requests and responses refer
+	// to.
+	apiSchemas = map[string]schema{
+		"Error": {
+			"type": "object",
+			"properties": schema{
+				"code":       schema{"type": "integer"},
+				"message":    stringSchema,
+				"request_id": stringSchema,
+			},
+		},
+		"AttestationBody": {
+			"type": "object",
+			"properties": schema{
+				"document":       schema{"type": "string", "format": "byte"},
+				"encrypted_keys": schema{"type": "string", "format": "byte"},
+			},
+		},
+		"AttestationDocument": {
+			"type": "object",
+			"properties": schema{
+				"document": schema{"type": "string", "format": "byte"},
+			},
+		},
+		"Index": {
+			"type": "object",
+			"properties": schema{
+				"fqdn":             stringSchema,
+				"app_url":          stringSchema,
+				"pcrs":             schema{"type": "object", "additionalProperties": stringSchema},
+				"cert_fingerprint": stringSchema,
+			},
+		},
+		"Heartbeat": {
+			"type": "object",
+			"properties": schema{
+				"hashed_keys":     schema{"type": "string", "format": "byte"},
+				"worker_hostname": stringSchema,
+			},
+		},
+		"EnclaveInfo": {
+			"type": "object",
+			"properties": schema{
+				"version":          stringSchema,
+				"git_commit":       stringSchema,
+				"start_time":       schema{"type": "string", "format": "date-time"},
+				"uptime":           stringSchema,
+				"in_enclave":       schema{"type": "boolean"},
+				"fips_mode":        schema{"type": "string", "enum": []string{fipsOff, "boringcrypto", "fips140"}},
+				"fqdn":             stringSchema,
+				"cert_fingerprint": stringSchema,
+				"config_hash":      stringSchema,
+				"onion_address":    stringSchema,
+				"restart_count":    counterSchema,
+				"operations":       schemaRef("Operations"),
+			},
+		},
+		"ImageInfo": {
+			"type": "object",
+			"properties": schema{
+				"pcrs": schema{"type": "object", "additionalProperties": stringSchema},
+				"kernel": schema{
+					"type": "object",
+					"properties": schema{
+						"release":        stringSchema,
+						"cmdline":        stringSchema,
+						"cmdline_sha384": stringSchema,
+					},
+				},
+				"metadata": schema{"type": "object"},
+			},
+		},
+		"VerificationBundle": {
+			"type": "object",
+			"properties": schema{
+				"pcrs":                 schema{"type": "object", "additionalProperties": stringSchema},
+				"cert_fingerprint":     stringSchema,
+				"nonce":                stringSchema,
+				"attestation_document": stringSchema,
+				"root_ca":              stringSchema,
+			},
+		},
+		"AuditEntry": {
+			"type": "object",
+			"properties": schema{
+				"seq":          counterSchema,
+				"time":         schema{"type": "string", "format": "date-time"},
+				"operation":    stringSchema,
+				"caller":       stringSchema,
+				"payload_hash": stringSchema,
+				"status":       schema{"type": "integer"},
+				"prev_hash":    stringSchema,
+				"hash":         stringSchema,
+			},
+		},
+		"EgressStats": {
+			"type": "object",
+			"properties": schema{
+				"destinations": schema{
+					"type":  "array",
+					"items": schemaRef("EgressCounters"),
+				},
+				"untracked": schemaRef("EgressCounters"),
+			},
+		},
+		"EgressCounters": {
+			"type": "object",
+			"properties": schema{
+				"host":           stringSchema,
+				"port":           schema{"type": "integer"},
+				"protocol":       stringSchema,
+				"connections":    counterSchema,
+				"packets_sent":   counterSchema,
+				"bytes_sent":     counterSchema,
+				"bytes_received": counterSchema,
+				"errors":         counterSchema,
+			},
+		},
+		"RuntimeStats": {
+			"type": "object",
+			"properties": schema{
+				"goroutines":     schema{"type": "integer"},
+				"gomaxprocs":     schema{"type": "integer"},
+				"num_cpu":        schema{"type": "integer"},
+				"go_version":     stringSchema,
+				"heap_alloc":     counterSchema,
+				"heap_inuse":     counterSchema,
+				"heap_sys":       counterSchema,
+				"heap_objects":   counterSchema,
+				"sys":            counterSchema,
+				"num_gc":         counterSchema,
+				"gc_pause_total": stringSchema,
+				"last_gc":        schema{"type": "string", "format": "date-time"},
+				"memory_limit":   counterSchema,
+				"memory": schema{
+					"type": "object",
+					"properties": schema{
+						"total":     counterSchema,
+						"available": counterSchema,
+					},
+				},
+				"file_descriptors": schema{
+					"type": "object",
+					"properties": schema{
+						"open":       counterSchema,
+						"soft_limit": counterSchema,
+						"hard_limit": counterSchema,
+					},
+				},
+			},
+		},
+		"TimeInfo": {
+			"type": "object",
+			"properties": schema{
+				"time":      schema{"type": "string", "format": "date-time"},
+				"offset":    stringSchema,
+				"radius":    stringSchema,
+				"last_sync": schema{"type": "string", "format": "date-time"},
+				"server":    stringSchema,
+			},
+		},
+		"KMSDecryptRequest": {
+			"type":     "object",
+			"required": []string{"ciphertext_blob"},
+			"properties": schema{
+				"ciphertext_blob":    schema{"type": "string", "format": "byte"},
+				"key_id":             stringSchema,
+				"encryption_context": schema{"type": "object", "additionalProperties": stringSchema},
+				"region":             stringSchema,
+			},
+		},
+		"KMSDataKeyRequest": {
+			"type":     "object",
+			"required": []string{"key_id"},
+			"properties": schema{
+				"key_id":             stringSchema,
+				"key_spec":           schema{"type": "string", "enum": []string{"AES_128", "AES_256"}},
+				"number_of_bytes":    schema{"type": "integer", "minimum": 1, "maximum": 1024},
+				"encryption_context": schema{"type": "object", "additionalProperties": stringSchema},
+				"region":             stringSchema,
+			},
+		},
+		"S3FetchRequest": {
+			"type":     "object",
+			"required": []string{"bucket", "key", "sha256"},
+			"properties": schema{
+				"bucket": stringSchema,
+				"key":    stringSchema,
+				"region": stringSchema,
+				"sha256": schema{"type": "string", "pattern": "^[0-9a-fA-F]{64}$"},
+				"path":   stringSchema,
+				"attest": schema{"type": "boolean"},
+			},
+		},
+		"S3FetchResponse": {
+			"type": "object",
+			"properties": schema{
+				"path":   stringSchema,
+				"size":   counterSchema,
+				"sha256": stringSchema,
+			},
+		},
+		"VaultToken": {
+			"type": "object",
+			"properties": schema{
+				"client_token": stringSchema,
+				"expires_at":   schema{"type": "string", "format": "date-time"},
+			},
+		},
+		"SVID": {
+			"type": "object",
+			"properties": schema{
+				"spiffe_id":   stringSchema,
+				"cert_chain":  stringSchema,
+				"private_key": stringSchema,
+				"bundle":      stringSchema,
+				"expires_at":  schema{"type": "string", "format": "date-time"},
+			},
+		},
+		"DatabaseInfo": {
+			"type": "object",
+			"properties": schema{
+				"name":       stringSchema,
+				"protocol":   stringSchema,
+				"host":       stringSchema,
+				"port":       stringSchema,
+				"user":       stringSchema,
+				"password":   stringSchema,
+				"ca_bundle":  stringSchema,
+				"local_addr": stringSchema,
+			},
+		},
+		"OIDCTokenRequest": {
+			"type":     "object",
+			"required": []string{"sub", "aud"},
+			"properties": schema{
+				"sub":    stringSchema,
+				"aud":    stringSchema,
+				"ttl":    counterSchema,
+				"claims": schema{"type": "object"},
+			},
+		},
+		"OIDCTokenResponse": {
+			"type": "object",
+			"properties": schema{
+				"token":      stringSchema,
+				"expires_at": schema{"type": "string", "format": "date-time"},
+			},
+		},
+		"SealedLogReceipt": {
+			"type": "object",
+			"properties": schema{
+				"seq":  counterSchema,
+				"hash": stringSchema,
+			},
+		},
+		"PrivacyPassIssuerDirectory": {
+			"type": "object",
+			"properties": schema{
+				"issuer-request-uri": stringSchema,
+				"token-keys": schema{
+					"type": "array",
+					"items": schema{
+						"type": "object",
+						"properties": schema{
+							"token-type": schema{"type": "integer"},
+							"token-key":  stringSchema,
+						},
+					},
+				},
+			},
+		},
+		"PrivacyPassRedemption": {
+			"type": "object",
+			"properties": schema{
+				"nonce":            schema{"type": "string", "format": "byte"},
+				"challenge_digest": schema{"type": "string", "format": "byte"},
+			},
+		},
+		"KMSResponse": {
+			"type": "object",
+			"properties": schema{
+				"key_id":          stringSchema,
+				"plaintext":       schema{"type": "string", "format": "byte"},
+				"ciphertext_blob": schema{"type": "string", "format": "byte"},
+			},
+		},
+		"Operations": {
+			"type": "object",
+			"properties": schema{
+				"attestations":          counterSchema,
+				"attestation_errors":    counterSchema,
+				"key_syncs":             counterSchema,
+				"key_sync_errors":       counterSchema,
+				"cert_renewals":         counterSchema,
+				"host_proxy_errors":     counterSchema,
+				"app_proxy_errors":      counterSchema,
+				"nonce_cache_evictions": counterSchema,
+				"shed_requests":         counterSchema,
+				"events_forwarded":      counterSchema,
+				"events_dropped":        counterSchema,
+				"app_restarts":          counterSchema,
+				"dns_cache_hits":        counterSchema,
+				"dns_cache_misses":      counterSchema,
+			},
+		},
+	}
+
+	// apiOperations documents all of nitriding's endpoints, keyed by HTTP
+	// method and unversioned path.  Whenever we register a new route, we must
+	// document it here.  Our unit tests enforce this.
+	apiOperations = map[string]*openAPIOperation{
+		http.MethodGet + " " + pathRoot: {
+			Summary: "Returns an index page explaining that this host runs inside an enclave.",
+			Responses: func() map[string]*openAPIResponse {
+				resps := okResponse(contentTypeText, stringSchema)
+				resps["200"].Content[contentTypeHTML] = openAPIContent{stringSchema}
+				resps["200"].Content[contentTypeJSON] = openAPIContent{schemaRef("Index")}
+				return resps
+			}(),
+		},
+		http.MethodGet + " " + pathAttestation: {
+			Summary: "Returns an attestation document that contains the given nonce, encoded as requested via the Accept header.",
+			Parameters: func() []openAPIParameter {
+				optionalNonce := nonceParam
+				optionalNonce.Required = false
+				return []openAPIParameter{optionalNonce, bootParam, powParam, powTSParam}
+			}(),
+			Responses: func() map[string]*openAPIResponse {
+				resps := okResponse(contentTypeText, stringSchema)
+				resps["200"].Content[contentTypeCBOR] = openAPIContent{binarySchema}
+				resps["200"].Content[contentTypeJSON] = openAPIContent{schemaRef("AttestationDocument")}
+				return resps
+			}(),
+		},
+		http.MethodGet + " " + pathOIDCConfig: {
+			Summary:   "Returns the OpenID Connect discovery document of the enclave's token issuer.",
+			Responses: okResponse(contentTypeJSON, schema{"type": "object"}),
+		},
+		http.MethodGet + " " + pathOIDCKeys: {
+			Summary:   "Returns the JSON Web Key Set that verifies the enclave's tokens.",
+			Responses: okResponse(contentTypeJSON, schema{"type": "object"}),
+		},
+		http.MethodGet + " " + pathOIDCAttstn: {
+			Summary:    "Returns an attestation document whose public key is the enclave's token signing key.",
+			Parameters: []openAPIParameter{nonceParam, powParam, powTSParam},
+			Responses: func() map[string]*openAPIResponse {
+				resps := okResponse(contentTypeText, stringSchema)
+				resps["200"].Content[contentTypeCBOR] = openAPIContent{binarySchema}
+				resps["200"].Content[contentTypeJSON] = openAPIContent{schemaRef("AttestationDocument")}
+				return resps
+			}(),
+		},
+		http.MethodGet + " " + pathSLAttstn: {
+			Summary:    "Returns an attestation document whose public key is the enclave's sealed log signing key.",
+			Parameters: []openAPIParameter{nonceParam, powParam, powTSParam},
+			Responses: func() map[string]*openAPIResponse {
+				resps := okResponse(contentTypeText, stringSchema)
+				resps["200"].Content[contentTypeCBOR] = openAPIContent{binarySchema}
+				resps["200"].Content[contentTypeJSON] = openAPIContent{schemaRef("AttestationDocument")}
+				return resps
+			}(),
+		},
+		http.MethodPost + " " + pathOHTTP: {
+			Summary: "Decapsulates an Oblivious HTTP request, forwards it to the application, and returns the encapsulated response.",
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{ohttpReqType: {binarySchema}},
+			},
+			Responses: okResponse(ohttpRespType, binarySchema),
+		},
+		http.MethodGet + " " + pathOHTTPKeys: {
+			Summary:   "Returns the Oblivious HTTP gateway's key configuration.",
+			Responses: okResponse(ohttpKeysType, binarySchema),
+		},
+		http.MethodGet + " " + pathOHTTPAttstn: {
+			Summary:    "Returns an attestation document whose public key is the Oblivious HTTP gateway's key configuration.",
+			Parameters: []openAPIParameter{nonceParam, powParam, powTSParam},
+			Responses: func() map[string]*openAPIResponse {
+				resps := okResponse(contentTypeText, stringSchema)
+				resps["200"].Content[contentTypeCBOR] = openAPIContent{binarySchema}
+				resps["200"].Content[contentTypeJSON] = openAPIContent{schemaRef("AttestationDocument")}
+				return resps
+			}(),
+		},
+		http.MethodGet + " " + pathPPDirectory: {
+			Summary:   "Returns the Privacy Pass issuer directory.",
+			Responses: okResponse(privacyPassDirType, schemaRef("PrivacyPassIssuerDirectory")),
+		},
+		http.MethodGet + " " + pathPPAttstn: {
+			Summary:    "Returns an attestation document whose public key is the Privacy Pass issuer key.",
+			Parameters: []openAPIParameter{nonceParam, powParam, powTSParam},
+			Responses: func() map[string]*openAPIResponse {
+				resps := okResponse(contentTypeText, stringSchema)
+				resps["200"].Content[contentTypeCBOR] = openAPIContent{binarySchema}
+				resps["200"].Content[contentTypeJSON] = openAPIContent{schemaRef("AttestationDocument")}
+				return resps
+			}(),
+		},
+		http.MethodPost + " " + pathPPIssue: {
+			Summary: "Responds to a Privacy Pass token request.",
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{privacyPassReqType: {binarySchema}},
+			},
+			Responses: okResponse(privacyPassRespType, binarySchema),
+		},
+		http.MethodGet + " " + pathConfig: {
+			Summary:   "Returns nitriding's configuration.",
+			Responses: okResponse("text/plain", stringSchema),
+		},
+		http.MethodGet + " " + pathInfo: {
+			Summary:   "Returns information about the running nitriding instance.",
+			Responses: okResponse("application/json", schemaRef("EnclaveInfo")),
+		},
+		http.MethodGet + " " + pathImage: {
+			Summary:   "Returns the enclave image's PCR values, kernel, and build metadata.",
+			Responses: okResponse(contentTypeJSON, schemaRef("ImageInfo")),
+		},
+		http.MethodGet + " " + pathBundle: {
+			Summary:    "Returns the enclave's PCR values, certificate fingerprint, an attestation document that contains the given nonce, and the attestation's root certificate.",
+			Parameters: []openAPIParameter{nonceParam, powParam, powTSParam},
+			Responses:  okResponse(contentTypeJSON, schemaRef("VerificationBundle")),
+		},
+		http.MethodGet + " " + pathOpenAPI: {
+			Summary:   "Returns this OpenAPI specification.",
+			Responses: okResponse("application/json", schema{"type": "object"}),
+		},
+		http.MethodGet + " " + pathSync: {
+			Summary:    "Exposed by workers; the leader initiates key synchronization.",
+			Parameters: []openAPIParameter{nonceParam},
+			Responses:  okResponse("application/json", schemaRef("AttestationBody")),
+		},
+		http.MethodPost + " " + pathSync: {
+			Summary:     "Exposed by workers; the leader completes key synchronization.",
+			RequestBody: jsonBody(schemaRef("AttestationBody")),
+			Responses:   okResponse("", nil),
+		},
+		http.MethodPost + " " + pathHeartbeat: {
+			Summary:     "Exposed by the leader; workers periodically send heartbeats.",
+			RequestBody: jsonBody(schemaRef("Heartbeat")),
+			Responses:   okResponse("", nil),
+		},
+		http.MethodGet + " " + pathLeader: {
+			Summary:    "Exposed by all enclaves; helps enclaves designate the leader.",
+			Parameters: []openAPIParameter{nonceParam},
+			Responses:  okResponse("", nil),
+		},
+		http.MethodGet + " " + pathReady: {
+			Summary:   "Lets the application signal its readiness.",
+			Responses: okResponse("", nil),
+		},
+		http.MethodPost + " " + pathShutdown: {
+			Summary: "Shuts down the enclave gracefully, e.g., so it can be restarted.",
+			Responses: map[string]*openAPIResponse{
+				"202": {Description: "Shutting down."},
+				"default": {
+					Description: "Error.",
+					Content:     map[string]openAPIContent{"application/json": {schemaRef("Error")}},
+				},
+			},
+		},
+		http.MethodGet + " " + pathState: {
+			Summary:   "Returns the application state that the leader set.",
+			Responses: okResponse("application/octet-stream", binarySchema),
+		},
+		http.MethodPut + " " + pathState: {
+			Summary: "Sets the application state that's synchronized with workers.",
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{"application/octet-stream": {binarySchema}},
+			},
+			Responses: okResponse("", nil),
+		},
+		http.MethodPut + " " + pathConfig: {
+			Summary:     "Reloads the runtime-tunable parts of nitriding's configuration.",
+			RequestBody: jsonBody(schema{"type": "object"}),
+			Responses:   okResponse("", nil),
+		},
+		http.MethodGet + " " + pathAudit: {
+			Summary: "Returns the audit log's entries, starting at the optional 'since' sequence number.",
+			Parameters: []openAPIParameter{{
+				Name:        "since",
+				In:          "query",
+				Description: "The sequence number of the first entry to return.",
+				Schema:      schema{"type": "integer", "format": "int64", "minimum": 0},
+			}},
+			Responses: okResponse(contentTypeJSON, schema{"type": "array", "items": schemaRef("AuditEntry")}),
+		},
+		http.MethodGet + " " + pathEntropy: {
+			Summary: "Returns random bytes from the Nitro Secure Module.",
+			Parameters: []openAPIParameter{{
+				Name:        "size",
+				In:          "query",
+				Description: fmt.Sprintf("The number of random bytes to return.  Defaults to %d.", defaultEntropyLen),
+				Schema:      schema{"type": "integer", "minimum": 1, "maximum": maxEntropyLen},
+			}},
+			Responses: okResponse("application/octet-stream", binarySchema),
+		},
+		http.MethodPost + " " + pathProvision: {
+			Summary: "Accepts a secret that's encrypted, using HPKE, to the public key in our attestation documents.",
+			Parameters: []openAPIParameter{{
+				Name:        "name",
+				In:          "query",
+				Description: "The name of the application secret that the secret becomes.  Without a name, the secret is queued for the enclave application.",
+				Schema:      stringSchema,
+			}},
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{"application/octet-stream": {binarySchema}},
+			},
+			Responses: okResponse("", nil),
+		},
+		http.MethodGet + " " + pathProvision: {
+			Summary: "Returns and forgets the oldest provisioned secret.",
+			Responses: func() map[string]*openAPIResponse {
+				resps := okResponse("application/octet-stream", binarySchema)
+				resps["204"] = &openAPIResponse{Description: "No secret is pending."}
+				return resps
+			}(),
+		},
+		http.MethodPost + " " + pathSecrets: {
+			Summary: "Returns our secrets, encrypted to the public key in the calling enclave's attestation document.",
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{contentTypeCBOR: {binarySchema}},
+			},
+			Responses: okResponse("application/octet-stream", binarySchema),
+		},
+		http.MethodGet + " " + pathStats: {
+			Summary:   "Returns Go runtime statistics and the enclave's memory usage, in bytes.",
+			Responses: okResponse(contentTypeJSON, schemaRef("RuntimeStats")),
+		},
+		http.MethodGet + " " + pathEgress: {
+			Summary:   "Returns counters of the enclave's outbound traffic by destination.",
+			Responses: okResponse(contentTypeJSON, schemaRef("EgressStats")),
+		},
+		http.MethodGet + " " + pathTime: {
+			Summary:   "Returns the time that nitriding obtained via Roughtime or from the EC2 host, and its offset from the local clock.",
+			Responses: okResponse(contentTypeJSON, schemaRef("TimeInfo")),
+		},
+		http.MethodPost + " " + pathKMSDecrypt: {
+			Summary:     "Decrypts a KMS ciphertext, proving our identity to KMS with an attestation document.",
+			RequestBody: jsonBody(schemaRef("KMSDecryptRequest")),
+			Responses:   okResponse(contentTypeJSON, schemaRef("KMSResponse")),
+		},
+		http.MethodPost + " " + pathKMSDataKey: {
+			Summary:     "Generates a KMS data key, proving our identity to KMS with an attestation document.",
+			RequestBody: jsonBody(schemaRef("KMSDataKeyRequest")),
+			Responses:   okResponse(contentTypeJSON, schemaRef("KMSResponse")),
+		},
+		http.MethodPost + " " + pathS3Fetch: {
+			Summary:     "Fetches an S3 object and verifies its SHA-256 hash.",
+			RequestBody: jsonBody(schemaRef("S3FetchRequest")),
+			Responses: func() map[string]*openAPIResponse {
+				resps := okResponse(contentTypeJSON, schemaRef("S3FetchResponse"))
+				resps["200"].Content["application/octet-stream"] = openAPIContent{binarySchema}
+				return resps
+			}(),
+		},
+		http.MethodGet + " " + pathAppSecrets: {
+			Summary: "Returns an application secret that nitriding fetched from Secrets Manager, or that a client provisioned by name.",
+			Parameters: []openAPIParameter{{
+				Name:        "name",
+				In:          "query",
+				Description: "The secret's name.",
+				Required:    true,
+				Schema:      stringSchema,
+			}},
+			Responses: okResponse("application/octet-stream", binarySchema),
+		},
+		http.MethodPut + " " + pathSealedState: {
+			Summary:    "Encrypts a blob under an attestation-bound KMS key, and stores it under the given name.",
+			Parameters: []openAPIParameter{stateNameParam},
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{"application/octet-stream": {binarySchema}},
+			},
+			Responses: map[string]*openAPIResponse{
+				"204": {Description: "Stored."},
+				"default": {
+					Description: "Error.",
+					Content:     map[string]openAPIContent{"application/json": {schemaRef("Error")}},
+				},
+			},
+		},
+		http.MethodGet + " " + pathSealedState: {
+			Summary:    "Loads and decrypts the blob that was stored under the given name.",
+			Parameters: []openAPIParameter{stateNameParam},
+			Responses:  okResponse("application/octet-stream", binarySchema),
+		},
+		http.MethodGet + " " + pathVaultToken: {
+			Summary:   "Returns the Vault token that nitriding obtained using an attestation document.",
+			Responses: okResponse(contentTypeJSON, schemaRef("VaultToken")),
+		},
+		http.MethodGet + " " + pathSVID: {
+			Summary:   "Returns the X.509 SVID, its private key, and the trust bundle that nitriding obtained from SPIRE.",
+			Responses: okResponse(contentTypeJSON, schemaRef("SVID")),
+		},
+		http.MethodGet + " " + pathDatabases: {
+			Summary: "Returns the connection details, credentials, and pinned CA certificates of a database.",
+			Parameters: []openAPIParameter{{
+				Name:        "name",
+				In:          "query",
+				Description: "The database's name.",
+				Required:    true,
+				Schema:      stringSchema,
+			}},
+			Responses: okResponse(contentTypeJSON, schemaRef("DatabaseInfo")),
+		},
+		http.MethodPost + " " + pathSealedLog: {
+			Summary: "Appends a record to the sealed log, which nitriding hash-chains, signs, and ships to the EC2 host.",
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{"application/octet-stream": {binarySchema}},
+			},
+			Responses: okResponse(contentTypeJSON, schemaRef("SealedLogReceipt")),
+		},
+		http.MethodPost + " " + pathEvents: {
+			Summary: "Enqueues a JSON-encoded event that nitriding forwards to SQS or Kafka.",
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{"application/json": {schema{"type": "object"}}},
+			},
+			Responses: map[string]*openAPIResponse{
+				"202": {Description: "Enqueued."},
+				"default": {
+					Description: "Error.",
+					Content:     map[string]openAPIContent{"application/json": {schemaRef("Error")}},
+				},
+			},
+		},
+		http.MethodPost + " " + pathOIDCToken: {
+			Summary:     "Mints a short-lived JWT that's signed by the enclave's OIDC signing key.",
+			RequestBody: jsonBody(schemaRef("OIDCTokenRequest")),
+			Responses:   okResponse(contentTypeJSON, schemaRef("OIDCTokenResponse")),
+		},
+		http.MethodPost + " " + pathPPRedeem: {
+			Summary: "Verifies a Privacy Pass token, and returns its nonce and challenge digest.",
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{"application/octet-stream": {binarySchema}},
+			},
+			Responses: okResponse(contentTypeJSON, schemaRef("PrivacyPassRedemption")),
+		},
+		http.MethodPost + " " + pathHash: {
+			Summary: "Registers a Base64-encoded SHA-256 hash that's included in attestation documents.",
+			RequestBody: &openAPIBody{
+				Required: true,
+				Content:  map[string]openAPIContent{"text/plain": {stringSchema}},
+			},
+			Responses: okResponse("", nil),
+		},
+	}
+)
+
+// okResponse returns the responses of an operation that responds with the
+// given content type and schema if all goes well, and with our JSON error
+// envelope otherwise.
+func okResponse(contentType string, s schema) map[string]*openAPIResponse {
+	ok := &openAPIResponse{Description: "Success."}
+	if contentType != "" {
+		ok.Content = map[string]openAPIContent{contentType: {s}}
+	}
+	return map[string]*openAPIResponse{
+		"200": ok,
+		"default": {
+			Description: "Error.",
+			Content:     map[string]openAPIContent{"application/json": {schemaRef("Error")}},
+		},
+	}
+}
+
+// jsonBody returns a required, JSON-encoded request body of the given schema.
+func jsonBody(s schema) *openAPIBody {
+	return &openAPIBody{
+		Required: true,
+		Content:  map[string]openAPIContent{"application/json": {s}},
+	}
+}
+
+// isDocumentedRoute returns true if the given route belongs in our OpenAPI
+// specification.  Profiling endpoints and the catch-all route that forwards
+// requests to the enclave application are not part of nitriding's API.
+func isDocumentedRoute(route string) bool {
+	return isNitridingPath(route) && !strings.HasPrefix(route, pathProfiling)
+}
+
+// buildOpenAPISpec walks over the routes that are registered with the given
+// routers (keyed by API name) and returns an OpenAPI specification of these
+// routes.  Building the specification from our routers means that the
+// specification cannot diverge from the routes that we actually serve.
+func buildOpenAPISpec(routers map[string]chi.Routes) (*openAPISpec, error) {
+	spec := &openAPISpec{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:   "Nitriding",
+			Version: version,
+		},
+		Tags: []openAPITag{
+			{Name: apiPublic, Description: "Reachable by the Internet."},
+			{Name: apiPrivate, Description: "Reachable by other enclaves."},
+			{Name: apiInternal, Description: "Reachable by the enclave application."},
+		},
+		Paths:      make(map[string]openAPIPathItem),
+		Components: map[string]map[string]schema{"schemas": apiSchemas},
+	}
+
+	apis := make([]string, 0, len(routers))
+	for api := range routers {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+
+	for _, api := range apis {
+		err := chi.Walk(routers[api], func(
+			method, route string,
+			_ http.Handler,
+			_ ...func(http.Handler) http.Handler,
+		) error {
+			if !isDocumentedRoute(route) {
+				return nil
+			}
+			doc, exists := apiOperations[method+" "+unversioned(route)]
+			if !exists {
+				return fmt.Errorf("route %s %s is undocumented", method, route)
+			}
+			op := *doc
+			op.Tags = []string{api}
+			op.Deprecated = unversioned(route) == route
+			if spec.Paths[route] == nil {
+				spec.Paths[route] = make(openAPIPathItem)
+			}
+			spec.Paths[route][strings.ToLower(method)] = &op
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+// openAPIHandler returns an HTTP handler that returns an OpenAPI specification
+// of nitriding's public, private, and internal APIs.
+func openAPIHandler(e *Enclave) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		spec, err := buildOpenAPISpec(map[string]chi.Routes{
+			apiPublic:   e.extPubSrv.Handler.(*chi.Mux),
+			apiPrivate:  e.extPrivSrv.Handler.(*chi.Mux),
+			apiInternal: e.intSrv.Handler.(*chi.Mux),
+		})
+		if err != nil {
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(spec); err != nil {
+			elog.Error("Error encoding OpenAPI specification.", "error", err)
+		}
+	}
+}
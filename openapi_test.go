@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	c := defaultCfg
+	c.AuditLog = true
+	c.IntAuthToken = "foo"
+	c.Provisioning = true
+	c.DeliveredSecrets = []string{"foo=asm://foo"}
+	c.SecretDeliveryPCRs = []string{testDeliveryPCR}
+	c.AppSecrets = []string{"foo=asm://foo"}
+	c.VaultAddr = "https://vault.example.com:8200"
+	c.VaultRole = "foo"
+	c.SpireServer = "127.0.0.1:8081"
+	c.SpireTrustDomain = "example.org"
+	c.SpireTrustBundle = newSpireCA(t).bundle
+	c.OIDCTokens = true
+	c.Databases = []string{"main=postgres://app@db.example.com:5432"}
+	c.DatabaseCA = c.SpireTrustBundle
+	c.EventSink = "sqs://us-east-1/123456789012/events"
+	c.SealedStateKMSKey = "alias/state"
+	c.SealedStateStore = "s3://state-bucket/prefix"
+	c.SealedLogPort = 8006
+	c.EgressStats = true
+	c.AppWebSrv, _ = url.Parse("http://127.0.0.1:8080")
+	c.OHTTPGateway = true
+	c.PrivacyPass = true
+	c.RoughtimeServer = "127.0.0.1:2002"
+	c.RoughtimePublicKey = base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	e := createEnclave(&c)
+	// Register the leader-specific endpoints as well, to make sure that they
+	// are documented too.
+	e.setupLeader()
+	addRoute(e.extPrivSrv.Handler.(*chi.Mux), http.MethodGet, pathLeader, func(w http.ResponseWriter, r *http.Request) {})
+
+	var spec openAPISpec
+	resp := makeReqToSrv(e.extPubSrv)(http.MethodGet, pathOpenAPI, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, spec.OpenAPI, openAPIVersion)
+
+	// Every documented operation must show up in the specification.
+	numOps := 0
+	for _, item := range spec.Paths {
+		numOps += len(item)
+	}
+	// ...once under our versioned API and once under the deprecated,
+	// unversioned path.
+	assertEqual(t, numOps, len(apiOperations)*2)
+	assertEqual(t, spec.Paths[pathState]["put"].Tags[0], apiInternal)
+	assertEqual(t, spec.Paths[pathState]["put"].Deprecated, true)
+	assertEqual(t, spec.Paths[versioned(pathSync)]["post"].Tags[0], apiPrivate)
+	assertEqual(t, spec.Paths[versioned(pathSync)]["post"].Deprecated, false)
+	assertEqual(t, spec.Paths[pathProvision]["post"].Tags[0], apiPublic)
+	assertEqual(t, spec.Paths[pathProvision]["get"].Tags[0], apiInternal)
+}
+
+func TestUndocumentedRoute(t *testing.T) {
+	m := chi.NewRouter()
+	m.Get(pathRoot+"/undocumented", func(w http.ResponseWriter, r *http.Request) {})
+	if _, err := buildOpenAPISpec(map[string]chi.Routes{apiPublic: m}); err == nil {
+		t.Fatal("Expected error for undocumented route.")
+	}
+}
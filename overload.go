@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// loadCheckInterval determines how often we measure the enclave's memory
+	// and CPU utilization.
+	loadCheckInterval = time.Second
+	// shedRetryAfter is the number of seconds after which we ask clients to
+	// retry requests that we shed.
+	shedRetryAfter = "5"
+)
+
+var (
+	errCfgBadOverload = errors.New("given config has overload threshold above 100 percent")
+	errOverloaded     = errors.New("enclave is overloaded; try again later")
+)
+
+// procStatPath is the file that tells us how much time the enclave's CPUs
+// spent on what.
+var procStatPath = "/proc/stat"
+
+// lowPriorityPaths contains nitriding's endpoints that we stop serving when
+// the enclave is overloaded.  Attestation and key synchronization remain
+// available.
+var lowPriorityPaths = map[string]bool{
+	pathRoot:  true,
+	pathStats: true,
+}
+
+// cpuTimes holds the cumulative time, in clock ticks, that the enclave's CPUs
+// spent busy and in total, as reported by /proc/stat.
+type cpuTimes struct {
+	busy, total uint64
+}
+
+// readCPUTimes parses the aggregate CPU times from the given file in the
+// format of /proc/stat.
+func readCPUTimes(path string) (*cpuTimes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// The line looks like "cpu  user nice system idle iowait irq ...".
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		times := new(cpuTimes)
+		for i, field := range fields[1:] {
+			n, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			times.total += n
+			// Idle and iowait are the fourth and fifth column.
+			if i != 3 && i != 4 {
+				times.busy += n
+			}
+		}
+		return times, nil
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no aggregate CPU times in %s", path)
+}
+
+// loadMonitor tells if the enclave's memory or CPU utilization exceeds the
+// given thresholds, in percent.  A threshold of 0 disables the respective
+// check.
+type loadMonitor struct {
+	memPercent, cpuPercent uint8
+	lastCPU                *cpuTimes
+	overloaded             atomic.Bool
+}
+
+// newLoadMonitor returns a new load monitor for the given thresholds.
+func newLoadMonitor(memPercent, cpuPercent uint8) *loadMonitor {
+	return &loadMonitor{memPercent: memPercent, cpuPercent: cpuPercent}
+}
+
+// update measures the enclave's utilization, and determines if the enclave
+// is overloaded.  If we fail to measure the utilization, we consider the
+// enclave not overloaded, so a broken measurement never takes endpoints
+// offline.
+func (l *loadMonitor) update() {
+	var overloaded bool
+	if l.memPercent > 0 {
+		if mem, err := readMeminfo(meminfoPath); err == nil && mem.Total > 0 {
+			used := (mem.Total - min(mem.Available, mem.Total)) * 100 / mem.Total
+			overloaded = used >= uint64(l.memPercent)
+		}
+	}
+	if l.cpuPercent > 0 {
+		if cur, err := readCPUTimes(procStatPath); err == nil {
+			if prev := l.lastCPU; prev != nil && cur.total > prev.total {
+				busy := (cur.busy - min(prev.busy, cur.busy)) * 100 / (cur.total - prev.total)
+				overloaded = overloaded || busy >= uint64(l.cpuPercent)
+			}
+			l.lastCPU = cur
+		}
+	}
+	if l.overloaded.Swap(overloaded) != overloaded {
+		if overloaded {
+			elog.Warn("Enclave is overloaded.  Shedding low-priority requests.")
+		} else {
+			elog.Info("Enclave is no longer overloaded.")
+		}
+	}
+}
+
+// isOverloaded returns true if the enclave was overloaded when we last
+// measured its utilization.
+func (l *loadMonitor) isOverloaded() bool {
+	return l.overloaded.Load()
+}
+
+// monitorLoad periodically measures the enclave's utilization until the
+// enclave stops.
+func (e *Enclave) monitorLoad() {
+	defer reportPanic()
+	ticker := time.NewTicker(loadCheckInterval)
+	defer ticker.Stop()
+	for {
+		e.load.update()
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// shedLoad returns a chi middleware that responds with status code 503 to
+// requests that the given function considers low priority while the enclave is
+// overloaded.
+func shedLoad(l *loadMonitor, isLowPriority func(*http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l.isOverloaded() && isLowPriority(r) {
+				ops.shedRequests.Add(1)
+				w.Header().Set("Retry-After", shedRetryAfter)
+				httpError(w, r, errOverloaded, http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isLowPriorityPath returns true if the given request is for one of
+// lowPriorityPaths.
+func isLowPriorityPath(r *http.Request) bool {
+	return lowPriorityPaths[unversioned(r.URL.Path)]
+}
+
+// isAnyRequest returns true for all requests.  We use it to shed all requests
+// to our Prometheus endpoint.
+func isAnyRequest(*http.Request) bool {
+	return true
+}
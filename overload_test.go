@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadCPUTimes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stat")
+	failOnErr(t, os.WriteFile(path, []byte(
+		"cpu  10 1 5 80 4 0 0 0 0 0\n"+
+			"cpu0 10 1 5 80 4 0 0 0 0 0\n"), 0o600))
+
+	times, err := readCPUTimes(path)
+	failOnErr(t, err)
+	assertEqual(t, times.total, uint64(100))
+	assertEqual(t, times.busy, uint64(16))
+
+	failOnErr(t, os.WriteFile(path, []byte("intr 1 2 3\n"), 0o600))
+	if _, err = readCPUTimes(path); err == nil {
+		t.Fatal("Expected error for missing aggregate CPU times.")
+	}
+}
+
+func TestLoadMonitor(t *testing.T) {
+	dir := t.TempDir()
+	defer func(mem, stat string) { meminfoPath, procStatPath = mem, stat }(meminfoPath, procStatPath)
+	meminfoPath, procStatPath = filepath.Join(dir, "meminfo"), filepath.Join(dir, "stat")
+	writeLoad := func(meminfo, stat string) {
+		failOnErr(t, os.WriteFile(meminfoPath, []byte(meminfo), 0o600))
+		failOnErr(t, os.WriteFile(procStatPath, []byte(stat), 0o600))
+	}
+
+	l := newLoadMonitor(90, 80)
+	writeLoad("MemTotal: 1000 kB\nMemAvailable: 500 kB\n", "cpu 10 0 0 90 0\n")
+	l.update()
+	assertEqual(t, l.isOverloaded(), false)
+
+	// 95% of our memory is in use.
+	writeLoad("MemTotal: 1000 kB\nMemAvailable: 50 kB\n", "cpu 20 0 0 180 0\n")
+	l.update()
+	assertEqual(t, l.isOverloaded(), true)
+
+	// 90 out of the last 100 clock ticks were busy.
+	writeLoad("MemTotal: 1000 kB\nMemAvailable: 500 kB\n", "cpu 110 0 0 190 0\n")
+	l.update()
+	assertEqual(t, l.isOverloaded(), true)
+
+	writeLoad("MemTotal: 1000 kB\nMemAvailable: 500 kB\n", "cpu 120 0 0 280 0\n")
+	l.update()
+	assertEqual(t, l.isOverloaded(), false)
+
+	// Failing measurements must not take endpoints offline.
+	failOnErr(t, os.Remove(meminfoPath))
+	failOnErr(t, os.Remove(procStatPath))
+	l.update()
+	assertEqual(t, l.isOverloaded(), false)
+}
+
+func TestShedLoad(t *testing.T) {
+	c := defaultCfg
+	c.OverloadMemPercent = 90
+	e := createEnclave(&c)
+	e.load.overloaded.Store(true)
+	shed := ops.shedRequests.Load()
+
+	resp := makeReqToSrv(e.extPubSrv)(http.MethodGet, versioned(pathRoot), nil)
+	assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+	assertEqual(t, resp.Header.Get("Retry-After"), shedRetryAfter)
+	resp = makeReqToSrv(e.extPrivSrv)(http.MethodGet, pathStats, nil)
+	assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+	resp = makeReqToSrv(e.promSrv)(http.MethodGet, "/metrics", nil)
+	assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+	assertEqual(t, ops.shedRequests.Load(), shed+3)
+
+	// Attestation remains available.
+	resp = makeReqToSrv(e.extPubSrv)(http.MethodGet, pathAttestation, nil)
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		t.Fatal("Attestation endpoint must not be shed.")
+	}
+
+	e.load.overloaded.Store(false)
+	resp = makeReqToSrv(e.extPubSrv)(http.MethodGet, pathRoot, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+}
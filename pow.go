@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxPoWBits is the maximum difficulty of our proof-of-work puzzle.  At 32
+	// bits, clients already need billions of hashes to solve the puzzle.
+	maxPoWBits = 32
+	// maxPoWAge determines how far a puzzle's timestamp may deviate from our
+	// clock.
+	maxPoWAge = time.Minute
+	// maxPoWLen is the maximum length of a puzzle solution.
+	maxPoWLen = 64
+)
+
+var (
+	errCfgBadPoW   = fmt.Errorf("given config has proof-of-work difficulty above %d bits", maxPoWBits)
+	errNoPoW       = errors.New("could not find 'pow' and 'pow_ts' in URL query parameters")
+	errBadPoW      = errors.New("proof of work has unexpected format")
+	errStalePoW    = errors.New("proof of work's timestamp deviates too much from our clock")
+	errInvalidPoW  = errors.New("proof of work does not solve the puzzle")
+	errReplayedPoW = errors.New("proof of work was already used")
+)
+
+// powInput returns the string that clients must hash when solving our
+// puzzle for the given nonce, timestamp, and solution.
+func powInput(nonce nonce, ts, solution string) string {
+	return hex.EncodeToString(nonce[:]) + ":" + ts + ":" + solution
+}
+
+// leadingZeros returns the number of leading zero bits in the given hash.
+func leadingZeros(hash []byte) int {
+	n := 0
+	for _, b := range hash {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// checkPoW returns nil if the request's URL parameters contain a fresh
+// solution to our puzzle: the SHA-256 hash over
+// "<nonce>:<pow_ts>:<pow>" must start with the given number of zero bits,
+// where <nonce> is the request's lower-case hex nonce and <pow_ts> is a Unix
+// timestamp in seconds.
+func checkPoW(r *http.Request, difficulty uint8, seen *cache) error {
+	n, err := getNonceFromReq(r)
+	if err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	ts, solution := query.Get("pow_ts"), query.Get("pow")
+	if ts == "" || solution == "" {
+		return errNoPoW
+	}
+	if len(solution) > maxPoWLen {
+		return errBadPoW
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errBadPoW
+	}
+	if age := currentTime().Sub(time.Unix(unix, 0)); age > maxPoWAge || age < -maxPoWAge {
+		return errStalePoW
+	}
+
+	input := powInput(n, ts, solution)
+	hash := sha256.Sum256([]byte(input))
+	if leadingZeros(hash[:]) < int(difficulty) {
+		return errInvalidPoW
+	}
+	// Checking the puzzle is stateless but we remember solutions until their
+	// timestamp expires, so clients cannot replay them.
+	if !seen.AddIfAbsent(input) {
+		return errReplayedPoW
+	}
+	return nil
+}
+
+// newPoWCache returns the cache that remembers the puzzle solutions that
+// clients used.  A solution's timestamp may lie maxPoWAge in the future, so it
+// can remain valid for twice as long.
+func newPoWCache() *cache {
+	return newCache(2*maxPoWAge, defaultCacheMaxItems)
+}
+
+// requirePoW wraps the given handler and only passes on requests that contain
+// a solution to a proof-of-work puzzle of the given difficulty.  The puzzle
+// is cheap to verify but expensive to solve, which keeps adversaries from
+// asking the Nitro Secure Module for attestation documents at will.  The
+// given cache remembers used solutions.  Solutions don't depend on the
+// request's path, so all of our proof-of-work-gated endpoints must share a
+// cache, or clients could spend a solution once per endpoint.
+func requirePoW(difficulty uint8, seen *cache, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := checkPoW(r, difficulty, seen)
+		switch {
+		case errors.Is(err, errStalePoW), errors.Is(err, errInvalidPoW), errors.Is(err, errReplayedPoW):
+			httpError(w, r, err, http.StatusForbidden)
+			return
+		case err != nil:
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withPoW returns the given handler, behind our proof-of-work check if the
+// enclave's configuration asks for one.
+func (e *Enclave) withPoW(h http.HandlerFunc) http.HandlerFunc {
+	if e.cfg.AttestationPoWBits == 0 {
+		return h
+	}
+	return requirePoW(e.cfg.AttestationPoWBits, e.powSeen, h)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// solvePoW returns a solution to our proof-of-work puzzle for the given nonce,
+// timestamp, and difficulty.
+func solvePoW(n nonce, ts string, difficulty uint8) string {
+	return findPoW(n, ts, func(zeros int) bool { return zeros >= int(difficulty) })
+}
+
+// failPoW returns a string that fails to solve our proof-of-work puzzle for
+// the given nonce, timestamp, and difficulty.
+func failPoW(n nonce, ts string, difficulty uint8) string {
+	return findPoW(n, ts, func(zeros int) bool { return zeros < int(difficulty) })
+}
+
+func findPoW(n nonce, ts string, isDone func(int) bool) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		hash := sha256.Sum256([]byte(powInput(n, ts, solution)))
+		if isDone(leadingZeros(hash[:])) {
+			return solution
+		}
+	}
+}
+
+func TestLeadingZeros(t *testing.T) {
+	assertEqual(t, leadingZeros([]byte{0x80}), 0)
+	assertEqual(t, leadingZeros([]byte{0x01, 0xff}), 7)
+	assertEqual(t, leadingZeros([]byte{0x00, 0x0f}), 12)
+	assertEqual(t, leadingZeros([]byte{0x00, 0x00}), 16)
+}
+
+func TestRequirePoW(t *testing.T) {
+	const difficulty = 8
+	var (
+		n, _     = newNonce()
+		nonceHex = fmt.Sprintf("%x", n[:])
+		ts       = strconv.FormatInt(currentTime().Unix(), 10)
+		solution = solvePoW(n, ts, difficulty)
+		makeReq  = makeReqToHandler(requirePoW(difficulty, newPoWCache(), func(w http.ResponseWriter, r *http.Request) {}))
+		path     = func(ts, solution string) string {
+			return fmt.Sprintf("%s?nonce=%s&pow_ts=%s&pow=%s", pathAttestation, nonceHex, ts, solution)
+		}
+	)
+
+	assertResponse(t,
+		makeReq(http.MethodGet, pathAttestation+"?nonce="+nonceHex, nil),
+		newErrResp(http.StatusBadRequest, errNoPoW),
+	)
+	assertResponse(t,
+		makeReq(http.MethodGet, path("foo", solution), nil),
+		newErrResp(http.StatusBadRequest, errBadPoW),
+	)
+	stale := strconv.FormatInt(currentTime().Add(-2*maxPoWAge).Unix(), 10)
+	assertResponse(t,
+		makeReq(http.MethodGet, path(stale, solvePoW(n, stale, difficulty)), nil),
+		newErrResp(http.StatusForbidden, errStalePoW),
+	)
+	assertResponse(t,
+		makeReq(http.MethodGet, path(ts, failPoW(n, ts, difficulty)), nil),
+		newErrResp(http.StatusForbidden, errInvalidPoW),
+	)
+
+	// A valid solution works exactly once.
+	assertResponse(t,
+		makeReq(http.MethodGet, path(ts, solution), nil),
+		newResp(http.StatusOK, ""),
+	)
+	assertResponse(t,
+		makeReq(http.MethodGet, path(ts, solution), nil),
+		newErrResp(http.StatusForbidden, errReplayedPoW),
+	)
+}
+
+func TestPoWSharedAcrossEndpoints(t *testing.T) {
+	c := defaultCfg
+	c.AttestationPoWBits = 8
+	makeReq := makeReqToSrv(createEnclave(&c).extPubSrv)
+	n, _ := newNonce()
+	ts := strconv.FormatInt(currentTime().Unix(), 10)
+	query := fmt.Sprintf("?nonce=%x&pow_ts=%s&pow=%s", n[:], ts, solvePoW(n, ts, c.AttestationPoWBits))
+
+	// A solution that bought an attestation document cannot buy a
+	// verification bundle.
+	assertEqual(t, makeReq(http.MethodGet, pathAttestation+query, nil).StatusCode, http.StatusOK)
+	assertResponse(t,
+		makeReq(http.MethodGet, pathBundle+query, nil),
+		newErrResp(http.StatusForbidden, errReplayedPoW),
+	)
+}
+
+func TestPoWConcurrentReplay(t *testing.T) {
+	const difficulty = 8
+	n, _ := newNonce()
+	ts := strconv.FormatInt(currentTime().Unix(), 10)
+	target := fmt.Sprintf("%s?nonce=%x&pow_ts=%s&pow=%s", pathAttestation, n[:], ts, solvePoW(n, ts, difficulty))
+	var passed atomic.Int32
+	h := requirePoW(difficulty, newPoWCache(), func(http.ResponseWriter, *http.Request) { passed.Add(1) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, passed.Load(), int32(1))
+}
+
+func TestPoWOnAllAttestationEndpoints(t *testing.T) {
+	c := defaultCfg
+	c.AttestationPoWBits = 8
+	c.OIDCTokens = true
+	c.SealedLogPort = 8006
+	c.PrivacyPass = true
+	c.OHTTPGateway = true
+	c.AppWebSrv, _ = url.Parse("http://127.0.0.1:8080")
+	makeReq := makeReqToSrv(createEnclave(&c).extPubSrv)
+	n, _ := newNonce()
+
+	for _, path := range []string{
+		pathAttestation,
+		pathBundle,
+		pathOIDCAttstn,
+		pathSLAttstn,
+		pathPPAttstn,
+		pathOHTTPAttstn,
+	} {
+		assertResponse(t,
+			makeReq(http.MethodGet, fmt.Sprintf("%s?nonce=%x", path, n[:]), nil),
+			newErrResp(http.StatusBadRequest, errNoPoW),
+		)
+	}
+}
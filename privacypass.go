@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+)
+
+// We issue and redeem privately verifiable Privacy Pass tokens as specified
+// in RFC 9578, i.e., token type 0x0001 that's based on VOPRF(P-384, SHA-384):
+// https://www.rfc-editor.org/rfc/rfc9578.html
+// Clients obtain tokens from our public Web server and present them to the
+// enclave application, which asks us to verify them.  The issuer's private
+// key is part of the key material that the leader enclave syncs to its
+// workers, so every replica issues and verifies the same tokens, and every
+// replica's attestation documents contain the same public key.
+const (
+	privacyPassTokenType = 0x0001
+	privacyPassDirType   = "application/private-token-issuer-directory"
+	privacyPassReqType   = "application/private-token-request"
+	privacyPassRespType  = "application/private-token-response"
+	privacyPassNonceLen  = 32
+	privacyPassKeyIDLen  = sha256.Size
+	privacyPassDigestLen = sha256.Size
+	// A token request consists of the token type, the truncated key ID, and
+	// the blinded element.
+	privacyPassReqLen = 2 + 1 + voprfElementLen
+	// A token consists of the token type, the nonce, the challenge digest,
+	// the key ID, and the authenticator.
+	privacyPassTokenLen = 2 + privacyPassNonceLen + privacyPassDigestLen + privacyPassKeyIDLen + voprfHashLen
+)
+
+var (
+	errPrivacyPassReqType  = errors.New("expected content type " + privacyPassReqType)
+	errPrivacyPassBadReq   = errors.New("malformed token request")
+	errPrivacyPassKeyID    = errors.New("token request uses unknown token type or key")
+	errPrivacyPassNoKey    = errors.New("token key is gone")
+	errPrivacyPassBadToken = errors.New("invalid token")
+)
+
+// privacyPassIssuerDir is the issuer directory that tells clients where to
+// request tokens, and which key to expect.
+type privacyPassIssuerDir struct {
+	RequestURI string                 `json:"issuer-request-uri"`
+	TokenKeys  []privacyPassDirTokKey `json:"token-keys"`
+}
+
+// privacyPassDirTokKey is a token key in our issuer directory.  The key is
+// the Base64url-encoded serialized public key, including padding.
+type privacyPassDirTokKey struct {
+	TokenType int    `json:"token-type"`
+	TokenKey  string `json:"token-key"`
+}
+
+// privacyPassRedemption is our response to the enclave application after
+// verifying a token.  Verifying a token doesn't prevent double spending: the
+// application must check that the challenge digest matches a challenge that
+// it issued, and reject nonces that it has seen before.
+type privacyPassRedemption struct {
+	Nonce           []byte `json:"nonce"`
+	ChallengeDigest []byte `json:"challenge_digest"`
+}
+
+// tokenIssuer issues and verifies Privacy Pass tokens using the token key in
+// the given enclave keys.
+type tokenIssuer struct {
+	keys      *enclaveKeys
+	issuerURL string
+}
+
+// newTokenIssuer returns a new tokenIssuer and installs a fresh token key in
+// the given enclave keys.  Worker enclaves later replace the key with their
+// leader's.
+func newTokenIssuer(keys *enclaveKeys, issuerURL string) (*tokenIssuer, error) {
+	key, err := newVOPRFKey()
+	if err != nil {
+		return nil, err
+	}
+	keys.setTokenKey(serializeScalar(key))
+	return &tokenIssuer{keys: keys, issuerURL: issuerURL}, nil
+}
+
+// privateKey returns the current token key, or errPrivacyPassNoKey if our
+// key material is gone.
+func (i *tokenIssuer) privateKey() (*big.Int, error) {
+	raw := i.keys.getTokenKey()
+	if raw == nil {
+		return nil, errPrivacyPassNoKey
+	}
+	defer wipeBytes(raw)
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// publicKey returns the serialized public key that belongs to the current
+// token key, or nil if our key material is gone.
+func (i *tokenIssuer) publicKey() []byte {
+	key, err := i.privateKey()
+	if err != nil {
+		return nil
+	}
+	return voprfBaseMult(key).serialize()
+}
+
+// privacyPassKeyID returns the ID of the given serialized public key.
+func privacyPassKeyID(pub []byte) []byte {
+	id := sha256.Sum256(pub)
+	return id[:]
+}
+
+// issue returns the token response for the given token request.
+func (i *tokenIssuer) issue(req []byte) ([]byte, error) {
+	if len(req) != privacyPassReqLen {
+		return nil, errPrivacyPassBadReq
+	}
+	key, err := i.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	keyID := privacyPassKeyID(voprfBaseMult(key).serialize())
+	if binary.BigEndian.Uint16(req) != privacyPassTokenType || req[2] != keyID[len(keyID)-1] {
+		return nil, errPrivacyPassKeyID
+	}
+	blinded, err := deserializeVOPRFElement(req[3:])
+	if err != nil {
+		return nil, errPrivacyPassBadReq
+	}
+	evaluated, proof, err := voprfBlindEvaluate(key, blinded)
+	if err != nil {
+		return nil, err
+	}
+	return append(evaluated, proof...), nil
+}
+
+// redeem verifies the given token, and returns the nonce and challenge
+// digest that it contains.
+func (i *tokenIssuer) redeem(token []byte) (*privacyPassRedemption, error) {
+	if len(token) != privacyPassTokenLen || binary.BigEndian.Uint16(token) != privacyPassTokenType {
+		return nil, errPrivacyPassBadToken
+	}
+	key, err := i.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	input, authenticator := token[:len(token)-voprfHashLen], token[len(token)-voprfHashLen:]
+	nonce, rest := input[2:2+privacyPassNonceLen], input[2+privacyPassNonceLen:]
+	challenge, keyID := rest[:privacyPassDigestLen], rest[privacyPassDigestLen:]
+	if !bytes.Equal(keyID, privacyPassKeyID(voprfBaseMult(key).serialize())) {
+		return nil, errPrivacyPassBadToken
+	}
+	expected, err := voprfEvaluate(key, input)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(expected, authenticator) != 1 {
+		return nil, errPrivacyPassBadToken
+	}
+	return &privacyPassRedemption{
+		Nonce:           bytes.Clone(nonce),
+		ChallengeDigest: bytes.Clone(challenge),
+	}, nil
+}
+
+// privacyPassDirHandler returns an HTTP handler that returns our issuer
+// directory.
+func privacyPassDirHandler(i *tokenIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pub := i.publicKey()
+		if pub == nil {
+			httpError(w, r, errPrivacyPassNoKey, http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", privacyPassDirType)
+		if err := json.NewEncoder(w).Encode(&privacyPassIssuerDir{
+			RequestURI: i.issuerURL,
+			TokenKeys: []privacyPassDirTokKey{{
+				TokenType: privacyPassTokenType,
+				TokenKey:  base64.URLEncoding.EncodeToString(pub),
+			}},
+		}); err != nil {
+			elog.Error("Error encoding Privacy Pass issuer directory.", "error", err)
+		}
+	}
+}
+
+// privacyPassAttstnHandler returns an HTTP handler that returns attestation
+// documents that contain our current token public key.
+func privacyPassAttstnHandler(i *tokenIssuer, useProfiling bool, hashes *AttestationHashes, a attester) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pub := i.publicKey()
+		if pub == nil {
+			httpError(w, r, errPrivacyPassNoKey, http.StatusGone)
+			return
+		}
+		attestationHandler(useProfiling, hashes, pub, a)(w, r)
+	}
+}
+
+// privacyPassIssueHandler returns an HTTP handler that responds to token
+// requests.
+func privacyPassIssueHandler(i *tokenIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != privacyPassReqType {
+			httpError(w, r, errPrivacyPassReqType, http.StatusUnsupportedMediaType)
+			return
+		}
+		req, err := io.ReadAll(newLimitReader(r.Body, privacyPassReqLen))
+		if errors.Is(err, errTooMuchToRead) || isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
+			return
+		}
+		resp, err := i.issue(req)
+		switch {
+		case errors.Is(err, errPrivacyPassNoKey):
+			httpError(w, r, err, http.StatusGone)
+			return
+		case errors.Is(err, errPrivacyPassBadReq) || errors.Is(err, errPrivacyPassKeyID):
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		case err != nil:
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", privacyPassRespType)
+		_, _ = w.Write(resp)
+	}
+}
+
+// privacyPassRedeemHandler returns an HTTP handler that verifies the token in
+// the request body, and returns the token's nonce and challenge digest.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func privacyPassRedeemHandler(i *tokenIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := io.ReadAll(newLimitReader(r.Body, privacyPassTokenLen))
+		if errors.Is(err, errTooMuchToRead) || isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
+			return
+		}
+		redemption, err := i.redeem(token)
+		switch {
+		case errors.Is(err, errPrivacyPassNoKey):
+			httpError(w, r, err, http.StatusGone)
+			return
+		case errors.Is(err, errPrivacyPassBadToken):
+			httpError(w, r, err, http.StatusForbidden)
+			return
+		case err != nil:
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(redemption); err != nil {
+			elog.Error("Error encoding Privacy Pass redemption.", "error", err)
+		}
+	}
+}
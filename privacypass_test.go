@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// requestToken runs the issuance protocol against the given enclave, and
+// returns a token for the given challenge digest.
+func requestToken(t *testing.T, e *Enclave, digest []byte) []byte {
+	t.Helper()
+	resp := makeReqToSrv(e.extPubSrv)(http.MethodGet, pathPPDirectory, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Content-Type"), privacyPassDirType)
+	var dir privacyPassIssuerDir
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&dir))
+	assertEqual(t, dir.RequestURI, publicURL(e.cfg, pathPPIssue))
+	assertEqual(t, len(dir.TokenKeys), 1)
+	assertEqual(t, dir.TokenKeys[0].TokenType, privacyPassTokenType)
+	pub, err := base64.URLEncoding.DecodeString(dir.TokenKeys[0].TokenKey)
+	failOnErr(t, err)
+	keyID := sha256.Sum256(pub)
+
+	nonce := make([]byte, privacyPassNonceLen)
+	_, err = rand.Read(nonce)
+	failOnErr(t, err)
+	input := binary.BigEndian.AppendUint16(nil, privacyPassTokenType)
+	input = append(append(append(input, nonce...), digest...), keyID[:]...)
+	c := newVOPRFClient(t, input)
+	req := binary.BigEndian.AppendUint16(nil, privacyPassTokenType)
+	req = append(append(req, keyID[len(keyID)-1]), c.blinded.serialize()...)
+
+	r := httptest.NewRequest(http.MethodPost, pathPPIssue, bytes.NewReader(req))
+	r.Header.Set("Content-Type", privacyPassReqType)
+	rec := httptest.NewRecorder()
+	e.extPubSrv.Handler.ServeHTTP(rec, r)
+	assertEqual(t, rec.Code, http.StatusOK)
+	assertEqual(t, rec.Header().Get("Content-Type"), privacyPassRespType)
+	body := rec.Body.Bytes()
+	assertEqual(t, len(body), voprfElementLen+2*voprfScalarLen)
+	authenticator, err := c.finalize(pub, body[:voprfElementLen], body[voprfElementLen:])
+	failOnErr(t, err)
+	return append(input, authenticator...)
+}
+
+func TestPrivacyPass(t *testing.T) {
+	c := defaultCfg
+	c.PrivacyPass = true
+	e := createEnclave(&c)
+	digest := sha256.Sum256([]byte("challenge"))
+	token := requestToken(t, e, digest[:])
+
+	redeem := makeReqToSrv(e.intSrv)
+	resp := redeem(http.MethodPost, pathPPRedeem, bytes.NewReader(token))
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var redemption privacyPassRedemption
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&redemption))
+	assertEqual(t, bytes.Equal(redemption.Nonce, token[2:2+privacyPassNonceLen]), true)
+	assertEqual(t, bytes.Equal(redemption.ChallengeDigest, digest[:]), true)
+
+	// Tampered tokens must not verify.
+	tampered := bytes.Clone(token)
+	tampered[2]++
+	assertEqual(t, redeem(http.MethodPost, pathPPRedeem, bytes.NewReader(tampered)).StatusCode, http.StatusForbidden)
+	assertEqual(t, redeem(http.MethodPost, pathPPRedeem, bytes.NewReader(token[1:])).StatusCode, http.StatusForbidden)
+
+	// Token requests must use our content type and key.
+	r := httptest.NewRequest(http.MethodPost, pathPPIssue, bytes.NewReader(make([]byte, privacyPassReqLen)))
+	rec := httptest.NewRecorder()
+	e.extPubSrv.Handler.ServeHTTP(rec, r)
+	assertEqual(t, rec.Code, http.StatusUnsupportedMediaType)
+	r.Header.Set("Content-Type", privacyPassReqType)
+	rec = httptest.NewRecorder()
+	e.extPubSrv.Handler.ServeHTTP(rec, r)
+	assertEqual(t, rec.Code, http.StatusBadRequest)
+
+	// The key is unusable once wiped.
+	e.WipeKeyMaterial()
+	assertEqual(t, redeem(http.MethodPost, pathPPRedeem, bytes.NewReader(token)).StatusCode, http.StatusGone)
+	assertEqual(t, makeReqToSrv(e.extPubSrv)(http.MethodGet, pathPPDirectory, nil).StatusCode, http.StatusGone)
+}
+
+func TestPrivacyPassSyncedKey(t *testing.T) {
+	c := defaultCfg
+	c.PrivacyPass = true
+	leader, worker := createEnclave(&c), createEnclave(&c)
+	digest := sha256.Sum256([]byte("challenge"))
+	token := requestToken(t, leader, digest[:])
+	resp := makeReqToSrv(worker.intSrv)(http.MethodPost, pathPPRedeem, bytes.NewReader(token))
+	assertEqual(t, resp.StatusCode, http.StatusForbidden)
+
+	// Once the worker has the leader's keys, it accepts the leader's tokens.
+	keys := leader.keys.copy()
+	defer keys.wipe()
+	worker.keys.set(keys)
+	assertEqual(t, bytes.Equal(worker.tokens.publicKey(), leader.tokens.publicKey()), true)
+	resp = makeReqToSrv(worker.intSrv)(http.MethodPost, pathPPRedeem, bytes.NewReader(token))
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	_, _ = io.Copy(io.Discard, resp.Body)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// retainedCaps contains the capabilities that we keep after dropping
+// privileges: CAP_NET_ADMIN lets us re-create our TAP interface if we lose the
+// connection to the EC2 host, and CAP_NET_BIND_SERVICE lets our public Web
+// server bind to its privileged port once the enclave application is ready.
+var retainedCaps = []uint{unix.CAP_NET_ADMIN, unix.CAP_NET_BIND_SERVICE}
+
+// allThreads invokes the given system call on all of nitriding's threads,
+// which we need for system calls that only affect the calling thread.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	if _, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropPrivileges switches all of nitriding's threads to the given user and
+// group ID, and drops all capabilities except for retainedCaps.  This fails
+// if nitriding was built with cgo.
+func dropPrivileges(uid, gid uint32) error {
+	// Keep our capabilities across the UID change, so we can retain some of
+	// them below.
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		return fmt.Errorf("failed to keep capabilities: %w", err)
+	}
+	if err := syscall.Setgroups([]int{int(gid)}); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(int(gid)); err != nil {
+		return fmt.Errorf("failed to set group ID: %w", err)
+	}
+	if err := syscall.Setuid(int(uid)); err != nil {
+		return fmt.Errorf("failed to set user ID: %w", err)
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for _, c := range retainedCaps {
+		data[c/32].Effective |= 1 << (c % 32)
+		data[c/32].Permitted |= 1 << (c % 32)
+	}
+	if err := allThreads(
+		unix.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)),
+		uintptr(unsafe.Pointer(&data[0])),
+		0,
+	); err != nil {
+		return fmt.Errorf("failed to drop capabilities: %w", err)
+	}
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 0, 0); err != nil {
+		return fmt.Errorf("failed to reset keep-capabilities flag: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Dropping privileges requires root.")
+	}
+	// Dropping privileges is irreversible, so we do it in a child process.
+	if os.Getenv("NITRIDING_TEST_PRIVDROP") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$", "-test.v")
+		cmd.Env = append(os.Environ(), "NITRIDING_TEST_PRIVDROP=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Privilege drop test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	const nobody = 65534
+	if err := dropPrivileges(nobody, nobody); err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			t.Skip("Dropping privileges requires a binary built without cgo.")
+		}
+		t.Fatalf("Failed to drop privileges: %v", err)
+	}
+	assertEqual(t, os.Getuid(), nobody)
+	assertEqual(t, os.Getgid(), nobody)
+
+	// We must have lost root's access to files.
+	if _, err := os.Stat("/root/.nitriding-does-not-exist"); !errors.Is(err, os.ErrPermission) && !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.WriteFile("/etc/nitriding-test", nil, 0o600); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("Expected permission error but got: %v", err)
+	}
+
+	// We must still be able to bind to privileged ports.
+	l, err := net.Listen("tcp", "127.0.0.1:1")
+	failOnErr(t, err)
+	l.Close()
+}
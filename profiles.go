@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// The configuration profiles that users can select via Config.Profile.
+	profileDev     = "dev"
+	profileStaging = "staging"
+	profileProd    = "prod"
+
+	// The directory URL of Let's Encrypt's staging environment, which has
+	// generous rate limits but issues untrusted certificates:
+	// https://letsencrypt.org/docs/staging-environment/
+	acmeStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+	// Our stricter timeouts for production.
+	prodReadHeaderTimeout = 5 * time.Second
+	prodReadTimeout       = 10 * time.Second
+	prodWriteTimeout      = 30 * time.Second
+	prodIdleTimeout       = 60 * time.Second
+
+	tlsVersion12 = "1.2"
+	tlsVersion13 = "1.3"
+)
+
+var (
+	errCfgBadProfile    = errors.New("given config has unknown profile")
+	errCfgUnsafeProd    = errors.New("given config enables debug features in production profile")
+	errCfgBadTLSVersion = errors.New("given config has unsupported minimum TLS version")
+)
+
+// parseTLSVersion returns the crypto/tls constant of the given TLS version,
+// e.g., tls.VersionTLS13 for "1.3".  The empty string maps to TLS 1.2.
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "", tlsVersion12:
+		return tls.VersionTLS12, nil
+	case tlsVersion13:
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", errCfgBadTLSVersion, v)
+	}
+}
+
+// validateProfile returns an error if the config's profile is unknown, or if
+// the config contradicts the profile.
+func (c *Config) validateProfile() error {
+	switch c.Profile {
+	case "", profileDev, profileStaging:
+		return nil
+	case profileProd:
+		if c.Debug || c.UseProfiling {
+			return errCfgUnsafeProd
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", errCfgBadProfile, c.Profile)
+	}
+}
+
+// applyProfile sets the unset fields of the config to the defaults of the
+// config's profile.  As the zero value of booleans is false, profiles may
+// enable boolean options regardless of what the user set.
+//
+// The dev profile enables debug mode (which uses fake attestation documents)
+// and access logs.  The staging profile obtains certificates from Let's
+// Encrypt's staging environment and enables access logs.  The prod profile
+// uses strict timeouts and requires TLS 1.3.
+func (c *Config) applyProfile() {
+	switch c.Profile {
+	case profileDev:
+		c.Debug = true
+		c.AccessLog = true
+	case profileStaging:
+		c.AccessLog = true
+		if c.ACMEDirectoryURL == "" {
+			c.ACMEDirectoryURL = acmeStagingURL
+		}
+	case profileProd:
+		if c.ReadHeaderTimeout == 0 {
+			c.ReadHeaderTimeout = prodReadHeaderTimeout
+		}
+		if c.ReadTimeout == 0 {
+			c.ReadTimeout = prodReadTimeout
+		}
+		if c.WriteTimeout == 0 {
+			c.WriteTimeout = prodWriteTimeout
+		}
+		if c.IdleTimeout == 0 {
+			c.IdleTimeout = prodIdleTimeout
+		}
+		if c.TLSMinVersion == "" {
+			c.TLSMinVersion = tlsVersion13
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	c := defaultCfg
+	c.Debug = false
+	c.Profile = profileDev
+	e := createEnclave(&c)
+	assertEqual(t, e.cfg.Debug, true)
+	assertEqual(t, e.cfg.AccessLog, true)
+	if _, ok := e.attester.(*dummyAttester); !ok {
+		t.Fatal("Expected dev profile to use dummy attester.")
+	}
+
+	c = defaultCfg
+	c.Profile = profileStaging
+	c.ACMEDirectoryURL = ""
+	e = createEnclave(&c)
+	assertEqual(t, e.cfg.ACMEDirectoryURL, acmeStagingURL)
+
+	c = defaultCfg
+	c.Debug = false
+	c.Profile = profileProd
+	// Other tests may have set defaults in defaultCfg.
+	c.ReadTimeout, c.TLSMinVersion = 0, ""
+	c.WriteTimeout = defaultWriteTimeout
+	e = createEnclave(&c)
+	assertEqual(t, e.cfg.ReadTimeout, prodReadTimeout)
+	assertEqual(t, e.cfg.TLSMinVersion, tlsVersion13)
+	// Explicitly set fields take precedence over the profile.
+	assertEqual(t, e.cfg.WriteTimeout, defaultWriteTimeout)
+}
+
+func TestValidateProfile(t *testing.T) {
+	c := defaultCfg
+	c.Profile = "foo"
+	if err := c.Validate(); !errors.Is(err, errCfgBadProfile) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadProfile, err)
+	}
+
+	// The production profile must not be used with debug features.
+	c.Profile = profileProd
+	c.Debug = true
+	if err := c.Validate(); !errors.Is(err, errCfgUnsafeProd) {
+		t.Fatalf("Expected error %v but got %v.", errCfgUnsafeProd, err)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	v, err := parseTLSVersion("")
+	failOnErr(t, err)
+	assertEqual(t, v, uint16(tls.VersionTLS12))
+
+	v, err = parseTLSVersion(tlsVersion13)
+	failOnErr(t, err)
+	assertEqual(t, v, uint16(tls.VersionTLS13))
+
+	if _, err = parseTLSVersion("1.0"); !errors.Is(err, errCfgBadTLSVersion) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadTLSVersion, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxProvisionedSecrets is the maximum number of provisioned secrets that
+	// we hold until the enclave application fetches them.  Provisioning is a
+	// public endpoint, so we cannot let clients grow our queue without bound.
+	maxProvisionedSecrets = 100
+	// hpkeProvisionInfo is the HPKE info string that clients must use when
+	// encrypting secrets for provisioning.
+	hpkeProvisionInfo = "nitriding provisioning"
+)
+
+var (
+	errProvisioningFull = errors.New("too many provisioned secrets pending")
+	errNoProvisionKey   = errors.New("provisioning key is gone")
+)
+
+// provisioner receives secrets that clients encrypt to our HPKE public key,
+// and holds the decrypted secrets until the enclave application fetches them.
+// We publish the HPKE public key in our attestation documents, so clients can
+// verify that only this enclave can decrypt their secrets.
+type provisioner struct {
+	sync.Mutex
+	key     *hpkeKey
+	secrets []*SecretBytes
+}
+
+// newProvisioner returns a new provisioner with a fresh HPKE key pair.
+func newProvisioner() (*provisioner, error) {
+	key, err := newHPKEKey()
+	if err != nil {
+		return nil, err
+	}
+	return &provisioner{key: key}, nil
+}
+
+// publicKey returns the HPKE public key that clients encrypt secrets to.
+func (p *provisioner) publicKey() []byte {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.key == nil {
+		return nil
+	}
+	return p.key.pub
+}
+
+// add decrypts the given HPKE ciphertext and queues the resulting secret.
+func (p *provisioner) add(ciphertext []byte) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.key == nil {
+		return errNoProvisionKey
+	}
+	if len(p.secrets) >= maxProvisionedSecrets {
+		return errProvisioningFull
+	}
+	plaintext, err := p.key.open([]byte(hpkeProvisionInfo), ciphertext)
+	if err != nil {
+		return err
+	}
+	p.secrets = append(p.secrets, newSecretBytes(plaintext))
+	return nil
+}
+
+// addAppSecret decrypts the given HPKE ciphertext and hands the resulting
+// secret to the given store as the application secret of the given name.
+func (p *provisioner) addAppSecret(ciphertext []byte, name string, s *appSecretStore) error {
+	if s == nil {
+		return errNoSuchAppSecret
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	if p.key == nil {
+		return errNoProvisionKey
+	}
+	plaintext, err := p.key.open([]byte(hpkeProvisionInfo), ciphertext)
+	if err != nil {
+		return err
+	}
+	return s.provision(name, plaintext)
+}
+
+// next removes and returns the oldest provisioned secret, or nil if there is
+// none.  The caller is responsible for wiping the secret.
+func (p *provisioner) next() *SecretBytes {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.secrets) == 0 {
+		return nil
+	}
+	s := p.secrets[0]
+	p.secrets[0] = nil
+	p.secrets = p.secrets[1:]
+	return s
+}
+
+// wipe wipes our pending secrets and our HPKE private key.  We cannot accept
+// secrets after that.
+func (p *provisioner) wipe() {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, s := range p.secrets {
+		s.Wipe()
+	}
+	p.secrets = nil
+	if p.key != nil {
+		p.key.wipe()
+		p.key = nil
+	}
+}
+
+// provisionHandler returns an HTTP handler that accepts a secret that the
+// client encrypted to the HPKE public key in our attestation document.  The
+// request body consists of the 32-byte encapsulated key followed by the
+// ciphertext.  If the "name" URL parameter is set, the secret becomes the
+// application secret of the given name, which we inject into the enclave
+// application.
+func provisionHandler(p *provisioner, s *appSecretStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ciphertext, err := io.ReadAll(newLimitReader(r.Body, maxKeyMaterialLen))
+		if isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name != "" {
+			err = p.addAppSecret(ciphertext, name, s)
+		} else {
+			err = p.add(ciphertext)
+		}
+		switch {
+		case errors.Is(err, errNoSuchAppSecret):
+			httpError(w, r, err, http.StatusNotFound)
+			return
+		case errors.Is(err, errAppSecretTaken):
+			httpError(w, r, err, http.StatusConflict)
+			return
+		case errors.Is(err, errProvisioningFull):
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, errNoProvisionKey):
+			httpError(w, r, err, http.StatusGone)
+			return
+		case err != nil:
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if name == "" {
+			elog.Info("Received provisioned secret.")
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// getProvisionedHandler returns an HTTP handler that hands the oldest
+// provisioned secret to the enclave application, and forgets the secret.  If
+// no secret is pending, the handler responds with 204 No Content.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func getProvisionedHandler(p *provisioner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := p.next()
+		if s == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		defer s.Wipe()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(s.Bytes())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestProvisioner(t *testing.T) {
+	p, err := newProvisioner()
+	failOnErr(t, err)
+	info := []byte(hpkeProvisionInfo)
+
+	// We hand out secrets in the order that we receive them.
+	failOnErr(t, p.add(mustSeal(t, p.publicKey(), info, []byte("first"))))
+	failOnErr(t, p.add(mustSeal(t, p.publicKey(), info, []byte("second"))))
+	assertEqual(t, string(p.next().Bytes()), "first")
+	assertEqual(t, string(p.next().Bytes()), "second")
+	assertEqual(t, p.next() == nil, true)
+
+	// We reject secrets that are encrypted with another info string.
+	if err := p.add(mustSeal(t, p.publicKey(), []byte("other"), []byte("foo"))); err == nil {
+		t.Fatal("Expected error for wrong info string.")
+	}
+
+	// Our queue is bounded.
+	for i := 0; i < maxProvisionedSecrets; i++ {
+		failOnErr(t, p.add(mustSeal(t, p.publicKey(), info, []byte("foo"))))
+	}
+	assertEqual(t, p.add(mustSeal(t, p.publicKey(), info, []byte("foo"))), errProvisioningFull)
+
+	// Once wiped, we hold no secrets and accept no more.
+	s := p.secrets[0]
+	p.wipe()
+	assertEqual(t, s.Bytes() == nil, true)
+	assertEqual(t, p.next() == nil, true)
+	assertEqual(t, p.publicKey() == nil, true)
+	assertEqual(t, p.add(nil), errNoProvisionKey)
+}
+
+func TestProvisionHandlers(t *testing.T) {
+	c := defaultCfg
+	c.Provisioning = true
+	e := createEnclave(&c)
+	pubKey := e.provisioner.publicKey()
+	ciphertext := mustSeal(t, pubKey, []byte(hpkeProvisionInfo), []byte("secret"))
+
+	pubReq := makeReqToSrv(e.extPubSrv)
+	assertResponse(t,
+		pubReq(http.MethodPost, pathProvision, bytes.NewReader(ciphertext)),
+		newResp(http.StatusOK, ""),
+	)
+	assertResponse(t,
+		pubReq(http.MethodPost, pathProvision, bytes.NewReader(ciphertext[:hpkeEncLen])),
+		newErrResp(http.StatusBadRequest, errHPKEDecrypt),
+	)
+
+	intReq := makeReqToSrv(e.intSrv)
+	assertResponse(t,
+		intReq(http.MethodGet, pathProvision, nil),
+		newResp(http.StatusOK, "secret"),
+	)
+	assertResponse(t,
+		intReq(http.MethodGet, pathProvision, nil),
+		newResp(http.StatusNoContent, ""),
+	)
+}
+
+func TestProvisioningDisabled(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	assertEqual(t, e.provisioner == nil, true)
+
+	resp := makeReqToSrv(e.intSrv)(http.MethodGet, pathProvision, nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotFound)
+}
+
+func TestProvisionAppSecret(t *testing.T) {
+	c := defaultCfg
+	c.Provisioning = true
+	c.AppCmd = "my-app"
+	c.AppSecretInject = []string{"token=env:TOKEN"}
+	e := createEnclave(&c)
+	seal := func(plaintext string) *bytes.Reader {
+		return bytes.NewReader(mustSeal(t, e.provisioner.publicKey(), []byte(hpkeProvisionInfo), []byte(plaintext)))
+	}
+
+	pubReq := makeReqToSrv(e.extPubSrv)
+	assertResponse(t,
+		pubReq(http.MethodPost, pathProvision+"?name=foo", seal("secret")),
+		newErrResp(http.StatusNotFound, errNoSuchAppSecret),
+	)
+	assertResponse(t,
+		pubReq(http.MethodPost, pathProvision+"?name=token", seal("secret")),
+		newResp(http.StatusOK, ""),
+	)
+	assertResponse(t,
+		pubReq(http.MethodPost, pathProvision+"?name=token", seal("other secret")),
+		newErrResp(http.StatusConflict, errAppSecretTaken),
+	)
+
+	// Named secrets don't end up in the queue.
+	intReq := makeReqToSrv(e.intSrv)
+	assertResponse(t,
+		intReq(http.MethodGet, pathProvision, nil),
+		newResp(http.StatusNoContent, ""),
+	)
+	assertResponse(t,
+		intReq(http.MethodGet, pathAppSecrets+"?name=token", nil),
+		newResp(http.StatusOK, "secret"),
+	)
+}
@@ -5,10 +5,13 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/transport"
@@ -16,40 +19,105 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+// maxTapQueues is the kernel's limit of queues per TAP device.
+const maxTapQueues = 256
+
 var (
 	frameLen     = 0xffff
 	frameSizeLen = 2
+
+	errCfgBadTapQueues = fmt.Errorf("given config has more than %d TAP queues", maxTapQueues)
+	errCfgBadTapSubnet = errors.New("given config has invalid TAP subnet")
 )
 
+// tapSubnet holds the addresses of our TAP device's subnet.  Like gvproxy, we
+// use the subnet's first address for the default gateway -- the host proxy,
+// which also operates a DNS resolver -- and the second address for ourselves.
+type tapSubnet struct {
+	network *net.IPNet
+	gw      net.IP
+	addr    net.IP
+}
+
+// parseTapSubnet parses the given IPv4 subnet in CIDR notation, which must be
+// large enough to fit our gateway and our own address.
+func parseTapSubnet(cidr string) (*tapSubnet, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errCfgBadTapSubnet, err)
+	}
+	ip := network.IP.To4()
+	if ones, _ := network.Mask.Size(); ip == nil || ones > 30 {
+		return nil, fmt.Errorf("%w: %s is not an IPv4 subnet of at least four addresses",
+			errCfgBadTapSubnet, cidr)
+	}
+	nth := func(n byte) net.IP {
+		addr := make(net.IP, net.IPv4len)
+		copy(addr, ip)
+		addr[3] += n
+		return addr
+	}
+	return &tapSubnet{network: network, gw: nth(1), addr: nth(2)}, nil
+}
+
+// ipNet returns our own address within the subnet.
+func (s *tapSubnet) ipNet() *net.IPNet {
+	return &net.IPNet{IP: s.addr, Mask: s.network.Mask}
+}
+
+// syncWriter serializes writes to the given writer, so the frames that several
+// goroutines forward don't interleave.
+type syncWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.w.Write(p)
+}
+
 // runNetworking calls the function that sets up our networking environment.
 // If anything fails, we try again after a brief wait period.
-func runNetworking(c *Config, stop chan struct{}) {
+func runNetworking(c *Config, egress *egressStats, stop chan struct{}) {
+	defer reportPanic()
 	var err error
 	for {
-		if err = setupNetworking(c, stop); err == nil {
+		if err = setupNetworking(c, egress, stop); err == nil {
+			return
+		}
+		ops.hostProxyErrors.Add(1)
+		select {
+		case <-stop:
 			return
+		case <-time.After(time.Second):
 		}
-		time.Sleep(time.Second)
 	}
 }
 
 // setupNetworking sets up the enclave's networking environment.  In
 // particular, this function:
 //
-//  1. Creates a TAP device.
+//  1. Creates a TAP device with the configured number of queues.
 //  2. Set up networking links.
 //  3. Establish a connection with the proxy running on the host.
 //  4. Spawn goroutines to forward traffic between the TAP device and the proxy
-//     running on the host.
-func setupNetworking(c *Config, stop chan struct{}) error {
+//     running on the host: one per queue for outgoing traffic, and one for
+//     incoming traffic, which the host sends over a single connection.
+func setupNetworking(c *Config, egress *egressStats, stop chan struct{}) error {
 	// Establish connection with the proxy running on the EC2 host.
-	endpoint := fmt.Sprintf("vsock://%d:%d/connect", parentCID, c.HostProxyPort)
+	subnet, err := parseTapSubnet(c.TapSubnet)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("vsock://%d:%d/connect", c.HostCID, c.HostProxyPort)
 	conn, path, err := transport.Dial(endpoint)
 	if err != nil {
 		return fmt.Errorf("failed to connect to host: %w", err)
 	}
 	defer conn.Close()
-	elog.Println("Established connection with EC2 host.")
+	elog.Info("Established connection with EC2 host.")
 
 	req, err := http.NewRequest(http.MethodPost, path, nil)
 	if err != nil {
@@ -58,43 +126,60 @@ func setupNetworking(c *Config, stop chan struct{}) error {
 	if err := req.Write(conn); err != nil {
 		return fmt.Errorf("failed to send POST request to host: %w", err)
 	}
-	elog.Println("Sent HTTP request to EC2 host.")
+	elog.Debug("Sent HTTP request to EC2 host.")
 
-	// Create a TAP interface.
-	tap, err := water.New(water.Config{
-		DeviceType:             water.TAP,
-		PlatformSpecificParams: ourWaterParams,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create tap device: %w", err)
+	// Create a TAP interface.  Each additional queue attaches to the
+	// interface that the first queue created.
+	queues := make([]*water.Interface, c.TapQueues)
+	for i := range queues {
+		tap, err := water.New(water.Config{
+			DeviceType:             water.TAP,
+			PlatformSpecificParams: ourWaterParams,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create tap device queue %d: %w", i, err)
+		}
+		defer tap.Close()
+		queues[i] = tap
 	}
-	defer tap.Close()
-	elog.Println("Created TAP device.")
+	elog.Debug("Created TAP device.", "queues", len(queues))
 
 	// Configure IP address, MAC address, MTU, default gateway, and DNS.
-	if err = configureTapIface(); err != nil {
+	if err = configureTapIface(subnet); err != nil {
 		return fmt.Errorf("failed to configure tap interface: %w", err)
 	}
-	if err = writeResolvconf(); err != nil {
+	nameserver := subnet.gw
+	if c.DNSCache {
+		nameserver = net.IPv4(127, 0, 0, 1)
+	}
+	if err = writeResolvconf(nameserver); err != nil {
 		return fmt.Errorf("failed to create resolv.conf: %w", err)
 	}
+	if len(c.HostOverrides) > 0 {
+		if err = writeHosts(newHostOverrides(c.HostOverrides).hostsFile()); err != nil {
+			return fmt.Errorf("failed to create hosts file: %w", err)
+		}
+	}
 
 	// Set up networking links.
 	if err := linkUp(); err != nil {
 		return fmt.Errorf("failed to set MAC address: %w", err)
 	}
-	elog.Println("Created networking link.")
+	elog.Debug("Created networking link.")
 
 	// Spawn goroutines that forward traffic.
-	errCh := make(chan error, 1)
-	go tx(conn, tap, errCh)
-	go rx(conn, tap, errCh)
-	elog.Println("Started goroutines to forward traffic.")
+	errCh := make(chan error, len(queues)+1)
+	go tx(conn, queues[0], egress, errCh)
+	hostConn := &syncWriter{w: conn}
+	for i, tap := range queues {
+		go rxQueue(i, len(queues), hostConn, tap, egress, errCh)
+	}
+	elog.Info("Started goroutines to forward traffic.")
 	select {
 	case err := <-errCh:
 		return err
 	case <-stop:
-		elog.Printf("Shutting down networking.")
+		elog.Info("Shutting down networking.")
 		return nil
 	}
 }
@@ -117,9 +202,30 @@ func linkUp() error {
 	return netlink.LinkSetUp(link)
 }
 
-func rx(conn io.Writer, tap io.Reader, errCh chan error) {
-	elog.Println("Waiting for frames from enclave application.")
-	buf := make([]byte, frameSizeLen+frameLen) // Two bytes for the frame length plus the frame itself
+// rxQueue forwards frames from the given queue of our TAP device to the host.
+// If we have several queues, we pin each queue's goroutine to its own vCPU, so
+// the queues don't compete for the same core.
+func rxQueue(queue, queues int, conn io.Writer, tap io.Reader, egress *egressStats, errCh chan error) {
+	if queues > 1 {
+		// We never unlock the thread, so the runtime discards the pinned
+		// thread once we return.
+		runtime.LockOSThread()
+		cpu := queue % runtime.NumCPU()
+		if err := pinToCPU(cpu); err != nil {
+			elog.Warn("Failed to pin TAP queue to vCPU.", "queue", queue, "cpu", cpu, "error", err)
+		}
+	}
+	rx(conn, tap, egress, errCh)
+}
+
+// rx forwards frames from the TAP device to the host.  The TAP device returns
+// one frame per read, which we read right behind the frame's length prefix, so
+// we can forward the prefixed frame with a single write.  If the given egress
+// stats aren't nil, they count each frame.
+func rx(conn io.Writer, tap io.Reader, egress *egressStats, errCh chan error) {
+	elog.Debug("Waiting for frames from enclave application.")
+	buf := frameBufPool.Get() // Two bytes for the frame length plus the frame itself
+	defer frameBufPool.Put(buf)
 
 	for {
 		n, err := tap.Read([]byte(buf[frameSizeLen:]))
@@ -128,6 +234,7 @@ func rx(conn io.Writer, tap io.Reader, errCh chan error) {
 			return
 		}
 
+		egress.observeOut(buf[frameSizeLen : frameSizeLen+n])
 		binary.LittleEndian.PutUint16(buf[:frameSizeLen], uint16(n))
 		m, err := conn.Write(buf[:frameSizeLen+n])
 		if err != nil {
@@ -142,40 +249,63 @@ func rx(conn io.Writer, tap io.Reader, errCh chan error) {
 	}
 }
 
-func tx(conn io.Reader, tap io.Writer, errCh chan error) {
-	elog.Println("Waiting for frames from host.")
-	buf := make([]byte, frameSizeLen+frameLen) // Two bytes for the frame length plus the frame itself
+// tx forwards frames from the host to the TAP device.  The host sends
+// length-prefixed frames back to back, so a single read from the host often
+// returns several frames, which we then write to the TAP device straight from
+// our buffer.  That saves us two reads per frame.  We cannot splice frames
+// because the TAP device expects exactly one frame per write.  If the given
+// egress stats aren't nil, they count each frame.
+func tx(conn io.Reader, tap io.Writer, egress *egressStats, errCh chan error) {
+	elog.Debug("Waiting for frames from host.")
+	buf := frameBufPool.Get() // Fits the largest frame plus its two-byte length prefix.
+	defer frameBufPool.Put(buf)
+
+	// buf[start:end] contains the bytes that we read but didn't forward yet.
+	start, end := 0, 0
+	fill := func(n int) error {
+		if end-start >= n {
+			return nil
+		}
+		// Move the partial frame to the front, to make room for the rest.
+		if start == end || start+n > len(buf) {
+			end = copy(buf, buf[start:end])
+			start = 0
+		}
+		m, err := io.ReadAtLeast(conn, buf[end:], n-(end-start))
+		end += m
+		// The host hung up in the middle of a frame.
+		if errors.Is(err, io.EOF) && end > start {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
 
 	for {
-		n, err := io.ReadFull(conn, buf[:frameSizeLen])
-		if err != nil {
+		if err := fill(frameSizeLen); err != nil {
 			errCh <- fmt.Errorf("failed to read length from host: %w", err)
 			return
 		}
-		if n != frameSizeLen {
-			errCh <- fmt.Errorf("received unexpected length %d", n)
+		size := int(binary.LittleEndian.Uint16(buf[start : start+frameSizeLen]))
+		if size == 0 {
+			errCh <- errors.New("expected payload but got empty frame")
 			return
 		}
-		size := int(binary.LittleEndian.Uint16(buf[:frameSizeLen]))
-
-		n, err = io.ReadFull(conn, buf[frameSizeLen:size+frameSizeLen])
-		if err != nil {
+		if err := fill(frameSizeLen + size); err != nil {
 			errCh <- fmt.Errorf("failed to read payload from host: %w", err)
 			return
 		}
-		if n == 0 || n != size {
-			errCh <- fmt.Errorf("expected payload of size %d but got %d", size, n)
-			return
-		}
+		start += frameSizeLen
 
-		m, err := tap.Write(buf[frameSizeLen : n+frameSizeLen])
+		egress.observeIn(buf[start : start+size])
+		m, err := tap.Write(buf[start : start+size])
 		if err != nil {
 			errCh <- fmt.Errorf("failed to write payload to enclave application: %w", err)
 			return
 		}
-		if m != n {
-			errCh <- fmt.Errorf("wrote %d instead of %d bytes to host", m, n)
+		if m != size {
+			errCh <- fmt.Errorf("wrote %d instead of %d bytes to enclave application", m, size)
 			return
 		}
+		start += size
 	}
 }
@@ -23,7 +23,7 @@ func send(t *testing.T, sizeBuf, expectedBytes []byte, expectedErr error) {
 
 	out := &bytes.Buffer{}
 	in := bytes.NewBuffer(append(sizeBuf, expectedBytes...))
-	tx(in, out, errCh)
+	tx(in, out, nil, errCh)
 
 	wg.Wait()
 	if !errors.Is(err, expectedErr) {
@@ -53,7 +53,7 @@ func receive(t *testing.T, b []byte, expectedErr error) {
 	copy(expectedBytes[frameSizeLen:], b)
 
 	out := &bytes.Buffer{}
-	rx(out, bytes.NewBuffer(b), errCh)
+	rx(out, bytes.NewBuffer(b), nil, errCh)
 
 	wg.Wait()
 	if !errors.Is(err, expectedErr) {
@@ -78,3 +78,91 @@ func TestRx(t *testing.T) {
 	expected := "foobar"
 	receive(t, []byte(expected), io.EOF)
 }
+
+// frameRecorder records each write as a separate frame, like a TAP device.
+type frameRecorder struct {
+	frames []string
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+	r.frames = append(r.frames, string(p))
+	return len(p), nil
+}
+
+func TestTxBatch(t *testing.T) {
+	var in bytes.Buffer
+	expected := []string{"foo", "barbaz", string(bytes.Repeat([]byte("x"), frameLen))}
+	for _, f := range expected {
+		size := make([]byte, frameSizeLen)
+		binary.LittleEndian.PutUint16(size, uint16(len(f)))
+		in.Write(append(size, f...))
+	}
+
+	errCh := make(chan error, 1)
+	out := &frameRecorder{}
+	// Several frames arrive with a single read, and the largest frame must
+	// still fit into our buffer after the smaller ones.
+	tx(&in, out, nil, errCh)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected error %v but got %v.", io.EOF, err)
+	}
+	assertEqual(t, len(out.frames), len(expected))
+	for i := range expected {
+		assertEqual(t, out.frames[i], expected[i])
+	}
+}
+
+func TestTxTruncatedFrame(t *testing.T) {
+	size := make([]byte, frameSizeLen)
+	binary.LittleEndian.PutUint16(size, 10)
+	errCh := make(chan error, 1)
+	tx(bytes.NewBuffer(append(size, "foo"...)), &frameRecorder{}, nil, errCh)
+	if err := <-errCh; !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected error %v but got %v.", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestSyncWriter(t *testing.T) {
+	var wg sync.WaitGroup
+	out := &frameRecorder{}
+	w := &syncWriter{w: out}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = w.Write([]byte("foobar"))
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, len(out.frames), 10)
+}
+
+func TestRxQueue(t *testing.T) {
+	errCh := make(chan error, 1)
+	out := &frameRecorder{}
+	rxQueue(1, 2, out, bytes.NewBufferString("foobar"), nil, errCh)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected error %v but got %v.", io.EOF, err)
+	}
+	assertEqual(t, out.frames[0][frameSizeLen:], "foobar")
+}
+
+func TestParseTapSubnet(t *testing.T) {
+	s, err := parseTapSubnet(defaultTapSubnet)
+	failOnErr(t, err)
+	assertEqual(t, s.gw.String(), "192.168.127.1")
+	assertEqual(t, s.addr.String(), "192.168.127.2")
+	assertEqual(t, s.ipNet().String(), "192.168.127.2/24")
+
+	// The network address is derived from the CIDR's prefix.
+	s, err = parseTapSubnet("10.0.5.7/30")
+	failOnErr(t, err)
+	assertEqual(t, s.gw.String(), "10.0.5.5")
+	assertEqual(t, s.addr.String(), "10.0.5.6")
+
+	for _, cidr := range []string{"foo", "10.0.5.4/31", "fd00::/64"} {
+		if _, err := parseTapSubnet(cidr); !errors.Is(err, errCfgBadTapSubnet) {
+			t.Fatalf("Expected error %v for %q but got %v.", errCfgBadTapSubnet, cidr, err)
+		}
+	}
+}
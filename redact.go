@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// redacted replaces confidential values in our log messages.
+	redacted = "[REDACTED]"
+	// Registered secrets that are shorter than this are too likely to match
+	// unrelated text, so we don't register them.
+	minSecretLen = 8
+)
+
+var (
+	// Log attributes whose key contains one of these substrings have
+	// confidential values.
+	secretKeyParts = []string{
+		"token",
+		"secret",
+		"password",
+		"passwd",
+		"authorization",
+		"cookie",
+		"credential",
+		"private_key",
+		"privatekey",
+		"user_data",
+		"userdata",
+	}
+
+	// Patterns of common secrets that we redact wherever they occur.
+	secretPatterns = []*regexp.Regexp{
+		// PEM-encoded private keys.
+		regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|$)`),
+		// Bearer tokens in Authorization headers.
+		regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`),
+		// JSON Web Tokens.
+		regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		// AWS access key IDs.
+		regexp.MustCompile(`\b(AKIA|ASIA)[A-Z0-9]{16}\b`),
+		// Long Base64 blobs, e.g., key material or attestation documents.
+		// Hashes are shorter, so we keep them.
+		regexp.MustCompile(`[A-Za-z0-9+/_-]{128,}={0,2}`),
+	}
+
+	// knownSecrets contains secrets that we learned about at runtime, e.g.,
+	// our internal API's authentication token.
+	knownSecrets = struct {
+		sync.RWMutex
+		m map[string]struct{}
+	}{m: make(map[string]struct{})}
+)
+
+// registerSecret makes sure that the given secret never shows up in our log
+// messages.
+func registerSecret(s string) {
+	if len(s) < minSecretLen {
+		return
+	}
+	knownSecrets.Lock()
+	defer knownSecrets.Unlock()
+	knownSecrets.m[s] = struct{}{}
+}
+
+// isSecretKey returns true if the given log attribute key suggests that the
+// attribute's value is confidential.
+func isSecretKey(key string) bool {
+	key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+	for _, part := range secretKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactString replaces registered secrets and strings that look like secrets
+// in the given string.
+func redactString(s string) string {
+	knownSecrets.RLock()
+	for secret := range knownSecrets.m {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	knownSecrets.RUnlock()
+
+	for _, p := range secretPatterns {
+		s = p.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+// redactAttr is an slog.HandlerOptions.ReplaceAttr function that keeps
+// confidential values out of our log messages, regardless of the log level.
+// We redact the values of attributes whose key suggests a secret, raw bytes,
+// which may be key material, and anything in strings and errors that looks
+// like a secret.
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	if isSecretKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactString(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case []byte:
+			return slog.String(a.Key, redacted)
+		case error:
+			return slog.String(a.Key, redactString(v.Error()))
+		}
+	}
+	return a
+}
+
+// registerSecrets registers the plaintext values of the config's secret
+// fields.  Unresolved secret references are not confidential.
+func (c *Config) registerSecrets() {
+	for _, v := range c.secretFields() {
+		if !isSecretRef(v.String()) {
+			registerSecret(v.String())
+		}
+	}
+}
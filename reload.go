@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+var errBadConfig = errors.New("failed to decode configuration")
+
+// handlerBox lets us store http.Handler values of varying concrete types in an
+// atomic.Value.
+type handlerBox struct {
+	http.Handler
+}
+
+// applyTunables copies the configuration fields that can be changed at runtime
+// from src to dst.  Other fields, e.g., ports, are only read when nitriding
+// starts, so changing them requires a restart.
+func applyTunables(dst, src *Config) {
+	dst.CORSAllowedOrigins = src.CORSAllowedOrigins
+	dst.CORSAllowedMethods = src.CORSAllowedMethods
+	dst.CORSMaxAge = src.CORSMaxAge
+	dst.MaxReqBodyLen = src.MaxReqBodyLen
+	dst.DisableSecurityHeaders = src.DisableSecurityHeaders
+	dst.HSTSMaxAge = src.HSTSMaxAge
+	dst.ReferrerPolicy = src.ReferrerPolicy
+	dst.ContentSecurityPolicy = src.ContentSecurityPolicy
+	dst.LogLevel = src.LogLevel
+	dst.ReadTimeout = src.ReadTimeout
+	dst.WriteTimeout = src.WriteTimeout
+}
+
+// currentConfig returns the enclave's current configuration, which reflects
+// reloads.
+func (e *Enclave) currentConfig() *Config {
+	return e.curCfg.Load()
+}
+
+// Reload applies the runtime-tunable fields of the given config without
+// restarting the enclave, which would lose our HTTPS certificate and key
+// material.  The tunable fields are the CORS settings, the maximum request
+// body length, the security headers, the log level, and the Web servers' read
+// and write timeouts, which apply to requests that arrive after the reload.
+// The header and idle timeouts cannot be reloaded because our Web servers
+// enforce them before our handlers see a request.  All other fields of the
+// given config are ignored.
+func (e *Enclave) Reload(cfg *Config) error {
+	e.reloadLock.Lock()
+	defer e.reloadLock.Unlock()
+
+	newCfg := *e.currentConfig()
+	applyTunables(&newCfg, cfg)
+	newCfg.setDefaults()
+	if err := newCfg.Validate(); err != nil {
+		return fmt.Errorf("failed to reload config: %w", err)
+	}
+
+	e.curCfg.Store(&newCfg)
+	configureLogging(&newCfg)
+	for _, hook := range e.reloadHooks {
+		hook(&newCfg)
+	}
+	elog.Info("Reloaded configuration.")
+	return nil
+}
+
+// reloadable returns a chi middleware that runs the middleware that the given
+// function builds from our current configuration.  Whenever the configuration
+// is reloaded, we build the middleware again.  The given function may return
+// nil if the middleware is disabled in the given configuration.
+func (e *Enclave) reloadable(build func(*Config) func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		var cur atomic.Value
+		apply := func(c *Config) {
+			h := next
+			if mw := build(c); mw != nil {
+				h = mw(next)
+			}
+			cur.Store(handlerBox{h})
+		}
+		apply(e.currentConfig())
+
+		e.reloadLock.Lock()
+		e.reloadHooks = append(e.reloadHooks, apply)
+		e.reloadLock.Unlock()
+
+		f := func(w http.ResponseWriter, r *http.Request) {
+			cur.Load().(handlerBox).ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(f)
+	}
+}
+
+// reloadHandler returns an HTTP handler that lets the enclave application
+// change the runtime-tunable parts of nitriding's configuration.  The request
+// body contains a JSON-encoded config, whose fields are named like the fields
+// of our Config struct.  Omitted fields remain unchanged.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func reloadHandler(e *Enclave) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		newCfg := *e.currentConfig()
+		if err := json.NewDecoder(r.Body).Decode(&newCfg); err != nil {
+			if isBodyTooLarge(err) {
+				httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			httpError(w, r, errBadConfig, http.StatusBadRequest)
+			return
+		}
+		if err := e.Reload(&newCfg); err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	makeReq := func(path, origin string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		e.extPubSrv.Handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	// CORS is disabled by default.
+	resp := makeReq(pathConfig, "https://example.com")
+	assertEqual(t, resp.Header.Get("Access-Control-Allow-Origin"), "")
+	assertEqual(t, resp.Header.Get("Referrer-Policy"), defaultReferrerPolicy)
+
+	c := defaultCfg
+	c.CORSAllowedOrigins = []string{"https://example.com"}
+	c.ReferrerPolicy = "same-origin"
+	c.FQDN = "ignored.example.com"
+	c.WriteTimeout = time.Minute
+	failOnErr(t, e.Reload(&c))
+
+	resp = makeReq(pathConfig, "https://example.com")
+	assertEqual(t, resp.Header.Get("Access-Control-Allow-Origin"), "https://example.com")
+	assertEqual(t, resp.Header.Get("Referrer-Policy"), "same-origin")
+	assertEqual(t, e.currentConfig().WriteTimeout, time.Minute)
+	// Fields that aren't runtime-tunable must remain unchanged.
+	assertEqual(t, e.currentConfig().FQDN, defaultCfg.FQDN)
+}
+
+func TestReloadTimeouts(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	e.Use(func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			_, _ = w.Write([]byte("slow"))
+		})
+	})
+	srv := httptest.NewServer(e.extPubSrv.Handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/slow")
+	failOnErr(t, err)
+	resp.Body.Close()
+
+	// Once we reload a shorter write timeout, the slow response must fail.
+	c := defaultCfg
+	c.WriteTimeout = 10 * time.Millisecond
+	failOnErr(t, e.Reload(&c))
+	if resp, err = http.Get(srv.URL + "/slow"); err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected request to exceed the reloaded write timeout.")
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	makeReq := makeReqToSrv(e.intSrv)
+
+	assertResponse(t,
+		makeReq(http.MethodPut, pathConfig, bytes.NewBufferString("{")),
+		newErrResp(http.StatusBadRequest, errBadConfig),
+	)
+
+	assertResponse(t,
+		makeReq(http.MethodPut, pathConfig, bytes.NewBufferString(`{"MaxReqBodyLen": 10}`)),
+		newResp(http.StatusOK, ""),
+	)
+	assertEqual(t, e.currentConfig().MaxReqBodyLen, int64(10))
+
+	// The new body limit must be in effect.
+	assertResponse(t,
+		makeReq(http.MethodPut, pathConfig, bytes.NewBufferString(`{"MaxReqBodyLen": 100000}`)),
+		newErrResp(http.StatusRequestEntityTooLarge, errBodyTooLarge),
+	)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	errCfgBadRestartCounter = errors.New("given config's RestartCounter requires SealedStateStore and must be a valid state name")
+	errBadRestartCounter    = errors.New("restart counter is malformed")
+)
+
+// restartCounter is the sealed state that holds our restart counter.
+type restartCounter struct {
+	Count uint64 `json:"count"`
+}
+
+// validateRestartCounter returns an error if the config enables the restart
+// counter without sealed state, or with an invalid name.
+func (c *Config) validateRestartCounter() error {
+	if c.RestartCounter == "" {
+		return nil
+	}
+	if c.SealedStateStore == "" || !stateNameRegexp.MatchString(c.RestartCounter) {
+		return errCfgBadRestartCounter
+	}
+	return nil
+}
+
+// countRestart loads our restart counter from the sealed state store,
+// increments it, and stores it again before adding it to our attestation
+// documents.  If the store has no counter yet, we start at zero, which means
+// that the first start of an enclave has a counter of one.  Sealing protects
+// the counter's integrity, but the store can still roll the counter back:
+// verifiers should therefore be suspicious of counters that decrease or that
+// grow quickly.
+func (e *Enclave) countRestart(ctx context.Context) error {
+	var counter restartCounter
+	blob, err := e.sealer.load(ctx, e.cfg.RestartCounter)
+	switch {
+	case errors.Is(err, errStateNotFound):
+		elog.Warn("Found no restart counter; starting at zero.", "name", e.cfg.RestartCounter)
+	case err != nil:
+		return fmt.Errorf("failed to load restart counter: %w", err)
+	default:
+		if err := json.Unmarshal(blob, &counter); err != nil {
+			return fmt.Errorf("%w: %v", errBadRestartCounter, err)
+		}
+	}
+	counter.Count++
+
+	// Marshalling a struct of integers cannot fail.
+	blob, _ = json.Marshal(&counter)
+	if err := e.sealer.save(ctx, e.cfg.RestartCounter, blob); err != nil {
+		return fmt.Errorf("failed to store restart counter: %w", err)
+	}
+	e.hashes.setRestartCount(counter.Count)
+	elog.Info("Counted enclave restart.", "restart_count", counter.Count)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestCountRestart(t *testing.T) {
+	cfg := defaultCfg
+	cfg.SealedStateKMSKey = "alias/state"
+	cfg.SealedStateStore = "vsock://8005"
+	cfg.RestartCounter = "restarts"
+	e := createEnclave(&cfg)
+	// Replace the enclave's store with an in-memory one.
+	e.sealer, _ = newTestSealer(t)
+	ctx := context.Background()
+	withoutCounter := e.hashes.Serialize()
+
+	for i := uint64(1); i <= 2; i++ {
+		failOnErr(t, e.countRestart(ctx))
+		assertEqual(t, e.hashes.restartCount(), i)
+	}
+
+	// The counter follows the hashes in the attestation user data.
+	expected := binary.BigEndian.AppendUint64(append(withoutCounter, counterPrefix...), 2)
+	assertEqual(t, bytes.Equal(e.hashes.Serialize(), expected), true)
+
+	failOnErr(t, e.sealer.save(ctx, "restarts", []byte("not json")))
+	if err := e.countRestart(ctx); !errors.Is(err, errBadRestartCounter) {
+		t.Fatalf("Expected error %v but got %v.", errBadRestartCounter, err)
+	}
+	assertEqual(t, e.hashes.restartCount(), uint64(2))
+}
+
+func TestValidateRestartCounter(t *testing.T) {
+	failOnErr(t, new(Config).validateRestartCounter())
+	c := &Config{SealedStateStore: "s3://bucket", RestartCounter: "restarts"}
+	failOnErr(t, c.validateRestartCounter())
+
+	for _, c := range []*Config{
+		{RestartCounter: "restarts"},
+		{SealedStateStore: "s3://bucket", RestartCounter: "../restarts"},
+	} {
+		if err := c.validateRestartCounter(); !errors.Is(err, errCfgBadRestartCounter) {
+			t.Fatalf("Expected error %v but got %v.", errCfgBadRestartCounter, err)
+		}
+	}
+}
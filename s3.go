@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// maxS3InMemoryLen is the maximum length of the S3 objects that we return in
+// our response body.  Larger objects must be written to a file.
+const maxS3InMemoryLen = 32 * 1024 * 1024
+
+var (
+	errS3BadRequest     = errors.New("S3 request lacks bucket, key, or hex-encoded SHA-256 hash, or has relative path")
+	errS3HashMismatch   = errors.New("S3 object's SHA-256 hash differs from the expected hash")
+	errS3NoSuchKey      = errors.New("S3 object does not exist")
+	errS3ObjectTooLarge = fmt.Errorf("S3 object exceeds %d bytes; set 'path' to write it to a file", maxS3InMemoryLen)
+
+	// emptyPayloadHash is the hex-encoded SHA-256 hash over an empty request
+	// body, which S3 expects in its X-Amz-Content-Sha256 header.
+	emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+)
+
+// s3FetchRequest is the enclave application's request to fetch an S3 object.
+// If no path is given, we return the object in our response body.  If no
+// region is given, we use the EC2 host's region.
+type s3FetchRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Region string `json:"region,omitempty"`
+	SHA256 string `json:"sha256"`
+	Path   string `json:"path,omitempty"`
+	Attest bool   `json:"attest,omitempty"`
+}
+
+// s3FetchResponse is our response to the enclave application if we wrote the
+// S3 object to a file.
+type s3FetchResponse struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// getS3Object returns the body of the given S3 object.  We talk to S3 using
+// the EC2 host's instance role.  The caller must close the body.
+func getS3Object(ctx context.Context, region, bucket, key string) (io.ReadCloser, error) {
+	creds, region, err := getAWSSession(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	url := awsEndpoint("s3", region) + awsURIEncode(bucket, true) + "/" + awsURIEncode(key, false)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	signAWSRequest(req, nil, creds, region, "s3", currentTime())
+
+	// Models and datasets can take a while to download, so we don't use
+	// awsHTTPClient's timeout.  The request's context bounds the download.
+	resp, err := outboundHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(newLimitReader(resp.Body, maxAWSRespLen))
+		err = fmt.Errorf("%w: %s: %s", errAWSResponse, resp.Status, body)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %w", errS3NoSuchKey, err)
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// putS3Object stores the given content as the given S3 object.  Like
+// getS3Object, we talk to S3 using the EC2 host's instance role.
+func putS3Object(ctx context.Context, region, bucket, key string, content []byte) error {
+	creds, region, err := getAWSSession(ctx, region)
+	if err != nil {
+		return err
+	}
+	url := awsEndpoint("s3", region) + awsURIEncode(bucket, true) + "/" + awsURIEncode(key, false)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256.Sum256(content)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, content, creds, region, "s3", currentTime())
+	_, err = doAWSRequest(req)
+	return err
+}
+
+// writeFileAtomically writes the given reader's content to a temporary file
+// next to the given path.  If the given function accepts the content, we
+// rename the temporary file to the given path.  Otherwise, we remove it, so
+// the enclave application never sees unverified content in the given path.
+func writeFileAtomically(path string, r io.Reader, accept func() error) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".nitriding-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return n, err
+	}
+	if err := accept(); err != nil {
+		return n, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return n, err
+	}
+	if err := tmp.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+// verifyHash returns an error if the given hash's sum differs from the given
+// expected sum.
+func verifyHash(h hash.Hash, expected []byte) error {
+	if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+		return errS3HashMismatch
+	}
+	return nil
+}
+
+// s3FetchHandler returns an HTTP handler that fetches an S3 object via the EC2
+// host, and verifies it against the SHA-256 hash in the enclave application's
+// JSON-encoded request.  The EC2 host could tamper with the object, so the
+// hash must come from a trustworthy source, e.g., the enclave image.  If the
+// request asks us to, we record the hash in our attestation documents, which
+// allows clients to verify which objects the enclave loaded.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func s3FetchHandler(hashes *AttestationHashes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req s3FetchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			if isBodyTooLarge(err) {
+				httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			httpError(w, r, errS3BadRequest, http.StatusBadRequest)
+			return
+		}
+		expected, err := hex.DecodeString(req.SHA256)
+		if err != nil || len(expected) != sha256.Size || req.Bucket == "" || req.Key == "" ||
+			(req.Path != "" && !filepath.IsAbs(req.Path)) {
+			httpError(w, r, errS3BadRequest, http.StatusBadRequest)
+			return
+		}
+
+		ctx, span := startSpan(r.Context(), "s3.get_object")
+		defer span.end()
+		body, err := getS3Object(ctx, req.Region, req.Bucket, req.Key)
+		span.setError(err)
+		if err != nil {
+			elog.Warn("Failed to fetch S3 object.", "bucket", req.Bucket, "key", req.Key, "error", err)
+			httpError(w, r, err, http.StatusBadGateway)
+			return
+		}
+		defer body.Close()
+
+		h := sha256.New()
+		var (
+			content []byte
+			size    int64
+		)
+		if req.Path == "" {
+			content, err = io.ReadAll(newLimitReader(io.TeeReader(body, h), maxS3InMemoryLen))
+			if errors.Is(err, errTooMuchToRead) {
+				httpError(w, r, errS3ObjectTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err == nil {
+				err = verifyHash(h, expected)
+			}
+			size = int64(len(content))
+		} else {
+			size, err = writeFileAtomically(req.Path, io.TeeReader(body, h), func() error {
+				return verifyHash(h, expected)
+			})
+		}
+		span.setError(err)
+		if errors.Is(err, errS3HashMismatch) {
+			elog.Warn("S3 object failed verification.", "bucket", req.Bucket, "key", req.Key)
+			httpError(w, r, err, http.StatusBadGateway)
+			return
+		}
+		if err != nil {
+			elog.Warn("Failed to fetch S3 object.", "bucket", req.Bucket, "key", req.Key, "error", err)
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if req.Attest {
+			hashes.addDataHash([sha256.Size]byte(expected))
+		}
+		elog.Info("Fetched S3 object.", "bucket", req.Bucket, "key", req.Key, "size", size)
+
+		if req.Path == "" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(content)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(&s3FetchResponse{
+			Path:   req.Path,
+			Size:   size,
+			SHA256: hex.EncodeToString(expected),
+		}); err != nil {
+			elog.Error("Error encoding S3 fetch response.", "error", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	testS3Object     = []byte("model weights")
+	testS3ObjectHash = sha256.Sum256(testS3Object)
+)
+
+// mockS3 points our AWS clients to a Web server that mimics S3, which serves
+// testS3Object under the bucket "models" and the key "v1/model.bin".
+func mockS3(t *testing.T) {
+	t.Helper()
+	mockAWS(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), awsSigAlgorithm+" Credential=AKID/") ||
+			r.Header.Get("X-Amz-Content-Sha256") != emptyPayloadHash {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/s3/models/v1/model.bin" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(testS3Object)
+	}))
+	origEndpoint := awsEndpoint
+	awsEndpoint = func(service, region string) string { return srv.URL + "/" + service + "/" }
+	t.Cleanup(func() {
+		awsEndpoint = origEndpoint
+		srv.Close()
+	})
+}
+
+// s3Req returns a JSON-encoded request to fetch the given S3 object.
+func s3Req(t *testing.T, req *s3FetchRequest) *bytes.Reader {
+	t.Helper()
+	body, err := json.Marshal(req)
+	failOnErr(t, err)
+	return bytes.NewReader(body)
+}
+
+func TestS3Fetch(t *testing.T) {
+	mockS3(t)
+	hashes := new(AttestationHashes)
+	makeReq := makeReqToHandler(s3FetchHandler(hashes))
+	goodHash := hex.EncodeToString(testS3ObjectHash[:])
+	badHash := strings.Repeat("00", sha256.Size)
+
+	// Fetch the object into our response body.
+	resp := makeReq(http.MethodPost, pathS3Fetch, s3Req(t, &s3FetchRequest{
+		Bucket: "models", Key: "v1/model.bin", SHA256: goodHash,
+	}))
+	assertResponse(t, resp, newResp(http.StatusOK, string(testS3Object)))
+
+	resp = makeReq(http.MethodPost, pathS3Fetch, s3Req(t, &s3FetchRequest{
+		Bucket: "models", Key: "v1/model.bin", SHA256: badHash,
+	}))
+	assertResponse(t, resp, newErrResp(http.StatusBadGateway, errS3HashMismatch))
+
+	// Fetch the object into a file.
+	path := filepath.Join(t.TempDir(), "model.bin")
+	resp = makeReq(http.MethodPost, pathS3Fetch, s3Req(t, &s3FetchRequest{
+		Bucket: "models", Key: "v1/model.bin", SHA256: badHash, Path: path,
+	}))
+	assertEqual(t, resp.StatusCode, http.StatusBadGateway)
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected no file for unverified object but got %v.", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	failOnErr(t, err)
+	assertEqual(t, len(entries), 0)
+
+	resp = makeReq(http.MethodPost, pathS3Fetch, s3Req(t, &s3FetchRequest{
+		Bucket: "models", Key: "v1/model.bin", SHA256: goodHash, Path: path,
+	}))
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var fetched s3FetchResponse
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&fetched))
+	assertEqual(t, fetched, s3FetchResponse{Path: path, Size: int64(len(testS3Object)), SHA256: goodHash})
+	content, err := os.ReadFile(path)
+	failOnErr(t, err)
+	assertEqual(t, string(content), string(testS3Object))
+
+	// Malformed requests and missing objects.
+	for _, req := range []*s3FetchRequest{
+		{Bucket: "models", Key: "v1/model.bin", SHA256: "foo"},
+		{Bucket: "models", SHA256: goodHash},
+		{Bucket: "models", Key: "v1/model.bin", SHA256: goodHash, Path: "model.bin"},
+	} {
+		resp = makeReq(http.MethodPost, pathS3Fetch, s3Req(t, req))
+		assertResponse(t, resp, newErrResp(http.StatusBadRequest, errS3BadRequest))
+	}
+	resp = makeReq(http.MethodPost, pathS3Fetch, s3Req(t, &s3FetchRequest{
+		Bucket: "models", Key: "v2/model.bin", SHA256: goodHash,
+	}))
+	assertEqual(t, resp.StatusCode, http.StatusBadGateway)
+
+	// So far, we haven't attested any data.
+	assertEqual(t, len(hashes.Serialize()), 3*(len(hashPrefix)+sha256.Size))
+}
+
+func TestS3FetchAttest(t *testing.T) {
+	mockS3(t)
+	hashes := new(AttestationHashes)
+	makeReq := makeReqToHandler(s3FetchHandler(hashes))
+	req := &s3FetchRequest{
+		Bucket: "models",
+		Key:    "v1/model.bin",
+		SHA256: hex.EncodeToString(testS3ObjectHash[:]),
+		Attest: true,
+	}
+
+	// Each attested object extends the data hash.
+	var expected [sha256.Size]byte
+	for i := 0; i < 2; i++ {
+		resp := makeReq(http.MethodPost, pathS3Fetch, s3Req(t, req))
+		assertEqual(t, resp.StatusCode, http.StatusOK)
+		expected = sha256.Sum256(append(expected[:], testS3ObjectHash[:]...))
+
+		ser := hashes.Serialize()
+		assertEqual(t, len(ser), 4*(len(hashPrefix)+sha256.Size))
+		assertEqual(t, bytes.Equal(ser[len(ser)-sha256.Size:], expected[:]), true)
+	}
+}
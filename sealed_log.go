@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxSealedLogRecordLen is the maximum length of a record that the enclave
+// application appends to the sealed log.
+const maxSealedLogRecordLen = 64 * 1024
+
+var (
+	errBadSealedLogRecord = errors.New("sealed log record is empty")
+	errSealedLogFull      = errors.New("sealed log buffer is full")
+)
+
+// sealedLogEntry represents a record that the enclave application appended
+// to the sealed log.  Like audit log entries, entries form a hash chain, and
+// each entry's hash is additionally signed by a key that our attestation
+// documents contain.  The host therefore cannot modify, reorder, or insert
+// entries without verifiers noticing, and gaps in the sequence numbers reveal
+// removed entries.
+type sealedLogEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	KeyID     string    `json:"key_id"`
+	Record    []byte    `json:"record"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash,omitempty"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+// hash returns the hex-encoded SHA-256 hash over the JSON-encoded entry,
+// without the entry's own hash and signature.
+func (entry sealedLogEntry) hash() string {
+	entry.Hash, entry.Signature = "", nil
+	// Marshalling a struct of strings, bytes, integers, and times cannot fail.
+	raw, _ := json.Marshal(entry)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// sealedLogReceipt is our response to the enclave application when it
+// appends a record.
+type sealedLogReceipt struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// sealedLog is an append-only log of the enclave application's records that
+// we ship to the EC2 host, one length-prefixed, JSON-encoded entry at a time.
+// Each enclave has its own signing key and therefore its own chain, which
+// starts over at sequence number 0 whenever the enclave starts.  Unlike our
+// log shipper, we never drop records: if the host is slow or unreachable for
+// long enough to fill our buffer, we reject new records instead.
+type sealedLog struct {
+	sync.Mutex
+	key      ed25519.PrivateKey
+	keyID    string
+	nextSeq  uint64
+	lastHash string
+	shipper  *logShipper
+}
+
+// newSealedLog returns a new sealed log with a fresh signing key, which ships
+// entries to the host via the given shipper.
+func newSealedLog(shipper *logShipper) (*sealedLog, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	l := &sealedLog{
+		key:      key,
+		lastHash: hex.EncodeToString(make([]byte, sha256.Size)),
+		shipper:  shipper,
+	}
+	keyHash := sha256.Sum256(l.publicKey())
+	l.keyID = hex.EncodeToString(keyHash[:])
+	return l, nil
+}
+
+// publicKey returns the DER-encoded public key that we sign entries with.
+func (l *sealedLog) publicKey() []byte {
+	der, _ := x509.MarshalPKIXPublicKey(l.key.Public())
+	return der
+}
+
+// append appends the given record to the log, and queues its entry for
+// shipping.
+func (l *sealedLog) append(record []byte) (*sealedLogReceipt, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	entry := sealedLogEntry{
+		Seq:      l.nextSeq,
+		Time:     time.Now().UTC(),
+		KeyID:    l.keyID,
+		Record:   record,
+		PrevHash: l.lastHash,
+	}
+	entry.Hash = entry.hash()
+	// The hash is hex-encoded, so decoding cannot fail.
+	rawHash, _ := hex.DecodeString(entry.Hash)
+	entry.Signature = ed25519.Sign(l.key, rawHash)
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	// We only extend the chain once the entry is queued, so rejected records
+	// don't leave gaps.
+	if !l.shipper.enqueue(lengthPrefixed(raw)) {
+		return nil, errSealedLogFull
+	}
+	l.lastHash = entry.Hash
+	l.nextSeq++
+	return &sealedLogReceipt{Seq: entry.Seq, Hash: entry.Hash}, nil
+}
+
+// sealedLogHandler returns an HTTP handler that appends the request body to
+// the sealed log, and responds with the JSON-encoded receipt of its entry.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func sealedLogHandler(l *sealedLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record, err := io.ReadAll(newLimitReader(r.Body, maxSealedLogRecordLen))
+		if errors.Is(err, errTooMuchToRead) || isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
+			return
+		}
+		if len(record) == 0 {
+			httpError(w, r, errBadSealedLogRecord, http.StatusBadRequest)
+			return
+		}
+		receipt, err := l.append(record)
+		if errors.Is(err, errSealedLogFull) {
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		_ = json.NewEncoder(w).Encode(receipt)
+	}
+}
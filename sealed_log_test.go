@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// shippedEntry returns the next sealed log entry that the given shipper has
+// queued.
+func shippedEntry(t *testing.T, s *logShipper) sealedLogEntry {
+	t.Helper()
+	frame := <-s.records
+	assertEqual(t, int(binary.BigEndian.Uint32(frame[:4])), len(frame)-4)
+	var entry sealedLogEntry
+	failOnErr(t, json.Unmarshal(frame[4:], &entry))
+	return entry
+}
+
+func TestSealedLog(t *testing.T) {
+	shipper := newLogShipper(logProtoFramed, nil)
+	l, err := newSealedLog(shipper)
+	failOnErr(t, err)
+	pub, err := x509.ParsePKIXPublicKey(l.publicKey())
+	failOnErr(t, err)
+
+	prevHash := hex.EncodeToString(make([]byte, 32))
+	for i, record := range []string{"approved", "denied"} {
+		receipt, err := l.append([]byte(record))
+		failOnErr(t, err)
+		entry := shippedEntry(t, shipper)
+		assertEqual(t, entry.Seq, uint64(i))
+		assertEqual(t, receipt.Seq, entry.Seq)
+		assertEqual(t, receipt.Hash, entry.Hash)
+		assertEqual(t, string(entry.Record), record)
+		assertEqual(t, entry.KeyID, l.keyID)
+
+		// Verifiers can check the chain and the signatures.
+		assertEqual(t, entry.PrevHash, prevHash)
+		assertEqual(t, entry.hash(), entry.Hash)
+		rawHash, err := hex.DecodeString(entry.Hash)
+		failOnErr(t, err)
+		assertEqual(t, ed25519.Verify(pub.(ed25519.PublicKey), rawHash, entry.Signature), true)
+		prevHash = entry.Hash
+	}
+}
+
+func TestSealedLogFull(t *testing.T) {
+	shipper := &logShipper{records: make(chan []byte, 1)}
+	l, err := newSealedLog(shipper)
+	failOnErr(t, err)
+
+	_, err = l.append([]byte("foo"))
+	failOnErr(t, err)
+	if _, err := l.append([]byte("bar")); !errors.Is(err, errSealedLogFull) {
+		t.Fatalf("Expected error %v but got %v.", errSealedLogFull, err)
+	}
+	// The rejected record doesn't leave a gap in the chain.
+	first := shippedEntry(t, shipper)
+	_, err = l.append([]byte("baz"))
+	failOnErr(t, err)
+	second := shippedEntry(t, shipper)
+	assertEqual(t, second.Seq, first.Seq+1)
+	assertEqual(t, second.PrevHash, first.Hash)
+}
+
+func TestSealedLogHandler(t *testing.T) {
+	shipper := newLogShipper(logProtoFramed, nil)
+	l, err := newSealedLog(shipper)
+	failOnErr(t, err)
+	makeReq := makeReqToHandler(sealedLogHandler(l))
+
+	res := makeReq(http.MethodPost, pathSealedLog, strings.NewReader("approved"))
+	assertEqual(t, res.StatusCode, http.StatusOK)
+	var receipt sealedLogReceipt
+	failOnErr(t, json.NewDecoder(res.Body).Decode(&receipt))
+	assertEqual(t, receipt.Hash, shippedEntry(t, shipper).Hash)
+
+	res = makeReq(http.MethodPost, pathSealedLog, strings.NewReader(""))
+	assertEqual(t, res.StatusCode, http.StatusBadRequest)
+	res = makeReq(http.MethodPost, pathSealedLog, bytes.NewReader(make([]byte, maxSealedLogRecordLen+1)))
+	assertEqual(t, res.StatusCode, http.StatusRequestEntityTooLarge)
+}
+
+func TestSealedLogRoutes(t *testing.T) {
+	cfg := defaultCfg
+	cfg.SealedLogPort = 8006
+	e := createEnclave(&cfg)
+
+	resp := makeReqToSrv(e.extPubSrv)(http.MethodGet, versioned(pathSLAttstn)+"?nonce="+strings.Repeat("00", nonceLen), nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	resp = makeReqToSrv(e.intSrv)(http.MethodPost, versioned(pathSealedLog), strings.NewReader("approved"))
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, shippedEntry(t, e.sealedLog.shipper).Seq, uint64(0))
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sealedStateVersion is the version of our sealed blob format.
+	sealedStateVersion = 1
+	// sealedStateCtxKey is the key of the KMS encryption context that binds
+	// a wrapped data key to the name of its blob.
+	sealedStateCtxKey = "nitriding:sealed-state"
+	// sealedStateTimeout bounds SaveState and LoadState, which talk to KMS
+	// and to the store.
+	sealedStateTimeout = 30 * time.Second
+	// maxSealedStateLen is the maximum length of the sealed blobs that we
+	// load from our store.
+	maxSealedStateLen = maxS3InMemoryLen
+
+	schemeS3    = "s3"
+	schemeVsock = "vsock"
+
+	// The operations of our host-side state store's protocol.
+	hostStatePut = "put"
+	hostStateGet = "get"
+)
+
+var (
+	errCfgBadSealedState = errors.New("given config needs both SealedStateKMSKey and SealedStateStore, with an s3:// or vsock:// store")
+	errNoSealedState     = errors.New("sealed state is not configured")
+	errBadStateName      = errors.New("state name must consist of 1 to 128 letters, digits, dots, dashes, and underscores")
+	errStateNotFound     = errors.New("state not found")
+	errBadSealedState    = errors.New("sealed state is malformed or was tampered with")
+	errHostState         = errors.New("host failed to store or load state")
+
+	stateNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+)
+
+// validateSealedState returns an error if the config sets only one of
+// SealedStateKMSKey and SealedStateStore, or if its store is invalid.
+func (c *Config) validateSealedState() error {
+	if c.SealedStateKMSKey == "" && c.SealedStateStore == "" {
+		return nil
+	}
+	if c.SealedStateKMSKey == "" {
+		return errCfgBadSealedState
+	}
+	_, err := newStateStore(c.SealedStateStore, c.HostCID)
+	return err
+}
+
+// sealedStateHostPort returns the host's VSOCK port of a vsock://
+// SealedStateStore, and 0 for all other stores.
+func (c *Config) sealedStateHostPort() uint32 {
+	u, err := url.Parse(c.SealedStateStore)
+	if err != nil || u.Scheme != schemeVsock {
+		return 0
+	}
+	port, _ := strconv.ParseUint(u.Host, 10, 32)
+	return uint32(port)
+}
+
+// stateStore stores sealed blobs outside the enclave.  Stores are untrusted:
+// they only ever see ciphertext.
+type stateStore interface {
+	put(ctx context.Context, name string, blob []byte) error
+	// get returns errStateNotFound if there's no blob of the given name.
+	get(ctx context.Context, name string) ([]byte, error)
+}
+
+// newStateStore returns the store at the given URL: s3://bucket/prefix stores
+// blobs as S3 objects, and vsock://port stores them on the EC2 host, at the
+// given VSOCK port of the host with the given context ID.
+func newStateStore(rawURL string, hostCID uint32) (stateStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCfgBadSealedState, err)
+	}
+	switch u.Scheme {
+	case schemeS3:
+		if u.Host == "" {
+			return nil, errCfgBadSealedState
+		}
+		return &s3StateStore{
+			bucket: u.Host,
+			prefix: strings.Trim(u.Path, "/"),
+			region: u.Query().Get("region"),
+		}, nil
+	case schemeVsock:
+		port, err := strconv.ParseUint(u.Host, 10, 32)
+		if err != nil || port == 0 {
+			return nil, errCfgBadSealedState
+		}
+		return &hostStateStore{dial: dialHostVsock(hostCID, uint32(port))}, nil
+	default:
+		return nil, errCfgBadSealedState
+	}
+}
+
+// s3StateStore stores sealed blobs as S3 objects, under the given prefix.
+type s3StateStore struct {
+	bucket, prefix, region string
+}
+
+func (s *s3StateStore) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *s3StateStore) put(ctx context.Context, name string, blob []byte) error {
+	return putS3Object(ctx, s.region, s.bucket, s.key(name), blob)
+}
+
+func (s *s3StateStore) get(ctx context.Context, name string) ([]byte, error) {
+	body, err := getS3Object(ctx, s.region, s.bucket, s.key(name))
+	if errors.Is(err, errS3NoSuchKey) {
+		return nil, errStateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(newLimitReader(body, maxSealedStateLen))
+}
+
+// hostStateReq is our request to the host-side state store.  The blob is
+// only set for puts.
+type hostStateReq struct {
+	Op   string `json:"op"`
+	Name string `json:"name"`
+	Blob []byte `json:"blob,omitempty"`
+}
+
+// hostStateResp is the host-side state store's response.  The blob is only
+// set for gets of existing blobs.
+type hostStateResp struct {
+	Found bool   `json:"found"`
+	Blob  []byte `json:"blob,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// hostStateStore stores sealed blobs on the EC2 host.  We exchange one
+// length-prefixed, JSON-encoded request and response per connection.
+type hostStateStore struct {
+	dial func() (net.Conn, error)
+}
+
+func (s *hostStateStore) do(ctx context.Context, req *hostStateReq) (*hostStateResp, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(lengthPrefixed(msg)); err != nil {
+		return nil, err
+	}
+	var l [4]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	// Base64 inflates the blob by a third.
+	n := binary.BigEndian.Uint32(l[:])
+	if n > 2*maxSealedStateLen {
+		return nil, fmt.Errorf("%w: response of %d bytes", errHostState, n)
+	}
+	msg = make([]byte, n)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	var resp hostStateResp
+	if err := json.Unmarshal(msg, &resp); err != nil {
+		return nil, fmt.Errorf("%w: %v", errHostState, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%w: %s", errHostState, resp.Error)
+	}
+	return &resp, nil
+}
+
+func (s *hostStateStore) put(ctx context.Context, name string, blob []byte) error {
+	_, err := s.do(ctx, &hostStateReq{Op: hostStatePut, Name: name, Blob: blob})
+	return err
+}
+
+func (s *hostStateStore) get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, &hostStateReq{Op: hostStateGet, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Found {
+		return nil, errStateNotFound
+	}
+	return resp.Blob, nil
+}
+
+// sealedBlob is what we store for each blob: the blob, encrypted with
+// AES-256-GCM under a data key, and the data key, wrapped by KMS.
+type sealedBlob struct {
+	Version    int    `json:"version"`
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// stateSealer encrypts blobs under data keys from KMS, and stores them in an
+// untrusted store.  KMS only returns the plaintext of a data key encrypted to
+// a key in one of our attestation documents, so the key's policy can bind
+// the blobs to our enclave image via the kms:RecipientAttestation condition
+// keys.
+type stateSealer struct {
+	attester attester
+	hashes   *AttestationHashes
+	keyID    string
+	store    stateStore
+}
+
+// newStateSealer returns a sealer for the given config's KMS key and store.
+func newStateSealer(c *Config, a attester, hashes *AttestationHashes) *stateSealer {
+	// The config was validated, so parsing cannot fail.
+	store, _ := newStateStore(c.SealedStateStore, c.HostCID)
+	return &stateSealer{attester: a, hashes: hashes, keyID: c.SealedStateKMSKey, store: store}
+}
+
+// encryptionContext binds a wrapped data key to the given blob name, so the
+// store cannot swap blobs of different names.
+func encryptionContext(name string) map[string]string {
+	return map[string]string{sealedStateCtxKey: name}
+}
+
+// newGCM returns AES-256-GCM with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// save seals the given blob and stores it under the given name.
+func (s *stateSealer) save(ctx context.Context, name string, blob []byte) error {
+	if !stateNameRegexp.MatchString(name) {
+		return errBadStateName
+	}
+	resp, err := callKMSAsRecipient(ctx, s.attester, s.hashes, "", "TrentService.GenerateDataKey",
+		map[string]any{
+			"KeyId":             s.keyID,
+			"KeySpec":           defaultKMSKeySpec,
+			"EncryptionContext": encryptionContext(name),
+		})
+	if err != nil {
+		return err
+	}
+	defer wipeBytes(resp.Plaintext)
+
+	aead, err := newGCM(resp.Plaintext)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed, err := json.Marshal(&sealedBlob{
+		Version:    sealedStateVersion,
+		KeyID:      resp.KeyID,
+		WrappedKey: resp.CiphertextBlob,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, blob, []byte(name)),
+	})
+	if err != nil {
+		return err
+	}
+	return s.store.put(ctx, name, sealed)
+}
+
+// load loads the blob of the given name from our store, and unseals it.
+func (s *stateSealer) load(ctx context.Context, name string) ([]byte, error) {
+	if !stateNameRegexp.MatchString(name) {
+		return nil, errBadStateName
+	}
+	raw, err := s.store.get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var sealed sealedBlob
+	if err := json.Unmarshal(raw, &sealed); err != nil ||
+		sealed.Version != sealedStateVersion || len(sealed.WrappedKey) == 0 {
+		return nil, errBadSealedState
+	}
+	resp, err := callKMSAsRecipient(ctx, s.attester, s.hashes, "", "TrentService.Decrypt",
+		map[string]any{
+			"CiphertextBlob":    sealed.WrappedKey,
+			"KeyId":             s.keyID,
+			"EncryptionContext": encryptionContext(name),
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(resp.Plaintext)
+
+	aead, err := newGCM(resp.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, errBadSealedState
+	}
+	blob, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, []byte(name))
+	if err != nil {
+		return nil, errBadSealedState
+	}
+	return blob, nil
+}
+
+// SaveState encrypts the given blob under SealedStateKMSKey and stores it
+// under the given name in SealedStateStore, replacing the blob that was
+// previously stored under the name.  This is the Go equivalent of calling the
+// enclave-internal sealed state endpoint with PUT.
+func (e *Enclave) SaveState(name string, blob []byte) error {
+	if e.sealer == nil {
+		return errNoSealedState
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sealedStateTimeout)
+	defer cancel()
+	return e.sealer.save(ctx, name, blob)
+}
+
+// LoadState loads the blob of the given name from SealedStateStore and
+// decrypts it.  LoadState returns an error if the blob doesn't exist, or if
+// the store tampered with it.  This is the Go equivalent of calling the
+// enclave-internal sealed state endpoint with GET.
+func (e *Enclave) LoadState(name string) ([]byte, error) {
+	if e.sealer == nil {
+		return nil, errNoSealedState
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sealedStateTimeout)
+	defer cancel()
+	return e.sealer.load(ctx, name)
+}
+
+// sealedStateStatus maps the given error of a sealer to an HTTP status code.
+func sealedStateStatus(err error) int {
+	switch {
+	case errors.Is(err, errBadStateName):
+		return http.StatusBadRequest
+	case errors.Is(err, errStateNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errKMSRecipientAttn):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// putSealedStateHandler returns an HTTP handler that seals the request body
+// and stores it under the name in the request's "name" query parameter.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func putSealedStateHandler(s *stateSealer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blob, err := io.ReadAll(r.Body)
+		if err != nil {
+			if isBodyTooLarge(err) {
+				httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		ctx, span := startSpan(r.Context(), "sealed_state.save")
+		err = s.save(ctx, name, blob)
+		span.setError(err)
+		span.end()
+		if err != nil {
+			elog.Warn("Failed to save sealed state.", "name", name, "error", err)
+			httpError(w, r, err, sealedStateStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// getSealedStateHandler returns an HTTP handler that loads and unseals the
+// blob of the name in the request's "name" query parameter.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func getSealedStateHandler(s *stateSealer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		ctx, span := startSpan(r.Context(), "sealed_state.load")
+		blob, err := s.load(ctx, name)
+		span.setError(err)
+		span.end()
+		if err != nil {
+			if !errors.Is(err, errStateNotFound) {
+				elog.Warn("Failed to load sealed state.", "name", name, "error", err)
+			}
+			httpError(w, r, err, sealedStateStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(blob)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testStateKey is the data key that mockStateKMS hands out.
+var testStateKey = bytes.Repeat([]byte{7}, 32)
+
+// mockStateKMS points our AWS clients to a Web server that mimics KMS's
+// GenerateDataKey and Decrypt actions for the key "alias/state".  Like KMS,
+// the server only decrypts a wrapped data key given the encryption context
+// that the key was generated with.
+func mockStateKMS(t *testing.T, a *recipientAttester) {
+	t.Helper()
+	mockAWS(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			CiphertextBlob    []byte
+			KeyId             string
+			KeySpec           string
+			EncryptionContext map[string]string
+			Recipient         kmsRecipient
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil ||
+			string(in.Recipient.AttestationDocument) != "attestation document" ||
+			in.KeyId != "alias/state" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pub, err := x509.ParsePKIXPublicKey(a.publicKey)
+		failOnErr(t, err)
+
+		wrapped := "wrapped:" + in.EncryptionContext[sealedStateCtxKey]
+		out := map[string]any{"KeyId": "arn:aws:kms:us-east-2:1:key/state"}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			if in.KeySpec != defaultKMSKeySpec {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			out["CiphertextBlob"] = []byte(wrapped)
+		case "TrentService.Decrypt":
+			if string(in.CiphertextBlob) != wrapped {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		out["CiphertextForRecipient"] = sealEnvelopedData(t, pub.(*rsa.PublicKey), testStateKey)
+		_ = json.NewEncoder(w).Encode(out)
+	}))
+	origEndpoint := awsEndpoint
+	awsEndpoint = func(service, region string) string { return srv.URL }
+	t.Cleanup(func() {
+		awsEndpoint = origEndpoint
+		srv.Close()
+	})
+}
+
+// memStateStore is an in-memory stateStore.
+type memStateStore struct {
+	sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemStateStore() *memStateStore {
+	return &memStateStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memStateStore) put(_ context.Context, name string, blob []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.blobs[name] = blob
+	return nil
+}
+
+func (s *memStateStore) get(_ context.Context, name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	blob, ok := s.blobs[name]
+	if !ok {
+		return nil, errStateNotFound
+	}
+	return blob, nil
+}
+
+func newTestSealer(t *testing.T) (*stateSealer, *memStateStore) {
+	t.Helper()
+	a := new(recipientAttester)
+	mockStateKMS(t, a)
+	store := newMemStateStore()
+	return &stateSealer{
+		attester: a,
+		hashes:   new(AttestationHashes),
+		keyID:    "alias/state",
+		store:    store,
+	}, store
+}
+
+func TestStateSealer(t *testing.T) {
+	s, store := newTestSealer(t)
+	ctx := context.Background()
+
+	failOnErr(t, s.save(ctx, "counter", []byte("42")))
+	failOnErr(t, s.save(ctx, "other", []byte("foo")))
+	// The store only sees ciphertext.
+	if bytes.Contains(store.blobs["counter"], []byte("42")) {
+		t.Fatal("Store contains plaintext.")
+	}
+	blob, err := s.load(ctx, "counter")
+	failOnErr(t, err)
+	assertEqual(t, string(blob), "42")
+
+	if _, err := s.load(ctx, "missing"); !errors.Is(err, errStateNotFound) {
+		t.Fatalf("Expected error %v but got %v.", errStateNotFound, err)
+	}
+	for _, name := range []string{"", "../etc/passwd", strings.Repeat("a", 129)} {
+		if err := s.save(ctx, name, nil); !errors.Is(err, errBadStateName) {
+			t.Fatalf("Expected error %v but got %v.", errBadStateName, err)
+		}
+		if _, err := s.load(ctx, name); !errors.Is(err, errBadStateName) {
+			t.Fatalf("Expected error %v but got %v.", errBadStateName, err)
+		}
+	}
+
+	// The store cannot tamper with blobs.
+	var sealed sealedBlob
+	failOnErr(t, json.Unmarshal(store.blobs["counter"], &sealed))
+	sealed.Ciphertext[0] ^= 1
+	store.blobs["counter"], _ = json.Marshal(&sealed)
+	if _, err := s.load(ctx, "counter"); !errors.Is(err, errBadSealedState) {
+		t.Fatalf("Expected error %v but got %v.", errBadSealedState, err)
+	}
+	store.blobs["counter"] = []byte("not json")
+	if _, err := s.load(ctx, "counter"); !errors.Is(err, errBadSealedState) {
+		t.Fatalf("Expected error %v but got %v.", errBadSealedState, err)
+	}
+
+	// Nor can it swap blobs of different names.
+	store.blobs["counter"] = store.blobs["other"]
+	if _, err := s.load(ctx, "counter"); err == nil {
+		t.Fatal("Expected error but got none.")
+	}
+}
+
+// serveHostState serves one request of our host-side state store's protocol
+// on the given connection, using the given blobs.
+func serveHostState(t *testing.T, conn net.Conn, blobs map[string][]byte) {
+	defer conn.Close()
+	var l [4]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		t.Error(err)
+		return
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(l[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		t.Error(err)
+		return
+	}
+	var req hostStateReq
+	var resp hostStateResp
+	if err := json.Unmarshal(msg, &req); err != nil {
+		t.Error(err)
+		return
+	}
+	switch req.Op {
+	case hostStatePut:
+		blobs[req.Name] = req.Blob
+	case hostStateGet:
+		resp.Blob, resp.Found = blobs[req.Name]
+	default:
+		resp.Error = "unknown operation"
+	}
+	msg, _ = json.Marshal(&resp)
+	_, _ = conn.Write(lengthPrefixed(msg))
+}
+
+func TestHostStateStore(t *testing.T) {
+	blobs := make(map[string][]byte)
+	s := &hostStateStore{dial: func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go serveHostState(t, server, blobs)
+		return client, nil
+	}}
+	ctx := context.Background()
+
+	failOnErr(t, s.put(ctx, "foo", []byte("sealed")))
+	blob, err := s.get(ctx, "foo")
+	failOnErr(t, err)
+	assertEqual(t, string(blob), "sealed")
+	if _, err := s.get(ctx, "bar"); !errors.Is(err, errStateNotFound) {
+		t.Fatalf("Expected error %v but got %v.", errStateNotFound, err)
+	}
+	if _, err := s.do(ctx, &hostStateReq{Op: "delete", Name: "foo"}); !errors.Is(err, errHostState) {
+		t.Fatalf("Expected error %v but got %v.", errHostState, err)
+	}
+}
+
+func TestS3StateStore(t *testing.T) {
+	mockAWS(t)
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			hash := sha256.Sum256(body)
+			if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			obj, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(obj)
+		}
+	}))
+	origEndpoint := awsEndpoint
+	awsEndpoint = func(service, region string) string { return srv.URL + "/" + service + "/" }
+	t.Cleanup(func() {
+		awsEndpoint = origEndpoint
+		srv.Close()
+	})
+
+	store, err := newStateStore("s3://state/enclave/", parentCID)
+	failOnErr(t, err)
+	ctx := context.Background()
+	failOnErr(t, store.put(ctx, "foo", []byte("sealed")))
+	assertEqual(t, string(objects["/s3/state/enclave/foo"]), "sealed")
+	blob, err := store.get(ctx, "foo")
+	failOnErr(t, err)
+	assertEqual(t, string(blob), "sealed")
+	if _, err := store.get(ctx, "bar"); !errors.Is(err, errStateNotFound) {
+		t.Fatalf("Expected error %v but got %v.", errStateNotFound, err)
+	}
+}
+
+func TestValidateSealedState(t *testing.T) {
+	for store, valid := range map[string]bool{
+		"s3://bucket":                 true,
+		"s3://bucket/prefix?region=x": true,
+		"vsock://8005":                true,
+		"s3:///prefix":                false,
+		"vsock://0":                   false,
+		"vsock://foo":                 false,
+		"file:///var/lib/state":       false,
+	} {
+		c := &Config{SealedStateKMSKey: "alias/state", SealedStateStore: store}
+		if err := c.validateSealedState(); (err == nil) != valid {
+			t.Fatalf("Unexpected result %v for store %q.", err, store)
+		}
+	}
+	c := &Config{SealedStateKMSKey: "alias/state"}
+	if err := c.validateSealedState(); !errors.Is(err, errCfgBadSealedState) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadSealedState, err)
+	}
+	c = &Config{SealedStateStore: "s3://bucket"}
+	if err := c.validateSealedState(); !errors.Is(err, errCfgBadSealedState) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadSealedState, err)
+	}
+	failOnErr(t, new(Config).validateSealedState())
+}
+
+func TestSealedStateHandlers(t *testing.T) {
+	s, _ := newTestSealer(t)
+	put := makeReqToHandler(putSealedStateHandler(s))
+	get := makeReqToHandler(getSealedStateHandler(s))
+	path := pathSealedState + "?name=foo"
+
+	res := get(http.MethodGet, path, nil)
+	assertEqual(t, res.StatusCode, http.StatusNotFound)
+	res = put(http.MethodPut, path, strings.NewReader("state"))
+	assertEqual(t, res.StatusCode, http.StatusNoContent)
+	res = get(http.MethodGet, path, nil)
+	assertEqual(t, res.StatusCode, http.StatusOK)
+	body, err := io.ReadAll(res.Body)
+	failOnErr(t, err)
+	assertEqual(t, string(body), "state")
+
+	res = put(http.MethodPut, pathSealedState+"?name=a/b", strings.NewReader("state"))
+	assertEqual(t, res.StatusCode, http.StatusBadRequest)
+}
+
+func TestSaveStateUnconfigured(t *testing.T) {
+	cfg := defaultCfg
+	e := createEnclave(&cfg)
+	if err := e.SaveState("foo", []byte("bar")); !errors.Is(err, errNoSealedState) {
+		t.Fatalf("Expected error %v but got %v.", errNoSealedState, err)
+	}
+	if _, err := e.LoadState("foo"); !errors.Is(err, errNoSealedState) {
+		t.Fatalf("Expected error %v but got %v.", errNoSealedState, err)
+	}
+}
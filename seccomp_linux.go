@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Offsets into the kernel's struct seccomp_data, which our filter
+	// inspects.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// BPF opcodes that our filter uses.
+	bpfLoadAbs = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+	bpfJumpEq  = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	bpfRet     = unix.BPF_RET | unix.BPF_K
+)
+
+// seccompAllowlist contains the system calls that nitriding needs once it's
+// up and running: the Go runtime's, file and network I/O, VSOCK forwarding,
+// and re-creating our TAP interface if we lose the connection to the EC2
+// host.  Notably absent are system calls that execute programs, create new
+// processes, load kernel modules, mount file systems, or trace other
+// processes.  Architecture-specific system calls are in
+// seccompArchAllowlist.
+var seccompAllowlist = []uintptr{
+	// Memory management.
+	unix.SYS_BRK,
+	unix.SYS_MADVISE,
+	unix.SYS_MINCORE,
+	unix.SYS_MMAP,
+	unix.SYS_MPROTECT,
+	unix.SYS_MREMAP,
+	unix.SYS_MUNMAP,
+	// Threads, scheduling, signals, and time.
+	unix.SYS_CLOCK_GETTIME,
+	unix.SYS_CLOCK_NANOSLEEP,
+	unix.SYS_CLONE,
+	unix.SYS_EXIT,
+	unix.SYS_EXIT_GROUP,
+	unix.SYS_FUTEX,
+	unix.SYS_GETTIMEOFDAY,
+	unix.SYS_NANOSLEEP,
+	unix.SYS_RESTART_SYSCALL,
+	unix.SYS_RT_SIGACTION,
+	unix.SYS_RT_SIGPROCMASK,
+	unix.SYS_RT_SIGRETURN,
+	unix.SYS_SCHED_GETAFFINITY,
+	unix.SYS_SCHED_SETAFFINITY,
+	unix.SYS_SCHED_YIELD,
+	unix.SYS_SETITIMER,
+	unix.SYS_SIGALTSTACK,
+	unix.SYS_TGKILL,
+	unix.SYS_TIMER_CREATE,
+	unix.SYS_TIMER_DELETE,
+	unix.SYS_TIMER_SETTIME,
+	// Processes and system information.
+	unix.SYS_GETEGID,
+	unix.SYS_GETEUID,
+	unix.SYS_GETGID,
+	unix.SYS_GETPID,
+	unix.SYS_GETPPID,
+	unix.SYS_GETRANDOM,
+	unix.SYS_GETTID,
+	unix.SYS_GETUID,
+	unix.SYS_PRLIMIT64,
+	unix.SYS_SYSINFO,
+	unix.SYS_UNAME,
+	// File I/O.
+	unix.SYS_CLOSE,
+	unix.SYS_DUP,
+	unix.SYS_DUP3,
+	unix.SYS_FACCESSAT,
+	unix.SYS_FACCESSAT2,
+	unix.SYS_FCHMOD,
+	unix.SYS_FCNTL,
+	unix.SYS_FDATASYNC,
+	unix.SYS_FSTAT,
+	unix.SYS_FSYNC,
+	unix.SYS_FTRUNCATE,
+	unix.SYS_GETCWD,
+	unix.SYS_GETDENTS64,
+	unix.SYS_IOCTL,
+	unix.SYS_LSEEK,
+	unix.SYS_MKDIRAT,
+	unix.SYS_OPENAT,
+	unix.SYS_PIPE2,
+	unix.SYS_PREAD64,
+	unix.SYS_PWRITE64,
+	unix.SYS_READ,
+	unix.SYS_READLINKAT,
+	unix.SYS_READV,
+	unix.SYS_RENAMEAT,
+	unix.SYS_RENAMEAT2,
+	unix.SYS_STATX,
+	unix.SYS_UMASK,
+	unix.SYS_UNLINKAT,
+	unix.SYS_WRITE,
+	unix.SYS_WRITEV,
+	// Event polling.
+	unix.SYS_EPOLL_CREATE1,
+	unix.SYS_EPOLL_CTL,
+	unix.SYS_EPOLL_PWAIT,
+	unix.SYS_EPOLL_PWAIT2,
+	unix.SYS_EVENTFD2,
+	unix.SYS_PPOLL,
+	// Network I/O, including VSOCK and netlink.
+	unix.SYS_ACCEPT4,
+	unix.SYS_BIND,
+	unix.SYS_CONNECT,
+	unix.SYS_GETPEERNAME,
+	unix.SYS_GETSOCKNAME,
+	unix.SYS_GETSOCKOPT,
+	unix.SYS_LISTEN,
+	unix.SYS_RECVFROM,
+	unix.SYS_RECVMMSG,
+	unix.SYS_RECVMSG,
+	unix.SYS_SENDFILE,
+	unix.SYS_SENDMMSG,
+	unix.SYS_SENDMSG,
+	unix.SYS_SENDTO,
+	unix.SYS_SETSOCKOPT,
+	unix.SYS_SHUTDOWN,
+	unix.SYS_SOCKET,
+	unix.SYS_SPLICE,
+}
+
+// seccompFilter returns a BPF program that allows the given system calls on
+// the given architecture, and fails all other system calls with EPERM.  A
+// system call from another architecture kills the process because the system
+// call numbers would be meaningless.
+func seccompFilter(arch uint32, allowlist []uintptr) []unix.SockFilter {
+	prog := []unix.SockFilter{
+		{Code: bpfLoadAbs, K: seccompDataArch},
+		{Code: bpfJumpEq, Jt: 1, Jf: 0, K: arch},
+		{Code: bpfRet, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: bpfLoadAbs, K: seccompDataNr},
+	}
+	for _, nr := range allowlist {
+		prog = append(prog,
+			unix.SockFilter{Code: bpfJumpEq, Jt: 0, Jf: 1, K: uint32(nr)},
+			unix.SockFilter{Code: bpfRet, K: unix.SECCOMP_RET_ALLOW})
+	}
+	return append(prog, unix.SockFilter{Code: bpfRet, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)})
+}
+
+// installSeccompFilter restricts all of nitriding's threads to our allowlist
+// of system calls.  The filter cannot be removed, and child processes inherit
+// it.
+func installSeccompFilter() error {
+	allowlist := append(append([]uintptr{}, seccompAllowlist...), seccompArchAllowlist...)
+	filter := seccompFilter(seccompArch, allowlist)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// Unprivileged processes must promise not to gain privileges before they
+	// can install a filter.
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	if _, _, errno := unix.Syscall(
+		unix.SYS_SECCOMP,
+		unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC,
+		uintptr(unsafe.Pointer(&prog)),
+	); errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	}
+	return nil
+}
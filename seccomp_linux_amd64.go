@@ -0,0 +1,31 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompArch identifies x86-64 system calls.
+const seccompArch = unix.AUDIT_ARCH_X86_64
+
+// seccompArchAllowlist contains the x86-64 system calls that we allow in
+// addition to seccompAllowlist.  Unlike arm64, x86-64 retains legacy system
+// calls that the Go runtime and standard library still use.
+var seccompArchAllowlist = []uintptr{
+	unix.SYS_ACCESS,
+	unix.SYS_ARCH_PRCTL,
+	unix.SYS_DUP2,
+	unix.SYS_EPOLL_CREATE,
+	unix.SYS_EPOLL_WAIT,
+	unix.SYS_GETDENTS,
+	unix.SYS_GETRLIMIT,
+	unix.SYS_LSTAT,
+	unix.SYS_MKDIR,
+	unix.SYS_NEWFSTATAT,
+	unix.SYS_OPEN,
+	unix.SYS_PIPE,
+	unix.SYS_POLL,
+	unix.SYS_READLINK,
+	unix.SYS_RENAME,
+	unix.SYS_SELECT,
+	unix.SYS_STAT,
+	unix.SYS_TIME,
+	unix.SYS_UNLINK,
+}
@@ -0,0 +1,13 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompArch identifies arm64 system calls.
+const seccompArch = unix.AUDIT_ARCH_AARCH64
+
+// seccompArchAllowlist contains the arm64 system calls that we allow in
+// addition to seccompAllowlist.
+var seccompArchAllowlist = []uintptr{
+	unix.SYS_FSTATAT,
+	unix.SYS_GETRLIMIT,
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runSeccompFilter evaluates the given seccomp filter for the given
+// architecture and system call number, and returns the filter's verdict.
+func runSeccompFilter(t *testing.T, prog []unix.SockFilter, arch uint32, nr uintptr) uint32 {
+	t.Helper()
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch ins.Code {
+		case bpfLoadAbs:
+			switch ins.K {
+			case seccompDataNr:
+				acc = uint32(nr)
+			case seccompDataArch:
+				acc = arch
+			default:
+				t.Fatalf("Unexpected load offset %d.", ins.K)
+			}
+		case bpfJumpEq:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case bpfRet:
+			return ins.K
+		default:
+			t.Fatalf("Unexpected opcode %#x.", ins.Code)
+		}
+	}
+	t.Fatal("Filter did not return a verdict.")
+	return 0
+}
+
+func TestSeccompFilter(t *testing.T) {
+	prog := seccompFilter(seccompArch, []uintptr{unix.SYS_READ, unix.SYS_WRITE})
+
+	assertEqual(t, runSeccompFilter(t, prog, seccompArch, unix.SYS_READ), uint32(unix.SECCOMP_RET_ALLOW))
+	assertEqual(t, runSeccompFilter(t, prog, seccompArch, unix.SYS_WRITE), uint32(unix.SECCOMP_RET_ALLOW))
+	assertEqual(t, runSeccompFilter(t, prog, seccompArch, unix.SYS_EXECVE), uint32(unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM)))
+	// System calls of other architectures must kill the process.
+	assertEqual(t, runSeccompFilter(t, prog, 0, unix.SYS_READ), uint32(unix.SECCOMP_RET_KILL_PROCESS))
+}
+
+func TestSeccompAllowlist(t *testing.T) {
+	for _, nr := range append(seccompAllowlist, seccompArchAllowlist...) {
+		switch nr {
+		case unix.SYS_EXECVE, unix.SYS_EXECVEAT, unix.SYS_PTRACE, unix.SYS_MOUNT,
+			unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_BPF, unix.SYS_SETNS,
+			unix.SYS_UNSHARE, unix.SYS_KEXEC_LOAD, unix.SYS_SECCOMP:
+			t.Errorf("Dangerous system call %d is on our allowlist.", nr)
+		}
+	}
+}
+
+func TestInstallSeccompFilter(t *testing.T) {
+	// The filter cannot be removed, so we install it in a child process.
+	if os.Getenv("NITRIDING_TEST_SECCOMP") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInstallSeccompFilter$")
+		cmd.Env = append(os.Environ(), "NITRIDING_TEST_SECCOMP=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Seccomp test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	if err := installSeccompFilter(); err != nil {
+		t.Skipf("Cannot install seccomp filter: %v", err)
+	}
+
+	// Our Web servers must keep working.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	failOnErr(t, err)
+	resp.Body.Close()
+
+	// We must no longer be able to execute programs.
+	err = exec.Command("/bin/true").Run()
+	if !errors.Is(err, unix.EPERM) {
+		t.Fatalf("Expected EPERM but got: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// wipeBytes overwrites the given byte slice with zeros.
+func wipeBytes(b []byte) {
+	clear(b)
+}
+
+// SecretBytes holds key material.  Code that handles key material should keep
+// it in a SecretBytes, and call Wipe once it no longer needs the material.
+// In case the code forgets to call Wipe, the garbage collector wipes the key
+// material before it releases the SecretBytes.  Beware that copies of the
+// slice that Bytes returns are not wiped.
+type SecretBytes struct {
+	sync.Mutex
+	b []byte
+}
+
+// newSecretBytes returns a SecretBytes that takes ownership of the given key
+// material.
+func newSecretBytes(b []byte) *SecretBytes {
+	s := &SecretBytes{b: b}
+	runtime.SetFinalizer(s, (*SecretBytes).Wipe)
+	return s
+}
+
+// Bytes returns the key material, which is nil after the SecretBytes was
+// wiped.
+func (s *SecretBytes) Bytes() []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.b
+}
+
+// Wipe overwrites the key material with zeros and discards it.  It is safe to
+// call Wipe more than once.
+func (s *SecretBytes) Wipe() {
+	s.Lock()
+	defer s.Unlock()
+
+	wipeBytes(s.b)
+	s.b = nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecretBytes(t *testing.T) {
+	key := []byte("secret key material")
+	s := newSecretBytes(key)
+	assertEqual(t, string(s.Bytes()), "secret key material")
+
+	s.Wipe()
+	assertEqual(t, s.Bytes() == nil, true)
+	assertEqual(t, bytes.Count(key, []byte{0}), len(key))
+
+	// Wiping again must not panic.
+	s.Wipe()
+}
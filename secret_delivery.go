@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+const (
+	// hpkeDeliveryInfo is the HPKE info string with which we encrypt
+	// delivered secrets.
+	hpkeDeliveryInfo = "nitriding secret delivery"
+	// maxDeliveryAttstnAge is the maximum age of the attestation documents
+	// that we deliver secrets for.
+	maxDeliveryAttstnAge = 5 * time.Minute
+)
+
+var (
+	errCfgBadDeliveredSecret = errors.New("given config has invalid delivered secret")
+	errCfgBadDeliveryPCR     = errors.New("given config has invalid secret delivery measurement")
+	errCfgNoDeliveryPCRs     = errors.New("given config delivers secrets but allowlists no measurements")
+	errSecretsNotReady       = errors.New("delivered secrets not yet resolved")
+	errPCRNotAllowed         = errors.New("attestation document's measurement is not allowlisted")
+	errStaleAttstn           = errors.New("attestation document is too old")
+	errNoDeliveryKey         = errors.New("attestation document contains no X25519 public key")
+
+	// verifyDeliveryAttstn verifies the given attestation document and
+	// returns its content.  Using a variable allows us to mock the function
+	// in our unit tests.
+	verifyDeliveryAttstn = func(doc []byte) (*nitrite.Document, error) {
+		res, err := nitrite.Verify(doc, nitrite.VerifyOptions{CurrentTime: currentTime()})
+		if err != nil {
+			return nil, err
+		}
+		return res.Document, nil
+	}
+)
+
+// parseDeliveredSecret splits the given delivered secret of the form
+// <name>=<secret reference> into its name and secret reference.
+func parseDeliveredSecret(s string) (string, string, error) {
+	name, ref, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("%w: %q is not of the form <name>=<reference>", errCfgBadDeliveredSecret, s)
+	}
+	if _, err := parseSecretRef(ref); err != nil {
+		return "", "", fmt.Errorf("%w: %s: %v", errCfgBadDeliveredSecret, name, err)
+	}
+	return name, ref, nil
+}
+
+// parseDeliveryPCR parses the given hex-encoded PCR0 value, i.e., a SHA-384
+// hash over an enclave image.
+func parseDeliveryPCR(s string) ([]byte, error) {
+	pcr, err := hex.DecodeString(s)
+	if err != nil || len(pcr) != sha512.Size384 {
+		return nil, fmt.Errorf("%w: %q is not a hex-encoded SHA-384 hash", errCfgBadDeliveryPCR, s)
+	}
+	return pcr, nil
+}
+
+// validateSecretDelivery returns an error if the config's delivered secrets
+// or the measurements that we deliver them to are invalid.
+func (c *Config) validateSecretDelivery() error {
+	var errs []error
+	for _, s := range c.DeliveredSecrets {
+		if _, _, err := parseDeliveredSecret(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, s := range c.SecretDeliveryPCRs {
+		if _, err := parseDeliveryPCR(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(c.DeliveredSecrets) > 0 && len(c.SecretDeliveryPCRs) == 0 {
+		errs = append(errs, errCfgNoDeliveryPCRs)
+	}
+	return errors.Join(errs...)
+}
+
+// secretVault holds the secrets that we deliver to other enclaves, and the
+// measurements (i.e., PCR0 values) of the enclave images that we deliver
+// secrets to.  Unlike key synchronization, secret delivery works across
+// different enclave images.
+type secretVault struct {
+	sync.Mutex
+	secrets map[string]*SecretBytes // Nil until resolved.
+	allowed [][]byte
+}
+
+// newSecretVault returns a new secret vault that delivers secrets to enclaves
+// with the given hex-encoded PCR0 values, which must be valid.
+func newSecretVault(pcrs []string) *secretVault {
+	v := new(secretVault)
+	for _, s := range pcrs {
+		pcr, _ := parseDeliveryPCR(s)
+		v.allowed = append(v.allowed, pcr)
+	}
+	return v
+}
+
+// resolve resolves the given delivered secrets using the given function.
+func (v *secretVault) resolve(
+	ctx context.Context,
+	delivered []string,
+	resolve func(context.Context, string) (string, error),
+) error {
+	secrets := make(map[string]*SecretBytes)
+	for _, s := range delivered {
+		name, ref, err := parseDeliveredSecret(s)
+		if err != nil {
+			return err
+		}
+		plaintext, err := resolveWithRetry(ctx, resolve, ref)
+		if err != nil {
+			return fmt.Errorf("failed to resolve delivered secret %s: %w", name, err)
+		}
+		secrets[name] = newSecretBytes([]byte(plaintext))
+		elog.Info("Resolved delivered secret.", "name", name)
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	v.secrets = secrets
+	return nil
+}
+
+// isAllowed returns true if we deliver secrets to an enclave with the given
+// PCR0 value.
+func (v *secretVault) isAllowed(pcr0 []byte) bool {
+	for _, pcr := range v.allowed {
+		if bytes.Equal(pcr, pcr0) {
+			return true
+		}
+	}
+	return false
+}
+
+// seal returns our secrets as a JSON object that maps each secret's name to
+// its Base64-encoded value, encrypted to the given public key.
+func (v *secretVault) seal(pubKey []byte) ([]byte, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.secrets == nil {
+		return nil, errSecretsNotReady
+	}
+	secrets := make(map[string][]byte, len(v.secrets))
+	for name, s := range v.secrets {
+		secrets[name] = s.Bytes()
+	}
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(plaintext)
+	return hpkeSeal(pubKey, []byte(hpkeDeliveryInfo), plaintext)
+}
+
+// wipe wipes our secrets.  We cannot deliver secrets after that.
+func (v *secretVault) wipe() {
+	v.Lock()
+	defer v.Unlock()
+
+	for _, s := range v.secrets {
+		s.Wipe()
+	}
+	v.secrets = nil
+}
+
+// secretDeliveryHandler returns an HTTP handler that delivers our secrets to
+// another enclave.  The request body contains the enclave's raw attestation
+// document, whose public key field contains an ephemeral X25519 public key.
+// If the attestation document is valid, recent, and comes from an allowlisted
+// enclave image, we respond with our secrets, encrypted to the public key
+// using HPKE.  Replaying an attestation document gets an attacker nowhere
+// because only the attested enclave can decrypt our response.
+func secretDeliveryHandler(v *secretVault) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(newLimitReader(r.Body, maxKeyMaterialLen))
+		if isBodyTooLarge(err) {
+			httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, errFailedReqBody, http.StatusInternalServerError)
+			return
+		}
+		doc, err := verifyDeliveryAttstn(body)
+		if err != nil {
+			httpError(w, r, err, http.StatusUnauthorized)
+			return
+		}
+		if !v.isAllowed(doc.PCRs[0]) {
+			elog.Warn("Refused to deliver secrets to enclave.", "pcr0", fmt.Sprintf("%x", doc.PCRs[0]))
+			httpError(w, r, errPCRNotAllowed, http.StatusForbidden)
+			return
+		}
+		if currentTime().Sub(time.UnixMilli(int64(doc.Timestamp))) > maxDeliveryAttstnAge {
+			httpError(w, r, errStaleAttstn, http.StatusForbidden)
+			return
+		}
+		if len(doc.PublicKey) != hpkeEncLen {
+			httpError(w, r, errNoDeliveryKey, http.StatusBadRequest)
+			return
+		}
+
+		sealed, err := v.seal(doc.PublicKey)
+		if errors.Is(err, errSecretsNotReady) {
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		elog.Info("Delivered secrets to enclave.", "pcr0", fmt.Sprintf("%x", doc.PCRs[0]))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(sealed)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+var testDeliveryPCR = strings.Repeat("ab", 48)
+
+// mockDeliveryAttstn makes verifyDeliveryAttstn return the given document
+// for the duration of the test.
+func mockDeliveryAttstn(t *testing.T, doc *nitrite.Document) {
+	t.Helper()
+	orig := verifyDeliveryAttstn
+	verifyDeliveryAttstn = func([]byte) (*nitrite.Document, error) {
+		if doc == nil {
+			return nil, errors.New("invalid attestation document")
+		}
+		return doc, nil
+	}
+	t.Cleanup(func() { verifyDeliveryAttstn = orig })
+}
+
+func TestValidateSecretDelivery(t *testing.T) {
+	c := &Config{
+		DeliveredSecrets:   []string{"db=asm://db"},
+		SecretDeliveryPCRs: []string{testDeliveryPCR},
+	}
+	failOnErr(t, c.validateSecretDelivery())
+
+	c.SecretDeliveryPCRs = nil
+	assertEqual(t, errors.Is(c.validateSecretDelivery(), errCfgNoDeliveryPCRs), true)
+	c.SecretDeliveryPCRs = []string{"abcd"}
+	assertEqual(t, errors.Is(c.validateSecretDelivery(), errCfgBadDeliveryPCR), true)
+
+	c.SecretDeliveryPCRs = []string{testDeliveryPCR}
+	for _, s := range []string{"db", "=asm://db", "db=foo://db"} {
+		c.DeliveredSecrets = []string{s}
+		assertEqual(t, errors.Is(c.validateSecretDelivery(), errCfgBadDeliveredSecret), true)
+	}
+}
+
+func TestSecretDeliveryHandler(t *testing.T) {
+	c := defaultCfg
+	c.DeliveredSecrets = []string{"db=asm://db"}
+	c.SecretDeliveryPCRs = []string{testDeliveryPCR}
+	e := createEnclave(&c)
+	makeReq := makeReqToSrv(e.extPrivSrv)
+
+	key, err := newHPKEKey()
+	failOnErr(t, err)
+	pcr0, _ := hex.DecodeString(testDeliveryPCR)
+	doc := &nitrite.Document{
+		Timestamp: uint64(currentTime().UnixMilli()),
+		PCRs:      map[uint][]byte{0: pcr0},
+		PublicKey: key.pub,
+	}
+	mockDeliveryAttstn(t, doc)
+
+	// We don't deliver secrets before we resolved them.
+	assertResponse(t,
+		makeReq(http.MethodPost, pathSecrets, nil),
+		newErrResp(http.StatusServiceUnavailable, errSecretsNotReady),
+	)
+	failOnErr(t, e.vault.resolve(context.Background(), c.DeliveredSecrets,
+		func(context.Context, string) (string, error) { return "hunter2", nil }))
+
+	resp := makeReq(http.MethodPost, pathSecrets, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var body bytes.Buffer
+	_, err = body.ReadFrom(resp.Body)
+	failOnErr(t, err)
+	plaintext, err := key.open([]byte(hpkeDeliveryInfo), body.Bytes())
+	failOnErr(t, err)
+	var secrets map[string][]byte
+	failOnErr(t, json.Unmarshal(plaintext, &secrets))
+	assertEqual(t, string(secrets["db"]), "hunter2")
+
+	// Stale attestation documents don't get secrets.
+	doc.Timestamp = uint64(currentTime().Add(-maxDeliveryAttstnAge - time.Minute).UnixMilli())
+	assertResponse(t,
+		makeReq(http.MethodPost, pathSecrets, nil),
+		newErrResp(http.StatusForbidden, errStaleAttstn),
+	)
+
+	// Neither do enclaves whose measurement isn't allowlisted.
+	doc.PCRs[0] = make([]byte, len(pcr0))
+	assertResponse(t,
+		makeReq(http.MethodPost, pathSecrets, nil),
+		newErrResp(http.StatusForbidden, errPCRNotAllowed),
+	)
+
+	// Once wiped, we have no secrets to deliver.
+	doc.PCRs[0], doc.Timestamp = pcr0, uint64(currentTime().UnixMilli())
+	e.WipeKeyMaterial()
+	assertResponse(t,
+		makeReq(http.MethodPost, pathSecrets, nil),
+		newErrResp(http.StatusServiceUnavailable, errSecretsNotReady),
+	)
+
+	mockDeliveryAttstn(t, nil)
+	resp = makeReq(http.MethodPost, pathSecrets, nil)
+	assertEqual(t, resp.StatusCode, http.StatusUnauthorized)
+}
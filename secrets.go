@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// The schemes of secret references.  A reference of the form
+	// kms://<ciphertext> refers to a base64-encoded ciphertext that AWS KMS
+	// decrypts for us, and a reference of the form asm://<secret-id> refers to
+	// a secret in AWS Secrets Manager, identified by its name or ARN.  Both
+	// may carry a "?region=<region>" suffix; the default is the EC2 host's
+	// region.
+	schemeKMS = "kms"
+	schemeASM = "asm"
+
+	// How long we keep trying to resolve secret references.  Our networking
+	// may take a moment to come up after startup.
+	secretResolveTimeout = time.Minute
+	secretRetryInterval  = 2 * time.Second
+)
+
+var (
+	errCfgBadSecretRef = errors.New("given config has invalid secret reference")
+	errNoSecretString  = errors.New("secret has no string value")
+)
+
+// secretRef represents a parsed secret reference, e.g.,
+// asm://prod/nitriding?region=us-east-2.
+type secretRef struct {
+	scheme string
+	value  string
+	region string
+}
+
+// isSecretRef returns true if the given string looks like a secret reference.
+func isSecretRef(s string) bool {
+	return strings.HasPrefix(s, schemeKMS+"://") || strings.HasPrefix(s, schemeASM+"://")
+}
+
+// parseSecretRef parses the given secret reference.  We don't use url.Parse
+// because secret ARNs contain colons, which url.Parse mistakes for ports.
+func parseSecretRef(s string) (*secretRef, error) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok || (scheme != schemeKMS && scheme != schemeASM) {
+		return nil, fmt.Errorf("%w: unknown scheme", errCfgBadSecretRef)
+	}
+	ref := &secretRef{scheme: scheme}
+	value, rawQuery, _ := strings.Cut(rest, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCfgBadSecretRef, err)
+	}
+	ref.region = query.Get("region")
+	if ref.value, err = url.PathUnescape(value); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCfgBadSecretRef, err)
+	}
+	if ref.value == "" {
+		return nil, fmt.Errorf("%w: %s:// reference is empty", errCfgBadSecretRef, scheme)
+	}
+	if scheme == schemeKMS {
+		if _, err := base64.StdEncoding.DecodeString(ref.value); err != nil {
+			return nil, fmt.Errorf("%w: ciphertext is not base64-encoded", errCfgBadSecretRef)
+		}
+	}
+	return ref, nil
+}
+
+// resolveSecret returns the plaintext that the given secret reference refers
+// to.  We talk to AWS using the EC2 host's instance role, which we obtain from
+// the instance metadata service.  Secrets Manager hands secret values to
+// anyone with the role, so restrict its permissions to the secrets that the
+// enclave needs.  KMS ciphertexts, however, we decrypt using an attestation
+// document that the given attester creates, so a KMS key policy can restrict
+// decryption to our enclave image, as it can for application secrets.
+func resolveSecret(ctx context.Context, a attester, hashes *AttestationHashes, s string) (string, error) {
+	ref, err := parseSecretRef(s)
+	if err != nil {
+		return "", err
+	}
+
+	switch ref.scheme {
+	case schemeASM:
+		creds, region, err := getAWSSession(ctx, ref.region)
+		if err != nil {
+			return "", err
+		}
+		var resp struct {
+			SecretString *string
+		}
+		in := map[string]string{"SecretId": ref.value}
+		err = callAWS(ctx, creds, region, "secretsmanager", "secretsmanager.GetSecretValue", in, &resp)
+		if err != nil {
+			return "", err
+		}
+		if resp.SecretString == nil {
+			return "", errNoSecretString
+		}
+		return *resp.SecretString, nil
+	default: // schemeKMS
+		// parseSecretRef made sure that the ciphertext is base64-encoded.
+		ciphertext, _ := base64.StdEncoding.DecodeString(ref.value)
+		resp, err := callKMSAsRecipient(ctx, a, hashes, ref.region, "TrentService.Decrypt",
+			map[string]any{"CiphertextBlob": ciphertext})
+		if err != nil {
+			return "", err
+		}
+		defer wipeBytes(resp.Plaintext)
+		return string(resp.Plaintext), nil
+	}
+}
+
+// secretFields returns the config's string fields that are tagged with
+// `secret:"true"`.  Only these fields may contain secret references, which
+// keeps the resolved plaintext out of nitriding's configuration endpoint.
+func (c *Config) secretFields() map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Tag.Get("secret") == "true" && field.Type.Kind() == reflect.String {
+			fields[field.Name] = v.Field(i)
+		}
+	}
+	return fields
+}
+
+// validateSecretRefs returns an error if any of the config's secret fields
+// contains a malformed secret reference.
+func (c *Config) validateSecretRefs() error {
+	for name, v := range c.secretFields() {
+		if !isSecretRef(v.String()) {
+			continue
+		}
+		if _, err := parseSecretRef(v.String()); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// resolveSecrets replaces the secret references in the config's secret fields
+// with the plaintext that the given function resolves them to.  As our
+// networking may not be up yet, we retry until the given context expires.
+func (c *Config) resolveSecrets(ctx context.Context, resolve func(context.Context, string) (string, error)) error {
+	for name, v := range c.secretFields() {
+		if !isSecretRef(v.String()) {
+			continue
+		}
+		plaintext, err := resolveWithRetry(ctx, resolve, v.String())
+		if errors.Is(err, errCfgBadSecretRef) {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", name, err)
+		}
+		v.SetString(plaintext)
+		elog.Info("Resolved secret reference.", "field", name)
+	}
+	return nil
+}
+
+// resolveWithRetry resolves the given secret reference using the given
+// function, and registers the plaintext for redaction.  Unless the reference
+// is malformed, we retry until the given context expires.
+func resolveWithRetry(
+	ctx context.Context,
+	resolve func(context.Context, string) (string, error),
+	ref string,
+) (string, error) {
+	for {
+		plaintext, err := resolve(ctx, ref)
+		if err == nil {
+			registerSecret(plaintext)
+			return plaintext, nil
+		}
+		if errors.Is(err, errCfgBadSecretRef) {
+			return "", err
+		}
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(secretRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockAWS starts a Web server that mimics the instance metadata service and
+// Secrets Manager, and points our AWS clients to it.  See mockKMS for KMS.
+func mockAWS(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("imds-token"))
+	})
+	mux.HandleFunc("/latest/meta-data/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/latest/meta-data/") {
+		case "placement/region":
+			_, _ = w.Write([]byte("us-east-2"))
+		case "iam/security-credentials/":
+			_, _ = w.Write([]byte("enclave-role"))
+		case "iam/security-credentials/enclave-role":
+			_, _ = w.Write([]byte(`{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"token"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	mux.HandleFunc("/aws/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), awsSigAlgorithm+" Credential=AKID/") ||
+			r.Header.Get("X-Amz-Security-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var in map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		switch r.Header.Get("X-Amz-Target") {
+		case "secretsmanager.GetSecretValue":
+			if in["SecretId"] != "prod/token" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(`{"SecretString":"asm-plaintext"}`))
+		}
+	})
+	srv := httptest.NewServer(mux)
+
+	origIMDS, origEndpoint := imdsURL, awsEndpoint
+	imdsURL = srv.URL + "/latest"
+	awsEndpoint = func(service, region string) string {
+		return srv.URL + "/aws/" + service + "/" + region
+	}
+	t.Cleanup(func() {
+		imdsURL, awsEndpoint = origIMDS, origEndpoint
+		srv.Close()
+	})
+}
+
+func TestParseSecretRef(t *testing.T) {
+	ref, err := parseSecretRef("asm://arn:aws:secretsmanager:us-east-2:123:secret:foo?region=us-east-2")
+	failOnErr(t, err)
+	assertEqual(t, ref.scheme, schemeASM)
+	assertEqual(t, ref.value, "arn:aws:secretsmanager:us-east-2:123:secret:foo")
+	assertEqual(t, ref.region, "us-east-2")
+
+	for _, invalid := range []string{
+		"foo://bar",
+		"asm://",
+		"kms://not base64!",
+	} {
+		if _, err := parseSecretRef(invalid); !errors.Is(err, errCfgBadSecretRef) {
+			t.Fatalf("Expected error %v for %q but got %v.", errCfgBadSecretRef, invalid, err)
+		}
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	mockAWS(t)
+	ctx := context.Background()
+	resolve := func(ctx context.Context, ref string) (string, error) {
+		return resolveSecret(ctx, new(recipientAttester), new(AttestationHashes), ref)
+	}
+
+	plaintext, err := resolve(ctx, "asm://prod/token")
+	failOnErr(t, err)
+	assertEqual(t, plaintext, "asm-plaintext")
+
+	if _, err = resolve(ctx, "asm://does-not-exist"); !errors.Is(err, errAWSResponse) {
+		t.Fatalf("Expected error %v but got %v.", errAWSResponse, err)
+	}
+
+	// Only fields that are tagged as secret are resolved.
+	c := &Config{IntAuthToken: "asm://prod/token", FQDN: "asm://prod/token"}
+	failOnErr(t, c.resolveSecrets(ctx, resolve))
+	assertEqual(t, c.IntAuthToken, "asm-plaintext")
+	assertEqual(t, c.FQDN, "asm://prod/token")
+
+	// Malformed references must fail validation.
+	c = &Config{IntAuthToken: "kms://"}
+	if err := c.validateSecretRefs(); !errors.Is(err, errCfgBadSecretRef) {
+		t.Fatalf("Expected error %v but got %v.", errCfgBadSecretRef, err)
+	}
+}
+
+func TestResolveKMSSecret(t *testing.T) {
+	a := new(recipientAttester)
+	mockKMS(t, a)
+
+	// We decrypt KMS ciphertexts as the recipient of an attestation document,
+	// which mockKMS insists on.
+	ref := "kms://" + base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	plaintext, err := resolveSecret(context.Background(), a, new(AttestationHashes), ref)
+	failOnErr(t, err)
+	assertEqual(t, plaintext, "decrypted")
+	assertEqual(t, len(a.publicKey) > 0, true)
+}
+
+func TestResolveSecretsTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c := &Config{IntAuthToken: "asm://foo"}
+	errUnreachable := errors.New("unreachable")
+	err := c.resolveSecrets(ctx, func(context.Context, string) (string, error) {
+		return "", errUnreachable
+	})
+	if !errors.Is(err, errUnreachable) {
+		t.Fatalf("Expected error %v but got %v.", errUnreachable, err)
+	}
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	// The "get-vanilla" test vector of AWS's Signature Version 4 test suite.
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	failOnErr(t, err)
+	creds := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWSRequest(req, nil, creds, "us-east-1", "service", now)
+
+	assertEqual(t, req.Header.Get("Authorization"),
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, "+
+			"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// The steps of our graceful shutdown.
+	shutdownDrain = "drain" // We drain our public connections.
+	shutdownApp   = "app"   // We stop the enclave application.
+	shutdownWipe  = "wipe"  // We wipe our key material.
+
+	defaultDrainTimeout = 5 * time.Second
+	// shutdownSlack is the time that we allow for shutting down our remaining
+	// Web servers after the configured shutdown steps.
+	shutdownSlack = 5 * time.Second
+)
+
+var (
+	errCfgBadShutdownSeq     = errors.New("given config has invalid shutdown sequence")
+	errCfgBadShutdownTimeout = errors.New("given config has negative shutdown timeout")
+
+	defaultShutdownSequence = []string{shutdownDrain, shutdownApp, shutdownWipe}
+)
+
+// validateShutdown returns an error if the config's shutdown sequence doesn't
+// consist of each shutdown step exactly once, or if its timeouts are
+// negative.  We don't let the sequence skip wiping our key material.
+func (c *Config) validateShutdown() error {
+	if c.DrainTimeout < 0 || c.AppStopTimeout < 0 {
+		return errCfgBadShutdownTimeout
+	}
+	if len(c.ShutdownSequence) == 0 {
+		return nil
+	}
+	steps := map[string]bool{shutdownDrain: false, shutdownApp: false, shutdownWipe: false}
+	for _, s := range c.ShutdownSequence {
+		seen, known := steps[s]
+		if !known || seen {
+			return fmt.Errorf("%w: unknown or repeated step %q", errCfgBadShutdownSeq, s)
+		}
+		steps[s] = true
+	}
+	if len(c.ShutdownSequence) != len(steps) {
+		return fmt.Errorf("%w: must contain %s, %s, and %s",
+			errCfgBadShutdownSeq, shutdownDrain, shutdownApp, shutdownWipe)
+	}
+	return nil
+}
+
+// shutdownTimeout returns how long our graceful shutdown may take in total.
+func (c *Config) shutdownTimeout() time.Duration {
+	return c.DrainTimeout + c.AppStopTimeout + shutdownSlack
+}
+
+// drain stops our public Web server from accepting new connections, and waits
+// for in-flight requests until the drain timeout, after which we close the
+// remaining connections.
+func (e *Enclave) drain(ctx context.Context) error {
+	elog.Info("Draining public connections.", "timeout", e.cfg.DrainTimeout)
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.DrainTimeout)
+	defer cancel()
+
+	err := e.extPubSrv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		elog.Warn("Public connections didn't drain in time.  Closing them.")
+		return e.extPubSrv.Close()
+	}
+	return err
+}
+
+// stopApp asks the enclave application to exit, and waits until it did.  The
+// supervisor kills the application if it doesn't exit within the configured
+// timeout.
+func (e *Enclave) stopApp(ctx context.Context) error {
+	e.appStopOnce.Do(func() {
+		close(e.appStop)
+	})
+	if e.appExited == nil {
+		return nil
+	}
+	select {
+	case <-e.appExited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// requestShutdown asks whoever runs the enclave -- usually our main function
+// -- to shut it down gracefully.  It is safe to call requestShutdown more than
+// once.
+func (e *Enclave) requestShutdown() {
+	e.shutdownReqOnce.Do(func() {
+		close(e.shutdownReq)
+	})
+}
+
+// shutdownHandler returns an HTTP handler that requests a graceful shutdown
+// of the enclave, which lets the enclave application or in-enclave
+// orchestration restart the enclave without killing nitriding.  The handler
+// responds before the shutdown begins because the shutdown waits for
+// in-flight requests to our internal Web server, including this one.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func shutdownHandler(e *Enclave) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		elog.Info("Shutdown requested via internal API.")
+		e.requestShutdown()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Stop shuts down the enclave in the steps of our shutdown sequence, which
+// drains our public connections, stops the enclave application, and wipes our
+// key material -- in that order unless the config says otherwise.  We shut
+// down our remaining Web servers last because the application may talk to our
+// enclave-internal Web server while it shuts down.  It is safe to call Stop
+// more than once.
+func (e *Enclave) Stop(ctx context.Context) error {
+	var errs []error
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+	for _, step := range e.cfg.ShutdownSequence {
+		var err error
+		switch step {
+		case shutdownDrain:
+			err = e.drain(ctx)
+		case shutdownApp:
+			err = e.stopApp(ctx)
+		case shutdownWipe:
+			e.WipeKeyMaterial()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shutdown step %s: %w", step, err))
+		}
+	}
+	for _, srv := range []*http.Server{e.intSrv, e.grpcSrv, e.extPrivSrv, e.promSrv} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Ship the log records of our shutdown before we return.
+	if err := stopLogShipper(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush logs: %w", err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidateShutdown(t *testing.T) {
+	c := &Config{}
+	failOnErr(t, c.validateShutdown())
+	c.ShutdownSequence = []string{shutdownWipe, shutdownApp, shutdownDrain}
+	failOnErr(t, c.validateShutdown())
+
+	for _, seq := range [][]string{
+		{shutdownDrain, shutdownApp},              // Doesn't wipe.
+		{shutdownDrain, shutdownApp, shutdownApp}, // Repeated step.
+		{shutdownDrain, shutdownApp, "exit"},      // Unknown step.
+		{shutdownDrain, shutdownApp, shutdownWipe, shutdownWipe},
+	} {
+		c.ShutdownSequence = seq
+		if err := c.validateShutdown(); !errors.Is(err, errCfgBadShutdownSeq) {
+			t.Fatalf("Expected error %v for %v but got %v.", errCfgBadShutdownSeq, seq, err)
+		}
+	}
+
+	c = &Config{DrainTimeout: -time.Second}
+	assertEqual(t, c.validateShutdown(), errCfgBadShutdownTimeout)
+}
+
+func TestDrain(t *testing.T) {
+	c := defaultCfg
+	c.DrainTimeout = 100 * time.Millisecond
+	e := createEnclave(&c)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	failOnErr(t, err)
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	e.extPubSrv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})
+	go func() { _ = e.extPubSrv.Serve(l) }()
+
+	reqErr := make(chan error)
+	go func() {
+		_, err := http.Get("http://" + l.Addr().String())
+		reqErr <- err
+	}()
+	<-entered
+
+	// The stuck request must not hold up our shutdown.
+	failOnErr(t, e.drain(context.Background()))
+	select {
+	case err := <-reqErr:
+		assertEqual(t, err != nil, true)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Draining didn't close the stuck connection.")
+	}
+}
+
+func TestStopSequence(t *testing.T) {
+	c := defaultCfg
+	c.ShutdownSequence = []string{shutdownWipe, shutdownDrain, shutdownApp}
+	e := createEnclave(&c)
+	e.keys.set(newTestKeys(t))
+
+	failOnErr(t, e.Stop(context.Background()))
+	assertEqual(t, e.keys.getAppKeys() == nil, true)
+	// Without an application, stopping it is a no-op.
+	failOnErr(t, e.stopApp(context.Background()))
+}
+
+func TestShutdownHandler(t *testing.T) {
+	// Without an auth token, there's no shutdown endpoint.
+	e := createEnclave(&defaultCfg)
+	resp := makeReqToSrv(e.intSrv)(http.MethodPost, pathShutdown, nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotFound)
+
+	c := defaultCfg
+	c.IntAuthToken = "secret"
+	e = createEnclave(&c)
+	makeReq := func(token string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, pathShutdown, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.intSrv.Handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	assertEqual(t, makeReq("wrong").StatusCode, http.StatusUnauthorized)
+	select {
+	case <-e.shutdownReq:
+		t.Fatal("Expected no shutdown request.")
+	default:
+	}
+
+	// Repeated requests must not panic.
+	for i := 0; i < 2; i++ {
+		assertEqual(t, makeReq("secret").StatusCode, http.StatusAccepted)
+	}
+	select {
+	case <-e.shutdownReq:
+	default:
+		t.Fatal("Expected shutdown request.")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	errCfgBadSigstore   = errors.New("given config has incomplete or invalid Sigstore settings")
+	errSigstoreBundle   = errors.New("malformed Sigstore bundle")
+	errSigstoreIdentity = errors.New("signing certificate doesn't match the expected identity")
+	errSigstoreSig      = errors.New("signature doesn't match the artifact")
+	errSigstoreTlog     = errors.New("transparency log entry doesn't match or isn't signed by Rekor")
+
+	// The extensions of Fulcio certificates that contain the OIDC issuer of
+	// the signer's identity: the original one contains the raw issuer, and
+	// its successor a DER-encoded UTF8String.
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// sigstoreBundle is the part of a Sigstore bundle -- as created by, e.g.,
+// "cosign sign-blob --bundle" -- that we verify.  Bundles up to version 0.2
+// contain a certificate chain, and later versions only the leaf certificate.
+type sigstoreBundle struct {
+	VerificationMaterial struct {
+		X509CertificateChain *struct {
+			Certificates []struct {
+				RawBytes []byte `json:"rawBytes"`
+			} `json:"certificates"`
+		} `json:"x509CertificateChain"`
+		Certificate *struct {
+			RawBytes []byte `json:"rawBytes"`
+		} `json:"certificate"`
+		TlogEntries []struct {
+			LogIndex string `json:"logIndex"`
+			LogID    struct {
+				KeyID []byte `json:"keyId"`
+			} `json:"logId"`
+			IntegratedTime   string `json:"integratedTime"`
+			InclusionPromise *struct {
+				SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+			} `json:"inclusionPromise"`
+			CanonicalizedBody []byte `json:"canonicalizedBody"`
+		} `json:"tlogEntries"`
+	} `json:"verificationMaterial"`
+	MessageSignature *struct {
+		MessageDigest struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+}
+
+// hashedRekord is the body of a Rekor entry of kind "hashedrekord".
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// sigstorePolicy determines who must have signed an artifact.
+type sigstorePolicy struct {
+	identity      string // The certificate's email address or URI.
+	issuer        string // The OIDC issuer that vouched for the identity.
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+	rekorKey      *ecdsa.PublicKey
+	rekorKeyID    []byte
+}
+
+// newSigstorePolicy returns the policy that the given config specifies.
+func newSigstorePolicy(c *Config) (*sigstorePolicy, error) {
+	p := &sigstorePolicy{
+		identity:      c.SigstoreIdentity,
+		issuer:        c.SigstoreIssuer,
+		roots:         x509.NewCertPool(),
+		intermediates: x509.NewCertPool(),
+	}
+	rest := []byte(c.SigstoreRoots)
+	var n int
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad Fulcio certificate: %v", errCfgBadSigstore, err)
+		}
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			p.roots.AddCert(cert)
+		} else {
+			p.intermediates.AddCert(cert)
+		}
+		n++
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w: no Fulcio certificates", errCfgBadSigstore)
+	}
+
+	block, _ := pem.Decode([]byte(c.SigstoreRekorKey))
+	if block == nil {
+		return nil, fmt.Errorf("%w: no Rekor public key", errCfgBadSigstore)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad Rekor public key: %v", errCfgBadSigstore, err)
+	}
+	var ok bool
+	if p.rekorKey, ok = pub.(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("%w: Rekor public key is not an ECDSA key", errCfgBadSigstore)
+	}
+	// Rekor's log ID is the SHA-256 hash over its DER-encoded public key.
+	keyID := sha256.Sum256(block.Bytes)
+	p.rekorKeyID = keyID[:]
+	return p, nil
+}
+
+// validateSigstore returns an error if the config asks us to verify the
+// enclave application's signature but lacks parts of the policy.
+func (c *Config) validateSigstore() error {
+	if c.SigstoreBundle == "" {
+		return nil
+	}
+	if c.SigstoreArtifact == "" || c.SigstoreIdentity == "" || c.SigstoreIssuer == "" {
+		return fmt.Errorf("%w: artifact, identity, and issuer are required", errCfgBadSigstore)
+	}
+	_, err := newSigstorePolicy(c)
+	return err
+}
+
+// certIssuer returns the OIDC issuer in the given Fulcio certificate.
+func certIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidFulcioIssuerV2) {
+			var issuer string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &issuer, "utf8"); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidFulcioIssuer) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// certHasIdentity returns true if the given certificate was issued for the
+// given identity.
+func certHasIdentity(cert *x509.Certificate, identity string) bool {
+	for _, email := range cert.EmailAddresses {
+		if email == identity {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// verify verifies that the given bundle contains a signature over the
+// artifact with the given SHA-256 digest, by a certificate that Fulcio issued
+// for our identity, and that Rekor logged the signature while the
+// certificate was valid.  We rely on Rekor's signed promise of inclusion
+// rather than an inclusion proof, like cosign does for offline verification.
+func (p *sigstorePolicy) verify(b *sigstoreBundle, digest [sha256.Size]byte) error {
+	vm := &b.VerificationMaterial
+	var certs [][]byte
+	switch {
+	case vm.Certificate != nil:
+		certs = [][]byte{vm.Certificate.RawBytes}
+	case vm.X509CertificateChain != nil:
+		for _, c := range vm.X509CertificateChain.Certificates {
+			certs = append(certs, c.RawBytes)
+		}
+	}
+	if len(certs) == 0 || b.MessageSignature == nil || len(vm.TlogEntries) == 0 {
+		return fmt.Errorf("%w: lacks certificate, signature, or transparency log entry", errSigstoreBundle)
+	}
+	leaf, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSigstoreBundle, err)
+	}
+	sig := b.MessageSignature
+
+	// The signature must cover our artifact.
+	if sig.MessageDigest.Algorithm != "SHA2_256" || !bytes.Equal(sig.MessageDigest.Digest, digest[:]) {
+		return errSigstoreSig
+	}
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !ecdsa.VerifyASN1(pub, digest[:], sig.Signature) {
+		return errSigstoreSig
+	}
+
+	// Rekor must have promised to log the signature.
+	tlog := vm.TlogEntries[0]
+	if tlog.InclusionPromise == nil || !bytes.Equal(tlog.LogID.KeyID, p.rekorKeyID) {
+		return errSigstoreTlog
+	}
+	integratedTime, err1 := strconv.ParseInt(tlog.IntegratedTime, 10, 64)
+	logIndex, err2 := strconv.ParseInt(tlog.LogIndex, 10, 64)
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("%w: bad integrated time or log index", errSigstoreBundle)
+	}
+	// Marshalling a map sorts its keys, which yields the canonical JSON that
+	// Rekor signs.
+	payload, _ := json.Marshal(map[string]any{
+		"body":           base64.StdEncoding.EncodeToString(tlog.CanonicalizedBody),
+		"integratedTime": integratedTime,
+		"logID":          hex.EncodeToString(tlog.LogID.KeyID),
+		"logIndex":       logIndex,
+	})
+	setDigest := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(p.rekorKey, setDigest[:], tlog.InclusionPromise.SignedEntryTimestamp) {
+		return errSigstoreTlog
+	}
+	var body hashedRekord
+	if err := json.Unmarshal(tlog.CanonicalizedBody, &body); err != nil || body.Kind != "hashedrekord" {
+		return errSigstoreTlog
+	}
+	logged, _ := pem.Decode(body.Spec.Signature.PublicKey.Content)
+	if body.Spec.Data.Hash.Algorithm != "sha256" ||
+		body.Spec.Data.Hash.Value != hex.EncodeToString(digest[:]) ||
+		!bytes.Equal(body.Spec.Signature.Content, sig.Signature) ||
+		logged == nil || !bytes.Equal(logged.Bytes, leaf.Raw) {
+		return errSigstoreTlog
+	}
+
+	// The short-lived certificate must have been valid when Rekor logged the
+	// signature, and must belong to our identity.
+	intermediates := p.intermediates.Clone()
+	for _, der := range certs[1:] {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(cert)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Unix(integratedTime, 0),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("%w: %v", errSigstoreIdentity, err)
+	}
+	if !certHasIdentity(leaf, p.identity) {
+		return fmt.Errorf("%w: certificate lacks identity %s", errSigstoreIdentity, p.identity)
+	}
+	if issuer := certIssuer(leaf); issuer != p.issuer {
+		return fmt.Errorf("%w: issuer is %q", errSigstoreIdentity, issuer)
+	}
+	return nil
+}
+
+// verifyAppSignature verifies the Sigstore bundle of the artifact -- e.g.,
+// the enclave application's binary or manifest -- that the config refers to,
+// and adds the artifact's hash to our attestation documents' data hash, so
+// verifiers learn what we verified.  Nitriding verifies the artifact before
+// it starts its Web servers, and therefore before it proxies requests to the
+// enclave application.
+func (e *Enclave) verifyAppSignature() error {
+	p, err := newSigstorePolicy(e.cfg)
+	if err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(e.cfg.SigstoreBundle)
+	if err != nil {
+		return err
+	}
+	var b sigstoreBundle
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return fmt.Errorf("%w: %v", errSigstoreBundle, err)
+	}
+	f, err := os.Open(e.cfg.SigstoreArtifact)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+
+	if err := p.verify(&b, digest); err != nil {
+		return err
+	}
+	e.hashes.addDataHash(digest)
+	elog.Info("Verified Sigstore signature of enclave application.",
+		"artifact", e.cfg.SigstoreArtifact,
+		"sha256", hex.EncodeToString(digest[:]),
+		"identity", p.identity)
+	return nil
+}
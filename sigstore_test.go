@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	sigstoreTestIdentity = "release@example.com"
+	sigstoreTestIssuer   = "https://accounts.example.com"
+)
+
+// sigstoreFixture contains a fake Fulcio CA and Rekor instance, and signs
+// artifacts the way cosign does.
+type sigstoreFixture struct {
+	caKey, rekorKey *ecdsa.PrivateKey
+	ca              *x509.Certificate
+	roots, rekorPEM string
+}
+
+func newSigstoreFixture(t *testing.T) *sigstoreFixture {
+	t.Helper()
+	f := &sigstoreFixture{}
+	var err error
+	f.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	failOnErr(t, err)
+	f.rekorKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	failOnErr(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &f.caKey.PublicKey, f.caKey)
+	failOnErr(t, err)
+	f.ca, err = x509.ParseCertificate(der)
+	failOnErr(t, err)
+	f.roots = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	pub, err := x509.MarshalPKIXPublicKey(&f.rekorKey.PublicKey)
+	failOnErr(t, err)
+	f.rekorPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	return f
+}
+
+func (f *sigstoreFixture) cfg(bundle, artifact string) *Config {
+	return &Config{
+		SigstoreBundle:   bundle,
+		SigstoreArtifact: artifact,
+		SigstoreIdentity: sigstoreTestIdentity,
+		SigstoreIssuer:   sigstoreTestIssuer,
+		SigstoreRoots:    f.roots,
+		SigstoreRekorKey: f.rekorPEM,
+	}
+}
+
+// sign returns a bundle over the given artifact, signed by a certificate for
+// the given identity and issuer.
+func (f *sigstoreFixture) sign(t *testing.T, artifact []byte, identity, issuer string) *sigstoreBundle {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	failOnErr(t, err)
+	issuerExt, err := asn1.MarshalWithParams(issuer, "utf8")
+	failOnErr(t, err)
+	leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		EmailAddresses:  []string{identity},
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{{Id: oidFulcioIssuerV2, Value: issuerExt}},
+	}, f.ca, &key.PublicKey, f.caKey)
+	failOnErr(t, err)
+
+	digest := sha256.Sum256(artifact)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	failOnErr(t, err)
+
+	var rekord hashedRekord
+	rekord.Kind = "hashedrekord"
+	rekord.Spec.Data.Hash.Algorithm = "sha256"
+	rekord.Spec.Data.Hash.Value = hex.EncodeToString(digest[:])
+	rekord.Spec.Signature.Content = sig
+	rekord.Spec.Signature.PublicKey.Content = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+	body, err := json.Marshal(&rekord)
+	failOnErr(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&f.rekorKey.PublicKey)
+	failOnErr(t, err)
+	logID := sha256.Sum256(pub)
+	integratedTime := time.Now().Unix()
+	payload, err := json.Marshal(map[string]any{
+		"body":           base64.StdEncoding.EncodeToString(body),
+		"integratedTime": integratedTime,
+		"logID":          hex.EncodeToString(logID[:]),
+		"logIndex":       42,
+	})
+	failOnErr(t, err)
+	setDigest := sha256.Sum256(payload)
+	set, err := ecdsa.SignASN1(rand.Reader, f.rekorKey, setDigest[:])
+	failOnErr(t, err)
+
+	raw, err := json.Marshal(map[string]any{
+		"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+		"verificationMaterial": map[string]any{
+			"certificate": map[string]any{"rawBytes": leaf},
+			"tlogEntries": []any{map[string]any{
+				"logIndex":          "42",
+				"logId":             map[string]any{"keyId": logID[:]},
+				"kindVersion":       map[string]any{"kind": "hashedrekord", "version": "0.0.1"},
+				"integratedTime":    strconv.FormatInt(integratedTime, 10),
+				"inclusionPromise":  map[string]any{"signedEntryTimestamp": set},
+				"canonicalizedBody": body,
+			}},
+		},
+		"messageSignature": map[string]any{
+			"messageDigest": map[string]any{"algorithm": "SHA2_256", "digest": digest[:]},
+			"signature":     sig,
+		},
+	})
+	failOnErr(t, err)
+	var b sigstoreBundle
+	failOnErr(t, json.Unmarshal(raw, &b))
+	return &b
+}
+
+func TestValidateSigstore(t *testing.T) {
+	f := newSigstoreFixture(t)
+	c := f.cfg("bundle.json", "/bin/app")
+	failOnErr(t, c.validateSigstore())
+	failOnErr(t, (&Config{}).validateSigstore())
+
+	c.SigstoreIssuer = ""
+	assertEqual(t, errors.Is(c.validateSigstore(), errCfgBadSigstore), true)
+	c = f.cfg("bundle.json", "/bin/app")
+	c.SigstoreRekorKey = f.roots
+	assertEqual(t, errors.Is(c.validateSigstore(), errCfgBadSigstore), true)
+	c = f.cfg("bundle.json", "/bin/app")
+	c.SigstoreRoots = "foo"
+	assertEqual(t, errors.Is(c.validateSigstore(), errCfgBadSigstore), true)
+}
+
+func TestSigstoreVerify(t *testing.T) {
+	f := newSigstoreFixture(t)
+	p, err := newSigstorePolicy(f.cfg("bundle.json", "/bin/app"))
+	failOnErr(t, err)
+	artifact := []byte("enclave application")
+	digest := sha256.Sum256(artifact)
+
+	failOnErr(t, p.verify(f.sign(t, artifact, sigstoreTestIdentity, sigstoreTestIssuer), digest))
+
+	b := f.sign(t, artifact, "mallory@example.com", sigstoreTestIssuer)
+	assertEqual(t, errors.Is(p.verify(b, digest), errSigstoreIdentity), true)
+
+	b = f.sign(t, artifact, sigstoreTestIdentity, "https://evil.example.com")
+	assertEqual(t, errors.Is(p.verify(b, digest), errSigstoreIdentity), true)
+
+	b = f.sign(t, artifact, sigstoreTestIdentity, sigstoreTestIssuer)
+	assertEqual(t, errors.Is(p.verify(b, sha256.Sum256([]byte("tampered"))), errSigstoreSig), true)
+
+	b = f.sign(t, artifact, sigstoreTestIdentity, sigstoreTestIssuer)
+	b.VerificationMaterial.TlogEntries[0].LogIndex = "43"
+	assertEqual(t, errors.Is(p.verify(b, digest), errSigstoreTlog), true)
+
+	b = f.sign(t, artifact, sigstoreTestIdentity, sigstoreTestIssuer)
+	b.VerificationMaterial.TlogEntries[0].InclusionPromise = nil
+	assertEqual(t, errors.Is(p.verify(b, digest), errSigstoreTlog), true)
+}
+
+func TestVerifyAppSignature(t *testing.T) {
+	f := newSigstoreFixture(t)
+	dir := t.TempDir()
+	artifact := []byte("enclave application")
+	artifactPath := filepath.Join(dir, "app")
+	bundlePath := filepath.Join(dir, "app.sigstore.json")
+	failOnErr(t, os.WriteFile(artifactPath, artifact, 0o600))
+	raw, err := json.Marshal(f.sign(t, artifact, sigstoreTestIdentity, sigstoreTestIssuer))
+	failOnErr(t, err)
+	failOnErr(t, os.WriteFile(bundlePath, raw, 0o600))
+
+	c := defaultCfg
+	sc := f.cfg(bundlePath, artifactPath)
+	c.SigstoreBundle, c.SigstoreArtifact = sc.SigstoreBundle, sc.SigstoreArtifact
+	c.SigstoreIdentity, c.SigstoreIssuer = sc.SigstoreIdentity, sc.SigstoreIssuer
+	c.SigstoreRoots, c.SigstoreRekorKey = sc.SigstoreRoots, sc.SigstoreRekorKey
+	e := createEnclave(&c)
+	failOnErr(t, e.verifyAppSignature())
+
+	var zero [sha256.Size]byte
+	digest := sha256.Sum256(artifact)
+	assertEqual(t, e.hashes.hasData, true)
+	assertEqual(t, e.hashes.dataHash, sha256.Sum256(append(zero[:], digest[:]...)))
+
+	// Verification must fail once the artifact changes.
+	failOnErr(t, os.WriteFile(artifactPath, []byte("tampered"), 0o600))
+	assertEqual(t, errors.Is(e.verifyAppSignature(), errSigstoreSig), true)
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// We obtain an X.509 SVID (a SPIFFE verifiable identity document) by
+// attesting to a SPIRE server like a SPIRE agent does: we call the server's
+// AttestAgent RPC with an attestation document, which the server's node
+// attestor plugin of type "aws_nitro" verifies and maps to a SPIFFE ID.  The
+// attestation document contains the public key of our CSR, so the EC2 host
+// cannot obtain an SVID for its own key.  We don't depend on gRPC, so we
+// speak its wire format over HTTP/2 and encode the few protobuf messages that
+// we need by hand.  See:
+// https://github.com/spiffe/spire-api-sdk/blob/main/proto/spire/api/server/agent/v1/agent.proto
+const (
+	spireAttestorType    = "aws_nitro"
+	spireAttestAgentPath = "/spire.api.server.agent.v1.Agent/AttestAgent"
+	spireTimeout         = 30 * time.Second
+	spireRetryInterval   = 10 * time.Second
+	// The maximum length of gRPC messages that we accept from SPIRE.
+	maxSpireMsgLen = 1024 * 1024
+
+	protoWireVarint = 0
+	protoWireBytes  = 2
+)
+
+var (
+	errCfgBadSpire     = errors.New("given config has invalid SPIRE server, trust domain, or trust bundle")
+	errSpireNotReady   = errors.New("no SVID yet obtained from SPIRE")
+	errSpireResponse   = errors.New("SPIRE server returned an error")
+	errSpireBadMsg     = errors.New("malformed message from SPIRE server")
+	errSpireBadSVID    = errors.New("SVID from SPIRE server is invalid")
+	errSpireBadChall   = errors.New("SPIRE server's challenge is not a nonce")
+	errSpireServerCert = errors.New("SPIRE server's certificate is invalid")
+
+	trustDomainRegexp = regexp.MustCompile(`^[a-z0-9._-]+$`)
+)
+
+// validateSpire returns an error if the config's SPIRE server is set but
+// lacks a valid trust domain or trust bundle.
+func (c *Config) validateSpire() error {
+	if c.SpireServer == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.SpireServer); err != nil {
+		return fmt.Errorf("%w: %v", errCfgBadSpire, err)
+	}
+	if !trustDomainRegexp.MatchString(c.SpireTrustDomain) {
+		return fmt.Errorf("%w: bad trust domain %q", errCfgBadSpire, c.SpireTrustDomain)
+	}
+	if _, err := parseTrustBundle(c.SpireTrustBundle); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseTrustBundle returns the PEM-encoded certificates in the given trust
+// bundle.
+func parseTrustBundle(bundle string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(bundle)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCfgBadSpire, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w: trust bundle has no certificates", errCfgBadSpire)
+	}
+	return certs, nil
+}
+
+// protoField represents a decoded protobuf field.
+type protoField struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+// protoAppendBytes appends the given length-delimited field to the given
+// protobuf message.
+func protoAppendBytes(b []byte, num int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|protoWireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// protoDecode decodes the given protobuf message into its fields.  We only
+// support varints and length-delimited fields, which is all that SPIRE sends.
+func protoDecode(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errSpireBadMsg
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errSpireBadMsg
+		}
+		b = b[n:]
+		switch key & 7 {
+		case protoWireVarint:
+			f.varint = v
+		case protoWireBytes:
+			if v > uint64(len(b)) {
+				return nil, errSpireBadMsg
+			}
+			f.bytes, b = b[:v], b[v:]
+		default:
+			return nil, errSpireBadMsg
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// grpcFrame returns the given message in gRPC's length-prefixed framing: an
+// uncompressed flag followed by the message's big-endian length.
+func grpcFrame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...)
+}
+
+// readGRPCFrame reads a length-prefixed gRPC message from the given reader.
+func readGRPCFrame(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(hdr[1:])
+	if hdr[0] != 0 || l > maxSpireMsgLen {
+		return nil, errSpireBadMsg
+	}
+	msg := make([]byte, l)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// grpcError returns an error if the given header or trailer carries a gRPC
+// status other than OK.
+func grpcError(h http.Header) error {
+	status := h.Get("Grpc-Status")
+	if status == "" || status == "0" {
+		return nil
+	}
+	return fmt.Errorf("%w: status %s: %s", errSpireResponse, status, h.Get("Grpc-Message"))
+}
+
+// svid is an X.509 SVID and its private key.
+type svid struct {
+	id        string
+	chain     []*x509.Certificate
+	key       *ecdsa.PrivateKey
+	expiresAt time.Time
+}
+
+// svidInfo is the JSON representation of our SVID.
+type svidInfo struct {
+	SPIFFEID   string    `json:"spiffe_id"`
+	CertChain  string    `json:"cert_chain"`
+	PrivateKey string    `json:"private_key"`
+	Bundle     string    `json:"bundle"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// spireAgent obtains and renews an X.509 SVID from a SPIRE server, which
+// bridges the enclave's measurements to a standard workload identity.
+type spireAgent struct {
+	sync.RWMutex
+	server      string
+	trustDomain string
+	bundle      []*x509.Certificate
+	roots       *x509.CertPool
+	a           attester
+	hashes      *AttestationHashes
+	client      *http.Client
+	svid        *svid // Nil until attested.
+}
+
+// newSpireAgent returns a new spireAgent for the given config, which must be
+// valid.
+func newSpireAgent(c *Config, a attester, hashes *AttestationHashes) *spireAgent {
+	bundle, _ := parseTrustBundle(c.SpireTrustBundle)
+	s := &spireAgent{
+		server:      c.SpireServer,
+		trustDomain: c.SpireTrustDomain,
+		bundle:      bundle,
+		roots:       x509.NewCertPool(),
+		a:           a,
+		hashes:      hashes,
+	}
+	for _, cert := range bundle {
+		s.roots.AddCert(cert)
+	}
+	s.client = &http.Client{
+		Timeout: spireTimeout,
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				// The server's certificate contains a SPIFFE ID rather than
+				// a host name, so we verify it ourselves.
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: s.verifyServer,
+			},
+		},
+	}
+	return s
+}
+
+// verifyChain verifies the given DER-encoded certificate chain against our
+// trust bundle, and returns the parsed chain if the leaf certificate's SPIFFE
+// ID is the given ID.  An empty ID matches any ID in our trust domain.
+func (s *spireAgent) verifyChain(rawCerts [][]byte, id string) ([]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	intermediates := x509.NewCertPool()
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = cert
+		if i > 0 {
+			intermediates.AddCert(cert)
+		}
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         s.roots,
+		Intermediates: intermediates,
+		CurrentTime:   currentTime(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, err
+	}
+	if len(certs[0].URIs) != 1 {
+		return nil, errors.New("certificate must contain exactly one SPIFFE ID")
+	}
+	uri := certs[0].URIs[0]
+	if uri.Scheme != "spiffe" || uri.Host != s.trustDomain || (id != "" && uri.String() != id) {
+		return nil, fmt.Errorf("unexpected SPIFFE ID %s", uri)
+	}
+	return certs, nil
+}
+
+// verifyServer verifies that the SPIRE server presents the SVID of our trust
+// domain's server.
+func (s *spireAgent) verifyServer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if _, err := s.verifyChain(rawCerts, "spiffe://"+s.trustDomain+"/spire/server"); err != nil {
+		return fmt.Errorf("%w: %v", errSpireServerCert, err)
+	}
+	return nil
+}
+
+// attestationDoc returns an attestation document that contains the given nonce
+// and public key.
+func (s *spireAgent) attestationDoc(n nonce, pub []byte) ([]byte, error) {
+	return s.a.createAttstn(&clientAuxInfo{
+		clientNonce:       n,
+		attestationHashes: s.hashes.Serialize(),
+		publicKey:         pub,
+	})
+}
+
+// attest attests to the SPIRE server and returns the SVID that the server
+// issued.
+func (s *spireAgent) attest(ctx context.Context) (*svid, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	n, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := s.attestationDoc(n, pub)
+	if err != nil {
+		return nil, err
+	}
+
+	// AttestAgentRequest{params: {data: {type, payload}, params: {csr}}}
+	data := protoAppendBytes(protoAppendBytes(nil, 1, []byte(spireAttestorType)), 2, doc)
+	params := protoAppendBytes(protoAppendBytes(nil, 1, data), 2, protoAppendBytes(nil, 1, csr))
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		_, _ = pw.Write(grpcFrame(protoAppendBytes(nil, 1, params)))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+s.server+spireAttestAgentPath, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", errSpireResponse, resp.Status)
+	}
+	if err := grpcError(resp.Header); err != nil {
+		return nil, err
+	}
+
+	// The server either responds with a challenge, which we answer with a
+	// fresh attestation document, or with the result.
+	for {
+		msg, err := readGRPCFrame(resp.Body)
+		if errors.Is(err, io.EOF) {
+			if err := grpcError(resp.Trailer); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: stream ended without result", errSpireBadMsg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields, err := protoDecode(msg)
+		if err != nil || len(fields) != 1 {
+			return nil, errSpireBadMsg
+		}
+		switch fields[0].num {
+		case 1: // result
+			return s.parseResult(fields[0].bytes, key)
+		case 2: // challenge
+			if len(fields[0].bytes) != nonceLen {
+				return nil, errSpireBadChall
+			}
+			doc, err := s.attestationDoc(nonce(fields[0].bytes), pub)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := pw.Write(grpcFrame(protoAppendBytes(nil, 2, doc))); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errSpireBadMsg
+		}
+	}
+}
+
+// parseResult parses the given AttestAgentResponse.Result message, and
+// returns the SVID that it contains if it's valid for the given key.
+func (s *spireAgent) parseResult(result []byte, key *ecdsa.PrivateKey) (*svid, error) {
+	fields, err := protoDecode(result)
+	if err != nil {
+		return nil, err
+	}
+	var rawSVID []byte
+	for _, f := range fields {
+		if f.num == 1 {
+			rawSVID = f.bytes
+		}
+	}
+	// X509SVID{id: {trust_domain, path}, cert_chain (repeated), expires_at}
+	if fields, err = protoDecode(rawSVID); err != nil {
+		return nil, err
+	}
+	var (
+		rawCerts  [][]byte
+		expiresAt int64
+		id        string
+	)
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			idFields, err := protoDecode(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			var td, path string
+			for _, idf := range idFields {
+				switch idf.num {
+				case 1:
+					td = string(idf.bytes)
+				case 2:
+					path = string(idf.bytes)
+				}
+			}
+			id = "spiffe://" + td + path
+		case 2:
+			rawCerts = append(rawCerts, f.bytes)
+		case 3:
+			expiresAt = int64(f.varint)
+		}
+	}
+
+	chain, err := s.verifyChain(rawCerts, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSpireBadSVID, err)
+	}
+	if !key.PublicKey.Equal(chain[0].PublicKey) {
+		return nil, fmt.Errorf("%w: SVID is not for our key", errSpireBadSVID)
+	}
+	exp := chain[0].NotAfter
+	if expiresAt > 0 {
+		exp = time.Unix(expiresAt, 0).UTC()
+	}
+	return &svid{id: id, chain: chain, key: key, expiresAt: exp}, nil
+}
+
+// refresh obtains a new SVID.
+func (s *spireAgent) refresh(ctx context.Context) error {
+	svid, err := s.attest(ctx)
+	if err != nil {
+		return err
+	}
+	elog.Info("Obtained SVID from SPIRE.", "spiffe_id", svid.id, "expires", svid.expiresAt)
+
+	s.Lock()
+	defer s.Unlock()
+	s.svid = svid
+	return nil
+}
+
+// nextRefresh returns how long we wait until we refresh our SVID: after two
+// thirds of its lifetime, like SPIRE agents do.
+func (s *spireAgent) nextRefresh() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.svid == nil {
+		return spireRetryInterval
+	}
+	return max(time.Until(s.svid.expiresAt)*2/3, spireRetryInterval)
+}
+
+// info returns our current SVID, its private key, and our trust bundle.
+func (s *spireAgent) info() (*svidInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.svid == nil || currentTime().After(s.svid.expiresAt) {
+		return nil, errSpireNotReady
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(s.svid.key)
+	if err != nil {
+		return nil, err
+	}
+	var chain, bundle bytes.Buffer
+	for _, cert := range s.svid.chain {
+		_ = pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	for _, cert := range s.bundle {
+		_ = pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return &svidInfo{
+		SPIFFEID:   s.svid.id,
+		CertChain:  chain.String(),
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})),
+		Bundle:     bundle.String(),
+		ExpiresAt:  s.svid.expiresAt,
+	}, nil
+}
+
+// wipe forgets our SVID.
+func (s *spireAgent) wipe() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.svid = nil
+}
+
+// maintainSVID obtains an SVID from SPIRE and keeps renewing it until the
+// enclave stops.
+func (e *Enclave) maintainSVID() {
+	defer reportPanic()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), spireTimeout)
+		ctx, span := startSpan(ctx, "spire.attest_agent")
+		err := e.spire.refresh(ctx)
+		span.setError(err)
+		span.end()
+		cancel()
+
+		wait := e.spire.nextRefresh()
+		if err != nil {
+			elog.Warn("Failed to obtain SVID from SPIRE.", "server", e.spire.server, "error", err)
+			wait = spireRetryInterval
+		} else {
+			e.startup.markMet(appPrereqSVID)
+		}
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// svidHandler returns an HTTP handler that returns our X.509 SVID, its private
+// key, and the trust bundle, which the enclave application can use for mTLS
+// with services in the SPIFFE trust domain.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func svidHandler(s *spireAgent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, err := s.info()
+		if errors.Is(err, errSpireNotReady) {
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			elog.Error("Error encoding SVID.", "error", err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testSpiffeID = "spiffe://example.org/spire/agent/aws_nitro/i-123"
+
+// spireCA is a certificate authority for the trust domain "example.org".
+type spireCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	bundle string
+}
+
+// newSpireCA returns a new spireCA.
+func newSpireCA(t *testing.T) *spireCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	failOnErr(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	failOnErr(t, err)
+	cert, err := x509.ParseCertificate(der)
+	failOnErr(t, err)
+	return &spireCA{
+		cert:   cert,
+		key:    key,
+		bundle: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+// issue returns a DER-encoded certificate for the given public key and SPIFFE
+// ID.
+func (ca *spireCA) issue(t *testing.T, pub any, id string) []byte {
+	t.Helper()
+	uri, err := url.Parse(id)
+	failOnErr(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+	failOnErr(t, err)
+	return der
+}
+
+// mockSpire returns a SPIRE server that issues SVIDs to the attestation
+// documents of recipientAttester, after challenging them if challenge is set.
+// If foreignKey is set, the server issues SVIDs for a key other than the CSR's.
+func mockSpire(t *testing.T, ca *spireCA, a *recipientAttester, challenge, foreignKey bool) *httptest.Server {
+	t.Helper()
+	srvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	failOnErr(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		fail := func() { w.Header().Set("Grpc-Status", "7") }
+
+		// AttestAgentRequest{params: {data: {type, payload}, params: {csr}}}
+		msg, err := readGRPCFrame(r.Body)
+		failOnErr(t, err)
+		req, err := protoDecode(msg)
+		failOnErr(t, err)
+		params, err := protoDecode(req[0].bytes)
+		failOnErr(t, err)
+		data, err := protoDecode(params[0].bytes)
+		failOnErr(t, err)
+		csrParams, err := protoDecode(params[1].bytes)
+		failOnErr(t, err)
+		csr, err := x509.ParseCertificateRequest(csrParams[0].bytes)
+		failOnErr(t, err)
+		pub, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+		failOnErr(t, err)
+		if string(data[0].bytes) != spireAttestorType ||
+			string(data[1].bytes) != "attestation document" ||
+			!bytes.Equal(a.publicKey, pub) {
+			fail()
+			return
+		}
+
+		if challenge {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(grpcFrame(protoAppendBytes(nil, 2, make([]byte, nonceLen))))
+			w.(http.Flusher).Flush()
+			msg, err := readGRPCFrame(r.Body)
+			failOnErr(t, err)
+			resp, err := protoDecode(msg)
+			failOnErr(t, err)
+			if resp[0].num != 2 || string(resp[0].bytes) != "attestation document" {
+				fail()
+				return
+			}
+		}
+
+		certPub := csr.PublicKey
+		if foreignKey {
+			certPub = &srvKey.PublicKey
+		}
+		id := protoAppendBytes(protoAppendBytes(nil, 1, []byte("example.org")), 2, []byte("/spire/agent/aws_nitro/i-123"))
+		svid := protoAppendBytes(protoAppendBytes(nil, 1, id), 2, ca.issue(t, certPub, testSpiffeID))
+		svid = binary.AppendUvarint(append(svid, 3<<3|protoWireVarint), uint64(time.Now().Add(time.Hour).Unix()))
+		result := protoAppendBytes(nil, 1, svid)
+		_, _ = w.Write(grpcFrame(protoAppendBytes(nil, 1, result)))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{ca.issue(t, &srvKey.PublicKey, "spiffe://example.org/spire/server")},
+		PrivateKey:  srvKey,
+	}}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestValidateSpire(t *testing.T) {
+	ca := newSpireCA(t)
+	for _, c := range []Config{
+		{SpireServer: "spire", SpireTrustDomain: "example.org", SpireTrustBundle: ca.bundle},
+		{SpireServer: "spire:8081", SpireTrustDomain: "Example.org", SpireTrustBundle: ca.bundle},
+		{SpireServer: "spire:8081", SpireTrustDomain: "example.org"},
+	} {
+		if err := c.validateSpire(); !errors.Is(err, errCfgBadSpire) {
+			t.Fatalf("Expected error %v but got %v.", errCfgBadSpire, err)
+		}
+	}
+	failOnErr(t, (&Config{}).validateSpire())
+	failOnErr(t, (&Config{
+		SpireServer:      "spire:8081",
+		SpireTrustDomain: "example.org",
+		SpireTrustBundle: ca.bundle,
+	}).validateSpire())
+}
+
+func TestProtoDecode(t *testing.T) {
+	msg := protoAppendBytes(nil, 1, []byte("foo"))
+	msg = binary.AppendUvarint(append(msg, 3<<3|protoWireVarint), 300)
+	fields, err := protoDecode(msg)
+	failOnErr(t, err)
+	assertEqual(t, len(fields), 2)
+	assertEqual(t, fields[0].num, 1)
+	assertEqual(t, string(fields[0].bytes), "foo")
+	assertEqual(t, fields[1].num, 3)
+	assertEqual(t, fields[1].varint, uint64(300))
+
+	for _, b := range [][]byte{
+		{0x0a},             // Missing length.
+		{0x0a, 0x05, 'a'},  // Length exceeds input.
+		{0x0d, 0, 0, 0, 0}, // Fixed-size fields are unsupported.
+	} {
+		if _, err := protoDecode(b); !errors.Is(err, errSpireBadMsg) {
+			t.Fatalf("Expected error %v for %x but got %v.", errSpireBadMsg, b, err)
+		}
+	}
+}
+
+func TestSpireAgent(t *testing.T) {
+	ca := newSpireCA(t)
+	for _, challenge := range []bool{false, true} {
+		a := new(recipientAttester)
+		srv := mockSpire(t, ca, a, challenge, false)
+		s := newSpireAgent(&Config{
+			SpireServer:      srv.Listener.Addr().String(),
+			SpireTrustDomain: "example.org",
+			SpireTrustBundle: ca.bundle,
+		}, a, new(AttestationHashes))
+		makeReq := makeReqToHandler(svidHandler(s))
+
+		resp := makeReq(http.MethodGet, pathSVID, nil)
+		assertResponse(t, resp, newErrResp(http.StatusServiceUnavailable, errSpireNotReady))
+
+		failOnErr(t, s.refresh(context.Background()))
+		resp = makeReq(http.MethodGet, pathSVID, nil)
+		assertEqual(t, resp.StatusCode, http.StatusOK)
+		var info svidInfo
+		failOnErr(t, json.NewDecoder(resp.Body).Decode(&info))
+		assertEqual(t, info.SPIFFEID, testSpiffeID)
+		assertEqual(t, info.Bundle, ca.bundle)
+		_, err := tls.X509KeyPair([]byte(info.CertChain), []byte(info.PrivateKey))
+		failOnErr(t, err)
+
+		s.wipe()
+		resp = makeReq(http.MethodGet, pathSVID, nil)
+		assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestSpireAgentRejects(t *testing.T) {
+	ca := newSpireCA(t)
+	a := new(recipientAttester)
+
+	// The server issued an SVID for a key other than ours.
+	srv := mockSpire(t, ca, a, false, true)
+	cfg := &Config{
+		SpireServer:      srv.Listener.Addr().String(),
+		SpireTrustDomain: "example.org",
+		SpireTrustBundle: ca.bundle,
+	}
+	if err := newSpireAgent(cfg, a, new(AttestationHashes)).refresh(context.Background()); !errors.Is(err, errSpireBadSVID) {
+		t.Fatalf("Expected error %v but got %v.", errSpireBadSVID, err)
+	}
+
+	// The server's certificate is not part of our trust domain.
+	cfg.SpireTrustBundle = newSpireCA(t).bundle
+	if err := newSpireAgent(cfg, a, new(AttestationHashes)).refresh(context.Background()); err == nil {
+		t.Fatal("Expected error for untrusted SPIRE server.")
+	}
+	cfg.SpireTrustBundle = ca.bundle
+	cfg.SpireTrustDomain = "example.com"
+	if err := newSpireAgent(cfg, a, new(AttestationHashes)).refresh(context.Background()); err == nil {
+		t.Fatal("Expected error for SPIRE server of other trust domain.")
+	}
+}
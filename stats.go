@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// meminfoPath is the file that tells us about the enclave's memory.  Nitro
+// enclaves have a fixed memory allocation, so the total memory is also our
+// hard limit.
+var meminfoPath = "/proc/meminfo"
+
+// fdDirPath is the directory that contains one entry per file descriptor
+// that our process has open.
+var fdDirPath = "/proc/self/fd"
+
+// memoryStats describes the memory that's available to the enclave, in bytes.
+type memoryStats struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+}
+
+// fdStats describes our process's file descriptor usage and limits.
+type fdStats struct {
+	Open uint64 `json:"open"`
+	Soft uint64 `json:"soft_limit"`
+	Hard uint64 `json:"hard_limit"`
+}
+
+// runtimeStats holds runtime and memory statistics of the running nitriding
+// instance.
+type runtimeStats struct {
+	Goroutines   int          `json:"goroutines"`
+	GoMaxProcs   int          `json:"gomaxprocs"`
+	NumCPU       int          `json:"num_cpu"`
+	GoVersion    string       `json:"go_version"`
+	HeapAlloc    uint64       `json:"heap_alloc"`
+	HeapInuse    uint64       `json:"heap_inuse"`
+	HeapSys      uint64       `json:"heap_sys"`
+	HeapObjects  uint64       `json:"heap_objects"`
+	Sys          uint64       `json:"sys"`
+	NumGC        uint32       `json:"num_gc"`
+	GCPauseTotal string       `json:"gc_pause_total"`
+	LastGC       *time.Time   `json:"last_gc,omitempty"`
+	MemoryLimit  *int64       `json:"memory_limit,omitempty"`
+	Memory       *memoryStats `json:"memory,omitempty"`
+	Fds          *fdStats     `json:"file_descriptors,omitempty"`
+}
+
+// readMeminfo parses the total and available memory from the given file in
+// the format of /proc/meminfo.
+func readMeminfo(path string) (*memoryStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats := new(memoryStats)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Lines look like "MemTotal:        8056448 kB".
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dst *uint64
+		switch fields[0] {
+		case "MemTotal:":
+			dst = &stats.Total
+		case "MemAvailable:":
+			dst = &stats.Available
+		default:
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			n *= 1024
+		}
+		*dst = n
+	}
+	return stats, s.Err()
+}
+
+// readFdStats counts the entries of the given directory in the format of
+// /proc/self/fd, and returns them together with our file descriptor limits.
+func readFdStats(dir string) (*fdStats, error) {
+	var rLimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &fdStats{
+		Open: uint64(len(entries)),
+		Soft: rLimit.Cur,
+		Hard: rLimit.Max,
+	}, nil
+}
+
+// newRuntimeStats returns our current runtime and memory statistics.
+func newRuntimeStats() *runtimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := &runtimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		GoMaxProcs:   runtime.GOMAXPROCS(0),
+		NumCPU:       runtime.NumCPU(),
+		GoVersion:    runtime.Version(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapSys:      m.HeapSys,
+		HeapObjects:  m.HeapObjects,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		GCPauseTotal: time.Duration(m.PauseTotalNs).String(),
+	}
+	if m.LastGC != 0 {
+		lastGC := time.Unix(0, int64(m.LastGC)).UTC()
+		stats.LastGC = &lastGC
+	}
+	// A negative input returns the memory limit without changing it.  No
+	// limit is set unless it's below the maximum.
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		stats.MemoryLimit = &limit
+	}
+	if mem, err := readMeminfo(meminfoPath); err == nil {
+		stats.Memory = mem
+	}
+	if fds, err := readFdStats(fdDirPath); err == nil {
+		stats.Fds = fds
+	}
+	return stats
+}
+
+// statsHandler returns an HTTP handler that returns JSON-encoded runtime,
+// memory, and file descriptor statistics, which help operators anticipate
+// out-of-memory errors in the enclave's fixed memory allocation, and file
+// descriptor exhaustion.
+func statsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(newRuntimeStats()); err != nil {
+			elog.Error("Error encoding runtime stats.", "error", err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMeminfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meminfo")
+	failOnErr(t, os.WriteFile(path, []byte(
+		"MemTotal:        8056448 kB\n"+
+			"MemFree:         1234567 kB\n"+
+			"MemAvailable:    4028224 kB\n"), 0o600))
+
+	mem, err := readMeminfo(path)
+	failOnErr(t, err)
+	assertEqual(t, mem.Total, uint64(8056448*1024))
+	assertEqual(t, mem.Available, uint64(4028224*1024))
+
+	_, err = readMeminfo(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Fatal("Expected error for missing meminfo file.")
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meminfo")
+	failOnErr(t, os.WriteFile(path, []byte("MemTotal: 1024 kB\nMemAvailable: 512 kB\n"), 0o600))
+	defer func(orig string) { meminfoPath = orig }(meminfoPath)
+	meminfoPath = path
+
+	e := createEnclave(&defaultCfg)
+	resp := makeReqToSrv(e.extPrivSrv)(http.MethodGet, pathStats, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Content-Type"), contentTypeJSON)
+
+	var stats runtimeStats
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&stats))
+	if stats.Goroutines < 1 || stats.HeapAlloc == 0 || stats.Sys == 0 {
+		t.Fatalf("Expected non-zero runtime stats but got: %+v", stats)
+	}
+	if stats.Memory == nil {
+		t.Fatal("Expected memory stats.")
+	}
+	assertEqual(t, stats.Memory.Total, uint64(1024*1024))
+	assertEqual(t, stats.Memory.Available, uint64(512*1024))
+}
+
+func TestReadFdStats(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"0", "1", "2"} {
+		failOnErr(t, os.WriteFile(filepath.Join(dir, name), nil, 0o600))
+	}
+	fds, err := readFdStats(dir)
+	failOnErr(t, err)
+	assertEqual(t, fds.Open, uint64(3))
+	if fds.Soft == 0 || fds.Soft > fds.Hard {
+		t.Fatalf("Got unexpected file descriptor limits: %+v", fds)
+	}
+
+	_, err = readFdStats(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Fatal("Expected error for missing fd directory.")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	cryptoRand "crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -41,11 +42,16 @@ func (s *leaderSync) syncWith(worker *url.URL) (err error) {
 		reqBody   attstnBody
 		encrypted []byte
 	)
+	_, span := startSpan(context.Background(), "keysync.sync_with_worker")
+	span.setAttr("worker", worker.Host)
 	defer func() {
+		span.setError(err)
+		span.end()
+		ops.countKeySync(err)
 		if err == nil {
-			elog.Printf("Successfully synced with worker %s.", worker.Host)
+			elog.Info("Successfully synced with worker.", "worker", worker.Host)
 		} else {
-			elog.Printf("Error syncing with worker %s: %v", worker.Host, err)
+			elog.Error("Error syncing with worker.", "worker", worker.Host, "error", err)
 		}
 	}()
 
@@ -97,11 +103,15 @@ func (s *leaderSync) syncWith(worker *url.URL) (err error) {
 	// that the worker put into its auxiliary information.
 	pubKey := &[boxKeyLen]byte{}
 	copy(pubKey[:], workerAux.PublicKey[:])
-	jsonKeys, err := json.Marshal(s.keys.copy())
+	keys := s.keys.copy()
+	defer keys.wipe()
+	jsonKeys, err := json.Marshal(keys)
 	if err != nil {
 		return err
 	}
-	encrypted, err = box.SealAnonymous(nil, jsonKeys, pubKey, cryptoRand.Reader)
+	plaintext := newSecretBytes(jsonKeys)
+	defer plaintext.Wipe()
+	encrypted, err = box.SealAnonymous(nil, plaintext.Bytes(), pubKey, cryptoRand.Reader)
 	if err != nil {
 		return err
 	}
@@ -16,7 +16,7 @@ var (
 	// Instead of using rand.Read or time.Now directly, we use the following
 	// variables to enable mocking as part of our unit tets.
 	cryptoRead  = cryptoRand.Read
-	currentTime = func() time.Time { return time.Now().UTC() }
+	currentTime = func() time.Time { return time.Now().UTC().Add(syncedClock.getOffset()) }
 )
 
 // attstnBody contains a JSON-formatted, Base64-encoded attestation document and
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
@@ -50,8 +51,15 @@ type heartbeatRequest struct {
 }
 
 // registerWith registers the given worker with the given leader enclave.
-func (s *workerSync) registerWith(leader, worker *url.URL) error {
-	elog.Println("Attempting to sync with leader.")
+func (s *workerSync) registerWith(leader, worker *url.URL) (err error) {
+	elog.Info("Attempting to sync with leader.")
+	_, span := startSpan(context.Background(), "keysync.register_with_leader")
+	span.setAttr("leader", leader.Host)
+	defer func() {
+		span.setError(err)
+		span.end()
+		ops.countKeySync(err)
+	}()
 
 	errChan := make(chan error)
 	register := func(e chan error) {
@@ -80,10 +88,10 @@ func (s *workerSync) registerWith(leader, worker *url.URL) error {
 		select {
 		case err := <-errChan:
 			if err == nil {
-				elog.Println("Successfully registered with leader.")
+				elog.Info("Successfully registered with leader.")
 				return nil
 			}
-			elog.Printf("Error registering with leader: %v", err)
+			elog.Warn("Error registering with leader.", "error", err)
 		case <-timeout.C:
 			return errors.New("timed out syncing with leader")
 		case <-retry.C:
@@ -102,13 +110,13 @@ func (s *workerSync) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // initSync responds to the leader's request for initiating key synchronization.
 func (s *workerSync) initSync(w http.ResponseWriter, r *http.Request) {
-	elog.Println("Received leader's request to initiate key sync.")
+	elog.Info("Received leader's request to initiate key sync.")
 
 	// There must not be more than one key synchronization attempt at any given
 	// time.  Abort if we get another request while key synchronization is still
 	// in progress.
 	if len(s.ephemeralKeys) > 0 {
-		http.Error(w, errInProgress.Error(), http.StatusTooManyRequests)
+		httpError(w, r, errInProgress, http.StatusTooManyRequests)
 		return
 	}
 
@@ -116,14 +124,15 @@ func (s *workerSync) initSync(w http.ResponseWriter, r *http.Request) {
 	// https://example.com/enclave/sync?nonce=[HEX-ENCODED-NONCE]
 	leadersNonce, err := getNonceFromReq(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, r, err, http.StatusBadRequest)
+		return
 	}
 
 	// Create the worker's nonce and store it in our channel, so we can later
 	// verify it.
 	workersNonce, err := newNonce()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 	s.nonce <- workersNonce
@@ -132,7 +141,7 @@ func (s *workerSync) initSync(w http.ResponseWriter, r *http.Request) {
 	// its enclave keys.
 	boxKey, err := newBoxKey()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 	s.ephemeralKeys <- boxKey
@@ -144,7 +153,7 @@ func (s *workerSync) initSync(w http.ResponseWriter, r *http.Request) {
 		PublicKey:    boxKey.pubKey[:],
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -152,7 +161,7 @@ func (s *workerSync) initSync(w http.ResponseWriter, r *http.Request) {
 		Document: base64.StdEncoding.EncodeToString(attstnDoc),
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 	fmt.Fprintln(w, string(respBody))
@@ -165,34 +174,39 @@ func (s *workerSync) finishSync(w http.ResponseWriter, r *http.Request) {
 		reqBody attstnBody
 		keys    enclaveKeys
 	)
-	elog.Println("Received leader's request to complete key sync.")
+	elog.Info("Received leader's request to complete key sync.")
 
 	// Read the leader's Base64-encoded attestation document.
 	maxReadLen := base64.StdEncoding.EncodedLen(maxAttstnBodyLen)
 	jsonBody, err := io.ReadAll(newLimitReader(r.Body, maxReadLen))
+	if isBodyTooLarge(err) {
+		httpError(w, r, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 	if err := json.Unmarshal(jsonBody, &reqBody); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, r, err, http.StatusBadRequest)
+		return
 	}
 	attstnDoc, err := base64.StdEncoding.DecodeString(reqBody.Document)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	// Verify attestation document and obtain its auxiliary information.
 	aux, err := s.verifyAttstn(attstnDoc, <-s.nonce)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, r, err, http.StatusBadRequest)
 		return
 	}
 	leaderAux := aux.(*leaderAuxInfo)
 	encrypted, err := base64.StdEncoding.DecodeString(reqBody.EncryptedKeys)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
@@ -200,11 +214,13 @@ func (s *workerSync) finishSync(w http.ResponseWriter, r *http.Request) {
 	// attestation document.
 	hash := sha256.Sum256(encrypted)
 	if !bytes.Equal(hash[:], leaderAux.HashOfEncrypted) {
-		http.Error(w, errHashNotInAttstn.Error(), http.StatusBadRequest)
+		httpError(w, r, errHashNotInAttstn, http.StatusBadRequest)
 		return
 	}
 
 	ephemeralKey := <-s.ephemeralKeys
+	// We use each ephemeral key only once.
+	defer wipeBytes(ephemeralKey.privKey[:])
 	// Decrypt the leader's enclave keys, which are encrypted with the
 	// public key that we provided earlier.
 	decrypted, ok := box.OpenAnonymous(
@@ -213,19 +229,23 @@ func (s *workerSync) finishSync(w http.ResponseWriter, r *http.Request) {
 		ephemeralKey.pubKey,
 		ephemeralKey.privKey)
 	if !ok {
-		http.Error(w, errFailedToDecrypt.Error(), http.StatusBadRequest)
+		httpError(w, r, errFailedToDecrypt, http.StatusBadRequest)
 		return
 	}
 
+	plaintext := newSecretBytes(decrypted)
+	defer plaintext.Wipe()
+
 	// Install the leader's enclave keys.
-	if err := json.Unmarshal(decrypted, &keys); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := json.Unmarshal(plaintext.Bytes(), &keys); err != nil {
+		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 	if err := s.setupWorker(&keys); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		elog.Fatalf("Failed to install enclave keys: %v", err)
+		httpError(w, r, err, http.StatusInternalServerError)
+		fatal("Failed to install enclave keys.", "error", err)
 	}
 
-	elog.Printf("Successfully synced keys %s with leader.", keys.hashAndB64())
+	elog.Info("Successfully synced keys with leader.", "keys", keys.hashAndB64())
+	keys.wipe()
 }
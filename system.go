@@ -3,22 +3,31 @@ package main
 import (
 	"errors"
 	"io"
+	"os"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
 const (
-	defaultFdCur = 65536
+	// defaultFdMax is the hard file descriptor limit that we aim for if we
+	// cannot determine the kernel's maximum.
 	defaultFdMax = 65536
-	defaultGw    = "192.168.127.1"
-	addrLo       = "127.0.0.1/8"
-	addrTap      = "192.168.127.2/24"
-	mac          = "ba:aa:ad:c0:ff:ee"
-	ifaceLo      = "lo"
-	ifaceTap     = "tap0"
+	// defaultTapSubnet is the subnet of our TAP device, which matches the
+	// default subnet of gvproxy, our host proxy.
+	defaultTapSubnet = "192.168.127.0/24"
+	addrLo           = "127.0.0.1/8"
+	mac              = "ba:aa:ad:c0:ff:ee"
+	ifaceLo          = "lo"
+	ifaceTap         = "tap0"
 )
 
 var errTooMuchToRead = errors.New("reached read limit")
 
+// nrOpenPath is the file that tells us the kernel's maximum number of file
+// descriptors per process, i.e., the highest hard limit that we can set.
+var nrOpenPath = "/proc/sys/fs/nr_open"
+
 // limitReader behaves like a Reader but it returns errTooMuchToRead if the
 // given read limit was exceeded.
 type limitReader struct {
@@ -53,33 +62,61 @@ func newLimitReader(r io.Reader, limit int) *limitReader {
 	}
 }
 
+// kernelFdMax returns the kernel's maximum number of file descriptors per
+// process, as found in the given file in the format of /proc/sys/fs/nr_open.
+// If we cannot read the file, we return defaultFdMax.
+func kernelFdMax(path string) uint64 {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return defaultFdMax
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil || n == 0 {
+		return defaultFdMax
+	}
+	return n
+}
+
 // setFdLimit sets the process's file descriptor limit to the given soft (cur)
-// and hard (max) cap.  If either of the two given values is 0, we use our
-// default value instead.
+// and hard (max) cap.  If max is 0, we raise the hard limit to the kernel's
+// maximum.  If cur is 0, we raise the soft limit to the hard limit.  If we
+// lack the privileges to raise the hard limit, we keep the hard limit and
+// raise the soft limit as high as the hard limit permits.
 func setFdLimit(cur, max uint64) error {
-	var rLimit = new(syscall.Rlimit)
+	var orig = new(syscall.Rlimit)
 
-	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, rLimit); err != nil {
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, orig); err != nil {
 		return err
 	}
-	elog.Printf("Original file descriptor limit for cur=%d; max=%d.", rLimit.Cur, rLimit.Max)
+	kernelMax := kernelFdMax(nrOpenPath)
+	elog.Debug("Original file descriptor limit.",
+		"cur", orig.Cur, "max", orig.Max, "kernel_max", kernelMax)
 
-	rLimit.Cur, rLimit.Max = cur, max
-	if cur == 0 {
-		rLimit.Cur = defaultFdCur
+	rLimit := &syscall.Rlimit{Cur: cur, Max: max}
+	if rLimit.Max == 0 {
+		rLimit.Max = kernelMax
 	}
-	if max == 0 {
-		rLimit.Max = defaultFdMax
+	if rLimit.Cur == 0 || rLimit.Cur > rLimit.Max {
+		rLimit.Cur = rLimit.Max
 	}
 
-	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, rLimit); err != nil {
+	err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, rLimit)
+	if errors.Is(err, syscall.EPERM) && rLimit.Max > orig.Max {
+		elog.Warn("Not permitted to raise hard file descriptor limit.",
+			"max", rLimit.Max, "permitted", orig.Max)
+		rLimit.Max = orig.Max
+		rLimit.Cur = min(rLimit.Cur, orig.Max)
+		err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, rLimit)
+	}
+	if err != nil {
 		return err
 	}
 
 	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, rLimit); err != nil {
 		return err
 	}
-	elog.Printf("Modified file descriptor limit for cur=%d; max=%d.", rLimit.Cur, rLimit.Max)
+	elog.Info("Modified file descriptor limit.",
+		"cur", rLimit.Cur, "max", rLimit.Max, "kernel_max", kernelMax)
 
 	return nil
 }
@@ -1,12 +1,30 @@
 package main
 
-import "github.com/songgao/water"
+import (
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/songgao/water"
+)
 
 var ourWaterParams = water.PlatformSpecificParams{Name: ifaceTap}
 
 // Nitriding does not run on macOS but by implementing the following dummy
 // functions, we can at least get it to compile.
-func configureLoIface() error  { return nil }
-func configureTapIface() error { return nil }
-func writeResolvconf() error   { return nil }
-func maybeSeedEntropy()        {}
+func configureLoIface() error                                   { return nil }
+func configureTapIface(subnet *tapSubnet) error                 { return nil }
+func writeResolvconf(nameserver net.IP) error                   { return nil }
+func writeHosts(content string) error                           { return nil }
+func maybeSeedEntropy()                                         {}
+func installSeccompFilter() error                               { return nil }
+func dropPrivileges(uid, gid uint32) error                      { return nil }
+func seedEntropy() error                                        { return nil }
+func nsmRandom() ([]byte, error)                                { return nil, errNoRandomFromNSM }
+func lockMemory() error                                         { return nil }
+func disableCoreDumps() error                                   { return nil }
+func mountTmpfs(dir string, uid, gid uint32) error              { return nil }
+func newAppCgroup(cpuWeight uint16) (*os.File, error)           { return nil, errNoCgroups }
+func startInCgroup(cmd *exec.Cmd, cgroup *os.File)              {}
+func limitProcess(pid int, maxAddrSpace, maxFiles uint64) error { return nil }
+func pinToCPU(cpu int) error                                    { return nil }
@@ -4,6 +4,7 @@ import "testing"
 
 func TestNetworking(t *testing.T) {
 	assertEqual(t, configureLoIface(), nil)
-	assertEqual(t, configureTapIface(), nil)
-	assertEqual(t, writeResolvconf(), nil)
+	assertEqual(t, configureTapIface(nil), nil)
+	assertEqual(t, writeResolvconf(nil), nil)
+	assertEqual(t, writeHosts(""), nil)
 }
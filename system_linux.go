@@ -1,14 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 
-	"github.com/hf/nsm"
 	"github.com/hf/nsm/request"
 	"github.com/milosgajdos/tenus"
 	"github.com/songgao/water"
@@ -17,6 +21,9 @@ import (
 const (
 	entropySeedDevice = "/dev/random"
 	entropySeedSize   = 2048
+
+	cgroupRoot    = "/sys/fs/cgroup"
+	appCgroupName = "nitriding-app"
 )
 
 var ourWaterParams = water.PlatformSpecificParams{
@@ -43,17 +50,13 @@ func configureLoIface() error {
 // configureTapIface configures our TAP interface by assigning it a MAC
 // address, IP address, and link MTU.  We could have used DHCP instead but that
 // brings with it unnecessary complexity and attack surface.
-func configureTapIface() error {
+func configureTapIface(subnet *tapSubnet) error {
 	l, err := tenus.NewLinkFrom(ifaceTap)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve link: %w", err)
 	}
 
-	addr, network, err := net.ParseCIDR(addrTap)
-	if err != nil {
-		return fmt.Errorf("failed to parse CIDR: %w", err)
-	}
-	if err = l.SetLinkIp(addr, network); err != nil {
+	if err = l.SetLinkIp(subnet.addr, subnet.ipNet()); err != nil {
 		return fmt.Errorf("failed to set link address: %w", err)
 	}
 
@@ -69,28 +72,32 @@ func configureTapIface() error {
 		return fmt.Errorf("failed to bring up link: %w", err)
 	}
 
-	gw := net.ParseIP(defaultGw)
-	if err := l.SetLinkDefaultGw(&gw); err != nil {
+	if err := l.SetLinkDefaultGw(&subnet.gw); err != nil {
 		return fmt.Errorf("failed to set default gateway: %w", err)
 	}
 
 	return nil
 }
 
-// writeResolvconf creates our resolv.conf and adds a nameserver.
-func writeResolvconf() error {
+// writeResolvconf creates our resolv.conf and adds the given nameserver.
+func writeResolvconf(nameserver net.IP) error {
 	// A Nitro Enclave's /etc/resolv.conf is a symlink to
 	// /run/resolvconf/resolv.conf.  As of 2022-11-21, the /run/ directory
 	// exists but not its resolvconf/ subdirectory.
 	dir := "/run/resolvconf/"
 	file := dir + "resolv.conf"
 
+	// Our default gateway -- gvproxy -- also operates a DNS resolver.
+	c := fmt.Sprintf("nameserver %s\n", nameserver)
+
+	// If we re-create our networking after dropping privileges, we can no
+	// longer write the file, but we don't have to.
+	if existing, err := os.ReadFile(file); err == nil && string(existing) == c {
+		return nil
+	}
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create directories: %w", err)
 	}
-
-	// Our default gateway -- gvproxy -- also operates a DNS resolver.
-	c := fmt.Sprintf("nameserver %s\n", defaultGw)
 	if err := os.WriteFile(file, []byte(c), 0644); err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
@@ -98,6 +105,19 @@ func writeResolvconf() error {
 	return nil
 }
 
+// hostsPath is the enclave's hosts file.
+var hostsPath = "/etc/hosts"
+
+// writeHosts replaces our hosts file with the given content.
+func writeHosts(content string) error {
+	// Like our resolv.conf, we can no longer write the file after dropping
+	// privileges, but we don't have to.
+	if existing, err := os.ReadFile(hostsPath); err == nil && string(existing) == content {
+		return nil
+	}
+	return os.WriteFile(hostsPath, []byte(content), 0644)
+}
+
 // maybeSeedEntropy obtains cryptographically secure random bytes from the
 // Nitro Secure Module (NSM) and uses them to initialize the system's random
 // number generator.  If we don't do that, our system is going to start with no
@@ -105,58 +125,166 @@ func writeResolvconf() error {
 func maybeSeedEntropy() {
 	// Abort if we're not in an enclave.
 	if !inEnclave {
-		elog.Println("We are not inside an enclave.  Not seeding entropy pool.")
+		elog.Info("We are not inside an enclave.  Not seeding entropy pool.")
 		return
 	}
-
-	s, err := nsm.OpenDefaultSession()
-	if err != nil {
-		elog.Fatal(err)
+	if err := seedEntropy(); err != nil {
+		fatal("Failed to seed entropy pool.", "error", err)
 	}
-	defer func() {
-		_ = s.Close()
-	}()
+	elog.Info("Initialized the system's entropy pool.")
+}
 
+// seedEntropy writes random bytes from the NSM to the system's entropy pool.
+func seedEntropy() error {
 	fd, err := os.OpenFile(entropySeedDevice, os.O_WRONLY, os.ModePerm)
 	if err != nil {
-		elog.Fatal(err)
+		return err
 	}
 	defer func() {
 		if err = fd.Close(); err != nil {
-			elog.Printf("Failed to close %q: %s", entropySeedDevice, err)
+			elog.Error("Failed to close entropy device.", "device", entropySeedDevice, "error", err)
 		}
 	}()
 
 	var written int
 	for totalWritten := 0; totalWritten < entropySeedSize; {
-		res, err := s.Send(&request.GetRandom{})
+		random, err := nsmRandom()
 		if err != nil {
-			elog.Fatalf("Failed to communicate with hypervisor: %s", err)
-		}
-		if res.GetRandom == nil {
-			elog.Fatal("no GetRandom part in NSM's response")
-		}
-		if len(res.GetRandom.Random) == 0 {
-			elog.Fatal("got no random bytes from NSM")
+			return err
 		}
 
 		// Write NSM-provided random bytes to the system's entropy pool to seed
 		// it.
-		if written, err = fd.Write(res.GetRandom.Random); err != nil {
-			elog.Fatal(err)
+		if written, err = fd.Write(random); err != nil {
+			return err
 		}
 		totalWritten += written
 
-		// Tell the system to update its entropy count.
+		// Tell the system to update its entropy count.  Once we dropped
+		// privileges, we're no longer allowed to, but the bytes that we wrote
+		// still contribute to the pool.
 		if _, _, errno := unix.Syscall(
 			unix.SYS_IOCTL,
 			uintptr(fd.Fd()),
 			uintptr(unix.RNDADDTOENTCNT),
 			uintptr(unsafe.Pointer(&written)),
 		); errno != 0 {
-			elog.Printf("Failed to update system's entropy count: %s", errno)
+			elog.Debug("Failed to update system's entropy count.", "error", errno)
+		}
+	}
+	return nil
+}
+
+// nsmRandom returns a chunk of random bytes from the NSM.
+func nsmRandom() ([]byte, error) {
+	s, closeSession, err := openNSMSession()
+	if err != nil {
+		return nil, err
+	}
+	defer closeSession()
+
+	res, err := s.Send(&request.GetRandom{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to communicate with hypervisor: %w", err)
+	}
+	if res.GetRandom == nil || len(res.GetRandom.Random) == 0 {
+		return nil, errNoRandomFromNSM
+	}
+	return res.GetRandom.Random, nil
+}
+
+// lockMemory locks all of our current and future memory pages into RAM, so
+// key material never ends up in swap space.  We lift our limit of locked
+// memory first because the limit would otherwise make memory allocations fail
+// once we drop privileges.
+func lockMemory() error {
+	unlimited := &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}
+	if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, unlimited); err != nil {
+		return fmt.Errorf("failed to lift locked memory limit: %w", err)
+	}
+	if err := unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE); err != nil {
+		return fmt.Errorf("failed to lock memory: %w", err)
+	}
+	return nil
+}
+
+// disableCoreDumps makes sure that the kernel never writes our memory -- and
+// the key material in it -- to a core dump, and that other processes of the
+// same user cannot attach to us.
+func disableCoreDumps() error {
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{}); err != nil {
+		return fmt.Errorf("failed to set core dump limit: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to mark process as non-dumpable: %w", err)
+	}
+	return nil
+}
+
+// mountTmpfs mounts a tmpfs at the given directory that only the given user
+// can access, so secrets in the tmpfs never touch the disk.  We mount the
+// tmpfs before dropping privileges.
+func mountTmpfs(dir string, uid, gid uint32) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create tmpfs directory: %w", err)
+	}
+	opts := fmt.Sprintf("mode=0700,uid=%d,gid=%d,size=1m", uid, gid)
+	if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, opts); err != nil {
+		return fmt.Errorf("failed to mount tmpfs: %w", err)
+	}
+	return nil
+}
+
+// newAppCgroup creates a cgroup v2 with the given CPU weight for the enclave
+// application, and returns the cgroup's directory.  The caller must close the
+// directory.
+func newAppCgroup(cpuWeight uint16) (*os.File, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, errNoCgroups
+	}
+	// Enabling the CPU controller fails if it's already enabled, or if it
+	// isn't available, in which case writing the weight fails.
+	_ = os.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"), []byte("+cpu"), 0o644)
+	dir := filepath.Join(cgroupRoot, appCgroupName)
+	if err := os.Mkdir(dir, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	weight := []byte(strconv.FormatUint(uint64(cpuWeight), 10))
+	if err := os.WriteFile(filepath.Join(dir, "cpu.weight"), weight, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to set CPU weight: %w", err)
+	}
+	return os.Open(dir)
+}
+
+// startInCgroup makes the given command start in the cgroup of the given
+// directory.
+func startInCgroup(cmd *exec.Cmd, cgroup *os.File) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(cgroup.Fd())}
+}
+
+// limitProcess sets the address space limit, in bytes, and the open file
+// limit of the process with the given PID.  Zero means that we leave the
+// respective limit alone.
+func limitProcess(pid int, maxAddrSpace, maxFiles uint64) error {
+	if maxAddrSpace > 0 {
+		l := &unix.Rlimit{Cur: maxAddrSpace, Max: maxAddrSpace}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, l, nil); err != nil {
+			return fmt.Errorf("failed to limit address space: %w", err)
 		}
 	}
+	if maxFiles > 0 {
+		l := &unix.Rlimit{Cur: maxFiles, Max: maxFiles}
+		if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, l, nil); err != nil {
+			return fmt.Errorf("failed to limit open files: %w", err)
+		}
+	}
+	return nil
+}
 
-	elog.Println("Initialized the system's entropy pool.")
+// pinToCPU restricts the calling thread to the given CPU.  The caller must
+// have locked its goroutine to the thread.
+func pinToCPU(cpu int) error {
+	var set unix.CPUSet
+	set.Set(cpu)
+	return unix.SchedSetaffinity(0, &set)
 }
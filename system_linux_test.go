@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// inChildProcess runs the calling test in a child process, because the test
+// makes irreversible changes to its process.  The function returns true if
+// we're the child process.
+func inChildProcess(t *testing.T, name string) bool {
+	t.Helper()
+	if os.Getenv("NITRIDING_TEST_CHILD") == name {
+		return true
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+name+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "NITRIDING_TEST_CHILD="+name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Test in child process failed: %v\n%s", err, out)
+	}
+	return false
+}
+
+func TestDisableCoreDumps(t *testing.T) {
+	if !inChildProcess(t, "TestDisableCoreDumps") {
+		return
+	}
+	failOnErr(t, disableCoreDumps())
+
+	var limit unix.Rlimit
+	failOnErr(t, unix.Getrlimit(unix.RLIMIT_CORE, &limit))
+	assertEqual(t, limit.Cur, uint64(0))
+	dumpable, err := unix.PrctlRetInt(unix.PR_GET_DUMPABLE, 0, 0, 0, 0)
+	failOnErr(t, err)
+	assertEqual(t, dumpable, 0)
+}
+
+func TestLockMemory(t *testing.T) {
+	if !inChildProcess(t, "TestLockMemory") {
+		return
+	}
+	if err := lockMemory(); err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOMEM) {
+			t.Skipf("Not allowed to lock memory: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	status, err := os.ReadFile("/proc/self/status")
+	failOnErr(t, err)
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "VmLck:") {
+			if strings.Fields(line)[1] == "0" {
+				t.Fatal("Expected locked memory.")
+			}
+			return
+		}
+	}
+	t.Fatal("Found no VmLck in process status.")
+}
+
+func TestLimitProcess(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "app.sh")
+	// Give us a moment to limit the process before it reports its limits.
+	failOnErr(t, os.WriteFile(script, []byte("sleep 0.2\nulimit -n\nulimit -v\n"), 0o600))
+
+	var lines []string
+	limits := &appLimits{maxAddrSpace: 512 << 20, maxFiles: 64}
+	f := func(s string) { lines = append(lines, s) }
+	failOnErr(t, runAppCommand("sh "+script, nil, limits, nil, defaultAppStopTimeout, nil, f, func(string) {}))
+	assertEqual(t, strings.Join(lines, ","), "64,524288")
+}
+
+func TestWriteHosts(t *testing.T) {
+	defer func(path string) { hostsPath = path }(hostsPath)
+	hostsPath = filepath.Join(t.TempDir(), "hosts")
+
+	content := newHostOverrides([]string{"db.internal=10.0.0.5"}).hostsFile()
+	failOnErr(t, writeHosts(content))
+	written, err := os.ReadFile(hostsPath)
+	failOnErr(t, err)
+	assertEqual(t, string(written), content)
+}
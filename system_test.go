@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 )
@@ -69,18 +71,35 @@ func TestLimitReader(t *testing.T) {
 	}
 }
 
+func TestKernelFdMax(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nr_open")
+	failOnErr(t, os.WriteFile(path, []byte("1048576\n"), 0o600))
+	assertEqual(t, kernelFdMax(path), uint64(1048576))
+
+	failOnErr(t, os.WriteFile(path, []byte("foo\n"), 0o600))
+	assertEqual(t, kernelFdMax(path), uint64(defaultFdMax))
+	assertEqual(t, kernelFdMax(filepath.Join(t.TempDir(), "missing")), uint64(defaultFdMax))
+}
+
 func TestSetFdLimit(t *testing.T) {
-	var err error
+	var orig = new(syscall.Rlimit)
+	failOnErr(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, orig))
 
-	// Check if default values are set correctly.
-	if err = setFdLimit(0, 0); err != nil {
+	// By default, we raise the hard limit to the kernel's maximum, or keep it
+	// if we may not raise it, and the soft limit to the hard limit.
+	if err := setFdLimit(0, 0); err != nil {
 		t.Fatalf("Failed to set file descriptor limit: %s", err)
 	}
-	checkFdLimit(t, defaultFdCur, defaultFdMax)
+	var rLimit = new(syscall.Rlimit)
+	failOnErr(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, rLimit))
+	if rLimit.Max != kernelFdMax(nrOpenPath) && rLimit.Max != orig.Max {
+		t.Fatalf("Got unexpected hard file descriptor limit %d.", rLimit.Max)
+	}
+	checkFdLimit(t, rLimit.Max, rLimit.Max)
 
-	// Check if custom values are set correctly.
-	if err = setFdLimit(defaultFdCur-1, defaultFdMax-1); err != nil {
+	// Check if a custom soft limit is set correctly.
+	if err := setFdLimit(rLimit.Max-1, rLimit.Max); err != nil {
 		t.Fatalf("Failed to set file descriptor limit: %s", err)
 	}
-	checkFdLimit(t, defaultFdCur-1, defaultFdMax-1)
+	checkFdLimit(t, rLimit.Max-1, rLimit.Max)
 }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// We implement a client for Google's Roughtime protocol, which provides
+// authenticated time: each response is signed by the server, so the EC2 host
+// cannot tamper with the time that we receive.  See:
+// https://roughtime.googlesource.com/roughtime/+/HEAD/PROTOCOL.md
+const (
+	defaultTimeSyncInterval = 10 * time.Minute
+	roughtimeTimeout        = 5 * time.Second
+	roughtimeNonceLen       = 64
+	// Roughtime requests must be padded to at least 1024 bytes, so servers
+	// cannot be abused for amplification attacks.
+	roughtimeRequestLen = 1024
+	roughtimeMaxRespLen = 4096
+
+	roughtimeDelegationCtx = "RoughTime v1 delegation signature--\x00"
+	roughtimeResponseCtx   = "RoughTime v1 response signature\x00"
+)
+
+var (
+	errCfgBadRoughtime   = errors.New("given config has invalid Roughtime public key")
+	errBadRoughtimeMsg   = errors.New("malformed Roughtime message")
+	errBadRoughtimeSig   = errors.New("invalid Roughtime signature")
+	errBadRoughtimeProof = errors.New("Roughtime response does not contain our nonce")
+	errBadRoughtimeDele  = errors.New("Roughtime delegation does not cover response")
+	errNoTimeSync        = errors.New("time is not yet synchronized")
+	errCfgTimeSources    = errors.New("given config has both Roughtime server and host time port")
+
+	// syncedClock holds the offset between our local clock and the time that
+	// we obtained via Roughtime.
+	syncedClock = new(timeSync)
+)
+
+// isTimeSyncEnabled returns true if nitriding synchronizes its time, either
+// via Roughtime or with the EC2 host.
+func (c *Config) isTimeSyncEnabled() bool {
+	return c.RoughtimeServer != "" || c.HostTimePort != 0
+}
+
+// validateTimeSync returns an error if the config's Roughtime server lacks a
+// valid public key, or if the config has more than one time source.
+func (c *Config) validateTimeSync() error {
+	if c.RoughtimeServer == "" {
+		return nil
+	}
+	if c.HostTimePort != 0 {
+		return errCfgTimeSources
+	}
+	key, err := base64.StdEncoding.DecodeString(c.RoughtimePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errCfgBadRoughtime
+	}
+	return nil
+}
+
+// timeSync holds the result of our most recent time synchronization.
+type timeSync struct {
+	sync.RWMutex
+	offset   time.Duration
+	radius   time.Duration
+	lastSync time.Time
+	server   string
+}
+
+// getOffset returns the offset that we add to our local clock.
+func (t *timeSync) getOffset() time.Duration {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.offset
+}
+
+// set records the result of a time synchronization.
+func (t *timeSync) set(offset, radius time.Duration, server string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.offset, t.radius, t.server = offset, radius, server
+	t.lastSync = time.Now().UTC()
+}
+
+// timeInfo is the JSON representation of our synchronized time.
+type timeInfo struct {
+	Time     time.Time `json:"time"`
+	Offset   string    `json:"offset"`
+	Radius   string    `json:"radius"`
+	LastSync time.Time `json:"last_sync"`
+	Server   string    `json:"server"`
+}
+
+// info returns our synchronized time, or an error if we never synchronized.
+func (t *timeSync) info() (*timeInfo, error) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.lastSync.IsZero() {
+		return nil, errNoTimeSync
+	}
+	return &timeInfo{
+		Time:     time.Now().UTC().Add(t.offset),
+		Offset:   t.offset.String(),
+		Radius:   t.radius.String(),
+		LastSync: t.lastSync,
+		Server:   t.server,
+	}, nil
+}
+
+// encodeRoughtime encodes the given tags and values as a Roughtime message:
+// the number of tags, the offsets of all values but the first, the tags in
+// ascending order, and finally the values.  All numbers are little-endian.
+func encodeRoughtime(msg map[string][]byte) []byte {
+	tags := make([]string, 0, len(msg))
+	for tag := range msg {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return binary.LittleEndian.Uint32([]byte(tags[i])) < binary.LittleEndian.Uint32([]byte(tags[j]))
+	})
+
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := 0
+	for i, tag := range tags {
+		if i > 0 {
+			out = binary.LittleEndian.AppendUint32(out, uint32(offset))
+		}
+		offset += len(msg[tag])
+	}
+	for _, tag := range tags {
+		out = append(out, tag...)
+	}
+	for _, tag := range tags {
+		out = append(out, msg[tag]...)
+	}
+	return out
+}
+
+// decodeRoughtime decodes the given Roughtime message into its tags and
+// values.
+func decodeRoughtime(b []byte) (map[string][]byte, error) {
+	if len(b) < 4 {
+		return nil, errBadRoughtimeMsg
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n == 0 || n > 64 {
+		return nil, errBadRoughtimeMsg
+	}
+	header := 4 + 4*(n-1) + 4*n
+	if len(b) < header {
+		return nil, errBadRoughtimeMsg
+	}
+	values := b[header:]
+
+	msg := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		start, end := 0, len(values)
+		if i > 0 {
+			start = int(binary.LittleEndian.Uint32(b[4*i:]))
+		}
+		if i < n-1 {
+			end = int(binary.LittleEndian.Uint32(b[4*(i+1):]))
+		}
+		if start > end || end > len(values) || start%4 != 0 {
+			return nil, errBadRoughtimeMsg
+		}
+		tagOffset := 4 + 4*(n-1) + 4*i
+		msg[string(b[tagOffset:tagOffset+4])] = values[start:end]
+	}
+	return msg, nil
+}
+
+// roughtimeTags decodes the given message and returns the values of the
+// given tags, which must all be present.
+func roughtimeTags(b []byte, tags ...string) ([][]byte, error) {
+	msg, err := decodeRoughtime(b)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(tags))
+	for i, tag := range tags {
+		v, ok := msg[tag]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing tag %s", errBadRoughtimeMsg, tag)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// newRoughtimeRequest returns a Roughtime request for the given nonce.
+func newRoughtimeRequest(nonce []byte) []byte {
+	msg := map[string][]byte{"NONC": nonce, "PAD\xff": nil}
+	// The padding makes up for the rest of our request: the header takes 4
+	// bytes for the number of tags, 4 for the padding's offset, and 8 for the
+	// tags.
+	msg["PAD\xff"] = make([]byte, roughtimeRequestLen-16-len(nonce))
+	return encodeRoughtime(msg)
+}
+
+// verifyRoughtime verifies the given Roughtime response to our request with
+// the given nonce, using the server's given long-term public key.  If the
+// response is authentic, the function returns the server's time and the
+// radius of uncertainty around it.
+func verifyRoughtime(resp, nonce []byte, rootKey ed25519.PublicKey) (time.Time, time.Duration, error) {
+	v, err := roughtimeTags(resp, "SIG\x00", "PATH", "SREP", "CERT", "INDX")
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	sig, path, srep, cert, indx := v[0], v[1], v[2], v[3], v[4]
+
+	// The server's long-term key delegates to an online key.
+	v, err = roughtimeTags(cert, "DELE", "SIG\x00")
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	dele, deleSig := v[0], v[1]
+	if !ed25519.Verify(rootKey, append([]byte(roughtimeDelegationCtx), dele...), deleSig) {
+		return time.Time{}, 0, errBadRoughtimeSig
+	}
+	v, err = roughtimeTags(dele, "PUBK", "MINT", "MAXT")
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	pubKey, mint, maxt := v[0], v[1], v[2]
+	if len(pubKey) != ed25519.PublicKeySize || len(mint) != 8 || len(maxt) != 8 {
+		return time.Time{}, 0, errBadRoughtimeMsg
+	}
+
+	// The online key signs the response.
+	if !ed25519.Verify(pubKey, append([]byte(roughtimeResponseCtx), srep...), sig) {
+		return time.Time{}, 0, errBadRoughtimeSig
+	}
+	v, err = roughtimeTags(srep, "ROOT", "MIDP", "RADI")
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	root, midp, radi := v[0], v[1], v[2]
+	if len(root) != sha512.Size || len(midp) != 8 || len(radi) != 4 || len(indx) != 4 ||
+		len(path)%sha512.Size != 0 {
+		return time.Time{}, 0, errBadRoughtimeMsg
+	}
+
+	// The signed Merkle tree must contain our nonce.
+	hash := sha512.Sum512(append([]byte{0x00}, nonce...))
+	index := binary.LittleEndian.Uint32(indx)
+	for ; len(path) > 0; path = path[sha512.Size:] {
+		node := []byte{0x01}
+		if index&1 == 0 {
+			node = append(append(node, hash[:]...), path[:sha512.Size]...)
+		} else {
+			node = append(append(node, path[:sha512.Size]...), hash[:]...)
+		}
+		hash = sha512.Sum512(node)
+		index >>= 1
+	}
+	if !bytes.Equal(hash[:], root) {
+		return time.Time{}, 0, errBadRoughtimeProof
+	}
+
+	midpoint := binary.LittleEndian.Uint64(midp)
+	if midpoint < binary.LittleEndian.Uint64(mint) || midpoint > binary.LittleEndian.Uint64(maxt) {
+		return time.Time{}, 0, errBadRoughtimeDele
+	}
+	radius := time.Duration(binary.LittleEndian.Uint32(radi)) * time.Microsecond
+	return time.UnixMicro(int64(midpoint)).UTC(), radius, nil
+}
+
+// queryRoughtime asks the given Roughtime server for the time, and returns
+// the offset between the server's time and our local clock, as well as the
+// radius of uncertainty around the offset.
+func queryRoughtime(server string, rootKey ed25519.PublicKey) (time.Duration, time.Duration, error) {
+	nonce := make([]byte, roughtimeNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, 0, err
+	}
+	conn, err := net.DialTimeout("udp", server, roughtimeTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(roughtimeTimeout))
+
+	sent := time.Now()
+	if _, err := conn.Write(newRoughtimeRequest(nonce)); err != nil {
+		return 0, 0, err
+	}
+	resp := make([]byte, roughtimeMaxRespLen)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, 0, err
+	}
+	rtt := time.Since(sent)
+
+	serverTime, radius, err := verifyRoughtime(resp[:n], nonce, rootKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	// We assume that the server's time corresponds to the middle of our
+	// round trip.
+	offset := serverTime.Sub(sent.Add(rtt / 2))
+	return offset, radius + rtt/2, nil
+}
+
+// timeQuery obtains the offset between a time source and our local clock, as
+// well as the radius of uncertainty around the offset.
+type timeQuery func() (offset, radius time.Duration, err error)
+
+// timeSource returns our configured time source's name and a function that
+// queries it.  Nitriding prefers authenticated time from a Roughtime server;
+// otherwise, it falls back to the EC2 host's clock.
+func (e *Enclave) timeSource() (string, timeQuery) {
+	if e.cfg.RoughtimeServer != "" {
+		rootKey, _ := base64.StdEncoding.DecodeString(e.cfg.RoughtimePublicKey)
+		return e.cfg.RoughtimeServer, func() (time.Duration, time.Duration, error) {
+			return queryRoughtime(e.cfg.RoughtimeServer, rootKey)
+		}
+	}
+	dial := dialHostVsock(e.cfg.HostCID, e.cfg.HostTimePort)
+	return fmt.Sprintf("vsock:%d:%d", e.cfg.HostCID, e.cfg.HostTimePort),
+		func() (time.Duration, time.Duration, error) { return queryHostTime(dial) }
+}
+
+// syncTime periodically obtains the time from the given source until the
+// enclave stops.  Nitriding uses the resulting time to verify attestation
+// documents, create certificates, and sign AWS requests.
+func (e *Enclave) syncTime(server string, query timeQuery, interval time.Duration) {
+	defer reportPanic()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		offset, radius, err := query()
+		if err != nil {
+			elog.Warn("Failed to synchronize time.", "server", server, "error", err)
+		} else {
+			syncedClock.set(offset, radius, server)
+			e.startup.markMet(appPrereqTime)
+			elog.Debug("Synchronized time.", "offset", offset, "radius", radius)
+		}
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// timeHandler returns an HTTP handler that returns our authenticated time,
+// and how it deviates from our local clock.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func timeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, err := syncedClock.info()
+		if err != nil {
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			elog.Error("Error encoding time.", "error", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// roughtimeServer implements a Roughtime server for testing.  It signs the
+// given time, and puts each request's nonce into a Merkle tree alongside a
+// dummy nonce.
+type roughtimeServer struct {
+	rootKey, onlineKey ed25519.PrivateKey
+	now                time.Time
+}
+
+func newRoughtimeServer(t *testing.T, now time.Time) *roughtimeServer {
+	t.Helper()
+	_, rootKey, err := ed25519.GenerateKey(nil)
+	failOnErr(t, err)
+	_, onlineKey, err := ed25519.GenerateKey(nil)
+	failOnErr(t, err)
+	return &roughtimeServer{rootKey: rootKey, onlineKey: onlineKey, now: now}
+}
+
+func (s *roughtimeServer) publicKey() ed25519.PublicKey {
+	return s.rootKey.Public().(ed25519.PublicKey)
+}
+
+func uint64LE(i uint64) []byte { return binary.LittleEndian.AppendUint64(nil, i) }
+
+func (s *roughtimeServer) respond(t *testing.T, req []byte) []byte {
+	t.Helper()
+	v, err := roughtimeTags(req, "NONC")
+	failOnErr(t, err)
+
+	// Our nonce is the right leaf in a tree of two leaves.
+	leaf := sha512.Sum512(append([]byte{0x00}, v[0]...))
+	sibling := sha512.Sum512(append([]byte{0x00}, make([]byte, roughtimeNonceLen)...))
+	root := sha512.Sum512(append(append([]byte{0x01}, sibling[:]...), leaf[:]...))
+
+	midp := uint64(s.now.UnixMicro())
+	dele := encodeRoughtime(map[string][]byte{
+		"PUBK": s.onlineKey.Public().(ed25519.PublicKey),
+		"MINT": uint64LE(midp - uint64(time.Hour.Microseconds())),
+		"MAXT": uint64LE(midp + uint64(time.Hour.Microseconds())),
+	})
+	srep := encodeRoughtime(map[string][]byte{
+		"ROOT": root[:],
+		"MIDP": uint64LE(midp),
+		"RADI": binary.LittleEndian.AppendUint32(nil, 1000000),
+	})
+	return encodeRoughtime(map[string][]byte{
+		"SIG\x00": ed25519.Sign(s.onlineKey, append([]byte(roughtimeResponseCtx), srep...)),
+		"PATH":    sibling[:],
+		"SREP":    srep,
+		"CERT": encodeRoughtime(map[string][]byte{
+			"DELE":    dele,
+			"SIG\x00": ed25519.Sign(s.rootKey, append([]byte(roughtimeDelegationCtx), dele...)),
+		}),
+		"INDX": binary.LittleEndian.AppendUint32(nil, 1),
+	})
+}
+
+func TestRoughtimeEncoding(t *testing.T) {
+	req := newRoughtimeRequest(make([]byte, roughtimeNonceLen))
+	assertEqual(t, len(req), roughtimeRequestLen)
+
+	msg, err := decodeRoughtime(req)
+	failOnErr(t, err)
+	assertEqual(t, len(msg["NONC"]), roughtimeNonceLen)
+
+	for _, b := range [][]byte{nil, {1, 0, 0}, {0, 0, 0, 0}, {2, 0, 0, 0, 8, 0, 0, 0}} {
+		if _, err := decodeRoughtime(b); !errors.Is(err, errBadRoughtimeMsg) {
+			t.Fatalf("Expected error for malformed message %v.", b)
+		}
+	}
+}
+
+func TestVerifyRoughtime(t *testing.T) {
+	now := time.Now().Add(time.Hour).Truncate(time.Microsecond).UTC()
+	srv := newRoughtimeServer(t, now)
+	nonce := make([]byte, roughtimeNonceLen)
+	nonce[0] = 1
+	resp := srv.respond(t, newRoughtimeRequest(nonce))
+
+	serverTime, radius, err := verifyRoughtime(resp, nonce, srv.publicKey())
+	failOnErr(t, err)
+	assertEqual(t, serverTime, now)
+	assertEqual(t, radius, time.Second)
+
+	// The response must not verify for another nonce or another server.
+	_, _, err = verifyRoughtime(resp, make([]byte, roughtimeNonceLen), srv.publicKey())
+	assertEqual(t, errors.Is(err, errBadRoughtimeProof), true)
+	other := newRoughtimeServer(t, now)
+	_, _, err = verifyRoughtime(resp, nonce, other.publicKey())
+	assertEqual(t, errors.Is(err, errBadRoughtimeSig), true)
+}
+
+func TestQueryRoughtime(t *testing.T) {
+	now := time.Now().Add(time.Hour)
+	srv := newRoughtimeServer(t, now)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	failOnErr(t, err)
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, roughtimeMaxRespLen)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = conn.WriteTo(srv.respond(t, buf[:n]), addr)
+	}()
+
+	offset, _, err := queryRoughtime(conn.LocalAddr().String(), srv.publicKey())
+	failOnErr(t, err)
+	if offset < 59*time.Minute || offset > 61*time.Minute {
+		t.Fatalf("Expected offset of about an hour but got %s.", offset)
+	}
+}
+
+func TestTimeHandler(t *testing.T) {
+	defer func(orig *timeSync) { syncedClock = orig }(syncedClock)
+	syncedClock = new(timeSync)
+	makeReq := makeReqToHandler(timeHandler())
+
+	assertResponse(t,
+		makeReq(http.MethodGet, pathTime, nil),
+		newErrResp(http.StatusServiceUnavailable, errNoTimeSync),
+	)
+
+	syncedClock.set(time.Hour, time.Second, "example.com:2002")
+	resp := makeReq(http.MethodGet, pathTime, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	if d := currentTime().Sub(time.Now()); d < 59*time.Minute {
+		t.Fatalf("Expected current time to be an hour ahead but got %s.", d)
+	}
+}
+
+func TestValidateTimeSync(t *testing.T) {
+	c := &Config{RoughtimeServer: "example.com:2002"}
+	assertEqual(t, c.validateTimeSync(), errCfgBadRoughtime)
+	c.RoughtimePublicKey = base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	assertEqual(t, c.validateTimeSync(), nil)
+	c.HostTimePort = 1234
+	assertEqual(t, c.validateTimeSync(), errCfgTimeSources)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// The W3C Trace Context header that propagates traces across services:
+	// https://www.w3.org/TR/trace-context/
+	traceparentHeader = "traceparent"
+	traceFlagSampled  = 0x01
+
+	// OTLP span kinds and status codes.
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+
+	// The path of OTLP/HTTP's trace endpoint, relative to the collector's
+	// base URL.
+	otlpTracesPath = "/v1/traces"
+	// The number of finished spans that we buffer.  Once the buffer is full,
+	// we drop new spans.
+	traceQueueLen = 2048
+	// The maximum number of spans per export request, and how often we
+	// export spans.
+	traceBatchSize      = 512
+	traceExportInterval = 5 * time.Second
+	traceExportTimeout  = 10 * time.Second
+	traceServiceName    = "nitriding"
+)
+
+var (
+	errCfgBadOTLPEndpoint = errors.New("given config has invalid OTLP endpoint")
+
+	// tracer exports our spans.  It's nil if tracing is disabled, in which
+	// case all span operations are no-ops.
+	tracer *otlpTracer
+)
+
+type spanKey struct{}
+
+// span represents an OpenTelemetry span, i.e., a timed operation that's part
+// of a trace.  All methods are safe to call on a nil span.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	attrs    []otlpKeyValue
+	err      error
+}
+
+// startSpan starts a new span with the given name.  If the given context
+// carries a span, the new span becomes its child.  The returned context
+// carries the new span.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: spanKindInternal, start: time.Now(), sampled: true}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else if _, err := cryptoRead(s.traceID[:]); err != nil {
+		return ctx, nil
+	}
+	if _, err := cryptoRead(s.spanID[:]); err != nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// parseTraceparent returns a context that carries the remote parent span that
+// the given traceparent header refers to.  If the header is malformed, we
+// return the given context unchanged.
+func parseTraceparent(ctx context.Context, header string) context.Context {
+	// The header has the form 00-<trace ID>-<parent ID>-<flags>.
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	parent := &span{}
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return ctx
+	}
+	parent.sampled = flags&traceFlagSampled != 0
+	return context.WithValue(ctx, spanKey{}, parent)
+}
+
+// traceparent returns the span's W3C traceparent header value.
+func (s *span) traceparent() string {
+	var flags byte
+	if s.sampled {
+		flags = traceFlagSampled
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", s.traceID, s.spanID, flags)
+}
+
+// setAttr adds the given attribute to the span.  Values are strings, integers,
+// or booleans.
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case int:
+		i := strconv.Itoa(value)
+		v.IntValue = &i
+	case bool:
+		v.BoolValue = &value
+	default:
+		str := fmt.Sprint(value)
+		v.StringValue = &str
+	}
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: v})
+}
+
+// setError marks the span as failed if the given error is not nil.
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err
+}
+
+// end finishes the span and queues it for export.
+func (s *span) end() {
+	if s == nil || !s.sampled || tracer == nil {
+		return
+	}
+	tracer.export(s.toOTLP(time.Now()))
+}
+
+// The following types implement the subset of OTLP's JSON encoding that we
+// need: https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+func (s *span) toOTLP(end time.Time) *otlpSpan {
+	o := &otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		o.Status = otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+	}
+	return o
+}
+
+// otlpTracer exports finished spans in batches to an OTLP/HTTP collector.
+type otlpTracer struct {
+	endpoint string
+	spans    chan *otlpSpan
+	client   *http.Client
+}
+
+// newOTLPTracer returns a new tracer that exports spans to the OTLP/HTTP
+// collector at the given base URL, e.g., "http://collector:4318".
+func newOTLPTracer(endpoint string) *otlpTracer {
+	return &otlpTracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + otlpTracesPath,
+		spans:    make(chan *otlpSpan, traceQueueLen),
+		client:   &http.Client{Transport: outboundTransport, Timeout: traceExportTimeout},
+	}
+}
+
+// export queues the given span for export, or drops it if our queue is full.
+func (t *otlpTracer) export(s *otlpSpan) {
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+// run exports queued spans until the given channel is closed.
+func (t *otlpTracer) run(stop chan struct{}) {
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	var batch []*otlpSpan
+	for {
+		select {
+		case <-stop:
+			t.flush(batch)
+			return
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				t.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush sends the given spans to the collector.  Spans that we fail to export
+// are dropped.
+func (t *otlpTracer) flush(batch []*otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	var req otlpRequest
+	rs := otlpResourceSpans{}
+	name := traceServiceName
+	rs.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: &name}}}
+	ss := otlpScopeSpans{Spans: batch}
+	ss.Scope.Name = traceServiceName
+	ss.Scope.Version = version
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	req.ResourceSpans = []otlpResourceSpans{rs}
+
+	body, err := json.Marshal(&req)
+	if err != nil {
+		elog.Error("Error encoding spans.", "error", err)
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, contentTypeJSON, bytes.NewReader(body))
+	if err != nil {
+		elog.Warn("Error exporting spans.", "error", err, "spans", len(batch))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		elog.Warn("Collector rejected spans.", "status", resp.StatusCode, "spans", len(batch))
+	}
+}
+
+// validateTracing returns an error if the config's OTLP endpoint is not an
+// HTTP(S) URL.
+func (c *Config) validateTracing() error {
+	if c.OTLPEndpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(c.OTLPEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q", errCfgBadOTLPEndpoint, c.OTLPEndpoint)
+	}
+	return nil
+}
+
+// configureTracing starts exporting spans if the given config has an OTLP
+// endpoint.
+func configureTracing(c *Config) {
+	if c.OTLPEndpoint == "" || tracer != nil {
+		return
+	}
+	tracer = newOTLPTracer(c.OTLPEndpoint)
+	go tracer.run(make(chan struct{}))
+	elog.Info("Exporting traces.", "endpoint", tracer.endpoint)
+}
+
+// traceMiddleware returns a chi middleware that wraps each request of the
+// given Web server in a span.  We continue traces that the client started
+// via the traceparent header, and pass our span on to the enclave
+// application, so traces cross the enclave boundary.
+func traceMiddleware(server string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			if tracer == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			ctx := parseTraceparent(r.Context(), r.Header.Get(traceparentHeader))
+			ctx, s := startSpan(ctx, r.Method)
+			if s == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			s.kind = spanKindServer
+			r.Header.Set(traceparentHeader, s.traceparent())
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			h.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+				s.name = r.Method + " " + rctx.RoutePattern()
+			}
+			s.setAttr("nitriding.server", server)
+			s.setAttr("http.request.method", r.Method)
+			s.setAttr("url.path", r.URL.Path)
+			s.setAttr("http.response.status_code", status)
+			if id := middleware.GetReqID(ctx); id != "" {
+				s.setAttr("nitriding.request_id", id)
+			}
+			if status >= http.StatusInternalServerError {
+				s.setError(errors.New(http.StatusText(status)))
+			}
+			s.end()
+		}
+		return http.HandlerFunc(f)
+	}
+}
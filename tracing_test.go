@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := parseTraceparent(context.Background(), header)
+	parent, ok := ctx.Value(spanKey{}).(*span)
+	if !ok {
+		t.Fatal("Expected context to carry parent span.")
+	}
+	assertEqual(t, parent.traceparent(), header)
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if ctx := parseTraceparent(context.Background(), invalid); ctx.Value(spanKey{}) != nil {
+			t.Fatalf("Expected no parent span for %q.", invalid)
+		}
+	}
+}
+
+func TestSpansWithoutTracer(t *testing.T) {
+	// If tracing is disabled, spans are nil, and their methods are no-ops.
+	ctx, s := startSpan(context.Background(), "foo")
+	if s != nil || ctx.Value(spanKey{}) != nil {
+		t.Fatal("Expected no span without tracer.")
+	}
+	s.setAttr("foo", "bar")
+	s.setError(errNotAcceptable)
+	s.end()
+}
+
+func TestTraceMiddleware(t *testing.T) {
+	reqs := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertEqual(t, r.URL.Path, otlpTracesPath)
+		var req otlpRequest
+		failOnErr(t, json.NewDecoder(r.Body).Decode(&req))
+		reqs <- req
+	}))
+	defer collector.Close()
+
+	tracer = newOTLPTracer(collector.URL)
+	defer func() { tracer = nil }()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var appTraceparent string
+	m := chi.NewRouter()
+	m.Use(traceMiddleware(apiPublic))
+	m.Get("/foo/{id}", func(w http.ResponseWriter, r *http.Request) {
+		appTraceparent = r.Header.Get(traceparentHeader)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+	req.Header.Set(traceparentHeader, "00-"+traceID+"-00f067aa0ba902b7-01")
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The application must see our span as its parent.
+	if !strings.HasPrefix(appTraceparent, "00-"+traceID+"-") {
+		t.Fatalf("Unexpected traceparent for application: %q", appTraceparent)
+	}
+
+	tracer.flush([]*otlpSpan{<-tracer.spans})
+	s := (<-reqs).ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assertEqual(t, s.TraceID, traceID)
+	assertEqual(t, s.ParentSpanID, "00f067aa0ba902b7")
+	assertEqual(t, s.Name, "GET /foo/{id}")
+	assertEqual(t, s.Kind, spanKindServer)
+	assertEqual(t, appTraceparent, "00-"+traceID+"-"+s.SpanID+"-01")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+const (
+	defaultGoMemLimitPercent = 50
+	// fdMemCost is the memory that we budget for each file descriptor, most
+	// of which are sockets with kernel buffers.
+	fdMemCost = 64 * 1024
+	// The bounds of the file descriptor limit that we derive from the
+	// enclave's memory.
+	minAutoFds = 4096
+	maxAutoFds = 1 << 20
+)
+
+var errCfgBadMemLimit = errors.New("given config has Go memory limit percentage outside 0-100")
+
+// runtimeTuning contains the runtime settings that fit the enclave's
+// resources.
+type runtimeTuning struct {
+	maxProcs int    // GOMAXPROCS.
+	memLimit int64  // GOMEMLIMIT, in bytes.  Zero means no limit.
+	fds      uint64 // Soft and hard file descriptor limit.
+}
+
+// newRuntimeTuning returns the runtime settings for an enclave with the given
+// number of vCPUs and the given total memory, in bytes.  Nitriding shares the
+// enclave's fixed memory with the enclave application, so Go's soft memory
+// limit is only the given percentage of the total memory, which makes the
+// garbage collector work harder before we run out of memory rather than
+// after.
+func newRuntimeTuning(cpus int, memTotal uint64, memLimitPercent int) *runtimeTuning {
+	if memLimitPercent == 0 {
+		memLimitPercent = defaultGoMemLimitPercent
+	}
+	t := &runtimeTuning{
+		maxProcs: max(cpus, 1),
+		fds:      min(max(memTotal/fdMemCost, minAutoFds), maxAutoFds),
+	}
+	if memTotal > 0 {
+		t.memLimit = int64(memTotal / 100 * uint64(memLimitPercent))
+	}
+	return t
+}
+
+// autoTune sets GOMAXPROCS and Go's memory limit according to the enclave's
+// vCPUs and memory, and returns the file descriptor limits that we should
+// set.  We don't override the GOMAXPROCS and GOMEMLIMIT environment
+// variables, or file descriptor limits in the given config.
+func autoTune(c *Config) (fdCur, fdMax uint64) {
+	var memTotal uint64
+	if mem, err := readMeminfo(meminfoPath); err == nil {
+		memTotal = mem.Total
+	} else {
+		elog.Warn("Failed to determine enclave memory.  Not setting memory limit.", "error", err)
+	}
+	t := newRuntimeTuning(runtime.NumCPU(), memTotal, c.GoMemLimitPercent)
+
+	if os.Getenv("GOMAXPROCS") == "" {
+		runtime.GOMAXPROCS(t.maxProcs)
+	}
+	if os.Getenv("GOMEMLIMIT") == "" && t.memLimit > 0 {
+		debug.SetMemoryLimit(t.memLimit)
+	}
+	fdCur, fdMax = c.FdCur, c.FdMax
+	if fdCur == 0 && fdMax == 0 {
+		fdCur, fdMax = t.fds, t.fds
+	}
+	elog.Info("Tuned runtime to enclave resources.",
+		"gomaxprocs", runtime.GOMAXPROCS(0),
+		"memory_limit", debug.SetMemoryLimit(-1),
+		"fd_limit", fdMax)
+	return fdCur, fdMax
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewRuntimeTuning(t *testing.T) {
+	const gib = 1 << 30
+
+	tuning := newRuntimeTuning(4, 8*gib, 0)
+	assertEqual(t, tuning.maxProcs, 4)
+	assertEqual(t, tuning.memLimit, int64(8*gib/100*defaultGoMemLimitPercent))
+	assertEqual(t, tuning.fds, uint64(8*gib/fdMemCost))
+
+	// Small enclaves still get a usable number of file descriptors, and big
+	// ones don't get an unbounded number.
+	assertEqual(t, newRuntimeTuning(2, 64<<20, 75).fds, uint64(minAutoFds))
+	assertEqual(t, newRuntimeTuning(2, 1024*gib, 75).fds, uint64(maxAutoFds))
+	assertEqual(t, newRuntimeTuning(2, 1024*gib, 75).memLimit, int64(1024*gib/100*75))
+
+	// Without knowing our memory, we don't set a memory limit.
+	tuning = newRuntimeTuning(0, 0, 0)
+	assertEqual(t, tuning.maxProcs, 1)
+	assertEqual(t, tuning.memLimit, int64(0))
+}
+
+func TestAutoTune(t *testing.T) {
+	t.Setenv("GOMAXPROCS", "1")
+	t.Setenv("GOMEMLIMIT", "off")
+
+	// Limits in the config take precedence.
+	fdCur, fdMax := autoTune(&Config{FdCur: 1024, FdMax: 2048})
+	assertEqual(t, fdCur, uint64(1024))
+	assertEqual(t, fdMax, uint64(2048))
+}
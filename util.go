@@ -7,6 +7,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/pem"
 	"errors"
@@ -16,8 +17,12 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/net/idna"
 )
 
 const (
@@ -26,18 +31,61 @@ const (
 	// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ec2-instance-metadata.html
 	metadataSvcToken = "http://169.254.169.254/latest/api/token"
 	metadataSvcInfo  = "http://169.254.169.254/latest/meta-data/local-hostname"
+
+	// The maximum lengths of a domain name and its labels, as per RFC 1035.
+	maxFQDNLen  = 253
+	maxLabelLen = 63
+
+	// outboundIdleConnsPerHost is the number of idle connections that we keep
+	// to each host outside the enclave.
+	outboundIdleConnsPerHost = 16
 )
 
 var (
 	errBadSliceLen               = errors.New("slice is not of same length as nonce")
+	errBadFQDN                   = errors.New("invalid FQDN")
 	newUnauthenticatedHTTPClient = func() *http.Client {
 		return _newUnauthenticatedHTTPClient()
 	}
 	getSyncURL = func(host string, port uint16) *url.URL {
 		return _getSyncURL(host, port)
 	}
+
+	// outboundTransport is shared by the HTTP clients with which we talk to
+	// services outside the enclave, e.g., ACME, KMS, and Vault.  Each new
+	// connection traverses the proxy on the EC2 host and costs a TCP and TLS
+	// handshake, so our clients share their connection pool.
+	outboundTransport = newOutboundTransport()
+	// outboundHTTPClient uses outboundTransport without a timeout, for
+	// requests whose context bounds them.
+	outboundHTTPClient = &http.Client{Transport: outboundTransport}
+	// unauthenticatedTransport is shared by the clients that
+	// newUnauthenticatedHTTPClient returns, so leader and workers reuse
+	// their connections across heartbeats.
+	unauthenticatedTransport = newUnauthenticatedTransport()
 )
 
+// newOutboundTransport returns an HTTP transport that attempts HTTP/2, which
+// multiplexes concurrent requests over a single connection, and that keeps
+// more idle connections around than Go's default of two per host.  The
+// transport checks certificates' validity against our synchronized time
+// rather than the enclave's drifting clock.
+func newOutboundTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ForceAttemptHTTP2 = true
+	t.MaxIdleConnsPerHost = outboundIdleConnsPerHost
+	t.TLSClientConfig = &tls.Config{Time: currentTime}
+	return t
+}
+
+// newUnauthenticatedTransport returns an outbound HTTP transport that skips
+// HTTPS certificate validation.
+func newUnauthenticatedTransport() *http.Transport {
+	t := newOutboundTransport()
+	t.TLSClientConfig.InsecureSkipVerify = true
+	return t
+}
+
 // _getSyncURL turns the given host and port into a URL that a leader enclave
 // can sync with.
 var _getSyncURL = func(host string, port uint16) *url.URL {
@@ -53,11 +101,8 @@ var _getSyncURL = func(host string, port uint16) *url.URL {
 // all we need is a *confidential* channel; not an authenticated channel.
 // Authentication is handled on the next layer, using attestation documents.
 func _newUnauthenticatedHTTPClient() *http.Client {
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
 	return &http.Client{
-		Transport: transport,
+		Transport: unauthenticatedTransport,
 		Timeout:   3 * time.Second,
 	}
 }
@@ -83,8 +128,8 @@ func createCertificate(fqdn string) (cert []byte, key []byte, err error) {
 			Organization: []string{certificateOrg},
 		},
 		DNSNames:              []string{fqdn},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(certificateValidity),
+		NotBefore:             currentTime(),
+		NotAfter:              currentTime().Add(certificateValidity),
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
@@ -136,7 +181,7 @@ func sliceToNonce(s []byte) (nonce, error) {
 // choose when talking to a public IP address.
 func getHostnameOrDie() (hostname string) {
 	defer func() {
-		elog.Printf("Determined our hostname: %s", hostname)
+		elog.Info("Determined our hostname.", "hostname", hostname)
 	}()
 	var err error
 
@@ -157,7 +202,7 @@ func getHostnameOrDie() (hostname string) {
 		time.Sleep(time.Second)
 	}
 	if err != nil {
-		elog.Fatalf("Error obtaining hostname from IMDSv2: %v", err)
+		fatal("Error obtaining hostname from IMDSv2.", "error", err)
 	}
 	return
 }
@@ -166,13 +211,13 @@ func getLocalAddr() string {
 	const target = "1.1.1.1:53"
 	conn, err := net.Dial("udp", target)
 	if err != nil {
-		elog.Fatalf("Error dialing %s: %v", target, err)
+		fatal("Error dialing target.", "target", target, "error", err)
 	}
 	defer conn.Close()
 
 	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
 	if err != nil {
-		elog.Fatalf("Error extracing host: %v", err)
+		fatal("Error extracting host.", "error", err)
 	}
 	return host
 }
@@ -189,7 +234,7 @@ func getLocalEC2Hostname() (string, error) {
 		return "", err
 	}
 	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "10")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := outboundHTTPClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -206,7 +251,7 @@ func getLocalEC2Hostname() (string, error) {
 		return "", err
 	}
 	req.Header.Set("X-aws-ec2-metadata-token", token)
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = outboundHTTPClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -241,7 +286,7 @@ func getNonceFromReq(r *http.Request) (nonce, error) {
 }
 
 func makeLeaderRequest(leader *url.URL, ourNonce nonce, areWeLeader chan bool, errChan chan error) {
-	elog.Println("Attempting to talk to leader designation endpoint.")
+	elog.Debug("Attempting to talk to leader designation endpoint.")
 
 	reqURL := *leader
 	reqURL.RawQuery = fmt.Sprintf("nonce=%x", ourNonce[:])
@@ -257,3 +302,118 @@ func makeLeaderRequest(leader *url.URL, ourNonce nonce, areWeLeader chan bool, e
 	}
 	errChan <- fmt.Errorf("leader designation endpoint returned %d", resp.StatusCode)
 }
+
+// negotiateContentType takes as input the value of an HTTP Accept header and
+// the media types that we support, and returns the supported media type that
+// the client prefers, as per RFC 9110, section 12.5.1.  If the header is
+// empty, we return the first supported type.  If the client accepts none of
+// our types, we return the empty string.
+func negotiateContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	var (
+		best        string
+		bestQ       float64
+		bestSpecial int // 0 for */*, 1 for type/*, 2 for type/subtype.
+	)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			k, v, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(k) != "q" {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		for _, offer := range offers {
+			var specificity int
+			switch {
+			case mediaType == offer:
+				specificity = 2
+			case strings.HasSuffix(mediaType, "/*") &&
+				strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				specificity = 1
+			case mediaType == "*/*":
+				specificity = 0
+			default:
+				continue
+			}
+			if q > bestQ || (q == bestQ && specificity > bestSpecial) {
+				best, bestQ, bestSpecial = offer, q, specificity
+			}
+			// Wildcards match our first (i.e., default) type.
+			if specificity < 2 {
+				break
+			}
+		}
+	}
+	return best
+}
+
+// publicURL returns the URL under which clients reach the versioned
+// equivalent of the given path on our external public Web server.
+func publicURL(c *Config, path string) string {
+	host := c.FQDN
+	if c.ExtPubPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(int(c.ExtPubPort)))
+	}
+	return "https://" + host + versioned(path)
+}
+
+// normalizeFQDN validates the given fully qualified domain name against the
+// hostname rules of RFC 1123 and returns it in its ASCII form.  Unicode names
+// are converted to punycode, e.g., "bücher.example" becomes
+// "xn--bcher-kva.example", which is the form that ACME and X.509 certificates
+// expect.
+func normalizeFQDN(fqdn string) (string, error) {
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(fqdn, "."))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errBadFQDN, err)
+	}
+	if len(ascii) == 0 || len(ascii) > maxFQDNLen {
+		return "", fmt.Errorf("%w: length must be in interval [1, %d]", errBadFQDN, maxFQDNLen)
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if len(label) == 0 || len(label) > maxLabelLen {
+			return "", fmt.Errorf("%w: label length must be in interval [1, %d]", errBadFQDN, maxLabelLen)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("%w: label %q starts or ends with a hyphen", errBadFQDN, label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", fmt.Errorf("%w: label %q contains invalid character %q", errBadFQDN, label, c)
+			}
+		}
+	}
+	return ascii, nil
+}
+
+// lengthPrefixed prefixes the given message with its length as a 4-byte,
+// big-endian integer.
+func lengthPrefixed(msg []byte) []byte {
+	frame := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// chownUnprivileged hands the given file over to the given user and group,
+// which nitriding switches to when it drops its privileges.  Nitriding would
+// otherwise lose access to the files that it created as root.  A user ID of 0
+// means that nitriding keeps running as root, so we leave the file alone.
+func chownUnprivileged(path string, uid, gid uint32) error {
+	if uid == 0 {
+		return nil
+	}
+	return os.Chown(path, int(uid), int(gid))
+}
@@ -1,6 +1,20 @@
 package main
 
-import "testing"
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
 
 func TestSliceToNonce(t *testing.T) {
 	var err error
@@ -11,3 +25,155 @@ func TestSliceToNonce(t *testing.T) {
 	_, err = sliceToNonce(make([]byte, nonceLen))
 	assertEqual(t, err, nil)
 }
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []string{"text/plain", "application/cbor", "application/json"}
+	cases := map[string]string{
+		"":                                           "text/plain",
+		"*/*":                                        "text/plain",
+		"application/*":                              "application/cbor",
+		"application/json":                           "application/json",
+		"APPLICATION/CBOR":                           "application/cbor",
+		"text/html":                                  "",
+		"application/json;q=0":                       "",
+		"application/json, application/cbor":         "application/json",
+		"application/json;q=0.5, */*;q=0.1":          "application/json",
+		"text/plain;q=0.2, application/cbor":         "application/cbor",
+		"application/cbor;q=0.5, */*;q=0.5":          "application/cbor",
+		"application/json ; q=0.9, text/plain":       "text/plain",
+		"image/png, application/json;q=0.3":          "application/json",
+		"application/json;charset=utf-8;q=0.8":       "application/json",
+		"application/json;q=bogus, text/plain;q=0.5": "application/json",
+	}
+	for accept, expected := range cases {
+		if got := negotiateContentType(accept, offers); got != expected {
+			t.Errorf("Accept %q: expected %q but got %q", accept, expected, got)
+		}
+	}
+}
+
+func TestNormalizeFQDN(t *testing.T) {
+	valid := map[string]string{
+		"example.com":      "example.com",
+		"Example.COM":      "example.com",
+		"example.com.":     "example.com",
+		"localhost":        "localhost",
+		"bücher.example":   "xn--bcher-kva.example",
+		"a-b.1.example.io": "a-b.1.example.io",
+	}
+	for fqdn, expected := range valid {
+		ascii, err := normalizeFQDN(fqdn)
+		failOnErr(t, err)
+		assertEqual(t, ascii, expected)
+	}
+
+	invalid := []string{
+		"",
+		"foo..com",
+		"-foo.com",
+		"foo-.com",
+		"foo_bar.com",
+		"foo bar.com",
+		"https://example.com",
+		strings.Repeat("a", maxLabelLen+1) + ".com",
+		strings.Repeat("a.", maxFQDNLen/2) + "com",
+	}
+	for _, fqdn := range invalid {
+		if _, err := normalizeFQDN(fqdn); !errors.Is(err, errBadFQDN) {
+			t.Errorf("Expected error for FQDN %q but got %v.", fqdn, err)
+		}
+	}
+}
+
+func TestOutboundTransportUsesSyncedTime(t *testing.T) {
+	defer func(orig *timeSync) { syncedClock = orig }(syncedClock)
+	syncedClock = new(timeSync)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	tr := newOutboundTransport()
+	tr.TLSClientConfig.RootCAs = x509.NewCertPool()
+	tr.TLSClientConfig.RootCAs.AddCert(srv.Certificate())
+	get := func() error {
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	failOnErr(t, get())
+
+	// Once our synchronized time is past the test certificate's expiry, we
+	// must reject the certificate, regardless of the enclave's clock.
+	syncedClock.set(time.Until(srv.Certificate().NotAfter)+time.Hour, time.Second, "example.com:2002")
+	var certErr x509.CertificateInvalidError
+	if err := get(); !errors.As(err, &certErr) || certErr.Reason != x509.Expired {
+		t.Fatalf("Expected expired certificate but got %v.", err)
+	}
+}
+
+func TestUnauthenticatedClientReusesConns(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Clients share their transport, so subsequent requests reuse the first
+	// request's HTTP/2 connection.
+	for i := 0; i < 3; i++ {
+		resp, err := _newUnauthenticatedHTTPClient().Get(srv.URL)
+		failOnErr(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		assertEqual(t, resp.Header.Get("X-Proto"), "HTTP/2.0")
+	}
+	assertEqual(t, conns.Load(), int32(1))
+}
+
+// nobody is the user and group ID that tests hand files over to.
+const nobody = 65534
+
+// assertOwner fails the test unless the given file belongs to the given user
+// and group.  Changing a file's owner requires root, so the test is skipped
+// if we aren't root.
+func assertOwner(t *testing.T, path string, uid, gid uint32) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	failOnErr(t, err)
+	st := fi.Sys().(*syscall.Stat_t)
+	assertEqual(t, st.Uid, uid)
+	assertEqual(t, st.Gid, gid)
+}
+
+// skipUnlessRoot skips the test unless we can change files' owners.
+func skipUnlessRoot(t *testing.T) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("Changing a file's owner requires root.")
+	}
+}
+
+func TestChownUnprivileged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foo")
+	failOnErr(t, os.WriteFile(path, nil, 0o600))
+	fi, err := os.Stat(path)
+	failOnErr(t, err)
+	st := fi.Sys().(*syscall.Stat_t)
+
+	// A user ID of 0 leaves the file alone.
+	failOnErr(t, chownUnprivileged(path, 0, nobody))
+	assertOwner(t, path, st.Uid, st.Gid)
+
+	skipUnlessRoot(t)
+	failOnErr(t, chownUnprivileged(path, nobody, nobody))
+	assertOwner(t, path, nobody, nobody)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultVaultAuthPath is the path of the HashiCorp Vault auth method
+	// that verifies our attestation documents, relative to Vault's /v1/.
+	defaultVaultAuthPath = "auth/nitro-enclave/login"
+	vaultRenewPath       = "auth/token/renew-self"
+	vaultTimeout         = 30 * time.Second
+	// How long we wait before retrying a failed login or renewal.
+	vaultRetryInterval = 10 * time.Second
+	// The maximum length of responses that we accept from Vault.
+	maxVaultRespLen = 1024 * 1024
+)
+
+var (
+	errCfgBadVault    = errors.New("given config has invalid Vault address or lacks Vault role")
+	errVaultNotReady  = errors.New("not yet logged in to Vault")
+	errVaultResponse  = errors.New("Vault returned an error")
+	errVaultNoToken   = errors.New("Vault response lacks client token")
+	errVaultLoginAttn = errors.New("failed to create attestation document for Vault")
+
+	vaultHTTPClient = &http.Client{Transport: outboundTransport, Timeout: vaultTimeout}
+)
+
+// validateVault returns an error if the config's Vault address is set but
+// invalid, or lacks a role.
+func (c *Config) validateVault() error {
+	if c.VaultAddr == "" {
+		return nil
+	}
+	u, err := url.Parse(c.VaultAddr)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%w: %s", errCfgBadVault, c.VaultAddr)
+	}
+	if c.VaultRole == "" {
+		return errCfgBadVault
+	}
+	return nil
+}
+
+// vaultLoginRequest is what we send to the Vault auth method.  The auth method
+// -- a Vault plugin or a bridge that exchanges attestation documents for
+// JWTs -- verifies the attestation document, checks its nonce, and compares
+// its measurements to the given role's.
+type vaultLoginRequest struct {
+	Role                string `json:"role"`
+	AttestationDocument []byte `json:"attestation_document"`
+	Nonce               string `json:"nonce"`
+}
+
+// vaultAuthResponse is the part of Vault's response to logins and renewals
+// that we care about.
+type vaultAuthResponse struct {
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"` // In seconds.
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// vaultToken is our current Vault token.
+type vaultToken struct {
+	ClientToken string    `json:"client_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	renewable   bool
+}
+
+// vaultAuth logs in to HashiCorp Vault using our attestation documents, and
+// keeps our Vault token alive, so enclave applications can use Vault without
+// a static token in the enclave image.
+type vaultAuth struct {
+	sync.RWMutex
+	addr, authPath, role string
+	a                    attester
+	hashes               *AttestationHashes
+	token                *vaultToken // Nil until logged in.
+}
+
+// newVaultAuth returns a new vaultAuth for the given config.
+func newVaultAuth(c *Config, a attester, hashes *AttestationHashes) *vaultAuth {
+	authPath := c.VaultAuthPath
+	if authPath == "" {
+		authPath = defaultVaultAuthPath
+	}
+	return &vaultAuth{
+		addr:     strings.TrimSuffix(c.VaultAddr, "/"),
+		authPath: strings.Trim(authPath, "/"),
+		role:     c.VaultRole,
+		a:        a,
+		hashes:   hashes,
+	}
+}
+
+// call sends the given JSON-encoded input to the given Vault path, and returns
+// the auth information in Vault's response.
+func (v *vaultAuth) call(ctx context.Context, path, token string, in any) (*vaultToken, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.addr+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := vaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(newLimitReader(resp.Body, maxVaultRespLen))
+	if err != nil {
+		return nil, err
+	}
+
+	var out vaultAuthResponse
+	if err := json.Unmarshal(respBody, &out); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s: %s", errVaultResponse, resp.Status, strings.Join(out.Errors, "; "))
+	}
+	if out.Auth == nil || out.Auth.ClientToken == "" {
+		return nil, errVaultNoToken
+	}
+	registerSecret(out.Auth.ClientToken)
+	return &vaultToken{
+		ClientToken: out.Auth.ClientToken,
+		ExpiresAt:   time.Now().UTC().Add(time.Duration(out.Auth.LeaseDuration) * time.Second),
+		renewable:   out.Auth.Renewable,
+	}, nil
+}
+
+// login logs in to Vault using a fresh attestation document.
+func (v *vaultAuth) login(ctx context.Context) (*vaultToken, error) {
+	n, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := v.a.createAttstn(&clientAuxInfo{
+		clientNonce:       n,
+		attestationHashes: v.hashes.Serialize(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errVaultLoginAttn, err)
+	}
+	return v.call(ctx, v.authPath, "", &vaultLoginRequest{
+		Role:                v.role,
+		AttestationDocument: doc,
+		Nonce:               n.b64(),
+	})
+}
+
+// refresh renews our Vault token if possible, and logs in again otherwise.
+func (v *vaultAuth) refresh(ctx context.Context) error {
+	v.RLock()
+	cur := v.token
+	v.RUnlock()
+
+	var (
+		token *vaultToken
+		err   error
+	)
+	if cur != nil && cur.renewable && time.Now().Before(cur.ExpiresAt) {
+		token, err = v.call(ctx, vaultRenewPath, cur.ClientToken, struct{}{})
+		if err != nil {
+			elog.Warn("Failed to renew Vault token; logging in again.", "error", err)
+		}
+	}
+	if token == nil {
+		if token, err = v.login(ctx); err != nil {
+			return err
+		}
+		elog.Info("Logged in to Vault.", "role", v.role, "expires", token.ExpiresAt)
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	v.token = token
+	return nil
+}
+
+// nextRefresh returns how long we wait until we refresh our Vault token: after
+// two thirds of its lifetime, which leaves time for retries.
+func (v *vaultAuth) nextRefresh() time.Duration {
+	v.RLock()
+	defer v.RUnlock()
+
+	if v.token == nil {
+		return vaultRetryInterval
+	}
+	return max(time.Until(v.token.ExpiresAt)*2/3, vaultRetryInterval)
+}
+
+// get returns our current Vault token.
+func (v *vaultAuth) get() (*vaultToken, error) {
+	v.RLock()
+	defer v.RUnlock()
+
+	if v.token == nil || time.Now().After(v.token.ExpiresAt) {
+		return nil, errVaultNotReady
+	}
+	t := *v.token
+	return &t, nil
+}
+
+// wipe forgets our Vault token.
+func (v *vaultAuth) wipe() {
+	v.Lock()
+	defer v.Unlock()
+
+	v.token = nil
+}
+
+// maintainVaultToken logs in to Vault and keeps our token alive until the
+// enclave stops.
+func (e *Enclave) maintainVaultToken() {
+	defer reportPanic()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+		ctx, span := startSpan(ctx, "vault.refresh")
+		err := e.vaultAuth.refresh(ctx)
+		span.setError(err)
+		span.end()
+		cancel()
+
+		wait := e.vaultAuth.nextRefresh()
+		if err != nil {
+			elog.Warn("Failed to log in to Vault.", "addr", e.vaultAuth.addr, "error", err)
+			wait = vaultRetryInterval
+		} else {
+			e.startup.markMet(appPrereqVault)
+		}
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// vaultTokenHandler returns an HTTP handler that returns our current Vault
+// token, which the enclave application can use with any Vault client.
+//
+// This is an enclave-internal endpoint that can only be accessed by the
+// trusted enclave application.
+func vaultTokenHandler(v *vaultAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := v.get()
+		if err != nil {
+			httpError(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(token); err != nil {
+			elog.Error("Error encoding Vault token.", "error", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// mockVault returns a Web server that mimics a Vault server with an auth
+// method that accepts the attestation documents of recipientAttester.  The
+// server refuses renewals if renewable is false.
+func mockVault(t *testing.T, renewable *bool) (*httptest.Server, map[string]int) {
+	t.Helper()
+	calls := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		token := "login-token"
+		switch r.URL.Path {
+		case "/v1/" + defaultVaultAuthPath:
+			var req vaultLoginRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+				req.Role != "app" || string(req.AttestationDocument) != "attestation document" || req.Nonce == "" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+		case "/v1/" + vaultRenewPath:
+			if !*renewable || r.Header.Get("X-Vault-Token") != "login-token" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"` + token + `","lease_duration":3600,"renewable":true}}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, calls
+}
+
+func TestValidateVault(t *testing.T) {
+	for _, c := range []Config{
+		{VaultAddr: "vault.example.com", VaultRole: "app"},
+		{VaultAddr: "ftp://vault.example.com", VaultRole: "app"},
+		{VaultAddr: "https://vault.example.com"},
+	} {
+		if err := c.validateVault(); !errors.Is(err, errCfgBadVault) {
+			t.Fatalf("Expected error %v for %q but got %v.", errCfgBadVault, c.VaultAddr, err)
+		}
+	}
+	failOnErr(t, (&Config{}).validateVault())
+	failOnErr(t, (&Config{VaultAddr: "https://vault.example.com:8200", VaultRole: "app"}).validateVault())
+}
+
+func TestVaultAuth(t *testing.T) {
+	renewable := true
+	srv, calls := mockVault(t, &renewable)
+	v := newVaultAuth(&Config{VaultAddr: srv.URL + "/", VaultRole: "app"},
+		new(recipientAttester), new(AttestationHashes))
+	makeReq := makeReqToHandler(vaultTokenHandler(v))
+
+	// Until we logged in, there's no token.
+	resp := makeReq(http.MethodGet, pathVaultToken, nil)
+	assertResponse(t, resp, newErrResp(http.StatusServiceUnavailable, errVaultNotReady))
+
+	failOnErr(t, v.refresh(context.Background()))
+	assertEqual(t, calls["/v1/"+defaultVaultAuthPath], 1)
+	resp = makeReq(http.MethodGet, pathVaultToken, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var token vaultToken
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&token))
+	assertEqual(t, token.ClientToken, "login-token")
+	if d := v.nextRefresh(); d < vaultRetryInterval || d > 40*time.Minute {
+		t.Fatalf("Expected refresh after two thirds of the lease but got %s.", d)
+	}
+
+	// We renew our token if possible, and log in again otherwise.
+	failOnErr(t, v.refresh(context.Background()))
+	assertEqual(t, calls["/v1/"+vaultRenewPath], 1)
+	assertEqual(t, calls["/v1/"+defaultVaultAuthPath], 1)
+	renewable = false
+	failOnErr(t, v.refresh(context.Background()))
+	assertEqual(t, calls["/v1/"+vaultRenewPath], 2)
+	assertEqual(t, calls["/v1/"+defaultVaultAuthPath], 2)
+
+	v.wipe()
+	resp = makeReq(http.MethodGet, pathVaultToken, nil)
+	assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+
+	// Vault rejects other roles.
+	v = newVaultAuth(&Config{VaultAddr: srv.URL, VaultRole: "other"},
+		new(recipientAttester), new(AttestationHashes))
+	if err := v.refresh(context.Background()); !errors.Is(err, errVaultResponse) {
+		t.Fatalf("Expected error %v but got %v.", errVaultResponse, err)
+	}
+}
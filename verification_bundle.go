@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+const defaultBundleTimeout = 30 * time.Second
+
+var (
+	errBadBundleArgs    = errors.New("invalid verification bundle arguments")
+	errBundleMismatch   = errors.New("verification bundle doesn't match its attestation document")
+	errBundleWrongCert  = errors.New("verification bundle doesn't match the enclave's certificate")
+	errBundleWrongNonce = errors.New("verification bundle's attestation document doesn't contain our nonce")
+
+	// verifyBundleAttstn verifies the given attestation document and returns
+	// its content.  Using a variable allows us to mock the function in our
+	// unit tests.
+	verifyBundleAttstn = func(doc []byte) (*nitrite.Document, error) {
+		res, err := nitrite.Verify(doc, nitrite.VerifyOptions{CurrentTime: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+		return res.Document, nil
+	}
+)
+
+// verificationBundle contains everything that verifiers need to pin an
+// enclave, in a format that doesn't require a CBOR or COSE library: the
+// enclave image's PCR values, the fingerprint of the HTTPS certificate, a
+// fresh attestation document that proves both, and the root certificate of
+// the attestation document's certificate chain.
+type verificationBundle struct {
+	PCRs            map[uint]string `json:"pcrs,omitempty"`
+	CertFingerprint string          `json:"cert_fingerprint"`
+	Nonce           string          `json:"nonce"`
+	Document        string          `json:"attestation_document"`
+	RootCA          string          `json:"root_ca"`
+}
+
+// verificationBundleHandler returns an HTTP handler that returns a
+// verification bundle whose attestation document contains the client's nonce
+// and the given public key.
+func verificationBundleHandler(e *Enclave, publicKey []byte) http.HandlerFunc {
+	getPCRs := cachedPCRs("verification bundle")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if e.cfg.UseProfiling {
+			httpError(w, r, errProfilingSet, http.StatusServiceUnavailable)
+			return
+		}
+		n, err := getNonceFromReq(r)
+		if err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		rawDoc, err := e.attester.createAttstn(&clientAuxInfo{
+			clientNonce:       n,
+			attestationHashes: e.hashes.Serialize(),
+			publicKey:         publicKey,
+		})
+		if err != nil {
+			ops.attestationErrors.Add(1)
+			httpError(w, r, errFailedAttestation, http.StatusInternalServerError)
+			return
+		}
+		ops.attestations.Add(1)
+
+		fingerprint := e.hashes.getTLSKeyHash()
+		bundle := verificationBundle{
+			CertFingerprint: hex.EncodeToString(fingerprint[:]),
+			Nonce:           hex.EncodeToString(n[:]),
+			Document:        base64.StdEncoding.EncodeToString(rawDoc),
+			RootCA:          nitrite.DefaultCARoots,
+		}
+		if pcrs := getPCRs(); len(pcrs) > 0 {
+			bundle.PCRs = make(map[uint]string, len(imagePCRs))
+			for _, pcr := range imagePCRs {
+				if value, ok := pcrs[pcr]; ok {
+					bundle.PCRs[pcr] = hex.EncodeToString(value)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(&bundle); err != nil {
+			elog.Error("Error encoding verification bundle.", "error", err)
+		}
+	}
+}
+
+// verify returns an error if the bundle's attestation document is invalid,
+// doesn't contain the given nonce, or contradicts the rest of the bundle, or
+// if the bundle's certificate fingerprint isn't the given fingerprint.
+func (b *verificationBundle) verify(n nonce, certFingerprint [sha256.Size]byte) error {
+	rawDoc, err := base64.StdEncoding.DecodeString(b.Document)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBundleMismatch, err)
+	}
+	doc, err := verifyBundleAttstn(rawDoc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(doc.Nonce, n[:]) || b.Nonce != hex.EncodeToString(n[:]) {
+		return errBundleWrongNonce
+	}
+	for pcr, value := range b.PCRs {
+		if hex.EncodeToString(doc.PCRs[pcr]) != value {
+			return fmt.Errorf("%w: PCR%d", errBundleMismatch, pcr)
+		}
+	}
+	// The user data begins with the multihash of the certificate
+	// fingerprint.
+	if !bytes.HasPrefix(doc.UserData, append(bytes.Clone(hashPrefix), certFingerprint[:]...)) {
+		return fmt.Errorf("%w: certificate fingerprint", errBundleMismatch)
+	}
+	if b.CertFingerprint != hex.EncodeToString(certFingerprint[:]) {
+		return errBundleWrongCert
+	}
+	return nil
+}
+
+// runVerificationBundle implements "nitriding verification-bundle", which
+// fetches a verification bundle with a fresh nonce from a running enclave,
+// verifies it, and writes it to the given writer, or the file given via
+// -out.  Verifiers without Go or CBOR libraries can pin the enclave based on
+// the bundle, e.g., in curl-based scripts or browser extensions.
+func runVerificationBundle(args []string, out io.Writer) error {
+	var outFile string
+	var timeout time.Duration
+	fs := flag.NewFlagSet("verification-bundle", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: nitriding verification-bundle [flags] <enclave URL, e.g., https://example.com>")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&outFile, "out", "",
+		"File to write the verification bundle to.  Defaults to standard output.")
+	fs.DurationVar(&timeout, "timeout", defaultBundleTimeout,
+		"How long fetching the verification bundle may take.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("%w: expected one enclave URL", errBadBundleArgs)
+	}
+	target, err := url.Parse(fs.Arg(0))
+	if err != nil || target.Scheme != "https" || target.Host == "" {
+		return fmt.Errorf("%w: %q is no HTTPS URL", errBadBundleArgs, fs.Arg(0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	bundle, err := fetchVerificationBundle(ctx, target)
+	if err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+	if outFile != "" {
+		return os.WriteFile(outFile, raw, 0o644)
+	}
+	_, err = out.Write(raw)
+	return err
+}
+
+// fetchVerificationBundle fetches a verification bundle from the enclave at
+// the given URL, and verifies that the bundle matches the certificate that
+// the enclave presented.  Enclaves may use self-signed certificates, so we
+// trust the certificate because the attestation document binds it.
+func fetchVerificationBundle(ctx context.Context, target *url.URL) (*verificationBundle, error) {
+	n, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	u := *target
+	u.Path = strings.TrimSuffix(u.Path, "/") + pathBundle
+	u.RawQuery = url.Values{"nonce": {hex.EncodeToString(n[:])}}.Encode()
+
+	t := newOutboundTransport()
+	t.TLSClientConfig.InsecureSkipVerify = true
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: t}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch verification bundle: got status code %d", resp.StatusCode)
+	}
+	var bundle verificationBundle
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		return nil, err
+	}
+
+	certFingerprint := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+	if err := bundle.verify(n, certFingerprint); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hf/nitrite"
+)
+
+func TestVerificationBundleHandler(t *testing.T) {
+	e := createEnclave(&defaultCfg)
+	makeReq := makeReqToSrv(e.extPubSrv)
+
+	assertResponse(t,
+		makeReq(http.MethodGet, pathBundle, nil),
+		newErrResp(http.StatusBadRequest, errNoNonce),
+	)
+
+	n := "0123456789abcdef0123456789abcdef01234567"
+	resp := makeReq(http.MethodGet, pathBundle+"?nonce="+n, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var b verificationBundle
+	failOnErr(t, json.NewDecoder(resp.Body).Decode(&b))
+	assertEqual(t, b.Nonce, n)
+	assertEqual(t, b.CertFingerprint, hex.EncodeToString(e.hashes.tlsKeyHash[:]))
+	assertEqual(t, b.RootCA, nitrite.DefaultCARoots)
+	assertEqual(t, b.Document != "", true)
+}
+
+func TestFetchVerificationBundle(t *testing.T) {
+	var (
+		e         = createEnclave(&defaultCfg)
+		h         = verificationBundleHandler(e, nil)
+		lastNonce atomic.Pointer[[]byte]
+		tamper    func(*nitrite.Document)
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := hex.DecodeString(r.URL.Query().Get("nonce"))
+		lastNonce.Store(&n)
+		h(w, r)
+	}))
+	defer srv.Close()
+	e.hashes.tlsKeyHash = sha256.Sum256(srv.Certificate().Raw)
+
+	origVerify := verifyBundleAttstn
+	defer func() { verifyBundleAttstn = origVerify }()
+	verifyBundleAttstn = func([]byte) (*nitrite.Document, error) {
+		doc := &nitrite.Document{Nonce: *lastNonce.Load(), UserData: e.hashes.Serialize()}
+		if tamper != nil {
+			tamper(doc)
+		}
+		return doc, nil
+	}
+	target, _ := url.Parse(srv.URL)
+
+	// Write the bundle to a file.
+	out := filepath.Join(t.TempDir(), "bundle.json")
+	failOnErr(t, runVerificationBundle([]string{"-out", out, srv.URL}, new(bytes.Buffer)))
+	raw, err := os.ReadFile(out)
+	failOnErr(t, err)
+	var b verificationBundle
+	failOnErr(t, json.Unmarshal(raw, &b))
+	assertEqual(t, b.CertFingerprint, hex.EncodeToString(e.hashes.tlsKeyHash[:]))
+
+	// Reject bundles whose attestation document contradicts the connection.
+	for _, c := range []struct {
+		tamper func(*nitrite.Document)
+		err    error
+	}{
+		{func(d *nitrite.Document) { d.Nonce = make([]byte, nonceLen) }, errBundleWrongNonce},
+		{func(d *nitrite.Document) { d.UserData = make([]byte, len(d.UserData)) }, errBundleMismatch},
+	} {
+		tamper = c.tamper
+		if _, err := fetchVerificationBundle(context.Background(), target); !errors.Is(err, c.err) {
+			t.Fatalf("Expected error %v but got %v.", c.err, err)
+		}
+	}
+
+	for _, args := range [][]string{{}, {"http://example.com"}, {srv.URL, srv.URL}} {
+		if err := runVerificationBundle(args, new(bytes.Buffer)); !errors.Is(err, errBadBundleArgs) {
+			t.Fatalf("Expected error %v but got %v.", errBadBundleArgs, err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// We implement the server side of the verifiable oblivious pseudorandom
+// function (VOPRF) with the cipher suite P384-SHA384, which Privacy Pass uses
+// for privately verifiable tokens.  See RFC 9497:
+// https://www.rfc-editor.org/rfc/rfc9497.html
+// Hashing to the curve follows the suite P384_XMD:SHA-384_SSWU_RO_ of RFC
+// 9380: https://www.rfc-editor.org/rfc/rfc9380.html
+const (
+	voprfModeVOPRF = 0x01
+	// The lengths of serialized elements, scalars, and hash outputs.
+	voprfElementLen = 49
+	voprfScalarLen  = 48
+	voprfHashLen    = sha512.Size384
+	// The length of the uniform bytes that we reduce to a field element or a
+	// scalar: ceil((ceil(log2(p)) + k) / 8) for the security level k = 192.
+	voprfExpandLen = 72
+)
+
+var (
+	errVOPRFElement = errors.New("invalid element")
+	errVOPRFExpand  = errors.New("requested too many bytes or DST too long")
+
+	voprfCurve   = elliptic.P384()
+	voprfContext = append([]byte("OPRFV1-"), append([]byte{voprfModeVOPRF}, "-P384-SHA384"...)...)
+	// The curve's coefficient A = -3 and the SSWU parameter Z = -12.
+	voprfA = new(big.Int).Sub(voprfCurve.Params().P, big.NewInt(3))
+	voprfZ = new(big.Int).Sub(voprfCurve.Params().P, big.NewInt(12))
+)
+
+// voprfPoint is an affine point on P-384.
+type voprfPoint struct {
+	x, y *big.Int
+}
+
+// newVOPRFKey returns a random, non-zero scalar that serves as private key.
+func newVOPRFKey() (*big.Int, error) {
+	k, err := rand.Int(rand.Reader, new(big.Int).Sub(voprfCurve.Params().N, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	return k.Add(k, big.NewInt(1)), nil
+}
+
+// voprfBaseMult returns k*G.
+func voprfBaseMult(k *big.Int) *voprfPoint {
+	x, y := voprfCurve.ScalarBaseMult(k.FillBytes(make([]byte, voprfScalarLen)))
+	return &voprfPoint{x, y}
+}
+
+// mult returns k*p.
+func (p *voprfPoint) mult(k *big.Int) *voprfPoint {
+	x, y := voprfCurve.ScalarMult(p.x, p.y, k.FillBytes(make([]byte, voprfScalarLen)))
+	return &voprfPoint{x, y}
+}
+
+// add returns p+q.
+func (p *voprfPoint) add(q *voprfPoint) *voprfPoint {
+	x, y := voprfCurve.Add(p.x, p.y, q.x, q.y)
+	return &voprfPoint{x, y}
+}
+
+// serialize returns the compressed encoding of the point.
+func (p *voprfPoint) serialize() []byte {
+	return elliptic.MarshalCompressed(voprfCurve, p.x, p.y)
+}
+
+// deserializeVOPRFElement decodes the given compressed point.  Compressed
+// encodings cannot represent the identity, so we reject it implicitly.
+func deserializeVOPRFElement(b []byte) (*voprfPoint, error) {
+	if len(b) != voprfElementLen {
+		return nil, errVOPRFElement
+	}
+	x, y := elliptic.UnmarshalCompressed(voprfCurve, b)
+	if x == nil {
+		return nil, errVOPRFElement
+	}
+	return &voprfPoint{x, y}, nil
+}
+
+// serializeScalar returns the fixed-length big-endian encoding of k.
+func serializeScalar(k *big.Int) []byte {
+	return k.FillBytes(make([]byte, voprfScalarLen))
+}
+
+// voprfDST returns the domain separation tag with the given prefix.
+func voprfDST(prefix string) []byte {
+	return append([]byte(prefix), voprfContext...)
+}
+
+// lenPrefixed returns the concatenation of the given strings, each preceded
+// by its two-byte length, as VOPRF transcripts use them.
+func lenPrefixed(b ...[]byte) []byte {
+	var out []byte
+	for _, s := range b {
+		out = binary.BigEndian.AppendUint16(out, uint16(len(s)))
+		out = append(out, s...)
+	}
+	return out
+}
+
+// expandMessageXMD implements expand_message_xmd with SHA-384.
+func expandMessageXMD(msg, dst []byte, n int) ([]byte, error) {
+	const blockLen = 128
+	ell := (n + voprfHashLen - 1) / voprfHashLen
+	if ell > 255 || n > 65535 || len(dst) > 255 {
+		return nil, errVOPRFExpand
+	}
+	dstPrime := append(append([]byte{}, dst...), byte(len(dst)))
+
+	h := sha512.New384()
+	h.Write(make([]byte, blockLen))
+	h.Write(msg)
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	h.Write([]byte{0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	var out, prev []byte
+	for i := 1; i <= ell; i++ {
+		block := append([]byte{}, b0...)
+		for j := range prev {
+			block[j] ^= prev[j]
+		}
+		h.Reset()
+		h.Write(block)
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		prev = h.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:n], nil
+}
+
+// hashToField hashes the given message to count elements of the field with
+// the given modulus.
+func hashToField(msg, dst []byte, modulus *big.Int, count int) ([]*big.Int, error) {
+	uniform, err := expandMessageXMD(msg, dst, count*voprfExpandLen)
+	if err != nil {
+		return nil, err
+	}
+	elems := make([]*big.Int, count)
+	for i := range elems {
+		e := new(big.Int).SetBytes(uniform[i*voprfExpandLen : (i+1)*voprfExpandLen])
+		elems[i] = e.Mod(e, modulus)
+	}
+	return elems, nil
+}
+
+// mapToCurveSSWU maps the given field element to P-384 using the simplified
+// Shallue-van de Woestijne-Ulas method.
+func mapToCurveSSWU(u *big.Int) *voprfPoint {
+	p, b := voprfCurve.Params().P, voprfCurve.Params().B
+	mod := func(x *big.Int) *big.Int { return x.Mod(x, p) }
+	gx := func(x *big.Int) *big.Int {
+		x3 := new(big.Int).Exp(x, big.NewInt(3), p)
+		ax := new(big.Int).Mul(voprfA, x)
+		return mod(x3.Add(x3, ax).Add(x3, b))
+	}
+
+	// tv1 = inv0(Z^2 * u^4 + Z * u^2)
+	u2 := mod(new(big.Int).Mul(u, u))
+	zu2 := mod(new(big.Int).Mul(voprfZ, u2))
+	tv1 := mod(new(big.Int).Mul(zu2, zu2))
+	tv1 = mod(tv1.Add(tv1, zu2))
+	var x1 *big.Int
+	if tv1.Sign() == 0 {
+		// x1 = B / (Z * A)
+		x1 = new(big.Int).ModInverse(mod(new(big.Int).Mul(voprfZ, voprfA)), p)
+		x1 = mod(x1.Mul(x1, b))
+	} else {
+		// x1 = (-B / A) * (1 + tv1)
+		tv1.ModInverse(tv1, p)
+		x1 = new(big.Int).ModInverse(voprfA, p)
+		x1 = mod(x1.Mul(x1, new(big.Int).Sub(p, b)))
+		x1 = mod(x1.Mul(x1, tv1.Add(tv1, big.NewInt(1))))
+	}
+	// P-384's p is 3 mod 4, so square roots are x^((p+1)/4).
+	sqrtExp := new(big.Int).Rsh(new(big.Int).Add(p, big.NewInt(1)), 2)
+	x, y2 := x1, gx(x1)
+	y := new(big.Int).Exp(y2, sqrtExp, p)
+	if mod(new(big.Int).Mul(y, y)).Cmp(y2) != 0 {
+		x = mod(new(big.Int).Mul(zu2, x1))
+		y = new(big.Int).Exp(gx(x), sqrtExp, p)
+	}
+	if u.Bit(0) != y.Bit(0) {
+		y.Sub(p, y)
+	}
+	return &voprfPoint{x, y}
+}
+
+// hashToGroup hashes the given input to a point on P-384.
+func hashToGroup(input []byte) (*voprfPoint, error) {
+	u, err := hashToField(input, voprfDST("HashToGroup-"), voprfCurve.Params().P, 2)
+	if err != nil {
+		return nil, err
+	}
+	// P-384's cofactor is 1, so there's no cofactor to clear.
+	return mapToCurveSSWU(u[0]).add(mapToCurveSSWU(u[1])), nil
+}
+
+// hashToScalar hashes the given input to a scalar.
+func hashToScalar(input []byte) (*big.Int, error) {
+	s, err := hashToField(input, voprfDST("HashToScalar-"), voprfCurve.Params().N, 1)
+	if err != nil {
+		return nil, err
+	}
+	return s[0], nil
+}
+
+// voprfComposite returns the scalar that the DLEQ proof for the given public
+// key, blinded element, and evaluated element uses to compose its elements.
+// We only ever evaluate one element at a time, so there's a single scalar.
+func voprfComposite(pub, blinded, evaluated *voprfPoint) (*big.Int, error) {
+	seed := sha512.Sum384(lenPrefixed(pub.serialize(), voprfDST("Seed-")))
+	transcript := lenPrefixed(seed[:])
+	transcript = binary.BigEndian.AppendUint16(transcript, 0)
+	transcript = append(transcript, lenPrefixed(blinded.serialize(), evaluated.serialize())...)
+	return hashToScalar(append(transcript, "Composite"...))
+}
+
+// voprfChallenge returns the challenge of a DLEQ proof.
+func voprfChallenge(pub, m, z, t2, t3 *voprfPoint) (*big.Int, error) {
+	transcript := lenPrefixed(pub.serialize(), m.serialize(), z.serialize(), t2.serialize(), t3.serialize())
+	return hashToScalar(append(transcript, "Challenge"...))
+}
+
+// voprfBlindEvaluate evaluates the given blinded element with the given
+// private key, and returns the serialized evaluated element and a proof that
+// we used the private key that belongs to our public key.
+func voprfBlindEvaluate(key *big.Int, blinded *voprfPoint) ([]byte, []byte, error) {
+	n := voprfCurve.Params().N
+	pub := voprfBaseMult(key)
+	evaluated := blinded.mult(key)
+
+	// We prove that log_G(pub) equals log_M(Z) for the composite elements
+	// M and Z.
+	d, err := voprfComposite(pub, blinded, evaluated)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := blinded.mult(d)
+	z := m.mult(key)
+	r, err := newVOPRFKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := voprfChallenge(pub, m, z, voprfBaseMult(r), m.mult(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	// s = r - c * key
+	s := new(big.Int).Mul(c, key)
+	s.Sub(r, s).Mod(s, n)
+	return evaluated.serialize(), append(serializeScalar(c), serializeScalar(s)...), nil
+}
+
+// voprfEvaluate computes the VOPRF's output for the given input directly,
+// which is how we verify the outputs that clients finalized.
+func voprfEvaluate(key *big.Int, input []byte) ([]byte, error) {
+	p, err := hashToGroup(input)
+	if err != nil {
+		return nil, err
+	}
+	return voprfFinalize(input, p.mult(key)), nil
+}
+
+// voprfFinalize returns the VOPRF's output for the given input and
+// unblinded element.
+func voprfFinalize(input []byte, unblinded *voprfPoint) []byte {
+	out := sha512.Sum384(append(lenPrefixed(input, unblinded.serialize()), "Finalize"...))
+	return out[:]
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// voprfClient blinds inputs and finalizes evaluations the way VOPRF clients
+// do.
+type voprfClient struct {
+	t       *testing.T
+	input   []byte
+	blind   *big.Int
+	blinded *voprfPoint
+}
+
+func newVOPRFClient(t *testing.T, input []byte) *voprfClient {
+	t.Helper()
+	blind, err := newVOPRFKey()
+	failOnErr(t, err)
+	p, err := hashToGroup(input)
+	failOnErr(t, err)
+	return &voprfClient{t: t, input: input, blind: blind, blinded: p.mult(blind)}
+}
+
+// finalize verifies the given proof and returns the VOPRF's output.
+func (c *voprfClient) finalize(pub, evaluated, proof []byte) ([]byte, error) {
+	pk, err := deserializeVOPRFElement(pub)
+	failOnErr(c.t, err)
+	d, err := deserializeVOPRFElement(evaluated)
+	if err != nil {
+		return nil, err
+	}
+	n := voprfCurve.Params().N
+	challenge := new(big.Int).SetBytes(proof[:voprfScalarLen])
+	s := new(big.Int).SetBytes(proof[voprfScalarLen:])
+
+	composite, err := voprfComposite(pk, c.blinded, d)
+	failOnErr(c.t, err)
+	m, z := c.blinded.mult(composite), d.mult(composite)
+	t2 := voprfBaseMult(s).add(pk.mult(challenge))
+	t3 := m.mult(s).add(z.mult(challenge))
+	expected, err := voprfChallenge(pk, m, z, t2, t3)
+	failOnErr(c.t, err)
+	if expected.Cmp(challenge) != 0 {
+		return nil, errors.New("invalid proof")
+	}
+	return voprfFinalize(c.input, d.mult(new(big.Int).ModInverse(c.blind, n))), nil
+}
+
+func TestHashToCurve(t *testing.T) {
+	// RFC 9380, Appendix J.3.1, for the empty message.
+	dst := []byte("QUUX-V01-CS02-with-P384_XMD:SHA-384_SSWU_RO_")
+	u, err := hashToField(nil, dst, voprfCurve.Params().P, 2)
+	failOnErr(t, err)
+	p := mapToCurveSSWU(u[0]).add(mapToCurveSSWU(u[1]))
+	assertEqual(t, hex.EncodeToString(p.x.Bytes()),
+		"eb9fe1b4f4e14e7140803c1d99d0a93cd823d2b024040f9c067a8eca1f5a2eeac9ad604973527a356f3fa3aeff0e4d83")
+	assertEqual(t, hex.EncodeToString(p.y.Bytes()),
+		"0c21708cff382b7f4643c07b105c2eaec2cead93a917d825601e63c8f21f6abd9abc22c93c2bed6f235954b25048bb1a")
+
+	_, err = expandMessageXMD(nil, dst, 256*voprfHashLen)
+	assertEqual(t, errors.Is(err, errVOPRFExpand), true)
+}
+
+func TestVOPRF(t *testing.T) {
+	key, err := newVOPRFKey()
+	failOnErr(t, err)
+	pub := voprfBaseMult(key).serialize()
+	input := []byte("foo")
+
+	c := newVOPRFClient(t, input)
+	evaluated, proof, err := voprfBlindEvaluate(key, c.blinded)
+	failOnErr(t, err)
+	out, err := c.finalize(pub, evaluated, proof)
+	failOnErr(t, err)
+	// The client's output must match what we compute without blinding.
+	expected, err := voprfEvaluate(key, input)
+	failOnErr(t, err)
+	assertEqual(t, bytes.Equal(out, expected), true)
+
+	// A proof must not verify for another key.
+	otherKey, err := newVOPRFKey()
+	failOnErr(t, err)
+	_, err = c.finalize(voprfBaseMult(otherKey).serialize(), evaluated, proof)
+	assertEqual(t, err != nil, true)
+
+	_, err = deserializeVOPRFElement(make([]byte, voprfElementLen))
+	assertEqual(t, errors.Is(err, errVOPRFElement), true)
+}
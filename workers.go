@@ -33,8 +33,8 @@ func (w *workerManager) start(stop chan struct{}) {
 		set   = make(workers)
 		timer = time.NewTicker(w.timeout)
 	)
-	elog.Println("Starting worker event loop.")
-	defer elog.Println("Stopping worker event loop.")
+	elog.Info("Starting worker event loop.")
+	defer elog.Info("Stopping worker event loop.")
 
 	for {
 		select {
@@ -46,19 +46,17 @@ func (w *workerManager) start(stop chan struct{}) {
 			for worker, lastSeen := range set {
 				if now.Sub(lastSeen) > w.timeout {
 					delete(set, worker)
-					elog.Printf("Pruned %s from worker set.", worker.Host)
+					elog.Info("Pruned worker from worker set.", "worker", worker.Host)
 				}
 			}
 
 		case worker := <-w.reg:
 			set[*worker] = time.Now()
-			elog.Printf("(Re-)registered worker %s; %d worker(s) now registered.",
-				worker.Host, len(set))
+			elog.Info("(Re-)registered worker.", "worker", worker.Host, "workers", len(set))
 
 		case worker := <-w.unreg:
 			delete(set, *worker)
-			elog.Printf("Unregistered worker %s; %d worker(s) left.",
-				worker.Host, len(set))
+			elog.Info("Unregistered worker.", "worker", worker.Host, "workers", len(set))
 
 		case f := <-w.forAllFunc:
 			w.runForAll(f, set)